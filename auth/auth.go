@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
@@ -8,6 +9,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sync"
 
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/crypto/nacl/secretbox"
@@ -110,20 +112,20 @@ func EncryptAndSave(auth *CachedAuth, username string, secretKey *[32]byte) erro
 	return saveAuths(auths)
 }
 
-func authenticate(c *protonmail.Client, cachedAuth *CachedAuth, username string) (openpgp.EntityList, error) {
-	auth, err := c.AuthRefresh(&cachedAuth.Auth)
+func authenticate(ctx context.Context, c *protonmail.Client, cachedAuth *CachedAuth, username string) (openpgp.EntityList, error) {
+	auth, err := c.AuthRefresh(ctx, &cachedAuth.Auth)
 	if apiErr, ok := err.(*protonmail.APIError); ok && apiErr.Code == 10013 {
 		// Invalid refresh token, re-authenticate
-		authInfo, err := c.AuthInfo(username)
+		authInfo, err := c.AuthInfo(ctx, username)
 		if err != nil {
 			return nil, fmt.Errorf("cannot re-authenticate: failed to get auth info: %v", err)
 		}
 
-		if cachedAuth.TwoFactor.Enabled == 1 {
+		if cachedAuth.TwoFactor.Enabled != 0 {
 			return nil, fmt.Errorf("cannot re-authenticate: two factor authentication enabled, please login manually")
 		}
 
-		auth, err = c.Auth(username, cachedAuth.LoginPassword, authInfo)
+		auth, err = c.Auth(ctx, username, cachedAuth.LoginPassword, authInfo)
 		if err != nil {
 			return nil, fmt.Errorf("cannot re-authenticate: %v", err)
 		}
@@ -132,7 +134,54 @@ func authenticate(c *protonmail.Client, cachedAuth *CachedAuth, username string)
 	}
 	cachedAuth.Auth = *auth
 
-	return c.Unlock(auth, cachedAuth.KeySalts, cachedAuth.MailboxPassword)
+	return c.Unlock(ctx, auth, cachedAuth.KeySalts, cachedAuth.MailboxPassword)
+}
+
+// isCurrentSecretKey checks whether the stored auth of a user is encrypted
+// with secretKey.
+func isCurrentSecretKey(username string, secretKey *[32]byte) (bool, error) {
+	auths, err := readCachedAuths()
+	if err != nil {
+		return false, err
+	}
+	encrypted, ok := auths[username]
+	if !ok {
+		return false, nil
+	}
+	_, err = decrypt(encrypted, secretKey)
+	return err == nil, nil
+}
+
+// CheckPassword checks that password is a bridge password of a user, either
+// the main one or an application password, without logging in.
+// ErrUnauthorized is returned if it isn't.
+func CheckPassword(username, password string) error {
+	_, _, err := unlockAuth(username, password)
+	if err == errNoAuth {
+		return ErrUnauthorized
+	}
+	return err
+}
+
+// UpdateCachedAuth decrypts the auth stored for a user with a bridge password,
+// calls fn to modify it and saves it, e.g. after the passwords have been
+// changed.
+func UpdateCachedAuth(username, password string, fn func(cachedAuth *CachedAuth) error) error {
+	secretKey, decrypted, err := unlockAuth(username, password)
+	if err == errNoAuth {
+		return ErrUnauthorized
+	} else if err != nil {
+		return err
+	}
+
+	var cachedAuth CachedAuth
+	if err := json.Unmarshal(decrypted, &cachedAuth); err != nil {
+		return err
+	}
+	if err := fn(&cachedAuth); err != nil {
+		return err
+	}
+	return EncryptAndSave(&cachedAuth, username, secretKey)
 }
 
 func ListUsernames() ([]string, error) {
@@ -159,6 +208,10 @@ func GeneratePassword() (secretKey *[32]byte, password string, err error) {
 }
 
 type session struct {
+	// Held while the user is logged in, so that logins of other users aren't
+	// blocked
+	locker sync.Mutex
+
 	hashedSecretKey []byte
 	c               *protonmail.Client
 	privateKeys     openpgp.EntityList
@@ -166,61 +219,80 @@ type session struct {
 
 var ErrUnauthorized = errors.New("Invalid username or password")
 
+// Manager keeps the sessions of all users. It's safe for concurrent use:
+// several users can be logged in at once.
 type Manager struct {
-	newClient func() *protonmail.Client
-	sessions  map[string]*session
+	newClient func(username string) (*protonmail.Client, error)
+
+	locker   sync.Mutex // protects sessions
+	sessions map[string]*session
 }
 
-func (m *Manager) Auth(username, password string) (*protonmail.Client, openpgp.EntityList, error) {
-	var secretKey [32]byte
-	passwordBytes, err := base64.StdEncoding.DecodeString(password)
-	if err != nil || len(passwordBytes) != len(secretKey) {
-		return nil, nil, ErrUnauthorized
-	}
-	copy(secretKey[:], passwordBytes)
+// session returns the session of a user, creating an empty one if needed.
+func (m *Manager) session(username string) *session {
+	m.locker.Lock()
+	defer m.locker.Unlock()
 
 	s, ok := m.sessions[username]
-	if ok {
-		err := bcrypt.CompareHashAndPassword(s.hashedSecretKey, secretKey[:])
-		if err != nil {
-			return nil, nil, ErrUnauthorized
-		}
-	} else {
-		auths, err := readCachedAuths()
-		if err != nil && !os.IsNotExist(err) {
-			return nil, nil, err
-		}
+	if !ok {
+		s = new(session)
+		m.sessions[username] = s
+	}
+	return s
+}
 
-		encrypted, ok := auths[username]
-		if !ok {
-			return nil, nil, ErrUnauthorized
-		}
+func (m *Manager) Auth(ctx context.Context, username, password string) (*protonmail.Client, openpgp.EntityList, error) {
+	// Always check the password against the stored auth, which may have been
+	// encrypted with a new bridge password since the session was opened.
+	// Sessions are keyed by the main secret key, so that clients using
+	// different application passwords share them.
+	secretKey, decrypted, err := unlockAuth(username, password)
+	if err == errNoAuth {
+		m.locker.Lock()
+		delete(m.sessions, username)
+		m.locker.Unlock()
+		return nil, nil, ErrUnauthorized
+	} else if err != nil {
+		return nil, nil, err
+	}
 
-		decrypted, err := decrypt(encrypted, &secretKey)
-		if err != nil {
-			return nil, nil, ErrUnauthorized
-		}
+	s := m.session(username)
+	s.locker.Lock()
+	defer s.locker.Unlock()
 
+	// If the bridge password has changed, start a new session
+	if s.c == nil || bcrypt.CompareHashAndPassword(s.hashedSecretKey, secretKey[:]) != nil {
 		var cachedAuth CachedAuth
 		if err := json.Unmarshal(decrypted, &cachedAuth); err != nil {
 			return nil, nil, err
 		}
 
-		c := m.newClient()
-		c.ReAuth = func() error {
-			if _, err := authenticate(c, &cachedAuth, username); err != nil {
+		c, err := m.newClient(username)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.ReAuth = func(ctx context.Context) error {
+			// Don't overwrite the stored auth if it's been encrypted with a
+			// new bridge password
+			if ok, err := isCurrentSecretKey(username, secretKey); err != nil {
 				return err
+			} else if !ok {
+				return errors.New("cannot re-authenticate: bridge password has changed, please login again")
 			}
-			return EncryptAndSave(&cachedAuth, username, &secretKey)
+
+			if _, err := authenticate(ctx, c, &cachedAuth, username); err != nil {
+				return err
+			}
+			return EncryptAndSave(&cachedAuth, username, secretKey)
 		}
 
 		// authenticate updates cachedAuth with the new refresh token
-		privateKeys, err := authenticate(c, &cachedAuth, username)
+		privateKeys, err := authenticate(ctx, c, &cachedAuth, username)
 		if err != nil {
 			return nil, nil, err
 		}
 
-		if err := EncryptAndSave(&cachedAuth, username, &secretKey); err != nil {
+		if err := EncryptAndSave(&cachedAuth, username, secretKey); err != nil {
 			return nil, nil, err
 		}
 
@@ -229,18 +301,15 @@ func (m *Manager) Auth(username, password string) (*protonmail.Client, openpgp.E
 			return nil, nil, err
 		}
 
-		s = &session{
-			c:               c,
-			privateKeys:     privateKeys,
-			hashedSecretKey: hashed,
-		}
-		m.sessions[username] = s
+		s.c = c
+		s.privateKeys = privateKeys
+		s.hashedSecretKey = hashed
 	}
 
 	return s.c, s.privateKeys, nil
 }
 
-func NewManager(newClient func() *protonmail.Client) *Manager {
+func NewManager(newClient func(username string) (*protonmail.Client, error)) *Manager {
 	return &Manager{
 		newClient: newClient,
 		sessions:  make(map[string]*session),
@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/emersion/hydroxide/config"
+)
+
+// AppPassword is a named bridge password given to a single application. It
+// can be revoked without changing the passwords of other applications.
+type AppPassword struct {
+	Name    string
+	Created time.Time
+}
+
+// appPassword is a stored application password: the account's main secret
+// key, encrypted with the application's secret key.
+type appPassword struct {
+	Key     string
+	Created time.Time
+}
+
+// ErrAppPasswordNotFound is returned by RevokeAppPassword if the user has no
+// application password with the given name.
+var ErrAppPasswordNotFound = errors.New("no such application password")
+
+const appPasswordsFilename = "app-passwords.json"
+
+func readAppPasswords() (map[string]map[string]*appPassword, error) {
+	passwords := make(map[string]map[string]*appPassword)
+	err := config.ReadJSON(appPasswordsFilename, &passwords)
+	return passwords, err
+}
+
+// updateAppPasswords calls f to modify the stored application passwords.
+func updateAppPasswords(f func(passwords map[string]map[string]*appPassword) error) error {
+	passwords := make(map[string]map[string]*appPassword)
+	return config.UpdateJSON(appPasswordsFilename, &passwords, func() error {
+		return f(passwords)
+	})
+}
+
+func parsePassword(password string) (*[32]byte, error) {
+	var secretKey [32]byte
+	passwordBytes, err := base64.StdEncoding.DecodeString(password)
+	if err != nil || len(passwordBytes) != len(secretKey) {
+		return nil, ErrUnauthorized
+	}
+	copy(secretKey[:], passwordBytes)
+	return &secretKey, nil
+}
+
+// errNoAuth is returned by unlockAuth if the user isn't logged in.
+var errNoAuth = errors.New("no stored auth for user")
+
+// unlockAuth decrypts the stored auth of a user with a bridge password, either
+// the main one or an application password. The main secret key is returned
+// along with the decrypted auth.
+func unlockAuth(username, password string) (*[32]byte, []byte, error) {
+	secretKey, err := parsePassword(password)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	auths, err := readCachedAuths()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	encrypted, ok := auths[username]
+	if !ok {
+		return nil, nil, errNoAuth
+	}
+
+	if decrypted, err := decrypt(encrypted, secretKey); err == nil {
+		return secretKey, decrypted, nil
+	}
+
+	passwords, err := readAppPasswords()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, p := range passwords[username] {
+		key, err := decrypt(p.Key, secretKey)
+		if err != nil || len(key) != len(secretKey) {
+			continue
+		}
+		var mainKey [32]byte
+		copy(mainKey[:], key)
+		// Application passwords created before the account was logged in
+		// again don't unlock the new auth
+		if decrypted, err := decrypt(encrypted, &mainKey); err == nil {
+			return &mainKey, decrypted, nil
+		}
+	}
+
+	return nil, nil, ErrUnauthorized
+}
+
+// ListAppPasswords returns the application passwords of a user, sorted by
+// name.
+func ListAppPasswords(username string) ([]AppPassword, error) {
+	passwords, err := readAppPasswords()
+	if err != nil {
+		return nil, err
+	}
+
+	l := make([]AppPassword, 0, len(passwords[username]))
+	for name, p := range passwords[username] {
+		l = append(l, AppPassword{Name: name, Created: p.Created})
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Name < l[j].Name
+	})
+	return l, nil
+}
+
+// AddAppPassword generates a new application password for a user, replacing
+// any existing one with the same name. password is any valid bridge password
+// of the user.
+func AddAppPassword(username, password, name string) (string, error) {
+	mainKey, _, err := unlockAuth(username, password)
+	if err != nil {
+		return "", err
+	}
+
+	secretKey, appPass, err := GeneratePassword()
+	if err != nil {
+		return "", err
+	}
+	encrypted, err := encrypt(mainKey[:], secretKey)
+	if err != nil {
+		return "", err
+	}
+
+	err = updateAppPasswords(func(passwords map[string]map[string]*appPassword) error {
+		if passwords[username] == nil {
+			passwords[username] = make(map[string]*appPassword)
+		}
+		passwords[username][name] = &appPassword{Key: encrypted, Created: time.Now()}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return appPass, nil
+}
+
+// RevokeAppPassword removes an application password of a user. Clients using
+// it are refused on their next login.
+func RevokeAppPassword(username, name string) error {
+	return updateAppPasswords(func(passwords map[string]map[string]*appPassword) error {
+		if _, ok := passwords[username][name]; !ok {
+			return ErrAppPasswordNotFound
+		}
+		delete(passwords[username], name)
+		if len(passwords[username]) == 0 {
+			delete(passwords, username)
+		}
+		return nil
+	})
+}
+
+// RevokeAllAppPasswords removes all application passwords of a user, e.g.
+// after logging in again with a new main bridge password.
+func RevokeAllAppPasswords(username string) error {
+	return updateAppPasswords(func(passwords map[string]map[string]*appPassword) error {
+		delete(passwords, username)
+		return nil
+	})
+}
@@ -0,0 +1,120 @@
+// Package autocrypt implements the Autocrypt header field, used by mail
+// clients to exchange public keys in-band.
+//
+// See https://autocrypt.org/level1.html
+package autocrypt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// HeaderKey is the name of the Autocrypt header field.
+const HeaderKey = "Autocrypt"
+
+// Encryption preferences.
+const (
+	PreferEncryptNoPreference = "nopreference"
+	PreferEncryptMutual       = "mutual"
+)
+
+// Header is a parsed Autocrypt header field.
+type Header struct {
+	Addr          string
+	PreferEncrypt string
+	KeyData       []byte
+}
+
+// Parse parses the value of an Autocrypt header field.
+func Parse(v string) (*Header, error) {
+	h := &Header{PreferEncrypt: PreferEncryptNoPreference}
+	for _, attr := range strings.Split(v, ";") {
+		attr = strings.TrimSpace(attr)
+		if attr == "" {
+			continue
+		}
+		kv := strings.SplitN(attr, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("autocrypt: malformed attribute %q", attr)
+		}
+		k, v := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+
+		switch k {
+		case "addr":
+			h.Addr = v
+		case "prefer-encrypt":
+			if v == PreferEncryptMutual {
+				h.PreferEncrypt = v
+			}
+		case "keydata":
+			data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(v), ""))
+			if err != nil {
+				return nil, fmt.Errorf("autocrypt: malformed keydata: %v", err)
+			}
+			h.KeyData = data
+		default:
+			// Unknown critical attributes invalidate the whole header
+			if !strings.HasPrefix(k, "_") {
+				return nil, fmt.Errorf("autocrypt: unknown critical attribute %q", k)
+			}
+		}
+	}
+
+	if h.Addr == "" {
+		return nil, errors.New("autocrypt: missing addr attribute")
+	}
+	if len(h.KeyData) == 0 {
+		return nil, errors.New("autocrypt: missing keydata attribute")
+	}
+	return h, nil
+}
+
+// New creates an Autocrypt header for a key. Only the public parts of the key
+// are included.
+func New(addr, preferEncrypt string, e *openpgp.Entity) (*Header, error) {
+	var b bytes.Buffer
+	if err := e.Serialize(&b); err != nil {
+		return nil, err
+	}
+	return &Header{Addr: addr, PreferEncrypt: preferEncrypt, KeyData: b.Bytes()}, nil
+}
+
+// Entity parses the key contained in the header.
+func (h *Header) Entity() (*openpgp.Entity, error) {
+	keyRing, err := openpgp.ReadKeyRing(bytes.NewReader(h.KeyData))
+	if err != nil {
+		return nil, err
+	}
+	if len(keyRing) != 1 {
+		return nil, fmt.Errorf("autocrypt: keydata contains %v keys, expected exactly one", len(keyRing))
+	}
+	return keyRing[0], nil
+}
+
+// String formats the header field value. The key data is folded so that the
+// field can be written as-is.
+func (h *Header) String() string {
+	var sb strings.Builder
+	sb.WriteString("addr=" + h.Addr + "; ")
+	if h.PreferEncrypt == PreferEncryptMutual {
+		sb.WriteString("prefer-encrypt=mutual; ")
+	}
+	sb.WriteString("keydata=")
+
+	data := base64.StdEncoding.EncodeToString(h.KeyData)
+	for len(data) > 0 {
+		n := 72
+		if n > len(data) {
+			n = len(data)
+		}
+		sb.WriteString("\r\n ")
+		sb.WriteString(data[:n])
+		data = data[n:]
+	}
+	return sb.String()
+}
@@ -0,0 +1,784 @@
+// Package caldav exposes ProtonMail calendars over CalDAV (RFC 4791).
+//
+// go-webdav doesn't provide a CalDAV server yet, so the subset of WebDAV
+// needed by CalDAV clients is implemented here. Events can be created, updated
+// and deleted, but calendars themselves can't be changed.
+package caldav
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	pgperrors "golang.org/x/crypto/openpgp/errors"
+	"golang.org/x/crypto/openpgp/packet"
+
+	"github.com/emersion/hydroxide/logging"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+var logger = logging.New("caldav")
+
+var errNotFound = errors.New("hydroxide/caldav: not found")
+
+const eventsPageSize = 100
+
+// eventPermissions are the permissions of the events created through the
+// bridge.
+const eventPermissions protonmail.CalendarEventPermissions = 3
+
+type backend struct {
+	c           *protonmail.Client
+	privateKeys openpgp.EntityList
+
+	locker   sync.Mutex
+	keyRings map[string]*protonmail.CalendarKeyRing
+}
+
+func (b *backend) calendarKeys(ctx context.Context, calendarID string) (*protonmail.CalendarKeyRing, error) {
+	b.locker.Lock()
+	keys, ok := b.keyRings[calendarID]
+	b.locker.Unlock()
+	if ok {
+		return keys, nil
+	}
+
+	keys, err := b.c.UnlockCalendarKeys(ctx, calendarID, b.privateKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	b.locker.Lock()
+	b.keyRings[calendarID] = keys
+	b.locker.Unlock()
+	return keys, nil
+}
+
+// keyRing returns the keys needed to read the events of a calendar: the
+// calendar keys and the user's address keys.
+func (b *backend) keyRing(ctx context.Context, calendarID string) (openpgp.EntityList, error) {
+	keys, err := b.calendarKeys(ctx, calendarID)
+	if err != nil {
+		return nil, err
+	}
+	keyRing := make(openpgp.EntityList, 0, len(keys.Keys)+len(b.privateKeys))
+	keyRing = append(keyRing, keys.Keys...)
+	return append(keyRing, b.privateKeys...), nil
+}
+
+func (b *backend) getCalendar(ctx context.Context, id string) (*protonmail.Calendar, error) {
+	calendars, err := b.c.ListCalendars(ctx, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, cal := range calendars {
+		if cal.ID == id {
+			return cal, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+// listEvents lists the events of a calendar between start and end. If end is
+// zero, all events are listed.
+func (b *backend) listEvents(ctx context.Context, calendarID string, start, end time.Time) ([]*protonmail.CalendarEvent, error) {
+	filter := protonmail.CalendarEventFilter{
+		Start:    start.Unix(),
+		End:      end.Unix(),
+		Timezone: "UTC",
+		PageSize: eventsPageSize,
+	}
+	if start.IsZero() {
+		filter.Start = 0
+	}
+	if end.IsZero() {
+		filter.End = time.Now().AddDate(100, 0, 0).Unix()
+	}
+
+	var events []*protonmail.CalendarEvent
+	for {
+		page, err := b.c.ListCalendarEvents(ctx, calendarID, &filter)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, page...)
+		if len(page) < eventsPageSize {
+			return events, nil
+		}
+		filter.Page++
+	}
+}
+
+func (b *backend) getEvent(ctx context.Context, calendarID, eventID string) (*protonmail.CalendarEvent, error) {
+	event, err := b.c.GetCalendarEvent(ctx, calendarID, eventID)
+	if apiErr, ok := err.(*protonmail.APIError); ok && (apiErr.Code == 2501 || apiErr.StatusCode == http.StatusNotFound) {
+		return nil, errNotFound
+	}
+	return event, err
+}
+
+// readCards decrypts and merges the parts of an event.
+func readCards(vevent *component, cards []protonmail.CalendarEventCard, keyPacket string, keyRing openpgp.KeyRing) ([]*component, error) {
+	var others []*component
+	for _, card := range cards {
+		md, err := card.Read(keyPacket, keyRing)
+		if err != nil {
+			return nil, err
+		}
+
+		cal, err := parseCalendar(md.UnverifiedBody)
+		if err != nil {
+			return nil, err
+		}
+
+		// The signature can be checked only if md.UnverifiedBody is consumed
+		// until EOF
+		io.Copy(ioutil.Discard, md.UnverifiedBody)
+		// Events created by other members of shared calendars are signed with
+		// keys we don't know
+		if err := md.SignatureError; err != nil && err != pgperrors.ErrUnknownIssuer {
+			return nil, err
+		}
+
+		for _, comp := range cal.comps {
+			if comp.name != compVEvent {
+				others = append(others, comp)
+				continue
+			}
+
+			for _, prop := range comp.props {
+				// Each part repeats properties such as UID and DTSTAMP
+				if existing := vevent.prop(prop.name); existing != nil && existing.line == prop.line {
+					continue
+				}
+				vevent.props = append(vevent.props, prop)
+			}
+			vevent.comps = append(vevent.comps, comp.comps...)
+		}
+	}
+	return others, nil
+}
+
+// eventCalendar decrypts an event and returns it as a VCALENDAR.
+func (b *backend) eventCalendar(ctx context.Context, event *protonmail.CalendarEvent) (*component, error) {
+	keyRing, err := b.keyRing(ctx, event.CalendarID)
+	if err != nil {
+		return nil, err
+	}
+
+	vevent := &component{name: compVEvent}
+	var others []*component
+	parts := []struct {
+		cards     []protonmail.CalendarEventCard
+		keyPacket string
+	}{
+		{event.SharedEvents, event.SharedKeyPacket},
+		{event.CalendarEvents, event.CalendarKeyPacket},
+		{event.PersonalEvents, ""},
+	}
+	for _, part := range parts {
+		l, err := readCards(vevent, part.cards, part.keyPacket, keyRing)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read event %v: %v", event.ID, err)
+		}
+		others = append(others, l...)
+	}
+
+	return newCalendar(append(others, vevent)...), nil
+}
+
+func newCalendar(comps ...*component) *component {
+	return &component{
+		name: "VCALENDAR",
+		props: []property{
+			parseProperty("VERSION:2.0"),
+			parseProperty("PRODID:-//emersion//hydroxide//EN"),
+		},
+		comps: comps,
+	}
+}
+
+// putEvent creates or updates an event. existing is nil if the event doesn't
+// exist yet.
+func (b *backend) putEvent(ctx context.Context, calendarID string, existing *protonmail.CalendarEvent, vevent *component) (*protonmail.CalendarEvent, error) {
+	keys, err := b.calendarKeys(ctx, calendarID)
+	if err != nil {
+		return nil, err
+	}
+
+	var op protonmail.CalendarEventSync
+	var sessionKey *packet.EncryptedKey
+	var keyPacket string
+	if existing != nil {
+		keyRing, err := b.keyRing(ctx, calendarID)
+		if err != nil {
+			return nil, err
+		}
+		sessionKey, err = protonmail.DecryptCalendarEventKey(existing.SharedKeyPacket, keyRing)
+		if err != nil {
+			return nil, fmt.Errorf("cannot update event %v: %v", existing.ID, err)
+		}
+		op.ID = existing.ID
+	} else {
+		sessionKey, err = protonmail.GenerateCalendarEventKey()
+		if err != nil {
+			return nil, err
+		}
+		keyPacket, err = protonmail.EncryptCalendarEventKey(sessionKey, keys.Keys[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	content, err := eventContent(vevent, sessionKey, keys.AddressKey)
+	if err != nil {
+		return nil, err
+	}
+	// Invitations aren't supported, the user is the organizer of all the
+	// events created through the bridge
+	content.Permissions = eventPermissions
+	content.IsOrganizer = 1
+	content.SharedKeyPacket = keyPacket
+	op.Event = content
+
+	resp, err := b.syncEvent(ctx, calendarID, keys.MemberID, &op)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Response.Event, nil
+}
+
+func (b *backend) deleteEvent(ctx context.Context, event *protonmail.CalendarEvent) error {
+	keys, err := b.calendarKeys(ctx, event.CalendarID)
+	if err != nil {
+		return err
+	}
+	_, err = b.syncEvent(ctx, event.CalendarID, keys.MemberID, &protonmail.CalendarEventSync{ID: event.ID})
+	return err
+}
+
+func (b *backend) syncEvent(ctx context.Context, calendarID, memberID string, op *protonmail.CalendarEventSync) (*protonmail.CalendarEventSyncResp, error) {
+	resps, err := b.c.SyncCalendarEvents(ctx, calendarID, memberID, []*protonmail.CalendarEventSync{op})
+	if err != nil {
+		return nil, err
+	}
+	if len(resps) != 1 {
+		return nil, errors.New("hydroxide/caldav: expected exactly one response when syncing an event")
+	}
+	if err := resps[0].Err(); err != nil {
+		return nil, err
+	}
+	return resps[0], nil
+}
+
+func formatCalendarPath(calendarID string) string {
+	return "/" + url.PathEscape(calendarID) + "/"
+}
+
+func formatEventPath(calendarID, eventID string) string {
+	return formatCalendarPath(calendarID) + url.PathEscape(eventID) + calendarObjectExtension
+}
+
+// parsePath splits a request path into a calendar ID and an event ID. Both
+// are empty for the root collection.
+func parsePath(p string) (calendarID, eventID string, err error) {
+	p = strings.Trim(path.Clean(p), "/")
+	if p == "" {
+		return "", "", nil
+	}
+
+	parts := strings.Split(p, "/")
+	switch len(parts) {
+	case 1:
+		return parts[0], "", nil
+	case 2:
+		if !strings.HasSuffix(parts[1], calendarObjectExtension) {
+			return "", "", errNotFound
+		}
+		return parts[0], strings.TrimSuffix(parts[1], calendarObjectExtension), nil
+	default:
+		return "", "", errNotFound
+	}
+}
+
+func formatETag(event *protonmail.CalendarEvent) string {
+	return fmt.Sprintf(`"%x"`, event.LastEditTime)
+}
+
+func readOnlyPrivileges() string {
+	return element(davName("privilege"), element(davName("read"), ""))
+}
+
+func readWritePrivileges() string {
+	return readOnlyPrivileges() + element(davName("privilege"), element(davName("write"), ""))
+}
+
+func (b *backend) rootProps() props {
+	return props{
+		propResourceType: element(davName("collection"), "") +
+			element(davName("principal"), ""),
+		propDisplayName:           "ProtonMail",
+		propCurrentUserPrincipal:  hrefElement("/"),
+		propCalendarHomeSet:       hrefElement("/"),
+		propCurrentUserPrivileges: readOnlyPrivileges(),
+	}
+}
+
+func (b *backend) calendarProps(cal *protonmail.Calendar) props {
+	reports := ""
+	for _, name := range []xml.Name{reportCalendarQuery, reportCalendarMultiget} {
+		reports += element(davName("supported-report"),
+			element(davName("report"), element(name, "")))
+	}
+
+	return props{
+		propResourceType: element(davName("collection"), "") +
+			element(calDAVName("calendar"), ""),
+		propDisplayName:           escapeText(cal.Name),
+		propCalendarDescription:   escapeText(cal.Description),
+		propCalendarColor:         escapeText(cal.Color),
+		propCurrentUserPrincipal:  hrefElement("/"),
+		propCurrentUserPrivileges: readWritePrivileges(),
+		propSupportedReportSet:    reports,
+		propSupportedComponents:   `<comp xmlns="` + nsCalDAV + `" name="` + compVEvent + `"></comp>`,
+	}
+}
+
+// eventProps returns the properties of an event. The event is only decrypted
+// if its data is requested.
+func (b *backend) eventProps(ctx context.Context, event *protonmail.CalendarEvent, req *propRequest) (props, error) {
+	values := props{
+		propResourceType:          "",
+		propGetETag:               escapeText(formatETag(event)),
+		propGetContentType:        escapeText(calendarDataContentType + "; component=vevent"),
+		propGetLastModified:       event.LastEditTime.Time().UTC().Format(http.TimeFormat),
+		propCurrentUserPrivileges: readWritePrivileges(),
+	}
+
+	if req.wants(propCalendarData) {
+		cal, err := b.eventCalendar(ctx, event)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := cal.encode(&buf); err != nil {
+			return nil, err
+		}
+		values[propCalendarData] = escapeText(buf.String())
+	}
+
+	return values, nil
+}
+
+func (b *backend) eventResponses(ctx context.Context, events []*protonmail.CalendarEvent, req *propRequest) ([]response, error) {
+	resps := make([]response, 0, len(events))
+	for _, event := range events {
+		values, err := b.eventProps(ctx, event, req)
+		if err != nil {
+			return nil, err
+		}
+		resps = append(resps, newResponse(formatEventPath(event.CalendarID, event.ID), values, req))
+	}
+	return resps, nil
+}
+
+func (b *backend) propfind(ctx context.Context, p string, depth string, req *propRequest) (*multistatus, error) {
+	calendarID, eventID, err := parsePath(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var ms multistatus
+	switch {
+	case calendarID == "":
+		ms.Responses = append(ms.Responses, newResponse("/", b.rootProps(), req))
+		if depth == "0" {
+			break
+		}
+
+		calendars, err := b.c.ListCalendars(ctx, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, cal := range calendars {
+			ms.Responses = append(ms.Responses, newResponse(formatCalendarPath(cal.ID), b.calendarProps(cal), req))
+		}
+	case eventID == "":
+		cal, err := b.getCalendar(ctx, calendarID)
+		if err != nil {
+			return nil, err
+		}
+		ms.Responses = append(ms.Responses, newResponse(formatCalendarPath(cal.ID), b.calendarProps(cal), req))
+		if depth == "0" {
+			break
+		}
+
+		events, err := b.listEvents(ctx, cal.ID, time.Time{}, time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		resps, err := b.eventResponses(ctx, events, req)
+		if err != nil {
+			return nil, err
+		}
+		ms.Responses = append(ms.Responses, resps...)
+	default:
+		event, err := b.getEvent(ctx, calendarID, eventID)
+		if err != nil {
+			return nil, err
+		}
+		resps, err := b.eventResponses(ctx, []*protonmail.CalendarEvent{event}, req)
+		if err != nil {
+			return nil, err
+		}
+		ms.Responses = append(ms.Responses, resps...)
+	}
+
+	return &ms, nil
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(calendarDataTimeLayout, s)
+}
+
+// queryTimeRange returns the time range of a calendar-query filter. Other
+// filters aren't supported, a superset of the matching events is returned.
+func queryTimeRange(filter *compFilter) (ok bool, start, end time.Time, err error) {
+	if filter.Name != "VCALENDAR" {
+		return false, time.Time{}, time.Time{}, nil
+	}
+	for _, comp := range filter.Comps {
+		if comp.Name != compVEvent {
+			return false, time.Time{}, time.Time{}, nil
+		}
+		if comp.TimeRange != nil {
+			if start, err = parseTime(comp.TimeRange.Start); err != nil {
+				return false, time.Time{}, time.Time{}, err
+			}
+			if end, err = parseTime(comp.TimeRange.End); err != nil {
+				return false, time.Time{}, time.Time{}, err
+			}
+		}
+	}
+	return true, start, end, nil
+}
+
+func (b *backend) query(ctx context.Context, calendarID string, query *calendarQuery) (*multistatus, error) {
+	ok, start, end, err := queryTimeRange(&query.Filter)
+	if err != nil {
+		return nil, errBadRequest
+	} else if !ok {
+		// Only events are supported
+		return &multistatus{}, nil
+	}
+
+	events, err := b.listEvents(ctx, calendarID, start, end)
+	if err != nil {
+		return nil, err
+	}
+	resps, err := b.eventResponses(ctx, events, &query.propRequest)
+	if err != nil {
+		return nil, err
+	}
+	return &multistatus{Responses: resps}, nil
+}
+
+func (b *backend) multiget(ctx context.Context, multiget *calendarMultiget) (*multistatus, error) {
+	var ms multistatus
+	for _, href := range multiget.Hrefs {
+		u, err := url.Parse(href)
+		if err != nil {
+			return nil, errBadRequest
+		}
+
+		calendarID, eventID, err := parsePath(u.Path)
+		var event *protonmail.CalendarEvent
+		if err == nil && eventID != "" {
+			event, err = b.getEvent(ctx, calendarID, eventID)
+		} else if err == nil {
+			err = errNotFound
+		}
+		if err == errNotFound {
+			ms.Responses = append(ms.Responses, response{Href: href, Status: statusNotFound})
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		values, err := b.eventProps(ctx, event, &multiget.propRequest)
+		if err != nil {
+			return nil, err
+		}
+		ms.Responses = append(ms.Responses, newResponse(href, values, &multiget.propRequest))
+	}
+	return &ms, nil
+}
+
+type handler struct {
+	b *backend
+}
+
+const allowedMethods = "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, REPORT"
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var err error
+	switch r.Method {
+	case "OPTIONS":
+		w.Header().Set("DAV", "1, 3, calendar-access")
+		w.Header().Set("Allow", allowedMethods)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet, http.MethodHead:
+		err = h.serveGet(w, r)
+	case http.MethodPut:
+		err = h.servePut(w, r)
+	case http.MethodDelete:
+		err = h.serveDelete(w, r)
+	case "PROPFIND":
+		err = h.servePropfind(w, r)
+	case "REPORT":
+		err = h.serveReport(w, r)
+	default:
+		w.Header().Set("Allow", allowedMethods)
+		http.Error(w, "hydroxide/caldav: unsupported method", http.StatusMethodNotAllowed)
+	}
+
+	switch err {
+	case nil:
+	case errNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errBadRequest:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errPreconditionFailed:
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+	case errMethodNotAllowed:
+		w.Header().Set("Allow", allowedMethods)
+		http.Error(w, err.Error(), http.StatusMethodNotAllowed)
+	default:
+		logger.Warn("cannot handle request", "method", r.Method, "path", r.URL.Path, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *handler) serveGet(w http.ResponseWriter, r *http.Request) error {
+	if r.URL.Path == "/.well-known/caldav" {
+		http.Redirect(w, r, "/", http.StatusMovedPermanently)
+		return nil
+	}
+
+	calendarID, eventID, err := parsePath(r.URL.Path)
+	if err != nil {
+		return err
+	} else if eventID == "" {
+		w.Header().Set("Allow", allowedMethods)
+		http.Error(w, "hydroxide/caldav: cannot GET a collection", http.StatusMethodNotAllowed)
+		return nil
+	}
+
+	event, err := h.b.getEvent(r.Context(), calendarID, eventID)
+	if err != nil {
+		return err
+	}
+	cal, err := h.b.eventCalendar(r.Context(), event)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := cal.encode(&buf); err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", calendarDataContentType)
+	w.Header().Set("ETag", formatETag(event))
+	w.Header().Set("Last-Modified", event.LastEditTime.Time().UTC().Format(http.TimeFormat))
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+var errPreconditionFailed = errors.New("hydroxide/caldav: precondition failed")
+
+// checkPreconditions checks the If-Match and If-None-Match headers of a
+// request. event is nil if the resource doesn't exist.
+func checkPreconditions(r *http.Request, event *protonmail.CalendarEvent) error {
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if event == nil || (ifMatch != "*" && ifMatch != formatETag(event)) {
+			return errPreconditionFailed
+		}
+	}
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && event != nil {
+		if ifNoneMatch == "*" || ifNoneMatch == formatETag(event) {
+			return errPreconditionFailed
+		}
+	}
+	return nil
+}
+
+// lookupEvent returns the event at a path, or nil if it doesn't exist.
+func (h *handler) lookupEvent(r *http.Request) (calendarID string, event *protonmail.CalendarEvent, err error) {
+	calendarID, eventID, err := parsePath(r.URL.Path)
+	if err != nil {
+		return "", nil, err
+	} else if eventID == "" {
+		return "", nil, errMethodNotAllowed
+	}
+
+	event, err = h.b.getEvent(r.Context(), calendarID, eventID)
+	if err == errNotFound {
+		return calendarID, nil, nil
+	}
+	return calendarID, event, err
+}
+
+var errMethodNotAllowed = errors.New("hydroxide/caldav: method not allowed on a collection")
+
+func (h *handler) servePut(w http.ResponseWriter, r *http.Request) error {
+	calendarID, event, err := h.lookupEvent(r)
+	if err != nil {
+		return err
+	}
+	if event == nil {
+		// Make sure the calendar exists
+		if _, err := h.b.getCalendar(r.Context(), calendarID); err != nil {
+			return err
+		}
+	}
+	if err := checkPreconditions(r, event); err != nil {
+		return err
+	}
+
+	cal, err := parseCalendar(io.LimitReader(r.Body, maxRequestSize))
+	if err != nil {
+		return errBadRequest
+	}
+	// Time zones are referenced by their name, VTIMEZONE components are
+	// dropped
+	vevents := cal.children(compVEvent)
+	if len(vevents) != 1 {
+		http.Error(w, "hydroxide/caldav: calendar objects must contain exactly one event", http.StatusForbidden)
+		return nil
+	}
+	vevent := vevents[0]
+	if vevent.prop("UID") == nil || vevent.prop("DTSTART") == nil {
+		return errBadRequest
+	}
+
+	created := event == nil
+	event, err = h.b.putEvent(r.Context(), calendarID, event, vevent)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("ETag", formatETag(event))
+	if created {
+		// The event ID is chosen by ProtonMail, not by the client
+		w.Header().Set("Location", formatEventPath(event.CalendarID, event.ID))
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+	return nil
+}
+
+func (h *handler) serveDelete(w http.ResponseWriter, r *http.Request) error {
+	_, event, err := h.lookupEvent(r)
+	if err != nil {
+		return err
+	} else if event == nil {
+		return errNotFound
+	}
+	if err := checkPreconditions(r, event); err != nil {
+		return err
+	}
+
+	if err := h.b.deleteEvent(r.Context(), event); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (h *handler) servePropfind(w http.ResponseWriter, r *http.Request) error {
+	var req propfind
+	name, err := decodeRequest(r, map[xml.Name]interface{}{elementPropfind: &req})
+	if err != nil || (name != xml.Name{} && name != elementPropfind) {
+		return errBadRequest
+	}
+
+	depth := r.Header.Get("Depth")
+	if depth != "0" {
+		// Depth: infinity is handled like Depth: 1
+		depth = "1"
+	}
+
+	ms, err := h.b.propfind(r.Context(), r.URL.Path, depth, &req.propRequest)
+	if err != nil {
+		return err
+	}
+	return writeMultistatus(w, ms)
+}
+
+func (h *handler) serveReport(w http.ResponseWriter, r *http.Request) error {
+	calendarID, eventID, err := parsePath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+
+	var query calendarQuery
+	var multiget calendarMultiget
+	name, err := decodeRequest(r, map[xml.Name]interface{}{
+		reportCalendarQuery:    &query,
+		reportCalendarMultiget: &multiget,
+	})
+	if err != nil {
+		return errBadRequest
+	}
+
+	var ms *multistatus
+	switch name {
+	case reportCalendarQuery:
+		if calendarID == "" || eventID != "" {
+			return errBadRequest
+		}
+		ms, err = h.b.query(r.Context(), calendarID, &query)
+	case reportCalendarMultiget:
+		ms, err = h.b.multiget(r.Context(), &multiget)
+	default:
+		http.Error(w, "hydroxide/caldav: unsupported report", http.StatusForbidden)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return writeMultistatus(w, ms)
+}
+
+// NewHandler returns a CalDAV handler for the calendars of a user.
+// privateKeys are the user's address keys, used to unlock calendar keys.
+func NewHandler(c *protonmail.Client, privateKeys openpgp.EntityList) http.Handler {
+	if len(privateKeys) == 0 {
+		panic("hydroxide/caldav: no private key available")
+	}
+
+	return &handler{&backend{
+		c:           c,
+		privateKeys: privateKeys,
+		keyRings:    make(map[string]*protonmail.CalendarKeyRing),
+	}}
+}
@@ -0,0 +1,127 @@
+package caldav
+
+import (
+	"bytes"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// Properties of the signed parts of an event. All other VEVENT properties are
+// encrypted in the shared part. UID and DTSTAMP are repeated in all parts.
+var (
+	sharedSignedProps = map[string]bool{
+		"UID":           true,
+		"DTSTAMP":       true,
+		"DTSTART":       true,
+		"DTEND":         true,
+		"RECURRENCE-ID": true,
+		"RRULE":         true,
+		"EXDATE":        true,
+		"ORGANIZER":     true,
+		"SEQUENCE":      true,
+	}
+	calendarSignedProps = map[string]bool{
+		"UID":     true,
+		"DTSTAMP": true,
+		"STATUS":  true,
+		"TRANSP":  true,
+	}
+)
+
+const compVAlarm = "VALARM"
+
+// eventPart returns the VCALENDAR of an event part, containing the props of
+// vevent matching filter.
+func eventPart(vevent *component, filter func(name string) bool, comps []*component) *component {
+	part := &component{name: compVEvent, comps: comps}
+	for _, prop := range vevent.props {
+		if filter(prop.name) {
+			part.props = append(part.props, prop)
+		}
+	}
+
+	return newCalendar(part)
+}
+
+func encodeComponent(comp *component) (*bytes.Buffer, error) {
+	var buf bytes.Buffer
+	if err := comp.encode(&buf); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+// eventContent splits a VEVENT into the parts stored by ProtonMail. All parts
+// are signed with signer, the shared properties which aren't needed by the
+// server are encrypted with sessionKey.
+func eventContent(vevent *component, sessionKey *packet.EncryptedKey, signer *openpgp.Entity) (*protonmail.CalendarEventContent, error) {
+	var alarms, others []*component
+	for _, child := range vevent.comps {
+		if child.name == compVAlarm {
+			alarms = append(alarms, child)
+		} else {
+			others = append(others, child)
+		}
+	}
+
+	isStamp := func(name string) bool {
+		return name == "UID" || name == "DTSTAMP"
+	}
+	isShared := func(name string) bool {
+		return sharedSignedProps[name]
+	}
+	isCalendar := func(name string) bool {
+		return calendarSignedProps[name]
+	}
+	isEncrypted := func(name string) bool {
+		return isStamp(name) || (!sharedSignedProps[name] && !calendarSignedProps[name])
+	}
+
+	var content protonmail.CalendarEventContent
+
+	buf, err := encodeComponent(eventPart(vevent, isShared, nil))
+	if err != nil {
+		return nil, err
+	}
+	card, err := protonmail.NewSignedCalendarEventCard(buf, signer)
+	if err != nil {
+		return nil, err
+	}
+	content.SharedEventContent = append(content.SharedEventContent, card)
+
+	buf, err = encodeComponent(eventPart(vevent, isEncrypted, others))
+	if err != nil {
+		return nil, err
+	}
+	card, err = protonmail.NewEncryptedCalendarEventCard(buf, sessionKey, signer)
+	if err != nil {
+		return nil, err
+	}
+	content.SharedEventContent = append(content.SharedEventContent, card)
+
+	buf, err = encodeComponent(eventPart(vevent, isCalendar, nil))
+	if err != nil {
+		return nil, err
+	}
+	card, err = protonmail.NewSignedCalendarEventCard(buf, signer)
+	if err != nil {
+		return nil, err
+	}
+	content.CalendarEventContent = append(content.CalendarEventContent, card)
+
+	if len(alarms) > 0 {
+		buf, err = encodeComponent(eventPart(vevent, isStamp, alarms))
+		if err != nil {
+			return nil, err
+		}
+		content.PersonalEventContent, err = protonmail.NewSignedCalendarEventCard(buf, signer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &content, nil
+}
@@ -0,0 +1,60 @@
+package caldav
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// WriteCalendar decrypts all events of a calendar and writes them to w as a
+// single VCALENDAR. privateKeys are the user's address keys, used to unlock
+// calendar keys.
+func WriteCalendar(ctx context.Context, c *protonmail.Client, privateKeys openpgp.EntityList, cal *protonmail.Calendar, w io.Writer) error {
+	b := &backend{
+		c:           c,
+		privateKeys: privateKeys,
+		keyRings:    make(map[string]*protonmail.CalendarKeyRing),
+	}
+
+	events, err := b.listEvents(ctx, cal.ID, time.Time{}, time.Time{})
+	if err != nil {
+		return err
+	}
+
+	root := newCalendar()
+	if cal.Name != "" {
+		root.props = append(root.props, property{name: "X-WR-CALNAME", line: "X-WR-CALNAME:" + escapeValue(cal.Name)})
+	}
+
+	// Events referencing the same time zone each carry a copy of it
+	timezones := make(map[string]bool)
+	for _, event := range events {
+		eventCal, err := b.eventCalendar(ctx, event)
+		if err != nil {
+			return err
+		}
+
+		for _, comp := range eventCal.comps {
+			if comp.name == "VTIMEZONE" {
+				tzid := comp.prop("TZID")
+				if tzid == nil || timezones[tzid.value()] {
+					continue
+				}
+				timezones[tzid.value()] = true
+			}
+			root.comps = append(root.comps, comp)
+		}
+	}
+
+	return root.encode(w)
+}
+
+// escapeValue escapes a TEXT property value (RFC 5545 section 3.3.11).
+func escapeValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,184 @@
+package caldav
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// component is an iCalendar component (RFC 5545 section 3.6). Properties are
+// kept as unfolded content lines: they're passed through to clients as-is.
+type component struct {
+	name  string
+	props []property
+	comps []*component
+}
+
+type property struct {
+	// Upper-case property name
+	name string
+	line string
+}
+
+func parseProperty(line string) property {
+	i := strings.IndexAny(line, ";:")
+	if i < 0 {
+		i = len(line)
+	}
+	return property{name: strings.ToUpper(line[:i]), line: line}
+}
+
+// value returns the value of the property, without its name and parameters.
+func (p property) value() string {
+	quoted := false
+	for i, c := range p.line {
+		switch c {
+		case '"':
+			quoted = !quoted
+		case ':':
+			if !quoted {
+				return p.line[i+1:]
+			}
+		}
+	}
+	return ""
+}
+
+func (comp *component) prop(name string) *property {
+	for i := range comp.props {
+		if comp.props[i].name == name {
+			return &comp.props[i]
+		}
+	}
+	return nil
+}
+
+func (comp *component) children(name string) []*component {
+	var l []*component
+	for _, child := range comp.comps {
+		if child.name == name {
+			l = append(l, child)
+		}
+	}
+	return l
+}
+
+// readLines reads the unfolded content lines of an iCalendar stream.
+func readLines(r io.Reader) ([]string, error) {
+	var lines []string
+	br := bufio.NewReader(r)
+	for {
+		l, err := br.ReadString('\n')
+		l = strings.TrimRight(l, "\r\n")
+		if len(l) > 0 && (l[0] == ' ' || l[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += l[1:]
+		} else if l != "" {
+			lines = append(lines, l)
+		}
+
+		if err == io.EOF {
+			return lines, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseCalendar parses an iCalendar stream containing a single VCALENDAR.
+func parseCalendar(r io.Reader) (*component, error) {
+	lines, err := readLines(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var stack []*component
+	var root *component
+	for _, l := range lines {
+		prop := parseProperty(l)
+		switch prop.name {
+		case "BEGIN":
+			comp := &component{name: strings.ToUpper(prop.value())}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.comps = append(parent.comps, comp)
+			} else if root != nil {
+				return nil, errors.New("hydroxide/caldav: multiple top-level components")
+			} else {
+				root = comp
+			}
+			stack = append(stack, comp)
+		case "END":
+			if len(stack) == 0 || stack[len(stack)-1].name != strings.ToUpper(prop.value()) {
+				return nil, fmt.Errorf("hydroxide/caldav: unexpected END:%v", prop.value())
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			if len(stack) == 0 {
+				return nil, errors.New("hydroxide/caldav: property outside of a component")
+			}
+			comp := stack[len(stack)-1]
+			comp.props = append(comp.props, prop)
+		}
+	}
+
+	if root == nil || root.name != "VCALENDAR" {
+		return nil, errors.New("hydroxide/caldav: missing VCALENDAR component")
+	}
+	if len(stack) > 0 {
+		return nil, fmt.Errorf("hydroxide/caldav: unterminated %v component", stack[len(stack)-1].name)
+	}
+	return root, nil
+}
+
+// writeLine writes a content line, folded at 75 octets.
+func writeLine(w io.Writer, l string) error {
+	const maxLen = 75
+	for first := true; ; first = false {
+		n := maxLen
+		if !first {
+			// Account for the leading space
+			n--
+		}
+		if len(l) <= n {
+			n = len(l)
+		} else {
+			// Don't split UTF-8 sequences
+			for n > 0 && !utf8.RuneStart(l[n]) {
+				n--
+			}
+		}
+
+		prefix := ""
+		if !first {
+			prefix = " "
+		}
+		if _, err := io.WriteString(w, prefix+l[:n]+"\r\n"); err != nil {
+			return err
+		}
+
+		l = l[n:]
+		if l == "" {
+			return nil
+		}
+	}
+}
+
+func (comp *component) encode(w io.Writer) error {
+	if err := writeLine(w, "BEGIN:"+comp.name); err != nil {
+		return err
+	}
+	for _, prop := range comp.props {
+		if err := writeLine(w, prop.line); err != nil {
+			return err
+		}
+	}
+	for _, child := range comp.comps {
+		if err := child.encode(w); err != nil {
+			return err
+		}
+	}
+	return writeLine(w, "END:"+comp.name)
+}
@@ -0,0 +1,245 @@
+package caldav
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	nsDAV    = "DAV:"
+	nsCalDAV = "urn:ietf:params:xml:ns:caldav"
+	nsApple  = "http://apple.com/ns/ical/"
+)
+
+func davName(local string) xml.Name {
+	return xml.Name{Space: nsDAV, Local: local}
+}
+
+func calDAVName(local string) xml.Name {
+	return xml.Name{Space: nsCalDAV, Local: local}
+}
+
+var (
+	propResourceType          = davName("resourcetype")
+	propDisplayName           = davName("displayname")
+	propGetETag               = davName("getetag")
+	propGetContentType        = davName("getcontenttype")
+	propGetLastModified       = davName("getlastmodified")
+	propCurrentUserPrincipal  = davName("current-user-principal")
+	propCurrentUserPrivileges = davName("current-user-privilege-set")
+	propSupportedReportSet    = davName("supported-report-set")
+
+	propCalendarHomeSet     = calDAVName("calendar-home-set")
+	propCalendarDescription = calDAVName("calendar-description")
+	propSupportedComponents = calDAVName("supported-calendar-component-set")
+	propCalendarData        = calDAVName("calendar-data")
+
+	propCalendarColor = xml.Name{Space: nsApple, Local: "calendar-color"}
+
+	elementPropfind        = davName("propfind")
+	reportCalendarQuery    = calDAVName("calendar-query")
+	reportCalendarMultiget = calDAVName("calendar-multiget")
+)
+
+const (
+	compVEvent              = "VEVENT"
+	calendarDataContentType = "text/calendar; charset=utf-8"
+	calendarObjectExtension = ".ics"
+	calendarDataTimeLayout  = "20060102T150405Z"
+
+	statusOK       = "HTTP/1.1 200 OK"
+	statusNotFound = "HTTP/1.1 404 Not Found"
+
+	maxRequestSize = 1024 * 1024
+)
+
+type xmlName struct {
+	XMLName xml.Name
+}
+
+// propRequest is the set of properties requested by a PROPFIND or REPORT
+// request. If neither Prop nor PropName is set, all properties are requested.
+type propRequest struct {
+	AllProp  *struct{} `xml:"DAV: allprop"`
+	PropName *struct{} `xml:"DAV: propname"`
+	Prop     *struct {
+		Names []xmlName `xml:",any"`
+	} `xml:"DAV: prop"`
+}
+
+func (req *propRequest) names() []xml.Name {
+	if req.Prop == nil {
+		return nil
+	}
+	names := make([]xml.Name, len(req.Prop.Names))
+	for i, n := range req.Prop.Names {
+		names[i] = n.XMLName
+	}
+	return names
+}
+
+func (req *propRequest) wants(name xml.Name) bool {
+	for _, n := range req.names() {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+type propfind struct {
+	XMLName xml.Name `xml:"DAV: propfind"`
+	propRequest
+}
+
+type timeRange struct {
+	Start string `xml:"start,attr"`
+	End   string `xml:"end,attr"`
+}
+
+type compFilter struct {
+	Name      string       `xml:"name,attr"`
+	TimeRange *timeRange   `xml:"urn:ietf:params:xml:ns:caldav time-range"`
+	Comps     []compFilter `xml:"urn:ietf:params:xml:ns:caldav comp-filter"`
+}
+
+type calendarQuery struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:caldav calendar-query"`
+	propRequest
+	Filter compFilter `xml:"urn:ietf:params:xml:ns:caldav filter>comp-filter"`
+}
+
+type calendarMultiget struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:caldav calendar-multiget"`
+	propRequest
+	Hrefs []string `xml:"DAV: href"`
+}
+
+// rawProp is a property value. Inner is already XML-encoded.
+type rawProp struct {
+	XMLName xml.Name
+	Inner   string `xml:",innerxml"`
+}
+
+type propstat struct {
+	Prop struct {
+		Values []rawProp `xml:",any"`
+	} `xml:"DAV: prop"`
+	Status string `xml:"DAV: status"`
+}
+
+type response struct {
+	Href      string     `xml:"DAV: href"`
+	Propstats []propstat `xml:"DAV: propstat,omitempty"`
+	Status    string     `xml:"DAV: status,omitempty"`
+}
+
+type multistatus struct {
+	XMLName   xml.Name   `xml:"DAV: multistatus"`
+	Responses []response `xml:"DAV: response"`
+}
+
+// props maps property names to their XML-encoded values.
+type props map[xml.Name]string
+
+func escapeText(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func element(name xml.Name, inner string) string {
+	var b strings.Builder
+	b.WriteString("<" + name.Local + ` xmlns="` + name.Space + `">`)
+	b.WriteString(inner)
+	b.WriteString("</" + name.Local + ">")
+	return b.String()
+}
+
+func hrefElement(href string) string {
+	return element(davName("href"), escapeText(href))
+}
+
+// newResponse builds the response for a resource, depending on the requested
+// properties.
+func newResponse(href string, values props, req *propRequest) response {
+	resp := response{Href: href}
+
+	found := propstat{Status: statusOK}
+	missing := propstat{Status: statusNotFound}
+	switch {
+	case req.PropName != nil:
+		for name := range values {
+			found.Prop.Values = append(found.Prop.Values, rawProp{XMLName: name})
+		}
+	case req.Prop != nil:
+		for _, name := range req.names() {
+			if v, ok := values[name]; ok {
+				found.Prop.Values = append(found.Prop.Values, rawProp{XMLName: name, Inner: v})
+			} else {
+				missing.Prop.Values = append(missing.Prop.Values, rawProp{XMLName: name})
+			}
+		}
+	default:
+		for name, v := range values {
+			// calendar-data isn't part of allprop (RFC 4791 section 9.6)
+			if name != propCalendarData {
+				found.Prop.Values = append(found.Prop.Values, rawProp{XMLName: name, Inner: v})
+			}
+		}
+	}
+
+	if len(found.Prop.Values) > 0 {
+		resp.Propstats = append(resp.Propstats, found)
+	}
+	if len(missing.Prop.Values) > 0 {
+		resp.Propstats = append(resp.Propstats, missing)
+	}
+	return resp
+}
+
+// decodeRequest decodes the XML body of a request. The name of the root
+// element is returned, v is only filled if it matches.
+func decodeRequest(r *http.Request, v map[xml.Name]interface{}) (xml.Name, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestSize))
+	if err != nil {
+		return xml.Name{}, err
+	}
+	if len(bytes.TrimSpace(b)) == 0 {
+		return xml.Name{}, nil
+	}
+
+	dec := xml.NewDecoder(bytes.NewReader(b))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return xml.Name{}, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		dst, ok := v[start.Name]
+		if !ok {
+			return start.Name, nil
+		}
+		return start.Name, dec.DecodeElement(dst, &start)
+	}
+}
+
+var errBadRequest = errors.New("hydroxide/caldav: malformed request")
+
+func writeMultistatus(w http.ResponseWriter, ms *multistatus) error {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).Encode(ms)
+}
@@ -2,13 +2,15 @@ package carddav
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"path"
-	"strconv"
 	"strings"
 	"sync"
 
@@ -23,35 +25,95 @@ var errNotFound = errors.New("carddav: not found")
 
 var (
 	cleartextCardProps = []string{vcard.FieldVersion, vcard.FieldProductID, "X-PM-LABEL", "X-PM-GROUP"}
-	signedCardProps    = []string{vcard.FieldVersion, vcard.FieldProductID, vcard.FieldFormattedName, vcard.FieldUID, vcard.FieldEmail}
+	// Pinned keys and their preferences are signed, like the web client does
+	signedCardProps = []string{vcard.FieldVersion, vcard.FieldProductID, vcard.FieldFormattedName, vcard.FieldUID, vcard.FieldEmail, vcard.FieldKey, fieldPMEncrypt, fieldPMSign, fieldPMScheme, fieldPMMIMEType}
 )
 
-func formatCard(card vcard.Card, privateKey *openpgp.Entity) (*protonmail.ContactImport, error) {
-	vcard.ToV4(card)
-
-	// Add groups to emails
-	i := 1
-	for _, email := range card[vcard.FieldEmail] {
-		if email.Group == "" {
-			email.Group = "item" + strconv.Itoa(i)
-			i++
+// splitCard moves the properties listed in keys from card to a new card.
+// VERSION is kept in both cards.
+func splitCard(card vcard.Card, keys []string) vcard.Card {
+	part := make(vcard.Card)
+	for _, k := range keys {
+		if fields, ok := card[k]; ok {
+			part[k] = fields
+			if k != vcard.FieldVersion {
+				delete(card, k)
+			}
 		}
 	}
+	return part
+}
 
-	toEncrypt := card
-	toSign := make(vcard.Card)
-	for _, k := range signedCardProps {
-		if fields, ok := toEncrypt[k]; ok {
-			toSign[k] = fields
-			if k != vcard.FieldVersion {
-				delete(toEncrypt, k)
+func generateUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "hydroxide-" + hex.EncodeToString(b), nil
+}
+
+// copyCard returns a deep copy of a vCard: fields and their parameters are
+// copied too.
+func copyCard(card vcard.Card) vcard.Card {
+	cp := make(vcard.Card, len(card))
+	for k, fields := range card {
+		l := make([]*vcard.Field, len(fields))
+		for i, f := range fields {
+			field := *f
+			if f.Params != nil {
+				field.Params = make(vcard.Params, len(f.Params))
+				for name, values := range f.Params {
+					field.Params[name] = append([]string(nil), values...)
+				}
 			}
+			l[i] = &field
+		}
+		cp[k] = l
+	}
+	return cp
+}
+
+// FormatCard splits a vCard into the cleartext, signed and encrypted cards
+// stored by ProtonMail.
+func FormatCard(card vcard.Card, privateKey *openpgp.Entity) (*protonmail.ContactImport, error) {
+	// Don't modify the caller's card
+	toEncrypt := copyCard(card)
+	vcard.ToV4(toEncrypt)
+
+	// ProtonMail requires a UID to identify contacts
+	if toEncrypt.Value(vcard.FieldUID) == "" {
+		uid, err := generateUID()
+		if err != nil {
+			return nil, err
 		}
+		toEncrypt.SetValue(vcard.FieldUID, uid)
 	}
 
+	// Add groups to emails
+	for _, email := range toEncrypt[vcard.FieldEmail] {
+		if email.Group == "" {
+			email.Group = newGroup(toEncrypt)
+		}
+	}
+
+	toSign := splitCard(toEncrypt, signedCardProps)
+	cleartext := splitCard(toEncrypt, cleartextCardProps)
+
 	var contactImport protonmail.ContactImport
 	var b bytes.Buffer
 
+	// Cards containing only VERSION aren't needed
+	if len(cleartext) > 1 {
+		if err := vcard.NewEncoder(&b).Encode(cleartext); err != nil {
+			return nil, err
+		}
+		contactImport.Cards = append(contactImport.Cards, &protonmail.ContactCard{
+			Type: protonmail.ContactCardCleartext,
+			Data: b.String(),
+		})
+		b.Reset()
+	}
+
 	if len(toSign) > 0 {
 		if err := vcard.NewEncoder(&b).Encode(toSign); err != nil {
 			return nil, err
@@ -64,7 +126,7 @@ func formatCard(card vcard.Card, privateKey *openpgp.Entity) (*protonmail.Contac
 		b.Reset()
 	}
 
-	if len(toEncrypt) > 0 {
+	if len(toEncrypt) > 1 {
 		if err := vcard.NewEncoder(&b).Encode(toEncrypt); err != nil {
 			return nil, err
 		}
@@ -93,12 +155,19 @@ func formatAddressObjectPath(id string) string {
 	return "/" + id + ".vcf"
 }
 
-func (b *backend) toAddressObject(contact *protonmail.Contact, req *carddav.AddressDataRequest) (*carddav.AddressObject, error) {
-	// TODO: handle req
+// ReadCard decrypts and verifies the cards of a contact, and merges them
+// into a single vCard. The contact's groups are listed in its categories.
+func ReadCard(contact *protonmail.Contact, groups map[string]*protonmail.Label, keyring openpgp.KeyRing) (card vcard.Card, err error) {
+	protonmail.DecryptPool.Do(func() {
+		card, err = readCard(contact, groups, keyring)
+	})
+	return card, err
+}
 
+func readCard(contact *protonmail.Contact, groups map[string]*protonmail.Label, keyring openpgp.KeyRing) (vcard.Card, error) {
 	card := make(vcard.Card)
 	for _, c := range contact.Cards {
-		md, err := c.Read(b.privateKeys)
+		md, err := c.Read(keyring)
 		if err != nil {
 			return nil, err
 		}
@@ -116,12 +185,28 @@ func (b *backend) toAddressObject(contact *protonmail.Contact, req *carddav.Addr
 		}
 
 		for k, fields := range decoded {
+			// All cards repeat VERSION
+			if _, ok := card[k]; ok && k == vcard.FieldVersion {
+				continue
+			}
 			for _, f := range fields {
 				card.Add(k, f)
 			}
 		}
 	}
 
+	setCategories(card, contact, groups)
+	return card, nil
+}
+
+func (b *backend) toAddressObject(contact *protonmail.Contact, groups map[string]*protonmail.Label, req *carddav.AddressDataRequest) (*carddav.AddressObject, error) {
+	// TODO: handle req
+
+	card, err := ReadCard(contact, groups, b.privateKeys)
+	if err != nil {
+		return nil, err
+	}
+
 	return &carddav.AddressObject{
 		Path:    formatAddressObjectPath(contact.ID),
 		ModTime: contact.ModifyTime.Time(),
@@ -131,12 +216,31 @@ func (b *backend) toAddressObject(contact *protonmail.Contact, req *carddav.Addr
 	}, nil
 }
 
+// toAddressObjects decrypts several contacts in parallel.
+func (b *backend) toAddressObjects(contacts []*protonmail.Contact, groups map[string]*protonmail.Label, req *carddav.AddressDataRequest) ([]carddav.AddressObject, error) {
+	aos := make([]carddav.AddressObject, len(contacts))
+	err := protonmail.DecryptPool.Map(len(contacts), func(i int) error {
+		ao, err := b.toAddressObject(contacts[i], groups, req)
+		if err != nil {
+			return err
+		}
+		aos[i] = *ao
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return aos, nil
+}
+
 type backend struct {
 	c           *protonmail.Client
 	cache       map[string]*protonmail.Contact
 	locker      sync.Mutex
 	total       int
 	privateKeys openpgp.EntityList
+	// Contact groups indexed by ID, nil if not fetched yet
+	groups map[string]*protonmail.Label
 }
 
 func (b *backend) AddressBook() (*carddav.AddressBook, error) {
@@ -167,56 +271,89 @@ func (b *backend) putCache(contact *protonmail.Contact) {
 	b.locker.Unlock()
 }
 
+// addCache adds a new contact to the cache. Contacts are both added when
+// they're created by the backend and when the corresponding event is
+// received: total is only incremented once.
+func (b *backend) addCache(contact *protonmail.Contact) {
+	b.locker.Lock()
+	if _, ok := b.cache[contact.ID]; !ok && b.total >= 0 {
+		b.total++
+	}
+	b.cache[contact.ID] = contact
+	b.locker.Unlock()
+}
+
 func (b *backend) deleteCache(id string) {
 	b.locker.Lock()
+	if _, ok := b.cache[id]; ok && b.total >= 0 {
+		b.total--
+	}
 	delete(b.cache, id)
 	b.locker.Unlock()
 }
 
-func (b *backend) GetAddressObject(path string, req *carddav.AddressDataRequest) (*carddav.AddressObject, error) {
+func isContactNotFound(err error) bool {
+	apiErr, ok := err.(*protonmail.APIError)
+	return ok && apiErr.Code == 13051
+}
+
+func (b *backend) getContact(ctx context.Context, id string) (*protonmail.Contact, error) {
+	contact, ok := b.getCache(id)
+	if ok {
+		return contact, nil
+	}
+	if b.cacheComplete() {
+		return nil, errNotFound
+	}
+
+	contact, err := b.c.GetContact(ctx, id)
+	if isContactNotFound(err) {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	b.putCache(contact)
+	return contact, nil
+}
+
+func (b *backend) getAddressObject(ctx context.Context, path string, req *carddav.AddressDataRequest) (*carddav.AddressObject, error) {
 	id, err := parseAddressObjectPath(path)
 	if err != nil {
 		return nil, err
 	}
 
-	contact, ok := b.getCache(id)
-	if !ok {
-		if b.cacheComplete() {
-			return nil, errNotFound
-		}
-
-		contact, err = b.c.GetContact(id)
-		if apiErr, ok := err.(*protonmail.APIError); ok && apiErr.Code == 13051 {
-			return nil, errNotFound
-		} else if err != nil {
-			return nil, err
-		}
-		b.putCache(contact)
+	contact, err := b.getContact(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := b.contactGroups(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	return b.toAddressObject(contact, req)
+	return b.toAddressObject(contact, groups, req)
 }
 
-func (b *backend) ListAddressObjects(req *carddav.AddressDataRequest) ([]carddav.AddressObject, error) {
+func (b *backend) listAddressObjects(ctx context.Context, req *carddav.AddressDataRequest) ([]carddav.AddressObject, error) {
+	groups, err := b.contactGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	if b.cacheComplete() {
 		b.locker.Lock()
 		defer b.locker.Unlock()
 
-		aos := make([]carddav.AddressObject, 0, len(b.cache))
+		contacts := make([]*protonmail.Contact, 0, len(b.cache))
 		for _, contact := range b.cache {
-			ao, err := b.toAddressObject(contact, req)
-			if err != nil {
-				return nil, err
-			}
-			aos = append(aos, *ao)
+			contacts = append(contacts, contact)
 		}
-
-		return aos, nil
+		return b.toAddressObjects(contacts, groups, req)
 	}
 
 	// Get a list of all contacts
 	// TODO: paging support
-	total, contacts, err := b.c.ListContacts(0, 0)
+	total, contacts, err := b.c.ListContacts(ctx, 0, 0)
 	if err != nil {
 		return nil, err
 	}
@@ -233,7 +370,8 @@ func (b *backend) ListAddressObjects(req *carddav.AddressDataRequest) ([]carddav
 	aos := make([]carddav.AddressObject, 0, total)
 	page := 0
 	for {
-		_, contacts, err := b.c.ListContactsExport(page, 0)
+		var exported []*protonmail.Contact
+		_, contacts, err := b.c.ListContactsExport(ctx, page, 0)
 		if err != nil {
 			return nil, err
 		}
@@ -245,13 +383,14 @@ func (b *backend) ListAddressObjects(req *carddav.AddressDataRequest) ([]carddav
 			}
 			contact.Cards = contactExport.Cards
 			b.putCache(contact)
+			exported = append(exported, contact)
+		}
 
-			ao, err := b.toAddressObject(contact, req)
-			if err != nil {
-				return nil, err
-			}
-			aos = append(aos, *ao)
+		pageAOs, err := b.toAddressObjects(exported, groups, req)
+		if err != nil {
+			return nil, err
 		}
+		aos = append(aos, pageAOs...)
 
 		if len(aos) >= total || len(contacts) == 0 {
 			break
@@ -266,27 +405,36 @@ func (b *backend) QueryAddressObjects(query *carddav.AddressBookQuery) ([]cardda
 	panic("TODO")
 }
 
-func (b *backend) PutAddressObject(path string, card vcard.Card) (loc string, err error) {
+func (b *backend) putAddressObject(ctx context.Context, path string, card vcard.Card) (loc string, err error) {
 	id, err := parseAddressObjectPath(path)
 	if err != nil {
 		return "", err
 	}
 
-	contactImport, err := formatCard(card, b.privateKeys[0])
+	// Clients pick the path of new contacts, but the ID is chosen by the
+	// server
+	exists := true
+	if _, err := b.getContact(ctx, id); err == errNotFound {
+		exists = false
+	} else if err != nil {
+		return "", err
+	}
+
+	// Groups aren't stored in the card, they're labels
+	categories, hasCategories := popCategories(card)
+	contactImport, err := FormatCard(card, b.privateKeys[0])
 	if err != nil {
 		return "", err
 	}
 
 	var contact *protonmail.Contact
-
-	var req carddav.AddressDataRequest
-	if _, getErr := b.GetAddressObject(path, &req); getErr == nil {
-		contact, err = b.c.UpdateContact(id, contactImport)
+	if exists {
+		contact, err = b.c.UpdateContact(ctx, id, contactImport)
 		if err != nil {
 			return "", err
 		}
 	} else {
-		resps, err := b.c.CreateContacts([]*protonmail.ContactImport{contactImport})
+		resps, err := b.c.CreateContacts(ctx, []*protonmail.ContactImport{contactImport})
 		if err != nil {
 			return "", err
 		}
@@ -301,54 +449,94 @@ func (b *backend) PutAddressObject(path string, card vcard.Card) (loc string, er
 	}
 	contact.Cards = contactImport.Cards // Not returned by the server
 
-	// TODO: increment b.total if necessary
-	b.putCache(contact)
+	// Clients which don't support categories leave the groups unchanged
+	if hasCategories {
+		if err := b.setContactGroups(ctx, contact, categories); err != nil {
+			return "", err
+		}
+	}
+
+	b.addCache(contact)
 	return formatAddressObjectPath(contact.ID), nil
 }
 
-func (b *backend) DeleteAddressObject(path string) error {
+func (b *backend) deleteAddressObject(ctx context.Context, path string) error {
 	id, err := parseAddressObjectPath(path)
 	if err != nil {
 		return err
 	}
-	resps, err := b.c.DeleteContacts([]string{id})
+	resps, err := b.c.DeleteContacts(ctx, []string{id})
 	if err != nil {
 		return err
 	}
 	if len(resps) != 1 {
 		return errors.New("hydroxide/carddav: expected exactly one response when deleting contact")
 	}
-	resp := resps[0]
-	// TODO: decrement b.total if necessary
+	if err := resps[0].Err(); isContactNotFound(err) {
+		return errNotFound
+	} else if err != nil {
+		return err
+	}
 	b.deleteCache(id)
-	return resp.Err()
+	return nil
+}
+
+// requestBackend passes the context of an HTTP request to the backend.
+type requestBackend struct {
+	*backend
+	ctx context.Context
+}
+
+func (rb *requestBackend) GetAddressObject(path string, req *carddav.AddressDataRequest) (*carddav.AddressObject, error) {
+	return rb.getAddressObject(rb.ctx, path, req)
+}
+
+func (rb *requestBackend) ListAddressObjects(req *carddav.AddressDataRequest) ([]carddav.AddressObject, error) {
+	return rb.listAddressObjects(rb.ctx, req)
+}
+
+func (rb *requestBackend) PutAddressObject(path string, card vcard.Card) (loc string, err error) {
+	return rb.putAddressObject(rb.ctx, path, card)
+}
+
+func (rb *requestBackend) DeleteAddressObject(path string) error {
+	return rb.deleteAddressObject(rb.ctx, path)
+}
+
+type handler struct {
+	b *backend
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cardDAV := carddav.Handler{Backend: &requestBackend{h.b, r.Context()}}
+	cardDAV.ServeHTTP(w, r)
 }
 
 func (b *backend) receiveEvents(events <-chan *protonmail.Event) {
 	for event := range events {
-		b.locker.Lock()
 		if event.Refresh&protonmail.EventRefreshContacts != 0 {
+			b.locker.Lock()
 			b.cache = make(map[string]*protonmail.Contact)
 			b.total = -1
-		} else if len(event.Contacts) > 0 {
-			for _, eventContact := range event.Contacts {
-				switch eventContact.Action {
-				case protonmail.EventCreate:
-					if b.total >= 0 {
-						b.total++
-					}
-					fallthrough
-				case protonmail.EventUpdate:
-					b.cache[eventContact.ID] = eventContact.Contact
-				case protonmail.EventDelete:
-					delete(b.cache, eventContact.ID)
-					if b.total >= 0 {
-						b.total--
-					}
-				}
+			b.groups = nil
+			b.locker.Unlock()
+			continue
+		}
+
+		if len(event.Labels) > 0 {
+			b.invalidateGroups()
+		}
+
+		for _, eventContact := range event.Contacts {
+			switch eventContact.Action {
+			case protonmail.EventCreate:
+				b.addCache(eventContact.Contact)
+			case protonmail.EventUpdate:
+				b.putCache(eventContact.Contact)
+			case protonmail.EventDelete:
+				b.deleteCache(eventContact.ID)
 			}
 		}
-		b.locker.Unlock()
 	}
 }
 
@@ -368,5 +556,5 @@ func NewHandler(c *protonmail.Client, privateKeys openpgp.EntityList, events <-c
 		go b.receiveEvents(events)
 	}
 
-	return &carddav.Handler{b}
+	return &handler{b}
 }
@@ -0,0 +1,59 @@
+package carddav
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-vcard"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestFormatCardKeepsCard(t *testing.T) {
+	privateKey, err := protonmail.GenerateKey("Alice", "alice@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		card string
+	}{
+		{
+			name: "vCard 4.0",
+			card: "BEGIN:VCARD\r\nVERSION:4.0\r\nUID:urn:uuid:42\r\nFN:Bob\r\nEMAIL:bob@example.org\r\nEND:VCARD\r\n",
+		},
+		{
+			name: "vCard 3.0",
+			card: "BEGIN:VCARD\r\nVERSION:3.0\r\nFN:Bob\r\nEMAIL;TYPE=work,pref:bob@example.org\r\nEMAIL:bob@example.com\r\nTEL;TYPE=pref:+1234\r\nEND:VCARD\r\n",
+		},
+		{
+			name: "grouped email",
+			card: "BEGIN:VCARD\r\nVERSION:4.0\r\nFN:Bob\r\nitem1.EMAIL:bob@example.org\r\nNOTE:Hello\r\nEND:VCARD\r\n",
+		},
+	}
+	for _, tc := range tests {
+		card, err := vcard.NewDecoder(strings.NewReader(tc.card)).Decode()
+		if err != nil {
+			t.Fatalf("%v: cannot decode card: %v", tc.name, err)
+		}
+		var before bytes.Buffer
+		if err := vcard.NewEncoder(&before).Encode(card); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := FormatCard(card, privateKey); err != nil {
+			t.Errorf("%v: FormatCard() = %v", tc.name, err)
+			continue
+		}
+
+		var after bytes.Buffer
+		if err := vcard.NewEncoder(&after).Encode(card); err != nil {
+			t.Fatal(err)
+		}
+		if after.String() != before.String() {
+			t.Errorf("%v: FormatCard() changed the card from:\n%v\nto:\n%v", tc.name, before.String(), after.String())
+		}
+	}
+}
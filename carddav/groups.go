@@ -0,0 +1,193 @@
+package carddav
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-vcard"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// Contact groups are exposed as vCard categories. ProtonMail applies groups
+// to e-mail addresses rather than contacts: a contact belongs to a group if
+// one of its addresses does, and contacts without any address can't belong
+// to a group.
+
+// defaultGroupColor is the color of groups created from CardDAV clients.
+const defaultGroupColor = "#7272a7"
+
+// contactGroups returns the user's contact groups, indexed by ID.
+func (b *backend) contactGroups(ctx context.Context) (map[string]*protonmail.Label, error) {
+	b.locker.Lock()
+	groups := b.groups
+	b.locker.Unlock()
+	if groups != nil {
+		return groups, nil
+	}
+
+	labels, err := b.c.ListContactGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	groups = make(map[string]*protonmail.Label, len(labels))
+	for _, label := range labels {
+		groups[label.ID] = label
+	}
+
+	b.locker.Lock()
+	b.groups = groups
+	b.locker.Unlock()
+	return groups, nil
+}
+
+func (b *backend) invalidateGroups() {
+	b.locker.Lock()
+	b.groups = nil
+	b.locker.Unlock()
+}
+
+// setCategories replaces the categories of a card with the groups of a
+// contact.
+func setCategories(card vcard.Card, contact *protonmail.Contact, groups map[string]*protonmail.Label) {
+	delete(card, vcard.FieldCategories)
+
+	var labels []*protonmail.Label
+	for _, id := range contact.LabelIDs {
+		if label, ok := groups[id]; ok {
+			labels = append(labels, label)
+		}
+	}
+	if len(labels) == 0 {
+		return
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Order < labels[j].Order
+	})
+
+	names := make([]string, len(labels))
+	for i, label := range labels {
+		names[i] = label.Name
+	}
+	card.SetCategories(names)
+}
+
+// popCategories removes the categories from a card and returns them. ok is
+// false if the card has no CATEGORIES property at all, in which case the
+// groups of the contact shouldn't be changed.
+func popCategories(card vcard.Card) (names []string, ok bool) {
+	fields, ok := card[vcard.FieldCategories]
+	for _, field := range fields {
+		for _, name := range strings.Split(field.Value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	delete(card, vcard.FieldCategories)
+	return names, ok
+}
+
+type contactEmailLabeler func(ctx context.Context, labelID string, emailIDs []string) ([]*protonmail.ContactEmailLabelResp, error)
+
+func labelContactEmails(ctx context.Context, f contactEmailLabeler, labelID string, emailIDs []string) error {
+	resps, err := f(ctx, labelID, emailIDs)
+	if err != nil {
+		return err
+	}
+	for _, resp := range resps {
+		if err := resp.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setContactGroups updates the groups of a contact to match names. Missing
+// groups are created.
+func (b *backend) setContactGroups(ctx context.Context, contact *protonmail.Contact, names []string) error {
+	groups, err := b.contactGroups(ctx)
+	if err != nil {
+		return err
+	}
+
+	emails := contact.ContactEmails
+	if emails == nil {
+		full, err := b.c.GetContact(ctx, contact.ID)
+		if err != nil {
+			return err
+		}
+		emails = full.ContactEmails
+	}
+	if len(emails) == 0 {
+		if len(names) > 0 {
+			return errors.New("hydroxide/carddav: contacts without e-mail addresses can't belong to groups")
+		}
+		return nil
+	}
+
+	byName := make(map[string]*protonmail.Label, len(groups))
+	for _, label := range groups {
+		byName[label.Name] = label
+	}
+
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		label, ok := byName[name]
+		if !ok {
+			label, err = b.c.CreateLabel(ctx, &protonmail.Label{
+				Name:  name,
+				Color: defaultGroupColor,
+				Type:  protonmail.LabelContact,
+			})
+			if err != nil {
+				return err
+			}
+			byName[name] = label
+			b.invalidateGroups()
+		}
+		wanted[label.ID] = true
+	}
+
+	ids := make([]string, 0, len(byName))
+	for _, label := range byName {
+		ids = append(ids, label.ID)
+	}
+
+	// Only the addresses whose groups change are updated
+	for _, id := range ids {
+		var added, removed []string
+		for _, email := range emails {
+			has := false
+			for _, labelID := range email.LabelIDs {
+				if labelID == id {
+					has = true
+					break
+				}
+			}
+			if wanted[id] && !has {
+				added = append(added, email.ID)
+			} else if !wanted[id] && has {
+				removed = append(removed, email.ID)
+			}
+		}
+
+		if len(added) > 0 {
+			if err := labelContactEmails(ctx, b.c.LabelContactEmails, id, added); err != nil {
+				return err
+			}
+		}
+		if len(removed) > 0 {
+			if err := labelContactEmails(ctx, b.c.UnlabelContactEmails, id, removed); err != nil {
+				return err
+			}
+		}
+	}
+
+	contact.LabelIDs = make([]string, 0, len(wanted))
+	for id := range wanted {
+		contact.LabelIDs = append(contact.LabelIDs, id)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package carddav
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-vcard"
+)
+
+func TestPopCategories(t *testing.T) {
+	tests := []struct {
+		name  string
+		card  string
+		names []string
+		ok    bool
+	}{
+		{
+			name: "no categories",
+			card: "BEGIN:VCARD\r\nVERSION:4.0\r\nFN:Bob\r\nEND:VCARD\r\n",
+		},
+		{
+			name: "empty categories",
+			card: "BEGIN:VCARD\r\nVERSION:4.0\r\nFN:Bob\r\nCATEGORIES:\r\nEND:VCARD\r\n",
+			ok:   true,
+		},
+		{
+			name:  "several properties",
+			card:  "BEGIN:VCARD\r\nVERSION:4.0\r\nFN:Bob\r\nCATEGORIES:Friends, Work\r\nCATEGORIES:Family\r\nEND:VCARD\r\n",
+			names: []string{"Friends", "Work", "Family"},
+			ok:    true,
+		},
+	}
+	for _, tc := range tests {
+		card, err := vcard.NewDecoder(strings.NewReader(tc.card)).Decode()
+		if err != nil {
+			t.Fatalf("%v: cannot decode card: %v", tc.name, err)
+		}
+
+		names, ok := popCategories(card)
+		if ok != tc.ok || !reflect.DeepEqual(names, tc.names) {
+			t.Errorf("%v: popCategories() = %q, %v, want %q, %v", tc.name, names, ok, tc.names, tc.ok)
+		}
+		if _, ok := card[vcard.FieldCategories]; ok {
+			t.Errorf("%v: popCategories() didn't remove the categories", tc.name)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package carddav
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-vcard"
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// Fields used by the web client to store the preferences of an email address
+// of a contact, in the same group as the EMAIL field.
+const (
+	fieldPMEncrypt  = "X-PM-ENCRYPT"
+	fieldPMSign     = "X-PM-SIGN"
+	fieldPMScheme   = "X-PM-SCHEME"
+	fieldPMMIMEType = "X-PM-MIMETYPE"
+)
+
+const keyDataPrefix = "data:application/pgp-keys;base64,"
+
+// newGroup returns a property group name which isn't used in a card.
+func newGroup(card vcard.Card) string {
+	groups := make(map[string]bool)
+	for _, fields := range card {
+		for _, f := range fields {
+			groups[strings.ToLower(f.Group)] = true
+		}
+	}
+	for i := 1; ; i++ {
+		if g := "item" + strconv.Itoa(i); !groups[g] {
+			return g
+		}
+	}
+}
+
+// findEmailField returns the EMAIL field matching email.
+func findEmailField(card vcard.Card, email string) (*vcard.Field, bool) {
+	for _, f := range card[vcard.FieldEmail] {
+		if strings.EqualFold(strings.TrimSpace(f.Value), email) {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+func keyPref(f *vcard.Field) int {
+	if pref, err := strconv.Atoi(f.Params.Get(vcard.ParamPreferred)); err == nil {
+		return pref
+	}
+	return 100
+}
+
+func decodeKeyField(f *vcard.Field) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(f.Value, keyDataPrefix):
+		return base64.StdEncoding.DecodeString(strings.TrimPrefix(f.Value, keyDataPrefix))
+	case strings.EqualFold(f.Params.Get("ENCODING"), "b"):
+		// vCard 3
+		return base64.StdEncoding.DecodeString(f.Value)
+	default:
+		return nil, errors.New("unsupported KEY value")
+	}
+}
+
+// FindContact returns the contact of an email address and its decrypted card,
+// or nil if there's no such contact.
+func FindContact(ctx context.Context, c *protonmail.Client, email string, keyring openpgp.KeyRing) (*protonmail.Contact, vcard.Card, error) {
+	emails, err := c.FindContactEmails(ctx, email)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, ce := range emails {
+		if !strings.EqualFold(ce.Email, email) {
+			continue
+		}
+		contact, err := c.GetContact(ctx, ce.ContactID)
+		if err != nil {
+			return nil, nil, err
+		}
+		card, err := ReadCard(contact, nil, keyring)
+		if err != nil {
+			return nil, nil, err
+		}
+		return contact, card, nil
+	}
+	return nil, nil, nil
+}
+
+// PinnedKeys returns the public keys pinned for an email address of a
+// contact, by order of preference. The web client stores them in KEY fields
+// in the same group as the EMAIL field.
+func PinnedKeys(card vcard.Card, email string) (openpgp.EntityList, error) {
+	emailField, ok := findEmailField(card, email)
+	if !ok || emailField.Group == "" {
+		return nil, nil
+	}
+
+	var fields []*vcard.Field
+	for _, f := range card[vcard.FieldKey] {
+		if strings.EqualFold(f.Group, emailField.Group) {
+			fields = append(fields, f)
+		}
+	}
+	sort.SliceStable(fields, func(i, j int) bool {
+		return keyPref(fields[i]) < keyPref(fields[j])
+	})
+
+	var keys openpgp.EntityList
+	for _, f := range fields {
+		b, err := decodeKeyField(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key pinned for %v: %v", email, err)
+		}
+		el, err := openpgp.ReadKeyRing(bytes.NewReader(b))
+		if err != nil {
+			return nil, fmt.Errorf("invalid key pinned for %v: %v", email, err)
+		}
+		keys = append(keys, el...)
+	}
+	return keys, nil
+}
+
+// SetPinnedKeys replaces the public keys pinned for an email address of a
+// contact. The address is added to the card if missing. With no keys, the
+// pinned keys are removed.
+func SetPinnedKeys(card vcard.Card, email string, keys openpgp.EntityList) error {
+	emailField, ok := findEmailField(card, email)
+	if !ok {
+		emailField = &vcard.Field{Value: email}
+		card.Add(vcard.FieldEmail, emailField)
+	}
+	if emailField.Group == "" {
+		emailField.Group = newGroup(card)
+	}
+	group := emailField.Group
+
+	for _, k := range []string{vcard.FieldKey, fieldPMEncrypt} {
+		var kept []*vcard.Field
+		for _, f := range card[k] {
+			if !strings.EqualFold(f.Group, group) {
+				kept = append(kept, f)
+			}
+		}
+		if len(kept) > 0 {
+			card[k] = kept
+		} else {
+			delete(card, k)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	for i, e := range keys {
+		var b bytes.Buffer
+		if err := e.Serialize(&b); err != nil {
+			return err
+		}
+		card.Add(vcard.FieldKey, &vcard.Field{
+			Value:  keyDataPrefix + base64.StdEncoding.EncodeToString(b.Bytes()),
+			Params: vcard.Params{vcard.ParamPreferred: {strconv.Itoa(i + 1)}},
+			Group:  group,
+		})
+	}
+	// Tell the web client to encrypt to the pinned keys too
+	card.Add(fieldPMEncrypt, &vcard.Field{Value: "true", Group: group})
+	return nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/howeyc/gopass"
+
+	"github.com/emersion/hydroxide/auth"
+	"github.com/emersion/hydroxide/config"
+	"github.com/emersion/hydroxide/keyring"
+)
+
+type accountSetting struct {
+	get func(account *config.Account) string
+	set func(account *config.Account, value string) error
+}
+
+func parseBool(value string) (bool, error) {
+	switch value {
+	case "on", "true", "yes":
+		return true, nil
+	case "off", "false", "no":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid value %q: expected on or off", value)
+	}
+}
+
+func formatBool(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+var accountSettings = map[string]accountSetting{
+	"attach-public-key": {
+		get: func(account *config.Account) string {
+			return formatBool(account.AttachPublicKey)
+		},
+		set: func(account *config.Account, value string) (err error) {
+			account.AttachPublicKey, err = parseBool(value)
+			return err
+		},
+	},
+	"autocrypt": {
+		get: func(account *config.Account) string {
+			return account.AutocryptPreference()
+		},
+		set: func(account *config.Account, value string) error {
+			switch value {
+			case "nopreference", "mutual", config.AutocryptOff:
+				account.Autocrypt = value
+				return nil
+			default:
+				return fmt.Errorf("invalid value %q: expected nopreference, mutual or off", value)
+			}
+		},
+	},
+	"bind": {
+		get: func(account *config.Account) string {
+			if account.Bind == "" {
+				return "default"
+			}
+			return account.Bind
+		},
+		set: func(account *config.Account, value string) error {
+			if value == "default" {
+				value = ""
+			}
+			account.Bind = value
+			return nil
+		},
+	},
+	"caldav": {
+		get: func(account *config.Account) string {
+			return formatBool(account.ProtocolEnabled(config.ProtocolCalDAV))
+		},
+		set: func(account *config.Account, value string) error {
+			enabled, err := parseBool(value)
+			if err != nil {
+				return err
+			}
+			account.SetProtocolEnabled(config.ProtocolCalDAV, enabled)
+			return nil
+		},
+	},
+	"carddav": {
+		get: func(account *config.Account) string {
+			return formatBool(account.ProtocolEnabled(config.ProtocolCardDAV))
+		},
+		set: func(account *config.Account, value string) error {
+			enabled, err := parseBool(value)
+			if err != nil {
+				return err
+			}
+			account.SetProtocolEnabled(config.ProtocolCardDAV, enabled)
+			return nil
+		},
+	},
+	"cleartext": {
+		get: func(account *config.Account) string {
+			return account.CleartextPolicy()
+		},
+		set: func(account *config.Account, value string) error {
+			switch value {
+			case config.CleartextAllow, config.CleartextWarn, config.CleartextBlock:
+				account.Cleartext = value
+				return nil
+			default:
+				return fmt.Errorf("invalid value %q: expected allow, warn or block", value)
+			}
+		},
+	},
+	"imap": {
+		get: func(account *config.Account) string {
+			return formatBool(account.ProtocolEnabled(config.ProtocolIMAP))
+		},
+		set: func(account *config.Account, value string) error {
+			enabled, err := parseBool(value)
+			if err != nil {
+				return err
+			}
+			account.SetProtocolEnabled(config.ProtocolIMAP, enabled)
+			return nil
+		},
+	},
+	"keyring": {
+		get: func(account *config.Account) string {
+			return formatBool(account.Keyring)
+		},
+		set: func(account *config.Account, value string) (err error) {
+			account.Keyring, err = parseBool(value)
+			return err
+		},
+	},
+	"key-discovery": {
+		get: func(account *config.Account) string {
+			return account.KeyDiscoveryMethod()
+		},
+		set: func(account *config.Account, value string) error {
+			switch value {
+			case config.KeyDiscoveryOff, config.KeyDiscoveryWKD, config.KeyDiscoveryKeyserver:
+				account.KeyDiscovery = value
+				return nil
+			default:
+				return fmt.Errorf("invalid value %q: expected off, wkd or keyserver", value)
+			}
+		},
+	},
+	"key-pinning": {
+		get: func(account *config.Account) string {
+			return account.KeyPinningPolicy()
+		},
+		set: func(account *config.Account, value string) error {
+			switch value {
+			case config.KeyPinningWarn, config.KeyPinningBlock, config.KeyPinningOff:
+				account.KeyPinning = value
+				return nil
+			default:
+				return fmt.Errorf("invalid value %q: expected warn, block or off", value)
+			}
+		},
+	},
+	"key-transparency": {
+		get: func(account *config.Account) string {
+			return account.KeyTransparencyPolicy()
+		},
+		set: func(account *config.Account, value string) error {
+			switch value {
+			case config.KeyTransparencyOff, config.KeyTransparencyWarn, config.KeyTransparencyStrict:
+				account.KeyTransparency = value
+				return nil
+			default:
+				return fmt.Errorf("invalid value %q: expected off, warn or strict", value)
+			}
+		},
+	},
+	"pgp-mime": {
+		get: func(account *config.Account) string {
+			return formatBool(account.PGPMIME)
+		},
+		set: func(account *config.Account, value string) (err error) {
+			account.PGPMIME, err = parseBool(value)
+			return err
+		},
+	},
+	"protected-headers": {
+		get: func(account *config.Account) string {
+			return formatBool(account.ProtectedHeaders)
+		},
+		set: func(account *config.Account, value string) (err error) {
+			account.ProtectedHeaders, err = parseBool(value)
+			return err
+		},
+	},
+	"require-tls": {
+		get: func(account *config.Account) string {
+			return formatBool(account.RequireTLS)
+		},
+		set: func(account *config.Account, value string) (err error) {
+			account.RequireTLS, err = parseBool(value)
+			return err
+		},
+	},
+	"smtp": {
+		get: func(account *config.Account) string {
+			return formatBool(account.ProtocolEnabled(config.ProtocolSMTP))
+		},
+		set: func(account *config.Account, value string) error {
+			enabled, err := parseBool(value)
+			if err != nil {
+				return err
+			}
+			account.SetProtocolEnabled(config.ProtocolSMTP, enabled)
+			return nil
+		},
+	},
+	"webdav": {
+		get: func(account *config.Account) string {
+			return formatBool(account.ProtocolEnabled(config.ProtocolWebDAV))
+		},
+		set: func(account *config.Account, value string) error {
+			enabled, err := parseBool(value)
+			if err != nil {
+				return err
+			}
+			account.SetProtocolEnabled(config.ProtocolWebDAV, enabled)
+			return nil
+		},
+	},
+}
+
+// updateKeyring stores the bridge password of a user in the OS keyring, or
+// removes it.
+func updateKeyring(username string, enabled bool) error {
+	if !enabled {
+		if err := keyring.Delete(username); err != nil && err != keyring.ErrNotFound {
+			return err
+		}
+		return nil
+	}
+
+	fmt.Fprintf(os.Stderr, "Bridge password: ")
+	pass, err := gopass.GetPasswd()
+	if err != nil {
+		return err
+	}
+	if err := auth.CheckPassword(username, string(pass)); err != nil {
+		return err
+	}
+	return keyring.Set(username, string(pass))
+}
+
+const accountUsage = "usage: hydroxide account <username> [<setting> <value>]"
+
+func accountCommand(args []string) {
+	if len(args) != 1 && len(args) != 3 {
+		log.Fatal(accountUsage)
+	}
+	username := args[0]
+
+	account, err := config.LoadAccount(username)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(args) == 3 {
+		setting, ok := accountSettings[args[1]]
+		if !ok {
+			log.Fatalf("unknown setting %q", args[1])
+		}
+		wasKeyring := account.Keyring
+		if err := setting.set(account, args[2]); err != nil {
+			log.Fatal(err)
+		}
+		if account.Keyring != wasKeyring {
+			if err := updateKeyring(username, account.Keyring); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := config.SaveAccount(username, account); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	names := make([]string, 0, len(accountSettings))
+	for name := range accountSettings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(tw, "%v\t%v\n", name, accountSettings[name].get(account))
+	}
+	tw.Flush()
+}
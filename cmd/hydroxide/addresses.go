@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+const addressesUsage = `usage: hydroxide addresses list <username>
+       hydroxide addresses create [-name <display name>] [-key=false] <username> <address>
+       hydroxide addresses order <username> <address>...`
+
+func findAddress(ctx context.Context, c *protonmail.Client, email string) (*protonmail.Address, error) {
+	addrs, err := c.ListAddresses(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return lookupAddress(addrs, email)
+}
+
+func lookupAddress(addrs []*protonmail.Address, email string) (*protonmail.Address, error) {
+	for _, addr := range addrs {
+		if strings.EqualFold(addr.Email, email) {
+			return addr, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown address %q", email)
+}
+
+// selectAddressKeys returns the unlocked keys of the given addresses.
+func selectAddressKeys(ctx context.Context, c *protonmail.Client, privateKeys openpgp.EntityList, emails []string) (openpgp.EntityList, error) {
+	addrs, err := c.ListAddresses(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var selected openpgp.EntityList
+	for _, email := range emails {
+		addr, err := lookupAddress(addrs, email)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range addr.Keys {
+			found := false
+			for _, e := range privateKeys {
+				if strings.EqualFold(fmt.Sprintf("%x", e.PrimaryKey.Fingerprint), key.Fingerprint) {
+					selected = append(selected, e)
+					found = true
+					break
+				}
+			}
+			if !found {
+				log.Printf("Skipping key %v of %v: key isn't unlocked", key.Fingerprint, addr.Email)
+			}
+		}
+	}
+	return selected, nil
+}
+
+func addressesCommand(args []string) {
+	ctx := context.Background()
+
+	if len(args) < 1 {
+		log.Fatal(addressesUsage)
+	}
+	subcmd := args[0]
+
+	fs := flag.NewFlagSet("addresses "+subcmd, flag.ExitOnError)
+	switch subcmd {
+	case "list":
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			log.Fatal(addressesUsage)
+		}
+
+		c, _, err := login(ctx, fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		addrs, err := c.ListAddresses(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sort.Slice(addrs, func(i, j int) bool {
+			return addrs[i].Order < addrs[j].Order
+		})
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "ADDRESS\tNAME\tENABLED\tKEYS")
+		for _, addr := range addrs {
+			name := addr.DisplayName
+			if name == "" {
+				name = "-"
+			}
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", addr.Email, name, formatBool(addr.Status == protonmail.AddressEnabled), len(addr.Keys))
+		}
+		tw.Flush()
+	case "create":
+		displayName := fs.String("name", "", "display name of the address")
+		withKey := fs.Bool("key", true, "generate a key for the address")
+		fs.Parse(args[1:])
+		if fs.NArg() != 2 {
+			log.Fatal(addressesUsage)
+		}
+		email := fs.Arg(1)
+		i := strings.LastIndexByte(email, '@')
+		if i <= 0 {
+			log.Fatalf("invalid address %q", email)
+		}
+		local, domainName := email[:i], email[i+1:]
+
+		c, _, err := login(ctx, fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		d, err := findDomain(ctx, c, domainName)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		addr, err := c.CreateAddress(ctx, d.ID, local, *displayName, "")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Created address %v\n", addr.Email)
+
+		if *withKey {
+			key, _, err := c.CreateAddressKey(ctx, addr, true)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("Added primary key %v to %v\n", key.Fingerprint, addr.Email)
+		}
+	case "order":
+		fs.Parse(args[1:])
+		if fs.NArg() < 2 {
+			log.Fatal(addressesUsage)
+		}
+
+		c, _, err := login(ctx, fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		addrs, err := c.ListAddresses(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sort.Slice(addrs, func(i, j int) bool {
+			return addrs[i].Order < addrs[j].Order
+		})
+
+		// Addresses which aren't listed keep their relative order, after
+		// the listed ones
+		var ids []string
+		listed := make(map[string]bool)
+		for _, email := range fs.Args()[1:] {
+			addr, err := lookupAddress(addrs, email)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if listed[addr.ID] {
+				log.Fatalf("address %q listed twice", email)
+			}
+			listed[addr.ID] = true
+			ids = append(ids, addr.ID)
+		}
+		for _, addr := range addrs {
+			if !listed[addr.ID] {
+				ids = append(ids, addr.ID)
+			}
+		}
+
+		if err := c.OrderAddresses(ctx, ids); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatal(addressesUsage)
+	}
+}
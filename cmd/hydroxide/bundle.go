@@ -0,0 +1,310 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/howeyc/gopass"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+
+	"github.com/emersion/hydroxide/config"
+	"github.com/emersion/hydroxide/imap/database"
+)
+
+// importSuffix is appended to the name of files being imported, until the
+// whole bundle has been decrypted and checked.
+const importSuffix = ".import"
+
+const (
+	exportConfigUsage = "usage: hydroxide export-config <file>"
+	importConfigUsage = "usage: hydroxide import-config [-force] <file>"
+)
+
+func askPassphrase(prompt string) ([]byte, error) {
+	fmt.Fprintf(os.Stderr, "%v: ", prompt)
+	return gopass.GetPasswd()
+}
+
+// writeBundleFile adds a file to the bundle. Databases are copied in a
+// read transaction, to get a consistent copy.
+func writeBundleFile(tw *tar.Writer, dir, name string) error {
+	p := filepath.Join(dir, filepath.FromSlash(name))
+
+	if filepath.Ext(name) == ".db" {
+		u, err := database.OpenTimeout(name, time.Second)
+		if err == database.ErrLocked {
+			return fmt.Errorf("cannot export %v: %v, stop hydroxide first", name, err)
+		} else if err != nil {
+			return fmt.Errorf("cannot export %v: %v", name, err)
+		}
+		defer u.Close()
+
+		tmp, err := ioutil.TempFile("", "hydroxide-export-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		if _, err := u.WriteTo(tmp); err != nil {
+			return fmt.Errorf("cannot export %v: %v", name, err)
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return writeTarFile(tw, name, tmp)
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeTarFile(tw, name, f)
+}
+
+func writeTarFile(tw *tar.Writer, name string, f *os.File) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// exportConfig writes a passphrase-encrypted bundle of the configuration
+// directory to w: cached auth, local databases and settings.
+func exportConfig(w io.Writer, passphrase []byte) error {
+	dir, err := config.Dir()
+	if err != nil {
+		return err
+	}
+
+	aw, err := armor.Encode(w, "PGP MESSAGE", nil)
+	if err != nil {
+		return err
+	}
+	ew, err := openpgp.SymmetricallyEncrypt(aw, passphrase, &openpgp.FileHints{IsBinary: true}, nil)
+	if err != nil {
+		return err
+	}
+	gw := gzip.NewWriter(ew)
+	tw := tar.NewWriter(gw)
+
+	err = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() || strings.HasSuffix(p, importSuffix) {
+			return nil
+		}
+
+		name, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+
+		log.Printf("exporting %v", name)
+		return writeBundleFile(tw, dir, name)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, c := range []io.Closer{tw, gw, ew, aw} {
+		if err := c.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func exportConfigCommand(args []string) {
+	if len(args) != 1 {
+		log.Fatal(exportConfigUsage)
+	}
+	filename := args[0]
+
+	passphrase, err := askPassphrase("Bundle passphrase")
+	if err != nil {
+		log.Fatal(err)
+	}
+	confirm, err := askPassphrase("Confirm bundle passphrase")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if string(passphrase) != string(confirm) {
+		log.Fatal("passphrases don't match")
+	}
+	if len(passphrase) == 0 {
+		log.Fatal("the passphrase must not be empty")
+	}
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := exportConfig(f, passphrase); err != nil {
+		f.Close()
+		os.Remove(filename)
+		log.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("configuration exported to %v", filename)
+}
+
+// importConfig extracts a bundle created by exportConfig into the
+// configuration directory. Files are only replaced once the whole bundle has
+// been decrypted and its integrity has been checked.
+func importConfig(r io.Reader, passphrase []byte, force bool) error {
+	dir, err := config.Dir()
+	if err != nil {
+		return err
+	}
+
+	block, err := armor.Decode(r)
+	if err != nil {
+		return fmt.Errorf("cannot read bundle: %v", err)
+	}
+
+	tried := false
+	prompt := func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		if tried || !symmetric {
+			return nil, errors.New("invalid passphrase")
+		}
+		tried = true
+		return passphrase, nil
+	}
+	md, err := openpgp.ReadMessage(block.Body, nil, prompt, nil)
+	if err != nil {
+		return fmt.Errorf("cannot decrypt bundle: %v", err)
+	}
+
+	gr, err := gzip.NewReader(md.UnverifiedBody)
+	if err != nil {
+		return fmt.Errorf("cannot read bundle: %v", err)
+	}
+	tr := tar.NewReader(gr)
+
+	var staged []string // paths of the imported files, without importSuffix
+	defer func() {
+		for _, p := range staged {
+			os.Remove(p + importSuffix)
+		}
+	}()
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("cannot read bundle: %v", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("invalid file name in bundle: %q", hdr.Name)
+		}
+		p := filepath.Join(dir, filepath.FromSlash(name))
+
+		if _, err := os.Stat(p); err == nil {
+			if !force {
+				return fmt.Errorf("%v already exists, use -force to overwrite it", name)
+			}
+			if filepath.Ext(name) == ".db" {
+				// Make sure no running server is using the database
+				u, err := database.OpenTimeout(name, time.Second)
+				if err != nil {
+					return fmt.Errorf("cannot import %v: %v", name, err)
+				}
+				u.Close()
+			}
+		}
+
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(p+importSuffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		staged = append(staged, p)
+		_, err = io.Copy(f, tr)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("cannot import %v: %v", name, err)
+		}
+
+		log.Printf("importing %v", name)
+	}
+
+	// Reading the whole message checks its integrity
+	if _, err := io.Copy(ioutil.Discard, gr); err != nil {
+		return fmt.Errorf("cannot read bundle: %v", err)
+	}
+
+	for _, p := range staged {
+		if err := os.Rename(p+importSuffix, p); err != nil {
+			return err
+		}
+	}
+	staged = nil
+	return nil
+}
+
+func importConfigCommand(args []string) {
+	fs := flag.NewFlagSet("import-config", flag.ExitOnError)
+	force := fs.Bool("force", false, "overwrite existing files")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatal(importConfigUsage)
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	passphrase, err := askPassphrase("Bundle passphrase")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := importConfig(f, passphrase, *force); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("configuration imported, existing bridge passwords keep working")
+}
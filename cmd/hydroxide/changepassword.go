@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/howeyc/gopass"
+
+	"github.com/emersion/hydroxide/auth"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+const changePasswordUsage = "usage: hydroxide change-password [-mailbox] <username>"
+
+// askNewPassword asks for a new password twice.
+func askNewPassword(prompt string) (string, error) {
+	fmt.Printf("New %v: ", prompt)
+	pass, err := gopass.GetPasswd()
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("Confirm new %v: ", prompt)
+	confirm, err := gopass.GetPasswd()
+	if err != nil {
+		return "", err
+	}
+
+	if string(pass) != string(confirm) {
+		return "", errors.New("passwords don't match")
+	} else if len(pass) == 0 {
+		return "", errors.New("empty password")
+	}
+	return string(pass), nil
+}
+
+func changePasswordCommand(args []string) {
+	ctx := context.Background()
+
+	fs := flag.NewFlagSet("change-password", flag.ExitOnError)
+	mailbox := fs.Bool("mailbox", false, "change the mailbox password instead of the login password, in two-password mode")
+	fs.Parse(args)
+	username := fs.Arg(0)
+	if fs.NArg() != 1 {
+		log.Fatal(changePasswordUsage)
+	}
+
+	bridgePassword, err := askBridgePassword(username)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	c, _, err := auth.NewManager(newClient).Auth(ctx, username, bridgePassword)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The current passwords are the ones stored by hydroxide auth. They're
+	// only saved once ProtonMail has accepted the new ones.
+	changed := false
+	err = auth.UpdateCachedAuth(username, bridgePassword, func(cachedAuth *auth.CachedAuth) error {
+		singlePassword := cachedAuth.PasswordMode == protonmail.PasswordSingle
+		if singlePassword && *mailbox {
+			return errors.New("the account uses a single password, -mailbox can't be used")
+		}
+
+		prompt := "login password"
+		if singlePassword {
+			prompt = "password"
+		} else if *mailbox {
+			prompt = "mailbox password"
+		}
+		newPassword, err := askNewPassword(prompt)
+		if err != nil {
+			return err
+		}
+
+		tf := &cachedAuth.TwoFactor
+		var code string
+		if tf.TOTP == 1 || tf.Enabled&protonmail.TwoFactorTOTP != 0 {
+			scanner := bufio.NewScanner(os.Stdin)
+			fmt.Printf("2FA TOTP code: ")
+			scanner.Scan()
+			code = scanner.Text()
+		} else if tf.Enabled != 0 {
+			return errors.New("changing passwords requires a TOTP code, security keys aren't supported")
+		}
+
+		if singlePassword || *mailbox {
+			keySalts, err := c.ChangeMailboxPassword(ctx, username, cachedAuth.LoginPassword, newPassword, code, singlePassword)
+			if err != nil {
+				return err
+			}
+			changed = true
+			cachedAuth.MailboxPassword = newPassword
+			cachedAuth.KeySalts = keySalts
+			if singlePassword {
+				cachedAuth.LoginPassword = newPassword
+			}
+		} else {
+			if err := c.ChangeLoginPassword(ctx, username, cachedAuth.LoginPassword, newPassword, code); err != nil {
+				return err
+			}
+			changed = true
+			cachedAuth.LoginPassword = newPassword
+		}
+		return nil
+	})
+	if err != nil && changed {
+		log.Fatalf("password changed on ProtonMail, but the new one couldn't be saved: %v\nRun \"hydroxide auth %v\" to log in with the new password", err, username)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println("Password changed")
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+
+	"github.com/emersion/hydroxide/auth"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+const composeUsage = "usage: hydroxide compose [-username <username>] <mailto-url>"
+
+// mailtoFields are the header fields which can be set by a mailto URL, by
+// lower-case name. Other fields are ignored, as recommended by RFC 6068:
+// links must not be able to add arbitrary fields to a message.
+var mailtoFields = map[string]string{
+	"to":          "To",
+	"cc":          "Cc",
+	"bcc":         "Bcc",
+	"subject":     "Subject",
+	"in-reply-to": "In-Reply-To",
+}
+
+// parseMailto parses a mailto URL (RFC 6068) into a message header and body.
+func parseMailto(s string) (textproto.Header, string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return textproto.Header{}, "", err
+	}
+	if !strings.EqualFold(u.Scheme, "mailto") {
+		return textproto.Header{}, "", fmt.Errorf("not a mailto URL: %q", s)
+	}
+
+	var h textproto.Header
+	values := make(map[string][]string)
+	if u.Opaque != "" {
+		addr, err := url.PathUnescape(u.Opaque)
+		if err != nil {
+			return textproto.Header{}, "", err
+		}
+		values["To"] = append(values["To"], addr)
+	}
+
+	// url.ParseQuery can't be used because "+" isn't a space in mailto URLs
+	var body string
+	for _, field := range strings.Split(u.RawQuery, "&") {
+		if field == "" {
+			continue
+		}
+		kv := strings.SplitN(field, "=", 2)
+		k, err := url.PathUnescape(kv[0])
+		if err != nil {
+			return textproto.Header{}, "", err
+		}
+		var v string
+		if len(kv) == 2 {
+			if v, err = url.PathUnescape(kv[1]); err != nil {
+				return textproto.Header{}, "", err
+			}
+		}
+
+		k = strings.ToLower(k)
+		if k == "body" {
+			body = v
+			continue
+		}
+		name, ok := mailtoFields[k]
+		if !ok {
+			continue
+		}
+		// Line breaks would start a new header field in the draft
+		v = strings.Join(strings.FieldsFunc(v, func(r rune) bool {
+			return r == '\r' || r == '\n'
+		}), " ")
+		values[name] = append(values[name], v)
+	}
+
+	// Address lists can be split across several fields
+	for _, name := range []string{"To", "Cc", "Bcc"} {
+		if l := values[name]; len(l) > 0 {
+			h.Set(name, strings.Join(l, ", "))
+		}
+	}
+	for _, name := range []string{"Subject", "In-Reply-To"} {
+		if l := values[name]; len(l) > 0 {
+			h.Set(name, l[0])
+		}
+	}
+	return h, body, nil
+}
+
+func defaultAddress(ctx context.Context, c *protonmail.Client) (string, error) {
+	addrs, err := c.ListAddresses(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		if addr.Send == protonmail.AddressSendPrimary && addr.Status == protonmail.AddressEnabled {
+			return addr.Email, nil
+		}
+	}
+	for _, addr := range addrs {
+		if addr.Status == protonmail.AddressEnabled {
+			return addr.Email, nil
+		}
+	}
+	return "", errors.New("no enabled address")
+}
+
+// defaultUsername returns the username passed on the command line, or the
+// only logged in user.
+func defaultUsername(username string) (string, error) {
+	if username != "" {
+		return username, nil
+	}
+
+	usernames, err := auth.ListUsernames()
+	if err != nil {
+		return "", err
+	}
+	if len(usernames) != 1 {
+		return "", errors.New("no username specified and not exactly one logged in user")
+	}
+	return usernames[0], nil
+}
+
+func formatDraft(h textproto.Header, body string) []byte {
+	var b bytes.Buffer
+	for _, k := range []string{"From", "To", "Cc", "Bcc", "Subject"} {
+		fmt.Fprintf(&b, "%v: %v\n", k, h.Get(k))
+		h.Del(k)
+	}
+	fields := h.Fields()
+	for fields.Next() {
+		fmt.Fprintf(&b, "%v: %v\n", fields.Key(), fields.Value())
+	}
+	b.WriteString("\n")
+	b.WriteString(body)
+	return b.Bytes()
+}
+
+// editText opens $EDITOR to edit text. The temporary file name ends with
+// suffix, which allows editors to pick the right syntax. It returns nil if the
+// text hasn't been changed.
+func editText(text []byte, suffix string) ([]byte, error) {
+	f, err := ioutil.TempFile("", "hydroxide-*"+suffix)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(text)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	cmd := exec.Command("sh", "-c", editor+` "$1"`, "sh", f.Name())
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("editor failed: %v", err)
+	}
+
+	edited, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(edited, text) {
+		return nil, nil
+	}
+	return edited, nil
+}
+
+// formatMessage turns an edited draft into a message suitable for sending.
+func formatMessage(draft []byte) ([]byte, error) {
+	br := bufio.NewReader(bytes.NewReader(draft))
+	h, err := textproto.ReadHeader(br)
+	if err != nil {
+		return nil, fmt.Errorf("invalid draft header: %v", err)
+	}
+
+	// Drop fields left empty in the draft
+	fields := h.Fields()
+	for fields.Next() {
+		if strings.TrimSpace(fields.Value()) == "" {
+			fields.Del()
+		}
+	}
+
+	if !h.Has("Date") {
+		h.Set("Date", time.Now().Format(time.RFC1123Z))
+	}
+	if !h.Has("Content-Type") {
+		h.Set("Mime-Version", "1.0")
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+
+	var b bytes.Buffer
+	if err := textproto.WriteHeader(&b, h); err != nil {
+		return nil, err
+	}
+	if _, err := b.ReadFrom(br); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func composeCommand(args []string) {
+	ctx := context.Background()
+
+	fs := flag.NewFlagSet("compose", flag.ExitOnError)
+	username := fs.String("username", "", "account to send the message from")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatal(composeUsage)
+	}
+
+	h, body, err := parseMailto(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	*username, err = defaultUsername(*username)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	bridgePassword, err := askBridgePassword(*username)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	authManager := auth.NewManager(newClient)
+	c, _, err := authManager.Auth(ctx, *username, bridgePassword)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	from, err := defaultAddress(ctx, c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	h.Set("From", from)
+
+	draft, err := editText(formatDraft(h, body), ".eml")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if draft == nil {
+		log.Fatal("draft unchanged, message not sent")
+	}
+
+	msg, err := formatMessage(draft)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := sendMessage(authManager, *username, bridgePassword, nil, bytes.NewReader(msg)); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println("Message sent")
+}
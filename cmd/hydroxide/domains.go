@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+const domainsUsage = `usage: hydroxide domains list <username>
+       hydroxide domains catch-all <username> <domain> [address]`
+
+func findDomain(ctx context.Context, c *protonmail.Client, name string) (*protonmail.Domain, error) {
+	domains, err := c.ListDomains(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range domains {
+		if strings.EqualFold(d.DomainName, name) {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown domain %q", name)
+}
+
+func domainsCommand(args []string) {
+	ctx := context.Background()
+
+	if len(args) < 2 {
+		log.Fatal(domainsUsage)
+	}
+	subcmd, username := args[0], args[1]
+
+	switch subcmd {
+	case "list":
+		c, _, err := login(ctx, username)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		domains, err := c.ListDomains(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "DOMAIN\tVERIFY\tMX\tSPF\tDKIM\tDMARC\tCATCH-ALL")
+		for _, d := range domains {
+			addrs, err := c.ListDomainAddresses(ctx, d.ID)
+			if err != nil {
+				log.Fatal(err)
+			}
+			catchAll := "-"
+			for _, addr := range addrs {
+				if addr.CatchAll == 1 {
+					catchAll = addr.Email
+				}
+			}
+
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", d.DomainName, d.VerifyState, d.MxState, d.SpfState, d.DkimState, d.DmarcState, catchAll)
+		}
+		tw.Flush()
+	case "catch-all":
+		if len(args) < 3 {
+			log.Fatal(domainsUsage)
+		}
+		domainName := args[2]
+		email := ""
+		if len(args) > 3 {
+			email = args[3]
+		}
+
+		c, _, err := login(ctx, username)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		d, err := findDomain(ctx, c, domainName)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var addressID string
+		if email != "" {
+			addrs, err := c.ListDomainAddresses(ctx, d.ID)
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, addr := range addrs {
+				if strings.EqualFold(addr.Email, email) {
+					addressID = addr.ID
+					break
+				}
+			}
+			if addressID == "" {
+				log.Fatalf("address %q doesn't belong to domain %q", email, d.DomainName)
+			}
+		}
+
+		if _, err := c.SetCatchAll(ctx, d.ID, addressID); err != nil {
+			log.Fatal(err)
+		}
+
+		if email != "" {
+			fmt.Printf("Catch-all address for %v set to %v\n", d.DomainName, email)
+		} else {
+			fmt.Printf("Catch-all disabled for %v\n", d.DomainName)
+		}
+	default:
+		log.Fatal(domainsUsage)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+const filtersUsage = `usage: hydroxide filters list [-json] <username>
+       hydroxide filters show <username> <name>
+       hydroxide filters create [-disabled] [-simple] <username> <name> <file>
+       hydroxide filters edit <username> <name>
+       hydroxide filters enable|disable|delete <username> <name>
+       hydroxide filters order <username> <name>...`
+
+func findFilter(ctx context.Context, c *protonmail.Client, name string) (*protonmail.Filter, error) {
+	filters, err := c.ListFilters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return lookupFilter(filters, name)
+}
+
+func lookupFilter(filters []*protonmail.Filter, name string) (*protonmail.Filter, error) {
+	for _, filter := range filters {
+		if strings.EqualFold(filter.Name, name) {
+			return filter, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown filter %q", name)
+}
+
+// checkSieve validates a Sieve script with the API, printing issues.
+func checkSieve(ctx context.Context, c *protonmail.Client, sieve string) error {
+	issues, err := c.CheckSieve(ctx, sieve)
+	if err != nil {
+		return err
+	}
+	if len(issues) == 0 {
+		return nil
+	}
+
+	for _, issue := range issues {
+		fmt.Fprintf(os.Stderr, "line %v, column %v: %v\n", issue.Line, issue.Column, issue.Message)
+	}
+	return errors.New("invalid Sieve script")
+}
+
+func formatFilterStatus(status protonmail.FilterStatus) string {
+	if status == protonmail.FilterEnabled {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+func filtersCommand(args []string) {
+	ctx := context.Background()
+
+	if len(args) < 1 {
+		log.Fatal(filtersUsage)
+	}
+	subcmd := args[0]
+
+	fs := flag.NewFlagSet("filters "+subcmd, flag.ExitOnError)
+	switch subcmd {
+	case "list":
+		asJSON := fs.Bool("json", false, "print filters as JSON")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			log.Fatal(filtersUsage)
+		}
+
+		c, _, err := login(ctx, fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		filters, err := c.ListFilters(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if *asJSON {
+			if filters == nil {
+				filters = []*protonmail.Filter{}
+			}
+			if err := json.NewEncoder(os.Stdout).Encode(filters); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "NAME\tSTATUS\tPRIORITY\n")
+		for _, filter := range filters {
+			fmt.Fprintf(tw, "%v\t%v\t%v\n", filter.Name, formatFilterStatus(filter.Status), filter.Priority)
+		}
+		tw.Flush()
+	case "show":
+		fs.Parse(args[1:])
+		if fs.NArg() != 2 {
+			log.Fatal(filtersUsage)
+		}
+
+		c, _, err := login(ctx, fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		filter, err := findFilter(ctx, c, fs.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Print(filter.Sieve)
+		if !strings.HasSuffix(filter.Sieve, "\n") {
+			fmt.Println()
+		}
+	case "create":
+		disabled := fs.Bool("disabled", false, "create the filter disabled")
+		simple := fs.Bool("simple", false, "the file contains a simple filter as JSON instead of a Sieve script")
+		fs.Parse(args[1:])
+		if fs.NArg() != 3 {
+			log.Fatal(filtersUsage)
+		}
+
+		b, err := ioutil.ReadFile(fs.Arg(2))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		filter := &protonmail.Filter{
+			Name:    fs.Arg(1),
+			Status:  protonmail.FilterEnabled,
+			Version: protonmail.FilterVersion,
+			Sieve:   string(b),
+		}
+		if *simple {
+			var simpleFilter protonmail.SimpleFilter
+			if err := json.Unmarshal(b, &simpleFilter); err != nil {
+				log.Fatalf("invalid simple filter: %v", err)
+			}
+			filter, err = protonmail.NewSimpleFilter(fs.Arg(1), &simpleFilter)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		c, _, err := login(ctx, fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := checkSieve(ctx, c, filter.Sieve); err != nil {
+			log.Fatal(err)
+		}
+
+		if *disabled {
+			filter.Status = protonmail.FilterDisabled
+		}
+		if _, err := c.CreateFilter(ctx, filter); err != nil {
+			log.Fatal(err)
+		}
+	case "edit":
+		fs.Parse(args[1:])
+		if fs.NArg() != 2 {
+			log.Fatal(filtersUsage)
+		}
+
+		c, _, err := login(ctx, fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		filter, err := findFilter(ctx, c, fs.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		sieve := []byte(filter.Sieve)
+		for {
+			edited, err := editText(sieve, ".sieve")
+			if err != nil {
+				log.Fatal(err)
+			}
+			if edited == nil {
+				log.Fatal("filter unchanged")
+			}
+			sieve = edited
+
+			err = checkSieve(ctx, c, string(sieve))
+			if err == nil {
+				break
+			}
+			log.Printf("%v, editing again", err)
+		}
+
+		filter.Version = protonmail.FilterVersion
+		filter.Sieve = string(sieve)
+		// The script doesn't match the simple filter anymore
+		filter.Simple = nil
+		if _, err := c.UpdateFilter(ctx, filter); err != nil {
+			log.Fatal(err)
+		}
+	case "enable", "disable", "delete":
+		fs.Parse(args[1:])
+		if fs.NArg() != 2 {
+			log.Fatal(filtersUsage)
+		}
+
+		c, _, err := login(ctx, fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		filter, err := findFilter(ctx, c, fs.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		switch subcmd {
+		case "enable":
+			_, err = c.EnableFilter(ctx, filter.ID)
+		case "disable":
+			_, err = c.DisableFilter(ctx, filter.ID)
+		case "delete":
+			err = c.DeleteFilter(ctx, filter.ID)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "order":
+		fs.Parse(args[1:])
+		if fs.NArg() < 2 {
+			log.Fatal(filtersUsage)
+		}
+
+		c, _, err := login(ctx, fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		filters, err := c.ListFilters(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// Filters which aren't listed keep their relative order, after
+		// the listed ones
+		var ids []string
+		listed := make(map[string]bool)
+		for _, name := range fs.Args()[1:] {
+			filter, err := lookupFilter(filters, name)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if !listed[filter.ID] {
+				ids = append(ids, filter.ID)
+				listed[filter.ID] = true
+			}
+		}
+		sort.SliceStable(filters, func(i, j int) bool {
+			return filters[i].Priority < filters[j].Priority
+		})
+		for _, filter := range filters {
+			if !listed[filter.ID] {
+				ids = append(ids, filter.ID)
+			}
+		}
+
+		if err := c.OrderFilters(ctx, ids); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatal(filtersUsage)
+	}
+}
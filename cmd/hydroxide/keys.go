@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+const keysUsage = `usage: hydroxide keys list <username> [address]
+       hydroxide keys generate [-primary] <username> <address>
+       hydroxide keys import [-primary] <username> <address> <file>
+       hydroxide keys rotate <username> <address>
+       hydroxide keys primary <username> <address> <fingerprint>`
+
+// findAddressKey looks up a key of an address by fingerprint. A prefix of at
+// least 8 characters is enough.
+func findAddressKey(addr *protonmail.Address, fingerprint string) (*protonmail.PrivateKey, error) {
+	if len(fingerprint) < 8 {
+		return nil, fmt.Errorf("fingerprint %q is too short", fingerprint)
+	}
+	var found *protonmail.PrivateKey
+	for _, key := range addr.Keys {
+		if strings.HasPrefix(strings.ToLower(key.Fingerprint), strings.ToLower(fingerprint)) {
+			if found != nil {
+				return nil, fmt.Errorf("fingerprint %q is ambiguous", fingerprint)
+			}
+			found = key
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("address %v has no key %q", addr.Email, fingerprint)
+	}
+	return found, nil
+}
+
+func formatKeyFlags(flags protonmail.PrivateKeyFlags) string {
+	var l []string
+	if flags&protonmail.PrivateKeyVerify != 0 {
+		l = append(l, "verify")
+	}
+	if flags&protonmail.PrivateKeyEncrypt != 0 {
+		l = append(l, "encrypt")
+	}
+	if len(l) == 0 {
+		return "-"
+	}
+	return strings.Join(l, ",")
+}
+
+// readPrivateKey reads an armored private key, asking for its passphrase if
+// it's encrypted.
+func readPrivateKey(path string) (*openpgp.Entity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	el, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %v: %v", path, err)
+	}
+	if len(el) != 1 {
+		return nil, fmt.Errorf("%v must contain exactly one key, found %v", path, len(el))
+	}
+	e := el[0]
+	if e.PrivateKey == nil {
+		return nil, fmt.Errorf("%v doesn't contain a private key", path)
+	}
+
+	if e.PrivateKey.Encrypted {
+		passphrase, err := askPassphrase("Key passphrase")
+		if err != nil {
+			return nil, err
+		}
+		if err := e.PrivateKey.Decrypt(passphrase); err != nil {
+			return nil, errors.New("invalid key passphrase")
+		}
+		for _, sub := range e.Subkeys {
+			if sub.PrivateKey != nil && sub.PrivateKey.Encrypted {
+				if err := sub.PrivateKey.Decrypt(passphrase); err != nil {
+					return nil, errors.New("invalid key passphrase")
+				}
+			}
+		}
+	}
+	return e, nil
+}
+
+func keysCommand(args []string) {
+	ctx := context.Background()
+
+	if len(args) < 1 {
+		log.Fatal(keysUsage)
+	}
+	subcmd := args[0]
+
+	fs := flag.NewFlagSet("keys "+subcmd, flag.ExitOnError)
+	switch subcmd {
+	case "list":
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 && fs.NArg() != 2 {
+			log.Fatal(keysUsage)
+		}
+
+		c, _, err := login(ctx, fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		addrs, err := c.ListAddresses(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "ADDRESS\tFINGERPRINT\tPRIMARY\tFLAGS")
+		for _, addr := range addrs {
+			if fs.NArg() == 2 && !strings.EqualFold(addr.Email, fs.Arg(1)) {
+				continue
+			}
+			for _, key := range addr.Keys {
+				fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", addr.Email, key.Fingerprint, formatBool(key.Primary == 1), formatKeyFlags(key.Flags))
+			}
+		}
+		tw.Flush()
+	case "generate", "import", "rotate":
+		primary := subcmd == "rotate"
+		if subcmd != "rotate" {
+			fs.BoolVar(&primary, "primary", false, "make the new key the primary key of the address")
+		}
+		fs.Parse(args[1:])
+		nargs := 2
+		if subcmd == "import" {
+			nargs = 3
+		}
+		if fs.NArg() != nargs {
+			log.Fatal(keysUsage)
+		}
+
+		var e *openpgp.Entity
+		if subcmd == "import" {
+			var err error
+			if e, err = readPrivateKey(fs.Arg(2)); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		c, _, err := login(ctx, fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		addr, err := findAddress(ctx, c, fs.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var key *protonmail.PrivateKey
+		if e != nil {
+			key, err = c.ImportAddressKey(ctx, addr, e, primary)
+		} else {
+			key, _, err = c.CreateAddressKey(ctx, addr, primary)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if key.Primary == 1 {
+			fmt.Printf("Added primary key %v to %v\n", key.Fingerprint, addr.Email)
+		} else {
+			fmt.Printf("Added key %v to %v\n", key.Fingerprint, addr.Email)
+		}
+	case "primary":
+		fs.Parse(args[1:])
+		if fs.NArg() != 3 {
+			log.Fatal(keysUsage)
+		}
+
+		c, _, err := login(ctx, fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		addr, err := findAddress(ctx, c, fs.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		key, err := findAddressKey(addr, fs.Arg(2))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := c.MakeAddressKeyPrimary(ctx, addr, key.ID); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Primary key of %v set to %v\n", addr.Email, key.Fingerprint)
+	default:
+		log.Fatal(keysUsage)
+	}
+}
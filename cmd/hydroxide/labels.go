@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+const labelsUsage = `usage: hydroxide labels list [-json] <username>
+       hydroxide labels create [-folder] [-parent <folder>] [-color <color>] <username> <name>
+       hydroxide labels rename <username> <name> <new-name>
+       hydroxide labels color <username> <name> <color>
+       hydroxide labels move <username> <folder> [parent]
+       hydroxide labels order <username> <name>...
+       hydroxide labels delete <username> <name>`
+
+const defaultLabelColor = "#8080FF"
+
+var labelColorRegexp = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+type labelInfo struct {
+	ID     string
+	Name   string
+	Color  string
+	Folder bool
+}
+
+func checkLabelColor(color string) error {
+	if !labelColorRegexp.MatchString(color) {
+		return fmt.Errorf("invalid color %q: expected #RRGGBB", color)
+	}
+	return nil
+}
+
+func findLabel(ctx context.Context, c *protonmail.Client, name string) (*protonmail.Label, error) {
+	labels, err := c.ListLabels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return lookupLabel(labels, name)
+}
+
+func lookupLabel(labels []*protonmail.Label, name string) (*protonmail.Label, error) {
+	for _, label := range labels {
+		if label.Type == protonmail.LabelMessage && strings.EqualFold(label.Name, name) {
+			return label, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown label %q", name)
+}
+
+func labelsCommand(args []string) {
+	ctx := context.Background()
+
+	if len(args) < 1 {
+		log.Fatal(labelsUsage)
+	}
+	subcmd := args[0]
+
+	fs := flag.NewFlagSet("labels "+subcmd, flag.ExitOnError)
+	switch subcmd {
+	case "list":
+		asJSON := fs.Bool("json", false, "print labels as JSON")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			log.Fatal(labelsUsage)
+		}
+
+		c, _, err := login(ctx, fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		labels, err := c.ListLabels(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		sort.SliceStable(labels, func(i, j int) bool {
+			return labels[i].Order < labels[j].Order
+		})
+
+		infos := []*labelInfo{}
+		for _, label := range labels {
+			if label.Type != protonmail.LabelMessage {
+				continue
+			}
+			infos = append(infos, &labelInfo{
+				ID:     label.ID,
+				Name:   label.Name,
+				Color:  label.Color,
+				Folder: label.Exclusive != 0,
+			})
+		}
+
+		if *asJSON {
+			if err := json.NewEncoder(os.Stdout).Encode(infos); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "NAME\tTYPE\tCOLOR\tID\n")
+		for _, info := range infos {
+			kind := "label"
+			if info.Folder {
+				kind = "folder"
+			}
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", info.Name, kind, info.Color, info.ID)
+		}
+		tw.Flush()
+	case "create":
+		folder := fs.Bool("folder", false, "create a folder instead of a label")
+		parent := fs.String("parent", "", "parent folder of the new folder")
+		color := fs.String("color", defaultLabelColor, "label color, as #RRGGBB")
+		fs.Parse(args[1:])
+		if fs.NArg() != 2 {
+			log.Fatal(labelsUsage)
+		}
+		if err := checkLabelColor(*color); err != nil {
+			log.Fatal(err)
+		}
+
+		c, _, err := login(ctx, fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		label := &protonmail.Label{
+			Name:  fs.Arg(1),
+			Color: *color,
+			Type:  protonmail.LabelMessage,
+		}
+		if *folder {
+			label.Exclusive = 1
+		}
+		if *parent != "" {
+			if !*folder {
+				log.Fatal("only folders can have a parent")
+			}
+			p, err := findLabel(ctx, c, *parent)
+			if err != nil {
+				log.Fatal(err)
+			}
+			label.ParentID = p.ID
+		}
+		created, err := c.CreateLabel(ctx, label)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(created.ID)
+	case "rename", "color":
+		fs.Parse(args[1:])
+		if fs.NArg() != 3 {
+			log.Fatal(labelsUsage)
+		}
+		if subcmd == "color" {
+			if err := checkLabelColor(fs.Arg(2)); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		c, _, err := login(ctx, fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		label, err := findLabel(ctx, c, fs.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if subcmd == "rename" {
+			label.Name = fs.Arg(2)
+		} else {
+			label.Color = fs.Arg(2)
+		}
+		if _, err := c.UpdateLabel(ctx, label); err != nil {
+			log.Fatal(err)
+		}
+	case "move":
+		fs.Parse(args[1:])
+		if fs.NArg() != 2 && fs.NArg() != 3 {
+			log.Fatal(labelsUsage)
+		}
+
+		c, _, err := login(ctx, fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		folder, err := findLabel(ctx, c, fs.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if folder.Exclusive == 0 {
+			log.Fatalf("%q is a label, only folders can be nested", folder.Name)
+		}
+		folder.ParentID = ""
+		if fs.NArg() == 3 {
+			parent, err := findLabel(ctx, c, fs.Arg(2))
+			if err != nil {
+				log.Fatal(err)
+			}
+			folder.ParentID = parent.ID
+		}
+		if _, err := c.UpdateLabel(ctx, folder); err != nil {
+			log.Fatal(err)
+		}
+	case "order":
+		fs.Parse(args[1:])
+		if fs.NArg() < 2 {
+			log.Fatal(labelsUsage)
+		}
+
+		c, _, err := login(ctx, fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		labels, err := c.ListLabels(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sort.SliceStable(labels, func(i, j int) bool {
+			return labels[i].Order < labels[j].Order
+		})
+
+		// The given labels come first, the others keep their order
+		var ids []string
+		ordered := make(map[string]bool)
+		for _, name := range fs.Args()[1:] {
+			label, err := lookupLabel(labels, name)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if !ordered[label.ID] {
+				ids = append(ids, label.ID)
+				ordered[label.ID] = true
+			}
+		}
+		for _, label := range labels {
+			if label.Type == protonmail.LabelMessage && !ordered[label.ID] {
+				ids = append(ids, label.ID)
+			}
+		}
+		if err := c.OrderLabels(ctx, ids); err != nil {
+			log.Fatal(err)
+		}
+	case "delete":
+		fs.Parse(args[1:])
+		if fs.NArg() != 2 {
+			log.Fatal(labelsUsage)
+		}
+
+		c, _, err := login(ctx, fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		label, err := findLabel(ctx, c, fs.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := c.DeleteLabel(ctx, label.ID); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatal(labelsUsage)
+	}
+}
@@ -3,15 +3,23 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
-	imapmove "github.com/emersion/go-imap-move"
 	imapspacialuse "github.com/emersion/go-imap-specialuse"
 	imapserver "github.com/emersion/go-imap/server"
 	"github.com/emersion/go-mbox"
@@ -21,50 +29,177 @@ import (
 	"golang.org/x/crypto/openpgp/armor"
 
 	"github.com/emersion/hydroxide/auth"
+	"github.com/emersion/hydroxide/caldav"
 	"github.com/emersion/hydroxide/carddav"
 	"github.com/emersion/hydroxide/config"
+	"github.com/emersion/hydroxide/deliver"
 	"github.com/emersion/hydroxide/events"
 	"github.com/emersion/hydroxide/exports"
 	imapbackend "github.com/emersion/hydroxide/imap"
 	"github.com/emersion/hydroxide/imports"
+	"github.com/emersion/hydroxide/keyring"
+	"github.com/emersion/hydroxide/logging"
+	"github.com/emersion/hydroxide/notify"
 	"github.com/emersion/hydroxide/protonmail"
 	smtpbackend "github.com/emersion/hydroxide/smtp"
+	"github.com/emersion/hydroxide/systemd"
+	"github.com/emersion/hydroxide/webdav"
 )
 
-var debug bool
+var (
+	debug      bool
+	bind       string
+	proxyURL   string
+	maxRetries int
+	altRoute   bool
+	ktVRFKey   []byte
+)
 
-func newClient() *protonmail.Client {
-	return &protonmail.Client{
+func newClient(username string) (*protonmail.Client, error) {
+	c := &protonmail.Client{
 		RootURL:    "https://mail.protonmail.com/api",
 		AppVersion: "Web_3.16.6",
 		Debug:      debug,
+		MaxRetries: maxRetries,
+
+		AlternativeRouting: altRoute,
+		KTVRFPublicKey:     ktVRFKey,
+		KTCheckpointUpdated: func(cp *protonmail.KTCheckpoint) {
+			if err := config.SaveKTCheckpoint(cp); err != nil {
+				log.Printf("cannot save key transparency checkpoint: %v", err)
+			}
+		},
+	}
+
+	account, err := config.LoadAccount(username)
+	if err != nil {
+		return nil, err
+	}
+	if c.KTCheckpoint, err = config.LoadKTCheckpoint(); err != nil {
+		return nil, err
+	}
+	bindAddr := bind
+	if account.Bind != "" {
+		bindAddr = account.Bind
+	}
+	if proxyURL != "" {
+		c.HTTPClient, err = protonmail.NewProxyHTTPClient(proxyURL, bindAddr)
+		if err != nil {
+			return nil, err
+		}
+	} else if bindAddr != "" {
+		c.HTTPClient = protonmail.NewBoundHTTPClient(bindAddr)
+	}
+
+	return c, nil
+}
+
+// certHosts returns the host names a self-signed certificate is valid for:
+// localhost and the addresses the frontends listen on.
+func certHosts(listenHosts ...string) []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	seen := map[string]bool{"localhost": true, "127.0.0.1": true, "::1": true}
+	for _, host := range listenHosts {
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			// Listening on all interfaces
+			var err error
+			if host, err = os.Hostname(); err != nil {
+				continue
+			}
+		}
+		if !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// protocolNames contains the display names of frontends.
+var protocolNames = map[string]string{
+	config.ProtocolSMTP:    "SMTP",
+	config.ProtocolIMAP:    "IMAP",
+	config.ProtocolCardDAV: "CardDAV",
+	config.ProtocolCalDAV:  "CalDAV",
+	config.ProtocolWebDAV:  "WebDAV",
+}
+
+// listen opens the socket of a frontend, unless systemd passed one named after
+// the frontend.
+func listen(protocol, addr string, tlsConfig *tls.Config) (net.Listener, error) {
+	name := protocolNames[protocol]
+
+	l, err := systemd.Listener(protocol)
+	if err != nil {
+		return nil, err
+	} else if l != nil {
+		log.Printf("%v server listening on %v, passed by systemd", name, l.Addr())
+	} else {
+		if l, err = net.Listen("tcp", addr); err != nil {
+			return nil, err
+		}
+		if tlsConfig != nil {
+			log.Printf("%v server listening with TLS on %v", name, addr)
+		} else {
+			log.Printf("%v server listening on %v", name, addr)
+		}
+	}
+
+	checkInsecureAddr(name, l.Addr(), tlsConfig)
+	return systemd.Watch(l), nil
+}
+
+// listenAndServe opens the socket of a single frontend and serves it.
+func listenAndServe(protocol, addr string, tlsConfig *tls.Config, serve func(l net.Listener) error) error {
+	l, err := listen(protocol, addr, tlsConfig)
+	if err != nil {
+		return err
+	}
+	notifyReady()
+	return serve(l)
+}
+
+// notifyReady tells systemd that all frontends are listening, and starts
+// pinging its watchdog if enabled, as long as they accept connections.
+func notifyReady() {
+	if err := systemd.Ready(); err != nil {
+		log.Print(err)
+	}
+	systemd.StartWatchdog()
+}
+
+// checkInsecureAddr warns if a frontend without TLS listens on an address
+// reachable from other machines, since bridge passwords would be sent in
+// cleartext.
+func checkInsecureAddr(name string, addr net.Addr, tlsConfig *tls.Config) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if tlsConfig != nil || !ok || tcpAddr.IP.IsLoopback() {
+		return
 	}
+	log.Printf("warning: %v server listening on %v without TLS, passwords are sent in cleartext (see -tls-cert and -tls-self-signed)", name, addr)
 }
 
-func listenAndServeSMTP(addr string, debug bool, authManager *auth.Manager, tlsConfig *tls.Config) error {
-	be := smtpbackend.New(authManager)
+func serveSMTP(l net.Listener, debug bool, authManager *auth.Manager, tlsConfig *tls.Config, options *smtpbackend.Options) error {
+	be := smtpbackend.New(authManager, options)
 	s := smtp.NewServer(be)
-	s.Addr = addr
 	s.Domain = "localhost" // TODO: make this configurable
 	s.AllowInsecureAuth = tlsConfig == nil
 	s.TLSConfig = tlsConfig
+	s.EnableREQUIRETLS = true
+	s.EnableSMTPUTF8 = true
 	if debug {
 		s.Debug = os.Stdout
 	}
 
-	if s.TLSConfig != nil {
-		log.Println("SMTP server listening with TLS on", s.Addr)
-		return s.ListenAndServeTLS()
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
 	}
-
-	log.Println("SMTP server listening on", s.Addr)
-	return s.ListenAndServe()
+	return s.Serve(l)
 }
 
-func listenAndServeIMAP(addr string, debug bool, authManager *auth.Manager, eventsManager *events.Manager, tlsConfig *tls.Config) error {
-	be := imapbackend.New(authManager, eventsManager)
+func serveIMAP(l net.Listener, debug bool, authManager *auth.Manager, eventsManager *events.Manager, tlsConfig *tls.Config, options *imapbackend.Options) error {
+	be := imapbackend.New(authManager, eventsManager, options)
 	s := imapserver.New(be)
-	s.Addr = addr
 	s.AllowInsecureAuth = tlsConfig == nil
 	s.TLSConfig = tlsConfig
 	if debug {
@@ -72,22 +207,25 @@ func listenAndServeIMAP(addr string, debug bool, authManager *auth.Manager, even
 	}
 
 	s.Enable(imapspacialuse.NewExtension())
-	s.Enable(imapmove.NewExtension())
-
-	if s.TLSConfig != nil {
-		log.Println("IMAP server listening with TLS on", s.Addr)
-		return s.ListenAndServeTLS()
+	s.Enable(imapbackend.NewUIDPlusExtension())
+	s.Enable(imapbackend.NewEnableExtension())
+	s.Enable(imapbackend.NewBinaryExtension())
+	s.Enable(imapbackend.NewSaveDateExtension())
+	s.Enable(imapbackend.NewIdleExtension())
+	s.Enable(imapbackend.NewCondStoreExtension())
+	s.Enable(imapbackend.NewThreadExtension())
+
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
 	}
-
-	log.Println("IMAP server listening on", s.Addr)
-	return s.ListenAndServe()
+	return s.Serve(l)
 }
 
-func listenAndServeCardDAV(addr string, authManager *auth.Manager, eventsManager *events.Manager, tlsConfig *tls.Config) error {
+func serveCardDAV(l net.Listener, authManager *auth.Manager, eventsManager *events.Manager, tlsConfig *tls.Config) error {
+	var locker sync.Mutex
 	handlers := make(map[string]http.Handler)
 
 	s := &http.Server{
-		Addr:      addr,
 		TLSConfig: tlsConfig,
 		Handler: http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
 			resp.Header().Set("WWW-Authenticate", "Basic")
@@ -99,7 +237,7 @@ func listenAndServeCardDAV(addr string, authManager *auth.Manager, eventsManager
 				return
 			}
 
-			c, privateKeys, err := authManager.Auth(username, password)
+			c, privateKeys, err := authManager.Auth(req.Context(), username, password)
 			if err != nil {
 				if err == auth.ErrUnauthorized {
 					resp.WriteHeader(http.StatusUnauthorized)
@@ -109,7 +247,13 @@ func listenAndServeCardDAV(addr string, authManager *auth.Manager, eventsManager
 				io.WriteString(resp, err.Error())
 				return
 			}
+			if err := config.CheckProtocol(username, config.ProtocolCardDAV); err != nil {
+				resp.WriteHeader(http.StatusForbidden)
+				io.WriteString(resp, err.Error())
+				return
+			}
 
+			locker.Lock()
 			h, ok := handlers[username]
 			if !ok {
 				ch := make(chan *protonmail.Event)
@@ -118,18 +262,207 @@ func listenAndServeCardDAV(addr string, authManager *auth.Manager, eventsManager
 
 				handlers[username] = h
 			}
+			locker.Unlock()
 
 			h.ServeHTTP(resp, req)
 		}),
 	}
 
 	if s.TLSConfig != nil {
-		log.Println("CardDAV server listening with TLS on", s.Addr)
-		return s.ListenAndServeTLS("", "")
+		return s.ServeTLS(l, "", "")
 	}
+	return s.Serve(l)
+}
 
-	log.Println("CardDAV server listening on", s.Addr)
-	return s.ListenAndServe()
+func serveCalDAV(l net.Listener, authManager *auth.Manager, tlsConfig *tls.Config) error {
+	var locker sync.Mutex
+	handlers := make(map[string]http.Handler)
+
+	s := &http.Server{
+		TLSConfig: tlsConfig,
+		Handler: http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			resp.Header().Set("WWW-Authenticate", "Basic")
+
+			username, password, ok := req.BasicAuth()
+			if !ok {
+				resp.WriteHeader(http.StatusUnauthorized)
+				io.WriteString(resp, "Credentials are required")
+				return
+			}
+
+			c, privateKeys, err := authManager.Auth(req.Context(), username, password)
+			if err != nil {
+				if err == auth.ErrUnauthorized {
+					resp.WriteHeader(http.StatusUnauthorized)
+				} else {
+					resp.WriteHeader(http.StatusInternalServerError)
+				}
+				io.WriteString(resp, err.Error())
+				return
+			}
+			if err := config.CheckProtocol(username, config.ProtocolCalDAV); err != nil {
+				resp.WriteHeader(http.StatusForbidden)
+				io.WriteString(resp, err.Error())
+				return
+			}
+
+			locker.Lock()
+			h, ok := handlers[username]
+			if !ok {
+				h = caldav.NewHandler(c, privateKeys)
+				handlers[username] = h
+			}
+			locker.Unlock()
+
+			h.ServeHTTP(resp, req)
+		}),
+	}
+
+	if s.TLSConfig != nil {
+		return s.ServeTLS(l, "", "")
+	}
+	return s.Serve(l)
+}
+
+func serveWebDAV(l net.Listener, authManager *auth.Manager, tlsConfig *tls.Config) error {
+	var locker sync.Mutex
+	handlers := make(map[string]http.Handler)
+
+	s := &http.Server{
+		TLSConfig: tlsConfig,
+		Handler: http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			resp.Header().Set("WWW-Authenticate", "Basic")
+
+			username, password, ok := req.BasicAuth()
+			if !ok {
+				resp.WriteHeader(http.StatusUnauthorized)
+				io.WriteString(resp, "Credentials are required")
+				return
+			}
+
+			c, privateKeys, err := authManager.Auth(req.Context(), username, password)
+			if err != nil {
+				if err == auth.ErrUnauthorized {
+					resp.WriteHeader(http.StatusUnauthorized)
+				} else {
+					resp.WriteHeader(http.StatusInternalServerError)
+				}
+				io.WriteString(resp, err.Error())
+				return
+			}
+			if err := config.CheckProtocol(username, config.ProtocolWebDAV); err != nil {
+				resp.WriteHeader(http.StatusForbidden)
+				io.WriteString(resp, err.Error())
+				return
+			}
+
+			locker.Lock()
+			h, ok := handlers[username]
+			if !ok {
+				h = webdav.NewHandler(c, privateKeys)
+				handlers[username] = h
+			}
+			locker.Unlock()
+
+			h.ServeHTTP(resp, req)
+		}),
+	}
+
+	if s.TLSConfig != nil {
+		return s.ServeTLS(l, "", "")
+	}
+	return s.Serve(l)
+}
+
+// askBridgePassword reads the bridge password of a user from the OS keyring
+// if the account is configured to store it there, or asks for it otherwise.
+func askBridgePassword(username string) (string, error) {
+	if pass, ok := keyringPassword(username); ok {
+		return pass, nil
+	}
+
+	fmt.Fprintf(os.Stderr, "Bridge password: ")
+	pass, err := gopass.GetPasswd()
+	if err != nil {
+		return "", err
+	}
+	return string(pass), nil
+}
+
+// keyringPassword reads the bridge password of a user from the OS keyring, if
+// enabled for the account. Errors are logged and the caller falls back to
+// asking for the password.
+func keyringPassword(username string) (string, bool) {
+	account, err := config.LoadAccount(username)
+	if err != nil || !account.Keyring {
+		return "", false
+	}
+	pass, err := keyring.Get(username)
+	if err != nil {
+		log.Printf("cannot read bridge password from keyring: %v", err)
+		return "", false
+	}
+	return pass, true
+}
+
+// isProtocolUsed checks whether at least one logged in account can use a
+// frontend. If there are no accounts yet, all frontends are considered used.
+func isProtocolUsed(protocol string) (bool, error) {
+	usernames, err := auth.ListUsernames()
+	if err != nil {
+		return false, err
+	}
+	if len(usernames) == 0 {
+		return true, nil
+	}
+
+	accounts, err := config.LoadAccounts()
+	if err != nil {
+		return false, err
+	}
+	for _, username := range usernames {
+		account, ok := accounts[username]
+		if !ok || account == nil || account.ProtocolEnabled(protocol) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// login asks for the bridge password and authenticates the user.
+func login(ctx context.Context, username string) (*protonmail.Client, openpgp.EntityList, error) {
+	bridgePassword, err := askBridgePassword(username)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return auth.NewManager(newClient).Auth(ctx, username, bridgePassword)
+}
+
+// parseRetention parses a comma-separated list of mailbox=days pairs.
+func parseRetention(s string) (map[string]time.Duration, error) {
+	retention := make(map[string]time.Duration)
+	if s == "" {
+		return retention, nil
+	}
+
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid retention policy %q: expected <mailbox>=<days>", item)
+		}
+		days, err := strconv.Atoi(parts[1])
+		if err != nil || days <= 0 {
+			return nil, fmt.Errorf("invalid retention policy %q: invalid number of days", item)
+		}
+		// Messages in these mailboxes are also in another folder, moving
+		// them to Trash doesn't necessarily remove them from the mailbox
+		if strings.EqualFold(parts[0], "All Mail") || strings.EqualFold(parts[0], "Starred") {
+			return nil, fmt.Errorf("invalid retention policy %q: retention can't be applied to %v", item, parts[0])
+		}
+		retention[parts[0]] = time.Duration(days) * 24 * time.Hour
+	}
+	return retention, nil
 }
 
 func isMbox(br *bufio.Reader) (bool, error) {
@@ -141,21 +474,93 @@ func isMbox(br *bufio.Reader) (bool, error) {
 	return bytes.Equal(b, prefix), nil
 }
 
+// importLabels returns the labels of messages imported into the folder or
+// label named name. Messages imported into a label are also archived, since
+// they must be in a folder.
+func importLabels(ctx context.Context, c *protonmail.Client, name string) ([]string, error) {
+	for _, data := range systemFolders {
+		if !strings.EqualFold(data.name, name) {
+			continue
+		}
+		if data.label == protonmail.LabelStarred {
+			return []string{protonmail.LabelInbox, protonmail.LabelStarred}, nil
+		}
+		return []string{data.label}, nil
+	}
+
+	labels, err := c.ListLabels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	label, err := lookupLabel(labels, name)
+	if err != nil {
+		return nil, err
+	}
+	if label.Exclusive == 1 {
+		return []string{label.ID}, nil
+	}
+	return []string{protonmail.LabelArchive, label.ID}, nil
+}
+
 const usage = `usage: hydroxide [options...] <command>
 Commands:
-	auth <username>		Login to ProtonMail via hydroxide
+	activate-pm-me <username>	Activate the pm.me address of the account
+	account <username> [<setting> <value>]	View or change local account settings (imap, smtp, carddav, caldav, webdav, require-tls, cleartext, key-discovery, key-pinning, key-transparency, autocrypt, pgp-mime, protected-headers, attach-public-key, bind, keyring)
+	addresses list|create|order <username> ...	Manage addresses of the account
+	auth [-keyring] <username>	Login to ProtonMail via hydroxide
+	auto-delete <username> [days]	View or set the Spam and Trash auto-delete delay
+	bridge-password list|add|revoke <username> ...	Manage per-application bridge passwords
+	caldav			Run hydroxide as a CalDAV server
+	change-password [-mailbox] <username>	Change the ProtonMail password of the account
 	carddav			Run hydroxide as a CardDAV server
-	export-secret-keys <username> Export secret keys
+	compose [-username <username>] <mailto-url>	Write a message in $EDITOR and send it
+	domains list <username>	List custom domains and their DNS status
+	domains catch-all <username> <domain> [address]	Set or disable the catch-all address of a domain
+	export-calendar [-dir <directory>] <username>	Export decrypted calendars as iCalendar files
+	export-contacts [-dir <directory>] <username>	Export decrypted contacts as vCards
+	export-config <file>	Export accounts, settings and local databases to a passphrase-encrypted file
+	export-secret-keys [-encrypt] <username> [address...]	Export secret keys, optionally only those of some addresses
 	imap			Run hydroxide as an IMAP server
-	import-messages <username> <file>	Import messages
+	filters list|show|create|edit|enable|disable|delete|order <username> ...	Manage filters
+	import-config [-force] <file>	Import a file created by export-config
+	import-messages [-label <name>] [-workers <n>] <username> <file|maildir>	Import messages from an mbox file, a Maildir or a single message
+	keys list|generate|import|rotate|primary <username> ...	Manage the keys of addresses
+	notify [-open-command <command>] <username>	Show desktop notifications for new messages
+	deliver -lmtp <address>|-command <command> [-rcpt <address>] <username>	Deliver new messages to a local MDA over LMTP or with a command
 	export-messages [options...] <username>	Export messages
+	labels list|create|rename|color|move|order|delete <username> ...	Manage labels and folders
+	messages list [options...] <username>	List recent messages of a folder
+	messages show [-attachments <dir>] <username> <id>	Print a decrypted message
+	pins list|update|remove|trust|untrust <username> ...	Manage public keys pinned for recipients
+	search [options...] <username> [query]	Search messages
+	send <username> [recipient...]	Send a message read from stdin
 	serve			Run all servers
+	settings <username> [<setting> <value>]...	View or change mail settings stored by ProtonMail (display-name, signature, proton-signature, auto-reply, pgp-scheme, sign, attach-public-key, composer-mode, draft-type, swipe-left, swipe-right)
 	smtp			Run hydroxide as an SMTP server
 	status			View hydroxide status
+	unread [-json] [-follow] [-conversations] [-listen <address>] <username>	Print the number of unread messages of each folder
+	vacation show|on|off [options...] <username>	View or change the auto-reply of the account
+	webdav			Run hydroxide as a WebDAV server for Proton Drive
 
 Global options:
+	-config /path/to/hydroxide.yaml
+		YAML configuration file, setting the options below (Optional)
+	-data-dir /var/lib/hydroxide
+		Directory containing accounts, settings and local databases, defaults to $XDG_CONFIG_HOME/hydroxide (Optional)
 	-debug
-		Enable debug logs
+		Enable debug logs, including raw IMAP and SMTP traffic
+	-log-level warn,imap=debug
+		Minimum level of log messages (debug, info, warn or error), optionally per subsystem (protonmail, imap, smtp, events or deliver), defaults to info
+	-log-format json
+		Format of log messages, text (the default) or json
+	-bind tun0
+		Local IP address or network interface used for connections to ProtonMail, connections fail if the interface is down (Optional)
+	-proxy socks5://127.0.0.1:9050
+		SOCKS5 proxy for connections to ProtonMail, e.g. Tor, host names are resolved by the proxy (Optional)
+	-alternative-routing
+		Look up alternative routes to ProtonMail with DNS-over-HTTPS when it's unreachable, can't be used with -proxy
+	-kt-vrf-key <hex>
+		Public key of the VRF used by ProtonMail for key transparency, required by the key-transparency account setting (Optional)
 	-smtp-host example.com
 		Allowed SMTP email hostname on which hydroxide listens, defaults to 127.0.0.1
 	-imap-host example.com
@@ -168,15 +573,58 @@ Global options:
 		IMAP port on which hydroxide listens, defaults to 1143
 	-carddav-port example.com
 		CardDAV port on which hydroxide listens, defaults to 8080
+	-caldav-host example.com
+		Allowed CalDAV hostname on which hydroxide listens, defaults to 127.0.0.1
+	-caldav-port example.com
+		CalDAV port on which hydroxide listens, defaults to 8081
+	-webdav-host example.com
+		Allowed WebDAV hostname on which hydroxide listens, defaults to 127.0.0.1
+	-webdav-port example.com
+		WebDAV port on which hydroxide listens, defaults to 8082
 	-tls-cert /path/to/cert.pem
 		Path to the certificate to use for incoming connections (Optional)
 	-tls-key /path/to/key.pem
 		Path to the certificate key to use for incoming connections (Optional)
 	-tls-client-ca /path/to/ca.pem
-		If set, clients must provide a certificate signed by the given CA (Optional)`
+		If set, clients must provide a certificate signed by the given CA (Optional)
+	-tls-self-signed
+		Use a self-signed certificate, generated once and kept in the data directory, if -tls-cert isn't set (Optional)
+	-retention Trash=30,Spam=7
+		Delete messages added to IMAP mailboxes more than the given number of days ago (Optional)
+	-imap-window 50000
+		Only list the most recent messages of large IMAP mailboxes (Optional)
+	-imap-unified-inbox
+		Allow logging in with comma-separated usernames and bridge passwords, with an "All Accounts/INBOX" mailbox (Optional)
+	-imap-search-index=false
+		Don't index message bodies locally, SEARCH TEXT only matches headers and SEARCH BODY is disabled (Optional)
+	-imap-block-trackers=false
+		Serve HTML bodies as-is, without removing tracking pixels and link tracking parameters (Optional)
+	-imap-tracker-list /path/to/trackers.json
+		Block the trackers listed in a JSON file with "Hosts" and "Params" arrays, instead of the built-in list (Optional)
+	-imap-cache-size 512
+		Maximum size in MiB of the local cache of decrypted messages, 0 disables it and removes cached messages (Optional)
+	-throttle-requests 5, -throttle-kbps 500
+		Limit the API requests per second and the bandwidth used by background synchronization and exports (Optional)
+	-smtp-hourly-limit 100, -smtp-daily-limit 1000
+		Maximum number of messages sent per account, further messages are temporarily rejected (Optional)
+	-smtp-max-recipients 50
+		Maximum number of recipients per message (Optional)
+	-smtp-scrub-headers
+		Remove User-Agent, X-Mailer, local Received fields and similar before sending (Optional)`
 
 func main() {
+	ctx := context.Background()
+
+	configPath := flag.String("config", "", "Path to a YAML configuration file")
+	dataDir := flag.String("data-dir", "", "Directory containing accounts, settings and local databases, defaults to $XDG_CONFIG_HOME/hydroxide")
 	flag.BoolVar(&debug, "debug", false, "Enable debug logs")
+	logLevel := flag.String("log-level", "", "Minimum level of log messages, optionally per subsystem, e.g. warn,imap=debug")
+	logFormat := flag.String("log-format", logging.FormatText, "Format of log messages: text or json")
+	flag.StringVar(&bind, "bind", "", "Local IP address or network interface used for connections to ProtonMail")
+	flag.StringVar(&proxyURL, "proxy", "", "SOCKS5 proxy for connections to ProtonMail, e.g. socks5://127.0.0.1:9050 for Tor")
+	flag.BoolVar(&altRoute, "alternative-routing", false, "Look up alternative routes to ProtonMail with DNS-over-HTTPS when it's unreachable")
+	ktVRFKeyHex := flag.String("kt-vrf-key", "", "Hex-encoded public key of the VRF used by ProtonMail for key transparency")
+	flag.IntVar(&maxRetries, "api-max-retries", protonmail.DefaultMaxRetries, "Maximum number of retries of requests throttled by ProtonMail, 0 disables retries")
 
 	smtpHost := flag.String("smtp-host", "127.0.0.1", "Allowed SMTP email hostname on which hydroxide listens, defaults to 127.0.0.1")
 	smtpPort := flag.String("smtp-port", "1025", "SMTP port on which hydroxide listens, defaults to 1025")
@@ -186,15 +634,46 @@ func main() {
 
 	carddavHost := flag.String("carddav-host", "127.0.0.1", "Allowed CardDAV email hostname on which hydroxide listens, defaults to 127.0.0.1")
 	carddavPort := flag.String("carddav-port", "8080", "CardDAV port on which hydroxide listens, defaults to 8080")
+	caldavHost := flag.String("caldav-host", "127.0.0.1", "Allowed CalDAV hostname on which hydroxide listens, defaults to 127.0.0.1")
+	caldavPort := flag.String("caldav-port", "8081", "CalDAV port on which hydroxide listens, defaults to 8081")
+	webdavHost := flag.String("webdav-host", "127.0.0.1", "Allowed WebDAV hostname on which hydroxide listens, defaults to 127.0.0.1")
+	webdavPort := flag.String("webdav-port", "8082", "WebDAV port on which hydroxide listens, defaults to 8082")
 
 	tlsCert := flag.String("tls-cert", "", "Path to the certificate to use for incoming connections")
 	tlsCertKey := flag.String("tls-key", "", "Path to the certificate key to use for incoming connections")
 	tlsClientCA := flag.String("tls-client-ca", "", "If set, clients must provide a certificate signed by the given CA")
+	tlsSelfSigned := flag.Bool("tls-self-signed", false, "Use a self-signed certificate generated in the data directory, if -tls-cert isn't set")
+
+	retentionFlag := flag.String("retention", "", "Delete messages added to IMAP mailboxes more than the given number of days ago")
+	imapWindow := flag.Int("imap-window", 0, "Maximum number of messages listed per IMAP mailbox")
+	imapUnifiedInbox := flag.Bool("imap-unified-inbox", false, "Allow logging in to several accounts at once, with a unified inbox")
+	imapSearchIndex := flag.Bool("imap-search-index", true, "Index decrypted message bodies locally for IMAP SEARCH BODY and TEXT")
+	imapFetchWorkers := flag.Int("imap-fetch-workers", 4, "Number of messages downloaded and decrypted concurrently by IMAP FETCH")
+	imapTrackerList := flag.String("imap-tracker-list", "", "JSON file with the Hosts and Params of trackers to block, instead of the built-in list")
+	imapBlockTrackers := flag.Bool("imap-block-trackers", true, "Remove tracking pixels and link tracking parameters from HTML bodies served over IMAP")
+	imapCacheSize := flag.Int64("imap-cache-size", 512, "Maximum size in MiB of the local cache of decrypted messages, 0 disables the cache")
+
+	throttleRequests := flag.Float64("throttle-requests", 0, "Maximum number of API requests per second sent by background tasks")
+	throttleKBps := flag.Int("throttle-kbps", 0, "Maximum bandwidth used by background tasks, in KB/s")
 
+	decryptWorkers := flag.Int("decrypt-workers", 0, "Maximum number of messages and contacts decrypted at the same time, defaults to the number of CPUs")
+
+	smtpHourlyLimit := flag.Int("smtp-hourly-limit", 0, "Maximum number of messages sent per account and per hour")
+	smtpDailyLimit := flag.Int("smtp-daily-limit", 0, "Maximum number of messages sent per account and per day")
+	smtpMaxRecipients := flag.Int("smtp-max-recipients", 0, "Maximum number of recipients per message")
+	smtpScrubHeaders := flag.Bool("smtp-scrub-headers", false, "Remove header fields leaking information about the sender's device or network")
+
+	activatePMCmd := flag.NewFlagSet("activate-pm-me", flag.ExitOnError)
 	authCmd := flag.NewFlagSet("auth", flag.ExitOnError)
+	authKeyring := authCmd.Bool("keyring", false, "store the bridge password in the OS keyring instead of printing it")
+	autoDeleteCmd := flag.NewFlagSet("auto-delete", flag.ExitOnError)
 	exportSecretKeysCmd := flag.NewFlagSet("export-secret-keys", flag.ExitOnError)
 	importMessagesCmd := flag.NewFlagSet("import-messages", flag.ExitOnError)
 	exportMessagesCmd := flag.NewFlagSet("export-messages", flag.ExitOnError)
+	exportContactsCmd := flag.NewFlagSet("export-contacts", flag.ExitOnError)
+	exportCalendarCmd := flag.NewFlagSet("export-calendar", flag.ExitOnError)
+	notifyCmd := flag.NewFlagSet("notify", flag.ExitOnError)
+	deliverCmd := flag.NewFlagSet("deliver", flag.ExitOnError)
 
 	flag.Usage = func() {
 		fmt.Println(usage)
@@ -202,10 +681,104 @@ func main() {
 
 	flag.Parse()
 
-	tlsConfig, err := config.TLS(*tlsCert, *tlsCertKey, *tlsClientCA)
+	var serveCfg *serveConfig
+	if *configPath != "" {
+		var err error
+		if serveCfg, err = loadServeConfig(*configPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *dataDir != "" {
+		config.SetDir(*dataDir)
+	}
+	if serveCfg != nil {
+		if err := serveCfg.saveAccounts(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if debug {
+		logging.SetLevel(logging.LevelDebug)
+	}
+	if err := logging.ParseLevels(*logLevel); err != nil {
+		log.Fatal(err)
+	}
+	if err := logging.SetFormat(*logFormat); err != nil {
+		log.Fatal(err)
+	}
+	if *logFormat == logging.FormatJSON {
+		// Keep one JSON object per line for messages of the standard logger
+		log.SetFlags(0)
+		log.SetOutput(logging.New("hydroxide").Writer(logging.LevelInfo))
+	}
+
+	if altRoute && proxyURL != "" {
+		// DNS-over-HTTPS requests and alternative routes would bypass the
+		// user's choice of exit
+		log.Fatal("-alternative-routing can't be used with -proxy")
+	}
+
+	if *ktVRFKeyHex != "" {
+		var err error
+		if ktVRFKey, err = hex.DecodeString(*ktVRFKeyHex); err != nil || len(ktVRFKey) != 32 {
+			log.Fatal("invalid -kt-vrf-key: expected 32 hex-encoded bytes")
+		}
+	}
+
+	certPath, keyPath := *tlsCert, *tlsCertKey
+	if *tlsSelfSigned && certPath == "" {
+		hosts := certHosts(*smtpHost, *imapHost, *carddavHost, *caldavHost, *webdavHost)
+		var err error
+		if certPath, keyPath, err = config.SelfSignedCert(hosts); err != nil {
+			log.Fatal(err)
+		}
+	}
+	tlsConfig, err := config.TLS(certPath, keyPath, *tlsClientCA)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *tlsSelfSigned && *tlsCert == "" {
+		fingerprint := sha256.Sum256(tlsConfig.Certificates[0].Certificate[0])
+		log.Printf("Using self-signed certificate %v with SHA-256 fingerprint %X", certPath, fingerprint)
+	}
+
+	retention, err := parseRetention(*retentionFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	throttle := protonmail.NewThrottle(*throttleRequests, *throttleKBps)
+	if *decryptWorkers > 0 {
+		protonmail.DecryptPool = protonmail.NewPool(*decryptWorkers)
+	}
+	messageCacheSize := int64(-1)
+	if *imapCacheSize > 0 {
+		messageCacheSize = *imapCacheSize << 20
+	}
+	var trackers *imapbackend.TrackerList
+	if *imapTrackerList != "" {
+		trackers, err = imapbackend.LoadTrackerList(*imapTrackerList)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	imapOptions := &imapbackend.Options{
+		Retention:        retention,
+		Window:           *imapWindow,
+		UnifiedInbox:     *imapUnifiedInbox,
+		Throttle:         throttle,
+		SearchIndex:      *imapSearchIndex,
+		FetchWorkers:     *imapFetchWorkers,
+		BlockTrackers:    *imapBlockTrackers,
+		Trackers:         trackers,
+		MessageCacheSize: messageCacheSize,
+	}
+
+	smtpOptions := &smtpbackend.Options{
+		HourlyLimit:   *smtpHourlyLimit,
+		DailyLimit:    *smtpDailyLimit,
+		MaxRecipients: *smtpMaxRecipients,
+		ScrubHeaders:  *smtpScrubHeaders,
+	}
 
 	cmd := flag.Arg(0)
 	switch cmd {
@@ -213,10 +786,18 @@ func main() {
 		authCmd.Parse(flag.Args()[1:])
 		username := authCmd.Arg(0)
 		if username == "" {
-			log.Fatal("usage: hydroxide auth <username>")
+			log.Fatal("usage: hydroxide auth [-keyring] <username>")
+		}
+
+		account, err := config.LoadAccount(username)
+		if err != nil {
+			log.Fatal(err)
 		}
 
-		c := newClient()
+		c, err := newClient(username)
+		if err != nil {
+			log.Fatal(err)
+		}
 
 		var a *protonmail.Auth
 		/*if cachedAuth, ok := auths[username]; ok {
@@ -237,27 +818,18 @@ func main() {
 				loginPassword = string(pass)
 			}
 
-			authInfo, err := c.AuthInfo(username)
+			authInfo, err := c.AuthInfo(ctx, username)
 			if err != nil {
 				log.Fatal(err)
 			}
 
-			a, err = c.Auth(username, loginPassword, authInfo)
+			a, err = c.Auth(ctx, username, loginPassword, authInfo)
 			if err != nil {
 				log.Fatal(err)
 			}
 
-			if a.TwoFactor.Enabled == 1 {
-				if a.TwoFactor.TOTP != 1 {
-					log.Fatal("Only TOTP is supported as a 2FA method")
-				}
-
-				scanner := bufio.NewScanner(os.Stdin)
-				fmt.Printf("2FA TOTP code: ")
-				scanner.Scan()
-				code := scanner.Text()
-
-				scope, err := c.AuthTOTP(code)
+			if a.TwoFactor.Enabled != 0 {
+				scope, err := authTwoFactor(ctx, c, a)
 				if err != nil {
 					log.Fatal(err)
 				}
@@ -282,12 +854,12 @@ func main() {
 			}
 		}
 
-		keySalts, err := c.ListKeySalts()
+		keySalts, err := c.ListKeySalts(ctx)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		_, err = c.Unlock(a, keySalts, mailboxPassword)
+		_, err = c.Unlock(ctx, a, keySalts, mailboxPassword)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -307,7 +879,139 @@ func main() {
 			log.Fatal(err)
 		}
 
+		// Application passwords unlock the previous auth only
+		if err := auth.RevokeAllAppPasswords(username); err != nil {
+			log.Fatal(err)
+		}
+
+		if *authKeyring && !account.Keyring {
+			account.Keyring = true
+			if err := config.SaveAccount(username, account); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if account.Keyring {
+			// Still print the password if it can't be stored, otherwise the
+			// account would need to be logged in again
+			if err := keyring.Set(username, bridgePassword); err != nil {
+				log.Printf("cannot store bridge password in keyring: %v", err)
+			} else {
+				fmt.Println("Bridge password stored in the keyring")
+				break
+			}
+		}
 		fmt.Println("Bridge password:", bridgePassword)
+	case "vacation":
+		vacationCommand(flag.Args()[1:])
+	case "change-password":
+		changePasswordCommand(flag.Args()[1:])
+	case "settings":
+		settingsCommand(flag.Args()[1:])
+	case "bridge-password":
+		bridgePasswordCommand(flag.Args()[1:])
+	case "auto-delete":
+		autoDeleteCmd.Parse(flag.Args()[1:])
+		username := autoDeleteCmd.Arg(0)
+		if username == "" {
+			log.Fatal("usage: hydroxide auto-delete <username> [days]")
+		}
+
+		c, _, err := login(ctx, username)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var settings *protonmail.MailSettings
+		if daysStr := autoDeleteCmd.Arg(1); daysStr != "" {
+			days, err := strconv.Atoi(daysStr)
+			if err != nil || days < 0 {
+				log.Fatal("invalid number of days")
+			}
+			settings, err = c.SetAutoDeleteSpamAndTrashDays(ctx, days)
+		} else {
+			settings, err = c.GetMailSettings(ctx)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if days := settings.AutoDeleteSpamAndTrashDays; days == nil || *days == 0 {
+			fmt.Println("Auto-delete is disabled")
+		} else {
+			fmt.Printf("Messages in Spam and Trash are deleted after %v days\n", *days)
+		}
+	case "account":
+		accountCommand(flag.Args()[1:])
+	case "activate-pm-me":
+		activatePMCmd.Parse(flag.Args()[1:])
+		username := activatePMCmd.Arg(0)
+		if username == "" {
+			log.Fatal("usage: hydroxide activate-pm-me <username>")
+		}
+
+		c, _, err := login(ctx, username)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		domains, err := c.ListPremiumDomains(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(domains) == 0 {
+			log.Fatal("no pm.me domain available for this account")
+		}
+
+		addrs, err := c.ListAddresses(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var displayName, signature string
+		for _, addr := range addrs {
+			if strings.HasSuffix(strings.ToLower(addr.Email), "@"+domains[0]) {
+				log.Fatalf("address %v is already activated", addr.Email)
+			}
+			if displayName == "" && addr.Status == protonmail.AddressEnabled {
+				displayName = addr.DisplayName
+				signature = addr.Signature
+			}
+		}
+
+		addr, err := c.SetupAddress(ctx, domains[0], displayName, signature)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, _, err := c.CreateAddressKey(ctx, addr, true); err != nil {
+			log.Fatalf("created address %v but failed to generate its key: %v", addr.Email, err)
+		}
+
+		fmt.Printf("Address %v activated, it can now be used as sender address\n", addr.Email)
+	case "compose":
+		composeCommand(flag.Args()[1:])
+	case "filters":
+		filtersCommand(flag.Args()[1:])
+	case "labels":
+		labelsCommand(flag.Args()[1:])
+	case "messages":
+		messagesCommand(flag.Args()[1:])
+	case "domains":
+		domainsCommand(flag.Args()[1:])
+	case "addresses":
+		addressesCommand(flag.Args()[1:])
+	case "keys":
+		keysCommand(flag.Args()[1:])
+	case "unread":
+		unreadCommand(flag.Args()[1:])
+	case "pins":
+		pinsCommand(flag.Args()[1:])
+	case "export-config":
+		exportConfigCommand(flag.Args()[1:])
+	case "import-config":
+		importConfigCommand(flag.Args()[1:])
+	case "search":
+		searchCommand(flag.Args()[1:])
+	case "send":
+		sendCommand(flag.Args()[1:])
 	case "status":
 		usernames, err := auth.ListUsernames()
 		if err != nil {
@@ -323,32 +1027,48 @@ func main() {
 			}
 		}
 	case "export-secret-keys":
+		encrypt := exportSecretKeysCmd.Bool("encrypt", false, "encrypt exported keys with a passphrase")
 		exportSecretKeysCmd.Parse(flag.Args()[1:])
 		username := exportSecretKeysCmd.Arg(0)
 		if username == "" {
-			log.Fatal("usage: hydroxide export-secret-keys <username>")
+			log.Fatal("usage: hydroxide export-secret-keys [-encrypt] <username> [address...]")
 		}
 
-		var bridgePassword string
-		fmt.Printf("Bridge password: ")
-		if pass, err := gopass.GetPasswd(); err != nil {
-			log.Fatal(err)
-		} else {
-			bridgePassword = string(pass)
+		var passphrase []byte
+		if *encrypt {
+			var err error
+			passphrase, err = askPassphrase("Key passphrase")
+			if err != nil {
+				log.Fatal(err)
+			}
+			confirm, err := askPassphrase("Confirm key passphrase")
+			if err != nil {
+				log.Fatal(err)
+			}
+			if len(passphrase) == 0 || !bytes.Equal(passphrase, confirm) {
+				log.Fatal("passphrases are empty or don't match")
+			}
 		}
 
-		_, privateKeys, err := auth.NewManager(newClient).Auth(username, bridgePassword)
+		c, privateKeys, err := login(ctx, username)
 		if err != nil {
 			log.Fatal(err)
 		}
 
+		if emails := exportSecretKeysCmd.Args()[1:]; len(emails) > 0 {
+			privateKeys, err = selectAddressKeys(ctx, c, privateKeys, emails)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
 		wc, err := armor.Encode(os.Stdout, openpgp.PrivateKeyType, nil)
 		if err != nil {
 			log.Fatal(err)
 		}
 
 		for _, key := range privateKeys {
-			if err := key.SerializePrivate(wc, nil); err != nil {
+			if err := protonmail.SerializePrivateKey(wc, key, passphrase); err != nil {
 				log.Fatal(err)
 			}
 		}
@@ -357,86 +1077,168 @@ func main() {
 			log.Fatal(err)
 		}
 	case "import-messages":
+		var labelName string
+		var workers int
+		importMessagesCmd.StringVar(&labelName, "label", "Inbox", "folder or label of the imported messages")
+		importMessagesCmd.IntVar(&workers, "workers", 4, "number of messages imported concurrently")
 		importMessagesCmd.Parse(flag.Args()[1:])
 		username := importMessagesCmd.Arg(0)
 		archivePath := importMessagesCmd.Arg(1)
-		if username == "" || archivePath == "" {
-			log.Fatal("usage: hydroxide import-messages <username> <file>")
+		if username == "" || archivePath == "" || workers <= 0 {
+			log.Fatal("usage: hydroxide import-messages [-label <name>] [-workers <n>] <username> <file|maildir>")
 		}
 
-		f, err := os.Open(archivePath)
+		fi, err := os.Stat(archivePath)
 		if err != nil {
 			log.Fatal(err)
 		}
-		defer f.Close()
 
-		var bridgePassword string
-		fmt.Printf("Bridge password: ")
-		if pass, err := gopass.GetPasswd(); err != nil {
+		bridgePassword, err := askBridgePassword(username)
+		if err != nil {
 			log.Fatal(err)
-		} else {
-			bridgePassword = string(pass)
 		}
 
-		c, _, err := auth.NewManager(newClient).Auth(username, bridgePassword)
+		c, _, err := auth.NewManager(newClient).Auth(ctx, username, bridgePassword)
 		if err != nil {
 			log.Fatal(err)
 		}
+		c.Throttle = throttle
 
-		br := bufio.NewReader(f)
-		if ok, err := isMbox(br); err != nil {
+		labelIDs, err := importLabels(ctx, c, labelName)
+		if err != nil {
 			log.Fatal(err)
-		} else if ok {
-			mr := mbox.NewReader(br)
-			for {
-				r, err := mr.NextMessage()
-				if err == io.EOF {
-					break
-				} else if err != nil {
-					log.Fatal(err)
+		}
+
+		var imported, failed, total int
+		options := &imports.BulkOptions{
+			LabelIDs: labelIDs,
+			Workers:  workers,
+			Progress: func(name string, err error) {
+				if err != nil {
+					failed++
+					fmt.Fprintln(os.Stderr)
+					log.Printf("cannot import %v: %v", name, err)
+				} else {
+					imported++
 				}
-				if err := imports.ImportMessage(c, r); err != nil {
-					log.Fatal(err)
+				if total > 0 {
+					fmt.Fprintf(os.Stderr, "\rImported %v/%v messages", imported, total)
+				} else {
+					fmt.Fprintf(os.Stderr, "\rImported %v messages", imported)
 				}
+			},
+		}
+
+		var importErr error
+		if fi.IsDir() {
+			paths, err := imports.ListMaildir(archivePath)
+			if err != nil {
+				log.Fatal(err)
 			}
+			total = len(paths)
+			importErr = imports.ImportMaildir(ctx, c, paths, options)
 		} else {
-			if err := imports.ImportMessage(c, br); err != nil {
+			f, err := os.Open(archivePath)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+
+			br := bufio.NewReader(f)
+			if ok, err := isMbox(br); err != nil {
 				log.Fatal(err)
+			} else if ok {
+				importErr = imports.ImportMbox(ctx, c, br, options)
+			} else {
+				total = 1
+				_, err := imports.ImportMessageWithMetadata(ctx, c, br, &protonmail.Message{
+					Unread:   1,
+					LabelIDs: labelIDs,
+					Type:     protonmail.MessageInbox,
+				})
+				options.Progress(archivePath, err)
 			}
 		}
+		if imported+failed > 0 {
+			fmt.Fprintln(os.Stderr)
+		}
+		if importErr != nil {
+			log.Fatal(importErr)
+		}
+		if failed > 0 {
+			log.Fatalf("%v messages couldn't be imported", failed)
+		}
 	case "export-messages":
 		// TODO: allow specifying multiple IDs
-		var convID, msgID string
+		var convID, msgID, format, dir, checkpointPath string
 		exportMessagesCmd.StringVar(&convID, "conversation-id", "", "conversation ID")
 		exportMessagesCmd.StringVar(&msgID, "message-id", "", "message ID")
+		exportMessagesCmd.StringVar(&format, "format", "mbox", "output format: mbox or maildir")
+		exportMessagesCmd.StringVar(&dir, "dir", ".", "Maildir directory, for the maildir format")
+		exportMessagesCmd.StringVar(&checkpointPath, "checkpoint", "", "file recording the progress of the export of all messages, defaults to "+exportCheckpointName+" in the Maildir directory")
 		exportMessagesCmd.Parse(flag.Args()[1:])
 		username := exportMessagesCmd.Arg(0)
-		if (convID == "" && msgID == "") || username == "" {
-			log.Fatal("usage: hydroxide export-messages [-conversation-id <id>] [-message-id <id>] <username>")
+		if (format != "mbox" && format != "maildir") || username == "" {
+			log.Fatal("usage: hydroxide export-messages [-format mbox|maildir] [-dir <directory>] [-checkpoint <file>] [-conversation-id <id>] [-message-id <id>] <username>")
+		}
+		if checkpointPath == "" && format == "maildir" {
+			checkpointPath = filepath.Join(dir, exportCheckpointName)
 		}
 
-		var bridgePassword string
-		fmt.Fprintf(os.Stderr, "Bridge password: ")
-		if pass, err := gopass.GetPasswd(); err != nil {
+		bridgePassword, err := askBridgePassword(username)
+		if err != nil {
 			log.Fatal(err)
-		} else {
-			bridgePassword = string(pass)
 		}
 
-		c, privateKeys, err := auth.NewManager(newClient).Auth(username, bridgePassword)
+		c, privateKeys, err := auth.NewManager(newClient).Auth(ctx, username, bridgePassword)
 		if err != nil {
 			log.Fatal(err)
 		}
+		c.Throttle = throttle
+
+		db, cache := openMessageCache(ctx, c, privateKeys)
+		if db != nil {
+			defer db.Close()
+		}
+
+		if format == "maildir" {
+			w, err := exports.NewMaildirWriter(ctx, c, dir)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			if convID == "" && msgID == "" {
+				if err := exports.ExportAllMaildir(ctx, c, privateKeys, cache, w, loadExportCheckpoint(checkpointPath)); err != nil {
+					log.Fatal(err)
+				}
+			}
+			if convID != "" {
+				if err := exports.ExportConversationMaildir(ctx, c, privateKeys, cache, w, convID); err != nil {
+					log.Fatal(err)
+				}
+			}
+			if msgID != "" {
+				if err := exports.ExportMessageMaildir(ctx, c, privateKeys, cache, w, msgID); err != nil {
+					log.Fatal(err)
+				}
+			}
+			break
+		}
 
 		mboxWriter := mbox.NewWriter(os.Stdout)
 
+		if convID == "" && msgID == "" {
+			if err := exports.ExportAllMbox(ctx, c, privateKeys, cache, mboxWriter, loadExportCheckpoint(checkpointPath)); err != nil {
+				log.Fatal(err)
+			}
+		}
 		if convID != "" {
-			if err := exports.ExportConversationMbox(c, privateKeys, mboxWriter, convID); err != nil {
+			if err := exports.ExportConversationMbox(ctx, c, privateKeys, cache, mboxWriter, convID); err != nil {
 				log.Fatal(err)
 			}
 		}
 		if msgID != "" {
-			if err := exports.ExportMessageMbox(c, privateKeys, mboxWriter, msgID); err != nil {
+			if err := exports.ExportMessageMbox(ctx, c, privateKeys, cache, mboxWriter, msgID); err != nil {
 				log.Fatal(err)
 			}
 		}
@@ -444,38 +1246,209 @@ func main() {
 		if err := mboxWriter.Close(); err != nil {
 			log.Fatal(err)
 		}
+	case "export-contacts":
+		var dir string
+		exportContactsCmd.StringVar(&dir, "dir", "", "write one vCard file per contact in this directory")
+		exportContactsCmd.Parse(flag.Args()[1:])
+		username := exportContactsCmd.Arg(0)
+		if username == "" {
+			log.Fatal("usage: hydroxide export-contacts [-dir <directory>] <username>")
+		}
+
+		bridgePassword, err := askBridgePassword(username)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		c, privateKeys, err := auth.NewManager(newClient).Auth(ctx, username, bridgePassword)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c.Throttle = throttle
+
+		if dir != "" {
+			err = exports.ExportContactsDir(ctx, c, privateKeys, dir)
+		} else {
+			err = exports.ExportContactsVCard(ctx, c, privateKeys, os.Stdout)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "export-calendar":
+		var dir string
+		exportCalendarCmd.StringVar(&dir, "dir", ".", "write the calendar files in this directory")
+		exportCalendarCmd.Parse(flag.Args()[1:])
+		username := exportCalendarCmd.Arg(0)
+		if username == "" {
+			log.Fatal("usage: hydroxide export-calendar [-dir <directory>] <username>")
+		}
+
+		bridgePassword, err := askBridgePassword(username)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		c, privateKeys, err := auth.NewManager(newClient).Auth(ctx, username, bridgePassword)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c.Throttle = throttle
+
+		if err := exports.ExportCalendarsDir(ctx, c, privateKeys, dir); err != nil {
+			log.Fatal(err)
+		}
+	case "notify":
+		var openCommand string
+		notifyCmd.StringVar(&openCommand, "open-command", "", "command to run when a notification is clicked")
+		notifyCmd.Parse(flag.Args()[1:])
+		username := notifyCmd.Arg(0)
+		if username == "" {
+			log.Fatal("usage: hydroxide notify [-open-command <command>] <username>")
+		}
+
+		c, _, err := login(ctx, username)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		n, err := notify.New(c, strings.Fields(openCommand))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer n.Close()
+
+		ch := make(chan *protonmail.Event)
+		events.NewManager().Register(c, username, ch, nil)
+		if err := n.Run(ctx, ch); err != nil {
+			log.Fatal(err)
+		}
+	case "deliver":
+		var options deliver.Options
+		var command string
+		deliverCmd.StringVar(&options.LMTP, "lmtp", "", "LMTP server address, host:port or path to a Unix socket")
+		deliverCmd.StringVar(&command, "command", "", "command receiving each message on its standard input, e.g. procmail")
+		deliverCmd.StringVar(&options.Recipient, "rcpt", "", "LMTP recipient, defaults to the address the message was received on")
+		deliverCmd.Parse(flag.Args()[1:])
+		username := deliverCmd.Arg(0)
+		options.Command = strings.Fields(command)
+		if username == "" || (options.LMTP == "") == (command == "") {
+			log.Fatal("usage: hydroxide deliver -lmtp <address>|-command <command> [-rcpt <address>] <username>")
+		}
+
+		c, privateKeys, err := login(ctx, username)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		d, err := deliver.New(ctx, c, privateKeys, &options)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ch := make(chan *protonmail.Event)
+		events.NewManager().Register(c, username, ch, nil)
+		if err := d.Run(ctx, ch); err != nil {
+			log.Fatal(err)
+		}
 	case "smtp":
 		addr := *smtpHost + ":" + *smtpPort
 		authManager := auth.NewManager(newClient)
-		log.Fatal(listenAndServeSMTP(addr, debug, authManager, tlsConfig))
+		log.Fatal(listenAndServe(config.ProtocolSMTP, addr, tlsConfig, func(l net.Listener) error {
+			return serveSMTP(l, debug, authManager, tlsConfig, smtpOptions)
+		}))
 	case "imap":
 		addr := *imapHost + ":" + *imapPort
 		authManager := auth.NewManager(newClient)
 		eventsManager := events.NewManager()
-		log.Fatal(listenAndServeIMAP(addr, debug, authManager, eventsManager, tlsConfig))
+		log.Fatal(listenAndServe(config.ProtocolIMAP, addr, tlsConfig, func(l net.Listener) error {
+			return serveIMAP(l, debug, authManager, eventsManager, tlsConfig, imapOptions)
+		}))
 	case "carddav":
 		addr := *carddavHost + ":" + *carddavPort
 		authManager := auth.NewManager(newClient)
 		eventsManager := events.NewManager()
-		log.Fatal(listenAndServeCardDAV(addr, authManager, eventsManager, tlsConfig))
+		log.Fatal(listenAndServe(config.ProtocolCardDAV, addr, tlsConfig, func(l net.Listener) error {
+			return serveCardDAV(l, authManager, eventsManager, tlsConfig)
+		}))
+	case "caldav":
+		addr := *caldavHost + ":" + *caldavPort
+		authManager := auth.NewManager(newClient)
+		log.Fatal(listenAndServe(config.ProtocolCalDAV, addr, tlsConfig, func(l net.Listener) error {
+			return serveCalDAV(l, authManager, tlsConfig)
+		}))
+	case "webdav":
+		addr := *webdavHost + ":" + *webdavPort
+		authManager := auth.NewManager(newClient)
+		log.Fatal(listenAndServe(config.ProtocolWebDAV, addr, tlsConfig, func(l net.Listener) error {
+			return serveWebDAV(l, authManager, tlsConfig)
+		}))
 	case "serve":
-		smtpAddr := *smtpHost + ":" + *smtpPort
-		imapAddr := *imapHost + ":" + *imapPort
-		carddavAddr := *carddavHost + ":" + *carddavPort
+		addrs := map[string]string{
+			config.ProtocolSMTP:    *smtpHost + ":" + *smtpPort,
+			config.ProtocolIMAP:    *imapHost + ":" + *imapPort,
+			config.ProtocolCardDAV: *carddavHost + ":" + *carddavPort,
+			config.ProtocolCalDAV:  *caldavHost + ":" + *caldavPort,
+			config.ProtocolWebDAV:  *webdavHost + ":" + *webdavPort,
+		}
+
+		if usernames, err := auth.ListUsernames(); err != nil {
+			log.Fatal(err)
+		} else {
+			log.Printf("Serving %v accounts, each is logged in on its first connection", len(usernames))
+		}
 
 		authManager := auth.NewManager(newClient)
 		eventsManager := events.NewManager()
 
-		done := make(chan error, 3)
-		go func() {
-			done <- listenAndServeSMTP(smtpAddr, debug, authManager, tlsConfig)
-		}()
-		go func() {
-			done <- listenAndServeIMAP(imapAddr, debug, authManager, eventsManager, tlsConfig)
-		}()
-		go func() {
-			done <- listenAndServeCardDAV(carddavAddr, authManager, eventsManager, tlsConfig)
-		}()
+		// Don't open ports for frontends disabled for all accounts
+		servers := map[string]func(l net.Listener) error{
+			config.ProtocolSMTP: func(l net.Listener) error {
+				return serveSMTP(l, debug, authManager, tlsConfig, smtpOptions)
+			},
+			config.ProtocolIMAP: func(l net.Listener) error {
+				return serveIMAP(l, debug, authManager, eventsManager, tlsConfig, imapOptions)
+			},
+			config.ProtocolCardDAV: func(l net.Listener) error {
+				return serveCardDAV(l, authManager, eventsManager, tlsConfig)
+			},
+			config.ProtocolCalDAV: func(l net.Listener) error {
+				return serveCalDAV(l, authManager, tlsConfig)
+			},
+			config.ProtocolWebDAV: func(l net.Listener) error {
+				return serveWebDAV(l, authManager, tlsConfig)
+			},
+		}
+
+		done := make(chan error, len(servers))
+		n := 0
+		for protocol, serve := range servers {
+			if !serveCfg.protocolEnabled(protocol) {
+				log.Printf("%v is disabled in the configuration file, not listening", strings.ToUpper(protocol))
+				continue
+			}
+			if used, err := isProtocolUsed(protocol); err != nil {
+				log.Fatal(err)
+			} else if !used {
+				log.Printf("%v is disabled for all accounts, not listening", strings.ToUpper(protocol))
+				continue
+			}
+
+			// Open all sockets before telling systemd that we're ready
+			l, err := listen(protocol, addrs[protocol], tlsConfig)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			serve := serve
+			go func() {
+				done <- serve(l)
+			}()
+			n++
+		}
+		if n == 0 {
+			log.Fatal("all frontends are disabled")
+		}
+		notifyReady()
 		log.Fatal(<-done)
 	default:
 		fmt.Println(usage)
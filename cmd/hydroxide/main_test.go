@@ -0,0 +1,190 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestParseRetention(t *testing.T) {
+	const day = 24 * time.Hour
+
+	tests := []struct {
+		s    string
+		want map[string]time.Duration
+	}{
+		{"", map[string]time.Duration{}},
+		{"Trash=30", map[string]time.Duration{"Trash": 30 * day}},
+		{"Trash=30,Spam=7", map[string]time.Duration{"Trash": 30 * day, "Spam": 7 * day}},
+		{"Folders/Old=365", map[string]time.Duration{"Folders/Old": 365 * day}},
+		{"Trash", nil},
+		{"Trash=", nil},
+		{"Trash=0", nil},
+		{"Trash=-1", nil},
+		{"All Mail=30", nil},
+		{"all mail=30", nil},
+		{"Trash=30,Starred=30", nil},
+	}
+	for _, tc := range tests {
+		got, err := parseRetention(tc.s)
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("parseRetention(%q) succeeded", tc.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRetention(%q) = %v", tc.s, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseRetention(%q) = %v, want %v", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestParseMailto(t *testing.T) {
+	tests := []struct {
+		s      string
+		header map[string]string
+		body   string
+	}{
+		{
+			s:      "mailto:someone@example.org",
+			header: map[string]string{"To": "someone@example.org"},
+		},
+		{
+			s: "mailto:someone@example.org?subject=Hello%20world&body=Hi+there",
+			header: map[string]string{
+				"To":      "someone@example.org",
+				"Subject": "Hello world",
+			},
+			body: "Hi+there",
+		},
+		{
+			s: "mailto:a@example.org?to=b@example.org&cc=c@example.org&CC=d@example.org&bcc=e@example.org",
+			header: map[string]string{
+				"To":  "a@example.org, b@example.org",
+				"Cc":  "c@example.org, d@example.org",
+				"Bcc": "e@example.org",
+			},
+		},
+		{
+			s: "mailto:list@example.org?In-Reply-To=%3C3469A91.D10AF4C@example.com%3E",
+			header: map[string]string{
+				"To":          "list@example.org",
+				"In-Reply-To": "<3469A91.D10AF4C@example.com>",
+			},
+		},
+		{
+			s:      "mailto:someone@example.org?from=attacker@example.org&reply-to=attacker@example.org&x-mailer=evil&content-type=text/html",
+			header: map[string]string{"To": "someone@example.org"},
+		},
+		{
+			s: "mailto:someone@example.org?subject=Hello%0D%0AReply-To:%20attacker@example.org",
+			header: map[string]string{
+				"To":      "someone@example.org",
+				"Subject": "Hello Reply-To: attacker@example.org",
+			},
+		},
+		{s: "https://example.org", header: nil},
+	}
+	for _, tc := range tests {
+		h, body, err := parseMailto(tc.s)
+		if tc.header == nil {
+			if err == nil {
+				t.Errorf("parseMailto(%q) succeeded", tc.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseMailto(%q) = %v", tc.s, err)
+			continue
+		}
+
+		got := make(map[string]string)
+		fields := h.Fields()
+		for fields.Next() {
+			got[fields.Key()] = fields.Value()
+		}
+		if !reflect.DeepEqual(got, tc.header) {
+			t.Errorf("parseMailto(%q) header = %v, want %v", tc.s, got, tc.header)
+		}
+		if body != tc.body {
+			t.Errorf("parseMailto(%q) body = %q, want %q", tc.s, body, tc.body)
+		}
+	}
+}
+
+func TestDecryptedMessage(t *testing.T) {
+	const header = "Subject: Hello\r\n" +
+		"Content-Type: multipart/mixed; boundary=abc\r\n" +
+		"Content-Transfer-Encoding: 7bit\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"\r\n"
+
+	tests := []struct {
+		name   string
+		msg    *protonmail.Message
+		body   string
+		header map[string]string
+		want   string
+	}{
+		{
+			name: "HTML",
+			msg:  &protonmail.Message{Header: header, MIMEType: "text/html"},
+			body: "<p>Hi</p>",
+			header: map[string]string{
+				"Subject":                   "Hello",
+				"Mime-Version":              "1.0",
+				"Content-Type":              "text/html; charset=utf-8",
+				"Content-Transfer-Encoding": "8bit",
+			},
+			want: "<p>Hi</p>",
+		},
+		{
+			name: "no MIME type",
+			msg:  &protonmail.Message{Header: header},
+			body: "Hi",
+			header: map[string]string{
+				"Subject":                   "Hello",
+				"Mime-Version":              "1.0",
+				"Content-Transfer-Encoding": "8bit",
+			},
+			want: "Hi",
+		},
+		{
+			name: "PGP/MIME",
+			msg:  &protonmail.Message{Header: header, MIMEType: "multipart/mixed", IsEncrypted: protonmail.MessageEncryptedPGPMIME},
+			body: "Content-Type: multipart/signed; boundary=def\r\n" +
+				"X-Other: ignored\r\n" +
+				"\r\n" +
+				"--def\r\n",
+			header: map[string]string{
+				"Subject":      "Hello",
+				"Mime-Version": "1.0",
+				"Content-Type": "multipart/signed; boundary=def",
+			},
+			want: "--def\r\n",
+		},
+	}
+	for _, tc := range tests {
+		h, body, err := decryptedMessage(tc.msg, []byte(tc.body))
+		if err != nil {
+			t.Errorf("%v: decryptedMessage() = %v", tc.name, err)
+			continue
+		}
+
+		got := make(map[string]string)
+		fields := h.Fields()
+		for fields.Next() {
+			got[fields.Key()] = fields.Value()
+		}
+		if !reflect.DeepEqual(got, tc.header) {
+			t.Errorf("%v: decryptedMessage() header = %v, want %v", tc.name, got, tc.header)
+		}
+		if string(body) != tc.want {
+			t.Errorf("%v: decryptedMessage() body = %q, want %q", tc.name, body, tc.want)
+		}
+	}
+}
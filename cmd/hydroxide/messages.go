@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/emersion/hydroxide/exports"
+	"github.com/emersion/hydroxide/imap/database"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+const messagesUsage = `usage: hydroxide messages list [-folder <name>] [-limit <n>] [-json] <username>
+       hydroxide messages show [-attachments <dir>] <username> <id>`
+
+// decryptedMessage returns the header and the body of a message whose body has
+// been decrypted. The content header fields of the original message describe
+// the encrypted MIME structure, they're replaced with the ones of the body.
+func decryptedMessage(msg *protonmail.Message, body []byte) (textproto.Header, []byte, error) {
+	h, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(msg.Header)))
+	if err != nil {
+		return h, nil, fmt.Errorf("failed to read message header: %v", err)
+	}
+	fields := h.Fields()
+	for fields.Next() {
+		if strings.HasPrefix(strings.ToLower(fields.Key()), "content-") {
+			fields.Del()
+		}
+	}
+
+	// PGP/MIME bodies are complete MIME entities
+	if msg.IsEncrypted != protonmail.MessageEncryptedPGPMIME && msg.MIMEType != "multipart/mixed" {
+		if msg.MIMEType != "" {
+			h.Set("Content-Type", mime.FormatMediaType(msg.MIMEType, map[string]string{"charset": "utf-8"}))
+		}
+		h.Set("Content-Transfer-Encoding", "8bit")
+		return h, body, nil
+	}
+
+	r := bytes.NewReader(body)
+	br := bufio.NewReader(r)
+	eh, err := textproto.ReadHeader(br)
+	if err != nil {
+		return h, nil, fmt.Errorf("failed to read MIME body header: %v", err)
+	}
+	fields = eh.Fields()
+	for fields.Next() {
+		if strings.HasPrefix(strings.ToLower(fields.Key()), "content-") {
+			h.Add(fields.Key(), fields.Value())
+		}
+	}
+	return h, body[len(body)-r.Len()-br.Buffered():], nil
+}
+
+// openMessageCache opens the local message cache filled by the IMAP server.
+// It returns nil if the cache can't be opened, e.g. because the IMAP server
+// is running: messages are then downloaded from the API.
+func openMessageCache(ctx context.Context, c *protonmail.Client, privateKeys openpgp.EntityList) (*database.User, *database.MessageCache) {
+	u, err := c.GetCurrentUser(ctx)
+	if err != nil {
+		log.Printf("cannot open message cache: %v", err)
+		return nil, nil
+	}
+
+	db, err := database.OpenTimeout(u.Name+".db", time.Second)
+	if err != nil {
+		log.Printf("cannot open message cache: %v", err)
+		return nil, nil
+	}
+
+	// The IMAP server enforces the size limit
+	cache, err := db.MessageCache(privateKeys, 0)
+	if err != nil {
+		db.Close()
+		log.Printf("cannot open message cache: %v", err)
+		return nil, nil
+	}
+	return db, cache
+}
+
+// exportCheckpointName is the default name of the checkpoint file of Maildir
+// exports.
+const exportCheckpointName = "hydroxide-export.json"
+
+// loadExportCheckpoint reads the checkpoint of an export of all messages. It
+// returns nil if path is empty: all messages are exported.
+func loadExportCheckpoint(path string) *exports.Checkpoint {
+	if path == "" {
+		return nil
+	}
+	cp, err := exports.LoadCheckpoint(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return cp
+}
+
+// saveAttachment decrypts an attachment to a file in dir.
+func saveAttachment(ctx context.Context, c *protonmail.Client, privateKeys openpgp.EntityList, dir string, att *protonmail.Attachment) (string, error) {
+	name := filepath.Base(att.Name)
+	if name == "." || name == string(filepath.Separator) || name == "" {
+		name = att.ID
+	}
+	p := filepath.Join(dir, name)
+
+	rc, err := c.GetAttachment(ctx, att.ID)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	md, err := att.Read(rc, privateKeys, nil)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// TODO: check signature
+	if _, err := io.Copy(f, md.UnverifiedBody); err != nil {
+		return "", err
+	}
+	return p, f.Close()
+}
+
+func messagesCommand(args []string) {
+	ctx := context.Background()
+
+	if len(args) < 1 {
+		log.Fatal(messagesUsage)
+	}
+	subcmd := args[0]
+
+	fs := flag.NewFlagSet("messages "+subcmd, flag.ExitOnError)
+	switch subcmd {
+	case "list":
+		folderName := fs.String("folder", "Inbox", "folder or label to list")
+		limit := fs.Int("limit", 50, "maximum number of messages to list")
+		asJSON := fs.Bool("json", false, "print messages as JSON")
+		fs.Parse(args[1:])
+		username := fs.Arg(0)
+		if username == "" || fs.NArg() > 1 || *limit <= 0 {
+			log.Fatal(messagesUsage)
+		}
+
+		c, _, err := login(ctx, username)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		folders, err := listFolders(ctx, c)
+		if err != nil {
+			log.Fatal(err)
+		}
+		label, err := findFolder(folders, *folderName)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		messages, err := searchServer(ctx, c, &protonmail.MessageFilter{Label: label}, *limit)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := printMessages(messages, folders, *asJSON); err != nil {
+			log.Fatal(err)
+		}
+	case "show":
+		attachmentsDir := fs.String("attachments", "", "save attachments to this directory")
+		fs.Parse(args[1:])
+		username, id := fs.Arg(0), fs.Arg(1)
+		if username == "" || id == "" || fs.NArg() > 2 {
+			log.Fatal(messagesUsage)
+		}
+
+		c, privateKeys, err := login(ctx, username)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		msg, err := c.GetMessage(ctx, id)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		md, err := msg.Read(privateKeys, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// TODO: check signature
+		body, err := ioutil.ReadAll(md.UnverifiedBody)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		h, body, err := decryptedMessage(msg, body)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := textproto.WriteHeader(os.Stdout, h); err != nil {
+			log.Fatal(err)
+		}
+		if _, err := os.Stdout.Write(body); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println()
+
+		for _, att := range msg.Attachments {
+			if *attachmentsDir == "" {
+				fmt.Fprintf(os.Stderr, "Attachment: %v (%v, %v bytes)\n", att.Name, att.MIMEType, att.Size)
+				continue
+			}
+
+			p, err := saveAttachment(ctx, c, privateKeys, *attachmentsDir, att)
+			if err != nil {
+				log.Fatalf("cannot save attachment %v: %v", att.Name, err)
+			}
+			fmt.Fprintf(os.Stderr, "Saved attachment to %v\n", p)
+		}
+	default:
+		log.Fatal(messagesUsage)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/emersion/hydroxide/auth"
+)
+
+const bridgePasswordUsage = `usage: hydroxide bridge-password list <username>
+       hydroxide bridge-password add <username> <name>
+       hydroxide bridge-password revoke <username> <name>`
+
+func bridgePasswordCommand(args []string) {
+	if len(args) < 2 {
+		log.Fatal(bridgePasswordUsage)
+	}
+	subcmd, username := args[0], args[1]
+
+	switch subcmd {
+	case "list":
+		if len(args) != 2 {
+			log.Fatal(bridgePasswordUsage)
+		}
+
+		passwords, err := auth.ListAppPasswords(username)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "NAME\tCREATED\n")
+		for _, p := range passwords {
+			fmt.Fprintf(tw, "%v\t%v\n", p.Name, p.Created.Format("2006-01-02"))
+		}
+		tw.Flush()
+	case "add":
+		if len(args) != 3 {
+			log.Fatal(bridgePasswordUsage)
+		}
+		name := args[2]
+
+		bridgePassword, err := askBridgePassword(username)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		appPassword, err := auth.AddAppPassword(username, bridgePassword, name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Bridge password for %v: %v\n", name, appPassword)
+	case "revoke":
+		if len(args) != 3 {
+			log.Fatal(bridgePasswordUsage)
+		}
+		if err := auth.RevokeAppPassword(username, args[2]); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatal(bridgePasswordUsage)
+	}
+}
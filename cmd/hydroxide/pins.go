@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/emersion/go-vcard"
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/emersion/hydroxide/carddav"
+	"github.com/emersion/hydroxide/config"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+const pinsUsage = `usage: hydroxide pins list <username>
+       hydroxide pins update <username> <email>
+       hydroxide pins remove <username> <email>
+       hydroxide pins trust <username> <email> [file]
+       hydroxide pins untrust <username> <email>`
+
+// setContactKeys pins keys in the contact of an email address, creating the
+// contact if needed. With no keys, the pinned keys are removed.
+func setContactKeys(ctx context.Context, c *protonmail.Client, privateKeys openpgp.EntityList, email string, keys openpgp.EntityList) error {
+	contact, card, err := carddav.FindContact(ctx, c, email, privateKeys)
+	if err != nil {
+		return err
+	}
+	if contact == nil {
+		if len(keys) == 0 {
+			return fmt.Errorf("no contact for %v", email)
+		}
+		card = make(vcard.Card)
+		card.SetValue(vcard.FieldFormattedName, email)
+	}
+
+	if err := carddav.SetPinnedKeys(card, email, keys); err != nil {
+		return err
+	}
+	contactImport, err := carddav.FormatCard(card, privateKeys[0])
+	if err != nil {
+		return err
+	}
+
+	if contact != nil {
+		_, err = c.UpdateContact(ctx, contact.ID, contactImport)
+		return err
+	}
+	resps, err := c.CreateContacts(ctx, []*protonmail.ContactImport{contactImport})
+	if err != nil {
+		return err
+	}
+	if len(resps) != 1 {
+		return errors.New("expected exactly one response when creating contact")
+	}
+	return resps[0].Err()
+}
+
+// readPublicKeys reads armored public keys from a file.
+func readPublicKeys(path string) (openpgp.EntityList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %v: %v", path, err)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%v doesn't contain any key", path)
+	}
+	return keys, nil
+}
+
+func pinsCommand(args []string) {
+	ctx := context.Background()
+
+	if len(args) < 2 {
+		log.Fatal(pinsUsage)
+	}
+	subcmd, username := args[0], args[1]
+
+	pins, err := config.LoadPins(username)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch subcmd {
+	case "list":
+		if len(args) != 2 {
+			log.Fatal(pinsUsage)
+		}
+
+		emails := make([]string, 0, len(pins))
+		for email := range pins {
+			emails = append(emails, email)
+		}
+		sort.Strings(emails)
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "EMAIL\tFINGERPRINT\tFIRST SEEN\n")
+		for _, email := range emails {
+			pin := pins[email]
+			fmt.Fprintf(tw, "%v\t%v\t%v\n", email, pin.Fingerprint, pin.FirstSeen.Format("2006-01-02"))
+		}
+		tw.Flush()
+	case "update":
+		if len(args) != 3 {
+			log.Fatal(pinsUsage)
+		}
+		email := args[2]
+
+		c, _, err := login(ctx, username)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		resp, err := c.GetPublicKeys(ctx, email)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(resp.Keys) == 0 {
+			log.Fatalf("no public key found for %v", email)
+		}
+		pub, err := resp.Keys[0].Entity()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fingerprint := fmt.Sprintf("%X", pub.PrimaryKey.Fingerprint[:])
+		pins[config.PinKey(email)] = &config.KeyPin{Fingerprint: fingerprint, FirstSeen: time.Now()}
+		if err := config.SavePins(username, pins); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Pinned key %v for %v\n", fingerprint, email)
+	case "remove":
+		if len(args) != 3 {
+			log.Fatal(pinsUsage)
+		}
+		k := config.PinKey(args[2])
+		if _, ok := pins[k]; !ok {
+			log.Fatalf("no key pinned for %v", args[2])
+		}
+		delete(pins, k)
+		if err := config.SavePins(username, pins); err != nil {
+			log.Fatal(err)
+		}
+	case "trust":
+		if len(args) != 3 && len(args) != 4 {
+			log.Fatal(pinsUsage)
+		}
+		email := args[2]
+
+		var keys openpgp.EntityList
+		if len(args) == 4 {
+			if keys, err = readPublicKeys(args[3]); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		c, privateKeys, err := login(ctx, username)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if keys == nil {
+			resp, err := c.GetPublicKeys(ctx, email)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if len(resp.Keys) == 0 {
+				log.Fatalf("no public key found for %v", email)
+			}
+			pub, err := resp.Keys[0].Entity()
+			if err != nil {
+				log.Fatal(err)
+			}
+			keys = openpgp.EntityList{pub}
+		}
+
+		if err := setContactKeys(ctx, c, privateKeys, email, keys); err != nil {
+			log.Fatal(err)
+		}
+		for _, e := range keys {
+			fmt.Printf("Pinned key %X in the contact of %v\n", e.PrimaryKey.Fingerprint[:], email)
+		}
+	case "untrust":
+		if len(args) != 3 {
+			log.Fatal(pinsUsage)
+		}
+
+		c, privateKeys, err := login(ctx, username)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := setContactKeys(ctx, c, privateKeys, args[2], nil); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatal(pinsUsage)
+	}
+}
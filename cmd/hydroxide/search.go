@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	imapbackend "github.com/emersion/hydroxide/imap"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+const searchUsage = "usage: hydroxide search [options...] <username> [query]"
+
+const searchDateLayout = "2006-01-02"
+
+type searchResult struct {
+	ID      string
+	Time    time.Time
+	From    string
+	To      []string
+	Subject string
+	Unread  bool
+	Folders []string
+}
+
+func findFolder(folders []mailFolder, name string) (string, error) {
+	for _, f := range folders {
+		if strings.EqualFold(f.name, name) {
+			return f.label, nil
+		}
+	}
+	return "", fmt.Errorf("unknown folder or label %q", name)
+}
+
+func parseSearchDate(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	t, err := time.ParseInLocation(searchDateLayout, s, time.Local)
+	if err != nil {
+		return 0, fmt.Errorf("invalid date %q: expected YYYY-MM-DD", s)
+	}
+	return t.Unix(), nil
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+func matchAddresses(addrs []*protonmail.MessageAddress, s string) bool {
+	for _, addr := range addrs {
+		if addr != nil && (containsFold(addr.Address, s) || containsFold(addr.Name, s)) {
+			return true
+		}
+	}
+	return false
+}
+
+func concatAddresses(lists ...[]*protonmail.MessageAddress) []*protonmail.MessageAddress {
+	var l []*protonmail.MessageAddress
+	for _, addrs := range lists {
+		l = append(l, addrs...)
+	}
+	return l
+}
+
+// matchFilter checks whether a message matches a filter, for messages which
+// haven't been returned by the API.
+func matchFilter(msg *protonmail.Message, filter *protonmail.MessageFilter) bool {
+	if filter.Label != "" {
+		found := false
+		for _, labelID := range msg.LabelIDs {
+			if labelID == filter.Label {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if filter.Begin != 0 && int64(msg.Time) < filter.Begin {
+		return false
+	}
+	if filter.End != 0 && int64(msg.Time) >= filter.End {
+		return false
+	}
+	if filter.From != "" && !matchAddresses([]*protonmail.MessageAddress{msg.Sender}, filter.From) {
+		return false
+	}
+	if filter.To != "" && !matchAddresses(concatAddresses(msg.ToList, msg.CCList, msg.BCCList), filter.To) {
+		return false
+	}
+	if filter.Subject != "" && !containsFold(msg.Subject, filter.Subject) {
+		return false
+	}
+	if filter.Keyword != "" {
+		all := concatAddresses(msg.ToList, msg.CCList, []*protonmail.MessageAddress{msg.Sender})
+		if !containsFold(msg.Subject, filter.Keyword) && !matchAddresses(all, filter.Keyword) {
+			return false
+		}
+	}
+	return true
+}
+
+func searchServer(ctx context.Context, c *protonmail.Client, filter *protonmail.MessageFilter, limit int) ([]*protonmail.Message, error) {
+	filter.PageSize = 150
+	if limit < filter.PageSize {
+		filter.PageSize = limit
+	}
+
+	var messages []*protonmail.Message
+	for len(messages) < limit {
+		_, page, err := c.ListMessages(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+		if len(page) == 0 {
+			break
+		}
+		messages = append(messages, page...)
+		filter.Page++
+	}
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
+func newSearchResult(msg *protonmail.Message, folders []mailFolder) *searchResult {
+	res := &searchResult{
+		ID:      msg.ID,
+		Time:    msg.Time.Time(),
+		Subject: msg.Subject,
+		Unread:  msg.Unread == 1,
+		To:      []string{},
+		Folders: []string{},
+	}
+	if msg.Sender != nil {
+		res.From = msg.Sender.Address
+	}
+	for _, addr := range msg.ToList {
+		res.To = append(res.To, addr.Address)
+	}
+	for _, f := range folders {
+		for _, labelID := range msg.LabelIDs {
+			if labelID == f.label {
+				res.Folders = append(res.Folders, f.name)
+			}
+		}
+	}
+	return res
+}
+
+// printMessages prints a list of messages either as a table or as JSON.
+func printMessages(messages []*protonmail.Message, folders []mailFolder, asJSON bool) error {
+	results := make([]*searchResult, 0, len(messages))
+	for _, msg := range messages {
+		results = append(results, newSearchResult(msg, folders))
+	}
+
+	if asJSON {
+		return json.NewEncoder(os.Stdout).Encode(results)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID\tDATE\tFROM\tSUBJECT\n")
+	for _, res := range results {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", res.ID, res.Time.Format("2006-01-02 15:04"), res.From, res.Subject)
+	}
+	return tw.Flush()
+}
+
+func searchCommand(args []string) {
+	ctx := context.Background()
+
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	from := fs.String("from", "", "only list messages whose sender contains this text")
+	to := fs.String("to", "", "only list messages whose recipients contain this text")
+	subject := fs.String("subject", "", "only list messages whose subject contains this text")
+	folderName := fs.String("folder", "", "only list messages in this folder or label")
+	after := fs.String("after", "", "only list messages received on or after this date (YYYY-MM-DD)")
+	before := fs.String("before", "", "only list messages received before this date (YYYY-MM-DD)")
+	body := fs.String("body", "", "only list messages whose body contains these words, using the local index of the IMAP server")
+	limit := fs.Int("limit", 50, "maximum number of messages to list")
+	asJSON := fs.Bool("json", false, "print results as JSON")
+	fs.Parse(args)
+	username := fs.Arg(0)
+	if username == "" || fs.NArg() > 2 || *limit <= 0 {
+		log.Fatal(searchUsage)
+	}
+
+	filter := &protonmail.MessageFilter{
+		Keyword: fs.Arg(1),
+		From:    *from,
+		To:      *to,
+		Subject: *subject,
+	}
+
+	var err error
+	if filter.Begin, err = parseSearchDate(*after); err != nil {
+		log.Fatal(err)
+	}
+	if filter.End, err = parseSearchDate(*before); err != nil {
+		log.Fatal(err)
+	}
+
+	c, privateKeys, err := login(ctx, username)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	folders, err := listFolders(ctx, c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *folderName != "" {
+		if filter.Label, err = findFolder(folders, *folderName); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var messages []*protonmail.Message
+	if *body != "" {
+		// Message bodies are end-to-end encrypted, so the API can't search
+		// them
+		u, err := c.GetCurrentUser(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		indexed, err := imapbackend.SearchLocal(u, privateKeys, *body)
+		if err != nil {
+			log.Fatalf("cannot search local index: %v", err)
+		}
+
+		for _, msg := range indexed {
+			if matchFilter(msg, filter) {
+				messages = append(messages, msg)
+			}
+		}
+		sort.Slice(messages, func(i, j int) bool {
+			return messages[i].Time > messages[j].Time
+		})
+		if len(messages) > *limit {
+			messages = messages[:*limit]
+		}
+	} else {
+		if messages, err = searchServer(ctx, c, filter, *limit); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := printMessages(messages, folders, *asJSON); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/howeyc/gopass"
+
+	"github.com/emersion/hydroxide/auth"
+	smtpbackend "github.com/emersion/hydroxide/smtp"
+)
+
+const sendUsage = "usage: hydroxide send <username> [recipient...] < message.eml"
+
+// sendMessage sends a message with the SMTP backend, as if it was submitted by
+// an SMTP client. Recipients which aren't listed in the message header are
+// sent a blind carbon copy.
+func sendMessage(authManager *auth.Manager, username, bridgePassword string, rcpts []string, r io.Reader) error {
+	session, err := smtpbackend.New(authManager, nil).Login(nil, username, bridgePassword)
+	if err != nil {
+		return err
+	}
+	defer session.Logout()
+
+	for _, rcpt := range rcpts {
+		if err := session.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+
+	return session.Data(r)
+}
+
+// askBridgePasswordTTY reads the bridge password from the HYDROXIDE_BRIDGE_PASS
+// environment variable or the OS keyring, or from the terminal if unset.
+// Unlike askBridgePassword, stdin is left untouched.
+func askBridgePasswordTTY(username string) (string, error) {
+	if pass := os.Getenv("HYDROXIDE_BRIDGE_PASS"); pass != "" {
+		return pass, nil
+	}
+	if pass, ok := keyringPassword(username); ok {
+		return pass, nil
+	}
+
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return "", fmt.Errorf("cannot ask for the bridge password: %v", err)
+	}
+	defer tty.Close()
+
+	pass, err := gopass.GetPasswdPrompt("Bridge password: ", false, tty, os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return string(pass), nil
+}
+
+func sendCommand(args []string) {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	fs.Parse(args)
+	username := fs.Arg(0)
+	if username == "" {
+		log.Fatal(sendUsage)
+	}
+
+	bridgePassword, err := askBridgePasswordTTY(username)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	authManager := auth.NewManager(newClient)
+	err = sendMessage(authManager, username, bridgePassword, fs.Args()[1:], bufio.NewReader(os.Stdin))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Fprintln(os.Stderr, "Message sent")
+}
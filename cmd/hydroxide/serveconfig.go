@@ -0,0 +1,183 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/emersion/hydroxide/config"
+)
+
+// serveConfig contains the settings of a configuration file which can't be
+// set with flags.
+type serveConfig struct {
+	// Frontends which aren't started by serve
+	disabled map[string]bool
+	// Account settings, indexed by username then by setting name
+	accounts map[string]map[string]string
+}
+
+// protocolEnabled checks whether serve starts a frontend.
+func (cfg *serveConfig) protocolEnabled(protocol string) bool {
+	return cfg == nil || !cfg.disabled[protocol]
+}
+
+// loadServeConfig reads a YAML configuration file. Its keys are the names of
+// the global flags, which can be nested: "smtp: {port: 1025}" is the same as
+// "-smtp-port 1025". Flags set on the command line take precedence.
+func loadServeConfig(path string) (*serveConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var root map[string]interface{}
+	if err := yaml.Unmarshal(b, &root); err != nil {
+		return nil, fmt.Errorf("cannot parse %v: %v", path, err)
+	}
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	cfg := &serveConfig{
+		disabled: make(map[string]bool),
+		accounts: make(map[string]map[string]string),
+	}
+	if accounts, ok := root["accounts"]; ok {
+		delete(root, "accounts")
+		if err := cfg.parseAccounts(accounts); err != nil {
+			return nil, fmt.Errorf("%v: %v", path, err)
+		}
+	}
+
+	if err := cfg.apply("", root, set); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return cfg, nil
+}
+
+func (cfg *serveConfig) apply(prefix string, m map[string]interface{}, set map[string]bool) error {
+	for k, v := range m {
+		name := k
+		if prefix != "" {
+			name = prefix + "-" + k
+		}
+
+		if k == "enabled" && isProtocol(prefix) {
+			enabled, ok := v.(bool)
+			if !ok {
+				return fmt.Errorf("%v: expected a boolean", name)
+			}
+			cfg.disabled[prefix] = !enabled
+			continue
+		}
+
+		f := flag.Lookup(name)
+		child, isMap := toStringMap(v)
+		if f == nil && isMap {
+			if err := cfg.apply(name, child, set); err != nil {
+				return err
+			}
+			continue
+		} else if f == nil {
+			return fmt.Errorf("unknown option %q", name)
+		}
+		if set[name] {
+			continue
+		}
+
+		var value string
+		if isMap {
+			// e.g. retention: {Trash: 30}
+			value = formatPairs(child)
+		} else {
+			value = fmt.Sprint(v)
+		}
+		if err := f.Value.Set(value); err != nil {
+			return fmt.Errorf("invalid value for %v: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (cfg *serveConfig) parseAccounts(v interface{}) error {
+	accounts, ok := toStringMap(v)
+	if !ok {
+		return fmt.Errorf("accounts: expected a map")
+	}
+	for username, v := range accounts {
+		settings, ok := toStringMap(v)
+		if !ok {
+			return fmt.Errorf("accounts: %v: expected a map", username)
+		}
+		cfg.accounts[username] = make(map[string]string)
+		for name, value := range settings {
+			if _, ok := accountSettings[name]; !ok {
+				return fmt.Errorf("accounts: %v: unknown setting %q", username, name)
+			}
+			if b, ok := value.(bool); ok {
+				// YAML parses on and off as booleans
+				value = formatBool(b)
+			}
+			cfg.accounts[username][name] = fmt.Sprint(value)
+		}
+	}
+	return nil
+}
+
+// saveAccounts applies the account settings of the configuration file.
+func (cfg *serveConfig) saveAccounts() error {
+	for username, settings := range cfg.accounts {
+		account, err := config.LoadAccount(username)
+		if err != nil {
+			return err
+		}
+		for name, value := range settings {
+			if err := accountSettings[name].set(account, value); err != nil {
+				return fmt.Errorf("account %v: %v: %v", username, name, err)
+			}
+		}
+		if err := config.SaveAccount(username, account); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isProtocol(s string) bool {
+	switch s {
+	case config.ProtocolIMAP, config.ProtocolSMTP, config.ProtocolCardDAV, config.ProtocolCalDAV, config.ProtocolWebDAV:
+		return true
+	default:
+		return false
+	}
+}
+
+// toStringMap converts a YAML map to a map with string keys.
+func toStringMap(v interface{}) (map[string]interface{}, bool) {
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, false
+	}
+	sm := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		sm[fmt.Sprint(k)] = v
+	}
+	return sm, true
+}
+
+// formatPairs formats a map as a comma-separated list of key=value pairs.
+func formatPairs(m map[string]interface{}) string {
+	l := make([]string, 0, len(m))
+	for k, v := range m {
+		l = append(l, fmt.Sprintf("%v=%v", k, v))
+	}
+	sort.Strings(l)
+	return strings.Join(l, ",")
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// mailSetting is a setting stored by ProtonMail, as opposed to local account
+// settings.
+type mailSetting struct {
+	get func(settings *protonmail.MailSettings) string
+	set func(settings *protonmail.MailSettings, update *protonmail.MailSettingsUpdate, value string) error
+}
+
+var swipeActionNames = map[protonmail.SwipeAction]string{
+	protonmail.SwipeTrash:    "trash",
+	protonmail.SwipeSpam:     "spam",
+	protonmail.SwipeStar:     "star",
+	protonmail.SwipeArchive:  "archive",
+	protonmail.SwipeMarkRead: "read",
+}
+
+func formatSwipeAction(action protonmail.SwipeAction) string {
+	if name, ok := swipeActionNames[action]; ok {
+		return name
+	}
+	return fmt.Sprint(int(action))
+}
+
+func parseSwipeAction(value string) (*protonmail.SwipeAction, error) {
+	for action, name := range swipeActionNames {
+		if name == value {
+			return &action, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid value %q: expected trash, spam, star, archive or read", value)
+}
+
+// parseMailBool parses an on/off value into a setting of MailSettingsUpdate.
+func parseMailBool(value string, dst **bool) error {
+	b, err := parseBool(value)
+	if err != nil {
+		return err
+	}
+	*dst = &b
+	return nil
+}
+
+var mailSettings = map[string]mailSetting{
+	"attach-public-key": {
+		get: func(settings *protonmail.MailSettings) string {
+			return formatBool(settings.AttachPublicKey != 0)
+		},
+		set: func(settings *protonmail.MailSettings, update *protonmail.MailSettingsUpdate, value string) error {
+			return parseMailBool(value, &update.AttachPublicKey)
+		},
+	},
+	"auto-reply": {
+		get: func(settings *protonmail.MailSettings) string {
+			return formatBool(settings.AutoResponder != nil && settings.AutoResponder.IsEnabled)
+		},
+		set: func(settings *protonmail.MailSettings, update *protonmail.MailSettingsUpdate, value string) error {
+			enabled, err := parseBool(value)
+			if err != nil {
+				return err
+			}
+			autoResponder := protonmail.AutoResponder{Repeat: protonmail.AutoResponderPermanent}
+			if settings.AutoResponder != nil {
+				autoResponder = *settings.AutoResponder
+			}
+			autoResponder.IsEnabled = enabled
+			update.AutoResponder = &autoResponder
+			return nil
+		},
+	},
+	"composer-mode": {
+		get: func(settings *protonmail.MailSettings) string {
+			if settings.ComposerMode == protonmail.ComposerMaximized {
+				return "maximized"
+			}
+			return "popup"
+		},
+		set: func(settings *protonmail.MailSettings, update *protonmail.MailSettingsUpdate, value string) error {
+			var mode protonmail.ComposerMode
+			switch value {
+			case "popup":
+				mode = protonmail.ComposerPopup
+			case "maximized":
+				mode = protonmail.ComposerMaximized
+			default:
+				return fmt.Errorf("invalid value %q: expected popup or maximized", value)
+			}
+			update.ComposerMode = &mode
+			return nil
+		},
+	},
+	"display-name": {
+		get: func(settings *protonmail.MailSettings) string {
+			return settings.DisplayName
+		},
+		set: func(settings *protonmail.MailSettings, update *protonmail.MailSettingsUpdate, value string) error {
+			update.DisplayName = &value
+			return nil
+		},
+	},
+	"draft-type": {
+		get: func(settings *protonmail.MailSettings) string {
+			if settings.DraftMIMEType == "text/plain" {
+				return "plain"
+			}
+			return "html"
+		},
+		set: func(settings *protonmail.MailSettings, update *protonmail.MailSettingsUpdate, value string) error {
+			var mimeType string
+			switch value {
+			case "html":
+				mimeType = "text/html"
+			case "plain":
+				mimeType = "text/plain"
+			default:
+				return fmt.Errorf("invalid value %q: expected html or plain", value)
+			}
+			update.DraftMIMEType = &mimeType
+			return nil
+		},
+	},
+	"pgp-scheme": {
+		get: func(settings *protonmail.MailSettings) string {
+			if settings.PGPScheme == protonmail.PGPInline {
+				return "inline"
+			}
+			return "mime"
+		},
+		set: func(settings *protonmail.MailSettings, update *protonmail.MailSettingsUpdate, value string) error {
+			var scheme protonmail.PGPScheme
+			switch value {
+			case "inline":
+				scheme = protonmail.PGPInline
+			case "mime":
+				scheme = protonmail.PGPMIME
+			default:
+				return fmt.Errorf("invalid value %q: expected inline or mime", value)
+			}
+			update.PGPScheme = &scheme
+			return nil
+		},
+	},
+	"proton-signature": {
+		get: func(settings *protonmail.MailSettings) string {
+			return formatBool(settings.PMSignature != 0)
+		},
+		set: func(settings *protonmail.MailSettings, update *protonmail.MailSettingsUpdate, value string) error {
+			return parseMailBool(value, &update.PMSignature)
+		},
+	},
+	"sign": {
+		get: func(settings *protonmail.MailSettings) string {
+			return formatBool(settings.Sign != 0)
+		},
+		set: func(settings *protonmail.MailSettings, update *protonmail.MailSettingsUpdate, value string) error {
+			return parseMailBool(value, &update.Sign)
+		},
+	},
+	"signature": {
+		get: func(settings *protonmail.MailSettings) string {
+			return fmt.Sprintf("%q", settings.Signature)
+		},
+		set: func(settings *protonmail.MailSettings, update *protonmail.MailSettingsUpdate, value string) error {
+			update.Signature = &value
+			return nil
+		},
+	},
+	"swipe-left": {
+		get: func(settings *protonmail.MailSettings) string {
+			return formatSwipeAction(settings.SwipeLeft)
+		},
+		set: func(settings *protonmail.MailSettings, update *protonmail.MailSettingsUpdate, value string) (err error) {
+			update.SwipeLeft, err = parseSwipeAction(value)
+			return err
+		},
+	},
+	"swipe-right": {
+		get: func(settings *protonmail.MailSettings) string {
+			return formatSwipeAction(settings.SwipeRight)
+		},
+		set: func(settings *protonmail.MailSettings, update *protonmail.MailSettingsUpdate, value string) (err error) {
+			update.SwipeRight, err = parseSwipeAction(value)
+			return err
+		},
+	},
+}
+
+const settingsUsage = "usage: hydroxide settings <username> [<setting> <value>]..."
+
+func settingsCommand(args []string) {
+	ctx := context.Background()
+
+	if len(args)%2 != 1 {
+		log.Fatal(settingsUsage)
+	}
+	username := args[0]
+
+	// Check settings before asking for the bridge password
+	for i := 1; i < len(args); i += 2 {
+		if _, ok := mailSettings[args[i]]; !ok {
+			log.Fatalf("unknown setting %q", args[i])
+		}
+	}
+
+	c, _, err := login(ctx, username)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	settings, err := c.GetMailSettings(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(args) > 1 {
+		var update protonmail.MailSettingsUpdate
+		for i := 1; i < len(args); i += 2 {
+			if err := mailSettings[args[i]].set(settings, &update, args[i+1]); err != nil {
+				log.Fatalf("%v: %v", args[i], err)
+			}
+		}
+		if settings, err = c.UpdateMailSettings(ctx, &update); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	names := make([]string, 0, len(mailSettings))
+	for name := range mailSettings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(tw, "%v\t%v\n", name, mailSettings[name].get(settings))
+	}
+	tw.Flush()
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// authTwoFactor completes a login with a second factor: a security key if one
+// is registered and libfido2's tools are installed, a TOTP code otherwise.
+func authTwoFactor(ctx context.Context, c *protonmail.Client, a *protonmail.Auth) (scope string, err error) {
+	tf := &a.TwoFactor
+	hasTOTP := tf.TOTP == 1 || tf.Enabled&protonmail.TwoFactorTOTP != 0
+	hasFIDO2 := tf.Enabled&protonmail.TwoFactorFIDO2 != 0 && tf.FIDO2 != nil
+
+	if hasFIDO2 {
+		_, lookErr := exec.LookPath("fido2-assert")
+		if lookErr != nil && !hasTOTP {
+			return "", errors.New("a security key is required to login, please install the fido2-assert tool of libfido2")
+		}
+
+		if lookErr == nil {
+			assertion, err := fido2Assert(tf.FIDO2)
+			if err == nil {
+				return c.AuthFIDO2(ctx, assertion)
+			} else if !hasTOTP {
+				return "", err
+			}
+			log.Printf("Cannot use security key: %v", err)
+		}
+	}
+
+	if !hasTOTP {
+		return "", errors.New("unsupported 2FA method")
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	fmt.Printf("2FA TOTP code: ")
+	scanner.Scan()
+	return c.AuthTOTP(ctx, scanner.Text())
+}
+
+// fido2Device returns the path of the first security key listed by
+// fido2-token.
+func fido2Device() (string, error) {
+	out, err := exec.Command("fido2-token", "-L").Output()
+	if err != nil {
+		return "", fmt.Errorf("cannot list security keys: %v", err)
+	}
+	// Lines are formatted as "<path>: vendor=..., product=..."
+	for _, line := range strings.Split(string(out), "\n") {
+		if i := strings.Index(line, ": "); i > 0 {
+			return line[:i], nil
+		}
+	}
+	return "", errors.New("no security key found")
+}
+
+// fido2Assert signs the WebAuthn challenge with a security key, using the
+// fido2-assert tool.
+func fido2Assert(info *protonmail.FIDO2Info) (*protonmail.FIDO2Assertion, error) {
+	options, err := info.Options()
+	if err != nil {
+		return nil, fmt.Errorf("invalid FIDO2 options: %v", err)
+	}
+	rpID := options.PublicKey.RPID
+
+	var credentialIDs [][]byte
+	for _, cred := range options.PublicKey.AllowCredentials {
+		credentialIDs = append(credentialIDs, cred.ID)
+	}
+	if len(credentialIDs) == 0 {
+		for _, key := range info.RegisteredKeys {
+			credentialIDs = append(credentialIDs, key.CredentialID)
+		}
+	}
+	if len(credentialIDs) == 0 {
+		return nil, errors.New("no security key registered")
+	}
+
+	clientData, err := json.Marshal(struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}{
+		Type:      "webauthn.get",
+		Challenge: base64.RawURLEncoding.EncodeToString(options.PublicKey.Challenge),
+		Origin:    "https://" + rpID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	clientDataHash := sha256.Sum256(clientData)
+
+	device, err := fido2Device()
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Touch your security key...")
+	var lastErr error
+	for _, id := range credentialIDs {
+		authData, sig, err := runFIDO2Assert(device, clientDataHash[:], rpID, id, options.PublicKey.UserVerification == "required")
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		return &protonmail.FIDO2Assertion{
+			AuthenticationOptions: info.AuthenticationOptions,
+			ClientData:            base64.StdEncoding.EncodeToString(clientData),
+			AuthenticatorData:     base64.StdEncoding.EncodeToString(authData),
+			Signature:             base64.StdEncoding.EncodeToString(sig),
+			CredentialID:          id,
+		}, nil
+	}
+	return nil, lastErr
+}
+
+// runFIDO2Assert gets an assertion for a credential, see fido2-assert(1).
+func runFIDO2Assert(device string, clientDataHash []byte, rpID string, credentialID []byte, userVerification bool) (authData, sig []byte, err error) {
+	args := []string{"-G"}
+	if userVerification {
+		args = append(args, "-v")
+	}
+	args = append(args, device)
+
+	var stdin bytes.Buffer
+	fmt.Fprintln(&stdin, base64.StdEncoding.EncodeToString(clientDataHash))
+	fmt.Fprintln(&stdin, rpID)
+	fmt.Fprintln(&stdin, base64.StdEncoding.EncodeToString(credentialID))
+
+	cmd := exec.Command("fido2-assert", args...)
+	cmd.Stdin = &stdin
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, nil, fmt.Errorf("fido2-assert failed: %v", err)
+	}
+
+	// Output lines: client data hash, relying party ID, authenticator data
+	// and signature
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) < 4 {
+		return nil, nil, errors.New("fido2-assert: unexpected output")
+	}
+	cborAuthData, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[2]))
+	if err != nil {
+		return nil, nil, fmt.Errorf("fido2-assert: invalid authenticator data: %v", err)
+	}
+	if authData, err = decodeCBORBytes(cborAuthData); err != nil {
+		return nil, nil, fmt.Errorf("fido2-assert: invalid authenticator data: %v", err)
+	}
+	if sig, err = base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3])); err != nil {
+		return nil, nil, fmt.Errorf("fido2-assert: invalid signature: %v", err)
+	}
+	return authData, sig, nil
+}
+
+// decodeCBORBytes decodes a CBOR byte string, as written by fido2-assert for
+// authenticator data.
+func decodeCBORBytes(b []byte) ([]byte, error) {
+	if len(b) == 0 || b[0]>>5 != 2 {
+		return nil, errors.New("not a CBOR byte string")
+	}
+
+	var n uint64
+	switch info := b[0] & 0x1f; {
+	case info < 24:
+		n, b = uint64(info), b[1:]
+	case info == 24 && len(b) >= 2:
+		n, b = uint64(b[1]), b[2:]
+	case info == 25 && len(b) >= 3:
+		n, b = uint64(binary.BigEndian.Uint16(b[1:])), b[3:]
+	case info == 26 && len(b) >= 5:
+		n, b = uint64(binary.BigEndian.Uint32(b[1:])), b[5:]
+	default:
+		return nil, errors.New("unsupported CBOR byte string length")
+	}
+	if uint64(len(b)) != n {
+		return nil, errors.New("truncated CBOR byte string")
+	}
+	return b, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDecodeCBORBytes(t *testing.T) {
+	long := bytes.Repeat([]byte{0xab}, 300)
+
+	tests := []struct {
+		name string
+		in   []byte
+		want []byte
+		err  bool
+	}{
+		{name: "empty byte string", in: []byte{0x40}, want: []byte{}},
+		{name: "short", in: []byte{0x43, 1, 2, 3}, want: []byte{1, 2, 3}},
+		{name: "1-byte length", in: append([]byte{0x58, 30}, long[:30]...), want: long[:30]},
+		{name: "2-byte length", in: append([]byte{0x59, 0x01, 0x2c}, long...), want: long},
+		{name: "4-byte length", in: append([]byte{0x5a, 0, 0, 0x01, 0x2c}, long...), want: long},
+		{name: "empty", in: nil, err: true},
+		{name: "text string", in: []byte{0x63, 'a', 'b', 'c'}, err: true},
+		{name: "truncated", in: []byte{0x43, 1, 2}, err: true},
+		{name: "trailing data", in: []byte{0x41, 1, 2}, err: true},
+		{name: "truncated length", in: []byte{0x59, 0x01}, err: true},
+		{name: "truncated 4-byte length", in: []byte{0x5a, 0, 0, 0x01}, err: true},
+		{name: "8-byte length", in: append([]byte{0x5b, 0, 0, 0, 0, 0, 0, 0x01, 0x2c}, long...), err: true},
+		{name: "indefinite length", in: []byte{0x5f, 0x41, 1, 0xff}, err: true},
+	}
+	for _, tc := range tests {
+		got, err := decodeCBORBytes(tc.in)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%v: decodeCBORBytes() succeeded", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: decodeCBORBytes() = %v", tc.name, err)
+		} else if !bytes.Equal(got, tc.want) {
+			t.Errorf("%v: decodeCBORBytes() = %x, want %x", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/emersion/hydroxide/events"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+const unreadUsage = "usage: hydroxide unread [-json] [-follow] [-conversations] [-listen <address>] <username>"
+
+var systemFolders = []struct {
+	name  string
+	label string
+}{
+	{"Inbox", protonmail.LabelInbox},
+	{"Drafts", protonmail.LabelDraft},
+	{"Sent", protonmail.LabelSent},
+	{"Starred", protonmail.LabelStarred},
+	{"Archive", protonmail.LabelArchive},
+	{"Spam", protonmail.LabelSpam},
+	{"Trash", protonmail.LabelTrash},
+}
+
+type mailFolder struct {
+	name  string
+	label string
+}
+
+// unreadStatus is formatted for status bars: text, tooltip and class are
+// understood by waybar custom modules. Other tools can use folders.
+type unreadStatus struct {
+	Text    string         `json:"text"`
+	Tooltip string         `json:"tooltip"`
+	Class   string         `json:"class"`
+	Folders map[string]int `json:"folders"`
+}
+
+func listFolders(ctx context.Context, c *protonmail.Client) ([]mailFolder, error) {
+	var folders []mailFolder
+	for _, data := range systemFolders {
+		folders = append(folders, mailFolder{data.name, data.label})
+	}
+
+	labels, err := c.ListLabels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, label := range labels {
+		if label.Type == protonmail.LabelMessage {
+			folders = append(folders, mailFolder{label.Name, label.ID})
+		}
+	}
+	return folders, nil
+}
+
+func newUnreadStatus(folders []mailFolder, unread map[string]int) *unreadStatus {
+	status := &unreadStatus{
+		Text:    strconv.Itoa(unread[protonmail.LabelInbox]),
+		Class:   "read",
+		Folders: make(map[string]int, len(folders)),
+	}
+	if unread[protonmail.LabelInbox] > 0 {
+		status.Class = "unread"
+	}
+
+	var lines []string
+	for _, folder := range folders {
+		n := unread[folder.label]
+		status.Folders[folder.name] = n
+		if n > 0 {
+			lines = append(lines, fmt.Sprintf("%v: %v", folder.name, n))
+		}
+	}
+	status.Tooltip = strings.Join(lines, "\n")
+	return status
+}
+
+func (status *unreadStatus) String() string {
+	if status.Tooltip == "" {
+		return "No unread messages"
+	}
+	return strings.Replace(status.Tooltip, "\n", ", ", -1)
+}
+
+// unreadHandler serves the latest unread counts as JSON.
+type unreadHandler struct {
+	locker sync.Mutex
+	status *unreadStatus
+}
+
+func (h *unreadHandler) set(status *unreadStatus) {
+	h.locker.Lock()
+	h.status = status
+	h.locker.Unlock()
+}
+
+func (h *unreadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.locker.Lock()
+	status := h.status
+	h.locker.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Println("cannot write unread counts:", err)
+	}
+}
+
+// countUnread fetches the unread counts of all folders. With conversations
+// set, unread conversations are counted instead of messages, like the web
+// client does in conversation mode.
+func countUnread(ctx context.Context, c *protonmail.Client, conversations bool, unread map[string]int) error {
+	var counts []*protonmail.MessageCount
+	var err error
+	if conversations {
+		counts, err = c.CountConversations(ctx, "")
+	} else {
+		counts, err = c.CountMessages(ctx, "")
+	}
+	if err != nil {
+		return err
+	}
+	for _, count := range counts {
+		unread[count.LabelID] = count.Unread
+	}
+	return nil
+}
+
+func unreadCommand(args []string) {
+	ctx := context.Background()
+
+	fs := flag.NewFlagSet("unread", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print counts as JSON")
+	follow := fs.Bool("follow", false, "print counts again each time they change")
+	listen := fs.String("listen", "", "serve counts as JSON over HTTP on this address")
+	conversations := fs.Bool("conversations", false, "count unread conversations instead of messages")
+	fs.Parse(args)
+	username := fs.Arg(0)
+	if username == "" {
+		log.Fatal(unreadUsage)
+	}
+
+	c, _, err := login(ctx, username)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	folders, err := listFolders(ctx, c)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	unread := make(map[string]int)
+	if err := countUnread(ctx, c, *conversations, unread); err != nil {
+		log.Fatal(err)
+	}
+
+	var handler unreadHandler
+	update := func() {
+		status := newUnreadStatus(folders, unread)
+		handler.set(status)
+		if *asJSON {
+			if err := json.NewEncoder(os.Stdout).Encode(status); err != nil {
+				log.Fatal(err)
+			}
+		} else {
+			fmt.Println(status)
+		}
+	}
+	update()
+
+	if !*follow && *listen == "" {
+		return
+	}
+	if !*follow {
+		// Only keep the HTTP endpoint up-to-date
+		update = func() {
+			handler.set(newUnreadStatus(folders, unread))
+		}
+	}
+
+	if *listen != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(*listen, &handler))
+		}()
+	}
+
+	ch := make(chan *protonmail.Event)
+	events.NewManager().Register(c, username, ch, nil)
+	for event := range ch {
+		changed := false
+		if event.Refresh&protonmail.EventRefreshMail != 0 {
+			if err := countUnread(ctx, c, *conversations, unread); err != nil {
+				log.Println("cannot count messages:", err)
+			}
+			changed = true
+		}
+		counts := event.MessageCounts
+		if *conversations {
+			counts = event.ConversationCounts
+		}
+		for _, count := range counts {
+			if unread[count.LabelID] != count.Unread {
+				unread[count.LabelID] = count.Unread
+				changed = true
+			}
+		}
+		if changed {
+			update()
+		}
+	}
+}
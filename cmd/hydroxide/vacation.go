@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+const vacationUsage = `usage: hydroxide vacation show <username>
+       hydroxide vacation on [options...] <username>
+       hydroxide vacation off <username>`
+
+// vacationTimeLayouts are the accepted formats of -start and -end.
+var vacationTimeLayouts = []string{"2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02"}
+
+func parseVacationTime(s string, loc *time.Location) (time.Time, error) {
+	for _, layout := range vacationTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: expected YYYY-MM-DD or YYYY-MM-DD HH:MM", s)
+}
+
+func printAutoResponder(ar *protonmail.AutoResponder) {
+	if ar == nil || !ar.IsEnabled {
+		fmt.Println("Auto-reply is disabled")
+		return
+	}
+
+	loc, err := time.LoadLocation(ar.Zone)
+	if err != nil {
+		loc = time.UTC
+	}
+	switch ar.Repeat {
+	case protonmail.AutoResponderPermanent:
+		fmt.Println("Auto-reply is enabled until disabled")
+	case protonmail.AutoResponderFixed:
+		const layout = "2006-01-02 15:04"
+		fmt.Printf("Auto-reply is enabled from %v to %v (%v)\n", ar.StartTime.Time().In(loc).Format(layout), ar.EndTime.Time().In(loc).Format(layout), ar.Zone)
+	default:
+		fmt.Println("Auto-reply is enabled periodically, as configured in the web client")
+	}
+	if ar.Subject != "" {
+		fmt.Printf("Subject: %v\n", ar.Subject)
+	}
+	fmt.Printf("\n%v\n", ar.Message)
+}
+
+func vacationCommand(args []string) {
+	ctx := context.Background()
+
+	if len(args) < 1 {
+		log.Fatal(vacationUsage)
+	}
+	subcmd := args[0]
+
+	fs := flag.NewFlagSet("vacation "+subcmd, flag.ExitOnError)
+	switch subcmd {
+	case "show":
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			log.Fatal(vacationUsage)
+		}
+
+		c, _, err := login(ctx, fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		settings, err := c.GetMailSettings(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printAutoResponder(settings.AutoResponder)
+	case "on":
+		start := fs.String("start", "", "start of the absence, YYYY-MM-DD [HH:MM], defaults to now")
+		end := fs.String("end", "", "end of the absence, YYYY-MM-DD [HH:MM], auto-reply stays enabled until disabled if unset")
+		zone := fs.String("zone", "", "time zone of -start and -end, e.g. Europe/Paris, defaults to the previous one or UTC")
+		subject := fs.String("subject", "", "subject of replies, defaults to the previous one")
+		message := fs.String("message", "", "message of replies, defaults to the previous one")
+		messageFile := fs.String("message-file", "", "file containing the message of replies")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			log.Fatal(vacationUsage)
+		}
+		if *start != "" && *end == "" {
+			log.Fatal("-start requires -end")
+		}
+
+		if *messageFile != "" {
+			b, err := ioutil.ReadFile(*messageFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			*message = string(b)
+		}
+
+		c, _, err := login(ctx, fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		settings, err := c.GetMailSettings(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var ar protonmail.AutoResponder
+		if settings.AutoResponder != nil {
+			ar = *settings.AutoResponder
+		}
+		ar.IsEnabled = true
+		if *subject != "" {
+			ar.Subject = *subject
+		}
+		if *message != "" {
+			ar.Message = *message
+		}
+		if ar.Message == "" {
+			log.Fatal("no auto-reply message, use -message or -message-file")
+		}
+		if *zone != "" {
+			ar.Zone = *zone
+		} else if ar.Zone == "" {
+			ar.Zone = "UTC"
+		}
+
+		if *end == "" {
+			ar.Repeat = protonmail.AutoResponderPermanent
+		} else {
+			loc, err := time.LoadLocation(ar.Zone)
+			if err != nil {
+				log.Fatalf("invalid time zone: %v", err)
+			}
+
+			startTime := time.Now()
+			if *start != "" {
+				if startTime, err = parseVacationTime(*start, loc); err != nil {
+					log.Fatal(err)
+				}
+			}
+			endTime, err := parseVacationTime(*end, loc)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if !endTime.After(startTime) {
+				log.Fatal("the end of the absence must be after its start")
+			}
+
+			ar.Repeat = protonmail.AutoResponderFixed
+			ar.StartTime = protonmail.Timestamp(startTime.Unix())
+			ar.EndTime = protonmail.Timestamp(endTime.Unix())
+		}
+
+		if settings, err = c.SetAutoResponder(ctx, &ar); err != nil {
+			log.Fatal(err)
+		}
+		printAutoResponder(settings.AutoResponder)
+	case "off":
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			log.Fatal(vacationUsage)
+		}
+
+		c, _, err := login(ctx, fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		settings, err := c.GetMailSettings(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if settings.AutoResponder == nil || !settings.AutoResponder.IsEnabled {
+			fmt.Println("Auto-reply is already disabled")
+			return
+		}
+
+		ar := *settings.AutoResponder
+		ar.IsEnabled = false
+		if _, err := c.SetAutoResponder(ctx, &ar); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Auto-reply is disabled")
+	default:
+		log.Fatal(vacationUsage)
+	}
+}
@@ -0,0 +1,224 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Account contains per-account settings.
+type Account struct {
+	// Refuse to send messages which would leave Proton in cleartext, as if
+	// the client always requested REQUIRETLS
+	RequireTLS bool `json:",omitempty"`
+	// What to do when the key of an external recipient doesn't match the key
+	// used for previous messages: "warn" (the default), "block" or "off"
+	KeyPinning string `json:",omitempty"`
+	// Whether to check the keys of ProtonMail recipients with key
+	// transparency: "off" (the default), "warn" or "strict" to refuse to
+	// send messages to recipients whose keys can't be verified
+	KeyTransparency string `json:",omitempty"`
+	// Encryption preference advertised in the Autocrypt header field of
+	// outgoing messages: "nopreference" (the default), "mutual" or "off" to
+	// omit the header field
+	Autocrypt string `json:",omitempty"`
+	// Send RFC 3156-compliant PGP/MIME messages to external recipients with
+	// a public key, instead of ProtonMail's default packaging
+	PGPMIME bool `json:",omitempty"`
+	// Include protected header fields in PGP/MIME messages
+	ProtectedHeaders bool `json:",omitempty"`
+	// Attach the sender's public key to outgoing messages
+	AttachPublicKey bool `json:",omitempty"`
+	// What to do with messages which would leave Proton unencrypted: "allow"
+	// (the default), "warn" to require a confirmation header field or "block"
+	Cleartext string `json:",omitempty"`
+	// How to look up the keys of external recipients without a key published
+	// on ProtonMail: "off" (the default), "wkd" or "keyserver" to query
+	// keys.openpgp.org too
+	KeyDiscovery string `json:",omitempty"`
+	// Local IP address or network interface used for connections to
+	// ProtonMail, overriding the -bind flag
+	Bind string `json:",omitempty"`
+	// Read the bridge password from the OS keyring instead of asking for it
+	Keyring bool `json:",omitempty"`
+	// Frontends which refuse to log in the account, e.g. "imap" for a
+	// send-only account
+	Disabled []string `json:",omitempty"`
+}
+
+// Frontends which can be disabled per account.
+const (
+	ProtocolIMAP    = "imap"
+	ProtocolSMTP    = "smtp"
+	ProtocolCardDAV = "carddav"
+	ProtocolCalDAV  = "caldav"
+	ProtocolWebDAV  = "webdav"
+)
+
+// ProtocolEnabled checks whether the account can log in to a frontend.
+func (account *Account) ProtocolEnabled(protocol string) bool {
+	for _, p := range account.Disabled {
+		if p == protocol {
+			return false
+		}
+	}
+	return true
+}
+
+// SetProtocolEnabled enables or disables a frontend for the account.
+func (account *Account) SetProtocolEnabled(protocol string, enabled bool) {
+	disabled := account.Disabled[:0]
+	for _, p := range account.Disabled {
+		if p != protocol {
+			disabled = append(disabled, p)
+		}
+	}
+	if !enabled {
+		disabled = append(disabled, protocol)
+	}
+	account.Disabled = disabled
+}
+
+// CheckProtocol returns an error if a frontend is disabled for an account.
+func CheckProtocol(username, protocol string) error {
+	account, err := LoadAccount(username)
+	if err != nil {
+		return err
+	}
+	if !account.ProtocolEnabled(protocol) {
+		return fmt.Errorf("%v is disabled for account %q", strings.ToUpper(protocol), username)
+	}
+	return nil
+}
+
+// Key pinning policies.
+const (
+	KeyPinningWarn  = "warn"
+	KeyPinningBlock = "block"
+	KeyPinningOff   = "off"
+)
+
+// KeyPinningPolicy returns the key pinning policy of the account.
+func (account *Account) KeyPinningPolicy() string {
+	if account.KeyPinning == "" {
+		return KeyPinningWarn
+	}
+	return account.KeyPinning
+}
+
+// Key transparency policies.
+const (
+	KeyTransparencyOff    = "off"
+	KeyTransparencyWarn   = "warn"
+	KeyTransparencyStrict = "strict"
+)
+
+// KeyTransparencyPolicy returns the key transparency policy of the account.
+func (account *Account) KeyTransparencyPolicy() string {
+	if account.KeyTransparency == "" {
+		return KeyTransparencyOff
+	}
+	return account.KeyTransparency
+}
+
+// Policies for messages sent unencrypted to external recipients.
+const (
+	CleartextAllow = "allow"
+	CleartextWarn  = "warn"
+	CleartextBlock = "block"
+)
+
+// CleartextPolicy returns the policy of the account for messages sent
+// unencrypted to external recipients.
+func (account *Account) CleartextPolicy() string {
+	if account.Cleartext == "" {
+		return CleartextAllow
+	}
+	return account.Cleartext
+}
+
+// Key discovery methods for external recipients.
+const (
+	KeyDiscoveryOff       = "off"
+	KeyDiscoveryWKD       = "wkd"
+	KeyDiscoveryKeyserver = "keyserver"
+)
+
+// KeyDiscoveryMethod returns how the keys of external recipients are looked
+// up.
+func (account *Account) KeyDiscoveryMethod() string {
+	if account.KeyDiscovery == "" {
+		return KeyDiscoveryOff
+	}
+	return account.KeyDiscovery
+}
+
+// AutocryptOff disables Autocrypt header fields in outgoing messages.
+const AutocryptOff = "off"
+
+// AutocryptPreference returns the Autocrypt encryption preference of the
+// account.
+func (account *Account) AutocryptPreference() string {
+	if account.Autocrypt == "" {
+		return "nopreference"
+	}
+	return account.Autocrypt
+}
+
+func accountsFilePath() (string, error) {
+	return Path("accounts.json")
+}
+
+// LoadAccounts reads the settings of all accounts, indexed by username.
+func LoadAccounts() (map[string]*Account, error) {
+	p, err := accountsFilePath()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return make(map[string]*Account), nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	accounts := make(map[string]*Account)
+	err = json.NewDecoder(f).Decode(&accounts)
+	return accounts, err
+}
+
+// LoadAccount reads the settings of an account. If the account has no
+// settings, the defaults are returned.
+func LoadAccount(username string) (*Account, error) {
+	accounts, err := LoadAccounts()
+	if err != nil {
+		return nil, err
+	}
+	if account, ok := accounts[username]; ok && account != nil {
+		return account, nil
+	}
+	return &Account{}, nil
+}
+
+// SaveAccount stores the settings of an account.
+func SaveAccount(username string, account *Account) error {
+	accounts, err := LoadAccounts()
+	if err != nil {
+		return err
+	}
+	accounts[username] = account
+
+	p, err := accountsFilePath()
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return json.NewEncoder(f).Encode(accounts)
+}
@@ -0,0 +1,38 @@
+package config
+
+import (
+	"time"
+)
+
+// AutocryptPeer is the state of an external correspondent, learned from the
+// Autocrypt header fields of their messages.
+type AutocryptPeer struct {
+	KeyData       []byte
+	PreferEncrypt string
+	// Date of the most recent message the state has been updated from
+	LastSeen time.Time
+}
+
+const autocryptFilename = "autocrypt.json"
+
+// LoadAutocryptPeers reads the Autocrypt peers of an account, indexed by
+// lower-case email address.
+func LoadAutocryptPeers(username string) (map[string]*AutocryptPeer, error) {
+	all := make(map[string]map[string]*AutocryptPeer)
+	if err := ReadJSON(autocryptFilename, &all); err != nil {
+		return nil, err
+	}
+	if peers, ok := all[username]; ok && peers != nil {
+		return peers, nil
+	}
+	return make(map[string]*AutocryptPeer), nil
+}
+
+// SaveAutocryptPeers stores the Autocrypt peers of an account.
+func SaveAutocryptPeers(username string, peers map[string]*AutocryptPeer) error {
+	all := make(map[string]map[string]*AutocryptPeer)
+	return UpdateJSON(autocryptFilename, &all, func() error {
+		all[username] = peers
+		return nil
+	})
+}
@@ -6,17 +6,30 @@ import (
 	"path/filepath"
 )
 
+// dir overrides the default directory, if set.
+var dir string
+
+// SetDir sets the directory containing hydroxide's configuration and state,
+// instead of $XDG_CONFIG_HOME/hydroxide.
+func SetDir(d string) {
+	dir = d
+}
+
 func Path(filename string) (string, error) {
-	configHome := os.Getenv("XDG_CONFIG_HOME")
-	if configHome == "" {
-		home := os.Getenv("HOME")
-		if home == "" {
-			return "", errors.New("HOME not set")
+	base := dir
+	if base == "" {
+		configHome := os.Getenv("XDG_CONFIG_HOME")
+		if configHome == "" {
+			home := os.Getenv("HOME")
+			if home == "" {
+				return "", errors.New("HOME not set")
+			}
+			configHome = filepath.Join(home, ".config")
 		}
-		configHome = filepath.Join(home, ".config")
+		base = filepath.Join(configHome, "hydroxide")
 	}
 
-	p := filepath.Join(configHome, "hydroxide", filename)
+	p := filepath.Join(base, filename)
 
 	dirname, _ := filepath.Split(p)
 	if err := os.MkdirAll(dirname, 0700); err != nil {
@@ -25,3 +38,12 @@ func Path(filename string) (string, error) {
 
 	return p, nil
 }
+
+// Dir returns the directory containing hydroxide's configuration and state.
+func Dir() (string, error) {
+	p, err := Path("")
+	if err != nil {
+		return "", err
+	}
+	return p, os.MkdirAll(p, 0700)
+}
@@ -0,0 +1,30 @@
+package config
+
+import (
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+const ktFilename = "kt.json"
+
+// LoadKTCheckpoint reads the most recent key transparency epoch verified by
+// hydroxide. It returns nil if no epoch has been verified yet.
+func LoadKTCheckpoint() (*protonmail.KTCheckpoint, error) {
+	var cp *protonmail.KTCheckpoint
+	if err := ReadJSON(ktFilename, &cp); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+// SaveKTCheckpoint stores a verified key transparency epoch. The stored epoch
+// is left unchanged if it's more recent, e.g. because it has been saved by
+// another account.
+func SaveKTCheckpoint(cp *protonmail.KTCheckpoint) error {
+	var stored *protonmail.KTCheckpoint
+	return UpdateJSON(ktFilename, &stored, func() error {
+		if stored == nil || stored.EpochID < cp.EpochID {
+			stored = cp
+		}
+		return nil
+	})
+}
@@ -0,0 +1,50 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestSaveKTCheckpoint(t *testing.T) {
+	defer setTestDir(t)()
+
+	if cp, err := LoadKTCheckpoint(); err != nil || cp != nil {
+		t.Fatalf("LoadKTCheckpoint() = %v, %v, want nil", cp, err)
+	}
+
+	tests := []struct {
+		name string
+		save *protonmail.KTCheckpoint
+		want *protonmail.KTCheckpoint
+	}{
+		{
+			name: "first",
+			save: &protonmail.KTCheckpoint{EpochID: 10, ChainHash: "aaaa"},
+			want: &protonmail.KTCheckpoint{EpochID: 10, ChainHash: "aaaa"},
+		},
+		{
+			name: "more recent",
+			save: &protonmail.KTCheckpoint{EpochID: 12, ChainHash: "bbbb"},
+			want: &protonmail.KTCheckpoint{EpochID: 12, ChainHash: "bbbb"},
+		},
+		{
+			name: "older",
+			save: &protonmail.KTCheckpoint{EpochID: 11, ChainHash: "cccc"},
+			want: &protonmail.KTCheckpoint{EpochID: 12, ChainHash: "bbbb"},
+		},
+	}
+	for _, tc := range tests {
+		if err := SaveKTCheckpoint(tc.save); err != nil {
+			t.Fatalf("%v: SaveKTCheckpoint() = %v", tc.name, err)
+		}
+		cp, err := LoadKTCheckpoint()
+		if err != nil {
+			t.Fatalf("%v: LoadKTCheckpoint() = %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(cp, tc.want) {
+			t.Errorf("%v: LoadKTCheckpoint() = %+v, want %+v", tc.name, cp, tc.want)
+		}
+	}
+}
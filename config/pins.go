@@ -0,0 +1,45 @@
+package config
+
+import (
+	"strings"
+	"time"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// KeyPin is the public key of an external correspondent, recorded the first
+// time a message has been encrypted to them (trust on first use).
+type KeyPin struct {
+	Fingerprint string
+	FirstSeen   time.Time
+}
+
+const pinsFilename = "pins.json"
+
+// LoadPins reads the key pins of an account, indexed by lower-case email
+// address.
+func LoadPins(username string) (map[string]*KeyPin, error) {
+	all := make(map[string]map[string]*KeyPin)
+	if err := ReadJSON(pinsFilename, &all); err != nil {
+		return nil, err
+	}
+	if pins, ok := all[username]; ok && pins != nil {
+		return pins, nil
+	}
+	return make(map[string]*KeyPin), nil
+}
+
+// SavePins stores the key pins of an account.
+func SavePins(username string, pins map[string]*KeyPin) error {
+	all := make(map[string]map[string]*KeyPin)
+	return UpdateJSON(pinsFilename, &all, func() error {
+		all[username] = pins
+		return nil
+	})
+}
+
+// PinKey normalizes an email address for use as a key pin index.
+// Internationalized domains are stored in their ASCII form.
+func PinKey(email string) string {
+	return strings.ToLower(protonmail.ASCIIAddress(email))
+}
@@ -0,0 +1,66 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func setTestDir(t *testing.T) (cleanup func()) {
+	d, err := ioutil.TempDir("", "hydroxide-config-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetDir(d)
+	return func() {
+		SetDir("")
+		os.RemoveAll(d)
+	}
+}
+
+func TestSavePins(t *testing.T) {
+	defer setTestDir(t)()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	pins := map[string]map[string]*KeyPin{
+		"alice": {"bob@example.org": {Fingerprint: "aaaa", FirstSeen: now}},
+		"carol": {"dave@example.org": {Fingerprint: "bbbb", FirstSeen: now}},
+	}
+
+	// Concurrent saves of different accounts must not overwrite each other
+	var wg sync.WaitGroup
+	for username, p := range pins {
+		wg.Add(1)
+		go func(username string, p map[string]*KeyPin) {
+			defer wg.Done()
+			if err := SavePins(username, p); err != nil {
+				t.Errorf("SavePins(%q) = %v", username, err)
+			}
+		}(username, p)
+	}
+	wg.Wait()
+
+	for username, want := range pins {
+		got, err := LoadPins(username)
+		if err != nil {
+			t.Errorf("LoadPins(%q) = %v", username, err)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("LoadPins(%q) = %v, want %v", username, got, want)
+		}
+	}
+
+	// Temporary files are removed once renamed
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range files {
+		if fi.Name() != pinsFilename {
+			t.Errorf("unexpected file %v", filepath.Join(dir, fi.Name()))
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// storeLocker serializes the accesses to the JSON files stored in the config
+// directory, so that concurrent read-modify-write cycles don't lose updates.
+var storeLocker sync.Mutex
+
+func readJSON(filename string, v interface{}) error {
+	p, err := Path(filename)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return json.NewDecoder(f).Decode(v)
+}
+
+// writeJSON atomically replaces a file with the JSON encoding of v. The data
+// is written to a temporary file which is then renamed, so that readers never
+// see a partially written file.
+func writeJSON(filename string, v interface{}) error {
+	p, err := Path(filename)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := json.NewEncoder(f).Encode(v); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+// ReadJSON decodes a JSON file of the config directory into v. v is left
+// unchanged if the file doesn't exist.
+func ReadJSON(filename string, v interface{}) error {
+	storeLocker.Lock()
+	defer storeLocker.Unlock()
+
+	return readJSON(filename, v)
+}
+
+// UpdateJSON decodes a JSON file of the config directory into v, calls f to
+// modify v and atomically writes v back. Other calls to ReadJSON and
+// UpdateJSON are blocked during the update, so f must not call them. The file
+// is left unchanged if f returns an error.
+func UpdateJSON(filename string, v interface{}, f func() error) error {
+	storeLocker.Lock()
+	defer storeLocker.Unlock()
+
+	if err := readJSON(filename, v); err != nil {
+		return err
+	}
+	if err := f(); err != nil {
+		return err
+	}
+	return writeJSON(filename, v)
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestUpdateJSON(t *testing.T) {
+	defer setTestDir(t)()
+
+	errAbort := errors.New("abort")
+	tests := []struct {
+		name   string
+		update func(m map[string]int) error
+		err    error
+		want   map[string]int
+	}{
+		{
+			name: "create",
+			update: func(m map[string]int) error {
+				m["a"] = 1
+				return nil
+			},
+			want: map[string]int{"a": 1},
+		},
+		{
+			name: "update",
+			update: func(m map[string]int) error {
+				m["a"]++
+				m["b"] = 1
+				return nil
+			},
+			want: map[string]int{"a": 2, "b": 1},
+		},
+		{
+			name: "abort",
+			update: func(m map[string]int) error {
+				m["c"] = 1
+				return errAbort
+			},
+			err:  errAbort,
+			want: map[string]int{"a": 2, "b": 1},
+		},
+		{
+			name: "delete",
+			update: func(m map[string]int) error {
+				delete(m, "a")
+				return nil
+			},
+			want: map[string]int{"b": 1},
+		},
+	}
+	for _, tc := range tests {
+		m := make(map[string]int)
+		err := UpdateJSON("test.json", &m, func() error {
+			return tc.update(m)
+		})
+		if err != tc.err {
+			t.Errorf("%v: UpdateJSON() = %v, want %v", tc.name, err, tc.err)
+		}
+
+		got := make(map[string]int)
+		if err := ReadJSON("test.json", &got); err != nil {
+			t.Errorf("%v: ReadJSON() = %v", tc.name, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: ReadJSON() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
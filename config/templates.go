@@ -0,0 +1,54 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// loadNamedFile reads dir/name.txt and dir/name.html. Missing files are
+// returned as empty strings, but at least one of them must exist.
+func loadNamedFile(dir, name string) (text, html string, err error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return "", "", fmt.Errorf("invalid name %q", name)
+	}
+
+	found := false
+	for _, f := range []struct {
+		ext string
+		s   *string
+	}{{".txt", &text}, {".html", &html}} {
+		p, err := Path(dir + "/" + name + f.ext)
+		if err != nil {
+			return "", "", err
+		}
+		b, err := ioutil.ReadFile(p)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return "", "", err
+		}
+		*f.s = string(b)
+		found = true
+	}
+
+	if !found {
+		return "", "", fmt.Errorf("%v/%v.txt or %v/%v.html not found in the config directory", dir, name, dir, name)
+	}
+	return text, html, nil
+}
+
+// LoadTemplate reads the plain text and HTML versions of a message template,
+// stored in templates/<name>.txt and templates/<name>.html. Missing versions
+// are returned as empty strings.
+func LoadTemplate(name string) (text, html string, err error) {
+	return loadNamedFile("templates", name)
+}
+
+// LoadSignature reads the plain text and HTML versions of a signature, stored
+// in signatures/<name>.txt and signatures/<name>.html. Missing versions are
+// returned as empty strings.
+func LoadSignature(name string) (text, html string, err error) {
+	return loadNamedFile("signatures", name)
+}
@@ -1,12 +1,24 @@
 package config
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"time"
 )
 
+// selfSignedValidity is the lifetime of generated certificates.
+const selfSignedValidity = 5 * 365 * 24 * time.Hour
+
 func TLS(certPath string, keyPath string, clientCAPath string) (*tls.Config, error) {
 	var tlsConfig *tls.Config
 
@@ -40,3 +52,97 @@ func TLS(certPath string, keyPath string, clientCAPath string) (*tls.Config, err
 
 	return tlsConfig, nil
 }
+
+// SelfSignedCert returns the paths of a self-signed certificate and its key,
+// stored in the configuration directory. The certificate is generated if it
+// doesn't exist yet, has expired or isn't valid for one of hosts.
+func SelfSignedCert(hosts []string) (certPath, keyPath string, err error) {
+	certPath, err = Path("tls-cert.pem")
+	if err != nil {
+		return "", "", err
+	}
+	keyPath, err = Path("tls-key.pem")
+	if err != nil {
+		return "", "", err
+	}
+
+	if ok, err := isCertValid(certPath, keyPath, hosts); err != nil {
+		return "", "", err
+	} else if ok {
+		return certPath, keyPath, nil
+	}
+
+	if err := generateCert(certPath, keyPath, hosts); err != nil {
+		return "", "", fmt.Errorf("cannot generate self-signed certificate: %v", err)
+	}
+	return certPath, keyPath, nil
+}
+
+func isCertValid(certPath, keyPath string, hosts []string) (bool, error) {
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("unable load key pair: %s", err)
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return false, err
+	}
+	if time.Now().After(cert.NotAfter) {
+		return false, nil
+	}
+	for _, host := range hosts {
+		if cert.VerifyHostname(host) != nil {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func generateCert(certPath, keyPath string, hosts []string) error {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "hydroxide"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return err
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return ioutil.WriteFile(certPath, certPEM, 0644)
+}
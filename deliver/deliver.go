@@ -0,0 +1,237 @@
+// Package deliver delivers new messages to a local mail delivery agent, either
+// over LMTP (RFC 2033) or by piping them to a command such as procmail.
+package deliver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/emersion/hydroxide/exports"
+	"github.com/emersion/hydroxide/logging"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+var logger = logging.New("deliver")
+
+const (
+	maxAttempts = 3
+	retryDelay  = 30 * time.Second
+)
+
+// Options configures the destination of messages. Exactly one of LMTP and
+// Command must be set.
+type Options struct {
+	// Address of an LMTP server: either host:port or the path to a Unix
+	// socket
+	LMTP string
+	// Recipient given to the LMTP server, defaults to the address the
+	// message has been received on
+	Recipient string
+	// Command started for each message, which is written to its standard
+	// input
+	Command []string
+}
+
+// Deliverer delivers each new message in the inbox.
+type Deliverer struct {
+	c           *protonmail.Client
+	privateKeys openpgp.KeyRing
+	options     *Options
+	addresses   map[string]string // address ID -> email
+}
+
+// New creates a deliverer. The user's addresses are fetched to find the
+// recipient of each message.
+func New(ctx context.Context, c *protonmail.Client, privateKeys openpgp.KeyRing, options *Options) (*Deliverer, error) {
+	if (options.LMTP == "") == (len(options.Command) == 0) {
+		return nil, fmt.Errorf("deliver: exactly one of an LMTP address or a command is required")
+	}
+
+	addrs, err := c.ListAddresses(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses: %v", err)
+	}
+	addresses := make(map[string]string, len(addrs))
+	for _, addr := range addrs {
+		addresses[addr.ID] = addr.Email
+	}
+
+	return &Deliverer{
+		c:           c,
+		privateKeys: privateKeys,
+		options:     options,
+		addresses:   addresses,
+	}, nil
+}
+
+func isNewInboxMessage(msg *protonmail.Message) bool {
+	for _, labelID := range msg.LabelIDs {
+		if labelID == protonmail.LabelInbox {
+			return true
+		}
+	}
+	return false
+}
+
+// temporaryError is a delivery failure which is worth retrying.
+type temporaryError struct {
+	err error
+}
+
+func (err *temporaryError) Error() string {
+	return err.err.Error()
+}
+
+func (d *Deliverer) deliver(ctx context.Context, msg *protonmail.Message) error {
+	var buf bytes.Buffer
+	if err := exports.ExportMessage(ctx, d.c, d.privateKeys, nil, &buf, msg.ID); err != nil {
+		return &temporaryError{err}
+	}
+
+	if d.options.LMTP != "" {
+		rcpt := d.options.Recipient
+		if rcpt == "" {
+			rcpt = d.addresses[msg.AddressID]
+		}
+		if rcpt == "" {
+			return fmt.Errorf("unknown recipient address %v", msg.AddressID)
+		}
+
+		var from string
+		if msg.Sender != nil {
+			from = msg.Sender.Address
+		}
+		return d.deliverLMTP(from, rcpt, buf.Bytes())
+	}
+	return d.deliverCommand(ctx, msg, buf.Bytes())
+}
+
+func (d *Deliverer) deliverLMTP(from, rcpt string, b []byte) error {
+	network := "tcp"
+	if strings.Contains(d.options.LMTP, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, d.options.LMTP, 30*time.Second)
+	if err != nil {
+		return &temporaryError{err}
+	}
+
+	c, err := smtp.NewClientLMTP(conn, "localhost")
+	if err != nil {
+		conn.Close()
+		return &temporaryError{err}
+	}
+	defer c.Close()
+
+	if err := c.Hello("localhost"); err != nil {
+		return lmtpError(err)
+	}
+	if err := c.Mail(from, nil); err != nil {
+		return lmtpError(err)
+	}
+	if err := c.Rcpt(rcpt); err != nil {
+		return lmtpError(err)
+	}
+
+	var rcptErr error
+	w, err := c.LMTPData(func(rcpt string, status *smtp.SMTPError) {
+		if status != nil {
+			rcptErr = status
+		}
+	})
+	if err != nil {
+		return lmtpError(err)
+	}
+	if _, err := w.Write(b); err != nil {
+		return &temporaryError{err}
+	}
+	if err := w.Close(); err != nil {
+		return lmtpError(err)
+	}
+	if rcptErr != nil {
+		return lmtpError(rcptErr)
+	}
+
+	return c.Quit()
+}
+
+// lmtpError checks whether an LMTP error is temporary: transient negative
+// replies (4xx) and I/O errors are.
+func lmtpError(err error) error {
+	if smtpErr, ok := err.(*smtp.SMTPError); ok && smtpErr.Code >= 500 {
+		return err
+	}
+	return &temporaryError{err}
+}
+
+func (d *Deliverer) deliverCommand(ctx context.Context, msg *protonmail.Message, b []byte) error {
+	cmd := exec.CommandContext(ctx, d.options.Command[0], d.options.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(b)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"HYDROXIDE_MESSAGE_ID="+msg.ID,
+		"HYDROXIDE_RECIPIENT="+d.addresses[msg.AddressID],
+	)
+	if err := cmd.Run(); err != nil {
+		// EX_TEMPFAIL, used by sendmail-compatible delivery agents
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 75 {
+			return &temporaryError{err}
+		}
+		return err
+	}
+	return nil
+}
+
+// deliverRetry delivers a message, retrying after temporary failures.
+func (d *Deliverer) deliverRetry(ctx context.Context, msg *protonmail.Message) error {
+	for n := 1; ; n++ {
+		err := d.deliver(ctx, msg)
+		if _, ok := err.(*temporaryError); !ok || n >= maxAttempts {
+			return err
+		}
+		logger.Warn("delivery failed, retrying", "message", msg.ID, "attempt", n, "error", err)
+
+		t := time.NewTimer(retryDelay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// Run delivers messages created by events until the events channel is closed
+// or ctx is done.
+func (d *Deliverer) Run(ctx context.Context, events <-chan *protonmail.Event) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+			for _, eventMessage := range event.Messages {
+				if eventMessage.Action != protonmail.EventCreate || !isNewInboxMessage(eventMessage.Created) {
+					continue
+				}
+				if err := d.deliverRetry(ctx, eventMessage.Created); err != nil {
+					logger.Error("cannot deliver message", "message", eventMessage.ID, "error", err)
+				} else {
+					logger.Info("message delivered", "message", eventMessage.ID)
+				}
+			}
+		}
+	}
+}
@@ -1,17 +1,26 @@
 package events
 
 import (
-	"log"
+	"context"
 	"sync"
 	"time"
 
+	"github.com/emersion/hydroxide/logging"
 	"github.com/emersion/hydroxide/protonmail"
 )
 
+var logger = logging.New("events")
+
 const pollInterval = 30 * time.Second
 
+// requestTimeout bounds the time spent waiting for the API to return an event.
+const requestTimeout = time.Minute
+
+// Receiver polls the events of a user. Each user has their own receiver, so
+// that a user whose events can't be fetched doesn't delay the others.
 type Receiver struct {
-	c *protonmail.Client
+	c        *protonmail.Client
+	username string
 
 	locker   sync.Mutex
 	channels []chan<- *protonmail.Event
@@ -25,9 +34,11 @@ func (r *Receiver) receiveEvents() {
 
 	var last string
 	for {
-		event, err := r.c.GetEvent(last)
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		event, err := r.c.GetEvent(ctx, last)
+		cancel()
 		if err != nil {
-			log.Println("cannot receive event:", err)
+			logger.Warn("cannot receive event", "user", r.username, "error", err)
 			select {
 			case <-t.C:
 			case <-r.poll:
@@ -81,6 +92,7 @@ func (m *Manager) Register(c *protonmail.Client, username string, ch chan<- *pro
 	} else {
 		r = &Receiver{
 			c:        c,
+			username: username,
 			channels: []chan<- *protonmail.Event{ch},
 			poll:     make(chan struct{}),
 		}
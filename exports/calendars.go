@@ -0,0 +1,60 @@
+package exports
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/emersion/hydroxide/caldav"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// calendarFilename returns the name of the file a calendar is exported to.
+// Calendar names aren't unique, the ID is used to disambiguate.
+func calendarFilename(cal *protonmail.Calendar, used map[string]bool) string {
+	name := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < ' ' {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(cal.Name))
+	if name == "" || name == "." || name == ".." || used[name] {
+		name = cal.ID
+	}
+	used[name] = true
+	return name + ".ics"
+}
+
+// ExportCalendarsDir writes each calendar to its own iCalendar file in dir,
+// named after the calendar.
+func ExportCalendarsDir(ctx context.Context, c *protonmail.Client, privateKeys openpgp.EntityList, dir string) error {
+	calendars, err := c.ListCalendars(ctx, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	used := make(map[string]bool)
+	for _, cal := range calendars {
+		f, err := os.OpenFile(filepath.Join(dir, calendarFilename(cal, used)), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+
+		if err := caldav.WriteCalendar(ctx, c, privateKeys, cal, f); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,248 @@
+package exports
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/emersion/hydroxide/imap/database"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+const exportPageSize = 150
+
+// Checkpoint records the progress of an export of all messages, so that an
+// interrupted export can be resumed and later exports only write new
+// messages.
+type Checkpoint struct {
+	// Time of the last exported message, and IDs of the exported messages
+	// with that time
+	Time int64
+	IDs  []string
+	// Last event when the export started. Once the first export has
+	// completed, new messages are found in the events following it.
+	EventID  string
+	Complete bool
+
+	path string
+}
+
+// LoadCheckpoint reads a checkpoint file. An empty checkpoint is returned if
+// the file doesn't exist yet.
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	cp := &Checkpoint{path: path}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cp, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, cp); err != nil {
+		return nil, fmt.Errorf("invalid export checkpoint %v: %v", path, err)
+	}
+	return cp, nil
+}
+
+// save writes the checkpoint file. The file is replaced atomically, so that
+// it isn't corrupted if the export is interrupted.
+func (cp *Checkpoint) save() error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	tmp := cp.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cp.path)
+}
+
+func (cp *Checkpoint) exported(msg *protonmail.Message) bool {
+	t := int64(msg.Time)
+	if t != cp.Time {
+		return t < cp.Time
+	}
+	for _, id := range cp.IDs {
+		if id == msg.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// markExported records that a message has been exported.
+func (cp *Checkpoint) markExported(msg *protonmail.Message) error {
+	if t := int64(msg.Time); t > cp.Time {
+		cp.Time = t
+		cp.IDs = nil
+	}
+	cp.IDs = append(cp.IDs, msg.ID)
+	return cp.save()
+}
+
+type exportFunc func(msg *protonmail.Message, body []byte) error
+
+// exportAll exports all messages, from the oldest to the newest. If cp isn't
+// nil, only the messages which haven't been exported yet are.
+func exportAll(ctx context.Context, c *protonmail.Client, privateKeys openpgp.KeyRing, cache *database.MessageCache, cp *Checkpoint, fn exportFunc) error {
+	if cp == nil {
+		return exportSince(ctx, c, privateKeys, cache, &Checkpoint{}, fn)
+	}
+
+	if cp.Complete && cp.EventID != "" {
+		ok, err := exportEvents(ctx, c, privateKeys, cache, cp, fn)
+		if err != nil || ok {
+			return err
+		}
+		// The events don't tell which messages have been created, look
+		// for new messages by time instead
+	}
+
+	if cp.Complete || cp.EventID == "" {
+		// Fetch the latest event before listing messages, so that messages
+		// created in the meantime are picked up by the next export
+		event, err := c.GetEvent(ctx, "")
+		if err != nil {
+			return fmt.Errorf("failed to get latest event: %v", err)
+		}
+		cp.EventID = event.ID
+		cp.Complete = false
+		if err := cp.save(); err != nil {
+			return err
+		}
+	}
+
+	if err := exportSince(ctx, c, privateKeys, cache, cp, fn); err != nil {
+		return err
+	}
+
+	cp.Complete = true
+	return cp.save()
+}
+
+// exportSince exports the messages more recent than the checkpoint.
+func exportSince(ctx context.Context, c *protonmail.Client, privateKeys openpgp.KeyRing, cache *database.MessageCache, cp *Checkpoint, fn exportFunc) error {
+	filter := &protonmail.MessageFilter{
+		PageSize: exportPageSize,
+		Label:    protonmail.LabelAllMail,
+		Sort:     "Time",
+		Asc:      true,
+		Begin:    cp.Time,
+	}
+
+	for {
+		total, page, err := c.ListMessages(ctx, filter)
+		if err != nil {
+			return fmt.Errorf("failed to list messages: %v", err)
+		}
+
+		var ids []string
+		for _, msg := range page {
+			if !cp.exported(msg) {
+				ids = append(ids, msg.ID)
+			}
+		}
+		if err := exportMessages(ctx, c, privateKeys, cache, cp, ids, fn); err != nil {
+			return err
+		}
+
+		filter.Page++
+		if len(page) == 0 || filter.Page*filter.PageSize >= total {
+			return nil
+		}
+	}
+}
+
+// exportEvents exports the messages created since the checkpoint's event. ok
+// is false if the events can't be used, e.g. because they require a full
+// refresh.
+func exportEvents(ctx context.Context, c *protonmail.Client, privateKeys openpgp.KeyRing, cache *database.MessageCache, cp *Checkpoint, fn exportFunc) (ok bool, err error) {
+	for {
+		event, err := c.GetEvent(ctx, cp.EventID)
+		if _, isAPIErr := err.(*protonmail.APIError); isAPIErr {
+			// The event has probably expired
+			return false, nil
+		} else if err != nil {
+			return false, fmt.Errorf("failed to get events: %v", err)
+		}
+		if event.Refresh&protonmail.EventRefreshMail != 0 {
+			return false, nil
+		}
+
+		for _, em := range event.Messages {
+			if em.Action != protonmail.EventCreate || em.Created == nil {
+				continue
+			}
+			if err := exportMessage(ctx, c, privateKeys, cache, cp, em.ID, fn); err != nil {
+				return false, err
+			}
+		}
+
+		if event.ID == cp.EventID {
+			return true, nil
+		}
+		cp.EventID = event.ID
+		if err := cp.save(); err != nil {
+			return false, err
+		}
+	}
+}
+
+func exportMessage(ctx context.Context, c *protonmail.Client, privateKeys openpgp.KeyRing, cache *database.MessageCache, cp *Checkpoint, id string, fn exportFunc) error {
+	msg, body, err := getMessage(ctx, c, privateKeys, cache, id)
+	if err != nil {
+		return fmt.Errorf("failed to export message %v: %v", id, err)
+	}
+	return writeExported(cp, msg, body, fn)
+}
+
+// exportMessages exports several messages in order. Messages are downloaded
+// and decrypted in parallel, a batch at a time to bound memory usage.
+func exportMessages(ctx context.Context, c *protonmail.Client, privateKeys openpgp.KeyRing, cache *database.MessageCache, cp *Checkpoint, ids []string, fn exportFunc) error {
+	batchSize := protonmail.DecryptPool.Size()
+	for len(ids) > 0 {
+		batch := ids
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+		ids = ids[len(batch):]
+
+		msgs := make([]*protonmail.Message, len(batch))
+		bodies := make([][]byte, len(batch))
+		err := protonmail.DecryptPool.Map(len(batch), func(i int) error {
+			var err error
+			msgs[i], bodies[i], err = getMessage(ctx, c, privateKeys, cache, batch[i])
+			if err != nil {
+				return fmt.Errorf("failed to export message %v: %v", batch[i], err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for i, msg := range msgs {
+			if err := writeExported(cp, msg, bodies[i], fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeExported(cp *Checkpoint, msg *protonmail.Message, body []byte, fn exportFunc) error {
+	if err := fn(msg, body); err != nil {
+		return fmt.Errorf("failed to export message %v: %v", msg.ID, err)
+	}
+	if cp.path == "" {
+		return nil
+	}
+	return cp.markExported(msg)
+}
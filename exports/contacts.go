@@ -0,0 +1,103 @@
+package exports
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/emersion/go-vcard"
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/emersion/hydroxide/carddav"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+const contactsPageSize = 100
+
+// ExportContacts decrypts all contacts and calls fn for each of them.
+func ExportContacts(ctx context.Context, c *protonmail.Client, privateKeys openpgp.KeyRing, fn func(contact *protonmail.Contact, card vcard.Card) error) error {
+	labels, err := c.ListContactGroups(ctx)
+	if err != nil {
+		return err
+	}
+	groups := make(map[string]*protonmail.Label, len(labels))
+	for _, label := range labels {
+		groups[label.ID] = label
+	}
+
+	// The export endpoint only returns cards, the other fields come from
+	// the contact list
+	contacts := make(map[string]*protonmail.Contact)
+	for page := 0; ; page++ {
+		total, l, err := c.ListContacts(ctx, page, contactsPageSize)
+		if err != nil {
+			return err
+		}
+		for _, contact := range l {
+			contacts[contact.ID] = contact
+		}
+		if len(l) == 0 || len(contacts) >= total {
+			break
+		}
+	}
+
+	for page := 0; ; page++ {
+		total, l, err := c.ListContactsExport(ctx, page, contactsPageSize)
+		if err != nil {
+			return err
+		}
+
+		for _, export := range l {
+			contact, ok := contacts[export.ID]
+			if !ok {
+				contact = &protonmail.Contact{ID: export.ID}
+			}
+			contact.Cards = export.Cards
+
+			card, err := carddav.ReadCard(contact, groups, privateKeys)
+			if err != nil {
+				return fmt.Errorf("cannot decrypt contact %v: %v", export.ID, err)
+			}
+			if err := fn(contact, card); err != nil {
+				return err
+			}
+		}
+
+		if len(l) == 0 || (page+1)*contactsPageSize >= total {
+			break
+		}
+	}
+
+	return nil
+}
+
+// ExportContactsVCard writes all contacts to a single vCard file.
+func ExportContactsVCard(ctx context.Context, c *protonmail.Client, privateKeys openpgp.KeyRing, w io.Writer) error {
+	enc := vcard.NewEncoder(w)
+	return ExportContacts(ctx, c, privateKeys, func(contact *protonmail.Contact, card vcard.Card) error {
+		return enc.Encode(card)
+	})
+}
+
+// ExportContactsDir writes each contact to its own vCard file in dir, named
+// after the contact's ID.
+func ExportContactsDir(ctx context.Context, c *protonmail.Client, privateKeys openpgp.KeyRing, dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	return ExportContacts(ctx, c, privateKeys, func(contact *protonmail.Contact, card vcard.Card) error {
+		f, err := os.OpenFile(filepath.Join(dir, contact.ID+".vcf"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if err := vcard.NewEncoder(f).Encode(card); err != nil {
+			return err
+		}
+		return f.Close()
+	})
+}
@@ -0,0 +1,242 @@
+package exports
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/utf7"
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/emersion/hydroxide/imap/database"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// maildirSystemFolders maps system labels to Maildir++ folders. The inbox is
+// the root of the Maildir. Starred messages are exported with the flagged
+// flag, and All Mail would duplicate every message.
+var maildirSystemFolders = map[string]string{
+	protonmail.LabelInbox:     "",
+	protonmail.LabelArchive:   "Archive",
+	protonmail.LabelDraft:     "Drafts",
+	protonmail.LabelSent:      "Sent",
+	protonmail.LabelSpam:      "Spam",
+	protonmail.LabelTrash:     "Trash",
+	protonmail.LabelScheduled: "Scheduled",
+	protonmail.LabelSnoozed:   "Snoozed",
+}
+
+// maildirAllMail is the folder of messages which aren't in any other folder.
+const maildirAllMail = "All Mail"
+
+// maildirLabels is the parent folder of labels, as in the IMAP server.
+const maildirLabels = "Labels"
+
+// MaildirWriter writes messages to a Maildir++ hierarchy mirroring ProtonMail
+// folders and labels.
+type MaildirWriter struct {
+	dir      string
+	labels   map[string]*protonmail.Label
+	hostname string
+	created  map[string]bool
+	n        int
+}
+
+// NewMaildirWriter creates a Maildir++ writer. The user's labels are fetched
+// to name folders.
+func NewMaildirWriter(ctx context.Context, c *protonmail.Client, dir string) (*MaildirWriter, error) {
+	labels, err := c.ListLabels(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	// "/" and ":" can't appear in file names
+	hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+
+	w := &MaildirWriter{
+		dir:      dir,
+		labels:   make(map[string]*protonmail.Label, len(labels)),
+		hostname: hostname,
+		created:  make(map[string]bool),
+	}
+	for _, label := range labels {
+		w.labels[label.ID] = label
+	}
+	return w, nil
+}
+
+// maildirFolderName encodes a folder name component: Maildir++ uses "." as
+// the hierarchy separator and modified UTF-7 for non-ASCII characters, as
+// IMAP does.
+func maildirFolderName(name string) string {
+	name = strings.NewReplacer(".", "_", "/", "_").Replace(name)
+	if encoded, err := utf7.Encoding.NewEncoder().String(name); err == nil {
+		name = encoded
+	}
+	return name
+}
+
+// labelFolder returns the Maildir++ folder of a user label, e.g.
+// "Work.Projects" for a nested folder or "Labels.Important" for a label.
+func (w *MaildirWriter) labelFolder(label *protonmail.Label) string {
+	if label.Exclusive != 1 {
+		return maildirLabels + "." + maildirFolderName(label.Name)
+	}
+
+	name := maildirFolderName(label.Name)
+	seen := map[string]bool{label.ID: true}
+	for parent := w.labels[label.ParentID]; parent != nil && !seen[parent.ID]; parent = w.labels[parent.ParentID] {
+		seen[parent.ID] = true
+		name = maildirFolderName(parent.Name) + "." + name
+	}
+	return name
+}
+
+// folders returns the Maildir++ folders a message is written to. The empty
+// string is the inbox.
+func (w *MaildirWriter) folders(msg *protonmail.Message) []string {
+	var folders []string
+	for _, id := range msg.LabelIDs {
+		if folder, ok := maildirSystemFolders[id]; ok {
+			folders = append(folders, folder)
+		} else if label, ok := w.labels[id]; ok {
+			folders = append(folders, w.labelFolder(label))
+		}
+	}
+	if len(folders) == 0 {
+		folders = append(folders, maildirAllMail)
+	}
+	return folders
+}
+
+// maildirInfo returns the info section of a message file name, containing
+// its flags sorted in ASCII order.
+func maildirInfo(msg *protonmail.Message) string {
+	var flags []string
+	for _, id := range msg.LabelIDs {
+		switch id {
+		case protonmail.LabelDraft:
+			flags = append(flags, "D")
+		case protonmail.LabelStarred:
+			flags = append(flags, "F")
+		}
+	}
+	if msg.IsForwarded != 0 {
+		flags = append(flags, "P")
+	}
+	if msg.IsReplied != 0 || msg.IsRepliedAll != 0 {
+		flags = append(flags, "R")
+	}
+	if msg.Unread == 0 {
+		flags = append(flags, "S")
+	}
+	sort.Strings(flags)
+	return ":2," + strings.Join(flags, "")
+}
+
+// folderPath creates a Maildir++ folder if needed and returns its path.
+func (w *MaildirWriter) folderPath(folder string) (string, error) {
+	p := w.dir
+	if folder != "" {
+		p = filepath.Join(w.dir, "."+folder)
+	}
+	if w.created[folder] {
+		return p, nil
+	}
+
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(p, sub), 0700); err != nil {
+			return "", err
+		}
+	}
+	if folder != "" {
+		// Marks sub-folders, see the Maildir++ specification
+		if err := ioutil.WriteFile(filepath.Join(p, "maildirfolder"), nil, 0600); err != nil {
+			return "", err
+		}
+	}
+
+	w.created[folder] = true
+	return p, nil
+}
+
+// deliver writes a message to a folder: the file is written to tmp, then
+// moved to cur with its info section.
+func (w *MaildirWriter) deliver(folder, name, info string, b []byte, t time.Time) error {
+	p, err := w.folderPath(folder)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(p, "tmp", name)
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	if !t.IsZero() {
+		os.Chtimes(tmp, t, t)
+	}
+	return os.Rename(tmp, filepath.Join(p, "cur", name+info))
+}
+
+// WriteMessage writes a decrypted message to each of its folders.
+func (w *MaildirWriter) WriteMessage(msg *protonmail.Message, body []byte) error {
+	var buf bytes.Buffer
+	if err := writeMessage(&buf, msg, body); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	w.n++
+	name := fmt.Sprintf("%v.M%vP%vQ%v.%v", now.Unix(), now.Nanosecond()/1000, os.Getpid(), w.n, w.hostname)
+	info := maildirInfo(msg)
+	for _, folder := range w.folders(msg) {
+		if err := w.deliver(folder, name, info, buf.Bytes(), msg.Time.Time()); err != nil {
+			return fmt.Errorf("failed to write message to Maildir: %v", err)
+		}
+	}
+	return nil
+}
+
+// ExportMessageMaildir writes a message to a Maildir. cache may be nil.
+func ExportMessageMaildir(ctx context.Context, c *protonmail.Client, privateKeys openpgp.KeyRing, cache *database.MessageCache, w *MaildirWriter, id string) error {
+	msg, body, err := getMessage(ctx, c, privateKeys, cache, id)
+	if err != nil {
+		return err
+	}
+
+	return w.WriteMessage(msg, body)
+}
+
+// ExportConversationMaildir writes the messages of a conversation to a
+// Maildir. cache may be nil.
+func ExportConversationMaildir(ctx context.Context, c *protonmail.Client, privateKeys openpgp.KeyRing, cache *database.MessageCache, w *MaildirWriter, id string) error {
+	_, msgs, err := c.GetConversation(ctx, id, "")
+	if err != nil {
+		return fmt.Errorf("failed to fetch conversation: %v", err)
+	}
+
+	for _, msg := range msgs {
+		if err := ExportMessageMaildir(ctx, c, privateKeys, cache, w, msg.ID); err != nil {
+			return fmt.Errorf("failed to export conversation message: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// ExportAllMaildir writes all messages to a Maildir, from the oldest to the
+// newest. cache may be nil. If cp isn't nil, only the messages which haven't
+// been exported yet are written.
+func ExportAllMaildir(ctx context.Context, c *protonmail.Client, privateKeys openpgp.KeyRing, cache *database.MessageCache, w *MaildirWriter, cp *Checkpoint) error {
+	return exportAll(ctx, c, privateKeys, cache, cp, w.WriteMessage)
+}
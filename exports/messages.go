@@ -2,8 +2,10 @@ package exports
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"strings"
 
 	"github.com/emersion/go-mbox"
@@ -12,10 +14,58 @@ import (
 	"github.com/emersion/go-message/textproto"
 	"golang.org/x/crypto/openpgp"
 
+	"github.com/emersion/hydroxide/imap/database"
 	"github.com/emersion/hydroxide/protonmail"
 )
 
-func writeMessage(c *protonmail.Client, privateKeys openpgp.KeyRing, w io.Writer, msg *protonmail.Message) error {
+// getMessage fetches a message and decrypts its body. If cache isn't nil,
+// messages already downloaded and decrypted by the IMAP server are read from
+// it.
+func getMessage(ctx context.Context, c *protonmail.Client, privateKeys openpgp.KeyRing, cache *database.MessageCache, id string) (*protonmail.Message, []byte, error) {
+	var msg *protonmail.Message
+	if cache != nil {
+		cm, err := cache.Get(id)
+		if err == nil && cm.Decrypted {
+			return cm.Message, cm.Body, nil
+		} else if err == nil {
+			msg = cm.Message
+		} else if err != database.ErrNotFound {
+			return nil, nil, fmt.Errorf("failed to read message cache: %v", err)
+		}
+	}
+
+	if msg == nil {
+		var err error
+		msg, err = c.GetMessage(ctx, id)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to fetch message: %v", err)
+		}
+		if cache != nil {
+			if err := cache.Put(&database.CachedMessage{Message: msg}); err != nil {
+				return nil, nil, fmt.Errorf("failed to cache message: %v", err)
+			}
+		}
+	}
+
+	var b []byte
+	var err error
+	protonmail.DecryptPool.Do(func() {
+		var md *openpgp.MessageDetails
+		md, err = msg.Read(privateKeys, nil)
+		if err != nil {
+			return
+		}
+
+		// TODO: check signature
+		b, err = ioutil.ReadAll(md.UnverifiedBody)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return msg, b, nil
+}
+
+func writeMessage(w io.Writer, msg *protonmail.Message, body []byte) error {
 	mimeType := msg.MIMEType
 	if mimeType == "" {
 		mimeType = "text/html"
@@ -37,32 +87,28 @@ func writeMessage(c *protonmail.Client, privateKeys openpgp.KeyRing, w io.Writer
 		return fmt.Errorf("failed to create message writer: %v", err)
 	}
 
-	md, err := msg.Read(privateKeys, nil)
-	if err != nil {
-		return err
-	}
-
-	// TODO: check signature
-	if _, err := io.Copy(mw, md.UnverifiedBody); err != nil {
+	if _, err := mw.Write(body); err != nil {
 		return err
 	}
 
 	return mw.Close()
 }
 
-func ExportMessage(c *protonmail.Client, privateKeys openpgp.KeyRing, w io.Writer, id string) error {
-	msg, err := c.GetMessage(id)
+// ExportMessage writes a message to w. cache may be nil.
+func ExportMessage(ctx context.Context, c *protonmail.Client, privateKeys openpgp.KeyRing, cache *database.MessageCache, w io.Writer, id string) error {
+	msg, body, err := getMessage(ctx, c, privateKeys, cache, id)
 	if err != nil {
-		return fmt.Errorf("failed to fetch message: %v", err)
+		return err
 	}
 
-	return writeMessage(c, privateKeys, w, msg)
+	return writeMessage(w, msg, body)
 }
 
-func ExportMessageMbox(c *protonmail.Client, privateKeys openpgp.KeyRing, mbox *mbox.Writer, id string) error {
-	msg, err := c.GetMessage(id)
+// ExportMessageMbox appends a message to an mbox file. cache may be nil.
+func ExportMessageMbox(ctx context.Context, c *protonmail.Client, privateKeys openpgp.KeyRing, cache *database.MessageCache, mbox *mbox.Writer, id string) error {
+	msg, body, err := getMessage(ctx, c, privateKeys, cache, id)
 	if err != nil {
-		return fmt.Errorf("failed to fetch message: %v", err)
+		return err
 	}
 
 	w, err := mbox.CreateMessage(msg.Sender.Address, msg.Time.Time())
@@ -70,20 +116,35 @@ func ExportMessageMbox(c *protonmail.Client, privateKeys openpgp.KeyRing, mbox *
 		return fmt.Errorf("failed to create mbox message: %v", err)
 	}
 
-	return writeMessage(c, privateKeys, w, msg)
+	return writeMessage(w, msg, body)
 }
 
-func ExportConversationMbox(c *protonmail.Client, privateKeys openpgp.KeyRing, mbox *mbox.Writer, id string) error {
-	_, msgs, err := c.GetConversation(id, "")
+// ExportConversationMbox appends the messages of a conversation to an mbox
+// file. cache may be nil.
+func ExportConversationMbox(ctx context.Context, c *protonmail.Client, privateKeys openpgp.KeyRing, cache *database.MessageCache, mbox *mbox.Writer, id string) error {
+	_, msgs, err := c.GetConversation(ctx, id, "")
 	if err != nil {
 		return fmt.Errorf("failed to fetch conversation: %v", err)
 	}
 
 	for _, msg := range msgs {
-		if err := ExportMessageMbox(c, privateKeys, mbox, msg.ID); err != nil {
+		if err := ExportMessageMbox(ctx, c, privateKeys, cache, mbox, msg.ID); err != nil {
 			return fmt.Errorf("failed to export conversation message: %v", err)
 		}
 	}
 
 	return nil
 }
+
+// ExportAllMbox appends all messages to an mbox file, from the oldest to the
+// newest. cache may be nil. If cp isn't nil, only the messages which haven't
+// been exported yet are written.
+func ExportAllMbox(ctx context.Context, c *protonmail.Client, privateKeys openpgp.KeyRing, cache *database.MessageCache, mbox *mbox.Writer, cp *Checkpoint) error {
+	return exportAll(ctx, c, privateKeys, cache, cp, func(msg *protonmail.Message, body []byte) error {
+		w, err := mbox.CreateMessage(msg.Sender.Address, msg.Time.Time())
+		if err != nil {
+			return fmt.Errorf("failed to create mbox message: %v", err)
+		}
+		return writeMessage(w, msg, body)
+	})
+}
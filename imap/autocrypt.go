@@ -0,0 +1,126 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-message/textproto"
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/emersion/hydroxide/autocrypt"
+	"github.com/emersion/hydroxide/config"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// autocryptLock serializes updates of the Autocrypt peers file.
+var autocryptLock sync.Mutex
+
+func (u *user) isOwnAddress(email string) bool {
+	for _, addr := range u.addrs {
+		if strings.EqualFold(addr.Email, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAutocrypt returns the Autocrypt header of a message sent by from. As
+// required by the specification, nil is returned if the message contains
+// more than one valid header for this address.
+func parseAutocrypt(rawHeader string, from string) *autocrypt.Header {
+	raw, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(rawHeader)))
+	if err != nil {
+		return nil
+	}
+
+	var found *autocrypt.Header
+	fields := raw.FieldsByKey(autocrypt.HeaderKey)
+	for fields.Next() {
+		h, err := autocrypt.Parse(fields.Value())
+		if err != nil || config.PinKey(h.Addr) != config.PinKey(from) {
+			continue
+		}
+		if found != nil {
+			return nil
+		}
+		found = h
+	}
+	return found
+}
+
+// learnAutocrypt updates the state of the sender of a message from its
+// Autocrypt header field. msg must have been fetched with GetMessage.
+func (u *user) learnAutocrypt(msg *protonmail.Message) {
+	if msg.Header == "" || msg.Sender == nil || u.isOwnAddress(msg.Sender.Address) {
+		return
+	}
+	email := config.PinKey(msg.Sender.Address)
+
+	h := parseAutocrypt(msg.Header, email)
+	if h == nil {
+		return
+	}
+	if _, err := h.Entity(); err != nil {
+		u.logger.Info("ignoring Autocrypt key", "email", email, "error", err)
+		return
+	}
+
+	autocryptLock.Lock()
+	defer autocryptLock.Unlock()
+
+	peers, err := config.LoadAutocryptPeers(u.username)
+	if err != nil {
+		u.logger.Warn("cannot load Autocrypt peers", "error", err)
+		return
+	}
+
+	t := msg.Time.Time()
+	peer, ok := peers[email]
+	if ok && !t.After(peer.LastSeen) {
+		return
+	}
+	if ok && peer.PreferEncrypt == h.PreferEncrypt && bytes.Equal(peer.KeyData, h.KeyData) {
+		return
+	}
+
+	peers[email] = &config.AutocryptPeer{
+		KeyData:       h.KeyData,
+		PreferEncrypt: h.PreferEncrypt,
+		LastSeen:      t,
+	}
+	if err := config.SaveAutocryptPeers(u.username, peers); err != nil {
+		u.logger.Warn("cannot save Autocrypt peers", "error", err)
+		return
+	}
+	u.logger.Info("learned Autocrypt key", "email", email)
+
+	u.Lock()
+	delete(u.senderKeysCache, email)
+	u.Unlock()
+}
+
+// autocryptKey returns the key learned from the Autocrypt header fields sent
+// by a correspondent, if any.
+func (u *user) autocryptKey(email string) *openpgp.Entity {
+	autocryptLock.Lock()
+	peers, err := config.LoadAutocryptPeers(u.username)
+	autocryptLock.Unlock()
+	if err != nil {
+		u.logger.Warn("cannot load Autocrypt peers", "error", err)
+		return nil
+	}
+
+	peer, ok := peers[config.PinKey(email)]
+	if !ok {
+		return nil
+	}
+	h := autocrypt.Header{KeyData: peer.KeyData}
+	e, err := h.Entity()
+	if err != nil {
+		u.logger.Warn("cannot parse Autocrypt key", "email", email, "error", err)
+		return nil
+	}
+	return e
+}
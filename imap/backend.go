@@ -1,46 +1,144 @@
 package imap
 
 import (
+	"context"
 	"errors"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/emersion/go-imap"
 	imapbackend "github.com/emersion/go-imap/backend"
 
 	"github.com/emersion/hydroxide/auth"
+	"github.com/emersion/hydroxide/config"
 	"github.com/emersion/hydroxide/events"
+	"github.com/emersion/hydroxide/logging"
+	"github.com/emersion/hydroxide/protonmail"
 )
 
 var errNotYetImplemented = errors.New("not yet implemented")
 
+var logger = logging.New("imap")
+
+const (
+	// loginTimeout bounds the time spent on API requests while logging in.
+	loginTimeout = time.Minute
+	// requestTimeout bounds the time spent on API requests for a single
+	// operation, e.g. fetching one message.
+	requestTimeout = 5 * time.Minute
+)
+
+// Options contains optional settings for the IMAP backend.
+type Options struct {
+	// Retention maps mailbox names to the maximum age of their messages. Older
+	// messages are periodically deleted.
+	Retention map[string]time.Duration
+	// Window is the maximum number of messages listed when a mailbox is first
+	// synchronized. Only the most recent messages are listed, older ones can
+	// still be accessed from the web client. Zero means no limit.
+	Window int
+	// UnifiedInbox allows logging in with comma-separated usernames and
+	// bridge passwords, to access several accounts at once. The inboxes of
+	// all accounts are aggregated in a read-only mailbox. Changes are only
+	// reported to clients polling this mailbox.
+	UnifiedInbox bool
+	// Throttle limits the traffic of background tasks: initial mailbox
+	// synchronization, retention and search indexing.
+	Throttle *protonmail.Throttle
+	// SearchIndex enables the local full-text index used by SEARCH BODY and
+	// TEXT. Bodies are encrypted server-side: messages are downloaded and
+	// decrypted to be indexed, new messages are indexed as they're received.
+	// If disabled, SEARCH TEXT only matches headers, using the ProtonMail
+	// search API, and SEARCH BODY fails.
+	SearchIndex bool
+	// FetchWorkers is the number of messages downloaded and decrypted
+	// concurrently by a FETCH command requesting bodies. Zero means a default
+	// of 4.
+	FetchWorkers int
+	// BlockTrackers removes tracking pixels of known trackers and tracking
+	// parameters of links from HTML bodies, and lists the blocked trackers in
+	// the X-Pm-Trackers-Blocked header field of the inline part.
+	BlockTrackers bool
+	// Trackers is the list of trackers removed if BlockTrackers is set. Nil
+	// means a built-in list.
+	Trackers *TrackerList
+	// MessageCacheSize is the maximum size in bytes of the local cache of
+	// downloaded and decrypted messages. Zero means a default of 512 MiB, a
+	// negative size disables the cache and removes cached messages.
+	MessageCacheSize int64
+}
+
+// defaultMessageCacheSize is the default value of Options.MessageCacheSize.
+const defaultMessageCacheSize = 512 << 20
+
 type backend struct {
 	sessions      *auth.Manager
 	eventsManager *events.Manager
+	options       Options
 	updates       chan imapbackend.Update
 
 	sync.Mutex // protects everything below
 
-	users map[string]*user
+	users        map[string]*user
+	unifiedUsers map[string]*unifiedUser
+	logins       map[string]*pendingLogin
+}
+
+// pendingLogin is a user being logged in. done is closed once the login has
+// completed, err is set before.
+type pendingLogin struct {
+	done chan struct{}
+	err  error
 }
 
 func (be *backend) Login(info *imap.ConnInfo, username, password string) (imapbackend.User, error) {
-	c, privateKeys, err := be.sessions.Auth(username, password)
+	ctx, cancel := context.WithTimeout(context.Background(), loginTimeout)
+	defer cancel()
+
+	if be.options.UnifiedInbox && strings.Contains(username, ",") {
+		return be.loginUnified(ctx, username, password)
+	}
+
+	c, privateKeys, err := be.sessions.Auth(ctx, username, password)
 	if err != nil {
 		return nil, err
 	}
+	if err := config.CheckProtocol(username, config.ProtocolIMAP); err != nil {
+		return nil, err
+	}
 
-	return getUser(be, username, c, privateKeys)
+	return getUser(ctx, be, username, c, privateKeys)
+}
+
+// notify sends updates to all connections and waits until they've been
+// delivered.
+func (be *backend) notify(updates []imapbackend.Update) {
+	for _, update := range updates {
+		update.Done() // Create the channel before the server uses it
+		be.updates <- update
+	}
+	for _, update := range updates {
+		<-update.Done()
+	}
 }
 
 func (be *backend) Updates() <-chan imapbackend.Update {
 	return be.updates
 }
 
-func New(sessions *auth.Manager, eventsManager *events.Manager) imapbackend.Backend {
+func New(sessions *auth.Manager, eventsManager *events.Manager, options *Options) imapbackend.Backend {
+	if options == nil {
+		options = &Options{}
+	}
+
 	return &backend{
 		sessions:      sessions,
 		eventsManager: eventsManager,
+		options:       *options,
 		updates:       make(chan imapbackend.Update, 50),
 		users:         make(map[string]*user),
+		unifiedUsers:  make(map[string]*unifiedUser),
+		logins:        make(map[string]*pendingLogin),
 	}
 }
@@ -0,0 +1,392 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+var literalRegexp = regexp.MustCompile(`(~?)\{([0-9]+)\+?\}\r?\n$`)
+var startTLSRegexp = regexp.MustCompile(`(?i)^[^ ]+ STARTTLS\r?\n$`)
+
+// literal8Conn rewrites literal8 strings (RFC 3516) sent by the client into
+// regular literals, which the go-imap parser understands. Literal contents
+// are passed through as-is, so they may contain arbitrary binary data.
+type literal8Conn struct {
+	net.Conn
+
+	r           *bufio.Reader
+	pending     []byte
+	literal     int64
+	passthrough bool
+}
+
+func newLiteral8Conn(c net.Conn) *literal8Conn {
+	return &literal8Conn{Conn: c, r: bufio.NewReader(c)}
+}
+
+func (c *literal8Conn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+
+	if c.passthrough {
+		return c.r.Read(b)
+	}
+
+	if c.literal > 0 {
+		if int64(len(b)) > c.literal {
+			b = b[:c.literal]
+		}
+		n, err := c.r.Read(b)
+		c.literal -= int64(n)
+		return n, err
+	}
+
+	line, err := c.r.ReadBytes('\n')
+	if len(line) == 0 {
+		return 0, err
+	}
+
+	if m := literalRegexp.FindSubmatchIndex(line); m != nil {
+		size, convErr := strconv.ParseInt(string(line[m[4]:m[5]]), 10, 64)
+		if convErr == nil {
+			c.literal = size
+		}
+		if m[3] > m[2] {
+			// Drop the "~" prefix
+			line = append(line[:m[2]], line[m[3]:]...)
+		}
+	} else if startTLSRegexp.Match(line) {
+		// The rest of the stream will be encrypted
+		c.passthrough = true
+	}
+
+	c.pending = line
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+type binaryExtension struct{}
+
+// NewBinaryExtension returns an extension implementing BINARY (RFC 3516). It
+// accepts literal8 strings in commands, e.g. to APPEND messages containing
+// binary parts. The BINARY and BINARY.SIZE fetch items are handled by
+// mailboxes.
+func NewBinaryExtension() server.ConnExtension {
+	return &binaryExtension{}
+}
+
+func (ext *binaryExtension) Capabilities(c server.Conn) []string {
+	return []string{"BINARY"}
+}
+
+func (ext *binaryExtension) Command(name string) server.HandlerFactory {
+	return nil
+}
+
+func (ext *binaryExtension) NewConn(c server.Conn) server.Conn {
+	err := c.Upgrade(func(conn net.Conn) (net.Conn, error) {
+		return newLiteral8Conn(conn), nil
+	})
+	if err != nil {
+		c.Server().ErrorLog.Println("cannot enable literal8 support:", err)
+	}
+	return c
+}
+
+// base64Filter drops characters which aren't part of the base64 alphabet, such
+// as spaces inserted by some clients.
+type base64Filter struct {
+	r io.Reader
+}
+
+func (f base64Filter) Read(b []byte) (int, error) {
+	n, err := f.r.Read(b)
+	j := 0
+	for _, c := range b[:n] {
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '+' || c == '/' || c == '=' {
+			b[j] = c
+			j++
+		}
+	}
+	return j, err
+}
+
+func decodeTransferEncoding(enc string, r io.Reader) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(enc)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, base64Filter{r}), nil
+	case "quoted-printable":
+		return quotedprintable.NewReader(r), nil
+	case "", "7bit", "8bit", "binary":
+		return r, nil
+	default:
+		return nil, fmt.Errorf("unsupported Content-Transfer-Encoding %q", enc)
+	}
+}
+
+// normalizePart copies an entity to a writer created by create, decoding its
+// body and re-encoding it with a 7-bit clean Content-Transfer-Encoding.
+func normalizePart(create func(h message.Header) (*message.Writer, error), h textproto.Header, body io.Reader) error {
+	t, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		t = "text/plain"
+	}
+	t = strings.ToLower(t)
+
+	if strings.HasPrefix(t, "multipart/") {
+		h.Del("Content-Transfer-Encoding")
+		w, err := create(message.Header{Header: h})
+		if err != nil {
+			return err
+		}
+
+		mr := textproto.NewMultipartReader(body, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+
+			if err := normalizePart(w.CreatePart, p.Header, p); err != nil {
+				return err
+			}
+		}
+		return w.Close()
+	}
+
+	dec, err := decodeTransferEncoding(h.Get("Content-Transfer-Encoding"), body)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(t, "text/") {
+		h.Set("Content-Transfer-Encoding", "quoted-printable")
+	} else {
+		h.Set("Content-Transfer-Encoding", "base64")
+	}
+
+	w, err := create(message.Header{Header: h})
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, dec); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// normalizeTransferEncoding rewrites a message so that all of its parts use
+// either the base64 or quoted-printable encoding. This allows messages
+// appended with binary or 8-bit parts to be stored without corruption.
+func normalizeTransferEncoding(r io.Reader) (*bytes.Buffer, error) {
+	br := bufio.NewReader(r)
+	h, err := textproto.ReadHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	create := func(h message.Header) (*message.Writer, error) {
+		return message.CreateWriter(&b, h)
+	}
+	if err := normalizePart(create, h, br); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+var binaryItemRegexp = regexp.MustCompile(`^BINARY(\.PEEK|\.SIZE)?\[([0-9]+(?:\.[0-9]+)*)?\](?:<([0-9]+)\.([0-9]+)>)?$`)
+
+// binaryItem is a BINARY, BINARY.PEEK or BINARY.SIZE fetch item.
+type binaryItem struct {
+	path    []int
+	size    bool
+	partial []int
+}
+
+// parseBinaryItem parses a BINARY fetch item, and returns false if item isn't
+// one.
+func parseBinaryItem(item imap.FetchItem) (*binaryItem, bool) {
+	m := binaryItemRegexp.FindStringSubmatch(strings.ToUpper(string(item)))
+	if m == nil {
+		return nil, false
+	}
+
+	bi := &binaryItem{size: m[1] == ".SIZE"}
+	if m[2] != "" {
+		for _, s := range strings.Split(m[2], ".") {
+			part, err := strconv.Atoi(s)
+			if err != nil || part == 0 {
+				return nil, false
+			}
+			bi.path = append(bi.path, part)
+		}
+	}
+	if m[3] != "" {
+		if bi.size {
+			return nil, false
+		}
+		off, err := strconv.Atoi(m[3])
+		if err != nil {
+			return nil, false
+		}
+		n, err := strconv.Atoi(m[4])
+		if err != nil || n == 0 {
+			return nil, false
+		}
+		bi.partial = []int{off, n}
+	}
+	return bi, true
+}
+
+func (bi *binaryItem) section() string {
+	parts := make([]string, len(bi.path))
+	for i, part := range bi.path {
+		parts[i] = strconv.Itoa(part)
+	}
+	return "[" + strings.Join(parts, ".") + "]"
+}
+
+// resp returns the name of the item in FETCH responses, which doesn't include
+// PEEK nor the length of partial fetches.
+func (bi *binaryItem) resp() imap.FetchItem {
+	if bi.size {
+		return imap.FetchItem("BINARY.SIZE" + bi.section())
+	}
+	s := "BINARY" + bi.section()
+	if bi.partial != nil {
+		s += fmt.Sprintf("<%v>", bi.partial[0])
+	}
+	return imap.FetchItem(s)
+}
+
+// fetchBinary returns the decoded content of a body part for BINARY, or its
+// size for BINARY.SIZE.
+func (mbox *mailbox) fetchBinary(ctx context.Context, msg *protonmail.Message, bi *binaryItem) (interface{}, error) {
+	var off, n int64 = 0, -1
+	if bi.partial != nil {
+		off, n = int64(bi.partial[0]), int64(bi.partial[1])
+	}
+
+	// BINARY.SIZE is usually followed by BINARY, keep the decoded part
+	key := fmt.Sprintf("%v %v BINARY%v", msg.ID, msg.Time, bi.section())
+	l := mbox.u.spoolCache.literal(key, off, n)
+	if l == nil {
+		b, err := mbox.binarySpool(ctx, msg, bi.path)
+		if err != nil {
+			return nil, err
+		}
+		mbox.u.spoolCache.put(key, b)
+		l = b.literal(off, n)
+	}
+
+	if bi.size {
+		l.Close()
+		return uint32(l.Len()), nil
+	}
+	return binaryLiteral(l)
+}
+
+// binarySpool writes the body of a part with its Content-Transfer-Encoding
+// decoded to a spool. The whole message is returned as-is.
+func (mbox *mailbox) binarySpool(ctx context.Context, msg *protonmail.Message, path []int) (*spool, error) {
+	var enc string
+	if len(path) > 0 {
+		hb, err := mbox.bodySpool(ctx, msg, &imap.BodySectionName{
+			BodyPartName: imap.BodyPartName{Specifier: imap.MIMESpecifier, Path: path},
+		})
+		if err != nil {
+			return nil, err
+		}
+		h, err := textproto.ReadHeader(bufio.NewReader(hb.literal(0, -1)))
+		hb.Close()
+		if err != nil {
+			return nil, err
+		}
+		enc = h.Get("Content-Transfer-Encoding")
+	}
+
+	raw, err := mbox.bodySpool(ctx, msg, &imap.BodySectionName{
+		BodyPartName: imap.BodyPartName{Specifier: imap.EntireSpecifier, Path: path},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer raw.Close()
+
+	dec, err := decodeTransferEncoding(enc, raw.literal(0, -1))
+	if err != nil {
+		return nil, &imap.ErrStatusResp{Resp: &imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Code: "UNKNOWN-CTE",
+			Info: err.Error(),
+		}}
+	}
+
+	b := new(spool)
+	if _, err := io.Copy(b, dec); err != nil {
+		b.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// binaryLiteral returns l as a literal, or as a literal8 if it contains NUL
+// octets, which literals can't contain. go-imap can't write literal8 strings,
+// so these are formatted by hand and kept in memory.
+func binaryLiteral(l *spoolLiteral) (interface{}, error) {
+	hasNUL, err := containsNUL(io.NewSectionReader(l.SectionReader, 0, l.Size()))
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	if !hasNUL {
+		return l, nil
+	}
+
+	b, err := ioutil.ReadAll(l)
+	l.Close()
+	if err != nil {
+		return nil, err
+	}
+	return imap.RawString(fmt.Sprintf("~{%v}\r\n", len(b)) + string(b)), nil
+}
+
+func containsNUL(r io.Reader) (bool, error) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if bytes.IndexByte(buf[:n], 0) >= 0 {
+			return true, nil
+		}
+		if err == io.EOF {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package imap
+
+import (
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+type readerConn struct {
+	net.Conn
+	r *strings.Reader
+}
+
+func (c readerConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func TestLiteral8Conn(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{
+			name: "no literal",
+			in:   "a1 NOOP\r\n",
+			want: "a1 NOOP\r\n",
+		},
+		{
+			name: "literal",
+			in:   "a1 APPEND INBOX {5}\r\nhello\r\n",
+			want: "a1 APPEND INBOX {5}\r\nhello\r\n",
+		},
+		{
+			name: "literal8",
+			in:   "a1 APPEND INBOX ~{5}\r\nhe\x00lo\r\n",
+			want: "a1 APPEND INBOX {5}\r\nhe\x00lo\r\n",
+		},
+		{
+			name: "non-synchronizing literal8",
+			in:   "a1 APPEND INBOX ~{5+}\r\nhe\x00lo\r\n",
+			want: "a1 APPEND INBOX {5+}\r\nhe\x00lo\r\n",
+		},
+		{
+			name: "literal containing a literal8",
+			in:   "a1 APPEND INBOX {7}\r\n~{1}\r\nx\r\na2 NOOP\r\n",
+			want: "a1 APPEND INBOX {7}\r\n~{1}\r\nx\r\na2 NOOP\r\n",
+		},
+		{
+			name: "literal8 containing line breaks",
+			in:   "a1 APPEND INBOX ~{7}\r\na\r\n~{1}\r\n",
+			want: "a1 APPEND INBOX {7}\r\na\r\n~{1}\r\n",
+		},
+		{
+			name: "several literal8",
+			in:   "a1 APPEND INBOX ~{2}\r\n\x01\x02 ~{1}\r\n\n\r\n",
+			want: "a1 APPEND INBOX {2}\r\n\x01\x02 {1}\r\n\n\r\n",
+		},
+		{
+			name: "STARTTLS",
+			in:   "a1 STARTTLS\r\n~{1}\r\n",
+			want: "a1 STARTTLS\r\n~{1}\r\n",
+		},
+	}
+	for _, tc := range tests {
+		c := newLiteral8Conn(readerConn{r: strings.NewReader(tc.in)})
+		b, err := ioutil.ReadAll(c)
+		if err != nil {
+			t.Errorf("%v: Read() = %v", tc.name, err)
+			continue
+		}
+		if string(b) != tc.want {
+			t.Errorf("%v: Read() = %q, want %q", tc.name, b, tc.want)
+		}
+	}
+}
+
+func TestParseBinaryItem(t *testing.T) {
+	tests := []struct {
+		item imap.FetchItem
+		want *binaryItem
+		resp imap.FetchItem
+	}{
+		{"BINARY[]", &binaryItem{}, "BINARY[]"},
+		{"BINARY[1]", &binaryItem{path: []int{1}}, "BINARY[1]"},
+		{"binary.peek[2.1]", &binaryItem{path: []int{2, 1}}, "BINARY[2.1]"},
+		{"BINARY[1]<0.100>", &binaryItem{path: []int{1}, partial: []int{0, 100}}, "BINARY[1]<0>"},
+		{"BINARY.PEEK[3]<42.10>", &binaryItem{path: []int{3}, partial: []int{42, 10}}, "BINARY[3]<42>"},
+		{"BINARY.SIZE[2]", &binaryItem{path: []int{2}, size: true}, "BINARY.SIZE[2]"},
+		{"BINARY.SIZE[]", &binaryItem{size: true}, "BINARY.SIZE[]"},
+		{"BINARY.SIZE[2]<0.10>", nil, ""},
+		{"BINARY[1]<0>", nil, ""},
+		{"BINARY[1]<0.0>", nil, ""},
+		{"BINARY[0]", nil, ""},
+		{"BINARY[1.]", nil, ""},
+		{"BINARY[HEADER]", nil, ""},
+		{"BINARY", nil, ""},
+		{"BODY[1]", nil, ""},
+	}
+	for _, tc := range tests {
+		bi, ok := parseBinaryItem(tc.item)
+		if tc.want == nil {
+			if ok {
+				t.Errorf("parseBinaryItem(%q) = %+v, want invalid item", tc.item, bi)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("parseBinaryItem(%q) failed", tc.item)
+			continue
+		}
+		if !reflect.DeepEqual(bi, tc.want) {
+			t.Errorf("parseBinaryItem(%q) = %+v, want %+v", tc.item, bi, tc.want)
+		}
+		if resp := bi.resp(); resp != tc.resp {
+			t.Errorf("parseBinaryItem(%q).resp() = %q, want %q", tc.item, resp, tc.resp)
+		}
+	}
+}
+
+func TestBinaryLiteral(t *testing.T) {
+	tests := []struct {
+		name, data string
+		off, n     int64
+		want       interface{}
+	}{
+		{name: "text", data: "hello", n: -1, want: "hello"},
+		{name: "8-bit", data: "caf\xc3\xa9", n: -1, want: "caf\xc3\xa9"},
+		{name: "NUL", data: "a\x00b", n: -1, want: imap.RawString("~{3}\r\na\x00b")},
+		{name: "partial without NUL", data: "ab\x00c", off: 0, n: 2, want: "ab"},
+		{name: "partial with NUL", data: "ab\x00c", off: 1, n: 2, want: imap.RawString("~{2}\r\nb\x00")},
+		{name: "empty", data: "", n: -1, want: ""},
+	}
+	for _, tc := range tests {
+		s := new(spool)
+		s.Write([]byte(tc.data))
+
+		v, err := binaryLiteral(s.literal(tc.off, tc.n))
+		if err != nil {
+			t.Errorf("%v: binaryLiteral() = %v", tc.name, err)
+			continue
+		}
+		if l, ok := v.(imap.Literal); ok {
+			b, err := ioutil.ReadAll(l)
+			if err != nil {
+				t.Errorf("%v: cannot read literal: %v", tc.name, err)
+				continue
+			}
+			v = string(b)
+		}
+		if v != tc.want {
+			t.Errorf("%v: binaryLiteral() = %q, want %q", tc.name, v, tc.want)
+		}
+		if s.refs != 0 {
+			t.Errorf("%v: spool has %v references after reading the literal", tc.name, s.refs)
+		}
+	}
+}
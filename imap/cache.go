@@ -0,0 +1,111 @@
+package imap
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/emersion/go-imap"
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/emersion/hydroxide/imap/database"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// getMessage fetches a message along with its body and attachments. Messages
+// are kept in the local cache, so that they're only downloaded once.
+func (u *user) getMessage(ctx context.Context, apiID string) (*protonmail.Message, error) {
+	cm, err := u.messageCache.Get(apiID)
+	if err == nil {
+		return cm.Message, nil
+	} else if err != database.ErrNotFound {
+		u.logger.Warn("cannot get message from cache", "message", apiID, "error", err)
+	}
+
+	msg, err := u.c.GetMessage(ctx, apiID)
+	if err != nil {
+		return nil, err
+	}
+	if err := u.messageCache.Put(&database.CachedMessage{Message: msg}); err != nil {
+		u.logger.Warn("cannot add message to cache", "message", apiID, "error", err)
+	}
+	return msg, nil
+}
+
+// decryptBody decrypts the body of a message fetched with getMessage and
+// verifies its signature. Decrypted bodies are kept in the local cache.
+//
+// Bodies whose signature can't be verified because the sender's keys are
+// unknown aren't cached, so that they're checked again once the keys are
+// known.
+func (u *user) decryptBody(ctx context.Context, msg *protonmail.Message) ([]byte, *signatureResult, error) {
+	cm, err := u.messageCache.Get(msg.ID)
+	if err == nil && cm.Decrypted {
+		return cm.Body, &signatureResult{Result: cm.SignatureResult, KeyID: cm.SignatureKeyID}, nil
+	} else if err != nil && err != database.ErrNotFound {
+		u.logger.Warn("cannot get message from cache", "message", msg.ID, "error", err)
+	}
+
+	keyRing := u.verificationKeyRing(ctx, msg)
+	var b []byte
+	var sig *signatureResult
+	protonmail.DecryptPool.Do(func() {
+		var md *openpgp.MessageDetails
+		md, err = msg.Read(keyRing, nil)
+		if err != nil {
+			return
+		}
+		if b, err = ioutil.ReadAll(md.UnverifiedBody); err != nil {
+			return
+		}
+		sig = verifySignature(md)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if sig.Result != "neutral" {
+		cm := &database.CachedMessage{
+			Message:         msg,
+			Decrypted:       true,
+			Body:            b,
+			SignatureResult: sig.Result,
+			SignatureKeyID:  sig.KeyID,
+		}
+		if err := u.messageCache.Put(cm); err != nil {
+			u.logger.Warn("cannot add message to cache", "message", msg.ID, "error", err)
+		}
+	}
+	return b, sig, nil
+}
+
+// cachedBodyStructure returns the cached body structure of a message whose
+// decrypted body is a MIME entity, or nil if it isn't known.
+func (u *user) cachedBodyStructure(apiID string) *imap.BodyStructure {
+	cm, err := u.messageCache.Get(apiID)
+	if err != nil || len(cm.BodyStructure) == 0 {
+		return nil
+	}
+	bs := new(imap.BodyStructure)
+	if err := json.Unmarshal(cm.BodyStructure, bs); err != nil {
+		u.logger.Warn("cannot parse cached body structure", "message", apiID, "error", err)
+		return nil
+	}
+	return bs
+}
+
+// cacheBodyStructure keeps the body structure of a message whose decrypted
+// body is cached.
+func (u *user) cacheBodyStructure(apiID string, bs *imap.BodyStructure) {
+	cm, err := u.messageCache.Get(apiID)
+	if err != nil || !cm.Decrypted {
+		return
+	}
+	if cm.BodyStructure, err = json.Marshal(bs); err != nil {
+		u.logger.Warn("cannot encode body structure", "message", apiID, "error", err)
+		return
+	}
+	if err := u.messageCache.Put(cm); err != nil {
+		u.logger.Warn("cannot add body structure to cache", "message", apiID, "error", err)
+	}
+}
@@ -0,0 +1,389 @@
+package imap
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/server"
+)
+
+const condStoreCapability = "CONDSTORE"
+
+const (
+	fetchModSeq         imap.FetchItem  = "MODSEQ"
+	statusHighestModSeq imap.StatusItem = "HIGHESTMODSEQ"
+)
+
+const (
+	codeHighestModSeq imap.StatusRespCode = "HIGHESTMODSEQ"
+	codeNoModSeq      imap.StatusRespCode = "NOMODSEQ"
+	codeModified      imap.StatusRespCode = "MODIFIED"
+)
+
+func formatModSeq(modSeq uint64) imap.RawString {
+	return imap.RawString(strconv.FormatUint(modSeq, 10))
+}
+
+func parseModSeq(f interface{}) (uint64, error) {
+	s, ok := f.(string)
+	if !ok {
+		return 0, errors.New("Modification sequence must be a number")
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+// modSeqMailbox returns the account mailbox behind a selected mailbox, or nil
+// if the mailbox doesn't support modification sequences. The unified inbox
+// doesn't: its messages come from several accounts.
+func modSeqMailbox(m imapbackend.Mailbox) *mailbox {
+	switch m := m.(type) {
+	case *mailbox:
+		return m
+	case *namespacedMailbox:
+		return m.mailbox
+	}
+	return nil
+}
+
+// splitModSeq splits the messages of seqSet depending on whether their
+// modification sequence is greater than since.
+func (mbox *mailbox) splitModSeq(isUID bool, seqSet *imap.SeqSet, since uint64) (unchanged, changed *imap.SeqSet, err error) {
+	if err := mbox.init(); err != nil {
+		return nil, nil, err
+	}
+
+	unchanged = new(imap.SeqSet)
+	changed = new(imap.SeqSet)
+	err = mbox.db.ForEach(func(seqNum, uid uint32, apiID string) error {
+		id := seqNum
+		if isUID {
+			id = uid
+		}
+		if !seqSet.Contains(id) {
+			return nil
+		}
+
+		modSeq, err := mbox.u.db.ModSeq(apiID)
+		if err != nil {
+			return err
+		}
+		if modSeq > since {
+			changed.AddNum(id)
+		} else {
+			unchanged.AddNum(id)
+		}
+		return nil
+	})
+	return unchanged, changed, err
+}
+
+// highestModSeq returns the highest modification sequence of the messages
+// returned by a search.
+func (mbox *mailbox) highestModSeq(isUID bool, ids []uint32) (uint64, error) {
+	var highest uint64
+	for _, id := range ids {
+		var apiID string
+		var err error
+		if isUID {
+			apiID, err = mbox.db.FromUid(id)
+		} else {
+			apiID, err = mbox.db.FromSeqNum(id)
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		modSeq, err := mbox.u.db.ModSeq(apiID)
+		if err != nil {
+			return 0, err
+		}
+		if modSeq > highest {
+			highest = modSeq
+		}
+	}
+	return highest, nil
+}
+
+type selectHandler struct {
+	server.Select
+}
+
+func (h *selectHandler) Parse(fields []interface{}) error {
+	if len(fields) == 0 {
+		return errors.New("No enough arguments")
+	}
+	if err := h.Select.Parse(fields[:1]); err != nil {
+		return err
+	}
+	if len(fields) == 1 {
+		return nil
+	}
+
+	params, ok := fields[1].([]interface{})
+	if !ok {
+		return errors.New("SELECT parameters must be a list")
+	}
+	for len(params) > 0 {
+		name, _ := params[0].(string)
+		switch strings.ToUpper(name) {
+		case condStoreCapability:
+			// Modification sequences are always sent
+			params = params[1:]
+		default:
+			return errors.New("Unknown SELECT parameter")
+		}
+	}
+	return nil
+}
+
+func (h *selectHandler) Handle(conn server.Conn) error {
+	// The inner handler always returns a status response on success
+	status := h.Select.Handle(conn)
+	if _, ok := status.(*imap.ErrStatusResp); !ok {
+		return status
+	}
+
+	mbox := modSeqMailbox(conn.Context().Mailbox)
+	if mbox == nil {
+		if err := conn.WriteResp(&imap.StatusResp{
+			Type: imap.StatusRespOk,
+			Code: codeNoModSeq,
+			Info: "Sorry, this mailbox format doesn't support modsequences",
+		}); err != nil {
+			return err
+		}
+		return status
+	}
+
+	highest, err := mbox.u.db.HighestModSeq()
+	if err != nil {
+		return err
+	}
+	if err := conn.WriteResp(&imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      codeHighestModSeq,
+		Arguments: []interface{}{formatModSeq(highest)},
+		Info:      "Highest",
+	}); err != nil {
+		return err
+	}
+
+	return status
+}
+
+type fetchHandler struct {
+	server.Fetch
+	changedSince *uint64
+}
+
+func (h *fetchHandler) Parse(fields []interface{}) error {
+	if len(fields) < 3 {
+		return h.Fetch.Parse(fields)
+	}
+	if err := h.Fetch.Parse(fields[:2]); err != nil {
+		return err
+	}
+
+	modifiers, ok := fields[2].([]interface{})
+	if !ok {
+		return errors.New("FETCH modifiers must be a list")
+	}
+	for len(modifiers) > 0 {
+		name, _ := modifiers[0].(string)
+		switch strings.ToUpper(name) {
+		case "CHANGEDSINCE":
+			if len(modifiers) < 2 {
+				return errors.New("Missing CHANGEDSINCE value")
+			}
+			modSeq, err := parseModSeq(modifiers[1])
+			if err != nil {
+				return err
+			}
+			h.changedSince = &modSeq
+			modifiers = modifiers[2:]
+		default:
+			return errors.New("Unknown FETCH modifier")
+		}
+	}
+	return nil
+}
+
+func (h *fetchHandler) handle(uid bool, conn server.Conn) error {
+	if h.changedSince == nil {
+		if uid {
+			return h.Fetch.UidHandle(conn)
+		}
+		return h.Fetch.Handle(conn)
+	}
+
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return server.ErrNoMailboxSelected
+	}
+	mbox := modSeqMailbox(ctx.Mailbox)
+	if mbox == nil {
+		return errors.New("Mailbox doesn't support modification sequences")
+	}
+	hasModSeq := false
+	for _, item := range h.Items {
+		if item == fetchModSeq {
+			hasModSeq = true
+			break
+		}
+	}
+	if !hasModSeq {
+		h.Items = append(h.Items, fetchModSeq)
+	}
+
+	_, changed, err := mbox.splitModSeq(uid, h.SeqSet, *h.changedSince)
+	if err != nil {
+		return err
+	} else if len(changed.Set) == 0 {
+		return nil
+	}
+	h.SeqSet = changed
+
+	if uid {
+		return h.Fetch.UidHandle(conn)
+	}
+	return h.Fetch.Handle(conn)
+}
+
+func (h *fetchHandler) Handle(conn server.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *fetchHandler) UidHandle(conn server.Conn) error {
+	return h.handle(true, conn)
+}
+
+type storeHandler struct {
+	server.Store
+	unchangedSince *uint64
+}
+
+func (h *storeHandler) Parse(fields []interface{}) error {
+	if len(fields) > 1 {
+		if modifiers, ok := fields[1].([]interface{}); ok {
+			if len(modifiers) != 2 {
+				return errors.New("Invalid STORE modifiers")
+			}
+			if name, _ := modifiers[0].(string); !strings.EqualFold(name, "UNCHANGEDSINCE") {
+				return errors.New("Unknown STORE modifier")
+			}
+			modSeq, err := parseModSeq(modifiers[1])
+			if err != nil {
+				return err
+			}
+			h.unchangedSince = &modSeq
+
+			fields = append([]interface{}{fields[0]}, fields[2:]...)
+		}
+	}
+	return h.Store.Parse(fields)
+}
+
+func (h *storeHandler) handle(uid bool, conn server.Conn) error {
+	if h.unchangedSince == nil {
+		if uid {
+			return h.Store.UidHandle(conn)
+		}
+		return h.Store.Handle(conn)
+	}
+
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return server.ErrNoMailboxSelected
+	}
+	if ctx.MailboxReadOnly {
+		return server.ErrMailboxReadOnly
+	}
+	mbox := modSeqMailbox(ctx.Mailbox)
+	if mbox == nil {
+		return server.ErrStatusResp(&imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Code: codeNoModSeq,
+			Info: "Mailbox doesn't support modification sequences",
+		})
+	}
+
+	// Messages modified since the client's modification sequence are left
+	// untouched
+	unchanged, modified, err := mbox.splitModSeq(uid, h.SeqSet, *h.unchangedSince)
+	if err != nil {
+		return err
+	}
+
+	if len(unchanged.Set) > 0 {
+		h.SeqSet = unchanged
+		if uid {
+			err = h.Store.UidHandle(conn)
+		} else {
+			err = h.Store.Handle(conn)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(modified.Set) == 0 {
+		return nil
+	}
+	return server.ErrStatusResp(&imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      codeModified,
+		Arguments: []interface{}{modified},
+		Info:      "Conditional STORE failed",
+	})
+}
+
+func (h *storeHandler) Handle(conn server.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *storeHandler) UidHandle(conn server.Conn) error {
+	return h.handle(true, conn)
+}
+
+type condStoreExtension struct{}
+
+// NewCondStoreExtension returns an extension implementing CONDSTORE (RFC
+// 7162). Modification sequences are bumped each time a message is changed by
+// an event from the API, and are included in all unsolicited FETCH responses.
+//
+// QRESYNC isn't implemented: it requires expunges to be reported with VANISHED
+// responses, which go-imap doesn't allow to be sent.
+func NewCondStoreExtension() server.Extension {
+	return &condStoreExtension{}
+}
+
+func (ext *condStoreExtension) Capabilities(c server.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{condStoreCapability}
+	}
+	return nil
+}
+
+func (ext *condStoreExtension) Command(name string) server.HandlerFactory {
+	switch name {
+	case "SELECT", "EXAMINE":
+		readOnly := name == "EXAMINE"
+		return func() server.Handler {
+			h := &selectHandler{}
+			h.ReadOnly = readOnly
+			return h
+		}
+	case "FETCH":
+		return func() server.Handler {
+			return &fetchHandler{}
+		}
+	case "STORE":
+		return func() server.Handler {
+			return &storeHandler{}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package imap
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/emersion/go-imap"
+
+	"github.com/emersion/hydroxide/config"
+	"github.com/emersion/hydroxide/imap/database"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestFlagsUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hydroxide-imap-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config.SetDir(dir)
+	defer config.SetDir("")
+
+	db, err := database.Open("alice.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	inbox, err := db.Mailbox(protonmail.LabelInbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := inbox.Sync([]*protonmail.Message{{ID: "a"}, {ID: "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.TouchMessages([]string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	u := &user{u: &protonmail.User{Name: "alice"}, db: db}
+	mbox := &mailbox{name: "INBOX", u: u, db: inbox}
+	unified := &unifiedMailbox{
+		uu: &unifiedUser{name: "alice,bob"},
+		db: openTestMailbox(t, "unified.db", []string{"a", "b"}),
+	}
+
+	for _, apiID := range []string{"a", "b"} {
+		want, err := db.ModSeq(apiID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		update, err := mbox.flagsUpdate(&protonmail.Message{ID: apiID})
+		if err != nil {
+			t.Fatalf("%v: flagsUpdate() = %v", apiID, err)
+		}
+		fields := update.Message.Format()
+		if len(fields) != 4 || fields[2] != imap.RawString(fetchModSeq) {
+			t.Errorf("%v: flagsUpdate() = %v, want FLAGS and MODSEQ", apiID, fields)
+		} else if modSeq := fields[3].([]interface{})[0]; modSeq != formatModSeq(want) {
+			t.Errorf("%v: flagsUpdate() MODSEQ = %v, want %v", apiID, modSeq, want)
+		}
+
+		unifiedUpdate := unified.messageUpdate(mbox, update)
+		if unifiedUpdate == nil {
+			t.Fatalf("%v: messageUpdate() = nil", apiID)
+		}
+		if _, ok := unifiedUpdate.Message.Items[fetchModSeq]; ok {
+			t.Errorf("%v: messageUpdate() contains MODSEQ", apiID)
+		}
+		if _, ok := update.Message.Items[fetchModSeq]; !ok {
+			t.Errorf("%v: messageUpdate() removed MODSEQ from the original update", apiID)
+		}
+	}
+}
@@ -0,0 +1,430 @@
+package database
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+var (
+	cacheBucket         = []byte("cache")
+	cacheMessagesBucket = []byte("messages")
+	// Maps sequence numbers, increasing each time a message is used, to
+	// message IDs
+	cacheOrderBucket = []byte("order")
+	// Maps message IDs to their sequence number in cacheOrderBucket
+	cacheSeqsBucket = []byte("seqs")
+	// Total size of the entries of cacheMessagesBucket
+	cacheSizeKey = []byte("size")
+)
+
+// CachedMessage is a message fetched with GetMessage, along with its decrypted
+// body once it's known.
+type CachedMessage struct {
+	Message *protonmail.Message
+
+	Decrypted bool
+	Body      []byte
+	// Result of the verification of the OpenPGP signature, see
+	// imap.signatureResult
+	SignatureResult string
+	SignatureKeyID  uint64
+	// JSON-encoded IMAP body structure of the decrypted body, for bodies
+	// which are MIME entities
+	BodyStructure json.RawMessage `json:",omitempty"`
+}
+
+// MessageCache is an encrypted cache of full messages and their decrypted
+// bodies, indexed by message ID. It saves fetching and decrypting messages
+// again each time the IMAP server is started.
+//
+// Entries are encrypted with a random cache key, which is itself stored
+// encrypted with the user's private keys. The database file still contains
+// the (encrypted) contents of the messages, it can be limited in size or
+// removed with DeleteMessageCache.
+//
+// Once the cache is larger than its maximum size, the least recently used
+// messages are evicted. A nil *MessageCache is a disabled cache: Get returns
+// ErrNotFound and the other methods do nothing.
+type MessageCache struct {
+	u       *User
+	aead    cipher.AEAD
+	maxSize int64
+
+	locker sync.Mutex
+	// Messages read since the last write, moved to the end of the order on
+	// the next write so that reads don't need a write transaction
+	used map[string]struct{}
+}
+
+// cacheTx holds the buckets of the message cache in a transaction.
+type cacheTx struct {
+	b, messages, order, seqs *bolt.Bucket
+}
+
+func openCacheTx(tx *bolt.Tx) (*cacheTx, error) {
+	b := tx.Bucket(cacheBucket)
+	if b == nil {
+		return nil, errors.New("cannot find cache bucket")
+	}
+	ct := &cacheTx{
+		b:        b,
+		messages: b.Bucket(cacheMessagesBucket),
+		order:    b.Bucket(cacheOrderBucket),
+		seqs:     b.Bucket(cacheSeqsBucket),
+	}
+	if ct.messages == nil || ct.order == nil || ct.seqs == nil {
+		return nil, errors.New("cannot find cache buckets")
+	}
+	return ct, nil
+}
+
+func (ct *cacheTx) size() int64 {
+	if v := ct.b.Get(cacheSizeKey); len(v) == 8 {
+		return int64(binary.BigEndian.Uint64(v))
+	}
+	return 0
+}
+
+func (ct *cacheTx) setSize(size int64) error {
+	if size < 0 {
+		size = 0
+	}
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(size))
+	return ct.b.Put(cacheSizeKey, v)
+}
+
+// touch marks a message as the most recently used one.
+func (ct *cacheTx) touch(apiID []byte) error {
+	if prev := ct.seqs.Get(apiID); prev != nil {
+		if err := ct.order.Delete(prev); err != nil {
+			return err
+		}
+	}
+	seq, err := ct.order.NextSequence()
+	if err != nil {
+		return err
+	}
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	if err := ct.order.Put(k, apiID); err != nil {
+		return err
+	}
+	return ct.seqs.Put(apiID, k)
+}
+
+// put stores an entry and adjusts the total size.
+func (ct *cacheTx) put(apiID, v []byte) error {
+	size := ct.size() - int64(len(ct.messages.Get(apiID))) + int64(len(v))
+	if err := ct.messages.Put(apiID, v); err != nil {
+		return err
+	}
+	if err := ct.touch(apiID); err != nil {
+		return err
+	}
+	return ct.setSize(size)
+}
+
+// remove deletes an entry and adjusts the total size.
+func (ct *cacheTx) remove(apiID []byte) error {
+	v := ct.messages.Get(apiID)
+	if v == nil {
+		return nil
+	}
+	size := ct.size() - int64(len(v))
+	if err := ct.messages.Delete(apiID); err != nil {
+		return err
+	}
+	if seq := ct.seqs.Get(apiID); seq != nil {
+		if err := ct.order.Delete(seq); err != nil {
+			return err
+		}
+		if err := ct.seqs.Delete(apiID); err != nil {
+			return err
+		}
+	}
+	return ct.setSize(size)
+}
+
+// evict removes the least recently used entries until the cache isn't larger
+// than maxSize.
+func (ct *cacheTx) evict(maxSize int64) error {
+	if maxSize <= 0 {
+		return nil
+	}
+	for ct.size() > maxSize {
+		_, apiID := ct.order.Cursor().First()
+		if apiID == nil {
+			// The size doesn't match the entries
+			return ct.setSize(0)
+		}
+		// The value is only valid until the bucket is modified
+		if err := ct.remove(append([]byte(nil), apiID...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reset removes all entries.
+func (ct *cacheTx) reset() error {
+	for _, name := range [][]byte{cacheMessagesBucket, cacheOrderBucket, cacheSeqsBucket} {
+		if err := ct.b.DeleteBucket(name); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+	}
+	if err := createCacheBuckets(ct.b); err != nil {
+		return err
+	}
+	ct.messages = ct.b.Bucket(cacheMessagesBucket)
+	ct.order = ct.b.Bucket(cacheOrderBucket)
+	ct.seqs = ct.b.Bucket(cacheSeqsBucket)
+	return nil
+}
+
+func createCacheBuckets(b *bolt.Bucket) error {
+	// Caches created before the size was bounded don't keep track of the
+	// order of entries
+	if b.Bucket(cacheOrderBucket) == nil && b.Bucket(cacheMessagesBucket) != nil {
+		if err := b.DeleteBucket(cacheMessagesBucket); err != nil {
+			return err
+		}
+	}
+	for _, name := range [][]byte{cacheMessagesBucket, cacheOrderBucket, cacheSeqsBucket} {
+		if _, err := b.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+	if k, _ := b.Bucket(cacheMessagesBucket).Cursor().First(); k == nil {
+		return b.Delete(cacheSizeKey)
+	}
+	return nil
+}
+
+// MessageCache opens the user's message cache, generating a new cache key if
+// necessary. If one of the user's keys has been removed since the cache has
+// been created, the cache is cleared. Least recently used messages are evicted
+// once the cache is larger than maxSize bytes, zero means no limit.
+func (u *User) MessageCache(keyRing openpgp.EntityList, maxSize int64) (*MessageCache, error) {
+	var key []byte
+	err := u.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(cacheBucket)
+		if err != nil {
+			return err
+		}
+
+		var created bool
+		key, created, err = loadKey(b, keyRing)
+		if err != nil {
+			return err
+		}
+		if err := createCacheBuckets(b); err != nil {
+			return err
+		}
+		ct, err := openCacheTx(tx)
+		if err != nil {
+			return err
+		}
+		if created {
+			return ct.reset()
+		}
+		return ct.evict(maxSize)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MessageCache{
+		u:       u,
+		aead:    aead,
+		maxSize: maxSize,
+		used:    make(map[string]struct{}),
+	}, nil
+}
+
+// DeleteMessageCache removes all cached messages and the cache key, e.g. when
+// the cache is disabled.
+func (u *User) DeleteMessageCache() error {
+	return u.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket(cacheBucket)
+		if err == bolt.ErrBucketNotFound {
+			err = nil
+		}
+		return err
+	})
+}
+
+// update runs f in a write transaction, once the messages read since the
+// last write have been marked as used.
+func (c *MessageCache) update(f func(ct *cacheTx) error) error {
+	c.locker.Lock()
+	used := c.used
+	c.used = make(map[string]struct{})
+	c.locker.Unlock()
+
+	return c.u.db.Update(func(tx *bolt.Tx) error {
+		ct, err := openCacheTx(tx)
+		if err != nil {
+			return err
+		}
+		for apiID := range used {
+			if ct.messages.Get([]byte(apiID)) == nil {
+				continue
+			}
+			if err := ct.touch([]byte(apiID)); err != nil {
+				return err
+			}
+		}
+		if err := f(ct); err != nil {
+			return err
+		}
+		return ct.evict(c.maxSize)
+	})
+}
+
+func (c *MessageCache) seal(cm *CachedMessage) ([]byte, error) {
+	b, err := json.Marshal(cm)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(b)+c.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	// The message ID is authenticated, so that entries can't be swapped
+	return c.aead.Seal(nonce, nonce, b, []byte(cm.Message.ID)), nil
+}
+
+func (c *MessageCache) open(apiID string, v []byte) (*CachedMessage, error) {
+	n := c.aead.NonceSize()
+	if len(v) < n {
+		return nil, errors.New("invalid cache entry")
+	}
+	b, err := c.aead.Open(nil, v[:n], v[n:], []byte(apiID))
+	if err != nil {
+		return nil, err
+	}
+
+	cm := new(CachedMessage)
+	if err := json.Unmarshal(b, cm); err != nil {
+		return nil, err
+	}
+	return cm, nil
+}
+
+// Get returns a cached message. ErrNotFound is returned if the message isn't
+// in the cache.
+func (c *MessageCache) Get(apiID string) (*CachedMessage, error) {
+	if c == nil {
+		return nil, ErrNotFound
+	}
+
+	var v []byte
+	err := c.u.db.View(func(tx *bolt.Tx) error {
+		ct, err := openCacheTx(tx)
+		if err != nil {
+			return err
+		}
+		if v = ct.messages.Get([]byte(apiID)); v != nil {
+			// The value is only valid during the transaction
+			v = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, ErrNotFound
+	}
+
+	c.locker.Lock()
+	c.used[apiID] = struct{}{}
+	c.locker.Unlock()
+
+	return c.open(apiID, v)
+}
+
+// Put adds a message to the cache, replacing any previous version.
+func (c *MessageCache) Put(cm *CachedMessage) error {
+	if c == nil {
+		return nil
+	}
+
+	v, err := c.seal(cm)
+	if err != nil {
+		return err
+	}
+	return c.update(func(ct *cacheTx) error {
+		return ct.put([]byte(cm.Message.ID), v)
+	})
+}
+
+// Update patches the metadata of a cached message. It's a no-op if the
+// message isn't in the cache.
+func (c *MessageCache) Update(apiID string, update *protonmail.EventMessageUpdate) error {
+	if c == nil {
+		return nil
+	}
+
+	return c.update(func(ct *cacheTx) error {
+		v := ct.messages.Get([]byte(apiID))
+		if v == nil {
+			return nil
+		}
+		cm, err := c.open(apiID, v)
+		if err != nil {
+			// Drop entries we can't read anymore
+			return ct.remove([]byte(apiID))
+		}
+
+		update.Patch(cm.Message)
+		if v, err = c.seal(cm); err != nil {
+			return err
+		}
+		return ct.put([]byte(apiID), v)
+	})
+}
+
+// Remove removes a message from the cache.
+func (c *MessageCache) Remove(apiID string) error {
+	if c == nil {
+		return nil
+	}
+
+	return c.update(func(ct *cacheTx) error {
+		return ct.remove([]byte(apiID))
+	})
+}
+
+// Clear removes all messages from the cache.
+func (c *MessageCache) Clear() error {
+	if c == nil {
+		return nil
+	}
+
+	return c.update(func(ct *cacheTx) error {
+		return ct.reset()
+	})
+}
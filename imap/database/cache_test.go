@@ -0,0 +1,144 @@
+package database
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func cachedIDs(t *testing.T, c *MessageCache, ids []string) []string {
+	l := []string{}
+	for _, id := range ids {
+		cm, err := c.Get(id)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			t.Fatalf("Get(%q) = %v", id, err)
+		}
+		if cm.Message.ID != id {
+			t.Errorf("Get(%q) returned message %q", id, cm.Message.ID)
+		}
+		l = append(l, id)
+	}
+	sort.Strings(l)
+	return l
+}
+
+func TestMessageCache(t *testing.T) {
+	u, cleanup := openTestUser(t)
+	defer cleanup()
+
+	body := bytes.Repeat([]byte("x"), 1000)
+	keyRing := newTestKeyRing(t)
+	c, err := u.MessageCache(keyRing, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The cache holds two entries
+	v, err := c.seal(&CachedMessage{Message: &protonmail.Message{ID: "a"}, Decrypted: true, Body: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entrySize := int64(len(v))
+	c.maxSize = 2*entrySize + entrySize/2
+
+	put := func(id string) func() error {
+		return func() error {
+			return c.Put(&CachedMessage{Message: &protonmail.Message{ID: id}, Decrypted: true, Body: body})
+		}
+	}
+	get := func(id string) func() error {
+		return func() error {
+			_, err := c.Get(id)
+			return err
+		}
+	}
+	remove := func(id string) func() error {
+		return func() error {
+			return c.Remove(id)
+		}
+	}
+
+	ids := []string{"a", "b", "c", "d"}
+	tests := []struct {
+		name string
+		op   func() error
+		want []string
+	}{
+		{"put a", put("a"), []string{"a"}},
+		{"put b", put("b"), []string{"a", "b"}},
+		{"put c evicts a", put("c"), []string{"b", "c"}},
+		{"get b", get("b"), []string{"b", "c"}},
+		{"put d evicts c", put("d"), []string{"b", "d"}},
+		{"replace b", put("b"), []string{"b", "d"}},
+		{"put a evicts d", put("a"), []string{"a", "b"}},
+		{"remove a", remove("a"), []string{"b"}},
+		{"put c", put("c"), []string{"b", "c"}},
+		{"clear", c.Clear, []string{}},
+		{"put d after clear", put("d"), []string{"d"}},
+		{"put a", put("a"), []string{"a", "d"}},
+		{"get d", get("d"), []string{"a", "d"}},
+	}
+	for _, tc := range tests {
+		if err := tc.op(); err != nil {
+			t.Fatalf("%v: %v", tc.name, err)
+		}
+		// Only look at the contents, reading changes the order
+		var got []string
+		err := u.db.View(func(tx *bolt.Tx) error {
+			ct, err := openCacheTx(tx)
+			if err != nil {
+				return err
+			}
+			got = []string{}
+			return ct.messages.ForEach(func(k, v []byte) error {
+				got = append(got, string(k))
+				return nil
+			})
+		})
+		if err != nil {
+			t.Fatalf("%v: %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: cached messages = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	// Opening the cache with a smaller size evicts the least recently used
+	// messages, once reads have been recorded by a write
+	if err := c.Remove("unknown"); err != nil {
+		t.Fatal(err)
+	}
+	c, err = u.MessageCache(keyRing, entrySize+entrySize/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cachedIDs(t, c, ids), []string{"d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("cached messages after re-opening = %v, want %v", got, want)
+	}
+
+	var disabled *MessageCache
+	if _, err := disabled.Get("d"); err != ErrNotFound {
+		t.Errorf("Get() on a disabled cache = %v, want ErrNotFound", err)
+	}
+	if err := disabled.Put(&CachedMessage{Message: &protonmail.Message{ID: "e"}}); err != nil {
+		t.Errorf("Put() on a disabled cache = %v", err)
+	}
+
+	if err := u.DeleteMessageCache(); err != nil {
+		t.Fatalf("DeleteMessageCache() = %v", err)
+	}
+	c, err = u.MessageCache(keyRing, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cachedIDs(t, c, ids); len(got) != 0 {
+		t.Errorf("cached messages after DeleteMessageCache = %v, want none", got)
+	}
+}
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+var (
+	// draftIDsBucket maps the Message-Id header field of drafts saved over
+	// IMAP to message IDs.
+	draftIDsBucket = []byte("draftids")
+	// draftVersionsBucket maps message IDs to the time of the last version
+	// of the draft saved over IMAP.
+	draftVersionsBucket = []byte("draftversions")
+)
+
+// PutDraft records that a version of a draft has been saved over IMAP.
+func (u *User) PutDraft(messageID string, msg *protonmail.Message) error {
+	return u.db.Update(func(tx *bolt.Tx) error {
+		ids, err := tx.CreateBucketIfNotExists(draftIDsBucket)
+		if err != nil {
+			return err
+		}
+		if messageID != "" {
+			if err := ids.Put([]byte(messageID), []byte(msg.ID)); err != nil {
+				return err
+			}
+		}
+
+		versions, err := tx.CreateBucketIfNotExists(draftVersionsBucket)
+		if err != nil {
+			return err
+		}
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, uint64(msg.Time))
+		return versions.Put([]byte(msg.ID), v)
+	})
+}
+
+// Draft returns the ID of the draft saved over IMAP with the provided
+// Message-Id header field, and the time of the last version saved over IMAP.
+func (u *User) Draft(messageID string) (apiID string, version protonmail.Timestamp, err error) {
+	err = u.db.View(func(tx *bolt.Tx) error {
+		ids := tx.Bucket(draftIDsBucket)
+		if ids == nil {
+			return ErrNotFound
+		}
+		v := ids.Get([]byte(messageID))
+		if v == nil {
+			return ErrNotFound
+		}
+		apiID = string(v)
+
+		version = draftVersion(tx, apiID)
+		return nil
+	})
+	return
+}
+
+// DraftVersion returns the time of the last version of a draft saved over
+// IMAP, or zero if the draft hasn't been saved over IMAP.
+func (u *User) DraftVersion(apiID string) (protonmail.Timestamp, error) {
+	var version protonmail.Timestamp
+	err := u.db.View(func(tx *bolt.Tx) error {
+		version = draftVersion(tx, apiID)
+		return nil
+	})
+	return version, err
+}
+
+func draftVersion(tx *bolt.Tx, apiID string) protonmail.Timestamp {
+	versions := tx.Bucket(draftVersionsBucket)
+	if versions == nil {
+		return 0
+	}
+	v := versions.Get([]byte(apiID))
+	if v == nil {
+		return 0
+	}
+	return protonmail.Timestamp(binary.BigEndian.Uint64(v))
+}
+
+// ReplaceMessage replaces the metadata of a message, e.g. after a draft has
+// been edited. The labels known to the local database are kept.
+func (u *User) ReplaceMessage(msg *protonmail.Message) error {
+	return u.db.Update(func(tx *bolt.Tx) error {
+		messages := tx.Bucket(messagesBucket)
+		if messages == nil {
+			return errors.New("cannot replace message in local DB: messages bucket doesn't exist")
+		}
+
+		old, err := userMessage(messages, msg.ID)
+		if err != nil {
+			return err
+		}
+
+		replaced := *msg
+		replaced.LabelIDs = old.LabelIDs
+		if err := touchMessage(tx, msg.ID); err != nil {
+			return err
+		}
+		return userCreateMessage(messages, &replaced)
+	})
+}
+
+// Renumber assigns a new UID to a message, so that clients fetch it again.
+// It returns the sequence number of the message before being renumbered and
+// the new number of messages in the mailbox.
+func (mbox *Mailbox) Renumber(apiID string) (oldSeqNum, messages uint32, err error) {
+	err = mbox.u.db.Update(func(tx *bolt.Tx) error {
+		b, err := mbox.bucket(tx)
+		if err != nil {
+			return err
+		}
+
+		oldSeqNum, err = mailboxDeleteMessage(b, mbox.labelID, apiID)
+		if err != nil {
+			return err
+		} else if oldSeqNum == 0 {
+			return ErrNotFound
+		}
+
+		messages, err = mailboxCreateMessage(b, apiID)
+		return err
+	})
+	return
+}
@@ -0,0 +1,147 @@
+package database
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/openpgp"
+)
+
+var (
+	keyKey = []byte("key")
+	// Hash of the fingerprints of the keys which encrypt the local key, stored
+	// before the fingerprints themselves
+	keyRingKey             = []byte("keyring")
+	keyRingFingerprintsKey = []byte("keyring-fingerprints")
+)
+
+const fingerprintSize = 20
+
+func decryptKey(encrypted []byte, keyRing openpgp.EntityList) ([]byte, error) {
+	md, err := openpgp.ReadMessage(bytes.NewReader(encrypted), keyRing, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(md.UnverifiedBody)
+}
+
+func encryptKey(key []byte, keyRing openpgp.EntityList) ([]byte, error) {
+	var b bytes.Buffer
+	w, err := openpgp.Encrypt(&b, keyRing, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(key); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// keyRingFingerprints returns the sorted fingerprints of the keys used to
+// encrypt a local key, concatenated.
+func keyRingFingerprints(keyRing openpgp.EntityList) []byte {
+	fingerprints := make([][]byte, 0, len(keyRing))
+	for _, e := range keyRing {
+		fingerprints = append(fingerprints, e.PrimaryKey.Fingerprint[:])
+	}
+	sort.Slice(fingerprints, func(i, j int) bool {
+		return bytes.Compare(fingerprints[i], fingerprints[j]) < 0
+	})
+	return bytes.Join(fingerprints, nil)
+}
+
+// keyRingFingerprint is the hash of keyRingFingerprints, stored by previous
+// versions.
+func keyRingFingerprint(fingerprints []byte) []byte {
+	sum := sha256.Sum256(fingerprints)
+	return sum[:]
+}
+
+// includesFingerprints checks whether all fingerprints of sub are in set.
+func includesFingerprints(set, sub []byte) bool {
+	if len(sub)%fingerprintSize != 0 {
+		return false
+	}
+	for i := 0; i < len(sub); i += fingerprintSize {
+		found := false
+		for j := 0; j+fingerprintSize <= len(set); j += fingerprintSize {
+			if bytes.Equal(sub[i:i+fingerprintSize], set[j:j+fingerprintSize]) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// prevKeysKept checks whether all the keys which encrypted the local key
+// stored in b are still in the key ring whose fingerprints are provided.
+func prevKeysKept(b *bolt.Bucket, fingerprints []byte) bool {
+	if prev := b.Get(keyRingFingerprintsKey); prev != nil {
+		return includesFingerprints(fingerprints, prev)
+	}
+	// Keys stored before key rings were tracked don't have a fingerprint,
+	// then only a hash of the fingerprints was stored
+	prev := b.Get(keyRingKey)
+	return prev == nil || bytes.Equal(prev, keyRingFingerprint(fingerprints))
+}
+
+// loadKey returns the random key stored in b, encrypted with keyRing.
+//
+// If keys have been added to the key ring since the key has been stored, it's
+// encrypted again with the whole key ring. If there's no key yet, or if one of
+// the keys which encrypted it has been removed from the key ring, a new key is
+// generated and created is true: the data protected by the previous key, if
+// any, must be cleared, so that the removed key can't decrypt it anymore.
+func loadKey(b *bolt.Bucket, keyRing openpgp.EntityList) (key []byte, created bool, err error) {
+	fingerprints := keyRingFingerprints(keyRing)
+
+	if encrypted := b.Get(keyKey); encrypted != nil && prevKeysKept(b, fingerprints) {
+		key, err = decryptKey(encrypted, keyRing)
+		if key != nil && err == nil {
+			if bytes.Equal(b.Get(keyRingFingerprintsKey), fingerprints) {
+				return key, false, nil
+			}
+			if encrypted, err = encryptKey(key, keyRing); err != nil {
+				return nil, false, err
+			}
+			if err := b.Put(keyKey, encrypted); err != nil {
+				return nil, false, err
+			}
+			return key, false, putKeyRingFingerprints(b, fingerprints)
+		}
+	}
+
+	key = make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, false, err
+	}
+	encrypted, err := encryptKey(key, keyRing)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := b.Put(keyKey, encrypted); err != nil {
+		return nil, false, err
+	}
+	return key, true, putKeyRingFingerprints(b, fingerprints)
+}
+
+func putKeyRingFingerprints(b *bolt.Bucket, fingerprints []byte) error {
+	if b.Get(keyRingKey) != nil {
+		if err := b.Delete(keyRingKey); err != nil {
+			return err
+		}
+	}
+	return b.Put(keyRingFingerprintsKey, fingerprints)
+}
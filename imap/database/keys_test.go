@@ -0,0 +1,86 @@
+package database
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestLoadKey(t *testing.T) {
+	u, cleanup := openTestUser(t)
+	defer cleanup()
+
+	k1 := newTestKeyRing(t)[0]
+	k2 := newTestKeyRing(t)[0]
+	k3 := newTestKeyRing(t)[0]
+	bucket := []byte("test")
+
+	tests := []struct {
+		name    string
+		keyRing openpgp.EntityList
+		// Stores a key the way previous versions did
+		legacy  bool
+		created bool
+	}{
+		{name: "new", keyRing: openpgp.EntityList{k1}, created: true},
+		{name: "same keys", keyRing: openpgp.EntityList{k1}},
+		{name: "added key", keyRing: openpgp.EntityList{k2, k1}},
+		{name: "same keys in another order", keyRing: openpgp.EntityList{k1, k2}},
+		{name: "removed key", keyRing: openpgp.EntityList{k2}, created: true},
+		{name: "legacy, same keys", keyRing: openpgp.EntityList{k2}, legacy: true},
+		{name: "legacy, added key", keyRing: openpgp.EntityList{k2, k3}, legacy: true, created: true},
+		{name: "after legacy", keyRing: openpgp.EntityList{k2, k3}},
+	}
+	var prev []byte
+	for _, tc := range tests {
+		var key []byte
+		var created bool
+		err := u.db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists(bucket)
+			if err != nil {
+				return err
+			}
+			if tc.legacy {
+				fingerprints := b.Get(keyRingFingerprintsKey)
+				if err := b.Put(keyRingKey, keyRingFingerprint(fingerprints)); err != nil {
+					return err
+				}
+				if err := b.Delete(keyRingFingerprintsKey); err != nil {
+					return err
+				}
+			}
+			key, created, err = loadKey(b, tc.keyRing)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("%v: loadKey() = %v", tc.name, err)
+		}
+		if created != tc.created {
+			t.Errorf("%v: loadKey() created = %v, want %v", tc.name, created, tc.created)
+		}
+		if same := bytes.Equal(key, prev); same == tc.created {
+			t.Errorf("%v: loadKey() returned the previous key: %v", tc.name, same)
+		}
+		prev = key
+
+		// The key can be decrypted by each key of the key ring
+		err = u.db.View(func(tx *bolt.Tx) error {
+			encrypted := tx.Bucket(bucket).Get(keyKey)
+			for _, e := range tc.keyRing {
+				decrypted, err := decryptKey(encrypted, openpgp.EntityList{e})
+				if err != nil {
+					return err
+				}
+				if !bytes.Equal(decrypted, key) {
+					t.Errorf("%v: key decrypted by %v doesn't match", tc.name, e.PrimaryKey.KeyIdString())
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%v: cannot decrypt key: %v", tc.name, err)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"time"
 
 	"github.com/boltdb/bolt"
 
@@ -33,15 +34,21 @@ func mailboxCreateMessage(b *bolt.Bucket, apiID string) (seqNum uint32, err erro
 
 	id, _ := b.NextSequence()
 	uid := uint32(id)
-	return n, b.Put(serializeUID(uid), want)
+	if err := b.Put(serializeUID(uid), want); err != nil {
+		return 0, err
+	}
+	return n, touchMessage(b.Tx(), apiID)
 }
 
-func mailboxDeleteMessage(b *bolt.Bucket, apiID string) (seqNum uint32, err error) {
+func mailboxDeleteMessage(b *bolt.Bucket, labelID, apiID string) (seqNum uint32, err error) {
 	want := []byte(apiID)
 	c := b.Cursor()
 	var n uint32 = 1
 	for k, v := c.First(); k != nil; k, v = c.Next() {
 		if bytes.Equal(v, want) {
+			if err := putVanished(b.Tx(), labelID, unserializeUID(k)); err != nil {
+				return 0, err
+			}
 			return n, b.Delete(k)
 		}
 		n++
@@ -66,21 +73,110 @@ func (mbox *Mailbox) bucket(tx *bolt.Tx) (*bolt.Bucket, error) {
 	return b, nil
 }
 
-func (mbox *Mailbox) Sync(messages []*protonmail.Message) error {
-	return mbox.u.db.Update(func(tx *bolt.Tx) error {
+// mappingValid checks that the UID mapping stored in b is consistent: keys are
+// UIDs, no message appears twice and no UID is above the last one assigned.
+//
+// Messages which aren't listed by the API anymore don't make the mapping
+// invalid, even if none of them is left (e.g. when Proton-side message IDs
+// change): they're expunged and the new messages get new UIDs.
+func mappingValid(b *bolt.Bucket) bool {
+	known := make(map[string]bool)
+	var last uint32
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if len(k) != 4 || known[string(v)] {
+			return false
+		}
+		known[string(v)] = true
+		last = unserializeUID(k)
+	}
+	return uint64(last) <= b.Sequence()
+}
+
+// Sync updates the mailbox so that it contains exactly the provided messages,
+// which must be sorted from the oldest to the newest. Existing UIDs are kept:
+// messages which aren't listed anymore are removed and new messages are
+// appended. The sequence numbers of the removed messages are returned in
+// descending order, so that they can be sent as EXPUNGE responses.
+//
+// Messages appended after the first synchronization get the current time as
+// save date: they've been added to the mailbox since the last one.
+//
+// If the stored mapping is invalid, it's rebuilt from scratch and the
+// UIDVALIDITY of the mailbox is bumped. In this case, repaired is true and no
+// sequence number is returned.
+func (mbox *Mailbox) Sync(messages []*protonmail.Message) (expunged []uint32, repaired bool, err error) {
+	err = mbox.u.db.Update(func(tx *bolt.Tx) error {
 		b, err := mbox.bucket(tx)
 		if err != nil {
 			return err
 		}
 
+		listed := make(map[string]bool, len(messages))
+		for _, msg := range messages {
+			listed[msg.ID] = true
+		}
+
+		if !mappingValid(b) {
+			repaired = true
+			if b, err = mbox.reset(tx); err != nil {
+				return err
+			}
+		}
+
+		now := time.Now()
+		first := syncTime(tx, mbox.labelID).IsZero()
+		if first {
+			if err := putSyncTime(tx, mbox.labelID, now); err != nil {
+				return err
+			}
+		}
+
+		expunged = nil
+		var removed [][]byte
+		existing := make(map[string]bool)
+		c := b.Cursor()
+		var n uint32 = 1
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			existing[string(v)] = true
+			if !listed[string(v)] {
+				removed = append(removed, k)
+				expunged = append(expunged, n)
+				if err := deleteSaveDate(tx, mbox.labelID, string(v)); err != nil {
+					return err
+				}
+			}
+			n++
+		}
+		for i, j := 0, len(expunged)-1; i < j; i, j = i+1, j-1 {
+			expunged[i], expunged[j] = expunged[j], expunged[i]
+		}
+		for _, k := range removed {
+			if err := putVanished(tx, mbox.labelID, unserializeUID(k)); err != nil {
+				return err
+			}
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+
 		for _, msg := range messages {
 			if _, err := mailboxCreateMessage(b, msg.ID); err != nil {
 				return err
 			}
+			if !first && !existing[msg.ID] {
+				if err := putSaveDate(tx, mbox.labelID, msg.ID, now); err != nil {
+					return err
+				}
+			}
 		}
 
 		return userSync(tx, messages)
 	})
+	if err != nil {
+		return nil, false, err
+	}
+	return expunged, repaired, nil
 }
 
 func (mbox *Mailbox) UidNext() (uint32, error) {
@@ -161,6 +257,21 @@ func (mbox *Mailbox) FromApiID(apiID string) (seqNum uint32, uid uint32, err err
 	return
 }
 
+// Len returns the number of messages in the mailbox.
+func (mbox *Mailbox) Len() (int, error) {
+	var n int
+	err := mbox.u.db.View(func(tx *bolt.Tx) error {
+		b, err := mbox.bucket(tx)
+		if err != nil {
+			return err
+		}
+
+		n = b.Stats().KeyN
+		return nil
+	})
+	return n, err
+}
+
 func (mbox *Mailbox) ForEach(f func(seqNum, uid uint32, apiID string) error) error {
 	return mbox.u.db.View(func(tx *bolt.Tx) error {
 		b, err := mbox.bucket(tx)
@@ -181,17 +292,31 @@ func (mbox *Mailbox) ForEach(f func(seqNum, uid uint32, apiID string) error) err
 	})
 }
 
+func (mbox *Mailbox) reset(tx *bolt.Tx) (*bolt.Bucket, error) {
+	b := tx.Bucket(mailboxesBucket)
+	if b == nil {
+		return nil, errors.New("cannot find mailboxes bucket")
+	}
+	k := []byte(mbox.labelID)
+	if err := b.DeleteBucket(k); err != nil {
+		return nil, err
+	}
+	if err := resetSaveDates(tx, mbox.labelID); err != nil {
+		return nil, err
+	}
+	if err := bumpUidValidity(tx, mbox.labelID); err != nil {
+		return nil, err
+	}
+	if err := resetVanished(tx, mbox.labelID); err != nil {
+		return nil, err
+	}
+	return b.CreateBucket(k)
+}
+
+// Reset removes all messages from the mailbox and bumps its UIDVALIDITY.
 func (mbox *Mailbox) Reset() error {
 	return mbox.u.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(mailboxesBucket)
-		if b == nil {
-			return errors.New("cannot find mailboxes bucket")
-		}
-		k := []byte(mbox.labelID)
-		if err := b.DeleteBucket(k); err != nil {
-			return err
-		}
-		_, err := b.CreateBucket(k)
+		_, err := mbox.reset(tx)
 		return err
 	})
 }
@@ -0,0 +1,204 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func mailboxUIDs(t *testing.T, mbox *Mailbox) map[string]uint32 {
+	uids := make(map[string]uint32)
+	err := mbox.ForEach(func(seqNum, uid uint32, apiID string) error {
+		uids[apiID] = uid
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ForEach() = %v", err)
+	}
+	return uids
+}
+
+func TestMailboxSync(t *testing.T) {
+	u, cleanup := openTestUser(t)
+	defer cleanup()
+
+	mbox, err := u.Mailbox("label")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		setup    func(b *bolt.Bucket) error
+		ids      []string
+		expunged []uint32
+		repaired bool
+		uids     map[string]uint32
+	}{
+		{
+			name: "initial",
+			ids:  []string{"a", "b", "c", "d"},
+			uids: map[string]uint32{"a": 1, "b": 2, "c": 3, "d": 4},
+		},
+		{
+			name:     "removed and added",
+			ids:      []string{"a", "c", "e"},
+			expunged: []uint32{4, 2},
+			uids:     map[string]uint32{"a": 1, "c": 3, "e": 5},
+		},
+		{
+			name:     "emptied",
+			ids:      []string{},
+			expunged: []uint32{3, 2, 1},
+			uids:     map[string]uint32{},
+		},
+		{
+			name: "refilled",
+			ids:  []string{"f", "g"},
+			uids: map[string]uint32{"f": 6, "g": 7},
+		},
+		{
+			name:     "IDs changed",
+			ids:      []string{"h", "i"},
+			expunged: []uint32{2, 1},
+			uids:     map[string]uint32{"h": 8, "i": 9},
+		},
+		{
+			name: "duplicate message",
+			setup: func(b *bolt.Bucket) error {
+				return b.Put(serializeUID(5), []byte("h"))
+			},
+			ids:      []string{"h", "i"},
+			repaired: true,
+			uids:     map[string]uint32{"h": 1, "i": 2},
+		},
+		{
+			name: "UID above the last one assigned",
+			setup: func(b *bolt.Bucket) error {
+				return b.Put(serializeUID(42), []byte("j"))
+			},
+			ids:      []string{"h", "i", "j"},
+			repaired: true,
+			uids:     map[string]uint32{"h": 1, "i": 2, "j": 3},
+		},
+	}
+	for _, tc := range tests {
+		if tc.setup != nil {
+			err := u.db.Update(func(tx *bolt.Tx) error {
+				b, err := mbox.bucket(tx)
+				if err != nil {
+					return err
+				}
+				return tc.setup(b)
+			})
+			if err != nil {
+				t.Fatalf("%v: %v", tc.name, err)
+			}
+		}
+
+		before, err := mbox.UidValidity()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		messages := make([]*protonmail.Message, len(tc.ids))
+		for i, id := range tc.ids {
+			messages[i] = &protonmail.Message{ID: id}
+		}
+		expunged, repaired, err := mbox.Sync(messages)
+		if err != nil {
+			t.Fatalf("%v: Sync() = %v", tc.name, err)
+		}
+		if repaired != tc.repaired {
+			t.Errorf("%v: Sync() repaired = %v, want %v", tc.name, repaired, tc.repaired)
+		}
+		if !reflect.DeepEqual(expunged, tc.expunged) {
+			t.Errorf("%v: Sync() expunged = %v, want %v", tc.name, expunged, tc.expunged)
+		}
+		if got := mailboxUIDs(t, mbox); !reflect.DeepEqual(got, tc.uids) {
+			t.Errorf("%v: UIDs = %v, want %v", tc.name, got, tc.uids)
+		}
+
+		after, err := mbox.UidValidity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed := after != before; changed != tc.repaired {
+			t.Errorf("%v: UIDVALIDITY changed = %v, want %v", tc.name, changed, tc.repaired)
+		}
+	}
+}
+
+func TestMailboxSaveDates(t *testing.T) {
+	u, cleanup := openTestUser(t)
+	defer cleanup()
+
+	mbox, err := u.Mailbox("label")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		reset bool
+		ids   []string
+		// Messages with a save date
+		saved map[string]bool
+	}{
+		{
+			name:  "first sync",
+			ids:   []string{"a", "b"},
+			saved: map[string]bool{"a": false, "b": false},
+		},
+		{
+			name:  "added",
+			ids:   []string{"a", "b", "c"},
+			saved: map[string]bool{"a": false, "b": false, "c": true},
+		},
+		{
+			name:  "removed and added",
+			ids:   []string{"a", "c", "d"},
+			saved: map[string]bool{"a": false, "b": false, "c": true, "d": true},
+		},
+		{
+			name:  "reset",
+			reset: true,
+			ids:   []string{"a", "c", "d", "e"},
+			saved: map[string]bool{"a": false, "c": false, "d": false, "e": false},
+		},
+	}
+	for _, tc := range tests {
+		if tc.reset {
+			if err := mbox.Reset(); err != nil {
+				t.Fatal(err)
+			}
+			if syncTime, err := mbox.SyncTime(); err != nil || !syncTime.IsZero() {
+				t.Errorf("%v: SyncTime() = %v, %v after Reset(), want the zero time", tc.name, syncTime, err)
+			}
+		}
+
+		messages := make([]*protonmail.Message, len(tc.ids))
+		for i, id := range tc.ids {
+			messages[i] = &protonmail.Message{ID: id}
+		}
+		if _, _, err := mbox.Sync(messages); err != nil {
+			t.Fatalf("%v: Sync() = %v", tc.name, err)
+		}
+
+		if syncTime, err := mbox.SyncTime(); err != nil || syncTime.IsZero() {
+			t.Errorf("%v: SyncTime() = %v, %v", tc.name, syncTime, err)
+		}
+		for id, want := range tc.saved {
+			saveDate, err := mbox.SaveDate(id)
+			if err != nil {
+				t.Fatalf("%v: SaveDate(%q) = %v", tc.name, id, err)
+			}
+			if saved := !saveDate.IsZero(); saved != want {
+				t.Errorf("%v: SaveDate(%q) = %v, want a save date: %v", tc.name, id, saveDate, want)
+			}
+		}
+	}
+}
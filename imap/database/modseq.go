@@ -0,0 +1,161 @@
+package database
+
+import (
+	"encoding/binary"
+
+	"github.com/boltdb/bolt"
+)
+
+// modSeqBucket contains the modification sequences of messages (RFC 7162).
+// Its sequence is the highest modification sequence of the user: it's bumped
+// each time a message is changed, e.g. when an event is received from the
+// API.
+var (
+	modSeqBucket         = []byte("modseq")
+	modSeqMessagesBucket = []byte("messages")
+	// One bucket per mailbox, mapping UIDs of expunged messages to the
+	// modification sequence of the expunge
+	modSeqVanishedBucket = []byte("vanished")
+)
+
+func serializeModSeq(modSeq uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, modSeq)
+	return b
+}
+
+func modSeqBuckets(tx *bolt.Tx) (root, messages, vanished *bolt.Bucket, err error) {
+	if root, err = tx.CreateBucketIfNotExists(modSeqBucket); err != nil {
+		return nil, nil, nil, err
+	}
+	if messages, err = root.CreateBucketIfNotExists(modSeqMessagesBucket); err != nil {
+		return nil, nil, nil, err
+	}
+	if vanished, err = root.CreateBucketIfNotExists(modSeqVanishedBucket); err != nil {
+		return nil, nil, nil, err
+	}
+	return root, messages, vanished, nil
+}
+
+// touchMessage assigns a new modification sequence to a message.
+func touchMessage(tx *bolt.Tx, apiID string) error {
+	root, messages, _, err := modSeqBuckets(tx)
+	if err != nil {
+		return err
+	}
+	modSeq, err := root.NextSequence()
+	if err != nil {
+		return err
+	}
+	return messages.Put([]byte(apiID), serializeModSeq(modSeq))
+}
+
+func deleteModSeq(tx *bolt.Tx, apiID string) error {
+	_, messages, _, err := modSeqBuckets(tx)
+	if err != nil {
+		return err
+	}
+	return messages.Delete([]byte(apiID))
+}
+
+// putVanished records that a message has been expunged from a mailbox.
+func putVanished(tx *bolt.Tx, labelID string, uid uint32) error {
+	root, _, vanished, err := modSeqBuckets(tx)
+	if err != nil {
+		return err
+	}
+	b, err := vanished.CreateBucketIfNotExists([]byte(labelID))
+	if err != nil {
+		return err
+	}
+	modSeq, err := root.NextSequence()
+	if err != nil {
+		return err
+	}
+	return b.Put(serializeUID(uid), serializeModSeq(modSeq))
+}
+
+// resetVanished forgets the expunged messages of a mailbox, when its
+// UIDVALIDITY changes.
+func resetVanished(tx *bolt.Tx, labelID string) error {
+	_, _, vanished, err := modSeqBuckets(tx)
+	if err != nil {
+		return err
+	}
+	if vanished.Bucket([]byte(labelID)) == nil {
+		return nil
+	}
+	return vanished.DeleteBucket([]byte(labelID))
+}
+
+// HighestModSeq returns the highest modification sequence of the user's
+// messages. It's always at least 1.
+func (u *User) HighestModSeq() (uint64, error) {
+	modSeq := uint64(1)
+	err := u.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(modSeqBucket); b != nil && b.Sequence() > modSeq {
+			modSeq = b.Sequence()
+		}
+		return nil
+	})
+	return modSeq, err
+}
+
+// ModSeq returns the modification sequence of a message. Messages which
+// haven't changed since modification sequences are tracked have the
+// modification sequence 1.
+func (u *User) ModSeq(apiID string) (uint64, error) {
+	modSeq := uint64(1)
+	err := u.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(modSeqBucket)
+		if b == nil {
+			return nil
+		}
+		if b = b.Bucket(modSeqMessagesBucket); b == nil {
+			return nil
+		}
+		if v := b.Get([]byte(apiID)); v != nil {
+			modSeq = binary.BigEndian.Uint64(v)
+		}
+		return nil
+	})
+	return modSeq, err
+}
+
+// Vanished returns the UIDs of the messages expunged from the mailbox after
+// the modification sequence since.
+func (mbox *Mailbox) Vanished(since uint64) ([]uint32, error) {
+	var uids []uint32
+	err := mbox.u.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(modSeqBucket)
+		if b == nil {
+			return nil
+		}
+		if b = b.Bucket(modSeqVanishedBucket); b == nil {
+			return nil
+		}
+		if b = b.Bucket([]byte(mbox.labelID)); b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if binary.BigEndian.Uint64(v) > since {
+				uids = append(uids, unserializeUID(k))
+			}
+			return nil
+		})
+	})
+	return uids, err
+}
+
+// TouchMessages assigns new modification sequences to messages whose flags
+// have changed locally.
+func (u *User) TouchMessages(apiIDs []string) error {
+	return u.db.Update(func(tx *bolt.Tx) error {
+		for _, apiID := range apiIDs {
+			if err := touchMessage(tx, apiID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,123 @@
+package database
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// saveDatesBucket contains one bucket per mailbox, which maps message IDs to
+// the time they've been added to the mailbox (RFC 8514).
+var saveDatesBucket = []byte("savedates")
+
+// syncTimesBucket maps mailbox IDs to the time they've been first
+// synchronized.
+var syncTimesBucket = []byte("synctimes")
+
+func serializeTime(t time.Time) []byte {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(t.Unix()))
+	return v
+}
+
+func unserializeTime(v []byte) time.Time {
+	return time.Unix(int64(binary.BigEndian.Uint64(v)), 0)
+}
+
+// syncTime returns the time a mailbox has been first synchronized, or the
+// zero time if it hasn't been synchronized yet.
+func syncTime(tx *bolt.Tx, labelID string) time.Time {
+	if b := tx.Bucket(syncTimesBucket); b != nil {
+		if v := b.Get([]byte(labelID)); v != nil {
+			return unserializeTime(v)
+		}
+	}
+	return time.Time{}
+}
+
+func putSyncTime(tx *bolt.Tx, labelID string, t time.Time) error {
+	b, err := tx.CreateBucketIfNotExists(syncTimesBucket)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(labelID), serializeTime(t))
+}
+
+func putSaveDate(tx *bolt.Tx, labelID, apiID string, t time.Time) error {
+	dates, err := tx.CreateBucketIfNotExists(saveDatesBucket)
+	if err != nil {
+		return err
+	}
+	b, err := dates.CreateBucketIfNotExists([]byte(labelID))
+	if err != nil {
+		return err
+	}
+
+	k := []byte(apiID)
+	if b.Get(k) != nil {
+		return nil
+	}
+
+	return b.Put(k, serializeTime(t))
+}
+
+func deleteSaveDate(tx *bolt.Tx, labelID, apiID string) error {
+	dates := tx.Bucket(saveDatesBucket)
+	if dates == nil {
+		return nil
+	}
+	b := dates.Bucket([]byte(labelID))
+	if b == nil {
+		return nil
+	}
+	return b.Delete([]byte(apiID))
+}
+
+func resetSaveDates(tx *bolt.Tx, labelID string) error {
+	if b := tx.Bucket(syncTimesBucket); b != nil {
+		if err := b.Delete([]byte(labelID)); err != nil {
+			return err
+		}
+	}
+
+	dates := tx.Bucket(saveDatesBucket)
+	if dates == nil || dates.Bucket([]byte(labelID)) == nil {
+		return nil
+	}
+	return dates.DeleteBucket([]byte(labelID))
+}
+
+// SaveDate returns the time at which a message has been added to the mailbox.
+// If the message was already in the mailbox when the mailbox was first
+// synchronized, the zero time is returned.
+func (mbox *Mailbox) SaveDate(apiID string) (time.Time, error) {
+	var t time.Time
+	err := mbox.u.db.View(func(tx *bolt.Tx) error {
+		dates := tx.Bucket(saveDatesBucket)
+		if dates == nil {
+			return nil
+		}
+		b := dates.Bucket([]byte(mbox.labelID))
+		if b == nil {
+			return nil
+		}
+		if v := b.Get([]byte(apiID)); v != nil {
+			t = unserializeTime(v)
+		}
+		return nil
+	})
+	return t, err
+}
+
+// SyncTime returns the time at which the mailbox has been first synchronized,
+// or the zero time if it hasn't been synchronized yet. Messages without a save
+// date have been in the mailbox at least since then.
+func (mbox *Mailbox) SyncTime() (time.Time, error) {
+	var t time.Time
+	err := mbox.u.db.View(func(tx *bolt.Tx) error {
+		t = syncTime(tx, mbox.labelID)
+		return nil
+	})
+	return t, err
+}
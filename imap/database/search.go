@@ -0,0 +1,204 @@
+package database
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/openpgp"
+)
+
+var (
+	searchBucket        = []byte("search")
+	searchTokensBucket  = []byte("tokens")
+	searchIndexedBucket = []byte("indexed")
+)
+
+// SearchIndex is an encrypted full-text index of message bodies.
+//
+// Like the web client's encrypted search, the index never contains plaintext:
+// tokens are keyed with a random index key, which is itself stored encrypted
+// with the user's private keys.
+type SearchIndex struct {
+	u   *User
+	key []byte
+}
+
+func searchBuckets(tx *bolt.Tx) (tokens, indexed *bolt.Bucket, err error) {
+	b := tx.Bucket(searchBucket)
+	if b == nil {
+		return nil, nil, errors.New("cannot find search bucket")
+	}
+	return b.Bucket(searchTokensBucket), b.Bucket(searchIndexedBucket), nil
+}
+
+// SearchIndex opens the user's search index, generating a new index key if
+// necessary.
+//
+// If one of the user's keys has been removed since the index has been created,
+// the index is cleared and a new index key is generated: tokens can't be
+// re-keyed, and the removed key must not be able to decrypt the index
+// anymore. The index is rebuilt when mailboxes are indexed again. Added keys
+// don't clear the index.
+func (u *User) SearchIndex(keyRing openpgp.EntityList) (*SearchIndex, error) {
+	var key []byte
+	err := u.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(searchBucket)
+		if err != nil {
+			return err
+		}
+
+		var created bool
+		key, created, err = loadKey(b, keyRing)
+		if err != nil {
+			return err
+		}
+		if created {
+			for _, k := range [][]byte{searchTokensBucket, searchIndexedBucket} {
+				if b.Bucket(k) != nil {
+					if err := b.DeleteBucket(k); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		if _, err := b.CreateBucketIfNotExists(searchTokensBucket); err != nil {
+			return err
+		}
+		_, err = b.CreateBucketIfNotExists(searchIndexedBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &SearchIndex{u, key}, nil
+}
+
+func (idx *SearchIndex) tokenKey(token string) []byte {
+	mac := hmac.New(sha256.New, idx.key)
+	mac.Write([]byte(token))
+	return mac.Sum(nil)
+}
+
+// IsIndexed checks whether a message has already been indexed.
+func (idx *SearchIndex) IsIndexed(apiID string) (bool, error) {
+	var ok bool
+	err := idx.u.db.View(func(tx *bolt.Tx) error {
+		_, indexed, err := searchBuckets(tx)
+		if err != nil {
+			return err
+		}
+		ok = indexed.Get([]byte(apiID)) != nil
+		return nil
+	})
+	return ok, err
+}
+
+// HasToken checks whether a token appears in at least one indexed message.
+func (idx *SearchIndex) HasToken(token string) (bool, error) {
+	var ok bool
+	err := idx.u.db.View(func(tx *bolt.Tx) error {
+		tokensBucket, _, err := searchBuckets(tx)
+		if err != nil {
+			return err
+		}
+		if b := tokensBucket.Bucket(idx.tokenKey(token)); b != nil {
+			k, _ := b.Cursor().First()
+			ok = k != nil
+		}
+		return nil
+	})
+	return ok, err
+}
+
+// Index adds a message's tokens to the index.
+func (idx *SearchIndex) Index(apiID string, tokens []string) error {
+	return idx.u.db.Update(func(tx *bolt.Tx) error {
+		tokensBucket, indexed, err := searchBuckets(tx)
+		if err != nil {
+			return err
+		}
+
+		k := []byte(apiID)
+		var keys []byte
+		for _, token := range tokens {
+			tk := idx.tokenKey(token)
+			b, err := tokensBucket.CreateBucketIfNotExists(tk)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(k, nil); err != nil {
+				return err
+			}
+			keys = append(keys, tk...)
+		}
+
+		// Keep track of the message's tokens to be able to remove it later
+		if keys == nil {
+			keys = []byte{}
+		}
+		return indexed.Put(k, keys)
+	})
+}
+
+// Remove removes a message from the index.
+func (idx *SearchIndex) Remove(apiID string) error {
+	return idx.u.db.Update(func(tx *bolt.Tx) error {
+		tokensBucket, indexed, err := searchBuckets(tx)
+		if err != nil {
+			return err
+		}
+
+		k := []byte(apiID)
+		keys := indexed.Get(k)
+		if keys == nil {
+			return nil
+		}
+		for i := 0; i+sha256.Size <= len(keys); i += sha256.Size {
+			if b := tokensBucket.Bucket(keys[i : i+sha256.Size]); b != nil {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		return indexed.Delete(k)
+	})
+}
+
+// Search returns the set of message IDs containing all tokens.
+func (idx *SearchIndex) Search(tokens []string) (map[string]struct{}, error) {
+	var results map[string]struct{}
+	err := idx.u.db.View(func(tx *bolt.Tx) error {
+		tokensBucket, _, err := searchBuckets(tx)
+		if err != nil {
+			return err
+		}
+
+		results = make(map[string]struct{})
+		for i, token := range tokens {
+			b := tokensBucket.Bucket(idx.tokenKey(token))
+			if b == nil {
+				results = make(map[string]struct{})
+				return nil
+			}
+
+			matches := make(map[string]struct{})
+			err := b.ForEach(func(k, v []byte) error {
+				apiID := string(k)
+				if _, ok := results[apiID]; ok || i == 0 {
+					matches[apiID] = struct{}{}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			results = matches
+		}
+		return nil
+	})
+	return results, err
+}
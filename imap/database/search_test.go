@@ -0,0 +1,134 @@
+package database
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/emersion/hydroxide/config"
+)
+
+func openTestUser(t *testing.T) (u *User, cleanup func()) {
+	dir, err := ioutil.TempDir("", "hydroxide-database-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.SetDir(dir)
+	u, err = Open("test.db")
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return u, func() {
+		u.Close()
+		config.SetDir("")
+		os.RemoveAll(dir)
+	}
+}
+
+func newTestKeyRing(t *testing.T) openpgp.EntityList {
+	e, err := openpgp.NewEntity("Test", "", "test@example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return openpgp.EntityList{e}
+}
+
+func searchIDs(t *testing.T, idx *SearchIndex, tokens []string) []string {
+	results, err := idx.Search(tokens)
+	if err != nil {
+		t.Fatalf("Search(%q) = %v", tokens, err)
+	}
+	ids := []string{}
+	for id := range results {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestSearchIndex(t *testing.T) {
+	u, cleanup := openTestUser(t)
+	defer cleanup()
+
+	keyRing := newTestKeyRing(t)
+	idx, err := u.SearchIndex(keyRing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := map[string][]string{
+		"a": {"hello", "world"},
+		"b": {"hello", "there"},
+		"c": {},
+	}
+	for id, tokens := range messages {
+		if err := idx.Index(id, tokens); err != nil {
+			t.Fatalf("Index(%q) = %v", id, err)
+		}
+	}
+
+	tests := []struct {
+		tokens []string
+		want   []string
+	}{
+		{[]string{"hello"}, []string{"a", "b"}},
+		{[]string{"hello", "world"}, []string{"a"}},
+		{[]string{"world", "there"}, []string{}},
+		{[]string{"unknown"}, []string{}},
+		{[]string{"hello", "unknown"}, []string{}},
+		{[]string{"hell"}, []string{}},
+	}
+	for _, tc := range tests {
+		if got := searchIDs(t, idx, tc.tokens); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Search(%q) = %v, want %v", tc.tokens, got, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		token string
+		want  bool
+	}{
+		{"hello", true},
+		{"there", true},
+		{"hell", false},
+		{"unknown", false},
+	} {
+		if ok, err := idx.HasToken(tc.token); err != nil || ok != tc.want {
+			t.Errorf("HasToken(%q) = %v, %v, want %v", tc.token, ok, err, tc.want)
+		}
+	}
+
+	for id := range messages {
+		if ok, err := idx.IsIndexed(id); err != nil || !ok {
+			t.Errorf("IsIndexed(%q) = %v, %v, want true", id, ok, err)
+		}
+	}
+
+	if err := idx.Remove("a"); err != nil {
+		t.Fatalf("Remove() = %v", err)
+	}
+	if ok, _ := idx.IsIndexed("a"); ok {
+		t.Errorf("message is still indexed after Remove")
+	}
+	if got, want := searchIDs(t, idx, []string{"hello"}), []string{"b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Search() after Remove = %v, want %v", got, want)
+	}
+	// Tokens of removed messages aren't known anymore
+	if ok, err := idx.HasToken("world"); err != nil || ok {
+		t.Errorf("HasToken() after Remove = %v, %v, want false", ok, err)
+	}
+
+	// Opening the index again with the same keys keeps its contents
+	idx, err = u.SearchIndex(keyRing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := searchIDs(t, idx, []string{"hello"}), []string{"b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Search() after re-opening = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,55 @@
+package database
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// uidValidityBucket maps label IDs to the UIDVALIDITY of their mailbox.
+var uidValidityBucket = []byte("uidvalidity")
+
+func getUidValidity(tx *bolt.Tx, labelID string) (uint32, error) {
+	b, err := tx.CreateBucketIfNotExists(uidValidityBucket)
+	if err != nil {
+		return 0, err
+	}
+
+	k := []byte(labelID)
+	if v := b.Get(k); v != nil {
+		return binary.BigEndian.Uint32(v), nil
+	}
+
+	uidValidity := uint32(time.Now().Unix())
+	return uidValidity, b.Put(k, serializeUID(uidValidity))
+}
+
+// bumpUidValidity changes the UIDVALIDITY of a mailbox. This must be done
+// each time UIDs are re-assigned.
+func bumpUidValidity(tx *bolt.Tx, labelID string) error {
+	b, err := tx.CreateBucketIfNotExists(uidValidityBucket)
+	if err != nil {
+		return err
+	}
+
+	k := []byte(labelID)
+	uidValidity := uint32(time.Now().Unix())
+	if v := b.Get(k); v != nil {
+		if prev := binary.BigEndian.Uint32(v); prev >= uidValidity {
+			uidValidity = prev + 1
+		}
+	}
+	return b.Put(k, serializeUID(uidValidity))
+}
+
+// UidValidity returns the UIDVALIDITY of the mailbox.
+func (mbox *Mailbox) UidValidity() (uint32, error) {
+	var uidValidity uint32
+	err := mbox.u.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		uidValidity, err = getUidValidity(tx, mbox.labelID)
+		return err
+	})
+	return uidValidity, err
+}
@@ -1,8 +1,11 @@
 package database
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"io"
+	"time"
 
 	"github.com/boltdb/bolt"
 
@@ -45,7 +48,19 @@ func userSync(tx *bolt.Tx, messages []*protonmail.Message) error {
 	}
 
 	for _, msg := range messages {
-		if err := userCreateMessage(b, msg); err != nil {
+		v, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		k := []byte(msg.ID)
+		if old := b.Get(k); old != nil && bytes.Equal(old, v) {
+			continue
+		}
+		// The message has changed while we weren't listening for events
+		if err := touchMessage(tx, msg.ID); err != nil {
+			return err
+		}
+		if err := b.Put(k, v); err != nil {
 			return err
 		}
 	}
@@ -105,6 +120,9 @@ func (u *User) CreateMessage(msg *protonmail.Message) (seqNums map[string]uint32
 		if err := userCreateMessage(messages, msg); err != nil {
 			return err
 		}
+		if err := touchMessage(tx, msg.ID); err != nil {
+			return err
+		}
 
 		mailboxes, err := tx.CreateBucketIfNotExists(mailboxesBucket)
 		if err != nil {
@@ -120,6 +138,9 @@ func (u *User) CreateMessage(msg *protonmail.Message) (seqNums map[string]uint32
 			if err != nil {
 				return err
 			}
+			if err := putSaveDate(tx, labelID, msg.ID, time.Now()); err != nil {
+				return err
+			}
 			seqNums[labelID] = seqNum
 		}
 
@@ -158,6 +179,9 @@ func (u *User) UpdateMessage(apiID string, update *protonmail.EventMessageUpdate
 			if err != nil {
 				return err
 			}
+			if err := putSaveDate(tx, labelID, apiID, time.Now()); err != nil {
+				return err
+			}
 			createdSeqNums[labelID] = seqNum
 		}
 		for _, labelID := range removedLabels {
@@ -166,14 +190,20 @@ func (u *User) UpdateMessage(apiID string, update *protonmail.EventMessageUpdate
 				continue
 			}
 
-			seqNum, err := mailboxDeleteMessage(mbox, apiID)
+			seqNum, err := mailboxDeleteMessage(mbox, labelID, apiID)
 			if err != nil {
 				return err
 			}
+			if err := deleteSaveDate(tx, labelID, apiID); err != nil {
+				return err
+			}
 			deletedSeqNums[labelID] = seqNum
 		}
 
 		update.Patch(msg)
+		if err := touchMessage(tx, apiID); err != nil {
+			return err
+		}
 		return userCreateMessage(messages, msg)
 	})
 	return
@@ -197,6 +227,9 @@ func (u *User) DeleteMessage(apiID string) (seqNums map[string]uint32, err error
 		if err := messages.Delete([]byte(apiID)); err != nil {
 			return err
 		}
+		if err := deleteModSeq(tx, apiID); err != nil {
+			return err
+		}
 
 		mailboxes := tx.Bucket(mailboxesBucket)
 		if mailboxes == nil {
@@ -208,10 +241,13 @@ func (u *User) DeleteMessage(apiID string) (seqNums map[string]uint32, err error
 				continue
 			}
 
-			seqNum, err := mailboxDeleteMessage(mbox, msg.ID)
+			seqNum, err := mailboxDeleteMessage(mbox, labelID, msg.ID)
 			if err != nil {
 				return err
 			}
+			if err := deleteSaveDate(tx, labelID, msg.ID); err != nil {
+				return err
+			}
 			seqNums[labelID] = seqNum
 		}
 
@@ -220,17 +256,46 @@ func (u *User) DeleteMessage(apiID string) (seqNums map[string]uint32, err error
 	return
 }
 
+// WriteTo writes a consistent copy of the database to w.
+func (u *User) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	err := u.db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
 func (u *User) Close() error {
 	return u.db.Close()
 }
 
 func Open(filename string) (*User, error) {
+	return open(filename, nil)
+}
+
+// ErrLocked is returned by OpenTimeout if the database is used by another
+// process, e.g. a running IMAP server.
+var ErrLocked = errors.New("local database is in use by another process")
+
+// OpenTimeout is like Open, but fails with ErrLocked if the database can't be
+// opened before timeout.
+func OpenTimeout(filename string, timeout time.Duration) (*User, error) {
+	u, err := open(filename, &bolt.Options{Timeout: timeout})
+	if err == bolt.ErrTimeout {
+		return nil, ErrLocked
+	}
+	return u, err
+}
+
+func open(filename string, options *bolt.Options) (*User, error) {
 	p, err := config.Path(filename)
 	if err != nil {
 		return nil, err
 	}
 
-	db, err := bolt.Open(p, 0700, nil)
+	db, err := bolt.Open(p, 0700, options)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,211 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-message/textproto"
+
+	"github.com/emersion/hydroxide/imap/database"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// draftVersionHeader is set on drafts listed over IMAP. Clients preserving it
+// when saving a new version of a draft allow concurrent edits to be detected
+// reliably.
+const draftVersionHeader = "X-Hydroxide-Draft-Version"
+
+// findDraft returns the ID of the draft with the provided Message-Id, or an
+// empty string if there's none.
+func (mbox *mailbox) findDraft(id string) (string, error) {
+	if id == "" {
+		return "", nil
+	}
+
+	// Drafts previously saved over IMAP
+	apiID, _, err := mbox.u.db.Draft(id)
+	if err == nil {
+		if _, _, err := mbox.db.FromApiID(apiID); err == nil {
+			return apiID, nil
+		} else if err != database.ErrNotFound {
+			return "", err
+		}
+	} else if err != database.ErrNotFound {
+		return "", err
+	}
+
+	// Drafts listed over IMAP
+	var found string
+	err = mbox.db.ForEach(func(seqNum, uid uint32, apiID string) error {
+		msg, err := mbox.u.db.Message(apiID)
+		if err != nil {
+			return err
+		}
+		if messageID(msg) == id {
+			found = apiID
+		}
+		return nil
+	})
+	return found, err
+}
+
+// isDraftConflict checks whether current has been edited elsewhere since the
+// client has read the version of the draft it's replacing. base is the
+// version in the client's message, if any.
+func (mbox *mailbox) isDraftConflict(current *protonmail.Message, base string) (bool, error) {
+	saved, err := mbox.u.db.DraftVersion(current.ID)
+	if err != nil {
+		return false, err
+	}
+	if current.Time == saved {
+		// The last version has been saved over IMAP
+		return false, nil
+	}
+
+	if v, err := strconv.ParseInt(strings.TrimSpace(base), 10, 64); err == nil {
+		return protonmail.Timestamp(v) != current.Time, nil
+	}
+
+	// Without the version header field, we can only detect edits which
+	// haven't been listed over IMAP yet
+	known, err := mbox.u.db.Message(current.ID)
+	if err != nil {
+		return false, err
+	}
+	return known.Time != current.Time, nil
+}
+
+// renumber assigns a new UID to a draft whose content has changed, so that
+// clients don't keep a cached version.
+func (mbox *mailbox) renumber(apiID string) ([]imapbackend.Update, error) {
+	oldSeqNum, n, err := mbox.db.Renumber(apiID)
+	if err != nil {
+		return nil, err
+	}
+
+	mbox.Lock()
+	delete(mbox.deleted, apiID)
+	mbox.Unlock()
+
+	expunge := new(imapbackend.ExpungeUpdate)
+	expunge.Update = imapbackend.NewUpdate(mbox.u.u.Name, mbox.name)
+	expunge.SeqNum = oldSeqNum
+
+	status := new(imapbackend.MailboxUpdate)
+	status.Update = imapbackend.NewUpdate(mbox.u.u.Name, mbox.name)
+	status.MailboxStatus = imap.NewMailboxStatus(mbox.name, []imap.StatusItem{imap.StatusMessages})
+	status.MailboxStatus.Messages = n
+
+	return []imapbackend.Update{expunge, status}, nil
+}
+
+// saveDraft saves a message appended to the Drafts mailbox. If it's a new
+// version of an existing draft, the draft is updated. If the draft has been
+// edited elsewhere in the meantime, a copy is created instead. The API ID of
+// the saved draft is returned.
+func (mbox *mailbox) saveDraft(ctx context.Context, r io.Reader) (string, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+
+	h, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		return "", fmt.Errorf("cannot parse message: %v", err)
+	}
+	id := strings.TrimSpace(h.Get("Message-Id"))
+	id = strings.TrimSuffix(strings.TrimPrefix(id, "<"), ">")
+
+	apiID, err := mbox.findDraft(id)
+	if err != nil {
+		return "", err
+	}
+
+	var existing *protonmail.Message
+	if apiID != "" {
+		current, err := mbox.u.c.GetMessage(ctx, apiID)
+		if err != nil {
+			return "", err
+		}
+
+		conflict, err := mbox.isDraftConflict(current, h.Get(draftVersionHeader))
+		if err != nil {
+			return "", err
+		}
+		if conflict {
+			mbox.u.logger.Info("draft has been edited concurrently, saving a copy", "message", apiID)
+		} else {
+			existing = current
+		}
+	}
+
+	msg, err := createMessage(ctx, mbox.u.c, mbox.u.u, mbox.u.privateKeys, mbox.u.addrs, bytes.NewReader(b), existing)
+	if err != nil {
+		return "", err
+	}
+	if err := mbox.u.db.PutDraft(id, msg); err != nil {
+		return "", err
+	}
+	if existing != nil {
+		if err := mbox.u.messageCache.Remove(existing.ID); err != nil {
+			return "", err
+		}
+	}
+
+	if apiID != "" {
+		// The version the client replaces is obsolete: either it's been
+		// updated, or it's the concurrent version
+		updates, err := mbox.renumber(apiID)
+		if err != nil {
+			return "", err
+		}
+		mbox.u.notify(updates)
+	}
+
+	return msg.ID, mbox.Poll()
+}
+
+// draftEdited handles an update event for a message which was a draft in
+// before. If the draft has been edited elsewhere, its metadata is refreshed
+// and it's renumbered.
+func (u *user) draftEdited(ctx context.Context, before *protonmail.Message, update *protonmail.EventMessageUpdate) ([]imapbackend.Update, error) {
+	if before.Type != protonmail.MessageDraft || update.Time == 0 || update.Time == before.Time {
+		return nil, nil
+	}
+
+	msg, err := u.c.GetMessage(ctx, before.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := u.db.ReplaceMessage(msg); err != nil {
+		return nil, err
+	}
+
+	saved, err := u.db.DraftVersion(before.ID)
+	if err != nil {
+		return nil, err
+	}
+	if update.Time == saved {
+		// Saved over IMAP, already renumbered
+		return nil, nil
+	}
+
+	mbox := u.getMailboxByLabel(protonmail.LabelDraft)
+	if mbox == nil {
+		return nil, nil
+	}
+	if _, _, err := mbox.db.FromApiID(before.ID); err == database.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return mbox.renumber(before.ID)
+}
@@ -0,0 +1,135 @@
+package imap
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/server"
+)
+
+const enableCapability = "ENABLE"
+
+// enableableCaps lists the capabilities which need to be turned on by the
+// client with ENABLE (RFC 5161) before the server may use them.
+var enableableCaps = map[string]bool{
+	condStoreCapability: true,
+}
+
+// EnableConn is a connection keeping track of the capabilities enabled by the
+// client.
+type EnableConn interface {
+	server.Conn
+
+	// Enabled returns true if the client has enabled the capability.
+	Enabled(capability string) bool
+}
+
+type enableConn struct {
+	server.Conn
+
+	locker  sync.Mutex
+	enabled map[string]bool
+}
+
+func (c *enableConn) Enabled(capability string) bool {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	return c.enabled[strings.ToUpper(capability)]
+}
+
+// enable marks the capabilities as enabled and returns the ones which weren't
+// enabled yet.
+func (c *enableConn) enable(caps []string) []string {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	var enabled []string
+	for _, capability := range caps {
+		if !c.enabled[capability] {
+			c.enabled[capability] = true
+			enabled = append(enabled, capability)
+		}
+	}
+	return enabled
+}
+
+type enableHandler struct {
+	caps []string
+}
+
+func (h *enableHandler) Parse(fields []interface{}) error {
+	if len(fields) == 0 {
+		return errors.New("No enough arguments")
+	}
+
+	h.caps = make([]string, 0, len(fields))
+	for _, f := range fields {
+		capability, ok := f.(string)
+		if !ok {
+			return errors.New("Capability must be an atom")
+		}
+		h.caps = append(h.caps, strings.ToUpper(capability))
+	}
+	return nil
+}
+
+func (h *enableHandler) Handle(conn server.Conn) error {
+	if conn.Context().State != imap.AuthenticatedState {
+		return errors.New("ENABLE is only allowed in the authenticated state")
+	}
+
+	ec, ok := conn.(*enableConn)
+	if !ok {
+		return errors.New("ENABLE extension not supported")
+	}
+
+	advertised := make(map[string]bool)
+	for _, capability := range conn.Capabilities() {
+		advertised[strings.ToUpper(capability)] = true
+	}
+
+	// Unknown capabilities are silently ignored
+	var supported []string
+	for _, capability := range h.caps {
+		if enableableCaps[capability] && advertised[capability] {
+			supported = append(supported, capability)
+		}
+	}
+
+	fields := []interface{}{imap.RawString("ENABLED")}
+	for _, capability := range ec.enable(supported) {
+		fields = append(fields, imap.RawString(capability))
+	}
+	return conn.WriteResp(&imap.DataResp{Fields: fields})
+}
+
+type enableExtension struct{}
+
+// NewEnableExtension returns an extension implementing ENABLE. The capability
+// is only advertised once the client is authenticated.
+func NewEnableExtension() server.ConnExtension {
+	return &enableExtension{}
+}
+
+func (ext *enableExtension) Capabilities(c server.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{enableCapability}
+	}
+	return nil
+}
+
+func (ext *enableExtension) Command(name string) server.HandlerFactory {
+	if name != enableCapability {
+		return nil
+	}
+
+	return func() server.Handler {
+		return &enableHandler{}
+	}
+}
+
+func (ext *enableExtension) NewConn(c server.Conn) server.Conn {
+	return &enableConn{Conn: c, enabled: make(map[string]bool)}
+}
@@ -0,0 +1,99 @@
+package imap
+
+import (
+	"github.com/emersion/go-imap"
+
+	"github.com/emersion/hydroxide/imap/database"
+)
+
+// defaultFetchWorkers is the default number of messages downloaded and
+// decrypted concurrently by a FETCH command.
+const defaultFetchWorkers = 4
+
+// fetchNeedsBody checks whether fetching items requires downloading message
+// bodies. Other items are read from the local database.
+func fetchNeedsBody(items []imap.FetchItem) bool {
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope, imap.FetchFlags, imap.FetchInternalDate, imap.FetchRFC822Size, imap.FetchUid, fetchSaveDate, fetchModSeq:
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// fetchWorkers returns the number of messages fetched concurrently for items.
+func (be *backend) fetchWorkers(items []imap.FetchItem) int {
+	if !fetchNeedsBody(items) {
+		return 1
+	}
+	if be.options.FetchWorkers > 0 {
+		return be.options.FetchWorkers
+	}
+	return defaultFetchWorkers
+}
+
+// fetchRange is an inclusive range of sequence numbers or UIDs.
+type fetchRange struct {
+	start, stop uint32
+}
+
+type fetchResult struct {
+	msg *imap.Message
+	err error
+}
+
+// pipelineFetch fetches the messages of ranges with up to workers concurrent
+// calls to fetch, and sends them to ch in order. Messages which don't exist
+// are skipped.
+//
+// Fetching a message is mostly waiting for the API and decrypting, so
+// upcoming messages are fetched while the previous ones are written to the
+// client.
+func pipelineFetch(ranges []fetchRange, workers int, fetch func(id uint32) (*imap.Message, error), ch chan<- *imap.Message) error {
+	pending := make(chan chan fetchResult, workers)
+	sem := make(chan struct{}, workers)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		defer close(pending)
+		for _, r := range ranges {
+			// id wraps around if stop is the maximum UID
+			for id := r.start; id >= r.start && id <= r.stop; id++ {
+				select {
+				case sem <- struct{}{}:
+				case <-done:
+					return
+				}
+
+				res := make(chan fetchResult, 1)
+				go func(id uint32) {
+					msg, err := fetch(id)
+					<-sem
+					res <- fetchResult{msg, err}
+				}(id)
+
+				select {
+				case pending <- res:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+
+	for res := range pending {
+		r := <-res
+		if r.err == database.ErrNotFound {
+			continue
+		} else if r.err != nil {
+			return r.err
+		}
+		if r.msg != nil {
+			ch <- r.msg
+		}
+	}
+	return nil
+}
@@ -0,0 +1,392 @@
+package imap
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// Folders are exclusive labels, they're exposed as mailboxes. Nested folders
+// are listed under their parent, e.g. "Work/Projects". Other labels are
+// exposed both as flags and as mailboxes under labelsMailbox, e.g.
+// "Labels/Important": a message can be in several label mailboxes at once.
+
+// labelsMailbox is the parent of label mailboxes. It's reserved, folders can't
+// be named after it.
+const labelsMailbox = "Labels"
+
+// Mailbox attributes defined in RFC 3348
+const (
+	hasChildrenAttr   = "\\HasChildren"
+	hasNoChildrenAttr = "\\HasNoChildren"
+)
+
+// defaultFolderColor is the color of folders created from IMAP clients.
+const defaultFolderColor = "#8080FF"
+
+var (
+	errMailboxExists  = errors.New("mailbox already exists")
+	errInvalidMailbox = errors.New("invalid mailbox name")
+	errSystemMailbox  = errors.New("system mailboxes can't be renamed, deleted or contain other mailboxes")
+	errLabelsMailbox  = errors.New(labelsMailbox + " only contains labels, which can't be nested or turned into folders")
+)
+
+func isSystemLabel(labelID string) bool {
+	for _, data := range systemMailboxes {
+		if data.label == labelID {
+			return true
+		}
+	}
+	for _, data := range systemFlags {
+		if data.label == labelID {
+			return true
+		}
+	}
+	return false
+}
+
+// folderName returns the mailbox name of a folder: the names of its parents
+// and its own, separated by the delimiter.
+func folderName(labels map[string]*protonmail.Label, folder *protonmail.Label) string {
+	name := folder.Name
+	seen := map[string]bool{folder.ID: true}
+	for parent := labels[folder.ParentID]; parent != nil && !seen[parent.ID]; parent = labels[parent.ParentID] {
+		seen[parent.ID] = true
+		name = parent.Name + delimiter + name
+	}
+	return name
+}
+
+// labelName returns the name of the label backing a mailbox under
+// labelsMailbox. ok is false if the mailbox isn't under it.
+func labelName(name string) (label string, ok bool) {
+	if !strings.HasPrefix(name, labelsMailbox+delimiter) {
+		return "", false
+	}
+	return strings.TrimPrefix(name, labelsMailbox+delimiter), true
+}
+
+// mailboxName returns the mailbox name of a folder or a label.
+func mailboxName(labels map[string]*protonmail.Label, label *protonmail.Label) string {
+	if label.Exclusive != 1 {
+		return labelsMailbox + delimiter + label.Name
+	}
+	return folderName(labels, label)
+}
+
+// renamed returns a copy of the mailbox with a new name. Its state is kept, so
+// that it doesn't need to be synchronized again.
+func (mbox *mailbox) renamed(name string) *mailbox {
+	mbox.Lock()
+	defer mbox.Unlock()
+
+	deleted := make(map[string]struct{}, len(mbox.deleted))
+	for apiID := range mbox.deleted {
+		deleted[apiID] = struct{}{}
+	}
+
+	return &mailbox{
+		name:        name,
+		label:       mbox.label,
+		attrs:       mbox.attrs,
+		u:           mbox.u,
+		db:          mbox.db,
+		initialized: mbox.initialized,
+		total:       mbox.total,
+		unread:      mbox.unread,
+		deleted:     deleted,
+	}
+}
+
+// setLabels replaces the user's folders and labels, and updates the mailboxes
+// and flags backed by them. u must be locked.
+func (u *user) setLabels(labels []*protonmail.Label) error {
+	byID := make(map[string]*protonmail.Label, len(labels))
+	for _, label := range labels {
+		if !isSystemLabel(label.ID) {
+			byID[label.ID] = label
+		}
+	}
+
+	for id := range u.labels {
+		if _, ok := byID[id]; !ok {
+			delete(u.mailboxes, id)
+			delete(u.flags, id)
+		}
+	}
+	u.labels = byID
+
+	for id, label := range byID {
+		if label.Exclusive != 1 {
+			u.flags[id] = labelNameToFlag(label.Name)
+		} else {
+			delete(u.flags, id)
+		}
+
+		name := mailboxName(byID, label)
+		if mbox, ok := u.mailboxes[id]; ok {
+			if mbox.name != name {
+				u.mailboxes[id] = mbox.renamed(name)
+			}
+			continue
+		}
+
+		mbox, err := newMailbox(name, id, nil, u)
+		if err != nil {
+			return err
+		}
+		u.mailboxes[id] = mbox
+	}
+
+	return nil
+}
+
+// refreshLabels fetches the user's folders and labels, e.g. after they've been
+// changed in the official apps.
+func (u *user) refreshLabels(ctx context.Context) error {
+	labels, err := u.c.ListLabels(ctx)
+	if err != nil {
+		return err
+	}
+
+	u.Lock()
+	defer u.Unlock()
+	return u.setLabels(labels)
+}
+
+// putLabel adds or replaces a folder or label.
+func (u *user) putLabel(label *protonmail.Label) error {
+	u.Lock()
+	defer u.Unlock()
+
+	labels := make([]*protonmail.Label, 0, len(u.labels)+1)
+	for id, l := range u.labels {
+		if id != label.ID {
+			labels = append(labels, l)
+		}
+	}
+	return u.setLabels(append(labels, label))
+}
+
+// removeLabel removes a folder or label.
+func (u *user) removeLabel(id string) error {
+	u.Lock()
+	defer u.Unlock()
+
+	labels := make([]*protonmail.Label, 0, len(u.labels))
+	for labelID, l := range u.labels {
+		if labelID != id {
+			labels = append(labels, l)
+		}
+	}
+	return u.setLabels(labels)
+}
+
+// label returns the folder or the label backing a mailbox, or nil if it's a
+// system mailbox.
+func (u *user) label(mbox *mailbox) *protonmail.Label {
+	u.Lock()
+	defer u.Unlock()
+	return u.labels[mbox.label]
+}
+
+// folder returns the folder backing a mailbox, or nil if it's a system
+// mailbox or a label mailbox.
+func (u *user) folder(mbox *mailbox) *protonmail.Label {
+	if label := u.label(mbox); label != nil && label.Exclusive == 1 {
+		return label
+	}
+	return nil
+}
+
+// isLabel checks whether a mailbox is backed by a label rather than a folder.
+func (mbox *mailbox) isLabel() bool {
+	label := mbox.u.label(mbox)
+	return label != nil && label.Exclusive != 1
+}
+
+func (u *user) hasSubfolders(id string) bool {
+	u.Lock()
+	defer u.Unlock()
+
+	for _, label := range u.labels {
+		if label.ParentID == id && label.Exclusive == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// folderAttrs returns the hierarchy attributes of a mailbox.
+func (mbox *mailbox) folderAttrs() []string {
+	if mbox.u.folder(mbox) == nil {
+		return []string{imap.NoInferiorsAttr}
+	}
+	if mbox.u.hasSubfolders(mbox.label) {
+		return []string{hasChildrenAttr}
+	}
+	return []string{hasNoChildrenAttr}
+}
+
+// createFolder creates the folder name, and its parents if they don't exist
+// yet. The ID of the folder is returned.
+func (u *user) createFolder(ctx context.Context, name string) (string, error) {
+	parts := strings.Split(name, delimiter)
+	if parts[0] == labelsMailbox {
+		return "", errLabelsMailbox
+	}
+	var parentID string
+	for i, part := range parts {
+		if part == "" {
+			return "", errInvalidMailbox
+		}
+
+		if mbox := u.getMailbox(strings.Join(parts[:i+1], delimiter)); mbox != nil {
+			if u.folder(mbox) == nil {
+				return "", errSystemMailbox
+			}
+			parentID = mbox.label
+			continue
+		}
+
+		label, err := u.c.CreateLabel(ctx, &protonmail.Label{
+			Name:      part,
+			Color:     defaultFolderColor,
+			Type:      protonmail.LabelMessage,
+			Exclusive: 1,
+			ParentID:  parentID,
+		})
+		if err != nil {
+			return "", err
+		}
+		if err := u.putLabel(label); err != nil {
+			return "", err
+		}
+		parentID = label.ID
+	}
+	return parentID, nil
+}
+
+func (u *user) CreateMailbox(name string) error {
+	// A trailing delimiter only indicates that the client intends to create
+	// mailboxes under this one
+	name = strings.TrimSuffix(name, delimiter)
+	if name == "" {
+		return errInvalidMailbox
+	}
+	if u.getMailbox(name) != nil {
+		return errMailboxExists
+	}
+
+	ctx, cancel := u.context()
+	defer cancel()
+
+	if name, ok := labelName(name); ok {
+		return u.createLabel(ctx, name)
+	}
+	_, err := u.createFolder(ctx, name)
+	return err
+}
+
+func (u *user) createLabel(ctx context.Context, name string) error {
+	if name == "" || strings.Contains(name, delimiter) {
+		return errLabelsMailbox
+	}
+
+	label, err := u.c.CreateLabel(ctx, &protonmail.Label{
+		Name:  name,
+		Color: defaultFolderColor,
+		Type:  protonmail.LabelMessage,
+	})
+	if err != nil {
+		return err
+	}
+	return u.putLabel(label)
+}
+
+func (u *user) DeleteMailbox(name string) error {
+	mbox := u.getMailbox(name)
+	if mbox == nil {
+		return imapbackend.ErrNoSuchMailbox
+	}
+	if u.label(mbox) == nil {
+		return errSystemMailbox
+	}
+	// The API would delete subfolders too
+	if u.hasSubfolders(mbox.label) {
+		return errors.New("mailbox has inferior mailboxes, delete them first")
+	}
+
+	ctx, cancel := u.context()
+	defer cancel()
+
+	if err := u.c.DeleteLabel(ctx, mbox.label); err != nil {
+		return err
+	}
+	return u.removeLabel(mbox.label)
+}
+
+func (u *user) RenameMailbox(existingName, newName string) error {
+	newName = strings.TrimSuffix(newName, delimiter)
+	if newName == "" {
+		return errInvalidMailbox
+	}
+
+	mbox := u.getMailbox(existingName)
+	if mbox == nil {
+		return imapbackend.ErrNoSuchMailbox
+	}
+	folder := u.label(mbox)
+	if folder == nil {
+		return errSystemMailbox
+	}
+	if u.getMailbox(newName) != nil {
+		return errMailboxExists
+	}
+	if strings.HasPrefix(newName, existingName+delimiter) {
+		return errors.New("a mailbox can't be moved under itself")
+	}
+
+	ctx, cancel := u.context()
+	defer cancel()
+
+	if folder.Exclusive != 1 {
+		name, ok := labelName(newName)
+		if !ok || name == "" || strings.Contains(name, delimiter) {
+			return errLabelsMailbox
+		}
+		updated := *folder
+		updated.Name = name
+		label, err := u.c.UpdateLabel(ctx, &updated)
+		if err != nil {
+			return err
+		}
+		return u.putLabel(label)
+	}
+	if _, ok := labelName(newName); ok || newName == labelsMailbox {
+		return errLabelsMailbox
+	}
+
+	updated := *folder
+	updated.Name = newName
+	updated.ParentID = ""
+	if i := strings.LastIndex(newName, delimiter); i >= 0 {
+		parentID, err := u.createFolder(ctx, newName[:i])
+		if err != nil {
+			return err
+		}
+		updated.Name = newName[i+len(delimiter):]
+		updated.ParentID = parentID
+	}
+	label, err := u.c.UpdateLabel(ctx, &updated)
+	if err != nil {
+		return err
+	}
+	// Subfolders are renamed too
+	return u.putLabel(label)
+}
@@ -0,0 +1,93 @@
+package imap
+
+import (
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/server"
+)
+
+const idleCapability = "IDLE"
+
+// maxIdleLineLen is the maximum length of the line ending IDLE.
+const maxIdleLineLen = 64
+
+// readIdleLine reads the line ending IDLE. It's read byte by byte, so that the
+// next command, if the client pipelines it, is left to the server.
+func readIdleLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < maxIdleLineLen {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return strings.TrimSuffix(string(line), "\r"), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", errors.New("IDLE line too long")
+}
+
+type idleHandler struct{}
+
+func (h *idleHandler) Parse(fields []interface{}) error {
+	return nil
+}
+
+// Handle waits for the client to send DONE. Updates received from the events
+// loop in the meantime are sent to the client by the server.
+func (h *idleHandler) Handle(conn server.Conn) error {
+	if conn.Context().State&imap.AuthenticatedState == 0 {
+		return server.ErrNotAuthenticated
+	}
+
+	// Send the changes which happened since the last command right away
+	if mbox, ok := conn.Context().Mailbox.(imapbackend.MailboxPoller); ok {
+		if err := mbox.Poll(); err != nil {
+			logger.Warn("cannot poll mailbox", "user", conn.Context().User.Username(), "mailbox", conn.Context().Mailbox.Name(), "error", err)
+		}
+	}
+
+	if err := conn.WriteResp(&imap.ContinuationReq{Info: "idling"}); err != nil {
+		return err
+	}
+
+	line, err := readIdleLine(conn)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(line, "DONE") {
+		return errors.New("Expected DONE")
+	}
+	return nil
+}
+
+type idleExtension struct{}
+
+// NewIdleExtension returns an extension implementing IDLE (RFC 2177). Clients
+// are notified of new messages and flag changes as soon as the events loop
+// receives them.
+func NewIdleExtension() server.Extension {
+	return &idleExtension{}
+}
+
+func (ext *idleExtension) Capabilities(c server.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{idleCapability}
+	}
+	return nil
+}
+
+func (ext *idleExtension) Command(name string) server.HandlerFactory {
+	if name != idleCapability {
+		return nil
+	}
+
+	return func() server.Handler {
+		return &idleHandler{}
+	}
+}
@@ -1,16 +1,19 @@
 package imap
 
 import (
+	"context"
 	"errors"
-	"log"
+	"fmt"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/emersion/go-imap"
 	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/server"
 
 	"github.com/emersion/hydroxide/imap/database"
+	"github.com/emersion/hydroxide/imports"
 	"github.com/emersion/hydroxide/protonmail"
 )
 
@@ -29,6 +32,7 @@ type mailbox struct {
 	initialized   bool
 	total, unread int
 	deleted       map[string]struct{}
+	indexing      bool
 }
 
 func newMailbox(name string, label string, attrs []string, u *user) (*mailbox, error) {
@@ -53,7 +57,7 @@ func (mbox *mailbox) Name() string {
 
 func (mbox *mailbox) Info() (*imap.MailboxInfo, error) {
 	return &imap.MailboxInfo{
-		Attributes: append([]string{imap.NoInferiorsAttr}, mbox.attrs...),
+		Attributes: append(mbox.folderAttrs(), mbox.attrs...),
 		Delimiter:  delimiter,
 		Name:       mbox.name,
 	}, nil
@@ -73,6 +77,7 @@ func (mbox *mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error
 	status.Flags = flags
 	status.PermanentFlags = permFlags
 	status.UnseenSeqNum = 0 // TODO
+	status.ReadOnly = isReadOnlyLabel(mbox.label)
 
 	mbox.Lock()
 	defer mbox.Unlock()
@@ -88,11 +93,21 @@ func (mbox *mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error
 			}
 			status.UidNext = uidNext
 		case imap.StatusUidValidity:
-			status.UidValidity = 1
+			uidValidity, err := mbox.db.UidValidity()
+			if err != nil {
+				return nil, err
+			}
+			status.UidValidity = uidValidity
 		case imap.StatusRecent:
 			status.Recent = 0
 		case imap.StatusUnseen:
 			status.Unseen = uint32(mbox.unread)
+		case statusHighestModSeq:
+			modSeq, err := mbox.u.db.HighestModSeq()
+			if err != nil {
+				return nil, err
+			}
+			status.Items[statusHighestModSeq] = formatModSeq(modSeq)
 		}
 	}
 
@@ -108,11 +123,11 @@ func (mbox *mailbox) Check() error {
 }
 
 func (mbox *mailbox) sync() error {
-	log.Printf("Synchronizing mailbox %v...", mbox.name)
+	mbox.u.logger.Info("synchronizing mailbox", "mailbox", mbox.name)
 
-	// TODO: don't do this without incrementing UIDVALIDITY
-	if err := mbox.db.Reset(); err != nil {
-		return err
+	window := mbox.u.backend.options.Window
+	if window > 0 {
+		return mbox.syncWindow(window)
 	}
 
 	filter := &protonmail.MessageFilter{
@@ -122,6 +137,7 @@ func (mbox *mailbox) sync() error {
 		Asc:      true,
 	}
 
+	var messages []*protonmail.Message
 	total := -1
 	for {
 		offset := filter.PageSize * filter.Page
@@ -131,22 +147,133 @@ func (mbox *mailbox) sync() error {
 
 		var page []*protonmail.Message
 		var err error
-		total, page, err = mbox.u.c.ListMessages(filter)
+		total, page, err = mbox.listMessages(filter)
 		if err != nil {
 			return err
 		}
+		if len(page) == 0 {
+			break
+		}
+
+		messages = append(messages, page...)
+		filter.Page++
+	}
 
-		if err := mbox.db.Sync(page); err != nil {
+	if err := mbox.syncMessages(messages); err != nil {
+		return err
+	}
+
+	mbox.u.logger.Info("mailbox synchronized", "mailbox", mbox.name)
+	return nil
+}
+
+// listMessages lists a page of messages for synchronization.
+func (mbox *mailbox) listMessages(filter *protonmail.MessageFilter) (int, []*protonmail.Message, error) {
+	ctx, cancel := mbox.u.context()
+	defer cancel()
+
+	if err := mbox.u.backend.options.Throttle.Wait(ctx); err != nil {
+		return 0, nil, err
+	}
+	return mbox.u.c.ListMessages(ctx, filter)
+}
+
+// syncMessages updates the local UID mapping with the messages listed by the
+// API, sorted from the oldest to the newest. Clients are notified of the
+// messages which have been removed in the meantime.
+func (mbox *mailbox) syncMessages(messages []*protonmail.Message) error {
+	expunged, repaired, err := mbox.db.Sync(messages)
+	if err != nil {
+		return err
+	}
+	if repaired {
+		mbox.u.logger.Warn("UID mapping was inconsistent and has been rebuilt, UIDVALIDITY has been reset", "mailbox", mbox.name)
+		return nil
+	}
+	if len(expunged) == 0 {
+		return nil
+	}
+
+	updates := make([]imapbackend.Update, 0, len(expunged))
+	for _, seqNum := range expunged {
+		update := new(imapbackend.ExpungeUpdate)
+		update.Update = imapbackend.NewUpdate(mbox.u.u.Name, mbox.name)
+		update.SeqNum = seqNum
+		updates = append(updates, update)
+	}
+	// The mailbox is locked: the unified inbox, which may need to lock it to
+	// synchronize, picks up the changes on its own
+	be := mbox.u.backend
+	be.notify(append(updates, be.namespacedUpdates(mbox.u, updates)...))
+	return nil
+}
+
+// syncWindow synchronizes the most recent messages of the mailbox.
+func (mbox *mailbox) syncWindow(window int) error {
+	filter := &protonmail.MessageFilter{
+		PageSize: 150,
+		Label:    mbox.label,
+		Sort:     "ID",
+	}
+
+	var messages []*protonmail.Message
+	total := -1
+	for len(messages) < window {
+		offset := filter.PageSize * filter.Page
+		if total >= 0 && offset > total {
+			break
+		}
+
+		var page []*protonmail.Message
+		var err error
+		total, page, err = mbox.listMessages(filter)
+		if err != nil {
 			return err
 		}
+		if len(page) == 0 {
+			break
+		}
 
+		messages = append(messages, page...)
 		filter.Page++
 	}
+	if len(messages) > window {
+		messages = messages[:window]
+	}
 
-	log.Printf("Synchronizing mailbox %v: done.", mbox.name)
+	// UIDs are assigned from the oldest to the newest message
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	if err := mbox.syncMessages(messages); err != nil {
+		return err
+	}
+
+	mbox.setCounts(total, mbox.unread)
+
+	if total > len(messages) {
+		mbox.u.logger.Info("mailbox synchronized, listing the most recent messages only", "mailbox", mbox.name, "listed", len(messages), "total", total)
+	} else {
+		mbox.u.logger.Info("mailbox synchronized", "mailbox", mbox.name)
+	}
 	return nil
 }
 
+// setCounts updates the message counters of the mailbox. When only a window
+// of the mailbox is listed, the total is the number of messages listed.
+func (mbox *mailbox) setCounts(total, unread int) {
+	if window := mbox.u.backend.options.Window; window > 0 && total > window {
+		if n, err := mbox.db.Len(); err == nil && n > 0 {
+			total = n
+		} else {
+			total = window
+		}
+	}
+
+	mbox.total = total
+	mbox.unread = unread
+}
+
 func (mbox *mailbox) init() error {
 	mbox.Lock()
 	defer mbox.Unlock()
@@ -155,7 +282,6 @@ func (mbox *mailbox) init() error {
 		return nil
 	}
 
-	// TODO: sync only the first time
 	if err := mbox.sync(); err != nil {
 		return err
 	}
@@ -169,7 +295,7 @@ func (mbox *mailbox) reset() error {
 	defer mbox.Unlock()
 
 	mbox.initialized = false
-	return mbox.db.Reset()
+	return nil
 }
 
 func (mbox *mailbox) fetchFlags(msg *protonmail.Message) []string {
@@ -198,7 +324,7 @@ func (mbox *mailbox) fetchFlags(msg *protonmail.Message) []string {
 	return flags
 }
 
-func (mbox *mailbox) fetchMessage(isUid bool, id uint32, items []imap.FetchItem) (*imap.Message, error) {
+func (mbox *mailbox) fetchMessage(ctx context.Context, isUid bool, id uint32, items []imap.FetchItem) (*imap.Message, error) {
 	var apiID string
 	var err error
 	if isUid {
@@ -226,7 +352,7 @@ func (mbox *mailbox) fetchMessage(isUid bool, id uint32, items []imap.FetchItem)
 		case imap.FetchEnvelope:
 			fetched.Envelope = fetchEnvelope(msg)
 		case imap.FetchBody, imap.FetchBodyStructure:
-			bs, err := mbox.fetchBodyStructure(msg, item == imap.FetchBodyStructure)
+			bs, err := mbox.fetchBodyStructure(ctx, msg, item == imap.FetchBodyStructure)
 			if err != nil {
 				return nil, err
 			}
@@ -239,13 +365,35 @@ func (mbox *mailbox) fetchMessage(isUid bool, id uint32, items []imap.FetchItem)
 			fetched.Size = uint32(msg.Size)
 		case imap.FetchUid:
 			fetched.Uid = uid
+		case fetchSaveDate:
+			t, err := mbox.saveDate(msg)
+			if err != nil {
+				return nil, err
+			}
+			fetched.Items[fetchSaveDate] = t
+		case fetchModSeq:
+			modSeq, err := mbox.u.db.ModSeq(apiID)
+			if err != nil {
+				return nil, err
+			}
+			fetched.Items[fetchModSeq] = []interface{}{formatModSeq(modSeq)}
 		default:
+			if bi, ok := parseBinaryItem(item); ok {
+				v, err := mbox.fetchBinary(ctx, msg, bi)
+				if err != nil {
+					return nil, err
+				}
+				delete(fetched.Items, item)
+				fetched.Items[bi.resp()] = v
+				break
+			}
+
 			section, err := imap.ParseBodySectionName(item)
 			if err != nil {
 				break
 			}
 
-			l, err := mbox.fetchBodySection(msg, section)
+			l, err := mbox.fetchBodySection(ctx, msg, section)
 			if err != nil {
 				return nil, err
 			}
@@ -263,6 +411,7 @@ func (mbox *mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.Fe
 		return err
 	}
 
+	var ranges []fetchRange
 	for _, seq := range seqSet.Set {
 		start := seq.Start
 		if start == 0 {
@@ -282,27 +431,70 @@ func (mbox *mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.Fe
 			}
 		}
 
-		for i := start; i <= stop; i++ {
-			msg, err := mbox.fetchMessage(uid, i, items)
-			if err == database.ErrNotFound {
-				continue
-			} else if err != nil {
-				return err
-			}
-			if msg != nil {
-				ch <- msg
-			}
-		}
+		ranges = append(ranges, fetchRange{start, stop})
 	}
 
-	return nil
+	workers := mbox.u.backend.fetchWorkers(items)
+	return pipelineFetch(ranges, workers, func(id uint32) (*imap.Message, error) {
+		ctx, cancel := mbox.u.context()
+		defer cancel()
+		return mbox.fetchMessage(ctx, uid, id, items)
+	}, ch)
 }
 
 func matchString(s, substr string) bool {
-	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+	return strings.Contains(normalizeText(s), normalizeText(substr))
+}
+
+// saveDate returns the time at which the message was added to the mailbox.
+func (mbox *mailbox) saveDate(msg *protonmail.Message) (time.Time, error) {
+	t, err := mbox.db.SaveDate(msg.ID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if t.IsZero() {
+		// The message was already there during the first sync
+		t = msg.Time.Time()
+	}
+	return t, nil
+}
+
+// scanCandidates returns the messages whose bodies can be scanned by a search:
+// the ones selected by explicit sequence numbers or UIDs, if they're among
+// candidates (unless nil) and there are at most maxScannedMessages of them.
+// Nil is returned otherwise.
+func (mbox *mailbox) scanCandidates(c *imap.SearchCriteria, candidates map[string]struct{}) (map[string]struct{}, error) {
+	if c.SeqNum == nil && c.Uid == nil {
+		return nil, nil
+	}
+
+	scanned := make(map[string]struct{})
+	err := mbox.db.ForEach(func(seqNum, uid uint32, apiID string) error {
+		if c.SeqNum != nil && !c.SeqNum.Contains(seqNum) {
+			return nil
+		}
+		if c.Uid != nil && !c.Uid.Contains(uid) {
+			return nil
+		}
+		if candidates != nil {
+			if _, ok := candidates[apiID]; !ok {
+				return nil
+			}
+		}
+		scanned[apiID] = struct{}{}
+		return nil
+	})
+	if err != nil || len(scanned) > maxScannedMessages {
+		return nil, err
+	}
+	return scanned, nil
 }
 
 func (mbox *mailbox) SearchMessages(isUID bool, c *imap.SearchCriteria) ([]uint32, error) {
+	return mbox.searchMessages(isUID, c, nil, 0)
+}
+
+func (mbox *mailbox) searchMessages(isUID bool, c *imap.SearchCriteria, saveDate *saveDateCriteria, modSeq uint64) ([]uint32, error) {
 	if err := mbox.init(); err != nil {
 		return nil, err
 	}
@@ -312,14 +504,61 @@ func (mbox *mailbox) SearchMessages(isUID bool, c *imap.SearchCriteria) ([]uint3
 		return nil, errors.New("search queries with NOT or OR clauses are not yet implemented")
 	}
 
+	// Dates are first evaluated by the servers, so that only the messages
+	// they return are checked locally
+	candidates, err := mbox.searchCandidates(c)
+	if err != nil {
+		mbox.u.logger.Warn("cannot search messages on the server, searching locally", "mailbox", mbox.name, "error", err)
+		candidates = nil
+	}
+
+	var bodyResults, textResults []map[string]struct{}
+	if mbox.u.searchIndex == nil && len(c.Body) == 0 && len(c.Text) > 0 {
+		// Without the local index, only headers can be searched, by the
+		// server
+		if textResults, err = mbox.searchServer(c, c.Text); err != nil {
+			return nil, err
+		}
+	} else if len(c.Body) > 0 || len(c.Text) > 0 {
+		// Messages which aren't indexed yet can't be found until the
+		// index has been built in the background
+		pending, err := mbox.indexMailbox()
+		if err != nil {
+			return nil, err
+		}
+		if pending > 0 {
+			return nil, server.ErrStatusResp(&imap.StatusResp{
+				Type: imap.StatusRespNo,
+				Code: "UNAVAILABLE",
+				Info: fmt.Sprintf("The search index is being built, %v messages left, try again later", pending),
+			})
+		}
+
+		scanned, err := mbox.scanCandidates(c, candidates)
+		if err != nil {
+			return nil, err
+		}
+		if bodyResults, err = mbox.searchBody(c.Body, scanned); err != nil {
+			return nil, err
+		}
+		if textResults, err = mbox.searchBody(c.Text, scanned); err != nil {
+			return nil, err
+		}
+	}
+
 	var results []uint32
-	err := mbox.db.ForEach(func(seqNum, uid uint32, apiID string) error {
+	err = mbox.db.ForEach(func(seqNum, uid uint32, apiID string) error {
 		if c.SeqNum != nil && !c.SeqNum.Contains(seqNum) {
 			return nil
 		}
 		if c.Uid != nil && !c.Uid.Contains(uid) {
 			return nil
 		}
+		if candidates != nil {
+			if _, ok := candidates[apiID]; !ok {
+				return nil
+			}
+		}
 
 		// TODO: fetch message from local DB only if needed
 		msg, err := mbox.u.db.Message(apiID)
@@ -362,7 +601,7 @@ func (mbox *mailbox) SearchMessages(isUID bool, c *imap.SearchCriteria) ([]uint3
 			fields := h.FieldsByKey(key)
 			var values []string
 			for fields.Next() {
-				values = append(values, fields.Value())
+				values = append(values, decodeHeaderValue(fields.Value()))
 			}
 
 			for _, wantValue := range wantValues {
@@ -384,7 +623,36 @@ func (mbox *mailbox) SearchMessages(isUID bool, c *imap.SearchCriteria) ([]uint3
 			}
 		}
 
-		// TODO: c.Body, c.Text
+		for _, matches := range bodyResults {
+			if _, ok := matches[apiID]; !ok {
+				return nil
+			}
+		}
+		for i, matches := range textResults {
+			if _, ok := matches[apiID]; !ok && !matchHeader(msg, c.Text[i]) {
+				return nil
+			}
+		}
+
+		if saveDate != nil {
+			t, err := mbox.saveDate(msg)
+			if err != nil {
+				return err
+			}
+			if !saveDate.match(t) {
+				return nil
+			}
+		}
+
+		if modSeq > 0 {
+			n, err := mbox.u.db.ModSeq(apiID)
+			if err != nil {
+				return err
+			}
+			if n < modSeq {
+				return nil
+			}
+		}
 
 		if c.Larger > 0 && uint32(msg.Size) < c.Larger {
 			return nil
@@ -406,21 +674,81 @@ func (mbox *mailbox) SearchMessages(isUID bool, c *imap.SearchCriteria) ([]uint3
 	return results, nil
 }
 
-func (mbox *mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
-	if mbox.label != protonmail.LabelDraft {
-		return errors.New("cannot create messages outside the Drafts mailbox")
+// importMetadata returns the metadata of a message appended to the mailbox.
+// The date is used if the message has no Date header field.
+func (mbox *mailbox) importMetadata(flags []string, date time.Time) (*protonmail.Message, error) {
+	msg := &protonmail.Message{
+		Unread: 1,
+		Type:   protonmail.MessageInbox,
+	}
+	if !date.IsZero() {
+		msg.Time = protonmail.Timestamp(date.Unix())
+	}
+
+	switch mbox.label {
+	case protonmail.LabelAllDraft:
+		return nil, errors.New("cannot append messages to this mailbox, use Drafts instead")
+	case protonmail.LabelAllMail:
+		msg.LabelIDs = []string{protonmail.LabelArchive}
+	case protonmail.LabelStarred:
+		msg.LabelIDs = []string{protonmail.LabelInbox, protonmail.LabelStarred}
+	case protonmail.LabelSent, protonmail.LabelAllSent:
+		msg.LabelIDs = []string{protonmail.LabelSent}
+		msg.Type = protonmail.MessageSent
+	default:
+		msg.LabelIDs = []string{mbox.label}
+		if mbox.isLabel() {
+			// Messages must be in a folder
+			msg.LabelIDs = []string{protonmail.LabelArchive, mbox.label}
+		}
 	}
 
+	for _, flag := range flags {
+		switch flag {
+		case imap.SeenFlag:
+			msg.Unread = 0
+		case imap.FlaggedFlag:
+			msg.LabelIDs = append(msg.LabelIDs, protonmail.LabelStarred)
+		case imap.DraftFlag, imap.RecentFlag, imap.DeletedFlag:
+			// Ignored
+		default:
+			if label := mbox.u.getFlag(flag); label != "" {
+				msg.LabelIDs = append(msg.LabelIDs, label)
+			}
+		}
+	}
+
+	return msg, nil
+}
+
+func (mbox *mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	_, err := mbox.createMessage(flags, date, body)
+	return err
+}
+
+// createMessage appends a message to the mailbox and returns its API ID.
+func (mbox *mailbox) createMessage(flags []string, date time.Time, body imap.Literal) (string, error) {
 	if err := mbox.init(); err != nil {
-		return err
+		return "", err
 	}
 
-	_, err := createMessage(mbox.u.c, mbox.u.u, mbox.u.privateKeys, mbox.u.addrs, body)
+	ctx, cancel := mbox.u.context()
+	defer cancel()
+
+	if mbox.label == protonmail.LabelDraft {
+		return mbox.saveDraft(ctx, body)
+	}
+
+	metadata, err := mbox.importMetadata(flags, date)
 	if err != nil {
-		return err
+		return "", err
+	}
+	apiID, err := imports.ImportMessageWithMetadata(ctx, mbox.u.c, body, metadata)
+	if err != nil {
+		return "", err
 	}
 
-	return mbox.Poll()
+	return apiID, mbox.Poll()
 }
 
 func (mbox *mailbox) fromSeqSet(isUID bool, seqSet *imap.SeqSet) ([]string, error) {
@@ -446,6 +774,9 @@ func (mbox *mailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, op imap.
 		return err
 	}
 
+	ctx, cancel := mbox.u.context()
+	defer cancel()
+
 	apiIDs, err := mbox.fromSeqSet(uid, seqSet)
 	if err != nil {
 		return err
@@ -459,12 +790,11 @@ func (mbox *mailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, op imap.
 		case imap.SeenFlag:
 			switch op {
 			case imap.SetFlags, imap.AddFlags:
-				err = mbox.u.c.MarkMessagesRead(apiIDs)
+				err = mbox.u.c.MarkMessagesRead(ctx, apiIDs)
 			case imap.RemoveFlags:
-				err = mbox.u.c.MarkMessagesUnread(apiIDs)
+				err = mbox.u.c.MarkMessagesUnread(ctx, apiIDs)
 			}
 		case imap.DeletedFlag:
-			// TODO: send updates
 			mbox.Lock()
 			switch op {
 			case imap.SetFlags, imap.AddFlags:
@@ -477,6 +807,12 @@ func (mbox *mailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, op imap.
 				}
 			}
 			mbox.Unlock()
+
+			// This flag is only stored locally, so there won't be any event
+			// from the API: notify other connections right away
+			if err = mbox.u.db.TouchMessages(apiIDs); err == nil {
+				err = mbox.notifyFlags(apiIDs)
+			}
 		case imap.DraftFlag:
 			// No-op
 		default:
@@ -487,9 +823,9 @@ func (mbox *mailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, op imap.
 
 			switch op {
 			case imap.SetFlags, imap.AddFlags:
-				err = mbox.u.c.LabelMessages(label, apiIDs)
+				err = mbox.u.c.LabelMessages(ctx, label, apiIDs)
 			case imap.RemoveFlags:
-				err = mbox.u.c.UnlabelMessages(label, apiIDs)
+				err = mbox.u.c.UnlabelMessages(ctx, label, apiIDs)
 			}
 		}
 		if err != nil {
@@ -500,70 +836,166 @@ func (mbox *mailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, op imap.
 	return mbox.Poll()
 }
 
-func (mbox *mailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, destName string) error {
-	if err := mbox.init(); err != nil {
-		return err
+// flagsUpdate returns an update containing the current flags and modification
+// sequence of a message. CONDSTORE requires the modification sequence to be
+// sent along with each flag change.
+func (mbox *mailbox) flagsUpdate(msg *protonmail.Message) (*imapbackend.MessageUpdate, error) {
+	seqNum, _, err := mbox.db.FromApiID(msg.ID)
+	if err != nil {
+		return nil, err
 	}
-
-	apiIDs, err := mbox.fromSeqSet(uid, seqSet)
+	modSeq, err := mbox.u.db.ModSeq(msg.ID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	dest := mbox.u.getMailbox(destName)
-	if dest == nil {
-		return imapbackend.ErrNoSuchMailbox
-	}
+	update := new(imapbackend.MessageUpdate)
+	update.Update = imapbackend.NewUpdate(mbox.u.u.Name, mbox.name)
+	update.Message = imap.NewMessage(seqNum, []imap.FetchItem{imap.FetchFlags, fetchModSeq})
+	update.Message.Flags = mbox.fetchFlags(msg)
+	update.Message.Items[fetchModSeq] = []interface{}{formatModSeq(modSeq)}
+	return update, nil
+}
 
-	if err := mbox.u.c.LabelMessages(dest.label, apiIDs); err != nil {
-		return err
+func (mbox *mailbox) notifyFlags(apiIDs []string) error {
+	updates := make([]imapbackend.Update, 0, len(apiIDs))
+	for _, apiID := range apiIDs {
+		msg, err := mbox.u.db.Message(apiID)
+		if err != nil {
+			return err
+		}
+		update, err := mbox.flagsUpdate(msg)
+		if err != nil {
+			return err
+		}
+		updates = append(updates, update)
 	}
-	return mbox.Poll()
+
+	mbox.u.notify(updates)
+	return nil
+}
+
+func (mbox *mailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, destName string) error {
+	_, err := mbox.copyMessages(uid, seqSet, destName, false)
+	return err
 }
 
 func (mbox *mailbox) MoveMessages(uid bool, seqSet *imap.SeqSet, destName string) error {
+	_, err := mbox.copyMessages(uid, seqSet, destName, true)
+	return err
+}
+
+// copyMessages adds messages to the mailbox destName, and removes them from
+// mbox if move is set. The UIDs of the messages in both mailboxes are
+// returned, or nil if the destination UIDs aren't known.
+func (mbox *mailbox) copyMessages(uid bool, seqSet *imap.SeqSet, destName string, move bool) (*copyUIDs, error) {
 	if err := mbox.init(); err != nil {
-		return err
+		return nil, err
 	}
 
-	apiIDs, err := mbox.fromSeqSet(uid, seqSet)
+	ctx, cancel := mbox.u.context()
+	defer cancel()
+
+	var apiIDs []string
+	var srcUIDs []uint32
+	err := mbox.db.ForEach(func(seqNum, msgUID uint32, apiID string) error {
+		id := seqNum
+		if uid {
+			id = msgUID
+		}
+		if seqSet.Contains(id) {
+			apiIDs = append(apiIDs, apiID)
+			srcUIDs = append(srcUIDs, msgUID)
+		}
+		return nil
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	dest := mbox.u.getMailbox(destName)
 	if dest == nil {
-		return imapbackend.ErrNoSuchMailbox
+		return nil, imapbackend.ErrNoSuchMailbox
+	}
+	if isReadOnlyLabel(dest.label) {
+		return nil, errReadOnlyMailbox
+	}
+
+	switch {
+	case move && isReadOnlyLabel(mbox.label):
+		err = mbox.release(ctx, apiIDs, dest.label)
+	case move && dest.isLabel() && !mbox.isLabel():
+		// Removing the source folder would leave the messages without any
+		// folder, they're only labelled
+		err = mbox.u.c.LabelMessages(ctx, dest.label, apiIDs)
+	case move:
+		if err = mbox.u.c.LabelMessages(ctx, dest.label, apiIDs); err == nil {
+			err = mbox.u.c.UnlabelMessages(ctx, mbox.label, apiIDs)
+		}
+	default:
+		err = mbox.u.c.LabelMessages(ctx, dest.label, apiIDs)
 	}
-
-	if err := mbox.u.c.LabelMessages(dest.label, apiIDs); err != nil {
-		return err
+	if err != nil {
+		return nil, err
 	}
-	if err := mbox.u.c.UnlabelMessages(mbox.label, apiIDs); err != nil {
-		return err
+	if err := mbox.Poll(); err != nil {
+		return nil, err
 	}
-	return mbox.Poll()
+
+	uidValidity, destUIDs, err := dest.uids(apiIDs)
+	if err != nil || destUIDs == nil {
+		return nil, err
+	}
+	return &copyUIDs{uidValidity: uidValidity, src: srcUIDs, dest: destUIDs}, nil
 }
 
 func (mbox *mailbox) Expunge() error {
+	return mbox.expunge(nil)
+}
+
+// expunge permanently removes the messages flagged as deleted. If uidSet
+// isn't nil, only the messages it contains are removed.
+func (mbox *mailbox) expunge(uidSet *imap.SeqSet) error {
 	if err := mbox.init(); err != nil {
 		return err
 	}
 
+	ctx, cancel := mbox.u.context()
+	defer cancel()
+
 	mbox.Lock()
 	if len(mbox.deleted) == 0 {
 		mbox.Unlock()
 		return nil // Nothing to do
 	}
-
-	apiIDs := make([]string, 0, len(mbox.deleted))
-
+	deleted := make(map[string]struct{}, len(mbox.deleted))
 	for apiID := range mbox.deleted {
-		apiIDs = append(apiIDs, apiID)
+		deleted[apiID] = struct{}{}
 	}
 	mbox.Unlock()
 
-	if err := mbox.u.c.DeleteMessages(apiIDs); err != nil {
+	// Messages which have been moved to another mailbox in the meantime are
+	// left alone: deleting them would remove them from their new mailbox too
+	var apiIDs []string
+	err := mbox.db.ForEach(func(seqNum, uid uint32, apiID string) error {
+		if _, ok := deleted[apiID]; ok && (uidSet == nil || uidSet.Contains(uid)) {
+			apiIDs = append(apiIDs, apiID)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	} else if len(apiIDs) == 0 {
+		return nil
+	}
+
+	// Expunging messages from a label mailbox only removes the label
+	if mbox.isLabel() {
+		err = mbox.u.c.UnlabelMessages(ctx, mbox.label, apiIDs)
+	} else {
+		err = mbox.u.c.DeleteMessages(ctx, apiIDs)
+	}
+	if err != nil {
 		return err
 	}
 
@@ -0,0 +1,65 @@
+package imap
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestImportMetadata(t *testing.T) {
+	date := time.Date(2020, time.February, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		label    string
+		flags    []string
+		date     time.Time
+		time     protonmail.Timestamp
+		unread   int
+		labelIDs []string
+	}{
+		{
+			name:     "inbox",
+			label:    protonmail.LabelInbox,
+			date:     date,
+			time:     protonmail.Timestamp(date.Unix()),
+			unread:   1,
+			labelIDs: []string{protonmail.LabelInbox},
+		},
+		{
+			name:     "no date",
+			label:    protonmail.LabelInbox,
+			unread:   1,
+			labelIDs: []string{protonmail.LabelInbox},
+		},
+		{
+			name:     "seen and flagged",
+			label:    protonmail.LabelArchive,
+			flags:    []string{imap.SeenFlag, imap.FlaggedFlag},
+			date:     date,
+			time:     protonmail.Timestamp(date.Unix()),
+			labelIDs: []string{protonmail.LabelArchive, protonmail.LabelStarred},
+		},
+	}
+	for _, tc := range tests {
+		mbox := &mailbox{label: tc.label, u: &user{}}
+		msg, err := mbox.importMetadata(tc.flags, tc.date)
+		if err != nil {
+			t.Errorf("%v: importMetadata() = %v", tc.name, err)
+			continue
+		}
+		if msg.Time != tc.time {
+			t.Errorf("%v: importMetadata() time = %v, want %v", tc.name, msg.Time, tc.time)
+		}
+		if msg.Unread != tc.unread {
+			t.Errorf("%v: importMetadata() unread = %v, want %v", tc.name, msg.Unread, tc.unread)
+		}
+		if !reflect.DeepEqual(msg.LabelIDs, tc.labelIDs) {
+			t.Errorf("%v: importMetadata() labels = %v, want %v", tc.name, msg.LabelIDs, tc.labelIDs)
+		}
+	}
+}
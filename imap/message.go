@@ -2,18 +2,24 @@ package imap
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"html"
 	"io"
-	"log"
+	"io/ioutil"
+	"strconv"
 	"strings"
 
 	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/backendutil"
 	"github.com/emersion/go-message"
 	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
 	"golang.org/x/crypto/openpgp"
+	pgperrors "golang.org/x/crypto/openpgp/errors"
 
 	"github.com/emersion/hydroxide/protonmail"
 )
@@ -40,22 +46,25 @@ func protonmailAddressList(addresses []*mail.Address) []*protonmail.MessageAddre
 	for i, addr := range addresses {
 		l[i] = &protonmail.MessageAddress{
 			Name:    addr.Name,
-			Address: addr.Address,
+			Address: protonmail.ASCIIAddress(addr.Address),
 		}
 	}
 	return l
 }
 
+// imapAddress converts an address for the envelope. UTF8=ACCEPT isn't
+// supported, so the domain is sent in its ASCII form.
 func imapAddress(addr *protonmail.MessageAddress) *imap.Address {
-	parts := strings.SplitN(addr.Address, "@", 2)
-	if len(parts) < 2 {
-		parts = append(parts, "")
+	i := strings.LastIndexByte(addr.Address, '@')
+	mailbox, host := addr.Address, ""
+	if i >= 0 {
+		mailbox, host = addr.Address[:i], addr.Address[i+1:]
 	}
 
 	return &imap.Address{
-		PersonalName: addr.Name,
-		MailboxName:  parts[0],
-		HostName:     parts[1],
+		PersonalName: decodeHeaderValue(addr.Name),
+		MailboxName:  mailbox,
+		HostName:     protonmail.ASCIIDomain(host),
 	}
 }
 
@@ -70,7 +79,7 @@ func imapAddressList(addresses []*protonmail.MessageAddress) []*imap.Address {
 func fetchEnvelope(msg *protonmail.Message) *imap.Envelope {
 	return &imap.Envelope{
 		Date:    msg.Time.Time(),
-		Subject: msg.Subject,
+		Subject: decodeHeaderValue(msg.Subject),
 		From:    []*imap.Address{imapAddress(msg.Sender)},
 		// TODO: Sender
 		To:      imapAddressList(msg.ToList),
@@ -104,10 +113,34 @@ func splitMIMEType(t string) (string, string) {
 	return parts[0], parts[1]
 }
 
-func (mbox *mailbox) fetchBodyStructure(msg *protonmail.Message, extended bool) (*imap.BodyStructure, error) {
+func (mbox *mailbox) fetchBodyStructure(ctx context.Context, msg *protonmail.Message, extended bool) (*imap.BodyStructure, error) {
+	if isMIMEBody(msg) {
+		// Computing the structure requires parsing the whole decrypted body
+		if bs := mbox.u.cachedBodyStructure(msg.ID); bs != nil {
+			setExtended(bs, extended)
+			return bs, nil
+		}
+
+		msg, err := mbox.u.getMessage(ctx, msg.ID)
+		if err != nil {
+			return nil, err
+		}
+		h, body, err := mbox.mimeMessage(ctx, msg)
+		if err != nil {
+			return nil, err
+		}
+		bs, err := backendutil.FetchBodyStructure(h, bytes.NewReader(body), true)
+		if err != nil {
+			return nil, err
+		}
+		mbox.u.cacheBodyStructure(msg.ID, bs)
+		setExtended(bs, extended)
+		return bs, nil
+	}
+
 	if msg.NumAttachments > 0 {
 		var err error
-		msg, err = mbox.u.c.GetMessage(msg.ID)
+		msg, err = mbox.u.getMessage(ctx, msg.ID)
 		if err != nil {
 			return nil, err
 		}
@@ -153,29 +186,118 @@ func (mbox *mailbox) fetchBodyStructure(msg *protonmail.Message, extended bool)
 	}, nil
 }
 
-func (mbox *mailbox) inlineBody(msg *protonmail.Message) (io.Reader, error) {
-	md, err := msg.Read(mbox.u.privateKeys, nil)
+// decryptionError returns a short description of a decryption error for the
+// X-Pm-Decryption-Error header field. Error messages aren't safe to use as
+// field values, e.g. they can contain line breaks, so they're only logged.
+func decryptionError(err error) string {
+	switch err.(type) {
+	case pgperrors.StructuralError, pgperrors.AEADError:
+		return "malformed or corrupted message"
+	case pgperrors.UnsupportedError:
+		return "unsupported encryption"
+	case pgperrors.ErrDummyPrivateKey:
+		return "no private key to decrypt the message"
+	}
+	if err == pgperrors.ErrKeyIncorrect {
+		return "no private key to decrypt the message"
+	}
+	return "decryption failed"
+}
+
+// setExtended sets whether a body structure and its parts include extension
+// data.
+func setExtended(bs *imap.BodyStructure, extended bool) {
+	bs.Extended = extended
+	for _, part := range bs.Parts {
+		setExtended(part, extended)
+	}
+	if bs.BodyStructure != nil {
+		setExtended(bs.BodyStructure, extended)
+	}
+}
+
+// decryptionErrorBody returns a body explaining why a message couldn't be
+// decrypted, in the format of the message's inline part. Like the
+// X-Pm-Decryption-Error header field, it only contains a short description of
+// the error.
+func decryptionErrorBody(msg *protonmail.Message, err error) string {
+	notice := fmt.Sprintf("This message couldn't be decrypted: %v. It may still be readable from the ProtonMail web client.", decryptionError(err))
+	if msg.MIMEType == "text/plain" {
+		return notice + "\r\n"
+	}
+	return "<p>" + html.EscapeString(notice) + "</p>\r\n"
+}
+
+// inlinePart returns the MIME header and the decrypted body of the message's
+// inline part, along with the result of the signature verification. Trackers
+// are removed from HTML bodies, unless disabled with Options.BlockTrackers. If
+// the body can't be decrypted, a notice is returned instead so that fetching
+// the rest of the mailbox still works.
+func (mbox *mailbox) inlinePart(ctx context.Context, msg *protonmail.Message) (message.Header, io.Reader, *signatureResult, error) {
+	mbox.u.learnAutocrypt(msg)
+
+	h := inlineHeader(msg)
+	b, sig, err := mbox.u.decryptBody(ctx, msg)
 	if err != nil {
-		return nil, err
+		mbox.u.logger.Warn("cannot decrypt message body", "message", msg.ID, "error", err)
+		h.Set("X-Pm-Decryption-Error", decryptionError(err))
+		return h, strings.NewReader(decryptionErrorBody(msg, err)), nil, nil
 	}
 
-	// TODO: check signature
-	return md.UnverifiedBody, nil
+	body := string(b)
+	if msg.MIMEType != "text/plain" && mbox.u.backend.options.BlockTrackers {
+		var blocked []string
+		trackers := mbox.u.backend.options.Trackers
+		if trackers == nil {
+			trackers = defaultTrackers
+		}
+		body, blocked = trackers.block(body)
+		if len(blocked) > 0 {
+			h.Set("X-Pm-Trackers-Blocked", strings.Join(blocked, ", "))
+		}
+	}
+
+	return h, strings.NewReader(body), sig, nil
 }
 
-func (mbox *mailbox) attachmentBody(att *protonmail.Attachment) (io.Reader, error) {
-	rc, err := mbox.u.c.GetAttachment(att.ID)
+type attachmentBody struct {
+	io.Reader
+	io.Closer
+}
+
+func (mbox *mailbox) attachmentBody(ctx context.Context, att *protonmail.Attachment) (io.ReadCloser, error) {
+	rc, err := mbox.u.c.GetAttachment(ctx, att.ID)
 	if err != nil {
 		return nil, err
 	}
 
 	md, err := att.Read(rc, mbox.u.privateKeys, nil)
 	if err != nil {
+		rc.Close()
 		return nil, err
 	}
 
 	// TODO: check signature
-	return md.UnverifiedBody, nil
+	return attachmentBody{md.UnverifiedBody, rc}, nil
+}
+
+// attachmentPart returns the MIME header and the decrypted body of an
+// attachment. If the attachment can't be decrypted, its body is left empty.
+//
+// The body is streamed from the API and must be closed. Errors detected while
+// reading it, e.g. integrity check failures, are returned by Read.
+func (mbox *mailbox) attachmentPart(ctx context.Context, att *protonmail.Attachment) (message.Header, io.ReadCloser, error) {
+	h := attachmentHeader(att)
+	r, err := mbox.attachmentBody(ctx, att)
+	if err != nil {
+		if _, ok := err.(*protonmail.APIError); ok {
+			return h, nil, err
+		}
+		mbox.u.logger.Warn("cannot decrypt attachment", "attachment", att.ID, "error", err)
+		h.Set("X-Pm-Decryption-Error", decryptionError(err))
+		return h, ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	return h, r, nil
 }
 
 func inlineHeader(msg *protonmail.Message) message.Header {
@@ -183,7 +305,7 @@ func inlineHeader(msg *protonmail.Message) message.Header {
 	if msg.MIMEType != "" {
 		h.SetContentType(msg.MIMEType, map[string]string{"charset": "utf-8"})
 	} else {
-		log.Println("Sending an inline header without its proper MIME type")
+		logger.Debug("sending an inline header without its proper MIME type", "message", msg.ID)
 	}
 	h.Set("Content-Transfer-Encoding", "quoted-printable")
 	return h.Header
@@ -200,10 +322,13 @@ func attachmentHeader(att *protonmail.Attachment) message.Header {
 	return h.Header
 }
 
+// mailAddress converts an address for the message header. Names are decoded
+// first, in case the API returns them encoded, so that they aren't encoded
+// twice.
 func mailAddress(addr *protonmail.MessageAddress) *mail.Address {
 	return &mail.Address{
-		Name:    addr.Name,
-		Address: addr.Address,
+		Name:    decodeHeaderValue(addr.Name),
+		Address: protonmail.ASCIIAddress(addr.Address),
 	}
 }
 
@@ -221,7 +346,7 @@ func messageHeader(msg *protonmail.Message) message.Header {
 	var h mail.Header
 	h.SetContentType("multipart/mixed", typeParams)
 	h.SetDate(msg.Time.Time())
-	h.SetSubject(msg.Subject)
+	h.SetSubject(decodeHeaderValue(msg.Subject))
 	h.SetAddressList("From", []*mail.Address{mailAddress(msg.Sender)})
 	if len(msg.ReplyTos) > 0 {
 		h.SetAddressList("Reply-To", mailAddressList(msg.ReplyTos))
@@ -237,36 +362,166 @@ func messageHeader(msg *protonmail.Message) message.Header {
 	}
 	// TODO: In-Reply-To
 	h.Set("Message-Id", fmt.Sprintf("<%s>", messageID(msg)))
+	if msg.ConversationID != "" {
+		h.Set("References", fmt.Sprintf("<%s>", conversationReference(msg)))
+		h.Set("X-Pm-Conversation-Id", msg.ConversationID)
+	}
+	h.Set("X-Pm-Origin", messageOrigin(msg))
+	h.Set("X-Pm-Encryption", messageEncryption(msg))
+	if msg.Type == protonmail.MessageDraft {
+		h.Set(draftVersionHeader, strconv.FormatInt(int64(msg.Time), 10))
+	}
+	if len(msg.LabelIDs) > 0 {
+		h.Set("X-Pm-Label-Ids", strings.Join(msg.LabelIDs, ", "))
+	}
 	return h.Header
 }
 
-func (mbox *mailbox) fetchBodySection(msg *protonmail.Message, section *imap.BodySectionName) (imap.Literal, error) {
+// messageOrigin returns "internal" if the message has been sent by a
+// ProtonMail user, "external" otherwise.
+func messageOrigin(msg *protonmail.Message) string {
+	switch msg.IsEncrypted {
+	case protonmail.MessageEncryptedInternal, protonmail.MessageEncryptedOutside:
+		return "internal"
+	case protonmail.MessageUnencrypted:
+		if msg.Type == protonmail.MessageSent || msg.Type == protonmail.MessageDraft {
+			return "internal"
+		}
+	}
+	return "external"
+}
+
+// messageEncryption describes how the message is protected: "end-to-end" if
+// it has been encrypted by the sender, "zero-access" if it has been encrypted
+// by ProtonMail upon reception, "none" otherwise.
+func messageEncryption(msg *protonmail.Message) string {
+	switch msg.IsEncrypted {
+	case protonmail.MessageUnencrypted:
+		return "none"
+	case protonmail.MessageEncryptedExternal:
+		return "zero-access"
+	default:
+		return "end-to-end"
+	}
+}
+
+func (mbox *mailbox) fetchBodySection(ctx context.Context, msg *protonmail.Message, section *imap.BodySectionName) (imap.Literal, error) {
 	// TODO: section.Peek
 
-	b := new(bytes.Buffer)
+	off, n := partialRange(section)
+	if n < 0 {
+		b, err := mbox.bodySpool(ctx, msg, section)
+		if err != nil {
+			return nil, err
+		}
+		return b.literal(0, -1), nil
+	}
+
+	// Clients downloading large messages or attachments in chunks request
+	// the same section for each chunk: keep it instead of downloading and
+	// decrypting it again
+	whole := *section
+	whole.Partial = nil
+	whole.Peek = false
+	key := fmt.Sprintf("%v %v %v", msg.ID, msg.Time, whole.FetchItem())
+	if l := mbox.u.spoolCache.literal(key, off, n); l != nil {
+		return l, nil
+	}
 
-	if len(section.Path) == 0 {
-		w, err := message.CreateWriter(b, messageHeader(msg))
+	b, err := mbox.bodySpool(ctx, msg, &whole)
+	if err != nil {
+		return nil, err
+	}
+	mbox.u.spoolCache.put(key, b)
+	return b.literal(off, n), nil
+}
+
+// bodySpool writes a body section to a spool. Partial fetches are handled
+// by the caller.
+func (mbox *mailbox) bodySpool(ctx context.Context, msg *protonmail.Message, section *imap.BodySectionName) (*spool, error) {
+	if isMIMEBody(msg) {
+		msg, err := mbox.u.getMessage(ctx, msg.ID)
 		if err != nil {
 			return nil, err
 		}
+		h, body, err := mbox.mimeMessage(ctx, msg)
+		if err != nil {
+			return nil, err
+		}
+		if len(section.Path) > 0 || (section.Specifier != imap.EntireSpecifier && section.Specifier != imap.TextSpecifier) {
+			whole := *section
+			whole.Partial = nil
+			l, err := backendutil.FetchBodySection(h, bytes.NewReader(body), &whole)
+			if err != nil {
+				return nil, err
+			}
+			b := new(spool)
+			if _, err := io.Copy(b, l); err != nil {
+				b.Close()
+				return nil, err
+			}
+			return b, nil
+		}
+		// backendutil copies the whole message to memory, write it to a
+		// spool instead
+		return mimeSpool(h, body, section)
+	}
 
-		if section.Specifier == imap.TextSpecifier {
-			b.Reset()
+	b := new(spool)
+	ok := false
+	defer func() {
+		if !ok {
+			b.Close()
 		}
+	}()
 
-		switch section.Specifier {
-		case imap.EntireSpecifier, imap.TextSpecifier:
-			msg, err := mbox.u.c.GetMessage(msg.ID)
+	if len(section.Path) == 0 {
+		h := messageHeader(msg)
+
+		// Verification results are only known once the body has been
+		// decrypted. They're part of the header in all sections, so that
+		// BODY[HEADER] is the header of BODY[], but the body isn't decrypted
+		// if the client only asks for other header fields.
+		var ph message.Header
+		var pr io.Reader
+		if sectionHasVerification(section) {
+			var err error
+			msg, err = mbox.u.getMessage(ctx, msg.ID)
 			if err != nil {
 				return nil, err
 			}
 
-			pw, err := w.CreatePart(inlineHeader(msg))
+			var sig *signatureResult
+			ph, pr, sig, err = mbox.inlinePart(ctx, msg)
 			if err != nil {
 				return nil, err
 			}
-			pr, err := mbox.inlineBody(msg)
+			setAuthenticationResults(&h, msg, sig)
+		}
+
+		if section.Specifier == imap.HeaderSpecifier {
+			filterHeaderFields(&h.Header, section)
+			if err := textproto.WriteHeader(b, h.Header); err != nil {
+				return nil, err
+			}
+			ok = true
+			return b, nil
+		}
+
+		w, err := message.CreateWriter(b, h)
+		if err != nil {
+			return nil, err
+		}
+
+		if section.Specifier == imap.TextSpecifier {
+			if err := b.Reset(); err != nil {
+				return nil, err
+			}
+		}
+
+		switch section.Specifier {
+		case imap.EntireSpecifier, imap.TextSpecifier:
+			pw, err := w.CreatePart(ph)
 			if err != nil {
 				return nil, err
 			}
@@ -276,15 +531,18 @@ func (mbox *mailbox) fetchBodySection(msg *protonmail.Message, section *imap.Bod
 			pw.Close()
 
 			for _, att := range msg.Attachments {
-				pw, err := w.CreatePart(attachmentHeader(att))
+				ah, pr, err := mbox.attachmentPart(ctx, att)
 				if err != nil {
 					return nil, err
 				}
-				pr, err := mbox.attachmentBody(att)
+				pw, err := w.CreatePart(ah)
 				if err != nil {
+					pr.Close()
 					return nil, err
 				}
-				if _, err := io.Copy(pw, pr); err != nil {
+				_, err = io.Copy(pw, pr)
+				pr.Close()
+				if err != nil {
 					return nil, err
 				}
 				pw.Close()
@@ -298,37 +556,40 @@ func (mbox *mailbox) fetchBodySection(msg *protonmail.Message, section *imap.Bod
 		}
 
 		var h message.Header
-		var getBody func() (io.Reader, error)
+		var body io.ReadCloser
 		if part := section.Path[0]; part == 1 {
 			// TODO: only fetch the message if the body is needed
 			// For now we fetch it in all cases because the MIME type is not included
 			// in the cached message, and inlineHeader needs it
-			msg, err := mbox.u.c.GetMessage(msg.ID)
+			msg, err := mbox.u.getMessage(ctx, msg.ID)
 			if err != nil {
 				return nil, err
 			}
 
-			h = inlineHeader(msg)
-			getBody = func() (io.Reader, error) {
-				return mbox.inlineBody(msg)
+			// The body is needed to know which trackers are blocked
+			var r io.Reader
+			h, r, _, err = mbox.inlinePart(ctx, msg)
+			if err != nil {
+				return nil, err
 			}
+			body = ioutil.NopCloser(r)
 		} else {
 			i := part - 2
 			if i >= msg.NumAttachments {
 				return nil, errors.New("invalid attachment section path")
 			}
 
-			msg, err := mbox.u.c.GetMessage(msg.ID)
+			msg, err := mbox.u.getMessage(ctx, msg.ID)
 			if err != nil {
 				return nil, err
 			}
 
-			att := msg.Attachments[i]
-			h = attachmentHeader(att)
-			getBody = func() (io.Reader, error) {
-				return mbox.attachmentBody(att)
+			h, body, err = mbox.attachmentPart(ctx, msg.Attachments[i])
+			if err != nil {
+				return nil, err
 			}
 		}
+		defer body.Close()
 
 		w, err := message.CreateWriter(b, h)
 		if err != nil {
@@ -338,24 +599,23 @@ func (mbox *mailbox) fetchBodySection(msg *protonmail.Message, section *imap.Bod
 		switch section.Specifier {
 		case imap.TextSpecifier:
 			// The header hasn't been requested. Discard it.
-			b.Reset()
+			if err := b.Reset(); err != nil {
+				return nil, err
+			}
 		case imap.EntireSpecifier:
 			if len(section.Path) > 0 {
 				// When selecting a specific part by index, IMAP servers
 				// return only the text, not the associated MIME header.
-				b.Reset()
+				if err := b.Reset(); err != nil {
+					return nil, err
+				}
 			}
 		}
 
 		// Write the body, if requested
 		switch section.Specifier {
 		case imap.EntireSpecifier, imap.TextSpecifier:
-			r, err := getBody()
-			if err != nil {
-				return nil, err
-			}
-
-			if _, err := io.Copy(w, r); err != nil {
+			if _, err := io.Copy(w, body); err != nil {
 				return nil, err
 			}
 		}
@@ -363,21 +623,86 @@ func (mbox *mailbox) fetchBodySection(msg *protonmail.Message, section *imap.Bod
 		w.Close()
 	}
 
-	var l imap.Literal = b
-	if section.Partial != nil {
-		l = bytes.NewReader(section.ExtractPartial(b.Bytes()))
+	ok = true
+	return b, nil
+}
+
+// sectionHasVerification checks whether a top-level body section includes
+// the header fields containing verification results.
+func sectionHasVerification(section *imap.BodySectionName) bool {
+	if section.Specifier != imap.HeaderSpecifier || len(section.Fields) == 0 {
+		return true
+	}
+	listed := false
+	for _, f := range section.Fields {
+		if strings.EqualFold(f, "Authentication-Results") || strings.EqualFold(f, "X-Pm-Signature") {
+			listed = true
+		}
 	}
+	return listed != section.NotFields
+}
 
-	return l, nil
+// filterHeaderFields keeps the header fields requested by a HEADER.FIELDS or
+// HEADER.FIELDS.NOT section.
+func filterHeaderFields(h *textproto.Header, section *imap.BodySectionName) {
+	if len(section.Fields) == 0 {
+		return
+	}
+	listed := make(map[string]bool, len(section.Fields))
+	for _, f := range section.Fields {
+		listed[strings.ToLower(f)] = true
+	}
+	fields := h.Fields()
+	for fields.Next() {
+		if listed[strings.ToLower(fields.Key())] == section.NotFields {
+			fields.Del()
+		}
+	}
 }
 
-func createMessage(c *protonmail.Client, u *protonmail.User, privateKeys openpgp.EntityList, addrs []*protonmail.Address, r io.Reader) (*protonmail.Message, error) {
+// partialRange returns the offset and the length of a partial fetch, or -1
+// for the length if the whole section is requested.
+func partialRange(section *imap.BodySectionName) (off, n int64) {
+	if len(section.Partial) == 2 {
+		return int64(section.Partial[0]), int64(section.Partial[1])
+	}
+	return 0, -1
+}
+
+// mimeSpool writes the whole message or its text for a message whose
+// decrypted body is a MIME entity.
+func mimeSpool(h textproto.Header, body []byte, section *imap.BodySectionName) (*spool, error) {
+	b := new(spool)
+	if section.Specifier == imap.EntireSpecifier {
+		if err := textproto.WriteHeader(b, h); err != nil {
+			b.Close()
+			return nil, err
+		}
+	}
+	if _, err := b.Write(body); err != nil {
+		b.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// createMessage saves a message as a draft. If existing is non-nil, the
+// existing draft is updated instead of creating a new one: its attachments
+// are kept if they're still part of the message.
+func createMessage(ctx context.Context, c *protonmail.Client, u *protonmail.User, privateKeys openpgp.EntityList, addrs []*protonmail.Address, r io.Reader, existing *protonmail.Message) (*protonmail.Message, error) {
+	normalized, err := normalizeTransferEncoding(r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse message: %v", err)
+	}
+
 	// Parse the incoming MIME message header
-	mr, err := mail.CreateReader(r)
+	mr, err := mail.CreateReader(normalized)
 	if err != nil {
 		return nil, err
 	}
 
+	mr.Header.Del(draftVersionHeader)
+
 	subject, _ := mr.Header.Subject()
 	fromList, _ := mr.Header.AddressList("From")
 	toList, _ := mr.Header.AddressList("To")
@@ -394,7 +719,7 @@ func createMessage(c *protonmail.Client, u *protonmail.User, privateKeys openpgp
 	fromAddrStr := fromList[0].Address
 	var fromAddr *protonmail.Address
 	for _, addr := range addrs {
-		if strings.EqualFold(addr.Email, fromAddrStr) {
+		if strings.EqualFold(protonmail.ASCIIAddress(addr.Email), protonmail.ASCIIAddress(fromAddrStr)) {
 			fromAddr = addr
 			break
 		}
@@ -432,19 +757,28 @@ func createMessage(c *protonmail.Client, u *protonmail.User, privateKeys openpgp
 		AddressID: fromAddr.ID,
 	}
 
-	// Create an empty draft
-	plaintext, err := msg.Encrypt([]*openpgp.Entity{privateKey}, privateKey)
-	if err != nil {
-		return nil, err
-	}
-	if err := plaintext.Close(); err != nil {
-		return nil, err
-	}
+	// Attachments of the existing draft, indexed by name and MIME type
+	kept := make(map[string]*protonmail.Attachment)
+	if existing != nil {
+		msg.ID = existing.ID
+		for _, att := range existing.Attachments {
+			kept[att.Name+"\x00"+att.MIMEType] = att
+		}
+	} else {
+		// Create an empty draft
+		plaintext, err := msg.Encrypt([]*openpgp.Entity{privateKey}, privateKey)
+		if err != nil {
+			return nil, err
+		}
+		if err := plaintext.Close(); err != nil {
+			return nil, err
+		}
 
-	// TODO: parentID from In-Reply-To
-	msg, err = c.CreateDraftMessage(msg, "")
-	if err != nil {
-		return nil, fmt.Errorf("cannot create draft message: %v", err)
+		// TODO: parentID from In-Reply-To
+		msg, err = c.CreateDraftMessage(ctx, msg, "", protonmail.MessageReply)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create draft message: %v", err)
+		}
 	}
 
 	var body *bytes.Buffer
@@ -485,6 +819,14 @@ func createMessage(c *protonmail.Client, u *protonmail.User, privateKeys openpgp
 				break
 			}
 
+			k := filename + "\x00" + t
+			if att, ok := kept[k]; ok {
+				// Already uploaded, no need to upload it again
+				delete(kept, k)
+				msg.Attachments = append(msg.Attachments, att)
+				break
+			}
+
 			att := &protonmail.Attachment{
 				MessageID: msg.ID,
 				Name:      filename,
@@ -513,7 +855,7 @@ func createMessage(c *protonmail.Client, u *protonmail.User, privateKeys openpgp
 				pw.CloseWithError(cleartext.Close())
 			}()
 
-			att, err = c.CreateAttachment(att, pr)
+			att, err = c.CreateAttachment(ctx, att, pr)
 			if err != nil {
 				return nil, fmt.Errorf("cannot upload attachment: %v", err)
 			}
@@ -526,9 +868,16 @@ func createMessage(c *protonmail.Client, u *protonmail.User, privateKeys openpgp
 		return nil, errors.New("message doesn't contain a body part")
 	}
 
+	// Attachments removed from the draft
+	for _, att := range kept {
+		if err := c.DeleteAttachment(ctx, att.ID); err != nil {
+			return nil, fmt.Errorf("cannot delete attachment: %v", err)
+		}
+	}
+
 	// Encrypt the body and update the draft
 	msg.MIMEType = bodyType
-	plaintext, err = msg.Encrypt([]*openpgp.Entity{privateKey}, privateKey)
+	plaintext, err := msg.Encrypt([]*openpgp.Entity{privateKey}, privateKey)
 	if err != nil {
 		return nil, err
 	}
@@ -539,9 +888,13 @@ func createMessage(c *protonmail.Client, u *protonmail.User, privateKeys openpgp
 		return nil, err
 	}
 
-	if _, err := c.UpdateDraftMessage(msg); err != nil {
+	updated, err := c.UpdateDraftMessage(ctx, msg)
+	if err != nil {
 		return nil, fmt.Errorf("cannot update draft message: %v", err)
 	}
+	if updated != nil {
+		msg = updated
+	}
 
 	return msg, nil
 }
@@ -0,0 +1,184 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-message/textproto"
+	pgperrors "golang.org/x/crypto/openpgp/errors"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestFilterHeaderFields(t *testing.T) {
+	tests := []struct {
+		item         string
+		want         []string
+		verification bool
+	}{
+		{"BODY[HEADER]", []string{"Authentication-Results", "From", "Subject", "To"}, true},
+		{"BODY[HEADER.FIELDS (FROM subject)]", []string{"From", "Subject"}, false},
+		{"BODY[HEADER.FIELDS (From Authentication-Results)]", []string{"Authentication-Results", "From"}, true},
+		{"BODY[HEADER.FIELDS.NOT (To)]", []string{"Authentication-Results", "From", "Subject"}, true},
+		{"BODY[HEADER.FIELDS.NOT (Authentication-Results X-Pm-Signature)]", []string{"From", "Subject", "To"}, false},
+		{"BODY[]", []string{"Authentication-Results", "From", "Subject", "To"}, true},
+		{"BODY[TEXT]", []string{"Authentication-Results", "From", "Subject", "To"}, true},
+	}
+	for _, tc := range tests {
+		section, err := imap.ParseBodySectionName(imap.FetchItem(tc.item))
+		if err != nil {
+			t.Fatalf("ParseBodySectionName(%q) = %v", tc.item, err)
+		}
+
+		if got := sectionHasVerification(section); got != tc.verification {
+			t.Errorf("sectionHasVerification(%q) = %v, want %v", tc.item, got, tc.verification)
+		}
+
+		var h textproto.Header
+		h.Add("To", "b@example.org")
+		h.Add("Subject", "Hello")
+		h.Add("From", "a@example.org")
+		h.Add("Authentication-Results", "hydroxide; x-pgp=none")
+		filterHeaderFields(&h, section)
+
+		var got []string
+		fields := h.Fields()
+		for fields.Next() {
+			got = append(got, fields.Key())
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("filterHeaderFields(%q) = %v, want %v", tc.item, got, tc.want)
+		}
+	}
+}
+
+func TestDecryptionError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{pgperrors.ErrKeyIncorrect, "no private key to decrypt the message"},
+		{pgperrors.StructuralError("tag byte does not have MSB set"), "malformed or corrupted message"},
+		{pgperrors.UnsupportedError("cipher: 42"), "unsupported encryption"},
+		{errors.New("Bla\r\nX-Injected: 1"), "decryption failed"},
+	}
+	for _, tc := range tests {
+		if got := decryptionError(tc.err); got != tc.want {
+			t.Errorf("decryptionError(%q) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestDecryptionErrorBody(t *testing.T) {
+	err := errors.New("openpgp: <script>\r\nX-Injected: 1")
+	tests := []struct {
+		mimeType string
+		want     string
+	}{
+		{"text/plain", "This message couldn't be decrypted: decryption failed. It may still be readable from the ProtonMail web client.\r\n"},
+		{"text/html", "<p>This message couldn&#39;t be decrypted: decryption failed. It may still be readable from the ProtonMail web client.</p>\r\n"},
+	}
+	for _, tc := range tests {
+		msg := &protonmail.Message{MIMEType: tc.mimeType}
+		if got := decryptionErrorBody(msg, err); got != tc.want {
+			t.Errorf("decryptionErrorBody(%v) = %q, want %q", tc.mimeType, got, tc.want)
+		}
+	}
+}
+
+func formatBodyStructure(t *testing.T, bs *imap.BodyStructure) string {
+	var b bytes.Buffer
+	resp := &imap.DataResp{Fields: bs.Format()}
+	if err := resp.WriteTo(imap.NewWriter(&b)); err != nil {
+		t.Fatalf("cannot format body structure: %v", err)
+	}
+	return b.String()
+}
+
+func TestCachedBodyStructure(t *testing.T) {
+	tests := []struct {
+		name, msg string
+	}{
+		{
+			name: "single part",
+			msg: "Content-Type: text/plain; charset=utf-8\r\n" +
+				"\r\n" +
+				"Hello\r\n",
+		},
+		{
+			name: "multipart",
+			msg: "Content-Type: multipart/mixed; boundary=b\r\n" +
+				"\r\n" +
+				"--b\r\n" +
+				"Content-Type: text/html\r\n" +
+				"\r\n" +
+				"<p>Hello</p>\r\n" +
+				"--b\r\n" +
+				"Content-Type: application/pdf\r\n" +
+				"Content-Disposition: attachment; filename=a.pdf\r\n" +
+				"Content-Transfer-Encoding: base64\r\n" +
+				"\r\n" +
+				"AAAA\r\n" +
+				"--b--\r\n",
+		},
+		{
+			name: "attached message",
+			msg: "Content-Type: multipart/mixed; boundary=b\r\n" +
+				"\r\n" +
+				"--b\r\n" +
+				"Content-Type: message/rfc822\r\n" +
+				"\r\n" +
+				"From: alice@example.org\r\n" +
+				"Subject: Hi\r\n" +
+				"Date: Mon, 02 Jan 2006 15:04:05 +0000\r\n" +
+				"Content-Type: text/plain\r\n" +
+				"\r\n" +
+				"Hi\r\n" +
+				"--b--\r\n",
+		},
+	}
+	for _, tc := range tests {
+		for _, extended := range []bool{false, true} {
+			msg := func() (textproto.Header, *bufio.Reader) {
+				br := bufio.NewReader(strings.NewReader(tc.msg))
+				h, err := textproto.ReadHeader(br)
+				if err != nil {
+					t.Fatalf("%v: cannot read header: %v", tc.name, err)
+				}
+				return h, br
+			}
+
+			h, br := msg()
+			want, err := backendutil.FetchBodyStructure(h, br, extended)
+			if err != nil {
+				t.Fatalf("%v: FetchBodyStructure() = %v", tc.name, err)
+			}
+
+			h, br = msg()
+			bs, err := backendutil.FetchBodyStructure(h, br, true)
+			if err != nil {
+				t.Fatalf("%v: FetchBodyStructure() = %v", tc.name, err)
+			}
+			b, err := json.Marshal(bs)
+			if err != nil {
+				t.Fatalf("%v: cannot encode body structure: %v", tc.name, err)
+			}
+			got := new(imap.BodyStructure)
+			if err := json.Unmarshal(b, got); err != nil {
+				t.Fatalf("%v: cannot decode body structure: %v", tc.name, err)
+			}
+			setExtended(got, extended)
+
+			if got, want := formatBodyStructure(t, got), formatBodyStructure(t, want); got != want {
+				t.Errorf("%v (extended: %v): cached body structure = %v, want %v", tc.name, extended, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	pgperrors "golang.org/x/crypto/openpgp/errors"
+	"golang.org/x/crypto/openpgp/packet"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// isMIMEBody returns true if the decrypted body of a message is a complete
+// MIME entity, which is the case for PGP/MIME messages sent by external
+// users.
+func isMIMEBody(msg *protonmail.Message) bool {
+	return msg.IsEncrypted == protonmail.MessageEncryptedPGPMIME || msg.MIMEType == "multipart/mixed"
+}
+
+// mimeMessage returns the header and the body of a message whose decrypted
+// body is a MIME entity. msg must have been fetched with GetMessage.
+//
+// The entity is returned as-is, without re-wrapping it or reordering its
+// parts, so that signatures made by the sender (e.g. multipart/signed) can
+// still be verified by the client. Only the content header fields of the
+// entity are merged into the message header.
+func (mbox *mailbox) mimeMessage(ctx context.Context, msg *protonmail.Message) (textproto.Header, []byte, error) {
+	mbox.u.learnAutocrypt(msg)
+	h := messageHeader(msg)
+
+	b, sig, err := mbox.u.decryptBody(ctx, msg)
+	if err != nil {
+		mbox.u.logger.Warn("cannot decrypt message body", "message", msg.ID, "error", err)
+		h.SetContentType("text/html", map[string]string{"charset": "utf-8"})
+		h.Set("X-Pm-Decryption-Error", decryptionError(err))
+		setAuthenticationResults(&h, msg, nil)
+		return h.Header, []byte(decryptionErrorBody(msg, err)), nil
+	}
+
+	r := bytes.NewReader(b)
+	br := bufio.NewReader(r)
+	eh, err := textproto.ReadHeader(br)
+	if err != nil {
+		return textproto.Header{}, nil, fmt.Errorf("cannot parse MIME body of message %v: %v", msg.ID, err)
+	}
+	// Slice the decrypted body instead of copying it, it can be large
+	body := b[len(b)-r.Len()-br.Buffered():]
+
+	h.Del("Content-Type")
+	fields := eh.Fields()
+	for fields.Next() {
+		if strings.HasPrefix(strings.ToLower(fields.Key()), "content-") {
+			h.Add(fields.Key(), fields.Value())
+		}
+	}
+
+	// The signature of PGP/MIME messages is usually in a multipart/signed
+	// part rather than in the encrypted OpenPGP message
+	if t, params, err := mime.ParseMediaType(eh.Get("Content-Type")); err == nil && strings.EqualFold(t, "multipart/signed") && sig.Result == "none" {
+		sig = verifyMultipartSigned(body, params["boundary"], mbox.u.verificationKeyRing(ctx, msg))
+	}
+	setAuthenticationResults(&h, msg, sig)
+
+	return h.Header, body, nil
+}
+
+// splitMultipartSigned returns the raw signed content and the signature part
+// of a multipart/signed body.
+func splitMultipartSigned(body []byte, boundary string) (content, sigPart []byte, err error) {
+	if boundary == "" {
+		return nil, nil, errors.New("missing boundary")
+	}
+	delim := []byte("--" + boundary)
+
+	var start int
+	if bytes.HasPrefix(body, delim) {
+		start = len(delim)
+	} else if i := bytes.Index(body, append([]byte("\n"), delim...)); i >= 0 {
+		start = i + 1 + len(delim)
+	} else {
+		return nil, nil, errors.New("missing first part")
+	}
+	// Skip the rest of the delimiter line
+	i := bytes.IndexByte(body[start:], '\n')
+	if i < 0 {
+		return nil, nil, errors.New("malformed delimiter")
+	}
+	start += i + 1
+
+	end := bytes.Index(body[start:], append([]byte("\n"), delim...))
+	if end < 0 {
+		return nil, nil, errors.New("missing signature part")
+	}
+	content = body[start : start+end]
+	content = bytes.TrimSuffix(content, []byte("\r"))
+
+	rest := body[start+end+1+len(delim):]
+	if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+		rest = rest[i+1:]
+	}
+	if i := bytes.Index(rest, append([]byte("\n"), delim...)); i >= 0 {
+		rest = rest[:i]
+	}
+	return content, rest, nil
+}
+
+// canonicalizeLineEndings converts line endings to CRLF, as required to
+// verify signatures of MIME entities (RFC 3156 section 5).
+func canonicalizeLineEndings(b []byte) []byte {
+	b = bytes.Replace(b, []byte("\r\n"), []byte("\n"), -1)
+	return bytes.Replace(b, []byte("\n"), []byte("\r\n"), -1)
+}
+
+// verifyMultipartSigned checks the signature of a multipart/signed body.
+func verifyMultipartSigned(body []byte, boundary string, keyRing openpgp.KeyRing) *signatureResult {
+	content, sigPart, err := splitMultipartSigned(body, boundary)
+	if err != nil {
+		logger.Warn("cannot parse multipart/signed message", "error", err)
+		return &signatureResult{Result: "fail"}
+	}
+
+	br := bufio.NewReader(bytes.NewReader(sigPart))
+	sh, err := textproto.ReadHeader(br)
+	if err != nil {
+		return &signatureResult{Result: "fail"}
+	}
+	sr, err := decodeTransferEncoding(sh.Get("Content-Transfer-Encoding"), br)
+	if err != nil {
+		return &signatureResult{Result: "fail"}
+	}
+	block, err := armor.Decode(sr)
+	if err != nil {
+		return &signatureResult{Result: "fail"}
+	}
+	sigData, err := ioutil.ReadAll(block.Body)
+	if err != nil {
+		return &signatureResult{Result: "fail"}
+	}
+
+	var keyID uint64
+	if p, err := packet.Read(bytes.NewReader(sigData)); err == nil {
+		if sig, ok := p.(*packet.Signature); ok && sig.IssuerKeyId != nil {
+			keyID = *sig.IssuerKeyId
+		}
+	}
+
+	_, err = openpgp.CheckDetachedSignature(keyRing, bytes.NewReader(canonicalizeLineEndings(content)), bytes.NewReader(sigData), nil)
+	switch err {
+	case nil:
+		return &signatureResult{Result: "pass", KeyID: keyID}
+	case pgperrors.ErrUnknownIssuer:
+		return &signatureResult{Result: "neutral", KeyID: keyID}
+	default:
+		return &signatureResult{Result: "fail", KeyID: keyID}
+	}
+}
@@ -0,0 +1,152 @@
+package imap
+
+import (
+	"time"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+const (
+	retentionInterval = time.Hour
+	retentionPageSize = 150
+)
+
+// applyRetention removes messages added to a mailbox more than maxAge ago.
+// Messages in Trash and Spam are permanently deleted, other messages are moved
+// to Trash.
+//
+// The age of a message is measured from the time it's been added to the
+// mailbox, not from its date: an old message moved to Trash a minute ago isn't
+// deleted. See retentionCandidates.
+func (u *user) applyRetention(mbox *mailbox, maxAge time.Duration) error {
+	if err := mbox.init(); err != nil {
+		return err
+	}
+
+	ctx, cancel := u.context()
+	defer cancel()
+
+	// Messages can't have been added to the mailbox before their date
+	cutoff := time.Now().Add(-maxAge)
+	filter := &protonmail.MessageFilter{
+		PageSize: retentionPageSize,
+		Label:    mbox.label,
+		End:      cutoff.Unix(),
+	}
+
+	// List all candidates before removing any, so that pages don't shift
+	var apiIDs []string
+	for {
+		if err := u.backend.options.Throttle.Wait(ctx); err != nil {
+			return err
+		}
+		_, page, err := u.c.ListMessages(ctx, filter)
+		if err != nil {
+			return err
+		}
+		expired, err := mbox.retentionCandidates(page, cutoff)
+		if err != nil {
+			return err
+		}
+		apiIDs = append(apiIDs, expired...)
+		if len(page) < filter.PageSize {
+			break
+		}
+		filter.Page++
+	}
+
+	for i := 0; i < len(apiIDs); i += retentionPageSize {
+		batch := apiIDs[i:]
+		if len(batch) > retentionPageSize {
+			batch = batch[:retentionPageSize]
+		}
+
+		if err := u.backend.options.Throttle.Wait(ctx); err != nil {
+			return err
+		}
+		var err error
+		switch mbox.label {
+		case protonmail.LabelTrash, protonmail.LabelSpam:
+			err = u.c.DeleteMessages(ctx, batch)
+		default:
+			err = u.c.LabelMessages(ctx, protonmail.LabelTrash, batch)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(apiIDs) > 0 {
+		u.logger.Info("retention policy removed messages", "mailbox", mbox.name, "count", len(apiIDs))
+	}
+	return nil
+}
+
+// retentionCandidates returns the IDs of the messages which have been added to
+// the mailbox before cutoff. Messages without a save date have been in the
+// mailbox since its first synchronization at least. Messages which haven't
+// been synchronized yet are left alone, it's unknown when they've been added.
+func (mbox *mailbox) retentionCandidates(messages []*protonmail.Message, cutoff time.Time) ([]string, error) {
+	syncTime, err := mbox.db.SyncTime()
+	if err != nil || syncTime.IsZero() {
+		return nil, err
+	}
+
+	known := make(map[string]bool)
+	err = mbox.db.ForEach(func(seqNum, uid uint32, apiID string) error {
+		known[apiID] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var apiIDs []string
+	for _, msg := range messages {
+		if !known[msg.ID] {
+			continue
+		}
+		t, err := mbox.db.SaveDate(msg.ID)
+		if err != nil {
+			return nil, err
+		}
+		if t.IsZero() {
+			t = syncTime
+		}
+		if t.Before(cutoff) {
+			apiIDs = append(apiIDs, msg.ID)
+		}
+	}
+	return apiIDs, nil
+}
+
+func (u *user) enforceRetention(done <-chan struct{}) {
+	t := time.NewTicker(retentionInterval)
+	defer t.Stop()
+
+	for {
+		for name, maxAge := range u.backend.options.Retention {
+			mbox := u.getMailbox(name)
+			if mbox == nil {
+				u.logger.Warn("cannot apply retention policy: unknown mailbox", "mailbox", name)
+				continue
+			}
+			// Messages in labels are also in a folder, moving them to Trash
+			// doesn't necessarily remove them from the mailbox
+			if mbox.isLabel() {
+				u.logger.Warn("cannot apply retention policy to a label", "mailbox", name)
+				continue
+			}
+
+			if err := u.applyRetention(mbox, maxAge); err != nil {
+				u.logger.Warn("cannot apply retention policy", "mailbox", name, "error", err)
+			}
+		}
+
+		select {
+		case <-t.C:
+		case <-done:
+			return
+		}
+	}
+}
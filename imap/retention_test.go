@@ -0,0 +1,56 @@
+package imap
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/hydroxide/config"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestRetentionCandidates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hydroxide-imap-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config.SetDir(dir)
+	defer config.SetDir("")
+
+	// a was there during the first sync, b has been added afterwards
+	db := openTestMailbox(t, "alice.db", []string{"a"})
+	if _, _, err := db.Sync([]*protonmail.Message{{ID: "a"}, {ID: "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	mbox := &mailbox{name: "Trash", db: db}
+
+	// All messages are years old
+	old := protonmail.Timestamp(time.Date(2010, time.January, 1, 0, 0, 0, 0, time.UTC).Unix())
+	messages := []*protonmail.Message{
+		{ID: "a", Time: old},
+		{ID: "b", Time: old},
+		{ID: "c", Time: old},
+	}
+
+	now := time.Now()
+	tests := []struct {
+		name   string
+		cutoff time.Time
+		want   []string
+	}{
+		{name: "recently added", cutoff: now.Add(-time.Hour), want: nil},
+		{name: "expired", cutoff: now.Add(time.Hour), want: []string{"a", "b"}},
+	}
+	for _, tc := range tests {
+		got, err := mbox.retentionCandidates(messages, tc.cutoff)
+		if err != nil {
+			t.Fatalf("%v: retentionCandidates() = %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: retentionCandidates() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/server"
+)
+
+const saveDateCapability = "SAVEDATE"
+
+const fetchSaveDate imap.FetchItem = "SAVEDATE"
+
+// saveDateCriteria contains the SEARCH keys defined in RFC 8514. Since is
+// inclusive and Before exclusive, SAVEDON is the day starting at Since.
+type saveDateCriteria struct {
+	Since  time.Time
+	Before time.Time
+}
+
+func (c *saveDateCriteria) match(t time.Time) bool {
+	// Only the day is compared, in UTC
+	date := t.UTC().Truncate(24 * time.Hour)
+	if !c.Since.IsZero() && date.Before(c.Since) {
+		return false
+	}
+	if !c.Before.IsZero() && !date.Before(c.Before) {
+		return false
+	}
+	return true
+}
+
+// searchKeyArgs is the number of arguments of RFC 3501 search keys, used to
+// find search keys which aren't arguments of other keys.
+var searchKeyArgs = map[string]int{
+	"BCC": 1, "BEFORE": 1, "BODY": 1, "CC": 1, "FROM": 1, "KEYWORD": 1,
+	"LARGER": 1, "ON": 1, "SENTBEFORE": 1, "SENTON": 1, "SENTSINCE": 1,
+	"SINCE": 1, "SMALLER": 1, "SUBJECT": 1, "TEXT": 1, "TO": 1, "UID": 1,
+	"UNKEYWORD": 1, "HEADER": 2,
+}
+
+type searchHandler struct {
+	charset  string
+	criteria *imap.SearchCriteria
+	saveDate saveDateCriteria
+	// RFC 7162 MODSEQ key, zero if absent
+	modSeq uint64
+}
+
+func parseSaveDate(fields []interface{}) (time.Time, error) {
+	if len(fields) == 0 {
+		return time.Time{}, errors.New("Missing date")
+	}
+	s, _ := fields[0].(string)
+	t, err := time.Parse(imap.DateLayout, s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t, nil
+}
+
+func (h *searchHandler) Parse(fields []interface{}) error {
+	if len(fields) == 0 {
+		return errors.New("Missing search criteria")
+	}
+
+	if f, ok := fields[0].(string); ok && strings.EqualFold(f, "CHARSET") {
+		if len(fields) < 2 {
+			return errors.New("Missing CHARSET value")
+		}
+		if h.charset, ok = fields[1].(string); !ok {
+			return errors.New("Charset must be a string")
+		}
+		fields = fields[2:]
+	}
+
+	// Extract RFC 8514 keys, pass the others to go-imap. The extracted keys
+	// are matched against all messages, so they can't be operands of NOT or
+	// OR: operands counts the keys which are.
+	var rest []interface{}
+	operands := 0
+	for len(fields) > 0 {
+		key, _ := fields[0].(string)
+		key = strings.ToUpper(key)
+
+		operand := operands > 0
+		if operand {
+			operands--
+		}
+		switch key {
+		case "NOT":
+			operands++
+		case "OR":
+			operands += 2
+		case "SAVEDBEFORE", "SAVEDON", "SAVEDSINCE", "MODSEQ":
+			if operand {
+				return fmt.Errorf("%v can't be used with NOT or OR", key)
+			}
+		}
+
+		switch key {
+		case "SAVEDBEFORE", "SAVEDON", "SAVEDSINCE":
+			t, err := parseSaveDate(fields[1:])
+			if err != nil {
+				return err
+			}
+			switch key {
+			case "SAVEDBEFORE":
+				h.saveDate.Before = t
+			case "SAVEDON":
+				h.saveDate.Since = t
+				h.saveDate.Before = t.Add(24 * time.Hour)
+			case "SAVEDSINCE":
+				h.saveDate.Since = t
+			}
+			fields = fields[2:]
+		case "MODSEQ":
+			// The optional entry name and type are ignored, there's only one
+			// modification sequence per message
+			n := 1
+			if len(fields) > 3 {
+				if _, err := parseModSeq(fields[1]); err != nil {
+					n = 3
+				}
+			}
+			if len(fields) <= n {
+				return errors.New("Missing modification sequence")
+			}
+			modSeq, err := parseModSeq(fields[n])
+			if err != nil {
+				return err
+			}
+			if modSeq == 0 {
+				// Matches all messages
+				modSeq = 1
+			}
+			h.modSeq = modSeq
+			fields = fields[n+1:]
+		case "SAVEDATESUPPORTED":
+			// All mailboxes support SAVEDATE
+			fields = fields[1:]
+		default:
+			n := 1 + searchKeyArgs[key]
+			if n > len(fields) {
+				n = len(fields)
+			}
+			rest = append(rest, fields[:n]...)
+			fields = fields[n:]
+		}
+	}
+
+	var charsetReader func(io.Reader) io.Reader
+	charset := strings.ToLower(h.charset)
+	if charset != "utf-8" && charset != "us-ascii" && charset != "" {
+		charsetReader = func(r io.Reader) io.Reader {
+			r, _ = imap.CharsetReader(charset, r)
+			return r
+		}
+	}
+
+	h.criteria = new(imap.SearchCriteria)
+	if len(rest) == 0 {
+		return nil
+	}
+	return h.criteria.ParseWithCharset(rest, charsetReader)
+}
+
+func (h *searchHandler) handle(uid bool, conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return server.ErrNoMailboxSelected
+	}
+
+	mbox := modSeqMailbox(ctx.Mailbox)
+	if mbox == nil {
+		if h.modSeq > 0 {
+			return errors.New("Mailbox doesn't support modification sequences")
+		}
+		ids, err := ctx.Mailbox.SearchMessages(uid, h.criteria)
+		if err != nil {
+			return err
+		}
+		return conn.WriteResp(&responses.Search{Ids: ids})
+	}
+
+	ids, err := mbox.searchMessages(uid, h.criteria, &h.saveDate, h.modSeq)
+	if err != nil {
+		return err
+	}
+	if h.modSeq == 0 || len(ids) == 0 {
+		return conn.WriteResp(&responses.Search{Ids: ids})
+	}
+
+	// With MODSEQ, the highest modification sequence of the results is
+	// appended (RFC 7162 section 3.1.5)
+	highest, err := mbox.highestModSeq(uid, ids)
+	if err != nil {
+		return err
+	}
+	fields := []interface{}{imap.RawString("SEARCH")}
+	for _, id := range ids {
+		fields = append(fields, id)
+	}
+	fields = append(fields, []interface{}{imap.RawString("MODSEQ"), formatModSeq(highest)})
+	return conn.WriteResp(&imap.DataResp{Fields: fields})
+}
+
+func (h *searchHandler) Handle(conn server.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *searchHandler) UidHandle(conn server.Conn) error {
+	return h.handle(true, conn)
+}
+
+type saveDateExtension struct{}
+
+// NewSaveDateExtension returns an extension implementing SAVEDATE (RFC 8514).
+func NewSaveDateExtension() server.Extension {
+	return &saveDateExtension{}
+}
+
+func (ext *saveDateExtension) Capabilities(c server.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{saveDateCapability}
+	}
+	return nil
+}
+
+func (ext *saveDateExtension) Command(name string) server.HandlerFactory {
+	if name != "SEARCH" {
+		return nil
+	}
+
+	return func() server.Handler {
+		return &searchHandler{}
+	}
+}
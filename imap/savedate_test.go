@@ -0,0 +1,163 @@
+package imap
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSaveDateCriteriaMatch(t *testing.T) {
+	feb1 := time.Date(2020, time.February, 1, 0, 0, 0, 0, time.UTC)
+	feb2 := feb1.Add(24 * time.Hour)
+	since := saveDateCriteria{Since: feb1}
+	before := saveDateCriteria{Before: feb1}
+	on := saveDateCriteria{Since: feb1, Before: feb2}
+
+	tests := []struct {
+		name     string
+		criteria saveDateCriteria
+		t        time.Time
+		want     bool
+	}{
+		{"since, day before", since, feb1.Add(-time.Minute), false},
+		{"since, same day", since, feb1.Add(18 * time.Hour), true},
+		{"since, day after", since, feb2.Add(time.Hour), true},
+		{"before, day before", before, feb1.Add(-time.Minute), true},
+		{"before, same day", before, feb1, false},
+		{"on, start of the day", on, feb1, true},
+		{"on, end of the day", on, feb2.Add(-time.Minute), true},
+		{"on, day after", on, feb2, false},
+		{"on, other time zone", on, time.Date(2020, time.February, 1, 23, 0, 0, 0, time.FixedZone("", -2*60*60)), false},
+		{"none", saveDateCriteria{}, feb1, true},
+	}
+	for _, tc := range tests {
+		if got := tc.criteria.match(tc.t); got != tc.want {
+			t.Errorf("%v: match(%v) = %v, want %v", tc.name, tc.t, got, tc.want)
+		}
+	}
+}
+
+func TestSearchHandlerParse(t *testing.T) {
+	feb1 := time.Date(2020, time.February, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		fields   []interface{}
+		charset  string
+		saveDate saveDateCriteria
+		modSeq   uint64
+		subject  string
+		seen     bool
+		err      bool
+	}{
+		{
+			name:    "regular keys",
+			fields:  []interface{}{"SUBJECT", "hello", "SEEN"},
+			subject: "hello",
+			seen:    true,
+		},
+		{
+			name:    "charset",
+			fields:  []interface{}{"CHARSET", "UTF-8", "SUBJECT", "hello"},
+			charset: "UTF-8",
+			subject: "hello",
+		},
+		{
+			name:     "SAVEDSINCE",
+			fields:   []interface{}{"SAVEDSINCE", "1-Feb-2020", "SEEN"},
+			saveDate: saveDateCriteria{Since: feb1},
+			seen:     true,
+		},
+		{
+			name:     "SAVEDBEFORE",
+			fields:   []interface{}{"savedbefore", "1-Feb-2020"},
+			saveDate: saveDateCriteria{Before: feb1},
+		},
+		{
+			name:     "SAVEDON",
+			fields:   []interface{}{"SAVEDON", "1-Feb-2020"},
+			saveDate: saveDateCriteria{Since: feb1, Before: feb1.Add(24 * time.Hour)},
+		},
+		{
+			name:   "SAVEDATESUPPORTED",
+			fields: []interface{}{"SAVEDATESUPPORTED", "SEEN"},
+			seen:   true,
+		},
+		{
+			name:    "SAVEDSINCE as an argument",
+			fields:  []interface{}{"SUBJECT", "SAVEDSINCE"},
+			subject: "SAVEDSINCE",
+		},
+		{
+			name:   "MODSEQ",
+			fields: []interface{}{"MODSEQ", "620", "SEEN"},
+			modSeq: 620,
+			seen:   true,
+		},
+		{
+			name:   "MODSEQ with entry",
+			fields: []interface{}{"MODSEQ", "/flags/\\draft", "all", "620"},
+			modSeq: 620,
+		},
+		{
+			name:   "MODSEQ 0",
+			fields: []interface{}{"MODSEQ", "0"},
+			modSeq: 1,
+		},
+		{
+			name:     "OR before SAVEDSINCE",
+			fields:   []interface{}{"OR", "SEEN", "FLAGGED", "SAVEDSINCE", "1-Feb-2020"},
+			saveDate: saveDateCriteria{Since: feb1},
+		},
+		{
+			name:   "NOT before MODSEQ",
+			fields: []interface{}{"NOT", "OR", "SEEN", "FLAGGED", "MODSEQ", "5"},
+			modSeq: 5,
+		},
+		{
+			name:   "NOT with a list before MODSEQ",
+			fields: []interface{}{"NOT", []interface{}{"SEEN", "FLAGGED"}, "MODSEQ", "5"},
+			modSeq: 5,
+		},
+		{name: "NOT SAVEDSINCE", fields: []interface{}{"NOT", "SAVEDSINCE", "1-Feb-2020"}, err: true},
+		{name: "OR SAVEDBEFORE", fields: []interface{}{"OR", "SEEN", "SAVEDBEFORE", "1-Feb-2020"}, err: true},
+		{name: "nested OR SAVEDON", fields: []interface{}{"OR", "OR", "SEEN", "SAVEDON", "1-Feb-2020", "FLAGGED"}, err: true},
+		{name: "NOT MODSEQ", fields: []interface{}{"NOT", "MODSEQ", "5"}, err: true},
+		{name: "NOT NOT MODSEQ", fields: []interface{}{"NOT", "NOT", "MODSEQ", "5"}, err: true},
+		{name: "empty", fields: nil, err: true},
+		{name: "missing date", fields: []interface{}{"SAVEDSINCE"}, err: true},
+		{name: "invalid date", fields: []interface{}{"SAVEDSINCE", "yesterday"}, err: true},
+		{name: "missing modseq", fields: []interface{}{"MODSEQ"}, err: true},
+		{name: "invalid modseq", fields: []interface{}{"MODSEQ", "x"}, err: true},
+		{name: "missing charset", fields: []interface{}{"CHARSET"}, err: true},
+	}
+	for _, tc := range tests {
+		var h searchHandler
+		err := h.Parse(tc.fields)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%v: Parse() succeeded", tc.name)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%v: Parse() = %v", tc.name, err)
+			continue
+		}
+
+		if h.charset != tc.charset {
+			t.Errorf("%v: charset = %q, want %q", tc.name, h.charset, tc.charset)
+		}
+		if !h.saveDate.Since.Equal(tc.saveDate.Since) || !h.saveDate.Before.Equal(tc.saveDate.Before) {
+			t.Errorf("%v: save date = %v, want %v", tc.name, h.saveDate, tc.saveDate)
+		}
+		if h.modSeq != tc.modSeq {
+			t.Errorf("%v: modseq = %v, want %v", tc.name, h.modSeq, tc.modSeq)
+		}
+		if got := h.criteria.Header.Get("Subject"); got != tc.subject {
+			t.Errorf("%v: subject = %q, want %q", tc.name, got, tc.subject)
+		}
+		seen := len(h.criteria.WithFlags) == 1 && h.criteria.WithFlags[0] == "\\Seen"
+		if seen != tc.seen {
+			t.Errorf("%v: seen = %v, want %v", tc.name, seen, tc.seen)
+		}
+	}
+}
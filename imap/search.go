@@ -0,0 +1,467 @@
+package imap
+
+import (
+	"context"
+	"errors"
+	"mime"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/charset"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/emersion/hydroxide/imap/database"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func init() {
+	// Allows clients to send SEARCH criteria in charsets other than UTF-8
+	imap.CharsetReader = charset.Reader
+}
+
+var errSearchIndexDisabled = errors.New("the local search index is disabled, message bodies can't be searched")
+
+var wordDecoder = mime.WordDecoder{CharsetReader: charset.Reader}
+
+// normalizeText converts s to a canonical form for matching: composed and
+// decomposed characters compare equal, and case is ignored.
+func normalizeText(s string) string {
+	return strings.ToLower(norm.NFKC.String(s))
+}
+
+// decodeHeaderValue decodes RFC 2047 encoded-words in a raw header value. If
+// the value is malformed, it's returned unchanged.
+func decodeHeaderValue(v string) string {
+	if decoded, err := wordDecoder.DecodeHeader(v); err == nil {
+		return decoded
+	}
+	return v
+}
+
+// htmlToText strips tags from an HTML document. It only needs to be good
+// enough to extract words for the search index.
+func htmlToText(s string) string {
+	var sb strings.Builder
+	inTag := false
+	for _, r := range s {
+		switch {
+		case r == '<':
+			inTag = true
+		case r == '>':
+			inTag = false
+			sb.WriteRune(' ')
+		case !inTag:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// tokenize splits s into normalized words.
+func tokenize(s string) []string {
+	s = normalizeText(s)
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	seen := make(map[string]struct{}, len(fields))
+	tokens := make([]string, 0, len(fields))
+	for _, f := range fields {
+		if _, ok := seen[f]; ok {
+			continue
+		}
+		seen[f] = struct{}{}
+		tokens = append(tokens, f)
+	}
+	return tokens
+}
+
+// messageText returns the searchable text of a message: its decrypted body
+// and the names of its attachments. If the body can't be decrypted, only the
+// attachment names are returned, so that the message isn't indexed again and
+// again.
+func (u *user) messageText(ctx context.Context, apiID string) (body string, attachments []string, err error) {
+	throttle := u.backend.options.Throttle
+	if err := throttle.Wait(ctx); err != nil {
+		return "", nil, err
+	}
+	msg, err := u.getMessage(ctx, apiID)
+	if err != nil {
+		return "", nil, err
+	}
+	throttle.Consume(len(msg.Body))
+
+	b, _, err := u.decryptBody(ctx, msg)
+	if err != nil {
+		u.logger.Warn("cannot decrypt message body, only attachment names are searchable", "message", apiID, "error", err)
+	} else {
+		body = string(b)
+		if msg.MIMEType != "text/plain" {
+			body = htmlToText(body)
+		}
+	}
+	for _, att := range msg.Attachments {
+		attachments = append(attachments, att.Name)
+	}
+	return body, attachments, nil
+}
+
+func (u *user) indexMessage(ctx context.Context, apiID string) error {
+	body, attachments, err := u.messageText(ctx, apiID)
+	if err != nil {
+		return err
+	}
+
+	tokens := tokenize(body)
+	for _, name := range attachments {
+		tokens = append(tokens, tokenize(name)...)
+	}
+
+	return u.searchIndex.Index(apiID, tokens)
+}
+
+// indexQueueSize is the number of received messages waiting to be indexed.
+// When the queue is full, messages are indexed by the next SEARCH instead.
+const indexQueueSize = 256
+
+// queueIndex schedules the indexing of a new message in the background.
+func (u *user) queueIndex(apiID string) {
+	if u.searchIndex == nil {
+		return
+	}
+	select {
+	case u.indexQueue <- apiID:
+	default:
+	}
+}
+
+// unindex removes a message from the search index.
+func (u *user) unindex(apiID string) {
+	if u.searchIndex == nil {
+		return
+	}
+	if err := u.searchIndex.Remove(apiID); err != nil {
+		u.logger.Warn("cannot remove message from search index", "message", apiID, "error", err)
+	}
+}
+
+// reindex indexes a message again, e.g. after its body has changed.
+func (u *user) reindex(apiID string) {
+	u.unindex(apiID)
+	u.queueIndex(apiID)
+}
+
+func (u *user) indexNewMessages(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case apiID := <-u.indexQueue:
+			indexed, err := u.searchIndex.IsIndexed(apiID)
+			if err != nil {
+				u.logger.Warn("cannot index message", "message", apiID, "error", err)
+				continue
+			} else if indexed {
+				continue
+			}
+
+			ctx, cancel := u.context()
+			err = u.indexMessage(ctx, apiID)
+			cancel()
+			if err != nil {
+				u.logger.Warn("cannot index message", "message", apiID, "error", err)
+			}
+		}
+	}
+}
+
+// apiIDs returns the IDs of the messages in the mailbox.
+func (mbox *mailbox) apiIDs() ([]string, error) {
+	var apiIDs []string
+	err := mbox.db.ForEach(func(seqNum, uid uint32, apiID string) error {
+		apiIDs = append(apiIDs, apiID)
+		return nil
+	})
+	return apiIDs, err
+}
+
+// indexMailbox starts adding the messages of the mailbox which aren't in the
+// search index yet, in the background. Messages are only downloaded and
+// decrypted the first time. It returns the number of messages which aren't
+// indexed yet.
+func (mbox *mailbox) indexMailbox() (int, error) {
+	if mbox.u.searchIndex == nil {
+		return 0, errSearchIndexDisabled
+	}
+
+	apiIDs, err := mbox.apiIDs()
+	if err != nil {
+		return 0, err
+	}
+
+	var pending []string
+	for _, apiID := range apiIDs {
+		indexed, err := mbox.u.searchIndex.IsIndexed(apiID)
+		if err != nil {
+			return 0, err
+		}
+		if !indexed {
+			pending = append(pending, apiID)
+		}
+	}
+	if len(pending) == 0 {
+		return 0, nil
+	}
+
+	mbox.Lock()
+	indexing := mbox.indexing
+	mbox.indexing = true
+	mbox.Unlock()
+	if !indexing {
+		go mbox.indexMessages(pending)
+	}
+	return len(pending), nil
+}
+
+// indexMessages adds messages of the mailbox to the search index. It stops
+// when the last client logs out.
+func (mbox *mailbox) indexMessages(apiIDs []string) {
+	defer func() {
+		mbox.Lock()
+		mbox.indexing = false
+		mbox.Unlock()
+	}()
+
+	mbox.u.logger.Info("indexing messages", "mailbox", mbox.name, "count", len(apiIDs))
+	n := 0
+	for _, apiID := range apiIDs {
+		if mbox.u.ctx.Err() != nil {
+			return
+		}
+
+		// The message may have been indexed when it was received
+		indexed, err := mbox.u.searchIndex.IsIndexed(apiID)
+		if err != nil {
+			mbox.u.logger.Warn("cannot index message", "message", apiID, "error", err)
+			continue
+		} else if indexed {
+			continue
+		}
+
+		ctx, cancel := mbox.u.context()
+		err = mbox.u.indexMessage(ctx, apiID)
+		cancel()
+		if err != nil {
+			mbox.u.logger.Warn("cannot index message", "message", apiID, "error", err)
+			continue
+		}
+		n++
+	}
+	mbox.u.logger.Info("indexed messages", "mailbox", mbox.name, "count", n)
+}
+
+// maxScannedMessages is the maximum number of messages whose bodies are
+// decrypted and scanned by a SEARCH, for terms which aren't words of the index.
+const maxScannedMessages = 100
+
+// searchBody returns the set of messages whose body contains each one of the
+// provided strings.
+//
+// Terms are looked up in the search index, which only contains whole words.
+// If one of the words of a term isn't in the index, e.g. because the term is
+// the beginning of a word, it only matches the messages of scanned, whose
+// bodies are scanned. scanned is nil unless the search is restricted to a few
+// messages, see scanCandidates: scanning the whole mailbox would download and
+// decrypt every message.
+func (mbox *mailbox) searchBody(terms []string, scanned map[string]struct{}) ([]map[string]struct{}, error) {
+	results := make([]map[string]struct{}, len(terms))
+	for i, term := range terms {
+		tokens := tokenize(term)
+		indexed := len(tokens) > 0
+		for _, token := range tokens {
+			ok, err := mbox.u.searchIndex.HasToken(token)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				indexed = false
+				break
+			}
+		}
+
+		var err error
+		if indexed {
+			results[i], err = mbox.u.searchIndex.Search(tokens)
+		} else if scanned != nil {
+			results[i], err = mbox.scanBody(term, scanned)
+		} else {
+			results[i] = make(map[string]struct{})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// scanBody returns the set of messages of candidates whose body contains term,
+// by decrypting them.
+func (mbox *mailbox) scanBody(term string, candidates map[string]struct{}) (map[string]struct{}, error) {
+	results := make(map[string]struct{})
+	for apiID := range candidates {
+		ctx, cancel := mbox.u.context()
+		body, attachments, err := mbox.u.messageText(ctx, apiID)
+		cancel()
+		if err != nil {
+			mbox.u.logger.Warn("cannot search message", "message", apiID, "error", err)
+			continue
+		}
+
+		if matchString(body, term) {
+			results[apiID] = struct{}{}
+			continue
+		}
+		for _, name := range attachments {
+			if matchString(name, term) {
+				results[apiID] = struct{}{}
+				break
+			}
+		}
+	}
+	return results, nil
+}
+
+const serverSearchPageSize = 150
+
+// searchFilter translates SEARCH criteria into a message filter for the
+// ProtonMail servers. Only criteria which the servers are guaranteed to match
+// more loosely than the local search are translated, so that the results are a
+// superset of the matching messages: the internal date, with a margin of one
+// day. Headers aren't, the servers don't implement IMAP substring matching nor
+// decode and normalize values like matchHeader does, and neither are flags,
+// which can be overridden locally. ok is false if none of the criteria could be
+// translated, in which case the filter matches the whole mailbox.
+func (mbox *mailbox) searchFilter(c *imap.SearchCriteria) (filter *protonmail.MessageFilter, ok bool) {
+	filter = &protonmail.MessageFilter{
+		Label:    mbox.label,
+		PageSize: serverSearchPageSize,
+	}
+
+	// Dates are compared locally with a precision of one day, leave some
+	// margin to account for time zones. SENTSINCE and SENTBEFORE refer to
+	// the Date header field, which the servers don't index.
+	if !c.Since.IsZero() {
+		filter.Begin = c.Since.Add(-24 * time.Hour).Unix()
+	}
+	if !c.Before.IsZero() {
+		filter.End = c.Before.Add(24 * time.Hour).Unix()
+	}
+
+	return filter, filter.Begin != 0 || filter.End != 0
+}
+
+// listFilter returns the set of messages matching a filter.
+func (mbox *mailbox) listFilter(filter *protonmail.MessageFilter) (map[string]struct{}, error) {
+	results := make(map[string]struct{})
+	for {
+		_, page, err := mbox.listMessages(filter)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, msg := range page {
+			results[msg.ID] = struct{}{}
+		}
+		if len(page) < filter.PageSize {
+			break
+		}
+		filter.Page++
+	}
+	return results, nil
+}
+
+// searchCandidates returns a superset of the messages matching the criteria,
+// as listed by the ProtonMail servers. All criteria still need to be checked
+// locally. It returns nil if none of the criteria can be evaluated by the
+// servers.
+func (mbox *mailbox) searchCandidates(c *imap.SearchCriteria) (map[string]struct{}, error) {
+	filter, ok := mbox.searchFilter(c)
+	if !ok {
+		return nil, nil
+	}
+	return mbox.listFilter(filter)
+}
+
+// searchServer returns the set of messages matching each one of the provided
+// keywords, searched by the ProtonMail servers. The servers can't decrypt
+// bodies, so only headers are searched.
+func (mbox *mailbox) searchServer(c *imap.SearchCriteria, keywords []string) ([]map[string]struct{}, error) {
+	results := make([]map[string]struct{}, len(keywords))
+	for i, keyword := range keywords {
+		filter, _ := mbox.searchFilter(c)
+		filter.Keyword = keyword
+
+		var err error
+		if results[i], err = mbox.listFilter(filter); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+func matchHeader(msg *protonmail.Message, term string) bool {
+	// Internationalized domains are written in their ASCII form
+	asciiTerm := protonmail.ASCIIDomain(term)
+	if strings.Contains(term, "@") {
+		asciiTerm = protonmail.ASCIIAddress(term)
+	}
+
+	h := messageHeader(msg)
+	fields := h.Fields()
+	for fields.Next() {
+		v := decodeHeaderValue(fields.Value())
+		if matchString(v, term) || matchString(v, asciiTerm) {
+			return true
+		}
+	}
+	return false
+}
+
+// SearchLocal looks up messages whose body contains all words of text in the
+// local search index built by the IMAP server. The cached metadata of matching
+// messages is returned.
+//
+// The local database can't be opened while the IMAP server is running for
+// this user, in which case database.ErrLocked is returned.
+func SearchLocal(u *protonmail.User, privateKeys openpgp.EntityList, text string) ([]*protonmail.Message, error) {
+	db, err := database.OpenTimeout(u.Name+".db", time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	idx, err := db.SearchIndex(privateKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	apiIDs, err := idx.Search(tokenize(text))
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]*protonmail.Message, 0, len(apiIDs))
+	for apiID := range apiIDs {
+		msg, err := db.Message(apiID)
+		if err == database.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
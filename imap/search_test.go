@@ -0,0 +1,193 @@
+package imap
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+
+	"github.com/emersion/hydroxide/config"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestSearchFilter(t *testing.T) {
+	since := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	before := time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		criteria *imap.SearchCriteria
+		want     *protonmail.MessageFilter
+		ok       bool
+	}{
+		{
+			name:     "all",
+			criteria: &imap.SearchCriteria{},
+			want:     &protonmail.MessageFilter{},
+		},
+		{
+			name:     "body only",
+			criteria: &imap.SearchCriteria{Body: []string{"hello"}, Larger: 1024},
+			want:     &protonmail.MessageFilter{},
+		},
+		{
+			name: "headers",
+			criteria: &imap.SearchCriteria{Header: textproto.MIMEHeader{
+				"From":       {"alice@example.org"},
+				"To":         {"bob@example.org"},
+				"Subject":    {"Hello"},
+				"X-Mailer":   {"hydroxide"},
+				"Message-Id": {"<42@example.org>"},
+			}},
+			want: &protonmail.MessageFilter{},
+		},
+		{
+			name:     "dates",
+			criteria: &imap.SearchCriteria{Since: since, Before: before},
+			want: &protonmail.MessageFilter{
+				Begin: since.Add(-24 * time.Hour).Unix(),
+				End:   before.Add(24 * time.Hour).Unix(),
+			},
+			ok: true,
+		},
+		{
+			name:     "sent dates",
+			criteria: &imap.SearchCriteria{SentSince: since, SentBefore: before},
+			want:     &protonmail.MessageFilter{},
+		},
+		{
+			name: "since with headers and flags",
+			criteria: &imap.SearchCriteria{
+				Since:        since,
+				Header:       textproto.MIMEHeader{"From": {"alice"}},
+				WithoutFlags: []string{imap.SeenFlag},
+			},
+			want: &protonmail.MessageFilter{Begin: since.Add(-24 * time.Hour).Unix()},
+			ok:   true,
+		},
+		{
+			name:     "flags",
+			criteria: &imap.SearchCriteria{WithFlags: []string{imap.SeenFlag, imap.FlaggedFlag}, WithoutFlags: []string{imap.DraftFlag}},
+			want:     &protonmail.MessageFilter{},
+		},
+	}
+	for _, tc := range tests {
+		mbox := &mailbox{name: "INBOX", label: protonmail.LabelInbox}
+		filter, ok := mbox.searchFilter(tc.criteria)
+		if ok != tc.ok {
+			t.Errorf("%v: searchFilter() ok = %v, want %v", tc.name, ok, tc.ok)
+		}
+
+		tc.want.Label = protonmail.LabelInbox
+		tc.want.PageSize = serverSearchPageSize
+		if !reflect.DeepEqual(filter, tc.want) {
+			t.Errorf("%v: searchFilter() = %+v, want %+v", tc.name, filter, tc.want)
+		}
+	}
+}
+
+func TestDecodeHeaderValue(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"plain", "Hello world", "Hello world"},
+		{"Q encoding", "=?utf-8?q?Caf=C3=A9?=", "Café"},
+		{"B encoding", "=?UTF-8?B?Q2Fmw6k=?=", "Café"},
+		{"ISO-8859-1", "=?iso-8859-1?q?caf=E9?= au lait", "café au lait"},
+		{"adjacent words", "=?utf-8?q?Caf?= =?utf-8?q?=C3=A9?=", "Café"},
+		{"unknown charset", "=?x-unknown?q?abc?=", "=?x-unknown?q?abc?="},
+	}
+	for _, tc := range tests {
+		if got := decodeHeaderValue(tc.in); got != tc.want {
+			t.Errorf("%v: decodeHeaderValue(%q) = %q, want %q", tc.name, tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestNormalizeText(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"NFC", "Caf\u00e9", "caf\u00e9"},
+		{"NFD", "Cafe\u0301", "caf\u00e9"},
+		{"NFKC ligature", "\ufb01le", "file"},
+		{"NFKC full width", "\uff28\uff25\uff2c\uff2c\uff2f", "hello"},
+		{"case", "HeLLo", "hello"},
+		{"non-Latin case", "\u0394\u0395\u039b\u03a4\u0391", "\u03b4\u03b5\u03bb\u03c4\u03b1"},
+	}
+	for _, tc := range tests {
+		if got := normalizeText(tc.in); got != tc.want {
+			t.Errorf("%v: normalizeText(%q) = %q, want %q", tc.name, tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestScanCandidates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hydroxide-imap-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config.SetDir(dir)
+	defer config.SetDir("")
+
+	ids := make([]string, maxScannedMessages+1)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("m%v", i+1)
+	}
+	mbox := &mailbox{name: "INBOX", db: openTestMailbox(t, "alice.db", ids)}
+
+	seqSet := func(s string) *imap.SeqSet {
+		set, err := imap.ParseSeqSet(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return set
+	}
+
+	tests := []struct {
+		name       string
+		criteria   *imap.SearchCriteria
+		candidates map[string]struct{}
+		want       map[string]struct{}
+	}{
+		{
+			name:     "whole mailbox",
+			criteria: &imap.SearchCriteria{},
+		},
+		{
+			name:     "UIDs",
+			criteria: &imap.SearchCriteria{Uid: seqSet("1:2")},
+			want:     map[string]struct{}{"m1": {}, "m2": {}},
+		},
+		{
+			name:       "UIDs and candidates",
+			criteria:   &imap.SearchCriteria{Uid: seqSet("1:2")},
+			candidates: map[string]struct{}{"m2": {}, "m3": {}},
+			want:       map[string]struct{}{"m2": {}},
+		},
+		{
+			name:     "sequence numbers",
+			criteria: &imap.SearchCriteria{SeqNum: seqSet("3")},
+			want:     map[string]struct{}{"m3": {}},
+		},
+		{
+			name:     "too many messages",
+			criteria: &imap.SearchCriteria{SeqNum: seqSet("1:*")},
+		},
+	}
+	for _, tc := range tests {
+		got, err := mbox.scanCandidates(tc.criteria, tc.candidates)
+		if err != nil {
+			t.Fatalf("%v: scanCandidates() = %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: scanCandidates() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
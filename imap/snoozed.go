@@ -0,0 +1,50 @@
+package imap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+var errReadOnlyMailbox = errors.New("messages can't be added to this mailbox")
+
+// isReadOnlyLabel checks whether a label is managed by the official apps:
+// messages are snoozed or scheduled there, not moved over IMAP. Moving
+// messages out of these mailboxes unsnoozes or unschedules them.
+func isReadOnlyLabel(label string) bool {
+	return label == protonmail.LabelSnoozed || label == protonmail.LabelScheduled
+}
+
+// release unsnoozes or unschedules messages in a read-only mailbox, then moves
+// them to dest.
+func (mbox *mailbox) release(ctx context.Context, apiIDs []string, dest string) error {
+	if len(apiIDs) == 0 {
+		return nil
+	}
+
+	// Where messages end up once released
+	var released string
+	switch mbox.label {
+	case protonmail.LabelSnoozed:
+		if err := mbox.u.c.UnsnoozeMessages(ctx, apiIDs); err != nil {
+			return err
+		}
+		released = protonmail.LabelInbox
+	case protonmail.LabelScheduled:
+		for _, apiID := range apiIDs {
+			if err := mbox.u.c.CancelScheduledMessage(ctx, apiID); err != nil {
+				return err
+			}
+		}
+		released = protonmail.LabelDraft
+	default:
+		return fmt.Errorf("cannot release messages from mailbox %q: not a read-only mailbox", mbox.name)
+	}
+
+	if dest == released {
+		return nil
+	}
+	return mbox.u.c.LabelMessages(ctx, dest, apiIDs)
+}
@@ -0,0 +1,24 @@
+package imap
+
+import (
+	"context"
+	"testing"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestReleaseNotReadOnly(t *testing.T) {
+	tests := []struct {
+		name  string
+		label string
+	}{
+		{"INBOX", protonmail.LabelInbox},
+		{"Archive", protonmail.LabelArchive},
+	}
+	for _, tc := range tests {
+		mbox := &mailbox{name: tc.name, label: tc.label}
+		if err := mbox.release(context.Background(), []string{"message"}, protonmail.LabelTrash); err == nil {
+			t.Errorf("%v: release() succeeded", tc.name)
+		}
+	}
+}
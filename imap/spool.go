@@ -0,0 +1,208 @@
+package imap
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// spoolThreshold is the size above which fetched literals are buffered in a
+// temporary file instead of memory.
+const spoolThreshold = 1 << 20
+
+// spoolCacheSize is the number of sections kept per user for partial fetches.
+const spoolCacheSize = 8
+
+// spool buffers a literal. IMAP literals are sent with their length, so they
+// can't be streamed as they're decrypted. Large literals, e.g. messages with
+// big attachments, are written to a temporary file to keep memory usage low.
+type spool struct {
+	mem  bytes.Buffer
+	f    *os.File
+	size int64
+
+	locker sync.Mutex
+	// Number of unread literals and caches using the spool
+	refs int
+}
+
+func (s *spool) Write(b []byte) (int, error) {
+	if s.f == nil && s.mem.Len()+len(b) > spoolThreshold {
+		f, err := ioutil.TempFile("", "hydroxide-literal-")
+		if err != nil {
+			return 0, err
+		}
+		// The file is removed once closed
+		os.Remove(f.Name())
+		if _, err := f.Write(s.mem.Bytes()); err != nil {
+			f.Close()
+			return 0, err
+		}
+		s.mem = bytes.Buffer{}
+		s.f = f
+	}
+
+	var n int
+	var err error
+	if s.f != nil {
+		n, err = s.f.Write(b)
+	} else {
+		n, err = s.mem.Write(b)
+	}
+	s.size += int64(n)
+	return n, err
+}
+
+// Reset discards the data written so far.
+func (s *spool) Reset() error {
+	s.mem.Reset()
+	s.size = 0
+	if s.f == nil {
+		return nil
+	}
+	if err := s.f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := s.f.Seek(0, io.SeekStart)
+	return err
+}
+
+func (s *spool) retain() {
+	s.locker.Lock()
+	s.refs++
+	s.locker.Unlock()
+}
+
+// release closes the spool once it's not used anymore.
+func (s *spool) release() {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	s.refs--
+	if s.refs == 0 {
+		s.Close()
+	}
+}
+
+// Close releases the temporary file, if any.
+func (s *spool) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	return s.f.Close()
+}
+
+// literal returns the n bytes starting at off as a literal. n is capped to the
+// available data. The spool is closed once all literals have been read, unless
+// it's cached.
+func (s *spool) literal(off, n int64) *spoolLiteral {
+	s.retain()
+	if off > s.size {
+		off = s.size
+	}
+	if n < 0 || off+n > s.size {
+		n = s.size - off
+	}
+
+	var ra io.ReaderAt = bytes.NewReader(s.mem.Bytes())
+	if s.f != nil {
+		ra = s.f
+	}
+	return &spoolLiteral{SectionReader: io.NewSectionReader(ra, off, n), s: s}
+}
+
+type spoolLiteral struct {
+	*io.SectionReader
+	s        *spool
+	released bool
+}
+
+func (l *spoolLiteral) Len() int {
+	return int(l.Size())
+}
+
+// Close releases the spool without reading the rest of the literal.
+func (l *spoolLiteral) Close() error {
+	if !l.released {
+		l.released = true
+		l.s.release()
+	}
+	return nil
+}
+
+func (l *spoolLiteral) Read(b []byte) (int, error) {
+	n, err := l.SectionReader.Read(b)
+	if err == io.EOF {
+		l.Close()
+	}
+	return n, err
+}
+
+// spoolCache keeps the most recently fetched sections of messages, so that
+// clients fetching a section in several chunks only download and decrypt it
+// once.
+type spoolCache struct {
+	locker sync.Mutex
+	keys   []string // least recently used first
+	spools map[string]*spool
+}
+
+func newSpoolCache() *spoolCache {
+	return &spoolCache{spools: make(map[string]*spool)}
+}
+
+func (c *spoolCache) remove(key string) {
+	for i, k := range c.keys {
+		if k == key {
+			c.keys = append(c.keys[:i], c.keys[i+1:]...)
+			break
+		}
+	}
+	if s, ok := c.spools[key]; ok {
+		delete(c.spools, key)
+		s.release()
+	}
+}
+
+// literal returns a literal from a cached section, or nil if the section
+// isn't cached.
+func (c *spoolCache) literal(key string, off, n int64) *spoolLiteral {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	s, ok := c.spools[key]
+	if !ok {
+		return nil
+	}
+	for i, k := range c.keys {
+		if k == key {
+			c.keys = append(append(c.keys[:i], c.keys[i+1:]...), key)
+			break
+		}
+	}
+	return s.literal(off, n)
+}
+
+func (c *spoolCache) put(key string, s *spool) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	c.remove(key)
+	s.retain()
+	c.spools[key] = s
+	c.keys = append(c.keys, key)
+	for len(c.keys) > spoolCacheSize {
+		c.remove(c.keys[0])
+	}
+}
+
+// clear releases all cached sections.
+func (c *spoolCache) clear() {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	for len(c.keys) > 0 {
+		c.remove(c.keys[0])
+	}
+}
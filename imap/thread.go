@@ -0,0 +1,284 @@
+package imap
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/server"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+const (
+	threadReferences     = "REFERENCES"
+	threadOrderedSubject = "ORDEREDSUBJECT"
+)
+
+// conversationReference returns a message ID shared by all messages of a
+// conversation, used in synthesized References header fields so that clients
+// threading messages locally show the same conversations as the web client.
+func conversationReference(msg *protonmail.Message) string {
+	return msg.ConversationID + "@conversation.protonmail.com"
+}
+
+// baseSubject extracts the base subject of a message, used by the
+// ORDEREDSUBJECT algorithm (RFC 5256 section 2.1). The result is normalized
+// so that it can be compared directly.
+func baseSubject(subject string) string {
+	s := strings.Join(strings.Fields(decodeHeaderValue(subject)), " ")
+
+	for {
+		prev := s
+
+		// Trailing "(fwd)"
+		for {
+			t := strings.TrimRight(s, " ")
+			if !strings.HasSuffix(strings.ToLower(t), "(fwd)") {
+				s = t
+				break
+			}
+			s = t[:len(t)-len("(fwd)")]
+		}
+
+		// Leading "Re:", "Fw:", "Fwd:" and "[blob]"
+		for {
+			t := strings.TrimLeft(s, " ")
+			if rest, ok := trimSubjectBlob(t); ok && strings.TrimSpace(rest) != "" {
+				t = rest
+			} else if rest, ok := trimSubjectRefwd(t); ok {
+				t = rest
+			}
+			if t == s {
+				break
+			}
+			s = t
+		}
+
+		// "[fwd: subject]"
+		if strings.HasPrefix(strings.ToLower(s), "[fwd:") && strings.HasSuffix(s, "]") {
+			s = strings.TrimSpace(s[len("[fwd:") : len(s)-1])
+		}
+
+		if s == prev {
+			break
+		}
+	}
+
+	return normalizeText(s)
+}
+
+// trimSubjectBlob removes a leading "[...]" from a subject.
+func trimSubjectBlob(s string) (string, bool) {
+	if !strings.HasPrefix(s, "[") {
+		return s, false
+	}
+	i := strings.IndexAny(s[1:], "[]")
+	if i < 0 || s[1+i] != ']' {
+		return s, false
+	}
+	return strings.TrimLeft(s[i+2:], " "), true
+}
+
+// trimSubjectRefwd removes a leading "Re:", "Fw:" or "Fwd:" from a subject,
+// optionally followed by a blob before the colon, e.g. "Re[2]:".
+func trimSubjectRefwd(s string) (string, bool) {
+	lower := strings.ToLower(s)
+	var rest string
+	switch {
+	case strings.HasPrefix(lower, "re"):
+		rest = s[2:]
+	case strings.HasPrefix(lower, "fwd"):
+		rest = s[3:]
+	case strings.HasPrefix(lower, "fw"):
+		rest = s[2:]
+	default:
+		return s, false
+	}
+	rest = strings.TrimLeft(rest, " ")
+	if blob, ok := trimSubjectBlob(rest); ok {
+		rest = blob
+	}
+	if !strings.HasPrefix(rest, ":") {
+		return s, false
+	}
+	return rest[1:], true
+}
+
+type threadMessage struct {
+	id  uint32
+	msg *protonmail.Message
+}
+
+// thread is a list of messages sorted by date. The first one is the root.
+type thread []threadMessage
+
+func (t thread) date() protonmail.Timestamp {
+	return t[0].msg.Time
+}
+
+// format formats a thread as an RFC 5256 thread list. With nested set, the
+// root is the parent of all other messages, otherwise each message is the
+// parent of the next one.
+func (t thread) format(nested bool) string {
+	ids := make([]string, len(t))
+	for i, m := range t {
+		ids[i] = strconv.FormatUint(uint64(m.id), 10)
+	}
+	if !nested || len(ids) <= 2 {
+		return "(" + strings.Join(ids, " ") + ")"
+	}
+	return "(" + ids[0] + " (" + strings.Join(ids[1:], ")(") + "))"
+}
+
+// groupThreads groups messages into threads sorted by the date of their
+// root.
+func groupThreads(messages []threadMessage, key func(msg *protonmail.Message) string) []thread {
+	sort.SliceStable(messages, func(i, j int) bool {
+		if messages[i].msg.Time != messages[j].msg.Time {
+			return messages[i].msg.Time < messages[j].msg.Time
+		}
+		return messages[i].id < messages[j].id
+	})
+
+	var threads []thread
+	indexes := make(map[string]int)
+	for _, m := range messages {
+		k := key(m.msg)
+		if i, ok := indexes[k]; ok && k != "" {
+			threads[i] = append(threads[i], m)
+			continue
+		}
+		indexes[k] = len(threads)
+		threads = append(threads, thread{m})
+	}
+
+	sort.SliceStable(threads, func(i, j int) bool {
+		return threads[i].date() < threads[j].date()
+	})
+	return threads
+}
+
+type threadHandler struct {
+	algorithm string
+	search    searchHandler
+}
+
+func (h *threadHandler) Parse(fields []interface{}) error {
+	if len(fields) < 3 {
+		return errors.New("Missing THREAD arguments")
+	}
+
+	algorithm, _ := fields[0].(string)
+	h.algorithm = strings.ToUpper(algorithm)
+	if h.algorithm != threadReferences && h.algorithm != threadOrderedSubject {
+		return errors.New("Unsupported threading algorithm")
+	}
+
+	// The charset is mandatory: pass it to the SEARCH parser as if it was
+	// specified with CHARSET
+	search := append([]interface{}{"CHARSET"}, fields[1:]...)
+	return h.search.Parse(search)
+}
+
+func (h *threadHandler) handle(uid bool, conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return server.ErrNoMailboxSelected
+	}
+
+	mbox := modSeqMailbox(ctx.Mailbox)
+	if mbox == nil {
+		return errors.New("Mailbox doesn't support threading")
+	}
+
+	ids, err := mbox.searchMessages(uid, h.search.criteria, &h.search.saveDate, h.search.modSeq)
+	if err != nil {
+		return err
+	}
+	matches := make(map[uint32]bool, len(ids))
+	for _, id := range ids {
+		matches[id] = true
+	}
+
+	var messages []threadMessage
+	err = mbox.db.ForEach(func(seqNum, msgUID uint32, apiID string) error {
+		id := seqNum
+		if uid {
+			id = msgUID
+		}
+		if !matches[id] {
+			return nil
+		}
+		msg, err := mbox.u.db.Message(apiID)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, threadMessage{id, msg})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var threads []thread
+	nested := false
+	switch h.algorithm {
+	case threadReferences:
+		// Messages are threaded like the web client does, by conversation
+		threads = groupThreads(messages, func(msg *protonmail.Message) string {
+			return msg.ConversationID
+		})
+	case threadOrderedSubject:
+		threads = groupThreads(messages, func(msg *protonmail.Message) string {
+			return baseSubject(msg.Subject)
+		})
+		nested = true
+	}
+
+	fields := []interface{}{imap.RawString("THREAD")}
+	if len(threads) > 0 {
+		var sb strings.Builder
+		for _, t := range threads {
+			sb.WriteString(t.format(nested))
+		}
+		fields = append(fields, imap.RawString(sb.String()))
+	}
+	return conn.WriteResp(&imap.DataResp{Fields: fields})
+}
+
+func (h *threadHandler) Handle(conn server.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *threadHandler) UidHandle(conn server.Conn) error {
+	return h.handle(true, conn)
+}
+
+type threadExtension struct{}
+
+// NewThreadExtension returns an extension implementing THREAD (RFC 5256).
+// The REFERENCES algorithm groups messages by ProtonMail conversation rather
+// than by parsing their headers, so that threads match the web client.
+func NewThreadExtension() server.Extension {
+	return &threadExtension{}
+}
+
+func (ext *threadExtension) Capabilities(c server.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{"THREAD=" + threadReferences, "THREAD=" + threadOrderedSubject}
+	}
+	return nil
+}
+
+func (ext *threadExtension) Command(name string) server.HandlerFactory {
+	if name != "THREAD" {
+		return nil
+	}
+
+	return func() server.Handler {
+		return &threadHandler{}
+	}
+}
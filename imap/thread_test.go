@@ -0,0 +1,103 @@
+package imap
+
+import (
+	"testing"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestBaseSubject(t *testing.T) {
+	tests := []struct {
+		subject, want string
+	}{
+		{"Hello", "hello"},
+		{"  Hello   world  ", "hello world"},
+		{"Re: Hello", "hello"},
+		{"RE: re: Fwd: Hello", "hello"},
+		{"Re: Fwd: [list] Hello (fwd)", "hello"},
+		{"RE[2]: hello", "hello"},
+		{"Fw : hello", "hello"},
+		{"Hello (fwd) (FWD)", "hello"},
+		{"[fwd: Re: hello]", "hello"},
+		{"[list] [other] Re: hello", "hello"},
+		{"[x]", "[x]"},
+		{"re: ", ""},
+		{"Reply to me", "reply to me"},
+		{"=?utf-8?q?Re=3A_Caf=C3=A9?=", "café"},
+	}
+	for _, tc := range tests {
+		if got := baseSubject(tc.subject); got != tc.want {
+			t.Errorf("baseSubject(%q) = %q, want %q", tc.subject, got, tc.want)
+		}
+	}
+}
+
+func TestGroupThreads(t *testing.T) {
+	msg := func(id uint32, conv string, time protonmail.Timestamp) threadMessage {
+		return threadMessage{id, &protonmail.Message{ConversationID: conv, Time: time}}
+	}
+
+	tests := []struct {
+		name     string
+		messages []threadMessage
+		flat     string
+		nested   string
+	}{
+		{
+			name:     "empty",
+			messages: nil,
+		},
+		{
+			name:     "single",
+			messages: []threadMessage{msg(1, "a", 10)},
+			flat:     "(1)",
+			nested:   "(1)",
+		},
+		{
+			name:     "conversation",
+			messages: []threadMessage{msg(4, "a", 30), msg(3, "a", 10), msg(1, "a", 20)},
+			flat:     "(3 1 4)",
+			nested:   "(3 (1)(4))",
+		},
+		{
+			name:     "two messages",
+			messages: []threadMessage{msg(2, "a", 20), msg(1, "a", 10)},
+			flat:     "(1 2)",
+			nested:   "(1 2)",
+		},
+		{
+			name:     "sorted by root",
+			messages: []threadMessage{msg(1, "a", 30), msg(2, "b", 10), msg(3, "a", 40), msg(4, "b", 50)},
+			flat:     "(2 4)(1 3)",
+			nested:   "(2 4)(1 3)",
+		},
+		{
+			name:     "same date",
+			messages: []threadMessage{msg(3, "a", 10), msg(2, "b", 10), msg(1, "a", 10)},
+			flat:     "(1 3)(2)",
+			nested:   "(1 3)(2)",
+		},
+		{
+			name:     "no conversation",
+			messages: []threadMessage{msg(1, "", 10), msg(2, "", 20)},
+			flat:     "(1)(2)",
+			nested:   "(1)(2)",
+		},
+	}
+	for _, tc := range tests {
+		threads := groupThreads(tc.messages, func(msg *protonmail.Message) string {
+			return msg.ConversationID
+		})
+		var flat, nested string
+		for _, thread := range threads {
+			flat += thread.format(false)
+			nested += thread.format(true)
+		}
+		if flat != tc.flat {
+			t.Errorf("%v: flat threads = %q, want %q", tc.name, flat, tc.flat)
+		}
+		if nested != tc.nested {
+			t.Errorf("%v: nested threads = %q, want %q", tc.name, nested, tc.nested)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package imap
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// TrackerList contains the trackers removed from HTML bodies.
+type TrackerList struct {
+	// Domains known to serve tracking pixels or click-tracking redirects,
+	// subdomains included
+	Hosts []string
+	// URL query parameters used for campaign tracking
+	Params []string
+}
+
+// LoadTrackerList reads a tracker list from a JSON file, e.g. one exported
+// from the lists used by the web client.
+func LoadTrackerList(path string) (*TrackerList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read tracker list: %v", err)
+	}
+	defer f.Close()
+
+	var l TrackerList
+	if err := json.NewDecoder(f).Decode(&l); err != nil {
+		return nil, fmt.Errorf("cannot read tracker list %q: %v", path, err)
+	}
+	if len(l.Hosts) == 0 && len(l.Params) == 0 {
+		return nil, fmt.Errorf("tracker list %q is empty", path)
+	}
+	for i, h := range l.Hosts {
+		l.Hosts[i] = strings.ToLower(strings.TrimPrefix(h, "."))
+	}
+	return &l, nil
+}
+
+// defaultTrackers is used unless a tracker list is loaded with
+// LoadTrackerList. It isn't the list of the web client, which relies on
+// ProtonMail's servers to detect trackers while proxying remote images.
+var defaultTrackers = &TrackerList{Hosts: defaultTrackerHosts, Params: defaultTrackerParams}
+
+var defaultTrackerHosts = []string{
+	"list-manage.com",
+	"mailchimp.com",
+	"mandrillapp.com",
+	"sendgrid.net",
+	"sendgrid.com",
+	"mailgun.org",
+	"mailgun.net",
+	"mktotracking.com",
+	"mktoresp.com",
+	"hubspotemail.net",
+	"hs-analytics.net",
+	"hubspotlinks.com",
+	"exct.net",
+	"exacttarget.com",
+	"sparkpostmail.com",
+	"cmail19.com",
+	"cmail20.com",
+	"createsend.com",
+	"mailjet.com",
+	"mjt.lu",
+	"customeriomail.com",
+	"intercom-mail.com",
+	"google-analytics.com",
+	"doubleclick.net",
+	"pardot.com",
+	"rs6.net",
+	"constantcontact.com",
+	"returnpath.net",
+	"mixpanel.com",
+	"yesware.com",
+	"mailtrack.io",
+	"bananatag.com",
+	"getnotify.com",
+	"streak.com",
+	"superhuman.com",
+}
+
+var defaultTrackerParams = []string{
+	"utm_source", "utm_medium", "utm_campaign", "utm_term", "utm_content",
+	"mc_cid", "mc_eid", "_hsenc", "_hsmi", "mkt_tok",
+}
+
+var (
+	imgTagRegexp  = regexp.MustCompile(`(?is)<img\b[^>]*>`)
+	hrefRegexp    = regexp.MustCompile(`(?is)\bhref\s*=\s*("[^"]*"|'[^']*')`)
+	srcRegexp     = regexp.MustCompile(`(?is)\bsrc\s*=\s*("[^"]*"|'[^']*'|[^\s>]+)`)
+	sizeAttrRegex = regexp.MustCompile(`(?is)\b(width|height)\s*=\s*["']?\s*[01](px)?\s*(["'\s/>]|$)`)
+)
+
+func unquoteAttr(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+func (tl *TrackerList) trackerHost(rawURL string) (string, bool) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || u.Host == "" {
+		return "", false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, h := range tl.Hosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return host, true
+		}
+	}
+	return host, false
+}
+
+func isTrackingPixel(tag string) bool {
+	matches := sizeAttrRegex.FindAllStringSubmatch(tag, -1)
+	return len(matches) >= 2
+}
+
+func (tl *TrackerList) stripTrackerParams(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.RawQuery == "" {
+		return rawURL
+	}
+	q := u.Query()
+	changed := false
+	for _, p := range tl.Params {
+		if _, ok := q[p]; ok {
+			q.Del(p)
+			changed = true
+		}
+	}
+	if !changed {
+		return rawURL
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// block removes tracking pixels and tracking parameters from an HTML document.
+// It returns the sanitized document and the list of blocked trackers.
+func (tl *TrackerList) block(doc string) (string, []string) {
+	blocked := make(map[string]struct{})
+
+	doc = imgTagRegexp.ReplaceAllStringFunc(doc, func(tag string) string {
+		m := srcRegexp.FindStringSubmatch(tag)
+		if m == nil {
+			return tag
+		}
+		src := html.UnescapeString(unquoteAttr(m[1]))
+		host, known := tl.trackerHost(src)
+		if !known && !(host != "" && isTrackingPixel(tag)) {
+			return tag
+		}
+		blocked[host] = struct{}{}
+		return strings.Replace(tag, m[0], `src=""`, 1)
+	})
+
+	doc = hrefRegexp.ReplaceAllStringFunc(doc, func(attr string) string {
+		m := hrefRegexp.FindStringSubmatch(attr)
+		href := html.UnescapeString(unquoteAttr(m[1]))
+		stripped := tl.stripTrackerParams(href)
+		if stripped == href {
+			return attr
+		}
+		if host, _ := tl.trackerHost(href); host != "" {
+			blocked[host] = struct{}{}
+		}
+		return `href="` + html.EscapeString(stripped) + `"`
+	})
+
+	l := make([]string, 0, len(blocked))
+	for host := range blocked {
+		l = append(l, host)
+	}
+	sort.Strings(l)
+	return doc, l
+}
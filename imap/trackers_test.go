@@ -0,0 +1,141 @@
+package imap
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTrackerListBlock(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		want    string
+		blocked []string
+	}{
+		{
+			name:    "no trackers",
+			doc:     `<p><img src="https://example.org/logo.png" width="120" height="40"><a href="https://example.org/?page=2">Next</a></p>`,
+			want:    `<p><img src="https://example.org/logo.png" width="120" height="40"><a href="https://example.org/?page=2">Next</a></p>`,
+			blocked: []string{},
+		},
+		{
+			name:    "known tracker",
+			doc:     `<img src="https://open.mailchimp.com/track.gif?u=1">`,
+			want:    `<img src="">`,
+			blocked: []string{"open.mailchimp.com"},
+		},
+		{
+			name:    "tracking pixel",
+			doc:     `<img width="1" height="1" src='https://pixel.example.net/o.gif'>`,
+			want:    `<img width="1" height="1" src="">`,
+			blocked: []string{"pixel.example.net"},
+		},
+		{
+			name:    "tracking parameters",
+			doc:     `<a href="https://example.org/post?id=3&amp;utm_source=newsletter&amp;utm_medium=email">Read</a>`,
+			want:    `<a href="https://example.org/post?id=3">Read</a>`,
+			blocked: []string{"example.org"},
+		},
+		{
+			name:    "large image",
+			doc:     `<img src="https://example.org/photo.jpg" width="100" height="150">`,
+			want:    `<img src="https://example.org/photo.jpg" width="100" height="150">`,
+			blocked: []string{},
+		},
+		{
+			name:    "sizes in pixels",
+			doc:     `<img src="https://example.org/photo.jpg" width=10px height=1px>`,
+			want:    `<img src="https://example.org/photo.jpg" width=10px height=1px>`,
+			blocked: []string{},
+		},
+		{
+			name:    "1x1 image",
+			doc:     `<img src="https://example.org/o.gif" width="1" height="1">`,
+			want:    `<img src="" width="1" height="1">`,
+			blocked: []string{"example.org"},
+		},
+		{
+			name:    "0x0 image, unquoted",
+			doc:     `<img src="https://example.org/o.gif" width=0 height=0px/>`,
+			want:    `<img src="" width=0 height=0px/>`,
+			blocked: []string{"example.org"},
+		},
+		{
+			name:    "similar domain",
+			doc:     `<img src="https://notmailchimp.com/a.png">`,
+			want:    `<img src="https://notmailchimp.com/a.png">`,
+			blocked: []string{},
+		},
+	}
+	for _, tc := range tests {
+		got, blocked := defaultTrackers.block(tc.doc)
+		if got != tc.want {
+			t.Errorf("%v: block() = %q, want %q", tc.name, got, tc.want)
+		}
+		if !reflect.DeepEqual(blocked, tc.blocked) {
+			t.Errorf("%v: block() blocked = %v, want %v", tc.name, blocked, tc.blocked)
+		}
+	}
+}
+
+func TestLoadTrackerList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hydroxide-trackers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		data    string
+		doc     string
+		want    string
+		blocked []string
+	}{
+		{
+			name:    "hosts",
+			data:    `{"Hosts": [".Tracker.Example"]}`,
+			doc:     `<img src="https://pixel.tracker.example/a.png"><img src="https://open.mailchimp.com/b.png">`,
+			want:    `<img src=""><img src="https://open.mailchimp.com/b.png">`,
+			blocked: []string{"pixel.tracker.example"},
+		},
+		{
+			name:    "params",
+			data:    `{"Params": ["ref"]}`,
+			doc:     `<a href="https://example.org/?ref=mail&amp;utm_source=x">`,
+			want:    `<a href="https://example.org/?utm_source=x">`,
+			blocked: []string{"example.org"},
+		},
+		{name: "empty", data: `{}`},
+		{name: "invalid", data: `["tracker.example"]`},
+	}
+	for _, tc := range tests {
+		path := filepath.Join(dir, "trackers.json")
+		if err := ioutil.WriteFile(path, []byte(tc.data), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		l, err := LoadTrackerList(path)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("%v: LoadTrackerList() succeeded", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: LoadTrackerList() = %v", tc.name, err)
+			continue
+		}
+
+		got, blocked := l.block(tc.doc)
+		if got != tc.want {
+			t.Errorf("%v: block() = %q, want %q", tc.name, got, tc.want)
+		}
+		if !reflect.DeepEqual(blocked, tc.blocked) {
+			t.Errorf("%v: block() blocked = %v, want %v", tc.name, blocked, tc.blocked)
+		}
+	}
+}
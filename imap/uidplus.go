@@ -0,0 +1,303 @@
+package imap
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapmove "github.com/emersion/go-imap-move"
+	"github.com/emersion/go-imap/server"
+)
+
+const uidPlusCapability = "UIDPLUS"
+
+const (
+	codeAppendUID imap.StatusRespCode = "APPENDUID"
+	codeCopyUID   imap.StatusRespCode = "COPYUID"
+)
+
+// formatUIDList formats UIDs as a sequence set. Unlike imap.SeqSet, the order
+// of the UIDs is kept: COPYUID matches source and destination UIDs by
+// position.
+func formatUIDList(uids []uint32) imap.RawString {
+	var b strings.Builder
+	for i := 0; i < len(uids); i++ {
+		j := i
+		for j+1 < len(uids) && uids[j+1] == uids[j]+1 {
+			j++
+		}
+
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.FormatUint(uint64(uids[i]), 10))
+		if j > i {
+			b.WriteByte(':')
+			b.WriteString(strconv.FormatUint(uint64(uids[j]), 10))
+		}
+		i = j
+	}
+	return imap.RawString(b.String())
+}
+
+// copyUIDs contains the UIDs of copied messages, in the source and in the
+// destination mailbox.
+type copyUIDs struct {
+	uidValidity uint32 // of the destination mailbox
+	src, dest   []uint32
+}
+
+func (res *copyUIDs) statusResp(info string) *imap.StatusResp {
+	return &imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      codeCopyUID,
+		Arguments: []interface{}{res.uidValidity, formatUIDList(res.src), formatUIDList(res.dest)},
+		Info:      info,
+	}
+}
+
+// uids returns the UIDs of messages in the mailbox, in the order of apiIDs. No
+// UIDs are returned if some messages aren't in the mailbox, or if the mailbox
+// hasn't been synchronized yet: its UIDs may change when it is.
+func (mbox *mailbox) uids(apiIDs []string) (uidValidity uint32, uids []uint32, err error) {
+	mbox.Lock()
+	initialized := mbox.initialized
+	mbox.Unlock()
+	if !initialized || len(apiIDs) == 0 {
+		return 0, nil, nil
+	}
+
+	byID := make(map[string]uint32, len(apiIDs))
+	for _, apiID := range apiIDs {
+		byID[apiID] = 0
+	}
+	err = mbox.db.ForEach(func(seqNum, uid uint32, apiID string) error {
+		if _, ok := byID[apiID]; ok {
+			byID[apiID] = uid
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	uids = make([]uint32, len(apiIDs))
+	for i, apiID := range apiIDs {
+		if uids[i] = byID[apiID]; uids[i] == 0 {
+			return 0, nil, nil
+		}
+	}
+
+	uidValidity, err = mbox.db.UidValidity()
+	if err != nil {
+		return 0, nil, err
+	}
+	return uidValidity, uids, nil
+}
+
+// uidPlusMailbox is a mailbox which can report the UIDs of the messages added
+// to it. The unified inbox is read-only and isn't one.
+type uidPlusMailbox interface {
+	createMessage(flags []string, date time.Time, body imap.Literal) (string, error)
+	copyMessages(uid bool, seqSet *imap.SeqSet, destName string, move bool) (*copyUIDs, error)
+	expunge(uidSet *imap.SeqSet) error
+	uids(apiIDs []string) (uint32, []uint32, error)
+}
+
+type appendHandler struct {
+	server.Append
+}
+
+func (h *appendHandler) Handle(conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return server.ErrNotAuthenticated
+	}
+
+	m, err := ctx.User.GetMailbox(h.Mailbox)
+	if err != nil {
+		// Let the inner handler report the error
+		return h.Append.Handle(conn)
+	}
+	mbox, ok := m.(uidPlusMailbox)
+	if !ok {
+		return h.Append.Handle(conn)
+	}
+
+	apiID, err := mbox.createMessage(h.Flags, h.Date, h.Message)
+	if err != nil {
+		return err
+	}
+
+	uidValidity, uids, err := mbox.uids([]string{apiID})
+	if err != nil || uids == nil {
+		return err
+	}
+	return server.ErrStatusResp(&imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      codeAppendUID,
+		Arguments: []interface{}{uidValidity, uids[0]},
+		Info:      "APPEND completed",
+	})
+}
+
+type copyHandler struct {
+	server.Copy
+}
+
+func (h *copyHandler) handle(uid bool, conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return server.ErrNoMailboxSelected
+	}
+	mbox, ok := ctx.Mailbox.(uidPlusMailbox)
+	if !ok {
+		return ctx.Mailbox.CopyMessages(uid, h.SeqSet, h.Mailbox)
+	}
+
+	res, err := mbox.copyMessages(uid, h.SeqSet, h.Mailbox, false)
+	if err != nil || res == nil {
+		return err
+	}
+
+	info := "COPY completed"
+	if uid {
+		info = "UID " + info
+	}
+	return server.ErrStatusResp(res.statusResp(info))
+}
+
+func (h *copyHandler) Handle(conn server.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *copyHandler) UidHandle(conn server.Conn) error {
+	return h.handle(true, conn)
+}
+
+type moveHandler struct {
+	imapmove.Command
+}
+
+func (h *moveHandler) handle(uid bool, conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return server.ErrNoMailboxSelected
+	}
+	// MOVE expunges the messages from the source mailbox
+	if ctx.MailboxReadOnly {
+		return server.ErrMailboxReadOnly
+	}
+	mbox, ok := ctx.Mailbox.(uidPlusMailbox)
+	if !ok {
+		if m, ok := ctx.Mailbox.(imapmove.Mailbox); ok {
+			return m.MoveMessages(uid, h.SeqSet, h.Mailbox)
+		}
+		return errors.New("MOVE isn't supported in this mailbox")
+	}
+
+	res, err := mbox.copyMessages(uid, h.SeqSet, h.Mailbox, true)
+	if err != nil || res == nil {
+		return err
+	}
+
+	// The expunges have already been sent while the move was processed
+	return conn.WriteResp(res.statusResp("Messages moved"))
+}
+
+func (h *moveHandler) Handle(conn server.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *moveHandler) UidHandle(conn server.Conn) error {
+	return h.handle(true, conn)
+}
+
+type expungeHandler struct {
+	server.Expunge
+	uidSet *imap.SeqSet
+}
+
+func (h *expungeHandler) Parse(fields []interface{}) error {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	s, ok := fields[0].(string)
+	if !ok {
+		return errors.New("Invalid UID set")
+	}
+	var err error
+	h.uidSet, err = imap.ParseSeqSet(s)
+	return err
+}
+
+func (h *expungeHandler) Handle(conn server.Conn) error {
+	if h.uidSet != nil {
+		return errors.New("EXPUNGE doesn't take any argument")
+	}
+	return h.Expunge.Handle(conn)
+}
+
+func (h *expungeHandler) UidHandle(conn server.Conn) error {
+	if h.uidSet == nil {
+		return errors.New("Missing UID set")
+	}
+
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return server.ErrNoMailboxSelected
+	}
+	if ctx.MailboxReadOnly {
+		return server.ErrMailboxReadOnly
+	}
+	mbox, ok := ctx.Mailbox.(uidPlusMailbox)
+	if !ok {
+		return errors.New("UID EXPUNGE isn't supported in this mailbox")
+	}
+
+	return mbox.expunge(h.uidSet)
+}
+
+type uidPlusExtension struct{}
+
+// NewUIDPlusExtension returns an extension implementing MOVE (RFC 6851) and
+// UIDPLUS (RFC 4315). Messages are moved by changing their labels.
+//
+// COPYUID is omitted if the destination mailbox hasn't been selected yet,
+// since its UIDs aren't assigned until it's synchronized. For MOVE, COPYUID
+// is sent after the EXPUNGE responses instead of before them.
+func NewUIDPlusExtension() server.Extension {
+	return &uidPlusExtension{}
+}
+
+func (ext *uidPlusExtension) Capabilities(c server.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{imapmove.Capability, uidPlusCapability}
+	}
+	return nil
+}
+
+func (ext *uidPlusExtension) Command(name string) server.HandlerFactory {
+	switch name {
+	case "APPEND":
+		return func() server.Handler {
+			return &appendHandler{}
+		}
+	case "COPY":
+		return func() server.Handler {
+			return &copyHandler{}
+		}
+	case imapmove.Capability:
+		return func() server.Handler {
+			return &moveHandler{}
+		}
+	case "EXPUNGE":
+		return func() server.Handler {
+			return &expungeHandler{}
+		}
+	}
+	return nil
+}
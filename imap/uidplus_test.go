@@ -0,0 +1,71 @@
+package imap
+
+import (
+	"testing"
+
+	"github.com/emersion/go-imap"
+	imapmove "github.com/emersion/go-imap-move"
+	"github.com/emersion/go-imap/server"
+)
+
+type testConn struct {
+	server.Conn
+	ctx *server.Context
+}
+
+func (c *testConn) Context() *server.Context {
+	return c.ctx
+}
+
+func TestMoveHandlerReadOnly(t *testing.T) {
+	seqSet, _ := imap.ParseSeqSet("1:*")
+	tests := []struct {
+		name string
+		ctx  *server.Context
+		err  error
+	}{
+		{
+			name: "no mailbox selected",
+			ctx:  &server.Context{},
+			err:  server.ErrNoMailboxSelected,
+		},
+		{
+			name: "examined mailbox",
+			ctx:  &server.Context{Mailbox: &mailbox{name: "INBOX"}, MailboxReadOnly: true},
+			err:  server.ErrMailboxReadOnly,
+		},
+	}
+	for _, tc := range tests {
+		h := &moveHandler{imapmove.Command{SeqSet: seqSet, Mailbox: "Archive"}}
+		for _, uid := range []bool{false, true} {
+			if err := h.handle(uid, &testConn{ctx: tc.ctx}); err != tc.err {
+				t.Errorf("%v (uid: %v): handle() = %v, want %v", tc.name, uid, err, tc.err)
+			}
+		}
+	}
+}
+
+func TestFormatUIDList(t *testing.T) {
+	tests := []struct {
+		uids []uint32
+		want string
+	}{
+		{nil, ""},
+		{[]uint32{1}, "1"},
+		{[]uint32{1, 2, 3}, "1:3"},
+		{[]uint32{1, 3, 5}, "1,3,5"},
+		{[]uint32{1, 2, 4, 5, 6, 9}, "1:2,4:6,9"},
+		// The order is kept, COPYUID matches UIDs by position
+		{[]uint32{5, 4, 3}, "5,4,3"},
+		{[]uint32{7, 8, 1, 2}, "7:8,1:2"},
+		{[]uint32{4294967294, 4294967295}, "4294967294:4294967295"},
+		{[]uint32{4294967295, 1}, "4294967295,1"},
+		// Duplicates aren't merged into ranges
+		{[]uint32{3, 3, 4}, "3,3:4"},
+	}
+	for _, tc := range tests {
+		if got := string(formatUIDList(tc.uids)); got != tc.want {
+			t.Errorf("formatUIDList(%v) = %q, want %q", tc.uids, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,868 @@
+package imap
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/server"
+
+	"github.com/emersion/hydroxide/auth"
+	"github.com/emersion/hydroxide/config"
+	"github.com/emersion/hydroxide/imap/database"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// unifiedInboxName is the name of the mailbox aggregating the inboxes of all
+// accounts of a unified session.
+const unifiedInboxName = "All Accounts" + delimiter + imap.InboxName
+
+var errReadOnly = errors.New("the unified inbox is read-only")
+
+// unifiedUser is an IMAP session spanning several accounts. It's created by
+// logging in with comma-separated usernames and bridge passwords. The
+// mailboxes of each account are listed with a "<username>/" prefix.
+type unifiedUser struct {
+	name    string
+	backend *backend
+	users   []*user
+	db      *database.User
+	inbox   *unifiedMailbox
+
+	numClients int // protected by backend
+}
+
+func (be *backend) loginUnified(ctx context.Context, username, password string) (imapbackend.User, error) {
+	usernames := strings.Split(username, ",")
+	passwords := strings.Split(password, ",")
+	if len(usernames) != len(passwords) {
+		return nil, auth.ErrUnauthorized
+	}
+
+	users := make([]*user, 0, len(usernames))
+	logout := func() {
+		for _, u := range users {
+			if err := u.Logout(); err != nil {
+				u.logger.Warn("cannot log out user", "error", err)
+			}
+		}
+	}
+	for i, name := range usernames {
+		c, privateKeys, err := be.sessions.Auth(ctx, name, passwords[i])
+		if err != nil {
+			logout()
+			return nil, err
+		}
+		if err := config.CheckProtocol(name, config.ProtocolIMAP); err != nil {
+			logout()
+			return nil, err
+		}
+		u, err := getUser(ctx, be, name, c, privateKeys)
+		if err != nil {
+			logout()
+			return nil, err
+		}
+		users = append(users, u)
+	}
+
+	be.Lock()
+	if uu, ok := be.unifiedUsers[username]; ok {
+		uu.numClients++
+		be.Unlock()
+		// The existing session already holds a reference to each user
+		logout()
+		return uu, nil
+	}
+	uu, err := newUnifiedUser(be, username, users)
+	if err == nil {
+		be.unifiedUsers[username] = uu
+	}
+	be.Unlock()
+	if err != nil {
+		logout()
+		return nil, err
+	}
+
+	logger.Info("users logged in with a unified inbox", "users", username)
+	return uu, nil
+}
+
+func newUnifiedUser(be *backend, name string, users []*user) (*unifiedUser, error) {
+	db, err := database.Open(name + ".unified.db")
+	if err != nil {
+		return nil, err
+	}
+
+	uu := &unifiedUser{
+		name:       name,
+		backend:    be,
+		users:      users,
+		db:         db,
+		numClients: 1,
+	}
+	if uu.inbox, err = newUnifiedMailbox(uu); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return uu, nil
+}
+
+func (uu *unifiedUser) Username() string {
+	return uu.name
+}
+
+func (uu *unifiedUser) ListMailboxes(subscribed bool) ([]imapbackend.Mailbox, error) {
+	list := []imapbackend.Mailbox{uu.inbox}
+	for _, u := range uu.users {
+		mailboxes, err := u.ListMailboxes(subscribed)
+		if err != nil {
+			return nil, err
+		}
+		for _, mbox := range mailboxes {
+			list = append(list, &namespacedMailbox{mbox.(*mailbox), u.username + delimiter})
+		}
+	}
+	return list, nil
+}
+
+func (uu *unifiedUser) GetMailbox(name string) (imapbackend.Mailbox, error) {
+	if name == unifiedInboxName {
+		return uu.inbox, nil
+	}
+	for _, u := range uu.users {
+		prefix := u.username + delimiter
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if mbox := u.getMailbox(strings.TrimPrefix(name, prefix)); mbox != nil {
+			return &namespacedMailbox{mbox, prefix}, nil
+		}
+	}
+	return nil, imapbackend.ErrNoSuchMailbox
+}
+
+// owner returns the account of a namespaced mailbox name, and the name of the
+// mailbox in this account.
+func (uu *unifiedUser) owner(name string) (*user, string, error) {
+	for _, u := range uu.users {
+		prefix := u.username + delimiter
+		if strings.HasPrefix(name, prefix) {
+			return u, strings.TrimPrefix(name, prefix), nil
+		}
+	}
+	return nil, "", errors.New("mailboxes can only be created in an account's namespace")
+}
+
+func (uu *unifiedUser) CreateMailbox(name string) error {
+	u, name, err := uu.owner(name)
+	if err != nil {
+		return err
+	}
+	return u.CreateMailbox(name)
+}
+
+func (uu *unifiedUser) DeleteMailbox(name string) error {
+	if name == unifiedInboxName {
+		return errReadOnly
+	}
+	u, name, err := uu.owner(name)
+	if err != nil {
+		return imapbackend.ErrNoSuchMailbox
+	}
+	return u.DeleteMailbox(name)
+}
+
+func (uu *unifiedUser) RenameMailbox(existingName, newName string) error {
+	if existingName == unifiedInboxName {
+		return errReadOnly
+	}
+	u, existingName, err := uu.owner(existingName)
+	if err != nil {
+		return imapbackend.ErrNoSuchMailbox
+	}
+	newOwner, newName, err := uu.owner(newName)
+	if err != nil {
+		return err
+	} else if newOwner != u {
+		return errors.New("cannot move mailboxes to another account")
+	}
+	return u.RenameMailbox(existingName, newName)
+}
+
+func (uu *unifiedUser) Logout() error {
+	uu.backend.Lock()
+	uu.numClients--
+	if uu.numClients > 0 {
+		uu.backend.Unlock()
+		return nil
+	}
+	delete(uu.backend.unifiedUsers, uu.name)
+	uu.backend.Unlock()
+
+	err := uu.db.Close()
+	for _, u := range uu.users {
+		if logoutErr := u.Logout(); logoutErr != nil && err == nil {
+			err = logoutErr
+		}
+	}
+
+	logger.Info("users logged out", "users", uu.name)
+	return err
+}
+
+// namespacedMailbox is a mailbox of one of the accounts of a unified session.
+type namespacedMailbox struct {
+	*mailbox
+	prefix string
+}
+
+func (mbox *namespacedMailbox) Name() string {
+	return mbox.prefix + mbox.mailbox.Name()
+}
+
+func (mbox *namespacedMailbox) Info() (*imap.MailboxInfo, error) {
+	info, err := mbox.mailbox.Info()
+	if err != nil {
+		return nil, err
+	}
+	info.Name = mbox.Name()
+	return info, nil
+}
+
+func (mbox *namespacedMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	status, err := mbox.mailbox.Status(items)
+	if err != nil {
+		return nil, err
+	}
+	status.Name = mbox.Name()
+	return status, nil
+}
+
+func (mbox *namespacedMailbox) destName(name string) (string, error) {
+	if !strings.HasPrefix(name, mbox.prefix) {
+		return "", errors.New("cannot copy messages to another account")
+	}
+	return strings.TrimPrefix(name, mbox.prefix), nil
+}
+
+func (mbox *namespacedMailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, destName string) error {
+	destName, err := mbox.destName(destName)
+	if err != nil {
+		return err
+	}
+	return mbox.mailbox.CopyMessages(uid, seqSet, destName)
+}
+
+func (mbox *namespacedMailbox) MoveMessages(uid bool, seqSet *imap.SeqSet, destName string) error {
+	destName, err := mbox.destName(destName)
+	if err != nil {
+		return err
+	}
+	return mbox.mailbox.MoveMessages(uid, seqSet, destName)
+}
+
+func (mbox *namespacedMailbox) copyMessages(uid bool, seqSet *imap.SeqSet, destName string, move bool) (*copyUIDs, error) {
+	destName, err := mbox.destName(destName)
+	if err != nil {
+		return nil, err
+	}
+	return mbox.mailbox.copyMessages(uid, seqSet, destName, move)
+}
+
+// unifiedMailbox is a read-only mailbox containing the messages of the inbox
+// of each account of a unified session. UIDs are stored in a separate
+// database, so that they don't depend on the UIDs of the accounts' inboxes.
+type unifiedMailbox struct {
+	uu *unifiedUser
+	db *database.Mailbox
+
+	sync.Mutex // protects everything below
+
+	initialized bool
+	owners      map[string]*mailbox // indexed by API ID
+	unread      int
+}
+
+func newUnifiedMailbox(uu *unifiedUser) (*unifiedMailbox, error) {
+	db, err := uu.db.Mailbox(protonmail.LabelInbox)
+	if err != nil {
+		return nil, err
+	}
+	return &unifiedMailbox{uu: uu, db: db}, nil
+}
+
+func (mbox *unifiedMailbox) Name() string {
+	return unifiedInboxName
+}
+
+func (mbox *unifiedMailbox) Info() (*imap.MailboxInfo, error) {
+	return &imap.MailboxInfo{
+		Attributes: []string{imap.NoInferiorsAttr},
+		Delimiter:  delimiter,
+		Name:       unifiedInboxName,
+	}, nil
+}
+
+// inboxes returns the inbox of each account.
+func (mbox *unifiedMailbox) inboxes() []*mailbox {
+	var l []*mailbox
+	for _, u := range mbox.uu.users {
+		if inbox := u.getMailboxByLabel(protonmail.LabelInbox); inbox != nil {
+			l = append(l, inbox)
+		}
+	}
+	return l
+}
+
+// sync updates the UID mapping from the accounts' inboxes. It returns the
+// sequence numbers of the messages which have been removed, in descending
+// order. It must be called with mbox locked.
+func (mbox *unifiedMailbox) sync() (expunged []uint32, err error) {
+	var messages []*protonmail.Message
+	owners := make(map[string]*mailbox)
+	unread := 0
+	for _, inbox := range mbox.inboxes() {
+		if err := inbox.init(); err != nil {
+			return nil, err
+		}
+		err := inbox.db.ForEach(func(seqNum, uid uint32, apiID string) error {
+			msg, err := inbox.u.db.Message(apiID)
+			if err != nil {
+				return err
+			}
+			messages = append(messages, msg)
+			owners[apiID] = inbox
+			if msg.Unread == 1 {
+				unread++
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Time < messages[j].Time
+	})
+
+	err = mbox.db.ForEach(func(seqNum, uid uint32, apiID string) error {
+		if _, ok := owners[apiID]; !ok {
+			expunged = append(expunged, seqNum)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(expunged)-1; i < j; i, j = i+1, j-1 {
+		expunged[i], expunged[j] = expunged[j], expunged[i]
+	}
+
+	_, repaired, err := mbox.db.Sync(messages)
+	if err != nil {
+		return nil, err
+	}
+	if repaired {
+		logger.Warn("UID mapping of the unified inbox was inconsistent and has been rebuilt", "users", mbox.uu.name)
+		// Clients will have to re-synchronize the whole mailbox
+		expunged = nil
+	}
+
+	mbox.owners = owners
+	mbox.unread = unread
+	mbox.initialized = true
+	return expunged, nil
+}
+
+func (mbox *unifiedMailbox) init() error {
+	mbox.Lock()
+	defer mbox.Unlock()
+
+	if mbox.initialized {
+		return nil
+	}
+	_, err := mbox.sync()
+	return err
+}
+
+// statusCountsOnly checks whether a STATUS command only requests message
+// counters.
+func statusCountsOnly(items []imap.StatusItem) bool {
+	for _, name := range items {
+		if name != imap.StatusMessages && name != imap.StatusUnseen {
+			return false
+		}
+	}
+	return true
+}
+
+// inboxCounts returns the sum of the message counters of the accounts'
+// inboxes, which are kept up-to-date with the API without listing messages.
+func (mbox *unifiedMailbox) inboxCounts() (total, unread int) {
+	for _, inbox := range mbox.inboxes() {
+		inbox.Lock()
+		total += inbox.total
+		unread += inbox.unread
+		inbox.Unlock()
+	}
+	return total, unread
+}
+
+func (mbox *unifiedMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	// Clients polling the message counters of all mailboxes shouldn't
+	// trigger the synchronization of every inbox
+	if !statusCountsOnly(items) {
+		if err := mbox.init(); err != nil {
+			return nil, err
+		}
+	}
+
+	status := imap.NewMailboxStatus(unifiedInboxName, items)
+	status.Flags = []string{imap.SeenFlag, imap.FlaggedFlag, imap.DraftFlag, imap.AnsweredFlag}
+	status.PermanentFlags = []string{}
+	status.ReadOnly = true
+
+	mbox.Lock()
+	defer mbox.Unlock()
+
+	if !mbox.initialized {
+		total, unread := mbox.inboxCounts()
+		status.Messages = uint32(total)
+		status.Unseen = uint32(unread)
+		return status, nil
+	}
+
+	for _, name := range items {
+		switch name {
+		case imap.StatusMessages:
+			n, err := mbox.db.Len()
+			if err != nil {
+				return nil, err
+			}
+			status.Messages = uint32(n)
+		case imap.StatusUidNext:
+			uidNext, err := mbox.db.UidNext()
+			if err != nil {
+				return nil, err
+			}
+			status.UidNext = uidNext
+		case imap.StatusUidValidity:
+			uidValidity, err := mbox.db.UidValidity()
+			if err != nil {
+				return nil, err
+			}
+			status.UidValidity = uidValidity
+		case imap.StatusRecent:
+			status.Recent = 0
+		case imap.StatusUnseen:
+			status.Unseen = uint32(mbox.unread)
+		}
+	}
+
+	return status, nil
+}
+
+func (mbox *unifiedMailbox) SetSubscribed(subscribed bool) error {
+	// LSUB lists all mailboxes, so the unified inbox is always subscribed
+	if subscribed {
+		return nil
+	}
+	return server.ErrStatusResp(&imap.StatusResp{
+		Type: imap.StatusRespNo,
+		Code: "CANNOT",
+		Info: "The unified inbox can't be unsubscribed",
+	})
+}
+
+func (mbox *unifiedMailbox) Check() error {
+	return nil
+}
+
+func (mbox *unifiedMailbox) owner(apiID string) *mailbox {
+	mbox.Lock()
+	defer mbox.Unlock()
+	return mbox.owners[apiID]
+}
+
+func (mbox *unifiedMailbox) fetchMessage(isUid bool, id uint32, items []imap.FetchItem) (*imap.Message, error) {
+	var apiID string
+	var err error
+	if isUid {
+		apiID, err = mbox.db.FromUid(id)
+	} else {
+		apiID, err = mbox.db.FromSeqNum(id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	seqNum, uid, err := mbox.db.FromApiID(apiID)
+	if err != nil {
+		return nil, err
+	}
+
+	owner := mbox.owner(apiID)
+	if owner == nil {
+		return nil, database.ErrNotFound
+	}
+	_, ownerUID, err := owner.db.FromApiID(apiID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := owner.u.context()
+	defer cancel()
+	fetched, err := owner.fetchMessage(ctx, true, ownerUID, items)
+	if err != nil {
+		return nil, err
+	}
+	fetched.SeqNum = seqNum
+	if fetched.Uid != 0 {
+		fetched.Uid = uid
+	}
+	return fetched, nil
+}
+
+func (mbox *unifiedMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	if err := mbox.init(); err != nil {
+		return err
+	}
+
+	var ranges []fetchRange
+	for _, seq := range seqSet.Set {
+		start := seq.Start
+		if start == 0 {
+			start = 1
+		}
+
+		stop := seq.Stop
+		if stop == 0 {
+			if uid {
+				uidNext, err := mbox.db.UidNext()
+				if err != nil {
+					return err
+				}
+				stop = uidNext - 1
+			} else {
+				n, err := mbox.db.Len()
+				if err != nil {
+					return err
+				}
+				stop = uint32(n)
+			}
+		}
+
+		ranges = append(ranges, fetchRange{start, stop})
+	}
+
+	workers := mbox.uu.backend.fetchWorkers(items)
+	return pipelineFetch(ranges, workers, func(id uint32) (*imap.Message, error) {
+		return mbox.fetchMessage(uid, id, items)
+	}, ch)
+}
+
+// ownerCriteria translates search criteria of the unified inbox into criteria
+// for one of the accounts' inboxes. Sequence numbers and UIDs are specific to
+// the unified inbox: at any depth, they're replaced with the UIDs of the same
+// messages in the account's inbox.
+func (mbox *unifiedMailbox) ownerCriteria(c *imap.SearchCriteria, inbox *mailbox) (*imap.SearchCriteria, error) {
+	oc := *c
+	if c.SeqNum != nil || c.Uid != nil {
+		var apiIDs []string
+		err := mbox.db.ForEach(func(seqNum, uid uint32, apiID string) error {
+			if c.SeqNum != nil && !c.SeqNum.Contains(seqNum) {
+				return nil
+			}
+			if c.Uid != nil && !c.Uid.Contains(uid) {
+				return nil
+			}
+			if mbox.owner(apiID) == inbox {
+				apiIDs = append(apiIDs, apiID)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		uidSet := new(imap.SeqSet)
+		for _, apiID := range apiIDs {
+			_, ownerUid, err := inbox.db.FromApiID(apiID)
+			if err == database.ErrNotFound {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			uidSet.AddNum(ownerUid)
+		}
+		// An empty set matches no message
+		oc.SeqNum = nil
+		oc.Uid = uidSet
+	}
+
+	oc.Not = nil
+	for _, not := range c.Not {
+		n, err := mbox.ownerCriteria(not, inbox)
+		if err != nil {
+			return nil, err
+		}
+		oc.Not = append(oc.Not, n)
+	}
+	oc.Or = nil
+	for _, or := range c.Or {
+		left, err := mbox.ownerCriteria(or[0], inbox)
+		if err != nil {
+			return nil, err
+		}
+		right, err := mbox.ownerCriteria(or[1], inbox)
+		if err != nil {
+			return nil, err
+		}
+		oc.Or = append(oc.Or, [2]*imap.SearchCriteria{left, right})
+	}
+	return &oc, nil
+}
+
+func (mbox *unifiedMailbox) SearchMessages(isUID bool, c *imap.SearchCriteria) ([]uint32, error) {
+	if err := mbox.init(); err != nil {
+		return nil, err
+	}
+
+	matches := make(map[string]struct{})
+	for _, inbox := range mbox.inboxes() {
+		ownerCriteria, err := mbox.ownerCriteria(c, inbox)
+		if err != nil {
+			return nil, err
+		}
+		uids, err := inbox.SearchMessages(true, ownerCriteria)
+		if err != nil {
+			return nil, err
+		}
+		for _, uid := range uids {
+			apiID, err := inbox.db.FromUid(uid)
+			if err != nil {
+				return nil, err
+			}
+			matches[apiID] = struct{}{}
+		}
+	}
+
+	var results []uint32
+	err := mbox.db.ForEach(func(seqNum, uid uint32, apiID string) error {
+		if _, ok := matches[apiID]; !ok {
+			return nil
+		}
+
+		if isUID {
+			results = append(results, uid)
+		} else {
+			results = append(results, seqNum)
+		}
+		return nil
+	})
+	return results, err
+}
+
+func (mbox *unifiedMailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	return errReadOnly
+}
+
+func (mbox *unifiedMailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	return errReadOnly
+}
+
+func (mbox *unifiedMailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, destName string) error {
+	return errReadOnly
+}
+
+func (mbox *unifiedMailbox) Expunge() error {
+	return errReadOnly
+}
+
+// changes synchronizes the unified inbox with the accounts' inboxes and
+// returns the updates to send to clients.
+func (mbox *unifiedMailbox) changes() ([]imapbackend.Update, error) {
+	mbox.Lock()
+	expunged, err := mbox.sync()
+	if err != nil {
+		mbox.Unlock()
+		return nil, err
+	}
+	n, err := mbox.db.Len()
+	mbox.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var updates []imapbackend.Update
+	for _, seqNum := range expunged {
+		update := new(imapbackend.ExpungeUpdate)
+		update.Update = imapbackend.NewUpdate(mbox.uu.name, unifiedInboxName)
+		update.SeqNum = seqNum
+		updates = append(updates, update)
+	}
+	update := new(imapbackend.MailboxUpdate)
+	update.Update = imapbackend.NewUpdate(mbox.uu.name, unifiedInboxName)
+	update.MailboxStatus = imap.NewMailboxStatus(unifiedInboxName, []imap.StatusItem{imap.StatusMessages})
+	update.MailboxStatus.Messages = uint32(n)
+	updates = append(updates, update)
+	return updates, nil
+}
+
+// Poll fetches new events for all accounts and notifies clients of changes in
+// the unified inbox.
+func (mbox *unifiedMailbox) Poll() error {
+	for _, u := range mbox.uu.users {
+		u.poll()
+	}
+
+	updates, err := mbox.changes()
+	if err != nil {
+		return err
+	}
+	mbox.uu.backend.notify(updates)
+	return nil
+}
+
+// messageUpdate translates an update of a message in the inbox of an account
+// to the unified inbox. It returns nil if the message isn't in the unified
+// inbox.
+func (mbox *unifiedMailbox) messageUpdate(inbox *mailbox, update *imapbackend.MessageUpdate) *imapbackend.MessageUpdate {
+	apiID, err := inbox.db.FromSeqNum(update.Message.SeqNum)
+	if err != nil {
+		return nil
+	}
+	seqNum, _, err := mbox.db.FromApiID(apiID)
+	if err != nil {
+		return nil
+	}
+
+	msg := *update.Message
+	msg.SeqNum = seqNum
+	// The unified inbox doesn't support modification sequences
+	msg.Items = make(map[imap.FetchItem]interface{}, len(update.Message.Items))
+	for k, v := range update.Message.Items {
+		if k != fetchModSeq {
+			msg.Items[k] = v
+		}
+	}
+	u := new(imapbackend.MessageUpdate)
+	u.Update = imapbackend.NewUpdate(mbox.uu.name, unifiedInboxName)
+	u.Message = &msg
+	return u
+}
+
+// namespacedUpdate copies an update of an account's mailbox for a unified
+// session, whose mailbox names are prefixed with the account's name.
+func namespacedUpdate(username, prefix string, update imapbackend.Update) imapbackend.Update {
+	base := imapbackend.NewUpdate(username, prefix+update.Mailbox())
+	switch update := update.(type) {
+	case *imapbackend.MailboxUpdate:
+		// The status name isn't sent in untagged responses
+		return &imapbackend.MailboxUpdate{Update: base, MailboxStatus: update.MailboxStatus}
+	case *imapbackend.MessageUpdate:
+		return &imapbackend.MessageUpdate{Update: base, Message: update.Message}
+	case *imapbackend.ExpungeUpdate:
+		return &imapbackend.ExpungeUpdate{Update: base, SeqNum: update.SeqNum}
+	case *imapbackend.StatusUpdate:
+		return &imapbackend.StatusUpdate{Update: base, StatusResp: update.StatusResp}
+	default:
+		return nil
+	}
+}
+
+// unifiedSessions returns the unified sessions including u.
+func (be *backend) unifiedSessions(u *user) []*unifiedUser {
+	be.Lock()
+	defer be.Unlock()
+
+	var sessions []*unifiedUser
+	for _, uu := range be.unifiedUsers {
+		for _, member := range uu.users {
+			if member == u {
+				sessions = append(sessions, uu)
+				break
+			}
+		}
+	}
+	return sessions
+}
+
+// namespacedUpdates returns copies of updates of u's mailboxes for the unified
+// sessions including u. Unlike unifiedUpdates, the unified inbox isn't
+// synchronized, so it can be called while one of u's mailboxes is locked.
+func (be *backend) namespacedUpdates(u *user, updates []imapbackend.Update) []imapbackend.Update {
+	var namespaced []imapbackend.Update
+	for _, uu := range be.unifiedSessions(u) {
+		for _, update := range updates {
+			if update.Mailbox() == "" {
+				continue
+			}
+			if nu := namespacedUpdate(uu.name, u.username+delimiter, update); nu != nil {
+				namespaced = append(namespaced, nu)
+			}
+		}
+	}
+	return namespaced
+}
+
+// unifiedUpdates returns the updates to send to the unified sessions including
+// u, so that connections of these sessions are notified of the changes in u's
+// mailboxes too.
+func (be *backend) unifiedUpdates(u *user, updates []imapbackend.Update) []imapbackend.Update {
+	sessions := be.unifiedSessions(u)
+	if len(sessions) == 0 {
+		return nil
+	}
+
+	inbox := u.getMailboxByLabel(protonmail.LabelInbox)
+
+	var unified []imapbackend.Update
+	for _, uu := range sessions {
+		inboxChanged := false
+		for _, update := range updates {
+			if update.Mailbox() == "" {
+				continue
+			}
+			if nu := namespacedUpdate(uu.name, u.username+delimiter, update); nu != nil {
+				unified = append(unified, nu)
+			}
+
+			if inbox == nil || update.Mailbox() != inbox.name {
+				continue
+			}
+			if update, ok := update.(*imapbackend.MessageUpdate); ok {
+				if mu := uu.inbox.messageUpdate(inbox, update); mu != nil {
+					unified = append(unified, mu)
+				}
+			} else {
+				inboxChanged = true
+			}
+		}
+
+		if !inboxChanged {
+			continue
+		}
+		uu.inbox.Lock()
+		initialized := uu.inbox.initialized
+		uu.inbox.Unlock()
+		if !initialized {
+			// No client has opened the unified inbox yet
+			continue
+		}
+		changes, err := uu.inbox.changes()
+		if err != nil {
+			logger.Warn("cannot synchronize the unified inbox", "users", uu.name, "error", err)
+			continue
+		}
+		unified = append(unified, changes...)
+	}
+	return unified
+}
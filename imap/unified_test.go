@@ -0,0 +1,153 @@
+package imap
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/emersion/go-imap"
+
+	"github.com/emersion/hydroxide/config"
+	"github.com/emersion/hydroxide/imap/database"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func openTestMailbox(t *testing.T, filename string, ids []string) *database.Mailbox {
+	u, err := database.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := u.Mailbox(protonmail.LabelInbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := make([]*protonmail.Message, len(ids))
+	for i, id := range ids {
+		messages[i] = &protonmail.Message{ID: id}
+	}
+	if _, _, err := mbox.Sync(messages); err != nil {
+		t.Fatal(err)
+	}
+	return mbox
+}
+
+// formatCriteria formats the sequence numbers and UIDs of search criteria.
+func formatCriteria(c *imap.SearchCriteria) string {
+	s := "("
+	if c.SeqNum != nil {
+		s += " seq:" + c.SeqNum.String()
+	}
+	if c.Uid != nil {
+		s += " uid:" + c.Uid.String()
+	}
+	for _, not := range c.Not {
+		s += " not" + formatCriteria(not)
+	}
+	for _, or := range c.Or {
+		s += " or" + formatCriteria(or[0]) + formatCriteria(or[1])
+	}
+	return s + " )"
+}
+
+func TestUnifiedOwnerCriteria(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hydroxide-imap-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config.SetDir(dir)
+	defer config.SetDir("")
+
+	// Messages a, b, c and d have the UIDs 1 to 4 in the unified inbox
+	alice := &mailbox{name: "INBOX", db: openTestMailbox(t, "alice.db", []string{"a", "c"})}
+	bob := &mailbox{name: "INBOX", db: openTestMailbox(t, "bob.db", []string{"b", "d"})}
+	mbox := &unifiedMailbox{
+		db: openTestMailbox(t, "unified.db", []string{"a", "b", "c", "d"}),
+		owners: map[string]*mailbox{
+			"a": alice,
+			"b": bob,
+			"c": alice,
+			"d": bob,
+		},
+	}
+
+	set := func(s string) *imap.SeqSet {
+		seqSet, err := imap.ParseSeqSet(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return seqSet
+	}
+
+	tests := []struct {
+		name     string
+		criteria *imap.SearchCriteria
+		alice    string
+		bob      string
+	}{
+		{
+			name:     "no sequence set",
+			criteria: &imap.SearchCriteria{},
+			alice:    "( )",
+			bob:      "( )",
+		},
+		{
+			name:     "UIDs",
+			criteria: &imap.SearchCriteria{Uid: set("1:2")},
+			alice:    "( uid:1 )",
+			bob:      "( uid:1 )",
+		},
+		{
+			name:     "sequence numbers and UIDs",
+			criteria: &imap.SearchCriteria{SeqNum: set("2:*"), Uid: set("1:3")},
+			alice:    "( uid:2 )",
+			bob:      "( uid:1 )",
+		},
+		{
+			name:     "no match",
+			criteria: &imap.SearchCriteria{SeqNum: set("3")},
+			alice:    "( uid:2 )",
+			bob:      "( uid: )",
+		},
+		{
+			name: "NOT",
+			criteria: &imap.SearchCriteria{
+				Not: []*imap.SearchCriteria{{SeqNum: set("3:4")}},
+			},
+			alice: "( not( uid:2 ) )",
+			bob:   "( not( uid:2 ) )",
+		},
+		{
+			name: "nested OR",
+			criteria: &imap.SearchCriteria{
+				Not: []*imap.SearchCriteria{{
+					Or: [][2]*imap.SearchCriteria{{{Uid: set("1")}, {SeqNum: set("4")}}},
+				}},
+			},
+			alice: "( not( or( uid:1 )( uid: ) ) )",
+			bob:   "( not( or( uid: )( uid:2 ) ) )",
+		},
+	}
+	for _, tc := range tests {
+		before := formatCriteria(tc.criteria)
+		for _, owner := range []struct {
+			name  string
+			inbox *mailbox
+			want  string
+		}{
+			{"alice", alice, tc.alice},
+			{"bob", bob, tc.bob},
+		} {
+			c, err := mbox.ownerCriteria(tc.criteria, owner.inbox)
+			if err != nil {
+				t.Fatalf("%v: ownerCriteria(%v) = %v", tc.name, owner.name, err)
+			}
+			if got := formatCriteria(c); got != owner.want {
+				t.Errorf("%v: ownerCriteria(%v) = %v, want %v", tc.name, owner.name, got, owner.want)
+			}
+		}
+		if after := formatCriteria(tc.criteria); after != before {
+			t.Errorf("%v: criteria changed from %v to %v", tc.name, before, after)
+		}
+	}
+}
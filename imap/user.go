@@ -1,7 +1,7 @@
 package imap
 
 import (
-	"log"
+	"context"
 	"strings"
 	"sync"
 
@@ -12,6 +12,7 @@ import (
 
 	"github.com/emersion/hydroxide/events"
 	"github.com/emersion/hydroxide/imap/database"
+	"github.com/emersion/hydroxide/logging"
 	"github.com/emersion/hydroxide/protonmail"
 )
 
@@ -28,6 +29,8 @@ var systemMailboxes = []struct {
 	{"Spam", protonmail.LabelSpam, []string{specialuse.Junk}},
 	{"Sent", protonmail.LabelSent, []string{specialuse.Sent}},
 	{"Trash", protonmail.LabelTrash, []string{specialuse.Trash}},
+	{"Scheduled", protonmail.LabelScheduled, nil},
+	{"Snoozed", protonmail.LabelSnoozed, nil},
 }
 
 var systemFlags = []struct {
@@ -41,53 +44,91 @@ var systemFlags = []struct {
 type user struct {
 	username    string
 	backend     *backend
+	logger      *logging.Logger
 	c           *protonmail.Client
 	u           *protonmail.User
 	privateKeys openpgp.EntityList
 	addrs       []*protonmail.Address
 
 	db             *database.User
+	messageCache   *database.MessageCache
 	eventsReceiver *events.Receiver
+	// Sections of messages kept for partial fetches
+	spoolCache *spoolCache
+
+	// Nil if the search index is disabled
+	searchIndex *database.SearchIndex
+	indexQueue  chan string
 
 	done      chan<- struct{}
 	eventSent chan struct{}
 
+	// Cancelled when the last client logs out
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	sync.Mutex // protects everything below
 
 	numClients int
-	mailboxes  map[string]*mailbox // indexed by label ID
-	flags      map[string]string   // indexed by label ID
+	mailboxes  map[string]*mailbox          // indexed by label ID
+	flags      map[string]string            // indexed by label ID
+	labels     map[string]*protonmail.Label // user folders and labels, indexed by ID
+
+	senderKeysCache map[string]openpgp.EntityList // indexed by email address
 }
 
-func getUser(be *backend, username string, c *protonmail.Client, privateKeys openpgp.EntityList) (*user, error) {
-	// TODO: logging a user in may take some time, find a way not to lock all
-	// other logins during this time
-	be.Lock()
-	defer be.Unlock()
-
-	if u, ok := be.users[username]; ok {
-		u.Lock()
-		u.numClients++
-		u.Unlock()
-		return u, nil
-	} else {
-		u, err := newUser(be, username, c, privateKeys)
-		if err != nil {
-			return nil, err
+func getUser(ctx context.Context, be *backend, username string, c *protonmail.Client, privateKeys openpgp.EntityList) (*user, error) {
+	for {
+		be.Lock()
+		if u, ok := be.users[username]; ok {
+			u.Lock()
+			u.numClients++
+			u.Unlock()
+			be.Unlock()
+			return u, nil
 		}
 
-		be.users[username] = u
-		return u, nil
+		// Logging a user in may take some time: only other logins of the same
+		// user wait for it
+		if l, ok := be.logins[username]; ok {
+			be.Unlock()
+			select {
+			case <-l.done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			if l.err != nil {
+				return nil, l.err
+			}
+			continue
+		}
+
+		l := &pendingLogin{done: make(chan struct{})}
+		be.logins[username] = l
+		be.Unlock()
+
+		u, err := newUser(ctx, be, username, c, privateKeys)
+
+		be.Lock()
+		delete(be.logins, username)
+		if err == nil {
+			be.users[username] = u
+		}
+		be.Unlock()
+
+		l.err = err
+		close(l.done)
+		return u, err
 	}
 }
 
-func newUser(be *backend, username string, c *protonmail.Client, privateKeys openpgp.EntityList) (*user, error) {
-	u, err := c.GetCurrentUser()
+func newUser(ctx context.Context, be *backend, username string, c *protonmail.Client, privateKeys openpgp.EntityList) (*user, error) {
+	u, err := c.GetCurrentUser(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	addrs, err := c.ListAddresses()
+	addrs, err := c.ListAddresses(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -95,12 +136,16 @@ func newUser(be *backend, username string, c *protonmail.Client, privateKeys ope
 	uu := &user{
 		username:    username,
 		backend:     be,
+		logger:      logger.With("user", username),
 		c:           c,
 		u:           u,
 		privateKeys: privateKeys,
 		addrs:       addrs,
 		eventSent:   make(chan struct{}),
+		spoolCache:  newSpoolCache(),
 		numClients:  1,
+
+		senderKeysCache: make(map[string]openpgp.EntityList),
 	}
 
 	db, err := database.Open(u.Name + ".db")
@@ -108,8 +153,26 @@ func newUser(be *backend, username string, c *protonmail.Client, privateKeys ope
 		return nil, err
 	}
 	uu.db = db
+	uu.ctx, uu.cancel = context.WithCancel(context.Background())
 
-	if err := uu.initMailboxes(); err != nil {
+	if be.options.SearchIndex {
+		if uu.searchIndex, err = db.SearchIndex(privateKeys); err != nil {
+			return nil, err
+		}
+		uu.indexQueue = make(chan string, indexQueueSize)
+	}
+	if cacheSize := be.options.MessageCacheSize; cacheSize >= 0 {
+		if cacheSize == 0 {
+			cacheSize = defaultMessageCacheSize
+		}
+		if uu.messageCache, err = db.MessageCache(privateKeys, cacheSize); err != nil {
+			return nil, err
+		}
+	} else if err := db.DeleteMessageCache(); err != nil {
+		return nil, err
+	}
+
+	if err := uu.initMailboxes(ctx); err != nil {
 		return nil, err
 	}
 
@@ -119,7 +182,14 @@ func newUser(be *backend, username string, c *protonmail.Client, privateKeys ope
 	go uu.receiveEvents(be.updates, ch)
 	uu.eventsReceiver = be.eventsManager.Register(c, u.Name, ch, done)
 
-	log.Printf("User %q logged in via IMAP", u.Name)
+	if len(be.options.Retention) > 0 {
+		go uu.enforceRetention(done)
+	}
+	if uu.searchIndex != nil {
+		go uu.indexNewMessages(done)
+	}
+
+	uu.logger.Info("user logged in")
 	return uu, nil
 }
 
@@ -150,7 +220,7 @@ func labelNameToFlag(s string) string {
 	return sb.String()
 }
 
-func (u *user) initMailboxes() error {
+func (u *user) initMailboxes(ctx context.Context) error {
 	u.Lock()
 	defer u.Unlock()
 
@@ -168,45 +238,37 @@ func (u *user) initMailboxes() error {
 		u.flags[data.label] = data.name
 	}
 
-	labels, err := u.c.ListLabels()
+	labels, err := u.c.ListLabels(ctx)
 	if err != nil {
 		return err
 	}
 
-	for _, label := range labels {
-		if label.Exclusive == 1 {
-			if _, ok := u.mailboxes[label.ID]; ok {
-				continue
-			}
-
-			u.mailboxes[label.ID], err = newMailbox(label.Name, label.ID, nil, u)
-			if err != nil {
-				return err
-			}
-		} else {
-			if _, ok := u.flags[label.ID]; ok {
-				continue
-			}
-
-			u.flags[label.ID] = labelNameToFlag(label.Name)
-		}
+	u.labels = nil
+	if err := u.setLabels(labels); err != nil {
+		return err
 	}
 
-	counts, err := u.c.CountMessages("")
+	counts, err := u.c.CountMessages(ctx, "")
 	if err != nil {
 		return err
 	}
 
 	for _, count := range counts {
 		if mbox, ok := u.mailboxes[count.LabelID]; ok {
-			mbox.total = count.Total
-			mbox.unread = count.Unread
+			mbox.setCounts(count.Total, count.Unread)
 		}
 	}
 
 	return nil
 }
 
+// context returns a context for the API requests of a single operation. It's
+// cancelled when the user logs out or after requestTimeout, so that a stuck
+// request doesn't block an IMAP connection forever.
+func (u *user) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(u.ctx, requestTimeout)
+}
+
 func (u *user) Username() string {
 	return u.u.Name
 }
@@ -260,18 +322,6 @@ func (u *user) getFlag(name string) string {
 	return ""
 }
 
-func (u *user) CreateMailbox(name string) error {
-	return errNotYetImplemented // TODO
-}
-
-func (u *user) DeleteMailbox(name string) error {
-	return errNotYetImplemented // TODO
-}
-
-func (u *user) RenameMailbox(existingName, newName string) error {
-	return errNotYetImplemented // TODO
-}
-
 func (u *user) Logout() error {
 	u.backend.Lock()
 	defer u.backend.Unlock()
@@ -289,18 +339,26 @@ func (u *user) Logout() error {
 	delete(u.backend.users, u.username)
 
 	close(u.done)
+	u.cancel()
+	u.spoolCache.clear()
 
 	if err := u.db.Close(); err != nil {
 		return err
 	}
 
-	log.Printf("User %q logged out via IMAP", u.u.Name)
+	u.logger.Info("user logged out")
 	u.c = nil
 	u.u = nil
 	u.privateKeys = nil
 	return nil
 }
 
+// notify sends updates to all connections and waits until they've been
+// delivered.
+func (u *user) notify(updates []imapbackend.Update) {
+	u.backend.notify(append(updates, u.backend.unifiedUpdates(u, updates)...))
+}
+
 func (u *user) poll() {
 	go u.eventsReceiver.Poll()
 	<-u.eventSent
@@ -308,37 +366,49 @@ func (u *user) poll() {
 
 func (u *user) receiveEvents(updates chan<- imapbackend.Update, events <-chan *protonmail.Event) {
 	for event := range events {
+		ctx, cancel := u.context()
 		var eventUpdates []imapbackend.Update
 
 		if event.Refresh&protonmail.EventRefreshMail != 0 {
-			log.Println("Reinitializing the whole IMAP database")
+			u.logger.Info("reinitializing the whole IMAP database")
 
 			u.Lock()
 			for _, mbox := range u.mailboxes {
 				if err := mbox.reset(); err != nil {
-					log.Printf("cannot reset mailbox %s: %v", mbox.name, err)
+					u.logger.Warn("cannot reset mailbox", "mailbox", mbox.name, "error", err)
 				}
 			}
 			u.Unlock()
 
 			if err := u.db.ResetMessages(); err != nil {
-				log.Printf("cannot reset user: %v", err)
+				u.logger.Warn("cannot reset user", "error", err)
+			}
+			if err := u.messageCache.Clear(); err != nil {
+				u.logger.Warn("cannot clear message cache", "error", err)
 			}
 
-			if err := u.initMailboxes(); err != nil {
-				log.Printf("cannot reinitialize mailboxes: %v", err)
+			if err := u.initMailboxes(ctx); err != nil {
+				u.logger.Warn("cannot reinitialize mailboxes", "error", err)
 			}
 		} else {
+			if len(event.Labels) > 0 {
+				if err := u.refreshLabels(ctx); err != nil {
+					u.logger.Warn("cannot refresh labels", "error", err)
+				}
+			}
+
 			for _, eventMessage := range event.Messages {
 				switch eventMessage.Action {
 				case protonmail.EventCreate:
-					log.Println("Received create event for message", eventMessage.ID)
+					u.logger.Debug("received create event", "message", eventMessage.ID)
 					seqNums, err := u.db.CreateMessage(eventMessage.Created)
 					if err != nil {
-						log.Printf("cannot handle create event for message %s: cannot create message in local DB: %v", eventMessage.ID, err)
+						u.logger.Warn("cannot handle create event: cannot create message in local DB", "message", eventMessage.ID, "error", err)
 						break
 					}
 
+					u.queueIndex(eventMessage.ID)
+
 					// TODO: what if the message was already in the local DB?
 					for labelID, seqNum := range seqNums {
 						if mbox := u.getMailboxByLabel(labelID); mbox != nil {
@@ -350,12 +420,36 @@ func (u *user) receiveEvents(updates chan<- imapbackend.Update, events <-chan *p
 						}
 					}
 				case protonmail.EventUpdate, protonmail.EventUpdateFlags:
-					log.Println("Received update event for message", eventMessage.ID)
+					u.logger.Debug("received update event", "message", eventMessage.ID)
+					if eventMessage.Action == protonmail.EventUpdate {
+						// The message body may have changed (e.g. drafts)
+						u.reindex(eventMessage.ID)
+					}
+					before, err := u.db.Message(eventMessage.ID)
+					if err != nil {
+						u.logger.Warn("cannot handle update event: cannot get message from local DB", "message", eventMessage.ID, "error", err)
+						break
+					}
+					if eventMessage.Action == protonmail.EventUpdate && before.Type == protonmail.MessageDraft {
+						err = u.messageCache.Remove(eventMessage.ID)
+					} else {
+						err = u.messageCache.Update(eventMessage.ID, eventMessage.Updated)
+					}
+					if err != nil {
+						u.logger.Warn("cannot update message in cache", "message", eventMessage.ID, "error", err)
+					}
 					createdSeqNums, deletedSeqNums, err := u.db.UpdateMessage(eventMessage.ID, eventMessage.Updated)
 					if err != nil {
-						log.Printf("cannot handle update event for message %s: cannot update message in local DB: %v", eventMessage.ID, err)
+						u.logger.Warn("cannot handle update event: cannot update message in local DB", "message", eventMessage.ID, "error", err)
 						break
 					}
+					if eventMessage.Action == protonmail.EventUpdate {
+						draftUpdates, err := u.draftEdited(ctx, before, eventMessage.Updated)
+						if err != nil {
+							u.logger.Warn("cannot handle update event for draft", "message", eventMessage.ID, "error", err)
+						}
+						eventUpdates = append(eventUpdates, draftUpdates...)
+					}
 
 					for labelID, seqNum := range createdSeqNums {
 						if mbox := u.getMailboxByLabel(labelID); mbox != nil {
@@ -378,7 +472,7 @@ func (u *user) receiveEvents(updates chan<- imapbackend.Update, events <-chan *p
 					// Send message updates
 					msg, err := u.db.Message(eventMessage.ID)
 					if err != nil {
-						log.Printf("cannot handle update event for message %s: cannot get updated message from local DB: %v", eventMessage.ID, err)
+						u.logger.Warn("cannot handle update event: cannot get updated message from local DB", "message", eventMessage.ID, "error", err)
 						break
 					}
 					for _, labelID := range msg.LabelIDs {
@@ -389,24 +483,23 @@ func (u *user) receiveEvents(updates chan<- imapbackend.Update, events <-chan *p
 						}
 
 						if mbox := u.getMailboxByLabel(labelID); mbox != nil {
-							seqNum, _, err := mbox.db.FromApiID(eventMessage.ID)
+							update, err := mbox.flagsUpdate(msg)
 							if err != nil {
-								log.Printf("cannot handle update event for message %s: cannot get message sequence number in %s: %v", eventMessage.ID, mbox.name, err)
+								u.logger.Warn("cannot handle update event: cannot get message sequence number", "message", eventMessage.ID, "mailbox", mbox.name, "error", err)
 								continue
 							}
-
-							update := new(imapbackend.MessageUpdate)
-							update.Update = imapbackend.NewUpdate(u.u.Name, mbox.name)
-							update.Message = imap.NewMessage(seqNum, []imap.FetchItem{imap.FetchFlags})
-							update.Message.Flags = mbox.fetchFlags(msg)
 							eventUpdates = append(eventUpdates, update)
 						}
 					}
 				case protonmail.EventDelete:
-					log.Println("Received delete event for message", eventMessage.ID)
+					u.logger.Debug("received delete event", "message", eventMessage.ID)
+					u.unindex(eventMessage.ID)
+					if err := u.messageCache.Remove(eventMessage.ID); err != nil {
+						u.logger.Warn("cannot remove message from cache", "message", eventMessage.ID, "error", err)
+					}
 					seqNums, err := u.db.DeleteMessage(eventMessage.ID)
 					if err != nil {
-						log.Printf("cannot handle delete event for message %s: cannot delete message from local DB: %v", eventMessage.ID, err)
+						u.logger.Warn("cannot handle delete event: cannot delete message from local DB", "message", eventMessage.ID, "error", err)
 						break
 					}
 
@@ -424,13 +517,14 @@ func (u *user) receiveEvents(updates chan<- imapbackend.Update, events <-chan *p
 			u.Lock()
 			for _, count := range event.MessageCounts {
 				if mbox, ok := u.mailboxes[count.LabelID]; ok {
-					mbox.total = count.Total
-					mbox.unread = count.Unread
+					mbox.setCounts(count.Total, count.Unread)
 				}
 			}
 			u.Unlock()
 		}
+		cancel()
 
+		eventUpdates = append(eventUpdates, u.backend.unifiedUpdates(u, eventUpdates)...)
 		for _, update := range eventUpdates {
 			updates <- update
 		}
@@ -0,0 +1,151 @@
+package imap
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// authServID is the authentication service identifier used in the
+// Authentication-Results header fields synthesized by hydroxide (RFC 8601).
+const authServID = "hydroxide"
+
+// protonAuthServIDs are the authentication service identifiers used by
+// ProtonMail in the header fields it adds to received messages.
+var protonAuthServIDs = []string{"mail.protonmail.ch", "protonmail.ch", "proton.me"}
+
+// signatureResult is the result of the verification of a message signature.
+type signatureResult struct {
+	// Result is one of "pass", "fail", "neutral" (the signing key is unknown)
+	// or "none" (the message isn't signed)
+	Result string
+	KeyID  uint64
+}
+
+// verifySignature checks the signature of a message. It must be called after
+// the whole body has been read.
+func verifySignature(md *openpgp.MessageDetails) *signatureResult {
+	switch {
+	case !md.IsSigned:
+		return &signatureResult{Result: "none"}
+	case md.SignedBy == nil:
+		return &signatureResult{Result: "neutral", KeyID: md.SignedByKeyId}
+	case md.SignatureError != nil:
+		return &signatureResult{Result: "fail", KeyID: md.SignedByKeyId}
+	default:
+		return &signatureResult{Result: "pass", KeyID: md.SignedByKeyId}
+	}
+}
+
+// signatureStatus describes a signature result for the X-Pm-Signature header
+// field: "verified", "failed", "unverified" if the signing key is unknown, or
+// "none" if the message isn't signed.
+func signatureStatus(sig *signatureResult) string {
+	switch sig.Result {
+	case "pass":
+		return "verified"
+	case "fail":
+		return "failed"
+	case "neutral":
+		return "unverified"
+	default:
+		return "none"
+	}
+}
+
+// senderKeys returns the public keys of a sender, used to verify signatures.
+// Keys are known for ProtonMail users and for correspondents who have sent an
+// Autocrypt header field.
+func (u *user) senderKeys(ctx context.Context, email string) openpgp.EntityList {
+	email = strings.ToLower(email)
+
+	u.Lock()
+	keys, ok := u.senderKeysCache[email]
+	u.Unlock()
+	if ok {
+		return keys
+	}
+
+	resp, err := u.c.GetPublicKeys(ctx, email)
+	if err != nil {
+		u.logger.Warn("cannot get public keys", "email", email, "error", err)
+		return nil
+	}
+	for _, pub := range resp.Keys {
+		e, err := pub.Entity()
+		if err != nil {
+			u.logger.Warn("cannot parse public key", "email", email, "error", err)
+			continue
+		}
+		keys = append(keys, e)
+	}
+	if e := u.autocryptKey(email); e != nil {
+		keys = append(keys, e)
+	}
+
+	u.Lock()
+	u.senderKeysCache[email] = keys
+	u.Unlock()
+	return keys
+}
+
+// verificationKeyRing returns the keys used to decrypt and verify a message.
+func (u *user) verificationKeyRing(ctx context.Context, msg *protonmail.Message) openpgp.EntityList {
+	keyRing := append(openpgp.EntityList(nil), u.privateKeys...)
+	if msg.Sender != nil && msg.Sender.Address != "" {
+		keyRing = append(keyRing, u.senderKeys(ctx, msg.Sender.Address)...)
+	}
+	return keyRing
+}
+
+func isProtonAuthServID(v string) bool {
+	id := strings.TrimSpace(strings.SplitN(v, ";", 2)[0])
+	for _, want := range protonAuthServIDs {
+		if strings.EqualFold(id, want) {
+			return true
+		}
+	}
+	return false
+}
+
+// setAuthenticationResults adds Authentication-Results header fields to h,
+// containing ProtonMail's SPF, DKIM and DMARC verdicts and the result of the
+// PGP signature verification, also summarized in an X-Pm-Signature field. Any
+// such field already present in h is removed, so that senders can't forge
+// them.
+//
+// Only the topmost Authentication-Results field of the received message is
+// kept, and only if it has been added by ProtonMail's MX: fields further down
+// have been added before the message reached ProtonMail, possibly by the
+// sender, even with ProtonMail's authentication service identifier.
+func setAuthenticationResults(h *message.Header, msg *protonmail.Message, sig *signatureResult) {
+	h.Del("Authentication-Results")
+	h.Del("X-Pm-Signature")
+
+	if msg.Header != "" {
+		raw, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(msg.Header)))
+		if v := raw.Get("Authentication-Results"); err == nil && isProtonAuthServID(v) {
+			h.Add("Authentication-Results", v)
+		}
+	}
+
+	if sig == nil {
+		return
+	}
+	v := fmt.Sprintf("%v; x-pgp=%v", authServID, sig.Result)
+	if sig.KeyID != 0 {
+		v += fmt.Sprintf(" (key %016X)", sig.KeyID)
+	}
+	if msg.Sender != nil && msg.Sender.Address != "" {
+		v += " header.from=" + msg.Sender.Address
+	}
+	h.Add("Authentication-Results", v)
+	h.Set("X-Pm-Signature", signatureStatus(sig))
+}
@@ -0,0 +1,69 @@
+package imap
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-message"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestSetAuthenticationResults(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		sig    *signatureResult
+		want   []string
+	}{
+		{
+			name:   "ProtonMail",
+			header: "Authentication-Results: mail.protonmail.ch; dkim=pass\r\nFrom: a@example.org\r\n\r\n",
+			want:   []string{"mail.protonmail.ch; dkim=pass"},
+		},
+		{
+			name:   "forged below ProtonMail",
+			header: "Authentication-Results: mail.protonmail.ch; dkim=fail\r\nAuthentication-Results: mail.protonmail.ch; dkim=pass\r\n\r\n",
+			want:   []string{"mail.protonmail.ch; dkim=fail"},
+		},
+		{
+			name:   "other service on top",
+			header: "Authentication-Results: mx.example.org; dkim=pass\r\nAuthentication-Results: mail.protonmail.ch; dkim=pass\r\n\r\n",
+			want:   nil,
+		},
+		{
+			name:   "no header",
+			header: "",
+			want:   nil,
+		},
+		{
+			name:   "signature",
+			header: "Authentication-Results: protonmail.ch; spf=pass\r\n\r\n",
+			sig:    &signatureResult{Result: "pass", KeyID: 0x1234},
+			want:   []string{"hydroxide; x-pgp=pass (key 0000000000001234) header.from=a@example.org", "protonmail.ch; spf=pass"},
+		},
+	}
+	for _, tc := range tests {
+		var h message.Header
+		h.Add("Authentication-Results", "mail.protonmail.ch; dkim=pass")
+		h.Set("X-Pm-Signature", "verified")
+		msg := &protonmail.Message{
+			Header: tc.header,
+			Sender: &protonmail.MessageAddress{Address: "a@example.org"},
+		}
+
+		setAuthenticationResults(&h, msg, tc.sig)
+
+		var got []string
+		fields := h.FieldsByKey("Authentication-Results")
+		for fields.Next() {
+			got = append(got, fields.Value())
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: Authentication-Results = %q, want %q", tc.name, got, tc.want)
+		}
+		if tc.sig == nil && h.Has("X-Pm-Signature") {
+			t.Errorf("%v: X-Pm-Signature wasn't removed", tc.name)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package imports
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-mbox"
+	"github.com/emersion/go-message/textproto"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// BulkOptions contains options for importing many messages at once.
+type BulkOptions struct {
+	// Labels applied to all messages, defaults to the inbox. Messages must be
+	// in at least one folder.
+	LabelIDs []string
+	// Number of messages imported concurrently, defaults to 1
+	Workers int
+	// Progress, if set, is called after each message with its name and the
+	// error which prevented it from being imported, if any. Calls aren't
+	// concurrent.
+	Progress func(name string, err error)
+}
+
+type bulkMessage struct {
+	name     string
+	b        []byte
+	metadata *protonmail.Message
+}
+
+func (options *BulkOptions) metadata() *protonmail.Message {
+	labelIDs := options.LabelIDs
+	if len(labelIDs) == 0 {
+		labelIDs = []string{protonmail.LabelInbox}
+	}
+	return &protonmail.Message{
+		Type:     protonmail.MessageInbox,
+		LabelIDs: append([]string(nil), labelIDs...),
+	}
+}
+
+// progress returns a function calling options.Progress, safe for concurrent
+// use.
+func (options *BulkOptions) progress() func(name string, err error) {
+	var locker sync.Mutex
+	return func(name string, err error) {
+		if options.Progress == nil {
+			return
+		}
+		locker.Lock()
+		defer locker.Unlock()
+		options.Progress(name, err)
+	}
+}
+
+// startBulk starts options.Workers workers importing the messages sent to the
+// returned channel. The returned function closes the channel and waits for
+// the workers to finish.
+func startBulk(ctx context.Context, c *protonmail.Client, options *BulkOptions, progress func(name string, err error)) (chan<- *bulkMessage, func()) {
+	workers := options.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	ch := make(chan *bulkMessage)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for msg := range ch {
+				_, err := ImportMessageWithMetadata(ctx, c, bytes.NewReader(msg.b), msg.metadata)
+				progress(msg.name, err)
+			}
+		}()
+	}
+
+	return ch, func() {
+		close(ch)
+		wg.Wait()
+	}
+}
+
+// mboxFlags reads the flags of an mbox message from the Status and X-Status
+// header fields written by most mail clients. Messages without a Status field
+// are considered read, so that archives exported by other providers aren't
+// imported as unread.
+func mboxFlags(b []byte, metadata *protonmail.Message) {
+	h, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		return
+	}
+	if status := h.Get("Status"); status != "" && !strings.Contains(status, "R") {
+		metadata.Unread = 1
+	}
+	if strings.Contains(h.Get("X-Status"), "F") {
+		metadata.LabelIDs = append(metadata.LabelIDs, protonmail.LabelStarred)
+	}
+}
+
+// ImportMbox imports all messages of an mbox file. Messages which can't be
+// imported are reported to options.Progress. An error is only returned if the
+// file can't be read.
+func ImportMbox(ctx context.Context, c *protonmail.Client, r io.Reader, options *BulkOptions) error {
+	progress := options.progress()
+	ch, wait := startBulk(ctx, c, options, progress)
+	defer wait()
+
+	mr := mbox.NewReader(r)
+	for i := 1; ; i++ {
+		msgReader, err := mr.NextMessage()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		b, err := ioutil.ReadAll(msgReader)
+		if err != nil {
+			return err
+		}
+
+		metadata := options.metadata()
+		mboxFlags(b, metadata)
+
+		select {
+		case ch <- &bulkMessage{name: "message #" + strconv.Itoa(i), b: b, metadata: metadata}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// maildirFlags reads the flags of a Maildir message from the info section of
+// its file name.
+func maildirFlags(name string, metadata *protonmail.Message) {
+	metadata.Unread = 1
+	i := strings.LastIndex(name, ":2,")
+	if i < 0 {
+		return
+	}
+	flags := name[i+len(":2,"):]
+	if strings.ContainsRune(flags, 'S') {
+		metadata.Unread = 0
+	}
+	if strings.ContainsRune(flags, 'F') {
+		metadata.LabelIDs = append(metadata.LabelIDs, protonmail.LabelStarred)
+	}
+}
+
+// ListMaildir lists the messages of a Maildir, in its cur and new
+// sub-directories. Sub-folders aren't listed.
+func ListMaildir(dir string) ([]string, error) {
+	var paths []string
+	for _, sub := range []string{"cur", "new"} {
+		fis, err := ioutil.ReadDir(filepath.Join(dir, sub))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, fi := range fis {
+			if fi.Mode().IsRegular() && !strings.HasPrefix(fi.Name(), ".") {
+				paths = append(paths, filepath.Join(dir, sub, fi.Name()))
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// ImportMaildir imports the messages listed by ListMaildir. Messages which can't
+// be read or imported are reported to options.Progress. Messages without a
+// Date header field are dated after their file's modification time.
+func ImportMaildir(ctx context.Context, c *protonmail.Client, paths []string, options *BulkOptions) error {
+	progress := options.progress()
+	ch, wait := startBulk(ctx, c, options, progress)
+	defer wait()
+
+	for _, p := range paths {
+		msg := &bulkMessage{name: p, metadata: options.metadata()}
+		maildirFlags(filepath.Base(p), msg.metadata)
+
+		var err error
+		msg.b, err = ioutil.ReadFile(p)
+		if err != nil {
+			progress(p, err)
+			continue
+		}
+		if fi, err := os.Stat(p); err == nil {
+			msg.metadata.Time = protonmail.Timestamp(fi.ModTime().Unix())
+		}
+
+		select {
+		case ch <- msg:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
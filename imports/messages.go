@@ -1,86 +1,136 @@
 package imports
 
 import (
+	"bufio"
+	"context"
 	"fmt"
 	"io"
+	"strings"
+	"time"
 
+	"github.com/emersion/go-message"
 	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
 	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/openpgp/armor"
 
 	"github.com/emersion/hydroxide/protonmail"
 )
 
-func ImportMessage(c *protonmail.Client, r io.Reader) error {
-	mr, err := mail.CreateReader(r)
+// ImportMessage imports a message into the inbox.
+func ImportMessage(ctx context.Context, c *protonmail.Client, r io.Reader) error {
+	_, err := ImportMessageWithMetadata(ctx, c, r, &protonmail.Message{
+		Unread:   1,
+		LabelIDs: []string{protonmail.LabelInbox},
+		Type:     protonmail.MessageInbox,
+	})
+	return err
+}
+
+// ImportMessageWithMetadata imports a message with the provided labels, flags
+// and type. If metadata.AddressID is empty, the address is chosen depending on
+// the message header. If the message has no Date header field, metadata.Time
+// is used. The ID of the imported message is returned.
+func ImportMessageWithMetadata(ctx context.Context, c *protonmail.Client, r io.Reader, metadata *protonmail.Message) (string, error) {
+	br := bufio.NewReader(r)
+	h, err := textproto.ReadHeader(br)
 	if err != nil {
-		return err
+		return "", fmt.Errorf("cannot parse message header: %v", err)
 	}
-	defer mr.Close()
-
-	// TODO: support attachments
-	hdr := mr.Header
-	var body io.Reader
-	for {
-		p, err := mr.NextPart()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return err
-		}
 
-		if _, ok := p.Header.(*mail.InlineHeader); ok {
-			if t := p.Header.Get("Content-Type"); t != "" {
-				hdr.Set("Content-Type", t)
-			}
-			body = p.Body
-			break
-		}
-	}
-	if body == nil {
-		return fmt.Errorf("message has no body")
+	if !h.Has("Date") && metadata.Time != 0 {
+		h.Set("Date", metadata.Time.Time().Format(time.RFC1123Z))
 	}
 
-	addrs, err := c.ListAddresses()
+	addrs, err := c.ListAddresses(ctx)
 	if err != nil {
-		return err
-	}
-	// TODO: choose address depending on message header
-	var importAddr *protonmail.Address
-	for _, addr := range addrs {
-		if addr.Send == protonmail.AddressSendPrimary {
-			importAddr = addr
-			break
-		}
+		return "", err
 	}
+	importAddr := chooseAddress(mail.Header{Header: message.Header{Header: h}}, addrs, metadata.AddressID)
 	if importAddr == nil {
-		return fmt.Errorf("no primary address found")
+		return "", fmt.Errorf("no primary address found")
 	}
 
 	publicKey, err := importAddr.Keys[0].Entity()
 	if err != nil {
-		return err
+		return "", err
 	}
 
+	meta := *metadata
+	meta.AddressID = importAddr.ID
+
 	key := "0"
-	metadata := map[string]*protonmail.Message{
-		key: {
-			Unread:    1,
-			LabelIDs:  []string{protonmail.LabelInbox},
-			Type:      protonmail.MessageInbox,
-			AddressID: importAddr.ID,
-		},
-	}
-	importer, err := c.Import(metadata)
+	importer, err := c.Import(ctx, map[string]*protonmail.Message{key: &meta})
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	w, err := importer.ImportMessage(key)
 	if err != nil {
+		return "", err
+	}
+
+	mh := message.Header{Header: h}
+	mediaType, _, _ := mh.ContentType()
+	if strings.HasPrefix(mediaType, "multipart/") {
+		err = writePGPMIME(w, h, br, publicKey)
+	} else {
+		err = writeInline(w, h, br, publicKey)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	result, err := importer.Commit()
+	if err != nil {
+		return "", err
+	} else if err := result.Err(); err != nil {
+		return "", err
+	}
+
+	return result[key].MessageID, nil
+}
+
+// chooseAddress returns the address a message belongs to: the address with
+// the provided ID if any, otherwise the first one of the user's addresses
+// found in the message header. It falls back to the primary address.
+func chooseAddress(h mail.Header, addrs []*protonmail.Address, id string) *protonmail.Address {
+	if id != "" {
+		for _, addr := range addrs {
+			if addr.ID == id {
+				return addr
+			}
+		}
+	}
+
+	for _, k := range []string{"Delivered-To", "To", "Cc", "From"} {
+		l, _ := h.AddressList(k)
+		for _, a := range l {
+			email := protonmail.ASCIIAddress(a.Address)
+			for _, addr := range addrs {
+				if strings.EqualFold(protonmail.ASCIIAddress(addr.Email), email) {
+					return addr
+				}
+			}
+		}
+	}
+
+	for _, addr := range addrs {
+		if addr.Send == protonmail.AddressSendPrimary {
+			return addr
+		}
+	}
+	return nil
+}
+
+// writeInline writes a single-part message, with an encrypted inline body.
+func writeInline(w io.Writer, h textproto.Header, body io.Reader, to *openpgp.Entity) error {
+	e, err := message.New(message.Header{Header: h}, body)
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
 		return err
 	}
 
+	hdr := mail.Header{Header: message.Header{Header: h.Copy()}}
 	var ihdr mail.InlineHeader
 	ihdr.Set("Content-Type", hdr.Get("Content-Type"))
 	ihdr.Set("Content-Transfer-Encoding", "8bit")
@@ -104,13 +154,13 @@ func ImportMessage(c *protonmail.Client, r io.Reader) error {
 		return err
 	}
 	defer awc.Close()
-	ewc, err := openpgp.Encrypt(awc, []*openpgp.Entity{publicKey}, nil, nil, nil)
+	ewc, err := openpgp.Encrypt(awc, []*openpgp.Entity{to}, nil, nil, nil)
 	if err != nil {
 		return err
 	}
 	defer ewc.Close()
 
-	if _, err := io.Copy(ewc, body); err != nil {
+	if _, err := io.Copy(ewc, e.Body); err != nil {
 		return err
 	}
 	if err := ewc.Close(); err != nil {
@@ -122,15 +172,77 @@ func ImportMessage(c *protonmail.Client, r io.Reader) error {
 	if err := iwc.Close(); err != nil {
 		return err
 	}
-	if err := mwc.Close(); err != nil {
+	return mwc.Close()
+}
+
+// writePGPMIME writes a PGP/MIME message (RFC 3156) encrypting the whole
+// entity as-is, so that attachments, alternative parts and signatures are
+// kept.
+func writePGPMIME(w io.Writer, h textproto.Header, body io.Reader, to *openpgp.Entity) error {
+	h = h.Copy()
+
+	// Content header fields describe the encrypted entity
+	var inner textproto.Header
+	fields := h.Fields()
+	for fields.Next() {
+		if strings.HasPrefix(strings.ToLower(fields.Key()), "content-") {
+			inner.Add(fields.Key(), fields.Value())
+			fields.Del()
+		}
+	}
+
+	outer := message.Header{Header: h}
+	outer.SetContentType("multipart/encrypted", map[string]string{
+		"protocol": "application/pgp-encrypted",
+	})
+	mw, err := message.CreateWriter(w, outer)
+	if err != nil {
 		return err
 	}
 
-	if result, err := importer.Commit(); err != nil {
+	var versionHeader message.Header
+	versionHeader.SetContentType("application/pgp-encrypted", nil)
+	pw, err := mw.CreatePart(versionHeader)
+	if err != nil {
 		return err
-	} else if err := result.Err(); err != nil {
+	}
+	if _, err := io.WriteString(pw, "Version: 1\r\n"); err != nil {
+		return err
+	}
+	if err := pw.Close(); err != nil {
 		return err
 	}
 
-	return nil
+	var dataHeader message.Header
+	dataHeader.SetContentType("application/octet-stream", map[string]string{"name": "encrypted.asc"})
+	dataHeader.SetContentDisposition("inline", map[string]string{"filename": "encrypted.asc"})
+	pw, err = mw.CreatePart(dataHeader)
+	if err != nil {
+		return err
+	}
+
+	awc, err := armor.Encode(pw, "PGP MESSAGE", nil)
+	if err != nil {
+		return err
+	}
+	ewc, err := openpgp.Encrypt(awc, []*openpgp.Entity{to}, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := textproto.WriteHeader(ewc, inner); err != nil {
+		return err
+	}
+	if _, err := io.Copy(ewc, body); err != nil {
+		return err
+	}
+	if err := ewc.Close(); err != nil {
+		return err
+	}
+	if err := awc.Close(); err != nil {
+		return err
+	}
+	if err := pw.Close(); err != nil {
+		return err
+	}
+	return mw.Close()
 }
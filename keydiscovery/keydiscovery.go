@@ -0,0 +1,148 @@
+// Package keydiscovery looks up the OpenPGP keys of e-mail addresses which
+// aren't hosted by ProtonMail, with the Web Key Directory (WKD) and with
+// keyservers implementing the VKS API, e.g. keys.openpgp.org.
+//
+// See https://datatracker.ietf.org/doc/draft-koch-openpgp-webkey-service/ and
+// https://keys.openpgp.org/about/api
+package keydiscovery
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// DefaultKeyserver is the keyserver used by LookupKeyserver if none is
+// provided.
+const DefaultKeyserver = "https://keys.openpgp.org"
+
+// maxKeySize is the maximum size of a key returned by a server.
+const maxKeySize = 1024 * 1024
+
+// ErrNotFound is returned when no key is published for an address.
+var ErrNotFound = errors.New("keydiscovery: no key found")
+
+var zbase32 = base32.NewEncoding("ybndrfg8ejkmcpqxot1uwisza345h769").WithPadding(base32.NoPadding)
+
+func splitAddress(email string) (local, domain string, err error) {
+	i := strings.LastIndexByte(email, '@')
+	if i <= 0 || i == len(email)-1 {
+		return "", "", fmt.Errorf("keydiscovery: invalid address %q", email)
+	}
+	return email[:i], strings.ToLower(email[i+1:]), nil
+}
+
+// wkdURLs returns the URLs of the key of an address, with the advanced and the
+// direct methods.
+func wkdURLs(email string) ([]string, error) {
+	local, domain, err := splitAddress(email)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(strings.ToLower(local)))
+	hash := zbase32.EncodeToString(sum[:])
+	query := "?l=" + url.QueryEscape(local)
+
+	return []string{
+		"https://openpgpkey." + domain + "/.well-known/openpgpkey/" + domain + "/hu/" + hash + query,
+		"https://" + domain + "/.well-known/openpgpkey/hu/" + hash + query,
+	}, nil
+}
+
+func fetch(ctx context.Context, c *http.Client, u string) ([]byte, error) {
+	if c == nil {
+		c = http.DefaultClient
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, ErrNotFound
+	case resp.StatusCode/100 != 2:
+		return nil, fmt.Errorf("keydiscovery: GET %v: %v", u, resp.Status)
+	}
+
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxKeySize))
+}
+
+// selectKey returns the key of el belonging to email.
+func selectKey(el openpgp.EntityList, email string) (*openpgp.Entity, error) {
+	for _, e := range el {
+		for _, ident := range e.Identities {
+			if ident.UserId != nil && strings.EqualFold(ident.UserId.Email, email) {
+				return e, nil
+			}
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// LookupWKD fetches the key of an address from the Web Key Directory of its
+// domain. The advanced method is tried first, then the direct method.
+func LookupWKD(ctx context.Context, c *http.Client, email string) (*openpgp.Entity, error) {
+	urls, err := wkdURLs(email)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ErrNotFound
+	for _, u := range urls {
+		var b []byte
+		b, err = fetch(ctx, c, u)
+		if err != nil {
+			continue
+		}
+
+		var el openpgp.EntityList
+		el, err = openpgp.ReadKeyRing(bytes.NewReader(b))
+		if err != nil {
+			err = fmt.Errorf("keydiscovery: invalid key in %v: %v", u, err)
+			continue
+		}
+		return selectKey(el, email)
+	}
+	return nil, err
+}
+
+// LookupKeyserver fetches the key of an address from a keyserver implementing
+// the VKS API. Such keyservers only return keys whose addresses have been
+// verified.
+func LookupKeyserver(ctx context.Context, c *http.Client, keyserver, email string) (*openpgp.Entity, error) {
+	if keyserver == "" {
+		keyserver = DefaultKeyserver
+	}
+	u := strings.TrimSuffix(keyserver, "/") + "/vks/v1/by-email/" + url.PathEscape(email)
+
+	b, err := fetch(ctx, c, u)
+	if err != nil {
+		return nil, err
+	}
+
+	el, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("keydiscovery: invalid key in %v: %v", u, err)
+	}
+	return selectKey(el, email)
+}
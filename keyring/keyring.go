@@ -0,0 +1,33 @@
+// Package keyring stores bridge passwords in the operating system's keyring:
+// the Secret Service on Linux and BSDs, the Keychain on macOS and the
+// Credential Manager on Windows.
+//
+// The bridge password of an account is also the key encrypting its stored
+// credentials, so nothing else needs to be kept in the keyring.
+package keyring
+
+import (
+	"errors"
+)
+
+// service is the name under which passwords are stored.
+const service = "hydroxide"
+
+// ErrNotFound is returned by Get and Delete if no password is stored for the
+// user.
+var ErrNotFound = errors.New("hydroxide/keyring: password not found")
+
+// Get returns the bridge password of a user.
+func Get(username string) (string, error) {
+	return get(username)
+}
+
+// Set stores the bridge password of a user, replacing any existing one.
+func Set(username, password string) error {
+	return set(username, password)
+}
+
+// Delete removes the bridge password of a user.
+func Delete(username string) error {
+	return del(username)
+}
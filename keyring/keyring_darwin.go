@@ -0,0 +1,42 @@
+package keyring
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+const securityCommand = "/usr/bin/security"
+
+// errItemNotFound is the exit status of security(1) when no item matches.
+const errItemNotFound = 44
+
+func security(args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(securityCommand, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == errItemNotFound {
+		return "", ErrNotFound
+	} else if err != nil {
+		return "", fmt.Errorf("hydroxide/keyring: %v failed: %v: %v", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+func get(username string) (string, error) {
+	return security("find-generic-password", "-s", service, "-a", username, "-w")
+}
+
+func set(username, password string) error {
+	// The password is visible in the process list while the command runs,
+	// but only to the same user
+	_, err := security("add-generic-password", "-U", "-s", service, "-a", username, "-w", password)
+	return err
+}
+
+func del(username string) error {
+	_, err := security("delete-generic-password", "-s", service, "-a", username)
+	return err
+}
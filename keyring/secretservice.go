@@ -0,0 +1,188 @@
+//go:build !darwin && !windows && !(freebsd && !cgo)
+// +build !darwin
+// +build !windows
+// +build !freebsd cgo
+
+package keyring
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// See https://specifications.freedesktop.org/secret-service/
+const (
+	secretsName       = "org.freedesktop.secrets"
+	secretsPath       = "/org/freedesktop/secrets"
+	secretsIface      = "org.freedesktop.Secret.Service"
+	collectionIface   = "org.freedesktop.Secret.Collection"
+	itemIface         = "org.freedesktop.Secret.Item"
+	promptIface       = "org.freedesktop.Secret.Prompt"
+	defaultCollection = "/org/freedesktop/secrets/aliases/default"
+)
+
+// noPrompt is returned instead of a prompt path when no prompt is needed.
+const noPrompt = dbus.ObjectPath("/")
+
+// secret is a Secret Service secret, passed in plain text over the session
+// bus.
+type secret struct {
+	Session     dbus.ObjectPath
+	Parameters  []byte
+	Value       []byte
+	ContentType string
+}
+
+type secretService struct {
+	conn       *dbus.Conn
+	obj        dbus.BusObject
+	session    dbus.ObjectPath
+	collection dbus.BusObject
+}
+
+func openSecretService() (*secretService, error) {
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return nil, fmt.Errorf("hydroxide/keyring: cannot connect to session bus: %v", err)
+	}
+
+	ss := &secretService{
+		conn:       conn,
+		obj:        conn.Object(secretsName, secretsPath),
+		collection: conn.Object(secretsName, defaultCollection),
+	}
+
+	var output dbus.Variant
+	err = ss.obj.Call(secretsIface+".OpenSession", 0, "plain", dbus.MakeVariant("")).Store(&output, &ss.session)
+	if err != nil {
+		return nil, fmt.Errorf("hydroxide/keyring: cannot open session: %v", err)
+	}
+
+	var unlocked []dbus.ObjectPath
+	var prompt dbus.ObjectPath
+	err = ss.obj.Call(secretsIface+".Unlock", 0, []dbus.ObjectPath{defaultCollection}).Store(&unlocked, &prompt)
+	if err != nil {
+		return nil, fmt.Errorf("hydroxide/keyring: cannot unlock collection: %v", err)
+	}
+	if err := ss.prompt(prompt); err != nil {
+		return nil, err
+	}
+
+	return ss, nil
+}
+
+// prompt shows a prompt, e.g. to unlock the keyring, and waits for the user to
+// complete it.
+func (ss *secretService) prompt(path dbus.ObjectPath) error {
+	if path == noPrompt {
+		return nil
+	}
+
+	err := ss.conn.AddMatchSignal(dbus.WithMatchObjectPath(path), dbus.WithMatchInterface(promptIface))
+	if err != nil {
+		return err
+	}
+	signals := make(chan *dbus.Signal, 1)
+	ss.conn.Signal(signals)
+	defer ss.conn.RemoveSignal(signals)
+
+	if err := ss.conn.Object(secretsName, path).Call(promptIface+".Prompt", 0, "").Err; err != nil {
+		return err
+	}
+	for sig := range signals {
+		if sig.Path != path || sig.Name != promptIface+".Completed" {
+			continue
+		}
+		var dismissed bool
+		var result dbus.Variant
+		if err := dbus.Store(sig.Body, &dismissed, &result); err != nil {
+			return err
+		}
+		if dismissed {
+			return errors.New("hydroxide/keyring: prompt dismissed")
+		}
+		return nil
+	}
+	return errors.New("hydroxide/keyring: session bus connection closed")
+}
+
+func (ss *secretService) search(username string) ([]dbus.ObjectPath, error) {
+	attrs := map[string]string{"service": service, "username": username}
+	var items []dbus.ObjectPath
+	if err := ss.collection.Call(collectionIface+".SearchItems", 0, attrs).Store(&items); err != nil {
+		return nil, fmt.Errorf("hydroxide/keyring: cannot search items: %v", err)
+	}
+	return items, nil
+}
+
+func get(username string) (string, error) {
+	ss, err := openSecretService()
+	if err != nil {
+		return "", err
+	}
+
+	items, err := ss.search(username)
+	if err != nil {
+		return "", err
+	} else if len(items) == 0 {
+		return "", ErrNotFound
+	}
+
+	var s secret
+	err = ss.conn.Object(secretsName, items[0]).Call(itemIface+".GetSecret", 0, ss.session).Store(&s)
+	if err != nil {
+		return "", fmt.Errorf("hydroxide/keyring: cannot get secret: %v", err)
+	}
+	return string(s.Value), nil
+}
+
+func set(username, password string) error {
+	ss, err := openSecretService()
+	if err != nil {
+		return err
+	}
+
+	props := map[string]dbus.Variant{
+		itemIface + ".Label":      dbus.MakeVariant("hydroxide bridge password for " + username),
+		itemIface + ".Attributes": dbus.MakeVariant(map[string]string{"service": service, "username": username}),
+	}
+	s := secret{
+		Session:     ss.session,
+		Value:       []byte(password),
+		ContentType: "text/plain; charset=utf8",
+	}
+
+	var item, prompt dbus.ObjectPath
+	err = ss.collection.Call(collectionIface+".CreateItem", 0, props, s, true).Store(&item, &prompt)
+	if err != nil {
+		return fmt.Errorf("hydroxide/keyring: cannot create item: %v", err)
+	}
+	return ss.prompt(prompt)
+}
+
+func del(username string) error {
+	ss, err := openSecretService()
+	if err != nil {
+		return err
+	}
+
+	items, err := ss.search(username)
+	if err != nil {
+		return err
+	} else if len(items) == 0 {
+		return ErrNotFound
+	}
+
+	for _, item := range items {
+		var prompt dbus.ObjectPath
+		if err := ss.conn.Object(secretsName, item).Call(itemIface+".Delete", 0).Store(&prompt); err != nil {
+			return fmt.Errorf("hydroxide/keyring: cannot delete item: %v", err)
+		}
+		if err := ss.prompt(prompt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build freebsd && !cgo
+// +build freebsd,!cgo
+
+package keyring
+
+import (
+	"errors"
+)
+
+// The D-Bus library used to talk to the Secret Service needs cgo on FreeBSD.
+var errUnsupported = errors.New("hydroxide/keyring: the Secret Service requires cgo on FreeBSD")
+
+func get(username string) (string, error) {
+	return "", errUnsupported
+}
+
+func set(username, password string) error {
+	return errUnsupported
+}
+
+func del(username string) error {
+	return errUnsupported
+}
@@ -0,0 +1,337 @@
+// Package logging implements a leveled, structured logger, modeled after
+// log/slog.
+//
+// Each message is written on one line, either as text followed by key=value
+// pairs or as a JSON object. The level of each subsystem can be configured
+// separately. Values of sensitive keys, such as tokens, passwords and message
+// bodies, are redacted.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the importance of a message.
+type Level int
+
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+func (level Level) String() string {
+	switch level {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return fmt.Sprintf("LEVEL(%d)", int(level))
+	}
+}
+
+// ParseLevel parses a level name: "debug", "info", "warn" or "error".
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return 0, fmt.Errorf("invalid log level %q: expected debug, info, warn or error", s)
+	}
+}
+
+// Output formats.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+var (
+	locker       sync.Mutex // protects the variables below and writes
+	output       io.Writer  = os.Stderr
+	format                  = FormatText
+	defaultLevel            = LevelInfo
+	levels                  = make(map[string]Level)
+)
+
+// SetOutput sets the destination of all loggers, os.Stderr by default.
+func SetOutput(w io.Writer) {
+	locker.Lock()
+	defer locker.Unlock()
+	output = w
+}
+
+// SetFormat sets the output format: FormatText (the default) or FormatJSON.
+func SetFormat(f string) error {
+	if f != FormatText && f != FormatJSON {
+		return fmt.Errorf("invalid log format %q: expected text or json", f)
+	}
+	locker.Lock()
+	defer locker.Unlock()
+	format = f
+	return nil
+}
+
+// Format returns the current output format.
+func Format() string {
+	locker.Lock()
+	defer locker.Unlock()
+	return format
+}
+
+// SetLevel sets the minimum level of messages written by subsystems without
+// a level of their own.
+func SetLevel(level Level) {
+	locker.Lock()
+	defer locker.Unlock()
+	defaultLevel = level
+}
+
+// SetSubsystemLevel sets the minimum level of messages written by a
+// subsystem.
+func SetSubsystemLevel(subsystem string, level Level) {
+	locker.Lock()
+	defer locker.Unlock()
+	levels[subsystem] = level
+}
+
+// ParseLevels configures levels from a comma-separated list of levels, either
+// bare for the default level or as subsystem=level pairs, e.g.
+// "warn,imap=debug".
+func ParseLevels(s string) error {
+	if s == "" {
+		return nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		subsystem, name := "", item
+		if i := strings.IndexByte(item, '='); i >= 0 {
+			subsystem, name = item[:i], item[i+1:]
+		}
+		level, err := ParseLevel(name)
+		if err != nil {
+			return err
+		}
+		if subsystem == "" {
+			SetLevel(level)
+		} else {
+			SetSubsystemLevel(subsystem, level)
+		}
+	}
+	return nil
+}
+
+// Logger writes messages of a subsystem.
+type Logger struct {
+	subsystem string
+	attrs     []interface{}
+}
+
+// New creates a logger for a subsystem, e.g. "imap".
+func New(subsystem string) *Logger {
+	return &Logger{subsystem: subsystem}
+}
+
+// With returns a logger adding key-value pairs to all messages.
+func (l *Logger) With(args ...interface{}) *Logger {
+	attrs := make([]interface{}, 0, len(l.attrs)+len(args))
+	attrs = append(attrs, l.attrs...)
+	attrs = append(attrs, args...)
+	return &Logger{subsystem: l.subsystem, attrs: attrs}
+}
+
+// Enabled checks whether messages of the given level are written, e.g. to
+// avoid formatting expensive debug messages.
+func (l *Logger) Enabled(level Level) bool {
+	locker.Lock()
+	defer locker.Unlock()
+	return l.enabled(level)
+}
+
+func (l *Logger) enabled(level Level) bool {
+	min, ok := levels[l.subsystem]
+	if !ok {
+		min = defaultLevel
+	}
+	return level >= min
+}
+
+// Debug writes a debug message. args are alternating keys and values.
+func (l *Logger) Debug(msg string, args ...interface{}) {
+	l.Log(LevelDebug, msg, args...)
+}
+
+// Info writes an informational message.
+func (l *Logger) Info(msg string, args ...interface{}) {
+	l.Log(LevelInfo, msg, args...)
+}
+
+// Warn writes a message about a recoverable error.
+func (l *Logger) Warn(msg string, args ...interface{}) {
+	l.Log(LevelWarn, msg, args...)
+}
+
+// Error writes a message about an error.
+func (l *Logger) Error(msg string, args ...interface{}) {
+	l.Log(LevelError, msg, args...)
+}
+
+// Log writes a message with the given level.
+func (l *Logger) Log(level Level, msg string, args ...interface{}) {
+	locker.Lock()
+	defer locker.Unlock()
+
+	if !l.enabled(level) {
+		return
+	}
+
+	attrs := l.attrs
+	if len(args) > 0 {
+		attrs = append(attrs[:len(attrs):len(attrs)], args...)
+	}
+
+	var b []byte
+	if format == FormatJSON {
+		b = formatJSON(time.Now(), level, l.subsystem, msg, attrs)
+	} else {
+		b = formatText(time.Now(), level, l.subsystem, msg, attrs)
+	}
+	output.Write(b)
+}
+
+// Writer returns an io.Writer writing each line as a message with the given
+// level, e.g. to redirect the standard logger.
+func (l *Logger) Writer(level Level) io.Writer {
+	return &lineWriter{l: l, level: level}
+}
+
+type lineWriter struct {
+	l     *Logger
+	level Level
+}
+
+func (w *lineWriter) Write(b []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+		w.l.Log(w.level, line)
+	}
+	return len(b), nil
+}
+
+// pairs calls fn for each key-value pair of attrs. A trailing value without a
+// key is given the key "!BADKEY", like log/slog does.
+func pairs(attrs []interface{}, fn func(key string, value interface{})) {
+	for i := 0; i < len(attrs); i += 2 {
+		key, ok := attrs[i].(string)
+		if !ok || i+1 == len(attrs) {
+			fn("!BADKEY", attrs[i])
+			i--
+			continue
+		}
+		value := attrs[i+1]
+		if isSensitive(key) {
+			value = redacted
+		}
+		fn(key, value)
+	}
+}
+
+func formatText(t time.Time, level Level, subsystem, msg string, attrs []interface{}) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(t.Format("2006/01/02 15:04:05 "))
+	buf.WriteString(level.String())
+	buf.WriteByte(' ')
+	if subsystem != "" {
+		buf.WriteString(subsystem)
+		buf.WriteString(": ")
+	}
+	buf.WriteString(msg)
+	pairs(attrs, func(key string, value interface{}) {
+		buf.WriteByte(' ')
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		buf.WriteString(quote(formatValue(value)))
+	})
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+func formatJSON(t time.Time, level Level, subsystem, msg string, attrs []interface{}) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`{"time":`)
+	writeJSON(&buf, t.Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSON(&buf, level.String())
+	if subsystem != "" {
+		buf.WriteString(`,"subsystem":`)
+		writeJSON(&buf, subsystem)
+	}
+	buf.WriteString(`,"msg":`)
+	writeJSON(&buf, msg)
+	pairs(attrs, func(key string, value interface{}) {
+		buf.WriteByte(',')
+		writeJSON(&buf, key)
+		buf.WriteByte(':')
+		switch v := value.(type) {
+		case error:
+			writeJSON(&buf, v.Error())
+		case fmt.Stringer:
+			writeJSON(&buf, v.String())
+		default:
+			if b, err := json.Marshal(v); err == nil {
+				buf.Write(b)
+			} else {
+				writeJSON(&buf, fmt.Sprint(v))
+			}
+		}
+	})
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+func writeJSON(buf *bytes.Buffer, s string) {
+	b, _ := json.Marshal(s)
+	buf.Write(b)
+}
+
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case error:
+		return v.Error()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// quote quotes s if it contains spaces, quotes, equal signs or control
+// characters.
+func quote(s string) string {
+	if s == "" {
+		return `""`
+	}
+	for _, r := range s {
+		if r <= ' ' || r == '"' || r == '=' || r == 0x7f {
+			return fmt.Sprintf("%q", s)
+		}
+	}
+	return s
+}
@@ -0,0 +1,96 @@
+package logging
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// redacted replaces the values of sensitive keys.
+const redacted = "[redacted]"
+
+// sensitiveWords are looked for in lower-case keys. They cover credentials
+// as well as message and contact contents, be they encrypted or not. "code"
+// also matches result codes of the API: two-factor and recovery codes can't
+// be told apart from them.
+var sensitiveWords = []string{
+	"token",
+	"password",
+	"passphrase",
+	"secret",
+	"authorization",
+	"proof",
+	"ephemeral",
+	"salt",
+	"privatekey",
+	"packet",
+	"body",
+	"subject",
+	"header",
+	"signature",
+	"verifier",
+	"code",
+}
+
+// sensitiveKeys are whole lower-case keys which are sensitive.
+var sensitiveKeys = map[string]bool{
+	"data":     true,
+	"cards":    true,
+	"uid":      true,
+	"x-pm-uid": true,
+}
+
+func isSensitive(key string) bool {
+	key = strings.ToLower(key)
+	if sensitiveKeys[key] {
+		return true
+	}
+	for _, word := range sensitiveWords {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactJSON returns a JSON document with the values of sensitive keys
+// redacted, e.g. to log API requests and responses. Invalid documents are
+// redacted as a whole.
+func RedactJSON(b []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return redacted
+	}
+	b, err := json.Marshal(redactValue(v))
+	if err != nil {
+		return redacted
+	}
+	return string(b)
+}
+
+// Redact returns the JSON representation of v with the values of sensitive
+// keys redacted.
+func Redact(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return redacted
+	}
+	return RedactJSON(b)
+}
+
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if isSensitive(k) {
+				v[k] = redacted
+			} else {
+				v[k] = redactValue(child)
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = redactValue(child)
+		}
+	}
+	return v
+}
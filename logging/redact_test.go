@@ -0,0 +1,67 @@
+package logging
+
+import (
+	"testing"
+)
+
+func TestRedactJSON(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{
+			name: "not sensitive",
+			in:   `{"ID":"a","Name":"Inbox","Total":2}`,
+			want: `{"ID":"a","Name":"Inbox","Total":2}`,
+		},
+		{
+			name: "SRP verifier and codes",
+			in:   `{"Code":1000,"TwoFactorCode":"123456","Auth":{"Verifier":"v","ModulusID":"m"}}`,
+			want: `{"Auth":{"ModulusID":"m","Verifier":"[redacted]"},"Code":"[redacted]","TwoFactorCode":"[redacted]"}`,
+		},
+		{
+			name: "credentials",
+			in:   `{"AccessToken":"a","RefreshToken":"b","Password":"c","ClientProof":"d","SRPSession":"s"}`,
+			want: `{"AccessToken":"[redacted]","ClientProof":"[redacted]","Password":"[redacted]","RefreshToken":"[redacted]","SRPSession":"s"}`,
+		},
+		{
+			name: "whole keys",
+			in:   `{"UID":"a","Data":"b","Cards":[1],"DataType":"c"}`,
+			want: `{"Cards":"[redacted]","Data":"[redacted]","DataType":"c","UID":"[redacted]"}`,
+		},
+		{
+			name: "nested",
+			in:   `{"Messages":[{"ID":"a","Subject":"s","Body":"b"}],"Key":{"PrivateKey":"k"}}`,
+			want: `{"Key":{"PrivateKey":"[redacted]"},"Messages":[{"Body":"[redacted]","ID":"a","Subject":"[redacted]"}]}`,
+		},
+		{
+			name: "sensitive object",
+			in:   `{"Headers":{"From":"a"}}`,
+			want: `{"Headers":"[redacted]"}`,
+		},
+		{
+			name: "array",
+			in:   `[{"KeySalt":"a"},2]`,
+			want: `[{"KeySalt":"[redacted]"},2]`,
+		},
+		{
+			name: "case insensitive",
+			in:   `{"X-PM-UID":"a","accesstoken":"b","Uids":["c"]}`,
+			want: `{"Uids":["c"],"X-PM-UID":"[redacted]","accesstoken":"[redacted]"}`,
+		},
+		{
+			name: "scalar",
+			in:   `"secret"`,
+			want: `"secret"`,
+		},
+		{
+			name: "invalid",
+			in:   `{"Password":`,
+			want: `[redacted]`,
+		},
+	}
+	for _, tc := range tests {
+		if got := RedactJSON([]byte(tc.in)); got != tc.want {
+			t.Errorf("%v: RedactJSON() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+//go:build !freebsd || cgo
+// +build !freebsd cgo
+
+// Package notify shows desktop notifications for new messages, via the
+// freedesktop.org notification specification.
+package notify
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+
+	"github.com/emersion/hydroxide/logging"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+var logger = logging.New("notify")
+
+const (
+	notificationsName  = "org.freedesktop.Notifications"
+	notificationsPath  = "/org/freedesktop/Notifications"
+	notificationsIface = "org.freedesktop.Notifications"
+)
+
+const (
+	actionDefault = "default"
+	actionOpen    = "open"
+	actionArchive = "archive"
+	actionRead    = "read"
+)
+
+// Notifier shows a notification for each new message in the inbox. Actions
+// invoked from notifications are applied to the message with the API.
+type Notifier struct {
+	c       *protonmail.Client
+	conn    *dbus.Conn
+	obj     dbus.BusObject
+	openCmd []string
+
+	locker  sync.Mutex
+	pending map[uint32]string // notification ID -> message ID
+}
+
+// New connects to the session bus. If openCmd isn't empty, notifications
+// have an action to start this command, e.g. to open a mail client.
+func New(c *protonmail.Client, openCmd []string) (*Notifier, error) {
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to session bus: %v", err)
+	}
+
+	err = conn.AddMatchSignal(dbus.WithMatchObjectPath(notificationsPath), dbus.WithMatchInterface(notificationsIface))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &Notifier{
+		c:       c,
+		conn:    conn,
+		obj:     conn.Object(notificationsName, notificationsPath),
+		openCmd: openCmd,
+		pending: make(map[uint32]string),
+	}, nil
+}
+
+// inhibited checks whether the notification server is in do-not-disturb
+// mode. Servers which don't expose this state are never inhibited.
+func (n *Notifier) inhibited() bool {
+	v, err := n.obj.GetProperty(notificationsIface + ".Inhibited")
+	if err != nil {
+		return false
+	}
+	inhibited, _ := v.Value().(bool)
+	return inhibited
+}
+
+func (n *Notifier) notify(msg *protonmail.Message) error {
+	if n.inhibited() {
+		return nil
+	}
+
+	summary := "New message"
+	if msg.Sender != nil {
+		summary = msg.Sender.Name
+		if summary == "" {
+			summary = msg.Sender.Address
+		}
+	}
+
+	actions := []string{actionRead, "Mark read", actionArchive, "Archive"}
+	if len(n.openCmd) > 0 {
+		actions = append(actions, actionDefault, "Open", actionOpen, "Open in client")
+	}
+
+	hints := map[string]dbus.Variant{
+		"category": dbus.MakeVariant("email.arrived"),
+	}
+
+	var id uint32
+	err := n.obj.Call(notificationsIface+".Notify", 0, "hydroxide", uint32(0), "mail-unread", summary, msg.Subject, actions, hints, int32(-1)).Store(&id)
+	if err != nil {
+		return err
+	}
+
+	n.locker.Lock()
+	n.pending[id] = msg.ID
+	n.locker.Unlock()
+	return nil
+}
+
+func (n *Notifier) handleAction(ctx context.Context, id uint32, action string) error {
+	n.locker.Lock()
+	msgID, ok := n.pending[id]
+	n.locker.Unlock()
+	if !ok {
+		return nil
+	}
+
+	switch action {
+	case actionRead:
+		return n.c.MarkMessagesRead(ctx, []string{msgID})
+	case actionArchive:
+		return n.c.LabelMessages(ctx, protonmail.LabelArchive, []string{msgID})
+	case actionDefault, actionOpen:
+		if len(n.openCmd) == 0 {
+			return nil
+		}
+		cmd := exec.Command(n.openCmd[0], n.openCmd[1:]...)
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		go cmd.Wait()
+	}
+	return nil
+}
+
+func isNewInboxMessage(msg *protonmail.Message) bool {
+	if msg.Unread != 1 {
+		return false
+	}
+	for _, labelID := range msg.LabelIDs {
+		if labelID == protonmail.LabelInbox {
+			return true
+		}
+	}
+	return false
+}
+
+// Run shows notifications for messages created by events until the events
+// channel is closed or ctx is done.
+func (n *Notifier) Run(ctx context.Context, events <-chan *protonmail.Event) error {
+	signals := make(chan *dbus.Signal, 16)
+	n.conn.Signal(signals)
+	defer n.conn.RemoveSignal(signals)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+			for _, eventMessage := range event.Messages {
+				if eventMessage.Action != protonmail.EventCreate || !isNewInboxMessage(eventMessage.Created) {
+					continue
+				}
+				if err := n.notify(eventMessage.Created); err != nil {
+					logger.Warn("cannot show notification", "message", eventMessage.ID, "error", err)
+				}
+			}
+		case sig := <-signals:
+			switch sig.Name {
+			case notificationsIface + ".ActionInvoked":
+				var id uint32
+				var action string
+				if err := dbus.Store(sig.Body, &id, &action); err != nil {
+					continue
+				}
+				if err := n.handleAction(ctx, id, action); err != nil {
+					logger.Warn("cannot handle notification action", "action", action, "error", err)
+				}
+			case notificationsIface + ".NotificationClosed":
+				var id, reason uint32
+				if err := dbus.Store(sig.Body, &id, &reason); err != nil {
+					continue
+				}
+				n.locker.Lock()
+				delete(n.pending, id)
+				n.locker.Unlock()
+			}
+		}
+	}
+}
+
+// Close disconnects from the session bus.
+func (n *Notifier) Close() error {
+	return n.conn.Close()
+}
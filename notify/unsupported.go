@@ -0,0 +1,29 @@
+//go:build freebsd && !cgo
+// +build freebsd,!cgo
+
+package notify
+
+import (
+	"context"
+	"errors"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// The D-Bus library used to show notifications needs cgo on FreeBSD.
+var errUnsupported = errors.New("desktop notifications require cgo on FreeBSD")
+
+// Notifier is unavailable in this build.
+type Notifier struct{}
+
+func New(c *protonmail.Client, openCmd []string) (*Notifier, error) {
+	return nil, errUnsupported
+}
+
+func (n *Notifier) Run(ctx context.Context, events <-chan *protonmail.Event) error {
+	return errUnsupported
+}
+
+func (n *Notifier) Close() error {
+	return nil
+}
@@ -1,6 +1,7 @@
 package protonmail
 
 import (
+	"context"
 	"net/http"
 )
 
@@ -39,12 +40,15 @@ type Address struct {
 	DisplayName string
 	Signature   string // HTML
 	HasKeys     int
+	CatchAll    int
 	Keys        []*PrivateKey
+	// Signed by the primary key, lists the fingerprints and flags of Keys
+	SignedKeyList *SignedKeyList
 }
 
-func (c *Client) ListAddresses() ([]*Address, error) {
+func (c *Client) ListAddresses(ctx context.Context) ([]*Address, error) {
 	// TODO: Page, PageSize
-	req, err := c.newRequest(http.MethodGet, "/addresses", nil)
+	req, err := c.newRequest(ctx, http.MethodGet, "/addresses", nil)
 	if err != nil {
 		return nil, err
 	}
@@ -59,3 +63,87 @@ func (c *Client) ListAddresses() ([]*Address, error) {
 
 	return respData.Addresses, nil
 }
+
+// ListPremiumDomains returns the short domains (e.g. pm.me) available to the
+// user.
+func (c *Client) ListPremiumDomains(ctx context.Context) ([]string, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/domains/premium", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Domains []string
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Domains, nil
+}
+
+// SetupAddress creates a new address for the user on the given domain, e.g. a
+// premium domain returned by ListPremiumDomains. The new address has no key,
+// see CreateAddressKey.
+func (c *Client) SetupAddress(ctx context.Context, domain, displayName, signature string) (*Address, error) {
+	reqData := struct {
+		Domain      string
+		DisplayName string
+		Signature   string
+	}{domain, displayName, signature}
+	req, err := c.newJSONRequest(ctx, http.MethodPost, "/addresses/setup", &reqData)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Address *Address
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Address, nil
+}
+
+// CreateAddress creates a new address on a custom domain, e.g.
+// local@example.org. The new address has no key, see CreateAddressKey.
+func (c *Client) CreateAddress(ctx context.Context, domainID, local, displayName, signature string) (*Address, error) {
+	reqData := struct {
+		DomainID    string
+		Local       string
+		DisplayName string
+		Signature   string
+	}{domainID, local, displayName, signature}
+	req, err := c.newJSONRequest(ctx, http.MethodPost, "/addresses", &reqData)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Address *Address
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Address, nil
+}
+
+// OrderAddresses sets the order of addresses. The first one is the default
+// sender address. ids must contain all addresses.
+func (c *Client) OrderAddresses(ctx context.Context, ids []string) error {
+	reqData := struct {
+		AddressIDs []string
+	}{ids}
+	req, err := c.newJSONRequest(ctx, http.MethodPut, "/addresses/order", &reqData)
+	if err != nil {
+		return err
+	}
+
+	var respData resp
+	return c.doJSON(req, &respData)
+}
@@ -2,10 +2,12 @@ package protonmail
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"strconv"
@@ -105,13 +107,21 @@ func (att *Attachment) Read(ciphertext io.Reader, keyring openpgp.KeyRing, promp
 	}
 }
 
-// GetAttachment downloads an attachment's payload. The returned io.ReadCloser
-// may be encrypted, use Attachment.Read to decrypt it.
-func (c *Client) GetAttachment(id string) (io.ReadCloser, error) {
-	req, err := c.newRequest(http.MethodGet, "/attachments/"+id, nil)
+// maxAttachmentResumes is the maximum number of times an interrupted
+// attachment download is resumed before giving up.
+const maxAttachmentResumes = 5
+
+func (c *Client) getAttachment(ctx context.Context, id string, offset int64, etag string) (*http.Response, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/attachments/"+id, nil)
 	if err != nil {
 		return nil, err
 	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%v-", offset))
+		if etag != "" {
+			req.Header.Set("If-Range", etag)
+		}
+	}
 
 	resp, err := c.do(req)
 	if err != nil {
@@ -119,15 +129,156 @@ func (c *Client) GetAttachment(id string) (io.ReadCloser, error) {
 	}
 
 	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
 		return nil, fmt.Errorf("cannot get attachment %q: %v %v", id, resp.Status, resp.StatusCode)
 	}
 
-	return resp.Body, nil
+	return resp, nil
+}
+
+// GetAttachment downloads an attachment's payload. The returned io.ReadCloser
+// may be encrypted, use Attachment.Read to decrypt it.
+//
+// If the connection is interrupted, the download is resumed with a range
+// request. The reassembled payload is checked against the length announced by
+// the server, and the If-Range header ensures all ranges belong to the same
+// version of the payload.
+func (c *Client) GetAttachment(ctx context.Context, id string) (io.ReadCloser, error) {
+	resp, err := c.getAttachment(ctx, id, 0, "")
+	if err != nil {
+		return nil, err
+	}
+
+	r := &attachmentReader{
+		ctx:  ctx,
+		c:    c,
+		id:   id,
+		body: resp.Body,
+		size: -1,
+	}
+	// Resuming requires a known size to detect truncated payloads
+	if resp.StatusCode == http.StatusOK && resp.ContentLength >= 0 && resp.Header.Get("Accept-Ranges") != "none" {
+		r.size = resp.ContentLength
+		r.etag = resp.Header.Get("ETag")
+	}
+	return r, nil
+}
+
+// parseContentRange parses a "bytes <first>-<last>/<size>" Content-Range
+// header. size is -1 if unknown.
+func parseContentRange(v string) (first, last, size int64, err error) {
+	if !strings.HasPrefix(v, "bytes ") {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", v)
+	}
+	v = strings.TrimPrefix(v, "bytes ")
+
+	parts := strings.SplitN(v, "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", v)
+	}
+	bounds := strings.SplitN(parts[0], "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", v)
+	}
+	if first, err = strconv.ParseInt(bounds[0], 10, 64); err != nil {
+		return 0, 0, 0, err
+	}
+	if last, err = strconv.ParseInt(bounds[1], 10, 64); err != nil {
+		return 0, 0, 0, err
+	}
+	size = -1
+	if parts[1] != "*" {
+		if size, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	return first, last, size, nil
+}
+
+// attachmentReader reads an attachment payload, resuming the download when
+// the connection is interrupted.
+type attachmentReader struct {
+	ctx     context.Context
+	c       *Client
+	id      string
+	body    io.ReadCloser
+	offset  int64
+	size    int64 // -1 if unknown, in which case the download can't be resumed
+	etag    string
+	resumes int
+}
+
+func (r *attachmentReader) Read(b []byte) (int, error) {
+	for {
+		n, err := r.body.Read(b)
+		r.offset += int64(n)
+		if r.size >= 0 && r.offset > r.size {
+			return n, fmt.Errorf("attachment %q is larger than announced (%v bytes)", r.id, r.size)
+		}
+		if err == io.EOF && r.size >= 0 && r.offset < r.size {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil || err == io.EOF || r.size < 0 {
+			return n, err
+		}
+
+		if err := r.resume(err); err != nil {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *attachmentReader) resume(cause error) error {
+	r.body.Close()
+	r.body = ioutil.NopCloser(strings.NewReader(""))
+
+	if r.resumes >= maxAttachmentResumes {
+		return fmt.Errorf("cannot download attachment %q: %v", r.id, cause)
+	}
+	if err := r.ctx.Err(); err != nil {
+		return err
+	}
+	r.resumes++
+	logger.Info("attachment download interrupted, resuming", "attachment", r.id, "offset", r.offset, "size", r.size, "error", cause)
+
+	resp, err := r.c.getAttachment(r.ctx, r.id, r.offset, r.etag)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusPartialContent {
+		// Either ranges aren't supported or the payload has changed
+		resp.Body.Close()
+		return fmt.Errorf("cannot resume download of attachment %q: %v", r.id, resp.Status)
+	}
+
+	first, last, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		resp.Body.Close()
+		return fmt.Errorf("cannot resume download of attachment %q: %v", r.id, err)
+	}
+	if first != r.offset || last != r.size-1 || (size >= 0 && size != r.size) {
+		resp.Body.Close()
+		return fmt.Errorf("cannot resume download of attachment %q: unexpected range %v-%v/%v", r.id, first, last, size)
+	}
+
+	r.body = resp.Body
+	return nil
+}
+
+func (r *attachmentReader) Close() error {
+	return r.body.Close()
 }
 
 // CreateAttachment uploads a new attachment. r must be an PGP data packet
 // encrypted with att.KeyPackets.
-func (c *Client) CreateAttachment(att *Attachment, r io.Reader) (created *Attachment, err error) {
+//
+// r is streamed to the server without being buffered, so the request can't be
+// retried if it's throttled.
+func (c *Client) CreateAttachment(ctx context.Context, att *Attachment, r io.Reader) (created *Attachment, err error) {
 	pr, pw := io.Pipe()
 	mw := multipart.NewWriter(pw)
 
@@ -178,7 +329,7 @@ func (c *Client) CreateAttachment(att *Attachment, r io.Reader) (created *Attach
 		pw.CloseWithError(mw.Close())
 	}()
 
-	req, err := c.newRequest(http.MethodPost, "/attachments", pr)
+	req, err := c.newRequest(ctx, http.MethodPost, "/attachments", pr)
 	if err != nil {
 		return nil, err
 	}
@@ -195,3 +346,13 @@ func (c *Client) CreateAttachment(att *Attachment, r io.Reader) (created *Attach
 
 	return respData.Attachment, nil
 }
+
+// DeleteAttachment removes an attachment from a draft.
+func (c *Client) DeleteAttachment(ctx context.Context, id string) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, "/attachments/"+id, nil)
+	if err != nil {
+		return err
+	}
+
+	return c.doJSON(req, nil)
+}
@@ -1,9 +1,9 @@
 package protonmail
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
-	"log"
 	"net/http"
 	"time"
 
@@ -43,12 +43,12 @@ func (resp *AuthInfoResp) authInfo() *AuthInfo {
 	return info
 }
 
-func (c *Client) AuthInfo(username string) (*AuthInfo, error) {
+func (c *Client) AuthInfo(ctx context.Context, username string) (*AuthInfo, error) {
 	reqData := &authInfoReq{
 		Username: username,
 	}
 
-	req, err := c.newJSONRequest(http.MethodPost, "/auth/info", reqData)
+	req, err := c.newJSONRequest(ctx, http.MethodPost, "/auth/info", reqData)
 	if err != nil {
 		return nil, err
 	}
@@ -85,12 +85,20 @@ type Auth struct {
 	EventID      string
 	PasswordMode PasswordMode
 	TwoFactor    struct {
+		// Bitmask of TwoFactorTOTP and TwoFactorFIDO2
 		Enabled int
 		U2F     interface{} // TODO
 		TOTP    int
+		FIDO2   *FIDO2Info
 	} `json:"2FA"`
 }
 
+// Second factors enabled for an account.
+const (
+	TwoFactorTOTP  = 1
+	TwoFactorFIDO2 = 2
+)
+
 type authResp struct {
 	resp
 	Auth
@@ -105,10 +113,10 @@ func (resp *authResp) auth() *Auth {
 	return auth
 }
 
-func (c *Client) Auth(username, password string, info *AuthInfo) (*Auth, error) {
+func (c *Client) Auth(ctx context.Context, username, password string, info *AuthInfo) (*Auth, error) {
 	if info == nil {
 		var err error
-		if info, err = c.AuthInfo(username); err != nil {
+		if info, err = c.AuthInfo(ctx, username); err != nil {
 			return nil, err
 		}
 	}
@@ -125,7 +133,7 @@ func (c *Client) Auth(username, password string, info *AuthInfo) (*Auth, error)
 		ClientProof:     base64.StdEncoding.EncodeToString(proofs.clientProof),
 	}
 
-	req, err := c.newJSONRequest(http.MethodPost, "/auth", reqData)
+	req, err := c.newJSONRequest(ctx, http.MethodPost, "/auth", reqData)
 	if err != nil {
 		return nil, err
 	}
@@ -140,19 +148,18 @@ func (c *Client) Auth(username, password string, info *AuthInfo) (*Auth, error)
 	}
 
 	auth := respData.auth()
-	c.uid = auth.UID
-	c.accessToken = auth.AccessToken
+	c.setAuth(auth.UID, auth.AccessToken)
 	return auth, nil
 }
 
-func (c *Client) AuthTOTP(code string) (scope string, err error) {
+func (c *Client) AuthTOTP(ctx context.Context, code string) (scope string, err error) {
 	reqData := struct {
 		TwoFactorCode string
 	}{
 		TwoFactorCode: code,
 	}
 
-	req, err := c.newJSONRequest(http.MethodPost, "/auth/2fa", reqData)
+	req, err := c.newJSONRequest(ctx, http.MethodPost, "/auth/2fa", reqData)
 	if err != nil {
 		return "", err
 	}
@@ -177,7 +184,7 @@ type authRefreshReq struct {
 	RedirectURI  string
 }
 
-func (c *Client) AuthRefresh(expiredAuth *Auth) (*Auth, error) {
+func (c *Client) AuthRefresh(ctx context.Context, expiredAuth *Auth) (*Auth, error) {
 	reqData := &authRefreshReq{
 		RefreshToken: expiredAuth.RefreshToken,
 		ResponseType: "token",
@@ -185,7 +192,7 @@ func (c *Client) AuthRefresh(expiredAuth *Auth) (*Auth, error) {
 		RedirectURI:  "http://www.protonmail.ch",
 	}
 
-	req, err := c.newJSONRequest(http.MethodPost, "/auth/refresh", reqData)
+	req, err := c.newJSONRequest(ctx, http.MethodPost, "/auth/refresh", reqData)
 	if err != nil {
 		return nil, err
 	}
@@ -202,8 +209,8 @@ func (c *Client) AuthRefresh(expiredAuth *Auth) (*Auth, error) {
 	return auth, nil
 }
 
-func (c *Client) ListKeySalts() (map[string][]byte, error) {
-	req, err := c.newRequest(http.MethodGet, "/keys/salts", nil)
+func (c *Client) ListKeySalts(ctx context.Context) (map[string][]byte, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/keys/salts", nil)
 	if err != nil {
 		return nil, err
 	}
@@ -259,24 +266,35 @@ func unlockKey(e *openpgp.Entity, passphraseBytes []byte) error {
 	return nil
 }
 
-func (c *Client) Unlock(auth *Auth, keySalts map[string][]byte, passphrase string) (openpgp.EntityList, error) {
-	c.uid = auth.UID
-	c.accessToken = auth.AccessToken
+func (c *Client) Unlock(ctx context.Context, auth *Auth, keySalts map[string][]byte, passphrase string) (openpgp.EntityList, error) {
+	c.setAuth(auth.UID, auth.AccessToken)
 
-	addrs, err := c.ListAddresses()
+	addrs, err := c.ListAddresses(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	var keyRing openpgp.EntityList
 	for _, addr := range addrs {
+		// Keys are verified before any of them is unlocked
+		if err := verifyAddressKeys(addr); err == errNoSignedKeyList {
+			logger.Warn("cannot verify keys", "address", addr.Email, "error", err)
+		} else if err != nil {
+			return nil, fmt.Errorf("refusing keys of %q: %v", addr.Email, err)
+		}
+
+		var addrKeyRing openpgp.EntityList
 		for _, key := range addr.Keys {
 			entity, err := key.Entity()
 			if err != nil {
-				log.Printf("warning: failed to read key %q: %v", addr.Email, err)
+				logger.Warn("cannot read key", "address", addr.Email, "error", err)
 				continue
 			}
 
+			if err := checkAddressKey(addr.Email, key, entity); err != nil {
+				logger.Warn("key looks suspicious", "address", addr.Email, "key_id", entity.PrimaryKey.KeyIdString(), "error", err)
+			}
+
 			passphraseBytes := []byte(passphrase)
 			if keySalt, ok := keySalts[key.ID]; ok && keySalt != nil {
 				passphraseBytes, err = computeKeyPassword(passphraseBytes, keySalt)
@@ -286,25 +304,35 @@ func (c *Client) Unlock(auth *Auth, keySalts map[string][]byte, passphrase strin
 			}
 
 			if err := unlockKey(entity, passphraseBytes); err != nil {
-				log.Printf("warning: failed to unlock key %q %v: %v", addr.Email, entity.PrimaryKey.KeyIdString(), err)
+				logger.Warn("cannot unlock key", "address", addr.Email, "key_id", entity.PrimaryKey.KeyIdString(), "error", err)
 				continue
 			}
 
-			keyRing = append(keyRing, entity)
+			c.keyLocker.Lock()
+			if c.keyPassphrase == nil {
+				// Used to encrypt and decrypt keys created later on
+				c.keyPassphrase = passphraseBytes
+			}
+			c.keyLocker.Unlock()
+
+			addrKeyRing = append(addrKeyRing, entity)
 		}
+		keyRing = append(keyRing, addrKeyRing...)
 	}
 
 	if len(keyRing) == 0 {
 		return nil, fmt.Errorf("failed to unlock any key")
 	}
 
+	c.keyLocker.Lock()
 	c.keyRing = keyRing
+	c.keyLocker.Unlock()
 
 	return keyRing, nil
 }
 
-func (c *Client) Logout() error {
-	req, err := c.newRequest(http.MethodDelete, "/auth", nil)
+func (c *Client) Logout(ctx context.Context) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, "/auth", nil)
 	if err != nil {
 		return err
 	}
@@ -313,8 +341,11 @@ func (c *Client) Logout() error {
 		return err
 	}
 
-	c.uid = ""
-	c.accessToken = ""
+	c.setAuth("", "")
+	c.keyLocker.Lock()
 	c.keyRing = nil
+	wipe(c.keyPassphrase)
+	c.keyPassphrase = nil
+	c.keyLocker.Unlock()
 	return nil
 }
@@ -0,0 +1,85 @@
+package protonmail
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// lookupBindAddr returns the local address to use for bind, which is either
+// an IP address or the name of a network interface.
+func lookupBindAddr(bind string) (net.IP, error) {
+	if ip := net.ParseIP(bind); ip != nil {
+		return ip, nil
+	}
+
+	iface, err := net.InterfaceByName(bind)
+	if err != nil {
+		return nil, fmt.Errorf("cannot bind to %q: %v", bind, err)
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		return nil, fmt.Errorf("cannot bind to %q: interface is down", bind)
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("cannot bind to %q: %v", bind, err)
+	}
+
+	// Prefer IPv4, which is more likely to be routed through VPNs
+	var ip net.IP
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			return ipnet.IP, nil
+		}
+		if ip == nil {
+			ip = ipnet.IP
+		}
+	}
+	if ip == nil {
+		return nil, fmt.Errorf("cannot bind to %q: interface has no address", bind)
+	}
+	return ip, nil
+}
+
+// NewBoundHTTPClient returns an HTTP client whose connections originate from
+// bind, either a local IP address or a network interface name. The address of
+// the interface is looked up for each new connection: if the interface is
+// down or has no address, connections fail instead of using the default
+// route. On Linux, sockets are also bound to the interface itself.
+func NewBoundHTTPClient(bind string) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = boundDialer(bind).DialContext
+	return &http.Client{Transport: transport}
+}
+
+// boundDialer dials connections originating from a local IP address or a
+// network interface.
+type boundDialer string
+
+func (bind boundDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	ip, err := lookupBindAddr(string(bind))
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		LocalAddr: &net.TCPAddr{IP: ip},
+	}
+	if net.ParseIP(string(bind)) == nil {
+		dialer.Control = bindToDevice(string(bind))
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+func (bind boundDialer) Dial(network, addr string) (net.Conn, error) {
+	return bind.DialContext(context.Background(), network, addr)
+}
@@ -0,0 +1,27 @@
+package protonmail
+
+import (
+	"syscall"
+)
+
+// bindToDevice returns a dialer control function which binds sockets to a
+// network interface with SO_BINDTODEVICE, so that connections can't leave
+// through another interface whatever the routing table says.
+//
+// Before Linux 5.7, SO_BINDTODEVICE requires CAP_NET_RAW. Without it,
+// connections only originate from the interface's address.
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+		})
+		if err != nil {
+			return err
+		}
+		if sockErr == syscall.EPERM {
+			return nil
+		}
+		return sockErr
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package protonmail
+
+import (
+	"syscall"
+)
+
+// bindToDevice returns nil: sockets can only be bound to a network interface
+// on Linux. Elsewhere, connections only originate from the interface's
+// address.
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,66 @@
+package protonmail
+
+import (
+	"net"
+	"testing"
+)
+
+func TestBoundDialer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	var loopback string
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 && iface.Flags&net.FlagUp != 0 {
+			loopback = iface.Name
+			break
+		}
+	}
+
+	tests := []struct {
+		bind string
+		err  bool
+	}{
+		{bind: "127.0.0.1"},
+		{bind: loopback},
+		{bind: "hydroxide-nonexistent0", err: true},
+		{bind: "192.0.2.1", err: true},
+	}
+	for _, tc := range tests {
+		if tc.bind == "" {
+			continue
+		}
+		c, err := boundDialer(tc.bind).Dial("tcp", ln.Addr().String())
+		if tc.err {
+			if err == nil {
+				c.Close()
+				t.Errorf("Dial() with bind %q succeeded", tc.bind)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Dial() with bind %q = %v", tc.bind, err)
+			continue
+		}
+		if ip := c.LocalAddr().(*net.TCPAddr).IP; !ip.IsLoopback() {
+			t.Errorf("Dial() with bind %q: local address = %v, want a loopback address", tc.bind, ip)
+		}
+		c.Close()
+	}
+}
@@ -1,9 +1,22 @@
 package protonmail
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
 )
 
 const calendarPath = "/calendar/v1"
@@ -23,35 +36,223 @@ type CalendarEventPermissions int
 
 type CalendarEvent struct {
 	ID                string
+	UID               string
 	CalendarID        string
 	CalendarKeyPacket string
 	CreateTime        Timestamp
 	LastEditTime      Timestamp
+	StartTime         Timestamp
+	EndTime           Timestamp
 	Author            string
 	Permissions       CalendarEventPermissions
 	SharedKeyPacket   string
-	SharedEvents      []CalendarEventCard
-	CalendarEvents    interface{}
-	PersonalEvent     []CalendarEventCard
+	// Parts of the event shared by all members of the calendar: the event's
+	// basic properties are signed, the others are encrypted with
+	// SharedKeyPacket
+	SharedEvents []CalendarEventCard
+	// Parts only visible to the calendar's members, encrypted with
+	// CalendarKeyPacket
+	CalendarEvents []CalendarEventCard
+	// Parts specific to a member, e.g. alarms
+	PersonalEvents []CalendarEventCard
 }
 
 type CalendarEventCardType int
 
+const (
+	CalendarEventCardCleartext CalendarEventCardType = iota
+	CalendarEventCardEncrypted
+	CalendarEventCardSigned
+	CalendarEventCardEncryptedAndSigned
+)
+
+func (t CalendarEventCardType) Signed() bool {
+	switch t {
+	case CalendarEventCardSigned, CalendarEventCardEncryptedAndSigned:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t CalendarEventCardType) Encrypted() bool {
+	switch t {
+	case CalendarEventCardEncrypted, CalendarEventCardEncryptedAndSigned:
+		return true
+	default:
+		return false
+	}
+}
+
 type CalendarEventCard struct {
 	Type      CalendarEventCardType
 	Data      string
-	Signature string
-	MemberID  string
+	Signature string `json:",omitempty"`
+	MemberID  string `json:",omitempty"`
+}
+
+// Read decrypts the card and checks its signature. Encrypted cards only
+// contain a data packet, the session key is in keyPacket: SharedKeyPacket or
+// CalendarKeyPacket, depending on where the card comes from. Both are base64
+// encoded.
+func (card *CalendarEventCard) Read(keyPacket string, keyring openpgp.KeyRing) (*openpgp.MessageDetails, error) {
+	if !card.Type.Encrypted() {
+		md := &openpgp.MessageDetails{
+			IsEncrypted:    false,
+			IsSigned:       false,
+			UnverifiedBody: strings.NewReader(card.Data),
+		}
+
+		if !card.Type.Signed() {
+			return md, nil
+		}
+
+		signed := strings.NewReader(card.Data)
+		signature := strings.NewReader(card.Signature)
+		signer, err := openpgp.CheckArmoredDetachedSignature(keyring, signed, signature, nil)
+		md.IsSigned = true
+		md.SignatureError = err
+		if signer != nil {
+			md.SignedByKeyId = signer.PrimaryKey.KeyId
+			md.SignedBy = entityPrimaryKey(signer)
+		}
+		return md, nil
+	}
+
+	if keyPacket == "" {
+		return nil, errors.New("missing key packet for encrypted calendar card")
+	}
+	key, err := base64.StdEncoding.DecodeString(keyPacket)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key packet: %v", err)
+	}
+	data, err := base64.StdEncoding.DecodeString(card.Data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid calendar card data: %v", err)
+	}
+
+	ciphertext := io.MultiReader(bytes.NewReader(key), bytes.NewReader(data))
+	md, err := openpgp.ReadMessage(ciphertext, keyring, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if card.Type.Signed() {
+		r := &detachedSignatureReader{
+			md:        md,
+			signature: strings.NewReader(card.Signature),
+			keyring:   keyring,
+		}
+		r.body = io.TeeReader(md.UnverifiedBody, &r.signed)
+
+		md.UnverifiedBody = r
+	}
+
+	return md, nil
+}
+
+// NewSignedCalendarEventCard creates a cleartext card with a detached
+// signature.
+func NewSignedCalendarEventCard(r io.Reader, signer *openpgp.Entity) (*CalendarEventCard, error) {
+	var msg, sig bytes.Buffer
+	r = io.TeeReader(r, &msg)
+	if err := openpgp.ArmoredDetachSignText(&sig, signer, r, nil); err != nil {
+		return nil, err
+	}
+
+	return &CalendarEventCard{
+		Type:      CalendarEventCardSigned,
+		Data:      msg.String(),
+		Signature: sig.String(),
+	}, nil
 }
 
-func (c *Client) ListCalendars(page, pageSize int) ([]*Calendar, error) {
+// NewEncryptedCalendarEventCard creates a card encrypted with sessionKey and
+// signed by signer. The card only contains the data packet, the session key
+// is sent separately in SharedKeyPacket or CalendarKeyPacket.
+func NewEncryptedCalendarEventCard(r io.Reader, sessionKey *packet.EncryptedKey, signer *openpgp.Entity) (*CalendarEventCard, error) {
+	var msg, encoded bytes.Buffer
+	r = io.TeeReader(r, &msg)
+
+	ciphertext := base64.NewEncoder(base64.StdEncoding, &encoded)
+	cleartext, err := symetricallyEncrypt(ciphertext, sessionKey, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(cleartext, r); err != nil {
+		return nil, err
+	}
+	if err := cleartext.Close(); err != nil {
+		return nil, err
+	}
+	if err := ciphertext.Close(); err != nil {
+		return nil, err
+	}
+
+	var sig bytes.Buffer
+	if err := openpgp.ArmoredDetachSignText(&sig, signer, &msg, nil); err != nil {
+		return nil, err
+	}
+
+	return &CalendarEventCard{
+		Type:      CalendarEventCardEncryptedAndSigned,
+		Data:      encoded.String(),
+		Signature: sig.String(),
+	}, nil
+}
+
+// GenerateCalendarEventKey generates a new session key for the encrypted
+// parts of an event.
+func GenerateCalendarEventKey() (*packet.EncryptedKey, error) {
+	return generateUnencryptedKey(packet.CipherAES256, nil)
+}
+
+// EncryptCalendarEventKey encrypts a session key with a calendar key. The
+// result is base64 encoded, suitable for SharedKeyPacket and
+// CalendarKeyPacket.
+func EncryptCalendarEventKey(sessionKey *packet.EncryptedKey, to *openpgp.Entity) (string, error) {
+	encKey, ok := encryptionKey(to, time.Now())
+	if !ok {
+		return "", errors.New("cannot encrypt an event key with this calendar key")
+	}
+	return serializeEncryptedKey(sessionKey, encKey.PublicKey, nil)
+}
+
+// DecryptCalendarEventKey decrypts the session key of an existing event, so
+// that it can be re-used when the event is updated.
+func DecryptCalendarEventKey(keyPacket string, keyring openpgp.KeyRing) (*packet.EncryptedKey, error) {
+	b, err := base64.StdEncoding.DecodeString(keyPacket)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key packet: %v", err)
+	}
+	p, err := packet.Read(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	sessionKey, ok := p.(*packet.EncryptedKey)
+	if !ok {
+		return nil, errors.New("key packet doesn't contain an encrypted key")
+	}
+
+	for _, k := range keyring.KeysById(sessionKey.KeyId) {
+		if k.PrivateKey == nil || k.PrivateKey.Encrypted {
+			continue
+		}
+		if err := sessionKey.Decrypt(k.PrivateKey, nil); err == nil {
+			return sessionKey, nil
+		}
+	}
+	return nil, errors.New("cannot decrypt event key")
+}
+
+func (c *Client) ListCalendars(ctx context.Context, page, pageSize int) ([]*Calendar, error) {
 	v := url.Values{}
 	v.Set("Page", strconv.Itoa(page))
 	if pageSize > 0 {
 		v.Set("PageSize", strconv.Itoa(pageSize))
 	}
 
-	req, err := c.newRequest(http.MethodGet, calendarPath+"?"+v.Encode(), nil)
+	req, err := c.newRequest(ctx, http.MethodGet, calendarPath+"?"+v.Encode(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -73,7 +274,7 @@ type CalendarEventFilter struct {
 	Page, PageSize int
 }
 
-func (c *Client) ListCalendarEvents(calendarID string, filter *CalendarEventFilter) ([]*CalendarEvent, error) {
+func (c *Client) ListCalendarEvents(ctx context.Context, calendarID string, filter *CalendarEventFilter) ([]*CalendarEvent, error) {
 	v := url.Values{}
 	v.Set("Start", strconv.FormatInt(filter.Start, 10))
 	v.Set("End", strconv.FormatInt(filter.End, 10))
@@ -83,7 +284,7 @@ func (c *Client) ListCalendarEvents(calendarID string, filter *CalendarEventFilt
 		v.Set("PageSize", strconv.Itoa(filter.PageSize))
 	}
 
-	req, err := c.newRequest(http.MethodGet, calendarPath+"/"+calendarID+"/events?"+v.Encode(), nil)
+	req, err := c.newRequest(ctx, http.MethodGet, calendarPath+"/"+calendarID+"/events?"+v.Encode(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -97,5 +298,222 @@ func (c *Client) ListCalendarEvents(calendarID string, filter *CalendarEventFilt
 	}
 
 	return respData.Events, nil
+}
+
+func (c *Client) GetCalendarEvent(ctx context.Context, calendarID, eventID string) (*CalendarEvent, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, calendarPath+"/"+calendarID+"/events/"+eventID, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Event *CalendarEvent
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Event, nil
+}
+
+type CalendarKeyFlags int
+
+const (
+	CalendarKeyActive  CalendarKeyFlags = 1
+	CalendarKeyPrimary CalendarKeyFlags = 2
+)
+
+type CalendarKey struct {
+	ID           string
+	CalendarID   string
+	PassphraseID string
+	PrivateKey   string
+	Flags        CalendarKeyFlags
+}
+
+func (c *Client) ListCalendarKeys(ctx context.Context, calendarID string) ([]*CalendarKey, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, calendarPath+"/"+calendarID+"/keys", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Keys []*CalendarKey
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Keys, nil
+}
+
+type CalendarMemberPassphrase struct {
+	MemberID string
+	// Armored message encrypted with the member's address key
+	Passphrase string
+	Signature  string
+}
+
+type CalendarPassphrase struct {
+	ID                string
+	Flags             int
+	MemberPassphrases []*CalendarMemberPassphrase
+}
+
+func (c *Client) GetCalendarPassphrase(ctx context.Context, calendarID string) (*CalendarPassphrase, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, calendarPath+"/"+calendarID+"/passphrase", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Passphrase *CalendarPassphrase
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Passphrase, nil
+}
+
+// decrypt returns the passphrase of the calendar keys, decrypted with the
+// keys of one of the calendar's members. The member and the address key used
+// are returned as well.
+func (passphrase *CalendarPassphrase) decrypt(addrKeys openpgp.KeyRing) ([]byte, *CalendarMemberPassphrase, *openpgp.Entity, error) {
+	var lastErr error = errors.New("no member passphrase available")
+	for _, mp := range passphrase.MemberPassphrases {
+		block, err := armor.Decode(strings.NewReader(mp.Passphrase))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		md, err := openpgp.ReadMessage(block.Body, addrKeys, nil, nil)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		b, err := ioutil.ReadAll(md.UnverifiedBody)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return b, mp, md.DecryptedWith.Entity, nil
+	}
+	return nil, nil, nil, fmt.Errorf("cannot decrypt calendar passphrase: %v", lastErr)
+}
+
+type CalendarKeyRing struct {
+	// Calendar keys, the primary key comes first
+	Keys openpgp.EntityList
+	// ID of the user's membership of the calendar
+	MemberID string
+	// Address key of the member, used to sign events
+	AddressKey *openpgp.Entity
+}
+
+// UnlockCalendarKeys decrypts the keys of a calendar with the keys of the
+// member's addresses.
+func (c *Client) UnlockCalendarKeys(ctx context.Context, calendarID string, addrKeys openpgp.KeyRing) (*CalendarKeyRing, error) {
+	passphrase, err := c.GetCalendarPassphrase(ctx, calendarID)
+	if err != nil {
+		return nil, err
+	}
+	passphraseBytes, member, addrKey, err := passphrase.decrypt(addrKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := c.ListCalendarKeys(ctx, calendarID)
+	if err != nil {
+		return nil, err
+	}
+
+	var keyRing openpgp.EntityList
+	for _, key := range keys {
+		if key.PassphraseID != "" && key.PassphraseID != passphrase.ID {
+			continue
+		}
+
+		el, err := openpgp.ReadArmoredKeyRing(strings.NewReader(key.PrivateKey))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read calendar key: %v", err)
+		}
+		if len(el) == 0 {
+			return nil, errors.New("calendar key is empty")
+		}
+		e := el[0]
+		if err := unlockKey(e, passphraseBytes); err != nil {
+			return nil, fmt.Errorf("failed to unlock calendar key %v: %v", e.PrimaryKey.KeyIdString(), err)
+		}
+
+		if key.Flags&CalendarKeyPrimary != 0 {
+			keyRing = append(openpgp.EntityList{e}, keyRing...)
+		} else {
+			keyRing = append(keyRing, e)
+		}
+	}
+	if len(keyRing) == 0 {
+		return nil, errors.New("calendar has no usable key")
+	}
+
+	return &CalendarKeyRing{
+		Keys:       keyRing,
+		MemberID:   member.MemberID,
+		AddressKey: addrKey,
+	}, nil
+}
+
+type CalendarEventContent struct {
+	Permissions CalendarEventPermissions
+	IsOrganizer int
+	// Only set when creating an event, the session key of existing events
+	// can't be changed
+	SharedKeyPacket      string `json:",omitempty"`
+	SharedEventContent   []*CalendarEventCard
+	CalendarEventContent []*CalendarEventCard `json:",omitempty"`
+	PersonalEventContent *CalendarEventCard   `json:",omitempty"`
+}
+
+// CalendarEventSync is an operation on an event: if ID is empty, the event is
+// created. If Event is nil, the event is deleted. Otherwise it's updated.
+type CalendarEventSync struct {
+	ID        string                `json:",omitempty"`
+	Overwrite int                   `json:",omitempty"`
+	Event     *CalendarEventContent `json:",omitempty"`
+}
+
+type CalendarEventSyncResp struct {
+	Index    int
+	Response struct {
+		resp
+		Event *CalendarEvent
+	}
+}
+
+func (resp *CalendarEventSyncResp) Err() error {
+	return resp.Response.Err()
+}
+
+func (c *Client) SyncCalendarEvents(ctx context.Context, calendarID, memberID string, events []*CalendarEventSync) ([]*CalendarEventSyncResp, error) {
+	reqData := struct {
+		MemberID string
+		Events   []*CalendarEventSync
+	}{memberID, events}
+	req, err := c.newJSONRequest(ctx, http.MethodPut, calendarPath+"/"+calendarID+"/events/sync", &reqData)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Responses []*CalendarEventSyncResp
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
 
+	return respData.Responses, nil
 }
@@ -2,6 +2,7 @@ package protonmail
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"net/http"
 	"net/url"
@@ -233,14 +234,14 @@ type ContactImport struct {
 	Cards []*ContactCard
 }
 
-func (c *Client) ListContacts(page, pageSize int) (total int, contacts []*Contact, err error) {
+func (c *Client) ListContacts(ctx context.Context, page, pageSize int) (total int, contacts []*Contact, err error) {
 	v := url.Values{}
 	v.Set("Page", strconv.Itoa(page))
 	if pageSize > 0 {
 		v.Set("PageSize", strconv.Itoa(pageSize))
 	}
 
-	req, err := c.newRequest(http.MethodGet, "/contacts?"+v.Encode(), nil)
+	req, err := c.newRequest(ctx, http.MethodGet, "/contacts?"+v.Encode(), nil)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -257,14 +258,14 @@ func (c *Client) ListContacts(page, pageSize int) (total int, contacts []*Contac
 	return respData.Total, respData.Contacts, nil
 }
 
-func (c *Client) ListContactsEmails(page, pageSize int) (total int, emails []*ContactEmail, err error) {
+func (c *Client) ListContactsEmails(ctx context.Context, page, pageSize int) (total int, emails []*ContactEmail, err error) {
 	v := url.Values{}
 	v.Set("Page", strconv.Itoa(page))
 	if pageSize > 0 {
 		v.Set("PageSize", strconv.Itoa(pageSize))
 	}
 
-	req, err := c.newRequest(http.MethodGet, "/contacts/emails?"+v.Encode(), nil)
+	req, err := c.newRequest(ctx, http.MethodGet, "/contacts/emails?"+v.Encode(), nil)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -281,14 +282,35 @@ func (c *Client) ListContactsEmails(page, pageSize int) (total int, emails []*Co
 	return respData.Total, respData.ContactEmails, nil
 }
 
-func (c *Client) ListContactsExport(page, pageSize int) (total int, contacts []*ContactExport, err error) {
+// FindContactEmails returns the contact emails matching an address.
+func (c *Client) FindContactEmails(ctx context.Context, email string) ([]*ContactEmail, error) {
+	v := url.Values{}
+	v.Set("Email", ASCIIAddress(email))
+
+	req, err := c.newRequest(ctx, http.MethodGet, "/contacts/emails?"+v.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		ContactEmails []*ContactEmail
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.ContactEmails, nil
+}
+
+func (c *Client) ListContactsExport(ctx context.Context, page, pageSize int) (total int, contacts []*ContactExport, err error) {
 	v := url.Values{}
 	v.Set("Page", strconv.Itoa(page))
 	if pageSize > 0 {
 		v.Set("PageSize", strconv.Itoa(pageSize))
 	}
 
-	req, err := c.newRequest(http.MethodGet, "/contacts/export?"+v.Encode(), nil)
+	req, err := c.newRequest(ctx, http.MethodGet, "/contacts/export?"+v.Encode(), nil)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -305,8 +327,8 @@ func (c *Client) ListContactsExport(page, pageSize int) (total int, contacts []*
 	return respData.Total, respData.Contacts, nil
 }
 
-func (c *Client) GetContact(id string) (*Contact, error) {
-	req, err := c.newRequest(http.MethodGet, "/contacts/"+id, nil)
+func (c *Client) GetContact(ctx context.Context, id string) (*Contact, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/contacts/"+id, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -334,12 +356,12 @@ func (resp *CreateContactResp) Err() error {
 	return resp.Response.Err()
 }
 
-func (c *Client) CreateContacts(contacts []*ContactImport) ([]*CreateContactResp, error) {
+func (c *Client) CreateContacts(ctx context.Context, contacts []*ContactImport) ([]*CreateContactResp, error) {
 	reqData := struct {
 		Contacts                  []*ContactImport
 		Overwrite, Groups, Labels int
 	}{contacts, 0, 0, 0}
-	req, err := c.newJSONRequest(http.MethodPost, "/contacts", &reqData)
+	req, err := c.newJSONRequest(ctx, http.MethodPost, "/contacts", &reqData)
 	if err != nil {
 		return nil, err
 	}
@@ -355,8 +377,8 @@ func (c *Client) CreateContacts(contacts []*ContactImport) ([]*CreateContactResp
 	return respData.Responses, nil
 }
 
-func (c *Client) UpdateContact(id string, contact *ContactImport) (*Contact, error) {
-	req, err := c.newJSONRequest(http.MethodPut, "/contacts/"+id, contact)
+func (c *Client) UpdateContact(ctx context.Context, id string, contact *ContactImport) (*Contact, error) {
+	req, err := c.newJSONRequest(ctx, http.MethodPut, "/contacts/"+id, contact)
 	if err != nil {
 		return nil, err
 	}
@@ -383,11 +405,11 @@ func (resp *DeleteContactResp) Err() error {
 	return resp.Response.Err()
 }
 
-func (c *Client) DeleteContacts(ids []string) ([]*DeleteContactResp, error) {
+func (c *Client) DeleteContacts(ctx context.Context, ids []string) ([]*DeleteContactResp, error) {
 	reqData := struct {
 		IDs []string
 	}{ids}
-	req, err := c.newJSONRequest(http.MethodPut, "/contacts/delete", &reqData)
+	req, err := c.newJSONRequest(ctx, http.MethodPut, "/contacts/delete", &reqData)
 	if err != nil {
 		return nil, err
 	}
@@ -403,8 +425,50 @@ func (c *Client) DeleteContacts(ids []string) ([]*DeleteContactResp, error) {
 	return respData.Responses, nil
 }
 
-func (c *Client) DeleteAllContacts() error {
-	req, err := c.newRequest(http.MethodDelete, "/contacts", nil)
+type ContactEmailLabelResp struct {
+	ID       string
+	Response struct {
+		resp
+	}
+}
+
+func (resp *ContactEmailLabelResp) Err() error {
+	return resp.Response.Err()
+}
+
+func (c *Client) setContactEmailsLabel(ctx context.Context, action, labelID string, emailIDs []string) ([]*ContactEmailLabelResp, error) {
+	reqData := struct {
+		LabelID         string
+		ContactEmailIDs []string
+	}{labelID, emailIDs}
+	req, err := c.newJSONRequest(ctx, http.MethodPut, "/contacts/emails/"+action, &reqData)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Responses []*ContactEmailLabelResp
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Responses, nil
+}
+
+// LabelContactEmails adds contact e-mail addresses to a contact group.
+func (c *Client) LabelContactEmails(ctx context.Context, labelID string, emailIDs []string) ([]*ContactEmailLabelResp, error) {
+	return c.setContactEmailsLabel(ctx, "label", labelID, emailIDs)
+}
+
+// UnlabelContactEmails removes contact e-mail addresses from a contact group.
+func (c *Client) UnlabelContactEmails(ctx context.Context, labelID string, emailIDs []string) ([]*ContactEmailLabelResp, error) {
+	return c.setContactEmailsLabel(ctx, "unlabel", labelID, emailIDs)
+}
+
+func (c *Client) DeleteAllContacts(ctx context.Context) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, "/contacts", nil)
 	if err != nil {
 		return err
 	}
@@ -1,6 +1,7 @@
 package protonmail
 
 import (
+	"context"
 	"net/http"
 	"net/url"
 )
@@ -18,15 +19,65 @@ type Conversation struct {
 	TotalSize      int64
 	AddressID      string
 	LabelIDs       []string
+
+	// When listing conversations, these fields only account for the messages
+	// having the listed label
+	ContextTime        Timestamp
+	ContextNumMessages int
+	ContextNumUnread   int
+}
+
+// ListConversations lists conversations. The filter is the same as for
+// messages, the Conversation field is ignored.
+func (c *Client) ListConversations(ctx context.Context, filter *MessageFilter) (total int, conversations []*Conversation, err error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/conversations?"+filter.values().Encode(), nil)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var respData struct {
+		resp
+		Total         int
+		Conversations []*Conversation
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return 0, nil, err
+	}
+
+	return respData.Total, respData.Conversations, nil
+}
+
+// CountConversations returns the number of conversations per label.
+func (c *Client) CountConversations(ctx context.Context, address string) ([]*MessageCount, error) {
+	v := url.Values{}
+	if address != "" {
+		v.Set("Address", address)
+	}
+	req, err := c.newRequest(ctx, http.MethodGet, "/conversations/count?"+v.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Counts []*MessageCount
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Counts, nil
 }
 
-func (c *Client) GetConversation(id, msgID string) (*Conversation, []*Message, error) {
+// GetConversation returns a conversation and the metadata of its messages. If
+// msgID isn't empty, the body of this message is included.
+func (c *Client) GetConversation(ctx context.Context, id, msgID string) (*Conversation, []*Message, error) {
 	v := url.Values{}
 	if msgID != "" {
 		v.Set("MessageID", msgID)
 	}
 
-	req, err := c.newRequest(http.MethodGet, "/conversations/"+id+"?"+v.Encode(), nil)
+	req, err := c.newRequest(ctx, http.MethodGet, "/conversations/"+id+"?"+v.Encode(), nil)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -42,3 +93,59 @@ func (c *Client) GetConversation(id, msgID string) (*Conversation, []*Message, e
 
 	return respData.Conversation, respData.Messages, nil
 }
+
+func (c *Client) doConversations(ctx context.Context, action string, reqData interface{}) error {
+	req, err := c.newJSONRequest(ctx, http.MethodPut, "/conversations/"+action, reqData)
+	if err != nil {
+		return err
+	}
+
+	// TODO: the response contains one response per conversation
+	return c.doJSON(req, nil)
+}
+
+// MarkConversationsRead marks all messages of conversations as read.
+func (c *Client) MarkConversationsRead(ctx context.Context, ids []string) error {
+	reqData := struct {
+		IDs []string
+	}{ids}
+	return c.doConversations(ctx, "read", &reqData)
+}
+
+// MarkConversationsUnread marks the latest message having the provided label
+// of each conversation as unread, like the web client does.
+func (c *Client) MarkConversationsUnread(ctx context.Context, labelID string, ids []string) error {
+	reqData := struct {
+		LabelID string
+		IDs     []string
+	}{labelID, ids}
+	return c.doConversations(ctx, "unread", &reqData)
+}
+
+// DeleteConversations permanently deletes the messages having the provided
+// label of conversations.
+func (c *Client) DeleteConversations(ctx context.Context, labelID string, ids []string) error {
+	reqData := struct {
+		LabelID string
+		IDs     []string
+	}{labelID, ids}
+	return c.doConversations(ctx, "delete", &reqData)
+}
+
+// LabelConversations adds a label to all messages of conversations.
+func (c *Client) LabelConversations(ctx context.Context, labelID string, ids []string) error {
+	reqData := struct {
+		LabelID string
+		IDs     []string
+	}{labelID, ids}
+	return c.doConversations(ctx, "label", &reqData)
+}
+
+// UnlabelConversations removes a label from all messages of conversations.
+func (c *Client) UnlabelConversations(ctx context.Context, labelID string, ids []string) error {
+	reqData := struct {
+		LabelID string
+		IDs     []string
+	}{labelID, ids}
+	return c.doConversations(ctx, "unlabel", &reqData)
+}
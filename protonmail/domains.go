@@ -0,0 +1,150 @@
+package protonmail
+
+import (
+	"context"
+	"net/http"
+)
+
+type DomainState int
+
+const (
+	DomainDisabled DomainState = iota
+	DomainActive
+	DomainWarning
+)
+
+// DomainVerifyState is the state of the TXT record proving domain ownership.
+type DomainVerifyState int
+
+const (
+	DomainVerifyDefault DomainVerifyState = iota
+	DomainVerifyWrong
+	DomainVerifyGood
+)
+
+func (state DomainVerifyState) String() string {
+	switch state {
+	case DomainVerifyDefault:
+		return "not checked"
+	case DomainVerifyWrong:
+		return "invalid"
+	case DomainVerifyGood:
+		return "ok"
+	default:
+		return "unknown"
+	}
+}
+
+// DomainRecordState is the state of a DNS record (MX, SPF, DKIM or DMARC).
+type DomainRecordState int
+
+const (
+	DomainRecordDefault DomainRecordState = iota
+	DomainRecordMissing
+	DomainRecordWrong
+	DomainRecordGood
+)
+
+func (state DomainRecordState) String() string {
+	switch state {
+	case DomainRecordDefault:
+		return "not checked"
+	case DomainRecordMissing:
+		return "missing"
+	case DomainRecordWrong:
+		return "invalid"
+	case DomainRecordGood:
+		return "ok"
+	default:
+		return "unknown"
+	}
+}
+
+type Domain struct {
+	ID          string
+	DomainName  string
+	State       DomainState
+	CheckTime   Timestamp
+	VerifyCode  string
+	VerifyState DomainVerifyState
+	MxState     DomainRecordState
+	SpfState    DomainRecordState
+	DkimState   DomainRecordState
+	DmarcState  DomainRecordState
+}
+
+func (c *Client) ListDomains(ctx context.Context) ([]*Domain, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/domains", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Domains []*Domain
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Domains, nil
+}
+
+func (c *Client) GetDomain(ctx context.Context, id string) (*Domain, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/domains/"+id, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Domain *Domain
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Domain, nil
+}
+
+func (c *Client) ListDomainAddresses(ctx context.Context, id string) ([]*Address, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/domains/"+id+"/addresses", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Addresses []*Address
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Addresses, nil
+}
+
+// SetCatchAll makes the address receive all messages sent to unknown
+// addresses of the domain. An empty address ID disables catch-all.
+func (c *Client) SetCatchAll(ctx context.Context, domainID, addressID string) (*Domain, error) {
+	reqData := struct {
+		AddressID *string
+	}{}
+	if addressID != "" {
+		reqData.AddressID = &addressID
+	}
+	req, err := c.newJSONRequest(ctx, http.MethodPut, "/domains/"+domainID+"/catchall", &reqData)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Domain *Domain
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Domain, nil
+}
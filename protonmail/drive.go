@@ -0,0 +1,408 @@
+package protonmail
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+const drivePath = "/drive"
+
+type ShareType int
+
+const (
+	ShareMain ShareType = 1 + iota
+	ShareStandard
+	ShareDevice
+	SharePhotos
+)
+
+type ShareState int
+
+const (
+	ShareActive ShareState = 1 + iota
+	ShareDeleted
+)
+
+// Share is the root of a tree of links: the user's main share contains the
+// files of "My files".
+type Share struct {
+	ShareID  string
+	VolumeID string
+	LinkID   string // root folder
+	Type     ShareType
+	State    ShareState
+	Creator  string
+	Flags    int
+
+	// Only returned by GetShare
+	AddressID string
+	// Armored private key, locked with Passphrase
+	Key string
+	// Armored message encrypted with the address key
+	Passphrase          string
+	PassphraseSignature string
+}
+
+type LinkType int
+
+const (
+	LinkFolder LinkType = 1 + iota
+	LinkFile
+)
+
+type LinkState int
+
+const (
+	LinkDraft LinkState = iota
+	LinkActive
+	LinkTrashed
+	LinkDeleted
+)
+
+// Link is a file or a folder. Its name and keys are encrypted with the node
+// key of its parent folder, or with the share key for the root folder.
+type Link struct {
+	LinkID       string
+	ParentLinkID string
+	Type         LinkType
+	State        LinkState
+	// Armored message
+	Name               string
+	NameSignatureEmail string
+	// HMAC of the name, keyed with the parent's NodeHashKey
+	Hash string
+	// Size of the encrypted contents, see LinkXAttr for the plaintext size
+	Size       int64
+	MIMEType   string
+	CreateTime Timestamp
+	ModifyTime Timestamp
+
+	// Armored private key, locked with NodePassphrase
+	NodeKey string
+	// Armored message
+	NodePassphrase          string
+	NodePassphraseSignature string
+	SignatureEmail          string
+	// Armored message encrypted with the node key, see LinkXAttr
+	XAttr string
+
+	FileProperties   *FileProperties
+	FolderProperties *FolderProperties
+}
+
+// LinkXAttr contains the extended attributes of a link.
+type LinkXAttr struct {
+	Common struct {
+		ModificationTime string // RFC 3339
+		Size             int64
+		BlockSizes       []int64
+	}
+}
+
+type FileProperties struct {
+	// Base64-encoded session key of the file contents, encrypted with the
+	// node key
+	ContentKeyPacket string
+	ActiveRevision   *Revision
+}
+
+type FolderProperties struct {
+	// Armored message
+	NodeHashKey string
+}
+
+type RevisionState int
+
+const (
+	RevisionDraft RevisionState = iota
+	RevisionActive
+	RevisionObsolete
+)
+
+// Revision is a version of the contents of a file, split into blocks.
+type Revision struct {
+	ID         string
+	CreateTime Timestamp
+	Size       int64
+	State      RevisionState
+	// Only returned by GetRevision
+	Blocks []*Block
+}
+
+// Block is a chunk of a file's contents, encrypted with the file's session
+// key. It's stored on a different server than the API.
+type Block struct {
+	Index        int
+	BareURL      string
+	Token        string
+	EncSignature string
+	Hash         string
+}
+
+// decryptArmored decrypts an armored message.
+func decryptArmored(s string, keyring openpgp.KeyRing) ([]byte, error) {
+	block, err := armor.Decode(strings.NewReader(s))
+	if err != nil {
+		return nil, err
+	}
+	md, err := openpgp.ReadMessage(block.Body, keyring, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(md.UnverifiedBody)
+}
+
+// unlockArmoredKey reads an armored private key and decrypts it with a
+// passphrase which is itself encrypted with keyring.
+func unlockArmoredKey(key, passphrase string, keyring openpgp.KeyRing) (*openpgp.Entity, error) {
+	passphraseBytes, err := decryptArmored(passphrase, keyring)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt key passphrase: %v", err)
+	}
+
+	el, err := openpgp.ReadArmoredKeyRing(strings.NewReader(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %v", err)
+	}
+	if len(el) == 0 {
+		return nil, errors.New("key is empty")
+	}
+	e := el[0]
+	if err := unlockKey(e, passphraseBytes); err != nil {
+		return nil, fmt.Errorf("failed to unlock key %v: %v", e.PrimaryKey.KeyIdString(), err)
+	}
+	return e, nil
+}
+
+// Unlock decrypts the share key with the keys of the share's address.
+func (share *Share) Unlock(addrKeys openpgp.KeyRing) (*openpgp.Entity, error) {
+	if share.Key == "" {
+		return nil, errors.New("share key is missing")
+	}
+	return unlockArmoredKey(share.Key, share.Passphrase, addrKeys)
+}
+
+// UnlockNodeKey decrypts the node key of a link with the key of its parent:
+// the parent's node key, or the share key for the root folder.
+func (link *Link) UnlockNodeKey(parentKey openpgp.KeyRing) (*openpgp.Entity, error) {
+	return unlockArmoredKey(link.NodeKey, link.NodePassphrase, parentKey)
+}
+
+// DecryptName decrypts the name of a link with the key of its parent.
+func (link *Link) DecryptName(parentKey openpgp.KeyRing) (string, error) {
+	b, err := decryptArmored(link.Name, parentKey)
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt link name: %v", err)
+	}
+	return string(b), nil
+}
+
+// DecryptXAttr decrypts the extended attributes of a link with its node key.
+// It returns nil if the link has none.
+func (link *Link) DecryptXAttr(nodeKey openpgp.KeyRing) (*LinkXAttr, error) {
+	if link.XAttr == "" {
+		return nil, nil
+	}
+	b, err := decryptArmored(link.XAttr, nodeKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt link attributes: %v", err)
+	}
+	var xattr LinkXAttr
+	if err := json.Unmarshal(b, &xattr); err != nil {
+		return nil, fmt.Errorf("invalid link attributes: %v", err)
+	}
+	return &xattr, nil
+}
+
+// maxBlockSize is the maximum size of an encrypted block. Clients split files
+// into blocks of 4 MiB, to which the encryption overhead is added.
+const maxBlockSize = 8 << 20
+
+// ReadBlock reads an encrypted block of a file, checks its hash, decrypts it
+// with the file's node key and checks its signature against signers.
+//
+// Blocks are small enough to be kept in memory: this way, no unverified data
+// is ever returned.
+func (link *Link) ReadBlock(r io.Reader, block *Block, nodeKey, signers openpgp.KeyRing) ([]byte, error) {
+	if link.FileProperties == nil {
+		return nil, errors.New("link isn't a file")
+	}
+	keyPacket, err := base64.StdEncoding.DecodeString(link.FileProperties.ContentKeyPacket)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content key packet: %v", err)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxBlockSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxBlockSize {
+		return nil, errors.New("block is too large")
+	}
+	sum := sha256.Sum256(data)
+	if block.Hash == "" || base64.StdEncoding.EncodeToString(sum[:]) != block.Hash {
+		return nil, errors.New("block hash mismatch")
+	}
+
+	md, err := openpgp.ReadMessage(io.MultiReader(bytes.NewReader(keyPacket), bytes.NewReader(data)), nodeKey, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return nil, err
+	}
+
+	// The detached signature of the plaintext is encrypted with the node key
+	if block.EncSignature == "" {
+		return nil, errors.New("block isn't signed")
+	}
+	sig, err := decryptArmored(block.EncSignature, nodeKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt block signature: %v", err)
+	}
+	if _, err := openpgp.CheckDetachedSignature(signers, bytes.NewReader(b), bytes.NewReader(sig), nil); err != nil {
+		return nil, fmt.Errorf("invalid block signature: %v", err)
+	}
+	return b, nil
+}
+
+func (c *Client) ListShares(ctx context.Context) ([]*Share, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, drivePath+"/shares", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Shares []*Share
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Shares, nil
+}
+
+// GetShare returns a share, including its key.
+func (c *Client) GetShare(ctx context.Context, shareID string) (*Share, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, drivePath+"/shares/"+shareID, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		*Share
+	}
+	respData.Share = new(Share)
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Share, nil
+}
+
+func (c *Client) GetLink(ctx context.Context, shareID, linkID string) (*Link, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, drivePath+"/shares/"+shareID+"/links/"+linkID, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Link *Link
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Link, nil
+}
+
+// ListChildren lists the links in a folder.
+func (c *Client) ListChildren(ctx context.Context, shareID, linkID string, page, pageSize int) ([]*Link, error) {
+	v := url.Values{}
+	v.Set("Page", strconv.Itoa(page))
+	if pageSize > 0 {
+		v.Set("PageSize", strconv.Itoa(pageSize))
+	}
+
+	req, err := c.newRequest(ctx, http.MethodGet, drivePath+"/shares/"+shareID+"/folders/"+linkID+"/children?"+v.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Links []*Link
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Links, nil
+}
+
+// GetRevision returns a revision of a file with its blocks, starting from
+// fromBlockIndex.
+func (c *Client) GetRevision(ctx context.Context, shareID, linkID, revisionID string, fromBlockIndex, pageSize int) (*Revision, error) {
+	v := url.Values{}
+	v.Set("FromBlockIndex", strconv.Itoa(fromBlockIndex))
+	if pageSize > 0 {
+		v.Set("PageSize", strconv.Itoa(pageSize))
+	}
+
+	path := drivePath + "/shares/" + shareID + "/files/" + linkID + "/revisions/" + revisionID + "?" + v.Encode()
+	req, err := c.newRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Revision *Revision
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Revision, nil
+}
+
+// GetBlock downloads an encrypted block. It can be checked and decrypted with
+// Link.ReadBlock.
+func (c *Client) GetBlock(ctx context.Context, block *Block) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, block.BareURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Pm-Appversion", c.AppVersion)
+	req.Header.Set("Pm-Storage-Token", block.Token)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("cannot get block %v: %v", block.Index, resp.Status)
+	}
+
+	return resp.Body, nil
+}
@@ -0,0 +1,139 @@
+package protonmail
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// encryptBlock encrypts a block with nodeKey and returns its content key
+// packet and its data packets.
+func encryptBlock(t *testing.T, b []byte, nodeKey *openpgp.Entity) (keyPacket, data []byte) {
+	var buf bytes.Buffer
+	w, err := openpgp.Encrypt(&buf, []*openpgp.Entity{nodeKey}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bytes.NewReader(buf.Bytes())
+	if _, err := packet.Read(r); err != nil {
+		t.Fatal(err)
+	}
+	n := buf.Len() - r.Len()
+	return buf.Bytes()[:n], buf.Bytes()[n:]
+}
+
+// signBlock returns the detached signature of b by signer, encrypted with
+// nodeKey.
+func signBlock(t *testing.T, b []byte, signer, nodeKey *openpgp.Entity) string {
+	var sig bytes.Buffer
+	if err := openpgp.DetachSign(&sig, signer, bytes.NewReader(b), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	aw, err := armor.Encode(&buf, "PGP MESSAGE", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := openpgp.Encrypt(aw, []*openpgp.Entity{nodeKey}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(sig.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestReadBlock(t *testing.T) {
+	nodeKey, err := GenerateKey("Node", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrKey, err := GenerateKey("Alice", "alice@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := GenerateKey("Mallory", "mallory@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext := []byte("Hello, Drive!")
+	keyPacket, data := encryptBlock(t, plaintext, nodeKey)
+	sum := sha256.Sum256(data)
+	hash := base64.StdEncoding.EncodeToString(sum[:])
+	link := &Link{
+		FileProperties: &FileProperties{
+			ContentKeyPacket: base64.StdEncoding.EncodeToString(keyPacket),
+		},
+	}
+
+	tests := []struct {
+		name  string
+		block *Block
+		err   bool
+	}{
+		{
+			name:  "valid",
+			block: &Block{Hash: hash, EncSignature: signBlock(t, plaintext, addrKey, nodeKey)},
+		},
+		{
+			name:  "hash mismatch",
+			block: &Block{Hash: base64.StdEncoding.EncodeToString(make([]byte, sha256.Size)), EncSignature: signBlock(t, plaintext, addrKey, nodeKey)},
+			err:   true,
+		},
+		{
+			name:  "no hash",
+			block: &Block{EncSignature: signBlock(t, plaintext, addrKey, nodeKey)},
+			err:   true,
+		},
+		{
+			name:  "not signed",
+			block: &Block{Hash: hash},
+			err:   true,
+		},
+		{
+			name:  "unknown signer",
+			block: &Block{Hash: hash, EncSignature: signBlock(t, plaintext, otherKey, nodeKey)},
+			err:   true,
+		},
+		{
+			name:  "signature of other contents",
+			block: &Block{Hash: hash, EncSignature: signBlock(t, []byte("Hello, World!"), addrKey, nodeKey)},
+			err:   true,
+		},
+	}
+	for _, tc := range tests {
+		b, err := link.ReadBlock(bytes.NewReader(data), tc.block, openpgp.EntityList{nodeKey}, openpgp.EntityList{addrKey})
+		if tc.err {
+			if err == nil {
+				t.Errorf("%v: ReadBlock() succeeded", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: ReadBlock() = %v", tc.name, err)
+		} else if !bytes.Equal(b, plaintext) {
+			t.Errorf("%v: ReadBlock() = %q, want %q", tc.name, b, plaintext)
+		}
+	}
+}
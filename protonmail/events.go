@@ -1,6 +1,7 @@
 package protonmail
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 )
@@ -18,13 +19,13 @@ type Event struct {
 	Messages []*EventMessage
 	Contacts []*EventContact
 	//ContactEmails
-	//Labels
+	Labels []*EventLabel
 	//User
 	//Members
 	//Domains
 	//Organization
-	MessageCounts []*MessageCount
-	//ConversationCounts
+	MessageCounts      []*MessageCount
+	ConversationCounts []*MessageCount
 	//UsedSpace
 	Notices []string
 }
@@ -160,12 +161,18 @@ type EventContact struct {
 	Contact *Contact
 }
 
-func (c *Client) GetEvent(last string) (*Event, error) {
+type EventLabel struct {
+	ID     string
+	Action EventAction
+	Label  *Label
+}
+
+func (c *Client) GetEvent(ctx context.Context, last string) (*Event, error) {
 	if last == "" {
 		last = "latest"
 	}
 
-	req, err := c.newRequest(http.MethodGet, "/events/"+last, nil)
+	req, err := c.newRequest(ctx, http.MethodGet, "/events/"+last, nil)
 	if err != nil {
 		return nil, err
 	}
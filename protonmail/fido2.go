@@ -0,0 +1,97 @@
+package protonmail
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// FIDO2Bytes is a byte string encoded as a JSON array of numbers, as in
+// WebAuthn options.
+type FIDO2Bytes []byte
+
+func (b FIDO2Bytes) MarshalJSON() ([]byte, error) {
+	l := make([]int, len(b))
+	for i, c := range b {
+		l[i] = int(c)
+	}
+	return json.Marshal(l)
+}
+
+func (b *FIDO2Bytes) UnmarshalJSON(data []byte) error {
+	// Base64-encoded strings are accepted too
+	return json.Unmarshal(data, (*[]byte)(b))
+}
+
+// FIDO2Key is a security key registered as a second factor.
+type FIDO2Key struct {
+	AttestationFormat string
+	CredentialID      FIDO2Bytes
+	Name              string
+}
+
+// FIDO2Credential is a credential accepted for an assertion.
+type FIDO2Credential struct {
+	Type string     `json:"type"`
+	ID   FIDO2Bytes `json:"id"`
+}
+
+// FIDO2Options are WebAuthn public key credential request options, see
+// https://www.w3.org/TR/webauthn-2/#dictdef-publickeycredentialrequestoptions
+type FIDO2Options struct {
+	PublicKey struct {
+		Challenge        FIDO2Bytes        `json:"challenge"`
+		Timeout          int               `json:"timeout"`
+		RPID             string            `json:"rpId"`
+		AllowCredentials []FIDO2Credential `json:"allowCredentials"`
+		UserVerification string            `json:"userVerification"`
+	} `json:"publicKey"`
+}
+
+// FIDO2Info contains the challenge to sign with a security key.
+type FIDO2Info struct {
+	// Sent back as is in FIDO2Assertion
+	AuthenticationOptions json.RawMessage
+	RegisteredKeys        []*FIDO2Key
+}
+
+// Options parses the WebAuthn options.
+func (info *FIDO2Info) Options() (*FIDO2Options, error) {
+	var options FIDO2Options
+	if err := json.Unmarshal(info.AuthenticationOptions, &options); err != nil {
+		return nil, err
+	}
+	return &options, nil
+}
+
+// FIDO2Assertion is the response of a security key to a challenge.
+// ClientData, AuthenticatorData and Signature are base64-encoded.
+type FIDO2Assertion struct {
+	AuthenticationOptions json.RawMessage
+	ClientData            string
+	AuthenticatorData     string
+	Signature             string
+	CredentialID          FIDO2Bytes
+}
+
+// AuthFIDO2 completes the authentication with a security key.
+func (c *Client) AuthFIDO2(ctx context.Context, assertion *FIDO2Assertion) (scope string, err error) {
+	reqData := struct {
+		FIDO2 *FIDO2Assertion
+	}{assertion}
+
+	req, err := c.newJSONRequest(ctx, http.MethodPost, "/auth/2fa", reqData)
+	if err != nil {
+		return "", err
+	}
+
+	respData := struct {
+		resp
+		Scope string
+	}{}
+	if err := c.doJSON(req, &respData); err != nil {
+		return "", err
+	}
+
+	return respData.Scope, nil
+}
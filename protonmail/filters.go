@@ -0,0 +1,160 @@
+package protonmail
+
+import (
+	"context"
+	"net/http"
+)
+
+type FilterStatus int
+
+const (
+	FilterDisabled FilterStatus = iota
+	FilterEnabled
+)
+
+// FilterVersion is the version of the Sieve dialect used by filters.
+const FilterVersion = 2
+
+type Filter struct {
+	ID       string
+	Name     string
+	Status   FilterStatus
+	Priority int
+	Version  int
+	Sieve    string
+	// Set for filters created with the simple editor of the web client
+	Simple *SimpleFilter `json:",omitempty"`
+}
+
+// SieveIssue is a problem found in a Sieve script.
+type SieveIssue struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (c *Client) ListFilters(ctx context.Context) ([]*Filter, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/filters", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Filters []*Filter
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Filters, nil
+}
+
+// CreateFilter creates a new filter. Name, Status, Version and Sieve are
+// required in filter.
+func (c *Client) CreateFilter(ctx context.Context, filter *Filter) (*Filter, error) {
+	req, err := c.newJSONRequest(ctx, http.MethodPost, "/filters", filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Filter *Filter
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Filter, nil
+}
+
+func (c *Client) UpdateFilter(ctx context.Context, filter *Filter) (*Filter, error) {
+	req, err := c.newJSONRequest(ctx, http.MethodPut, "/filters/"+filter.ID, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Filter *Filter
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Filter, nil
+}
+
+func (c *Client) setFilterStatus(ctx context.Context, id, action string) (*Filter, error) {
+	req, err := c.newRequest(ctx, http.MethodPut, "/filters/"+id+"/"+action, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Filter *Filter
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Filter, nil
+}
+
+func (c *Client) EnableFilter(ctx context.Context, id string) (*Filter, error) {
+	return c.setFilterStatus(ctx, id, "enable")
+}
+
+func (c *Client) DisableFilter(ctx context.Context, id string) (*Filter, error) {
+	return c.setFilterStatus(ctx, id, "disable")
+}
+
+// OrderFilters sets the order in which filters are applied. ids must contain
+// all filters.
+func (c *Client) OrderFilters(ctx context.Context, ids []string) error {
+	reqData := struct {
+		FilterIDs []string
+	}{ids}
+	req, err := c.newJSONRequest(ctx, http.MethodPut, "/filters/order", &reqData)
+	if err != nil {
+		return err
+	}
+
+	var respData resp
+	return c.doJSON(req, &respData)
+}
+
+func (c *Client) DeleteFilter(ctx context.Context, id string) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, "/filters/"+id, nil)
+	if err != nil {
+		return err
+	}
+
+	var respData resp
+	return c.doJSON(req, &respData)
+}
+
+// CheckSieve validates a Sieve script. An empty list is returned if the
+// script is valid.
+func (c *Client) CheckSieve(ctx context.Context, sieve string) ([]*SieveIssue, error) {
+	reqData := struct {
+		Version int
+		Sieve   string
+	}{FilterVersion, sieve}
+	req, err := c.newJSONRequest(ctx, http.MethodPut, "/filters/check", &reqData)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Issues []*SieveIssue
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Issues, nil
+}
@@ -0,0 +1,41 @@
+package protonmail
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// ASCIIDomain converts an internationalized domain name to its ASCII form
+// (punycode). ASCII domains and invalid domains are returned unchanged.
+func ASCIIDomain(domain string) string {
+	if isASCII(domain) {
+		return domain
+	}
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return domain
+	}
+	return ascii
+}
+
+// ASCIIAddress converts the domain of an email address to its ASCII form, as
+// expected by the API. The local part is left unchanged: Proton accepts UTF-8
+// local parts, but not UTF-8 domains.
+func ASCIIAddress(addr string) string {
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 {
+		return addr
+	}
+	return addr[:i+1] + ASCIIDomain(addr[i+1:])
+}
@@ -1,6 +1,7 @@
 package protonmail
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -84,7 +85,7 @@ func (imp *Importer) Commit() (ImportResult, error) {
 	return <-imp.result, nil
 }
 
-func (c *Client) Import(metadata map[string]*Message) (*Importer, error) {
+func (c *Client) Import(ctx context.Context, metadata map[string]*Message) (*Importer, error) {
 	pr, pw := io.Pipe()
 
 	mw := multipart.NewWriter(pw)
@@ -95,7 +96,7 @@ func (c *Client) Import(metadata map[string]*Message) (*Importer, error) {
 		defer close(done)
 		defer close(result)
 
-		req, err := c.newRequest(http.MethodPost, "/import", pr)
+		req, err := c.newRequest(ctx, http.MethodPost, "/import", pr)
 		if err != nil {
 			done <- err
 			return
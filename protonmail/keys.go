@@ -1,13 +1,20 @@
 package protonmail
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
 )
 
 type PrivateKeyFlags int
@@ -38,6 +45,423 @@ func (priv *PrivateKey) Entity() (*openpgp.Entity, error) {
 	return keyRing[0], nil
 }
 
+// checkAddressKey looks for anomalies in a key of an address: the key should
+// have a user ID for the address and usable subkeys for its flags. These are
+// sanity checks only, they don't tell whether the server has substituted the
+// key: see verifyAddressKeys.
+func checkAddressKey(email string, key *PrivateKey, e *openpgp.Entity) error {
+	var anomalies []string
+
+	hasIdentity := false
+	for _, ident := range e.Identities {
+		if strings.EqualFold(ident.UserId.Email, email) {
+			hasIdentity = true
+			break
+		}
+	}
+	if !hasIdentity {
+		anomalies = append(anomalies, "no user ID matches the address")
+	}
+
+	now := time.Now()
+	if len(e.Revocations) > 0 {
+		anomalies = append(anomalies, "key is revoked")
+	}
+	if i := primaryIdentity(e); i != nil {
+		if e.PrimaryKey.KeyExpired(i.SelfSignature, now) {
+			anomalies = append(anomalies, "key has expired")
+		}
+		if i.SelfSignature.FlagsValid && !i.SelfSignature.FlagCertify {
+			anomalies = append(anomalies, "primary key isn't allowed to certify")
+		}
+	}
+	if key.Flags&PrivateKeyEncrypt != 0 {
+		if _, ok := encryptionKey(e, now); !ok {
+			anomalies = append(anomalies, "no valid encryption key")
+		}
+	}
+	if key.Flags&PrivateKeyVerify != 0 {
+		if _, ok := signingKey(e, now); !ok {
+			anomalies = append(anomalies, "no valid signing key")
+		}
+	}
+
+	if len(anomalies) > 0 {
+		return errors.New(strings.Join(anomalies, ", "))
+	}
+	return nil
+}
+
+// GenerateKey generates a new unencrypted key pair.
+func GenerateKey(name, email string) (*openpgp.Entity, error) {
+	config := &packet.Config{RSABits: 2048}
+	return openpgp.NewEntity(name, "", email, config)
+}
+
+func lockKey(e *openpgp.Entity, passphrase []byte) error {
+	if e.PrivateKey != nil && !e.PrivateKey.Encrypted {
+		if err := e.PrivateKey.Encrypt(passphrase); err != nil {
+			return err
+		}
+	}
+	for _, subkey := range e.Subkeys {
+		if subkey.PrivateKey != nil && !subkey.PrivateKey.Encrypted {
+			if err := subkey.PrivateKey.Encrypt(passphrase); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SerializePrivateKey writes a decrypted private key, encrypting it with the
+// provided passphrase. If passphrase is nil, the key is left unencrypted. e
+// isn't modified.
+func SerializePrivateKey(w io.Writer, e *openpgp.Entity, passphrase []byte) error {
+	if passphrase == nil {
+		return e.SerializePrivateWithoutSigning(w, nil)
+	}
+
+	var b bytes.Buffer
+	if err := e.SerializePrivateWithoutSigning(&b, nil); err != nil {
+		return err
+	}
+	copied, err := openpgp.ReadEntity(packet.NewReader(&b))
+	if err != nil {
+		return err
+	}
+	if err := lockKey(copied, passphrase); err != nil {
+		return err
+	}
+	return copied.SerializePrivateWithoutSigning(w, nil)
+}
+
+// ArmorPrivateKey is like SerializePrivateKey, but returns an armored key.
+func ArmorPrivateKey(e *openpgp.Entity, passphrase []byte) (string, error) {
+	var armored bytes.Buffer
+	w, err := armor.Encode(&armored, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		return "", err
+	}
+	if err := SerializePrivateKey(w, e, passphrase); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return armored.String(), nil
+}
+
+type signedKeyListItem struct {
+	Fingerprint string
+	Primary     int
+	Flags       PrivateKeyFlags
+}
+
+type signedKeyList struct {
+	Data      string
+	Signature string
+}
+
+func keyFingerprint(e *openpgp.Entity) string {
+	return fmt.Sprintf("%x", e.PrimaryKey.Fingerprint)
+}
+
+// signKeyList lists the keys of an address, with an additional key if added
+// isn't nil, and signs the list with the key whose fingerprint is primary.
+// Recipients use the list to check that the server hasn't substituted keys.
+func (c *Client) signKeyList(addr *Address, added *openpgp.Entity, primary string) (*signedKeyList, error) {
+	var items []signedKeyListItem
+	signer := added
+	for _, key := range addr.Keys {
+		item := signedKeyListItem{
+			Fingerprint: strings.ToLower(key.Fingerprint),
+			Flags:       key.Flags,
+		}
+		if strings.EqualFold(key.Fingerprint, primary) {
+			item.Primary = 1
+			signer = c.findUnlockedKey(key.Fingerprint)
+		}
+		items = append(items, item)
+	}
+	if added != nil {
+		item := signedKeyListItem{
+			Fingerprint: keyFingerprint(added),
+			Flags:       PrivateKeyVerify | PrivateKeyEncrypt,
+		}
+		if item.Fingerprint == strings.ToLower(primary) {
+			item.Primary = 1
+			signer = added
+		}
+		items = append(items, item)
+	}
+	if signer == nil {
+		return nil, fmt.Errorf("cannot sign key list: primary key %v isn't unlocked", primary)
+	}
+
+	keyList, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+	var sig bytes.Buffer
+	if err := openpgp.ArmoredDetachSignText(&sig, signer, bytes.NewReader(keyList), nil); err != nil {
+		return nil, err
+	}
+	return &signedKeyList{string(keyList), sig.String()}, nil
+}
+
+var errNoSignedKeyList = errors.New("address has no signed key list")
+
+// verifyAddressKeys checks that the signed key list of an address lists
+// exactly the keys of the address, with the same flags, and that it's signed by
+// its primary key. Only the public parts of the keys are needed, so keys are
+// verified before being unlocked: the server could otherwise have added a key
+// of its own. errNoSignedKeyList is returned if the address has no list.
+func verifyAddressKeys(addr *Address) error {
+	skl := addr.SignedKeyList
+	if skl == nil {
+		return errNoSignedKeyList
+	}
+
+	keyRing := make(openpgp.EntityList, 0, len(addr.Keys))
+	for _, key := range addr.Keys {
+		e, err := key.Entity()
+		if err != nil {
+			return fmt.Errorf("cannot read key %v: %v", key.ID, err)
+		}
+		keyRing = append(keyRing, e)
+	}
+	if err := verifySignedKeyList(skl, keyRing); err != nil {
+		return err
+	}
+
+	var items []signedKeyListItem
+	if err := json.Unmarshal([]byte(skl.Data), &items); err != nil {
+		return fmt.Errorf("invalid signed key list: %v", err)
+	}
+	listed := make(map[string]PrivateKeyFlags, len(items))
+	for _, item := range items {
+		listed[strings.ToLower(item.Fingerprint)] = item.Flags
+	}
+	for i, e := range keyRing {
+		fingerprint := keyFingerprint(e)
+		if flags := addr.Keys[i].Flags; listed[fingerprint] != flags {
+			return fmt.Errorf("key %v has flags %v, but %v in the signed key list", fingerprint, flags, listed[fingerprint])
+		}
+	}
+	return nil
+}
+
+// primaryKeyFingerprint returns the fingerprint of the primary key of an
+// address, or an empty string if it has no key.
+func primaryKeyFingerprint(addr *Address) string {
+	for _, key := range addr.Keys {
+		if key.Primary == 1 {
+			return key.Fingerprint
+		}
+	}
+	return ""
+}
+
+// CreateAddressKey generates a new key for an address and uploads it. The key
+// is encrypted with the same passphrase as the keys unlocked by Unlock.
+func (c *Client) CreateAddressKey(ctx context.Context, addr *Address, primary bool) (*PrivateKey, *openpgp.Entity, error) {
+	if !c.unlocked() {
+		return nil, nil, errors.New("cannot create address key: client is not unlocked")
+	}
+
+	e, err := GenerateKey(addr.DisplayName, addr.Email)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := c.ImportAddressKey(ctx, addr, e, primary)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, e, nil
+}
+
+// ImportAddressKey uploads an existing decrypted key for an address, encrypted
+// with the same passphrase as the keys unlocked by Unlock. The key must have
+// a user ID for the address. The first key of an address is always primary.
+func (c *Client) ImportAddressKey(ctx context.Context, addr *Address, e *openpgp.Entity, primary bool) (*PrivateKey, error) {
+	passphrase := c.passphrase()
+	if passphrase == nil {
+		return nil, errors.New("cannot import address key: client is not unlocked")
+	}
+	defer wipe(passphrase)
+
+	hasIdentity := false
+	for _, ident := range e.Identities {
+		if strings.EqualFold(ident.UserId.Email, addr.Email) {
+			hasIdentity = true
+			break
+		}
+	}
+	if !hasIdentity {
+		return nil, fmt.Errorf("key has no user ID for %v", addr.Email)
+	}
+
+	armored, err := ArmorPrivateKey(e, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	primaryFingerprint := primaryKeyFingerprint(addr)
+	if primary || primaryFingerprint == "" {
+		primaryFingerprint = keyFingerprint(e)
+	}
+	keyList, err := c.signKeyList(addr, e, primaryFingerprint)
+	if err != nil {
+		return nil, err
+	}
+
+	reqData := struct {
+		AddressID     string
+		PrivateKey    string
+		Primary       int
+		SignedKeyList *signedKeyList
+	}{
+		AddressID:     addr.ID,
+		PrivateKey:    armored,
+		SignedKeyList: keyList,
+	}
+	if primaryFingerprint == keyFingerprint(e) {
+		reqData.Primary = 1
+	}
+	req, err := c.newJSONRequest(ctx, http.MethodPost, "/keys", &reqData)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Key *PrivateKey
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	c.addUnlockedKey(e)
+	return respData.Key, nil
+}
+
+// MakeAddressKeyPrimary makes a key the primary key of its address, used to
+// encrypt and sign new messages.
+func (c *Client) MakeAddressKeyPrimary(ctx context.Context, addr *Address, keyID string) error {
+	var key *PrivateKey
+	for _, k := range addr.Keys {
+		if k.ID == keyID {
+			key = k
+		}
+	}
+	if key == nil {
+		return fmt.Errorf("key %v doesn't belong to %v", keyID, addr.Email)
+	}
+
+	keyList, err := c.signKeyList(addr, nil, key.Fingerprint)
+	if err != nil {
+		return err
+	}
+
+	reqData := struct {
+		SignedKeyList *signedKeyList
+	}{keyList}
+	req, err := c.newJSONRequest(ctx, http.MethodPut, "/keys/"+keyID+"/primary", &reqData)
+	if err != nil {
+		return err
+	}
+
+	var respData resp
+	return c.doJSON(req, &respData)
+}
+
+// UnlockAddress decrypts the keys of an address which has been created after
+// the client has been unlocked.
+//
+// Keys which are already unlocked aren't unlocked again, the existing
+// entities are returned instead. It's safe to call UnlockAddress from several
+// goroutines.
+func (c *Client) UnlockAddress(addr *Address) (openpgp.EntityList, error) {
+	passphrase := c.passphrase()
+	if passphrase == nil {
+		return nil, errors.New("cannot unlock address: client is not unlocked")
+	}
+	defer wipe(passphrase)
+
+	if err := verifyAddressKeys(addr); err == errNoSignedKeyList {
+		logger.Warn("cannot verify keys", "address", addr.Email, "error", err)
+	} else if err != nil {
+		return nil, fmt.Errorf("refusing keys of %q: %v", addr.Email, err)
+	}
+
+	var keyRing openpgp.EntityList
+	for _, key := range addr.Keys {
+		e, err := key.Entity()
+		if err != nil {
+			return nil, err
+		}
+		if unlocked := c.findUnlockedKey(keyFingerprint(e)); unlocked != nil {
+			keyRing = append(keyRing, unlocked)
+			continue
+		}
+
+		if err := checkAddressKey(addr.Email, key, e); err != nil {
+			logger.Warn("key looks suspicious", "address", addr.Email, "key_id", e.PrimaryKey.KeyIdString(), "error", err)
+		}
+
+		if err := unlockKey(e, passphrase); err != nil {
+			return nil, fmt.Errorf("failed to unlock key %q %v: %v", addr.Email, e.PrimaryKey.KeyIdString(), err)
+		}
+		keyRing = append(keyRing, e)
+	}
+
+	for i, e := range keyRing {
+		keyRing[i] = c.addUnlockedKey(e)
+	}
+	return keyRing, nil
+}
+
+// unlocked checks whether the client has been unlocked.
+func (c *Client) unlocked() bool {
+	c.keyLocker.Lock()
+	defer c.keyLocker.Unlock()
+	return c.keyPassphrase != nil
+}
+
+// passphrase returns a copy of the passphrase of the keys unlocked by Unlock,
+// or nil if the client isn't unlocked. The copy should be wiped once used.
+func (c *Client) passphrase() []byte {
+	c.keyLocker.Lock()
+	defer c.keyLocker.Unlock()
+	if c.keyPassphrase == nil {
+		return nil
+	}
+	return append([]byte(nil), c.keyPassphrase...)
+}
+
+// addUnlockedKey adds a key to the key ring, unless a key with the same
+// fingerprint is already in it. It returns the key in the key ring.
+func (c *Client) addUnlockedKey(e *openpgp.Entity) *openpgp.Entity {
+	c.keyLocker.Lock()
+	defer c.keyLocker.Unlock()
+	for _, existing := range c.keyRing {
+		if existing.PrimaryKey.Fingerprint == e.PrimaryKey.Fingerprint {
+			return existing
+		}
+	}
+	c.keyRing = append(c.keyRing, e)
+	return e
+}
+
+// wipe overwrites a secret with zeroes.
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
 type RecipientType int
 
 const (
@@ -49,6 +473,7 @@ type PublicKeyResp struct {
 	RecipientType RecipientType
 	MIMEType      string
 	Keys          []*PublicKey
+	SignedKeyList *SignedKeyList
 }
 
 type PublicKey struct {
@@ -68,12 +493,12 @@ func (pub *PublicKey) Entity() (*openpgp.Entity, error) {
 }
 
 // GetPublicKeys retrieves public keys for a user.
-func (c *Client) GetPublicKeys(email string) (*PublicKeyResp, error) {
+func (c *Client) GetPublicKeys(ctx context.Context, email string) (*PublicKeyResp, error) {
 	v := url.Values{}
-	v.Set("Email", email)
+	v.Set("Email", ASCIIAddress(email))
 	// TODO: Fingerprint
 
-	req, err := c.newRequest(http.MethodGet, "/keys?"+v.Encode(), nil)
+	req, err := c.newRequest(ctx, http.MethodGet, "/keys?"+v.Encode(), nil)
 	if err != nil {
 		return nil, err
 	}
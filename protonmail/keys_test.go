@@ -0,0 +1,189 @@
+package protonmail
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+func newSignedKeyList(t *testing.T, signer *openpgp.Entity, items []signedKeyListItem) *SignedKeyList {
+	data, err := json.Marshal(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sig bytes.Buffer
+	if err := openpgp.ArmoredDetachSignText(&sig, signer, bytes.NewReader(data), nil); err != nil {
+		t.Fatal(err)
+	}
+	return &SignedKeyList{Data: string(data), Signature: sig.String()}
+}
+
+func TestVerifyAddressKeys(t *testing.T) {
+	passphrase := []byte("passphrase")
+	newKey := func(name string, flags PrivateKeyFlags) (*openpgp.Entity, *PrivateKey) {
+		e, err := GenerateKey(name, "alice@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		armored, err := ArmorPrivateKey(e, passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e, &PrivateKey{PrivateKey: armored, Fingerprint: keyFingerprint(e), Flags: flags}
+	}
+
+	const flags = PrivateKeyVerify | PrivateKeyEncrypt
+	primary, primaryKey := newKey("Alice", flags)
+	other, otherKey := newKey("Alice", flags)
+	forged, forgedKey := newKey("Mallory", flags)
+	items := []signedKeyListItem{
+		{Fingerprint: keyFingerprint(primary), Primary: 1, Flags: flags},
+		{Fingerprint: keyFingerprint(other), Flags: flags},
+	}
+
+	tests := []struct {
+		name string
+		skl  *SignedKeyList
+		keys []*PrivateKey
+		err  bool
+	}{
+		{
+			name: "valid",
+			skl:  newSignedKeyList(t, primary, items),
+			keys: []*PrivateKey{primaryKey, otherKey},
+		},
+		{
+			name: "listed key missing",
+			skl:  newSignedKeyList(t, primary, items),
+			keys: []*PrivateKey{primaryKey},
+			err:  true,
+		},
+		{
+			name: "primary key missing",
+			skl:  newSignedKeyList(t, primary, items),
+			keys: []*PrivateKey{otherKey},
+			err:  true,
+		},
+		{
+			name: "key not listed",
+			skl:  newSignedKeyList(t, primary, items[:1]),
+			keys: []*PrivateKey{primaryKey, otherKey},
+			err:  true,
+		},
+		{
+			name: "key added by the server",
+			skl:  newSignedKeyList(t, primary, items),
+			keys: []*PrivateKey{primaryKey, otherKey, forgedKey},
+			err:  true,
+		},
+		{
+			name: "flags changed",
+			skl:  newSignedKeyList(t, primary, items),
+			keys: []*PrivateKey{primaryKey, {PrivateKey: otherKey.PrivateKey, Flags: PrivateKeyEncrypt}},
+			err:  true,
+		},
+		{
+			name: "not signed by the primary key",
+			skl:  newSignedKeyList(t, other, items),
+			keys: []*PrivateKey{primaryKey, otherKey},
+			err:  true,
+		},
+		{
+			name: "forged list",
+			skl: newSignedKeyList(t, forged, []signedKeyListItem{
+				{Fingerprint: keyFingerprint(forged), Primary: 1, Flags: flags},
+				{Fingerprint: keyFingerprint(other), Flags: flags},
+			}),
+			keys: []*PrivateKey{primaryKey, otherKey},
+			err:  true,
+		},
+		{
+			name: "unreadable key",
+			skl:  newSignedKeyList(t, primary, items),
+			keys: []*PrivateKey{primaryKey, {PrivateKey: "garbage", Flags: flags}},
+			err:  true,
+		},
+	}
+	for _, tc := range tests {
+		addr := &Address{Email: "alice@example.org", Keys: tc.keys, SignedKeyList: tc.skl}
+		err := verifyAddressKeys(addr)
+		if tc.err && err == nil {
+			t.Errorf("%v: verifyAddressKeys() succeeded", tc.name)
+		} else if !tc.err && err != nil {
+			t.Errorf("%v: verifyAddressKeys() = %v", tc.name, err)
+		}
+	}
+
+	addr := &Address{Keys: []*PrivateKey{primaryKey, otherKey}}
+	if err := verifyAddressKeys(addr); err != errNoSignedKeyList {
+		t.Errorf("verifyAddressKeys() without a signed key list = %v, want errNoSignedKeyList", err)
+	}
+}
+
+func TestUnlockAddress(t *testing.T) {
+	passphrase := []byte("passphrase")
+
+	e, err := GenerateKey("Alice", "alice@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	armored, err := ArmorPrivateKey(e, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := &Address{
+		Email: "alice@example.org",
+		Keys:  []*PrivateKey{{ID: "key", PrivateKey: armored, Fingerprint: keyFingerprint(e)}},
+	}
+
+	tests := []struct {
+		name       string
+		passphrase []byte
+		calls      int
+		err        bool
+	}{
+		{name: "single", passphrase: passphrase, calls: 1},
+		{name: "concurrent", passphrase: passphrase, calls: 8},
+		{name: "wrong passphrase", passphrase: []byte("wrong"), calls: 1, err: true},
+		{name: "locked", passphrase: nil, calls: 1, err: true},
+	}
+	for _, tc := range tests {
+		c := &Client{keyPassphrase: tc.passphrase}
+
+		var wg sync.WaitGroup
+		errs := make([]error, tc.calls)
+		for i := 0; i < tc.calls; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, errs[i] = c.UnlockAddress(addr)
+			}(i)
+		}
+		wg.Wait()
+
+		for _, err := range errs {
+			if tc.err && err == nil {
+				t.Errorf("%v: UnlockAddress() succeeded", tc.name)
+			} else if !tc.err && err != nil {
+				t.Errorf("%v: UnlockAddress() = %v", tc.name, err)
+			}
+		}
+		if tc.err {
+			continue
+		}
+
+		if len(c.keyRing) != 1 {
+			t.Errorf("%v: key ring has %v keys, want 1", tc.name, len(c.keyRing))
+		}
+		keys, err := c.UnlockAddress(addr)
+		if err != nil || len(keys) != 1 || keys[0] != c.keyRing[0] {
+			t.Errorf("%v: UnlockAddress() didn't return the unlocked key", tc.name)
+		}
+		if string(c.keyPassphrase) != string(tc.passphrase) {
+			t.Errorf("%v: passphrase has been modified", tc.name)
+		}
+	}
+}
@@ -0,0 +1,476 @@
+package protonmail
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// Key transparency (KT) lets clients check that the public keys returned by
+// the API are the ones everyone else gets, and haven't been substituted for a
+// single client. The signed key list of each address is stored in a sparse
+// Merkle tree, at a position derived from the address with a VRF. The root of
+// the tree is published at regular intervals, called epochs: the hash of each
+// epoch is chained with the previous one and embedded in the names of a TLS
+// certificate, which makes it public through Certificate Transparency.
+
+const (
+	// ktCertDomain is the domain of the names of epoch certificates
+	ktCertDomain = ".keytransparency.ch"
+	ktTreeDepth  = 256
+	// ktMaxChainLength is the maximum number of epochs downloaded to check
+	// that an epoch is chained with the checkpoint
+	ktMaxChainLength = 1000
+)
+
+// SignedKeyList is the list of the keys of an address, signed by its primary
+// key. Data is a JSON array of {Fingerprint, Primary, Flags} objects.
+type SignedKeyList struct {
+	// First and last epochs including this list, nil if it hasn't been
+	// included yet
+	MinEpochID         *int
+	MaxEpochID         *int
+	ExpectedMinEpochID *int
+	Data               string
+	Signature          string
+	// Set if the address has been deleted or its keys disabled
+	ObsolescenceToken *string
+	Revision          int
+}
+
+// KTCheckpoint is an epoch verified by the client. Later epochs are only
+// accepted if their chain continues from it, so that the server can't present
+// a forked history to a client which has already seen the actual one.
+type KTCheckpoint struct {
+	EpochID   int
+	ChainHash string // hex
+}
+
+type KTEpoch struct {
+	EpochID           int
+	TreeHash          string // hex
+	ChainHash         string // hex
+	PrevChainHash     string // hex, empty for the first epoch
+	Certificate       string // PEM chain
+	CertificateIssuer int
+	CertificateTime   Timestamp
+}
+
+type KTProofType int
+
+const (
+	KTProofAbsent KTProofType = iota
+	KTProofExistent
+	KTProofObsolete
+)
+
+type KTProof struct {
+	Type KTProofType
+	// VRF proof of the position of the address in the tree, hex
+	Proof string
+	// Hashes of the siblings of the nodes on the path from the leaf to the
+	// root, from the root down, hex. Nil for empty subtrees.
+	Neighbors         []*string
+	Revision          int
+	ObsolescenceToken *string
+}
+
+var (
+	ktEpochsLocker sync.Mutex
+	// Verified epochs, indexed by Client.RootURL then by epoch ID
+	ktEpochs = make(map[string]map[int]*KTEpoch)
+	// Most recent verified epochs, indexed by Client.RootURL
+	ktCheckpoints = make(map[string]*KTCheckpoint)
+)
+
+func (c *Client) GetKTEpoch(ctx context.Context, id int) (*KTEpoch, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/kt/v1/epochs/"+strconv.Itoa(id), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		*KTEpoch
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.KTEpoch, nil
+}
+
+// GetKTProof retrieves the proof of the revision of the signed key list of an
+// address in an epoch.
+func (c *Client) GetKTProof(ctx context.Context, epochID int, email string, revision int) (*KTProof, error) {
+	path := fmt.Sprintf("/kt/v1/epochs/%v/proof/%v/%v", epochID, url.PathEscape(ASCIIAddress(email)), revision)
+	req, err := c.newRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		*KTProof
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.KTProof, nil
+}
+
+// ktCheckpoint returns the most recent epoch verified by the client, or nil.
+// The caller must hold ktEpochsLocker.
+func (c *Client) ktCheckpoint() *KTCheckpoint {
+	cp := ktCheckpoints[c.RootURL]
+	if cp == nil || (c.KTCheckpoint != nil && c.KTCheckpoint.EpochID > cp.EpochID) {
+		cp = c.KTCheckpoint
+	}
+	return cp
+}
+
+// fetchKTEpoch fetches an epoch and checks its certificate.
+func (c *Client) fetchKTEpoch(ctx context.Context, id int) (*KTEpoch, error) {
+	ktEpochsLocker.Lock()
+	epoch := ktEpochs[c.RootURL][id]
+	ktEpochsLocker.Unlock()
+	if epoch != nil {
+		return epoch, nil
+	}
+
+	epoch, err := c.GetKTEpoch(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if epoch.EpochID != id {
+		return nil, fmt.Errorf("got epoch %v instead of %v", epoch.EpochID, id)
+	}
+	if err := verifyKTEpoch(epoch); err != nil {
+		return nil, fmt.Errorf("epoch %v: %v", id, err)
+	}
+	return epoch, nil
+}
+
+// verifiedKTEpoch fetches an epoch, checks its certificate and checks that
+// it's chained with the checkpoint. The first epoch verified without a
+// checkpoint becomes the checkpoint, and so do more recent epochs.
+func (c *Client) verifiedKTEpoch(ctx context.Context, id int) (*KTEpoch, error) {
+	ktEpochsLocker.Lock()
+	epoch := ktEpochs[c.RootURL][id]
+	cp := c.ktCheckpoint()
+	ktEpochsLocker.Unlock()
+	if epoch != nil {
+		return epoch, nil
+	}
+
+	epochs := make(map[int]*KTEpoch)
+	if cp == nil {
+		epoch, err := c.fetchKTEpoch(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		epochs[id] = epoch
+	} else {
+		from, to := id, cp.EpochID
+		if from > to {
+			from, to = to, from
+		}
+		if to-from >= ktMaxChainLength {
+			return nil, fmt.Errorf("epoch %v is too far from the last verified epoch %v", id, cp.EpochID)
+		}
+
+		chain := make([]*KTEpoch, 0, to-from+1)
+		for i := from; i <= to; i++ {
+			epoch, err := c.fetchKTEpoch(ctx, i)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, epoch)
+			epochs[i] = epoch
+		}
+		if err := verifyKTChain(chain, cp); err != nil {
+			return nil, err
+		}
+	}
+	epoch = epochs[id]
+
+	ktEpochsLocker.Lock()
+	if ktEpochs[c.RootURL] == nil {
+		ktEpochs[c.RootURL] = make(map[int]*KTEpoch)
+	}
+	for i, e := range epochs {
+		ktEpochs[c.RootURL][i] = e
+	}
+	var updated *KTCheckpoint
+	if cp := c.ktCheckpoint(); cp == nil || id > cp.EpochID {
+		updated = &KTCheckpoint{EpochID: id, ChainHash: epoch.ChainHash}
+		ktCheckpoints[c.RootURL] = updated
+	}
+	ktEpochsLocker.Unlock()
+
+	if updated != nil && c.KTCheckpointUpdated != nil {
+		c.KTCheckpointUpdated(updated)
+	}
+	return epoch, nil
+}
+
+// verifyKTChain checks that consecutive epochs are chained with each other,
+// and that the chain includes the checkpoint. Epochs must have been checked
+// with verifyKTEpoch: their chain hash is then derived from the previous one.
+func verifyKTChain(epochs []*KTEpoch, cp *KTCheckpoint) error {
+	found := false
+	for i, epoch := range epochs {
+		if i > 0 {
+			prev := epochs[i-1]
+			if epoch.EpochID != prev.EpochID+1 {
+				return fmt.Errorf("epoch %v doesn't follow epoch %v", epoch.EpochID, prev.EpochID)
+			}
+			if !strings.EqualFold(epoch.PrevChainHash, prev.ChainHash) {
+				return fmt.Errorf("epoch %v isn't chained with epoch %v", epoch.EpochID, prev.EpochID)
+			}
+		}
+		if epoch.EpochID == cp.EpochID {
+			if !strings.EqualFold(epoch.ChainHash, cp.ChainHash) {
+				return fmt.Errorf("epoch %v doesn't match the last verified epoch", epoch.EpochID)
+			}
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("chain doesn't include the last verified epoch %v", cp.EpochID)
+	}
+	return nil
+}
+
+// verifyKTEpoch checks that the chain hash of an epoch is consistent with its
+// tree hash, and that it's certified.
+func verifyKTEpoch(epoch *KTEpoch) error {
+	treeHash, err := hex.DecodeString(epoch.TreeHash)
+	if err != nil || len(treeHash) != sha256.Size {
+		return errors.New("invalid tree hash")
+	}
+	prevChainHash, err := hex.DecodeString(epoch.PrevChainHash)
+	if err != nil {
+		return errors.New("invalid previous chain hash")
+	}
+	chainHash := sha256.Sum256(append(prevChainHash, treeHash...))
+	if !strings.EqualFold(hex.EncodeToString(chainHash[:]), epoch.ChainHash) {
+		return errors.New("chain hash doesn't match tree hash")
+	}
+
+	var certs []*x509.Certificate
+	rest := []byte(epoch.Certificate)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("invalid certificate: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return errors.New("missing certificate")
+	}
+
+	// The certificate must have a name containing the chain hash, e.g.
+	// <hash[:32]>.<hash[32:]>.<epoch>.<version>.keytransparency.ch
+	ch := hex.EncodeToString(chainHash[:])
+	prefix := fmt.Sprintf("%v.%v.%v.", ch[:32], ch[32:], epoch.EpochID)
+	var name string
+	for _, n := range certs[0].DNSNames {
+		n = strings.ToLower(n)
+		if strings.HasPrefix(n, prefix) && strings.HasSuffix(n, ktCertDomain) {
+			name = n
+			break
+		}
+	}
+	if name == "" {
+		return errors.New("certificate doesn't contain the chain hash")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	// Certificates of old epochs have expired, check them as of their
+	// issuance
+	_, err = certs[0].Verify(x509.VerifyOptions{
+		DNSName:       name,
+		Intermediates: intermediates,
+		CurrentTime:   certs[0].NotBefore,
+	})
+	if err != nil {
+		return fmt.Errorf("invalid certificate: %v", err)
+	}
+	return nil
+}
+
+// verifySignedKeyList checks that a signed key list lists exactly the given
+// keys, and is signed by its primary key.
+func verifySignedKeyList(skl *SignedKeyList, keys openpgp.EntityList) error {
+	var items []signedKeyListItem
+	if err := json.Unmarshal([]byte(skl.Data), &items); err != nil {
+		return fmt.Errorf("invalid signed key list: %v", err)
+	}
+
+	listed := make(map[string]bool)
+	var primary openpgp.EntityList
+	for _, item := range items {
+		fingerprint := strings.ToLower(item.Fingerprint)
+		listed[fingerprint] = true
+		if item.Primary != 1 {
+			continue
+		}
+		for _, e := range keys {
+			if keyFingerprint(e) == fingerprint {
+				primary = append(primary, e)
+			}
+		}
+	}
+	if len(listed) != len(keys) {
+		return fmt.Errorf("signed key list has %v keys, %v returned", len(listed), len(keys))
+	}
+	for _, e := range keys {
+		if !listed[keyFingerprint(e)] {
+			return fmt.Errorf("key %v isn't in the signed key list", keyFingerprint(e))
+		}
+	}
+	if len(primary) != 1 {
+		return errors.New("signed key list has no primary key")
+	}
+
+	_, err := openpgp.CheckArmoredDetachedSignature(primary, strings.NewReader(skl.Data), strings.NewReader(skl.Signature), nil)
+	if err != nil {
+		return fmt.Errorf("invalid signed key list signature: %v", err)
+	}
+	return nil
+}
+
+// ktLeaf computes the value of the leaf of a revision of a signed key list.
+func ktLeaf(skl *SignedKeyList) []byte {
+	dataHash := sha256.Sum256([]byte(skl.Data))
+	var revision [4]byte
+	binary.BigEndian.PutUint32(revision[:], uint32(skl.Revision))
+	leaf := sha256.Sum256(append(dataHash[:], revision[:]...))
+	return leaf[:]
+}
+
+// verifyKTProof checks that a signed key list is included in the tree of an
+// epoch, at the position given by the VRF for email. Without vrfKey, the
+// position can't be checked and the proof is rejected.
+func verifyKTProof(proof *KTProof, epoch *KTEpoch, email string, skl *SignedKeyList, vrfKey []byte) error {
+	if proof.Type != KTProofExistent {
+		return fmt.Errorf("signed key list isn't in the tree (proof type %v)", proof.Type)
+	}
+	if proof.Revision != skl.Revision {
+		return fmt.Errorf("proof is for revision %v instead of %v", proof.Revision, skl.Revision)
+	}
+
+	if len(vrfKey) == 0 {
+		// Trusting the position returned by the API would let it serve a
+		// different tree leaf to each client
+		return errors.New("no VRF public key to verify the proof with")
+	}
+	vrfProof, err := hex.DecodeString(proof.Proof)
+	if err != nil {
+		return errors.New("invalid VRF proof")
+	}
+	alpha := []byte(strings.ToLower(ASCIIAddress(email)))
+	vrfOutput, err := vrfVerify(vrfKey, alpha, vrfProof)
+	if err != nil {
+		return err
+	}
+	position := vrfOutput[:ktTreeDepth/8]
+
+	if len(proof.Neighbors) != ktTreeDepth {
+		return fmt.Errorf("proof has %v neighbors instead of %v", len(proof.Neighbors), ktTreeDepth)
+	}
+	h := ktLeaf(skl)
+	empty := make([]byte, sha256.Size)
+	for i := ktTreeDepth - 1; i >= 0; i-- {
+		neighbor := empty
+		if proof.Neighbors[i] != nil {
+			neighbor, err = hex.DecodeString(*proof.Neighbors[i])
+			if err != nil || len(neighbor) != sha256.Size {
+				return errors.New("invalid proof neighbor")
+			}
+		}
+
+		var node [2 * sha256.Size]byte
+		if position[i/8]&(0x80>>uint(i%8)) != 0 {
+			copy(node[:], neighbor)
+			copy(node[sha256.Size:], h)
+		} else {
+			copy(node[:], h)
+			copy(node[sha256.Size:], neighbor)
+		}
+		sum := sha256.Sum256(node[:])
+		h = sum[:]
+	}
+
+	treeHash, _ := hex.DecodeString(epoch.TreeHash)
+	if subtle.ConstantTimeCompare(h, treeHash) != 1 {
+		return errors.New("proof doesn't match the tree hash")
+	}
+	return nil
+}
+
+// VerifyKeyTransparency checks that the public keys of an internal address
+// are the ones published in the key transparency tree. Keys of external
+// addresses aren't published, and are left unchecked.
+func (c *Client) VerifyKeyTransparency(ctx context.Context, email string, resp *PublicKeyResp) error {
+	if resp.RecipientType != RecipientInternal || len(resp.Keys) == 0 {
+		return nil
+	}
+
+	skl := resp.SignedKeyList
+	if skl == nil {
+		return errors.New("no signed key list")
+	}
+	if skl.ObsolescenceToken != nil {
+		return errors.New("signed key list is obsolete")
+	}
+	var keys openpgp.EntityList
+	for _, pub := range resp.Keys {
+		e, err := pub.Entity()
+		if err != nil {
+			return err
+		}
+		keys = append(keys, e)
+	}
+	if err := verifySignedKeyList(skl, keys); err != nil {
+		return err
+	}
+	if skl.MaxEpochID == nil {
+		return errors.New("signed key list hasn't been included in an epoch yet")
+	}
+
+	epoch, err := c.verifiedKTEpoch(ctx, *skl.MaxEpochID)
+	if err != nil {
+		return err
+	}
+	proof, err := c.GetKTProof(ctx, epoch.EpochID, email, skl.Revision)
+	if err != nil {
+		return err
+	}
+	return verifyKTProof(proof, epoch, email, skl, c.KTVRFPublicKey)
+}
@@ -0,0 +1,70 @@
+package protonmail
+
+import (
+	"testing"
+)
+
+func TestVerifyKTChain(t *testing.T) {
+	epochs := []*KTEpoch{
+		{EpochID: 10, PrevChainHash: "09", ChainHash: "0a"},
+		{EpochID: 11, PrevChainHash: "0a", ChainHash: "0b"},
+		{EpochID: 12, PrevChainHash: "0b", ChainHash: "0c"},
+	}
+	forked := &KTEpoch{EpochID: 11, PrevChainHash: "ff", ChainHash: "1b"}
+	gap := &KTEpoch{EpochID: 13, PrevChainHash: "0b", ChainHash: "0d"}
+
+	tests := []struct {
+		name   string
+		epochs []*KTEpoch
+		cp     *KTCheckpoint
+		err    bool
+	}{
+		{
+			name:   "checkpoint is the epoch",
+			epochs: epochs[:1],
+			cp:     &KTCheckpoint{EpochID: 10, ChainHash: "0A"},
+		},
+		{
+			name:   "newer epoch",
+			epochs: epochs,
+			cp:     &KTCheckpoint{EpochID: 10, ChainHash: "0a"},
+		},
+		{
+			name:   "older epoch",
+			epochs: epochs,
+			cp:     &KTCheckpoint{EpochID: 12, ChainHash: "0c"},
+		},
+		{
+			name:   "checkpoint mismatch",
+			epochs: epochs,
+			cp:     &KTCheckpoint{EpochID: 12, ChainHash: "1c"},
+			err:    true,
+		},
+		{
+			name:   "fork",
+			epochs: []*KTEpoch{epochs[0], forked},
+			cp:     &KTCheckpoint{EpochID: 10, ChainHash: "0a"},
+			err:    true,
+		},
+		{
+			name:   "missing epoch",
+			epochs: []*KTEpoch{epochs[0], epochs[1], gap},
+			cp:     &KTCheckpoint{EpochID: 10, ChainHash: "0a"},
+			err:    true,
+		},
+		{
+			name:   "checkpoint not in the chain",
+			epochs: epochs[1:],
+			cp:     &KTCheckpoint{EpochID: 10, ChainHash: "0a"},
+			err:    true,
+		},
+	}
+	for _, tc := range tests {
+		err := verifyKTChain(tc.epochs, tc.cp)
+		if tc.err && err == nil {
+			t.Errorf("%v: verifyKTChain() succeeded", tc.name)
+		} else if !tc.err && err != nil {
+			t.Errorf("%v: verifyKTChain() = %v", tc.name, err)
+		}
+	}
+}
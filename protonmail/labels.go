@@ -1,20 +1,25 @@
 package protonmail
 
 import (
+	"context"
 	"net/http"
+	"net/url"
+	"strconv"
 )
 
 const (
-	LabelInbox    = "0"
-	LabelAllDraft = "1"
-	LabelAllSent  = "2"
-	LabelTrash    = "3"
-	LabelSpam     = "4"
-	LabelAllMail  = "5"
-	LabelArchive  = "6"
-	LabelSent     = "7"
-	LabelDraft    = "8"
-	LabelStarred  = "10"
+	LabelInbox     = "0"
+	LabelAllDraft  = "1"
+	LabelAllSent   = "2"
+	LabelTrash     = "3"
+	LabelSpam      = "4"
+	LabelAllMail   = "5"
+	LabelArchive   = "6"
+	LabelSent      = "7"
+	LabelDraft     = "8"
+	LabelStarred   = "10"
+	LabelScheduled = "12"
+	LabelSnoozed   = "16"
 )
 
 type LabelType int
@@ -33,10 +38,25 @@ type Label struct {
 	Exclusive int
 	Notify    int
 	Order     int
+	// Folders can be nested: ParentID is the ID of the parent folder, if any
+	ParentID string `json:",omitempty"`
 }
 
-func (c *Client) ListLabels() ([]*Label, error) {
-	req, err := c.newRequest(http.MethodGet, "/labels", nil)
+func (c *Client) ListLabels(ctx context.Context) ([]*Label, error) {
+	return c.listLabels(ctx, LabelMessage)
+}
+
+// ListContactGroups lists contact groups. Contact groups are labels applied to
+// contact e-mail addresses.
+func (c *Client) ListContactGroups(ctx context.Context) ([]*Label, error) {
+	return c.listLabels(ctx, LabelContact)
+}
+
+func (c *Client) listLabels(ctx context.Context, t LabelType) ([]*Label, error) {
+	v := url.Values{}
+	v.Set("Type", strconv.Itoa(int(t)))
+
+	req, err := c.newRequest(ctx, http.MethodGet, "/labels?"+v.Encode(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -51,3 +71,75 @@ func (c *Client) ListLabels() ([]*Label, error) {
 
 	return respData.Labels, nil
 }
+
+// CreateLabel creates a new label. Name, Color and Type are required in label.
+// Folders are labels with Exclusive set to 1.
+func (c *Client) CreateLabel(ctx context.Context, label *Label) (*Label, error) {
+	req, err := c.newJSONRequest(ctx, http.MethodPost, "/labels", label)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Label *Label
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Label, nil
+}
+
+// UpdateLabel updates a label. An empty ParentID moves a folder to the top
+// level.
+func (c *Client) UpdateLabel(ctx context.Context, label *Label) (*Label, error) {
+	body := struct {
+		*Label
+		ParentID *string
+	}{Label: label}
+	if label.ParentID != "" {
+		body.ParentID = &label.ParentID
+	}
+
+	req, err := c.newJSONRequest(ctx, http.MethodPut, "/labels/"+label.ID, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Label *Label
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Label, nil
+}
+
+// DeleteLabel deletes a label. Deleting a folder deletes its subfolders too.
+func (c *Client) DeleteLabel(ctx context.Context, id string) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, "/labels/"+id, nil)
+	if err != nil {
+		return err
+	}
+
+	var respData resp
+	return c.doJSON(req, &respData)
+}
+
+// OrderLabels sets the order in which labels and folders are displayed. ids
+// contains the IDs of all of the user's labels of the same type.
+func (c *Client) OrderLabels(ctx context.Context, ids []string) error {
+	reqData := struct {
+		LabelIDs []string
+	}{ids}
+	req, err := c.newJSONRequest(ctx, http.MethodPut, "/labels/order", &reqData)
+	if err != nil {
+		return err
+	}
+
+	var respData resp
+	return c.doJSON(req, &respData)
+}
@@ -2,6 +2,7 @@ package protonmail
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
 	"io"
@@ -166,7 +167,15 @@ type MessageFilter struct {
 	ExternalID   string
 }
 
-func (c *Client) ListMessages(filter *MessageFilter) (total int, messages []*Message, err error) {
+func formatBoolParam(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// values returns the query parameters of a message or conversation listing.
+func (filter *MessageFilter) values() url.Values {
 	v := url.Values{}
 	if filter.Page != 0 {
 		v.Set("Page", strconv.Itoa(filter.Page))
@@ -186,6 +195,33 @@ func (c *Client) ListMessages(filter *MessageFilter) (total int, messages []*Mes
 	if filter.Asc {
 		v.Set("Desc", "0")
 	}
+	if filter.Begin != 0 {
+		v.Set("Begin", strconv.FormatInt(filter.Begin, 10))
+	}
+	if filter.End != 0 {
+		v.Set("End", strconv.FormatInt(filter.End, 10))
+	}
+	if filter.Keyword != "" {
+		v.Set("Keyword", filter.Keyword)
+	}
+	if filter.To != "" {
+		v.Set("To", filter.To)
+	}
+	if filter.From != "" {
+		v.Set("From", filter.From)
+	}
+	if filter.Subject != "" {
+		v.Set("Subject", filter.Subject)
+	}
+	if filter.Attachments != nil {
+		v.Set("Attachments", formatBoolParam(*filter.Attachments))
+	}
+	if filter.Starred != nil {
+		v.Set("Starred", formatBoolParam(*filter.Starred))
+	}
+	if filter.Unread != nil {
+		v.Set("Unread", formatBoolParam(*filter.Unread))
+	}
 	if filter.Conversation != "" {
 		v.Set("Conversation", filter.Conversation)
 	}
@@ -195,8 +231,11 @@ func (c *Client) ListMessages(filter *MessageFilter) (total int, messages []*Mes
 	if filter.ExternalID != "" {
 		v.Set("ExternalID", filter.ExternalID)
 	}
+	return v
+}
 
-	req, err := c.newRequest(http.MethodGet, "/messages?"+v.Encode(), nil)
+func (c *Client) ListMessages(ctx context.Context, filter *MessageFilter) (total int, messages []*Message, err error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/messages?"+filter.values().Encode(), nil)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -219,12 +258,12 @@ type MessageCount struct {
 	Unread  int
 }
 
-func (c *Client) CountMessages(address string) ([]*MessageCount, error) {
+func (c *Client) CountMessages(ctx context.Context, address string) ([]*MessageCount, error) {
 	v := url.Values{}
 	if address != "" {
 		v.Set("Address", address)
 	}
-	req, err := c.newRequest(http.MethodGet, "/messages/count?"+v.Encode(), nil)
+	req, err := c.newRequest(ctx, http.MethodGet, "/messages/count?"+v.Encode(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -240,8 +279,8 @@ func (c *Client) CountMessages(address string) ([]*MessageCount, error) {
 	return respData.Counts, nil
 }
 
-func (c *Client) GetMessage(id string) (*Message, error) {
-	req, err := c.newRequest(http.MethodGet, "/messages/"+id, nil)
+func (c *Client) GetMessage(ctx context.Context, id string) (*Message, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/messages/"+id, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -258,12 +297,12 @@ func (c *Client) GetMessage(id string) (*Message, error) {
 }
 
 // CreateDraftMessage creates a new draft message. ToList, CCList, BCCList,
-// Subject, Body and AddressID are required in msg.
-func (c *Client) CreateDraftMessage(msg *Message, parentID string) (*Message, error) {
+// Subject, Body and AddressID are required in msg. If parentID isn't empty,
+// the draft is a reply to or a forward of the parent message, depending on
+// action.
+func (c *Client) CreateDraftMessage(ctx context.Context, msg *Message, parentID string, action MessageAction) (*Message, error) {
 	var actionPtr *MessageAction
 	if parentID != "" {
-		// TODO: support other actions
-		action := MessageReply
 		actionPtr = &action
 	}
 
@@ -272,7 +311,7 @@ func (c *Client) CreateDraftMessage(msg *Message, parentID string) (*Message, er
 		ParentID string         `json:",omitempty"`
 		Action   *MessageAction `json:",omitempty"`
 	}{msg, parentID, actionPtr}
-	req, err := c.newJSONRequest(http.MethodPost, "/messages", &reqData)
+	req, err := c.newJSONRequest(ctx, http.MethodPost, "/messages", &reqData)
 	if err != nil {
 		return nil, err
 	}
@@ -288,11 +327,11 @@ func (c *Client) CreateDraftMessage(msg *Message, parentID string) (*Message, er
 	return respData.Message, nil
 }
 
-func (c *Client) UpdateDraftMessage(msg *Message) (*Message, error) {
+func (c *Client) UpdateDraftMessage(ctx context.Context, msg *Message) (*Message, error) {
 	reqData := struct {
 		Message *Message
 	}{msg}
-	req, err := c.newJSONRequest(http.MethodPut, "/messages/"+msg.ID, &reqData)
+	req, err := c.newJSONRequest(ctx, http.MethodPut, "/messages/"+msg.ID, &reqData)
 	if err != nil {
 		return nil, err
 	}
@@ -308,11 +347,11 @@ func (c *Client) UpdateDraftMessage(msg *Message) (*Message, error) {
 	return respData.Message, nil
 }
 
-func (c *Client) doMessages(action string, ids []string) error {
+func (c *Client) doMessages(ctx context.Context, action string, ids []string) error {
 	reqData := struct {
 		IDs []string
 	}{ids}
-	req, err := c.newJSONRequest(http.MethodPut, "/messages/"+action, &reqData)
+	req, err := c.newJSONRequest(ctx, http.MethodPut, "/messages/"+action, &reqData)
 	if err != nil {
 		return err
 	}
@@ -321,28 +360,52 @@ func (c *Client) doMessages(action string, ids []string) error {
 	return c.doJSON(req, nil)
 }
 
-func (c *Client) MarkMessagesRead(ids []string) error {
-	return c.doMessages("read", ids)
+func (c *Client) MarkMessagesRead(ctx context.Context, ids []string) error {
+	return c.doMessages(ctx, "read", ids)
+}
+
+func (c *Client) MarkMessagesUnread(ctx context.Context, ids []string) error {
+	return c.doMessages(ctx, "unread", ids)
+}
+
+func (c *Client) DeleteMessages(ctx context.Context, ids []string) error {
+	return c.doMessages(ctx, "delete", ids)
 }
 
-func (c *Client) MarkMessagesUnread(ids []string) error {
-	return c.doMessages("unread", ids)
+func (c *Client) UndeleteMessages(ctx context.Context, ids []string) error {
+	return c.doMessages(ctx, "undelete", ids)
 }
 
-func (c *Client) DeleteMessages(ids []string) error {
-	return c.doMessages("delete", ids)
+// UnsnoozeMessages moves snoozed messages back to the inbox.
+func (c *Client) UnsnoozeMessages(ctx context.Context, ids []string) error {
+	reqData := struct {
+		IDs []string
+	}{ids}
+	req, err := c.newJSONRequest(ctx, http.MethodPut, "/mail/v4/messages/unsnooze", &reqData)
+	if err != nil {
+		return err
+	}
+
+	return c.doJSON(req, nil)
 }
 
-func (c *Client) UndeleteMessages(ids []string) error {
-	return c.doMessages("undelete", ids)
+// CancelScheduledMessage cancels sending a scheduled message, which is moved
+// back to the drafts.
+func (c *Client) CancelScheduledMessage(ctx context.Context, id string) error {
+	req, err := c.newRequest(ctx, http.MethodPut, "/mail/v4/messages/"+id+"/cancel_send", nil)
+	if err != nil {
+		return err
+	}
+
+	return c.doJSON(req, nil)
 }
 
-func (c *Client) LabelMessages(labelID string, ids []string) error {
+func (c *Client) LabelMessages(ctx context.Context, labelID string, ids []string) error {
 	reqData := struct {
 		LabelID string
 		IDs     []string
 	}{labelID, ids}
-	req, err := c.newJSONRequest(http.MethodPut, "/messages/label", &reqData)
+	req, err := c.newJSONRequest(ctx, http.MethodPut, "/messages/label", &reqData)
 	if err != nil {
 		return err
 	}
@@ -351,12 +414,12 @@ func (c *Client) LabelMessages(labelID string, ids []string) error {
 	return c.doJSON(req, nil)
 }
 
-func (c *Client) UnlabelMessages(labelID string, ids []string) error {
+func (c *Client) UnlabelMessages(ctx context.Context, labelID string, ids []string) error {
 	reqData := struct {
 		LabelID string
 		IDs     []string
 	}{labelID, ids}
-	req, err := c.newJSONRequest(http.MethodPut, "/messages/unlabel", &reqData)
+	req, err := c.newJSONRequest(ctx, http.MethodPut, "/messages/unlabel", &reqData)
 	if err != nil {
 		return err
 	}
@@ -546,6 +609,17 @@ func serializeEncryptedKey(symKey *packet.EncryptedKey, pub *packet.PublicKey, c
 }
 
 func (set *MessagePackageSet) AddInternal(addr string, pub *openpgp.Entity) (*MessagePackage, error) {
+	return set.addEncrypted(addr, pub, MessagePackageInternal)
+}
+
+// AddPGPMIME adds an external recipient which will receive a PGP/MIME
+// message (RFC 3156). The body must be a complete MIME entity, including
+// attachments.
+func (set *MessagePackageSet) AddPGPMIME(addr string, pub *openpgp.Entity) (*MessagePackage, error) {
+	return set.addEncrypted(addr, pub, MessagePackagePGPMIME)
+}
+
+func (set *MessagePackageSet) addEncrypted(addr string, pub *openpgp.Entity, t MessagePackageType) (*MessagePackage, error) {
 	config := &packet.Config{}
 
 	encKey, ok := encryptionKey(pub, config.Now())
@@ -567,9 +641,9 @@ func (set *MessagePackageSet) AddInternal(addr string, pub *openpgp.Entity) (*Me
 		attachmentKeys[att] = attKey
 	}
 
-	set.Type |= MessagePackageInternal
+	set.Type |= t
 	pkg := &MessagePackage{
-		Type:                 MessagePackageInternal,
+		Type:                 t,
 		BodyKeyPacket:        bodyKey,
 		AttachmentKeyPackets: attachmentKeys,
 		Signature:            set.signature,
@@ -583,12 +657,14 @@ type OutgoingMessage struct {
 
 	// Only if message expires
 	ExpirationTime int // Duration in seconds
+	// Only if message is scheduled
+	DeliveryTime int64 `json:",omitempty"` // Unix timestamp
 
 	Packages []*MessagePackageSet
 }
 
-func (c *Client) SendMessage(msg *OutgoingMessage) (sent, parent *Message, err error) {
-	req, err := c.newJSONRequest(http.MethodPost, "/messages/"+msg.ID, msg)
+func (c *Client) SendMessage(ctx context.Context, msg *OutgoingMessage) (sent, parent *Message, err error) {
+	req, err := c.newJSONRequest(ctx, http.MethodPost, "/messages/"+msg.ID, msg)
 	if err != nil {
 		return nil, nil, err
 	}
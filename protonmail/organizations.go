@@ -0,0 +1,316 @@
+package protonmail
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+type Organization struct {
+	Name          string
+	DisplayName   string
+	PlanName      string
+	MaxMembers    int
+	UsedMembers   int
+	MaxAddresses  int
+	UsedAddresses int
+	MaxDomains    int
+	UsedDomains   int
+	MaxSpace      int64
+	AssignedSpace int64
+	UsedSpace     int64
+	HasKeys       int
+}
+
+func (c *Client) GetOrganization(ctx context.Context) (*Organization, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/organizations", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Organization *Organization
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Organization, nil
+}
+
+type OrganizationKeys struct {
+	PublicKey  string
+	PrivateKey string // encrypted with the admin's mailbox password
+}
+
+func (c *Client) GetOrganizationKeys(ctx context.Context) (*OrganizationKeys, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/organizations/keys", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		*OrganizationKeys
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.OrganizationKeys, nil
+}
+
+// Entity decrypts the organization private key with the admin's key
+// passphrase.
+func (keys *OrganizationKeys) Entity(passphrase []byte) (*openpgp.Entity, error) {
+	keyRing, err := openpgp.ReadArmoredKeyRing(strings.NewReader(keys.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	if len(keyRing) == 0 {
+		return nil, errors.New("organization private key is empty")
+	}
+	e := keyRing[0]
+	if err := unlockKey(e, passphrase); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+type MemberRole int
+
+const (
+	MemberRoleMember MemberRole = 1
+	MemberRoleAdmin  MemberRole = 2
+)
+
+type Member struct {
+	ID        string
+	Role      MemberRole
+	Private   int
+	Type      int
+	Name      string
+	MaxSpace  int64
+	UsedSpace int64
+	Self      int
+	Addresses []*Address
+	Keys      []*PrivateKey
+}
+
+func (c *Client) ListMembers(ctx context.Context) ([]*Member, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/members", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Members []*Member
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Members, nil
+}
+
+func (c *Client) GetMember(ctx context.Context, id string) (*Member, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/members/"+id, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Member *Member
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Member, nil
+}
+
+// CreateMember creates a new organization member. If private is true, the
+// organization won't have access to the member's keys.
+func (c *Client) CreateMember(ctx context.Context, name string, maxSpace int64, private bool) (*Member, error) {
+	reqData := struct {
+		Name     string
+		MaxSpace int64
+		Private  int
+	}{Name: name, MaxSpace: maxSpace}
+	if private {
+		reqData.Private = 1
+	}
+	req, err := c.newJSONRequest(ctx, http.MethodPost, "/members", &reqData)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Member *Member
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Member, nil
+}
+
+func (c *Client) updateMember(ctx context.Context, id, field string, reqData interface{}) (*Member, error) {
+	req, err := c.newJSONRequest(ctx, http.MethodPut, "/members/"+id+"/"+field, reqData)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Member *Member
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Member, nil
+}
+
+func (c *Client) UpdateMemberName(ctx context.Context, id, name string) (*Member, error) {
+	return c.updateMember(ctx, id, "name", &struct{ Name string }{name})
+}
+
+func (c *Client) UpdateMemberQuota(ctx context.Context, id string, maxSpace int64) (*Member, error) {
+	return c.updateMember(ctx, id, "quota", &struct{ MaxSpace int64 }{maxSpace})
+}
+
+func (c *Client) UpdateMemberRole(ctx context.Context, id string, role MemberRole) (*Member, error) {
+	return c.updateMember(ctx, id, "role", &struct{ Role MemberRole }{role})
+}
+
+func (c *Client) DeleteMember(ctx context.Context, id string) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, "/members/"+id, nil)
+	if err != nil {
+		return err
+	}
+
+	return c.doJSON(req, nil)
+}
+
+// CreateMemberAddress assigns a new address to a member. The address is
+// local@domain, where domain has the provided ID.
+func (c *Client) CreateMemberAddress(ctx context.Context, memberID, domainID, local, displayName string) (*Address, error) {
+	reqData := struct {
+		DomainID    string
+		Local       string
+		DisplayName string
+	}{domainID, local, displayName}
+	req, err := c.newJSONRequest(ctx, http.MethodPost, "/members/"+memberID+"/addresses", &reqData)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Address *Address
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Address, nil
+}
+
+// MemberKey is a key generated by an organization admin for a member.
+type MemberKey struct {
+	AddressID  string
+	PrivateKey string // encrypted with the token
+	Token      string // encrypted to the organization key
+	Signature  string // detached signature of the token by the organization key
+}
+
+// NewMemberKey generates a key for a member's address. The key is protected
+// by a random token, which is encrypted and signed with the organization key
+// so that admins can later access the member's key.
+func NewMemberKey(addr *Address, orgKey *openpgp.Entity) (*MemberKey, error) {
+	e, err := GenerateKey(addr.DisplayName, addr.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	rawToken := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, rawToken); err != nil {
+		return nil, err
+	}
+	token := []byte(base64.StdEncoding.EncodeToString(rawToken))
+
+	privateKey, err := ArmorPrivateKey(e, token)
+	if err != nil {
+		return nil, err
+	}
+
+	var encryptedToken bytes.Buffer
+	aw, err := armor.Encode(&encryptedToken, "PGP MESSAGE", nil)
+	if err != nil {
+		return nil, err
+	}
+	pw, err := openpgp.Encrypt(aw, []*openpgp.Entity{orgKey}, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pw.Write(token); err != nil {
+		return nil, err
+	}
+	if err := pw.Close(); err != nil {
+		return nil, err
+	}
+	if err := aw.Close(); err != nil {
+		return nil, err
+	}
+
+	var sig bytes.Buffer
+	if err := openpgp.ArmoredDetachSignText(&sig, orgKey, bytes.NewReader(token), nil); err != nil {
+		return nil, err
+	}
+
+	return &MemberKey{
+		AddressID:  addr.ID,
+		PrivateKey: privateKey,
+		Token:      encryptedToken.String(),
+		Signature:  sig.String(),
+	}, nil
+}
+
+// SetupMemberKeys uploads the initial keys of a member. The first key is used
+// as the member's primary key.
+func (c *Client) SetupMemberKeys(ctx context.Context, memberID string, keys []*MemberKey) (*Member, error) {
+	reqData := struct {
+		PrimaryKey string
+		Keys       []*MemberKey
+	}{Keys: keys}
+	if len(keys) > 0 {
+		reqData.PrimaryKey = keys[0].PrivateKey
+	}
+	req, err := c.newJSONRequest(ctx, http.MethodPost, "/members/"+memberID+"/keys/setup", &reqData)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Member *Member
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.Member, nil
+}
@@ -2,10 +2,17 @@ package protonmail
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha512"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
 
 	"github.com/emersion/go-bcrypt"
+	"golang.org/x/crypto/openpgp"
 )
 
 const bcryptCost = 10
@@ -61,3 +68,243 @@ func computeKeyPassword(password, salt []byte) ([]byte, error) {
 	// Remove bcrypt prefix and salt (first 29 characters)
 	return hashed[29:], nil
 }
+
+// SRPAuth contains what the server needs to check a new password.
+type SRPAuth struct {
+	Version   int
+	ModulusID string
+	Salt      string
+	Verifier  string
+}
+
+func (c *Client) newSRPAuth(ctx context.Context, password string) (*SRPAuth, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/auth/modulus", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		Modulus   string
+		ModulusID string
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	modulus, err := decodeModulus(respData.Modulus)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 10)
+	if _, err := io.ReadFull(randReader, salt); err != nil {
+		return nil, err
+	}
+
+	verifier, err := srpVerifier([]byte(password), salt, modulus)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SRPAuth{
+		Version:   4,
+		ModulusID: respData.ModulusID,
+		Salt:      base64.StdEncoding.EncodeToString(salt),
+		Verifier:  base64.StdEncoding.EncodeToString(verifier),
+	}, nil
+}
+
+// passwordProofReq proves that the user knows the current login password,
+// required to change passwords.
+type passwordProofReq struct {
+	SRPSession      string
+	ClientEphemeral string
+	ClientProof     string
+	TwoFactorCode   string `json:",omitempty"`
+}
+
+func (c *Client) passwordProof(ctx context.Context, username, password, twoFactorCode string) (*passwordProofReq, *proofs, error) {
+	info, err := c.AuthInfo(ctx, username)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	proofs, err := srp([]byte(password), info)
+	if err != nil {
+		return nil, nil, fmt.Errorf("SRP failed during password change: %v", err)
+	}
+
+	return &passwordProofReq{
+		SRPSession:      info.srpSession,
+		ClientEphemeral: base64.StdEncoding.EncodeToString(proofs.clientEphemeral),
+		ClientProof:     base64.StdEncoding.EncodeToString(proofs.clientProof),
+		TwoFactorCode:   twoFactorCode,
+	}, proofs, nil
+}
+
+// ChangeLoginPassword changes the login password of an account in
+// two-password mode. loginPassword is the current one. twoFactorCode is
+// required if TOTP is enabled.
+func (c *Client) ChangeLoginPassword(ctx context.Context, username, loginPassword, newPassword, twoFactorCode string) error {
+	proofReq, proofs, err := c.passwordProof(ctx, username, loginPassword, twoFactorCode)
+	if err != nil {
+		return err
+	}
+
+	srpAuth, err := c.newSRPAuth(ctx, newPassword)
+	if err != nil {
+		return err
+	}
+
+	reqData := struct {
+		*passwordProofReq
+		Auth *SRPAuth
+	}{proofReq, srpAuth}
+	req, err := c.newJSONRequest(ctx, http.MethodPut, "/settings/password", &reqData)
+	if err != nil {
+		return err
+	}
+
+	var respData struct {
+		resp
+		ServerProof string
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return err
+	}
+
+	return proofs.VerifyServerProof(respData.ServerProof)
+}
+
+type privateKeyReq struct {
+	ID         string
+	PrivateKey string
+}
+
+// ChangeMailboxPassword re-encrypts the keys unlocked by Unlock with a new
+// passphrase derived from newPassword. In single-password mode, newPassword
+// becomes the login password too. loginPassword is the current login
+// password. twoFactorCode is required if TOTP is enabled.
+//
+// All address keys must have been unlocked, and user keys must be encrypted
+// with the same passphrase, so that none is left encrypted with the old
+// passphrase. The new key salts are returned.
+func (c *Client) ChangeMailboxPassword(ctx context.Context, username, loginPassword, newPassword, twoFactorCode string, singlePassword bool) (map[string][]byte, error) {
+	oldPassphrase := c.passphrase()
+	if oldPassphrase == nil {
+		return nil, errors.New("cannot change mailbox password: client is not unlocked")
+	}
+	defer wipe(oldPassphrase)
+
+	addrs, err := c.ListAddresses(ctx)
+	if err != nil {
+		return nil, err
+	}
+	user, err := c.GetCurrentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keySalt := make([]byte, 16)
+	if _, err := io.ReadFull(randReader, keySalt); err != nil {
+		return nil, err
+	}
+	keyPassphrase, err := computeKeyPassword([]byte(newPassword), keySalt)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []privateKeyReq
+	keySalts := make(map[string][]byte)
+	for _, addr := range addrs {
+		for _, key := range addr.Keys {
+			e := c.findUnlockedKey(key.Fingerprint)
+			if e == nil {
+				return nil, fmt.Errorf("cannot change mailbox password: key %v of %v isn't unlocked", key.Fingerprint, addr.Email)
+			}
+
+			armored, err := ArmorPrivateKey(e, keyPassphrase)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, privateKeyReq{ID: key.ID, PrivateKey: armored})
+			keySalts[key.ID] = keySalt
+		}
+	}
+
+	var userKeys []privateKeyReq
+	for _, key := range user.Keys {
+		e, err := key.Entity()
+		if err != nil {
+			return nil, err
+		}
+		if err := unlockKey(e, oldPassphrase); err != nil {
+			return nil, fmt.Errorf("cannot change mailbox password: user key %v can't be unlocked: %v", e.PrimaryKey.KeyIdString(), err)
+		}
+
+		armored, err := ArmorPrivateKey(e, keyPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		userKeys = append(userKeys, privateKeyReq{ID: key.ID, PrivateKey: armored})
+		keySalts[key.ID] = keySalt
+	}
+
+	proofReq, proofs, err := c.passwordProof(ctx, username, loginPassword, twoFactorCode)
+	if err != nil {
+		return nil, err
+	}
+
+	reqData := struct {
+		*passwordProofReq
+		Keys     []privateKeyReq
+		UserKeys []privateKeyReq
+		KeySalt  string
+		Auth     *SRPAuth `json:",omitempty"`
+	}{
+		passwordProofReq: proofReq,
+		Keys:             keys,
+		UserKeys:         userKeys,
+		KeySalt:          base64.StdEncoding.EncodeToString(keySalt),
+	}
+	if singlePassword {
+		if reqData.Auth, err = c.newSRPAuth(ctx, newPassword); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := c.newJSONRequest(ctx, http.MethodPut, "/keys/private", &reqData)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		ServerProof string
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+	if err := proofs.VerifyServerProof(respData.ServerProof); err != nil {
+		return nil, err
+	}
+
+	c.keyLocker.Lock()
+	wipe(c.keyPassphrase)
+	c.keyPassphrase = keyPassphrase
+	c.keyLocker.Unlock()
+	return keySalts, nil
+}
+
+// findUnlockedKey returns the unlocked key with the given fingerprint.
+func (c *Client) findUnlockedKey(fingerprint string) *openpgp.Entity {
+	c.keyLocker.Lock()
+	defer c.keyLocker.Unlock()
+	for _, e := range c.keyRing {
+		if strings.EqualFold(fmt.Sprintf("%x", e.PrimaryKey.Fingerprint[:]), fingerprint) {
+			return e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package protonmail
+
+import (
+	"runtime"
+	"sync"
+)
+
+// Pool bounds the number of CPU-intensive tasks, such as OpenPGP decryptions,
+// running at the same time.
+type Pool struct {
+	sem chan struct{}
+}
+
+// NewPool creates a pool running up to size tasks at the same time. If size
+// is zero, it defaults to the number of CPUs.
+func NewPool(size int) *Pool {
+	if size <= 0 {
+		size = runtime.NumCPU()
+	}
+	return &Pool{sem: make(chan struct{}, size)}
+}
+
+// DecryptPool is shared by all accounts and frontends to decrypt message
+// bodies and contacts. Private keys are unlocked once per account when
+// logging in, and the resulting key rings are used by all tasks.
+var DecryptPool = NewPool(0)
+
+// Size returns the maximum number of tasks running at the same time.
+func (p *Pool) Size() int {
+	return cap(p.sem)
+}
+
+// Do runs f once the pool has room for it, and waits for it to return. f must
+// not call Do, otherwise the pool could deadlock.
+func (p *Pool) Do(f func()) {
+	p.sem <- struct{}{}
+	defer func() {
+		<-p.sem
+	}()
+	f()
+}
+
+// Map calls f for each integer in [0, n), with up to Size calls running at
+// the same time, and returns the first error. f usually downloads something
+// and decrypts it with Do, so that downloads overlap with decryptions.
+func (p *Pool) Map(n int, f func(i int) error) error {
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	sem := make(chan struct{}, p.Size())
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() {
+				<-sem
+			}()
+			if err := f(i); err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+	return firstErr
+}
@@ -3,21 +3,25 @@ package protonmail
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/openpgp"
 
-	"log"
+	"github.com/emersion/hydroxide/logging"
 )
 
 const Version = 3
 
+var logger = logging.New("protonmail")
+
 const headerAPIVersion = "X-Pm-Apiversion"
 
 type resp struct {
@@ -46,6 +50,11 @@ type RawAPIError struct {
 type APIError struct {
 	Code    int
 	Message string
+	// HTTP status code of the response
+	StatusCode int
+	// Delay requested by the Retry-After header of the response, negative if
+	// missing
+	RetryAfter time.Duration
 }
 
 func (err *APIError) Error() string {
@@ -65,28 +74,96 @@ type Client struct {
 	Debug      bool
 
 	HTTPClient *http.Client
-	ReAuth     func() error
-
+	ReAuth     func(ctx context.Context) error
+	// If set, all requests are throttled. Used by clients dedicated to
+	// background tasks.
+	Throttle *Throttle
+	// Maximum number of times a request is retried when the API responds
+	// with 429 Too Many Requests or 503 Service Unavailable. Zero disables
+	// retries.
+	MaxRetries int
+	// If set, requests are sent through alternative routes published by
+	// ProtonMail when the API is unreachable, e.g. because it's blocked.
+	AlternativeRouting bool
+	// Public key of the VRF giving the position of addresses in the key
+	// transparency tree. If nil, key transparency checks fail.
+	KTVRFPublicKey []byte
+	// Key transparency epoch verified in a previous session, if any. Epochs
+	// are only accepted if they're chained with it.
+	KTCheckpoint *KTCheckpoint
+	// Called each time a more recent epoch has been verified, so that the
+	// checkpoint can be saved for the next sessions.
+	KTCheckpointUpdated func(cp *KTCheckpoint)
+
+	tokenLocker sync.Mutex
 	uid         string
 	accessToken string
-	keyRing     openpgp.EntityList
+	// Held while the access token is refreshed
+	reAuthLocker sync.Mutex
+
+	// Guards keyRing and keyPassphrase
+	keyLocker sync.Mutex
+	keyRing   openpgp.EntityList
+	// Passphrase of the first key unlocked by Unlock, used for the keys
+	// created or unlocked afterwards. Keys with a different salt can't be
+	// unlocked with it.
+	keyPassphrase []byte
+}
+
+// debug checks whether requests and responses should be logged.
+func (c *Client) debug() bool {
+	return c.Debug || logger.Enabled(logging.LevelDebug)
+}
+
+// setAuth sets the session used to authenticate requests.
+func (c *Client) setAuth(uid, accessToken string) {
+	c.tokenLocker.Lock()
+	c.uid = uid
+	c.accessToken = accessToken
+	c.tokenLocker.Unlock()
 }
 
 func (c *Client) setRequestAuthorization(req *http.Request) {
-	if c.uid != "" && c.accessToken != "" {
-		req.Header.Set("X-Pm-Uid", c.uid)
-		req.Header.Set("Authorization", "Bearer "+c.accessToken)
+	c.tokenLocker.Lock()
+	uid, accessToken := c.uid, c.accessToken
+	c.tokenLocker.Unlock()
+
+	if uid != "" && accessToken != "" {
+		req.Header.Set("X-Pm-Uid", uid)
+		req.Header.Set("Authorization", "Bearer "+accessToken)
 	}
 }
 
-func (c *Client) newRequest(method, path string, body io.Reader) (*http.Request, error) {
-	req, err := http.NewRequest(method, c.RootURL+path, body)
+// refreshAuth re-authenticates after a request sent with the authorization
+// sent has been rejected. Only one refresh runs at a time: if the access
+// token has been refreshed by another request in the meantime, it's used
+// as-is.
+func (c *Client) refreshAuth(ctx context.Context, sent string) error {
+	c.reAuthLocker.Lock()
+	defer c.reAuthLocker.Unlock()
+
+	c.tokenLocker.Lock()
+	current := "Bearer " + c.accessToken
+	if current == sent {
+		// Requests sent by ReAuth must not use the expired token
+		c.accessToken = ""
+	}
+	c.tokenLocker.Unlock()
+
+	if current != sent {
+		return nil
+	}
+	return c.ReAuth(ctx)
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.rootURL()+path, body)
 	if err != nil {
 		return nil, err
 	}
 
-	if c.Debug {
-		log.Printf(">> %v %v\n", req.Method, req.URL.Path)
+	if c.debug() {
+		logger.Debug("request", "method", req.Method, "path", req.URL.Path)
 	}
 
 	req.Header.Set("X-Pm-Appversion", c.AppVersion)
@@ -95,20 +172,20 @@ func (c *Client) newRequest(method, path string, body io.Reader) (*http.Request,
 	return req, nil
 }
 
-func (c *Client) newJSONRequest(method, path string, body interface{}) (*http.Request, error) {
+func (c *Client) newJSONRequest(ctx context.Context, method, path string, body interface{}) (*http.Request, error) {
 	var buf bytes.Buffer
 	if err := json.NewEncoder(&buf).Encode(body); err != nil {
 		return nil, err
 	}
 	b := buf.Bytes()
 
-	req, err := c.newRequest(method, path, bytes.NewReader(b))
+	req, err := c.newRequest(ctx, method, path, bytes.NewReader(b))
 	if err != nil {
 		return nil, err
 	}
 
-	if c.Debug {
-		log.Print(string(b))
+	if c.debug() {
+		logger.Debug("request body", "method", req.Method, "path", req.URL.Path, "json", logging.RedactJSON(b))
 	}
 
 	req.Header.Set("Content-Type", "application/json")
@@ -124,18 +201,18 @@ func (c *Client) do(req *http.Request) (*http.Response, error) {
 		httpClient = http.DefaultClient
 	}
 
-	resp, err := httpClient.Do(req)
+	resp, err := c.send(httpClient, req)
 	if err != nil {
 		return resp, err
 	}
+	resp.Body = c.Throttle.Reader(resp.Body)
 
 	// Check if access token has expired
 	_, hasAuth := req.Header["Authorization"]
 	canRetry := req.Body == nil || req.GetBody != nil
 	if resp.StatusCode == http.StatusUnauthorized && hasAuth && c.ReAuth != nil && canRetry {
 		resp.Body.Close()
-		c.accessToken = ""
-		if err := c.ReAuth(); err != nil {
+		if err := c.refreshAuth(req.Context(), req.Header.Get("Authorization")); err != nil {
 			return resp, err
 		}
 		c.setRequestAuthorization(req) // Access token has changed
@@ -169,14 +246,17 @@ func (c *Client) doJSON(req *http.Request, respData interface{}) error {
 		return err
 	}
 
-	if c.Debug {
-		log.Printf("<< %v %v", req.Method, req.URL.Path)
-		log.Printf("%#v", respData)
+	if c.debug() {
+		logger.Debug("response", "method", req.Method, "path", req.URL.Path, "json", logging.Redact(respData))
 	}
 
 	if maybeError, ok := respData.(maybeError); ok {
 		if err := maybeError.Err(); err != nil {
-			log.Printf("request failed: %v %v: %v", req.Method, req.URL.String(), err)
+			if apiErr, ok := err.(*APIError); ok {
+				apiErr.StatusCode = resp.StatusCode
+				apiErr.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+			}
+			logger.Warn("request failed", "method", req.Method, "path", req.URL.Path, "error", err)
 			return err
 		}
 	}
@@ -0,0 +1,59 @@
+package protonmail
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestRefreshAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		sent     string
+		requests int
+		reAuths  int
+	}{
+		{"expired token", "Bearer old", 1, 1},
+		{"concurrent requests", "Bearer old", 10, 1},
+		{"already refreshed", "Bearer older", 3, 0},
+	}
+	for _, tc := range tests {
+		var c Client
+		c.setAuth("uid", "old")
+
+		var locker sync.Mutex
+		reAuths := 0
+		c.ReAuth = func(ctx context.Context) error {
+			c.tokenLocker.Lock()
+			token := c.accessToken
+			c.tokenLocker.Unlock()
+			if token != "" {
+				t.Errorf("%v: ReAuth called with the expired token", tc.name)
+			}
+
+			locker.Lock()
+			reAuths++
+			n := reAuths
+			locker.Unlock()
+			c.setAuth("uid", "new"+strconv.Itoa(n))
+			return nil
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < tc.requests; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := c.refreshAuth(context.Background(), tc.sent); err != nil {
+					t.Errorf("%v: refreshAuth() = %v", tc.name, err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if reAuths != tc.reAuths {
+			t.Errorf("%v: ReAuth called %v times, want %v", tc.name, reAuths, tc.reAuths)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package protonmail
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+// NewProxyHTTPClient returns an HTTP client whose connections go through a
+// SOCKS5 proxy, e.g. "socks5://127.0.0.1:9050" for Tor. Host names are
+// resolved by the proxy, so that DNS requests don't leak outside of it. If
+// bind is set, connections to the proxy originate from it, see
+// NewBoundHTTPClient.
+func NewProxyHTTPClient(proxyURL, bind string) (*http.Client, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL %q: %v", proxyURL, err)
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return nil, fmt.Errorf("unsupported proxy URL %q: expected socks5://<host>:<port>", proxyURL)
+	}
+
+	var forward proxy.Dialer = proxy.Direct
+	if bind != "" {
+		forward = boundDialer(bind)
+	}
+	dialer, err := proxy.FromURL(u, forward)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Don't let HTTP_PROXY and the like bypass the SOCKS5 proxy
+	transport.Proxy = nil
+	transport.DialContext = dialer.(proxy.ContextDialer).DialContext
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,129 @@
+package protonmail
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultMaxRetries is a reasonable value for Client.MaxRetries, enough to
+// survive bulk operations such as full mailbox synchronizations.
+const DefaultMaxRetries = 5
+
+const (
+	minRetryDelay = time.Second
+	// Requests aren't retried if the server asks to wait for longer
+	maxRetryDelay = 5 * time.Minute
+	// Upper bound of the exponential backoff
+	maxBackoffDelay = time.Minute
+)
+
+// isThrottled checks whether a request has been rejected because of rate
+// limiting, and can be retried. A 503 error may be returned by a proxy after
+// the request has been processed by the API, so only idempotent requests are
+// retried in this case: retrying e.g. a POST /messages/send would send the
+// message twice.
+func isThrottled(req *http.Request, resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusServiceUnavailable:
+		switch req.Method {
+		case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+			return true
+		}
+	}
+	return false
+}
+
+// parseRetryAfter parses a Retry-After header, which contains either a number
+// of seconds or a date. It returns a negative duration if the header is
+// missing or invalid.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return -1
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return -1
+		}
+		return time.Duration(secs) * time.Second
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return -1
+	}
+	if d := t.Sub(now); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// backoffDelay returns a random delay for the n-th retry (starting from zero),
+// growing exponentially.
+func backoffDelay(n int) time.Duration {
+	d := maxBackoffDelay
+	if n < 16 {
+		if exp := minRetryDelay << uint(n); exp < d {
+			d = exp
+		}
+	}
+	// Randomize the upper half, so that clients throttled at the same time
+	// don't retry at the same time
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryDelay returns how long to wait before retrying a throttled request for
+// the n-th time, and false if it shouldn't be retried.
+func (c *Client) retryDelay(resp *http.Response, n int) (time.Duration, bool) {
+	if n >= c.MaxRetries {
+		return 0, false
+	}
+
+	d := backoffDelay(n)
+	if retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); retryAfter > maxRetryDelay {
+		return 0, false
+	} else if retryAfter >= 0 {
+		d = retryAfter
+	}
+	return d, true
+}
+
+// sendRetry sends a request. Throttled requests are retried after the delay
+// requested by the server, see isThrottled.
+func (c *Client) sendRetry(httpClient *http.Client, req *http.Request) (*http.Response, error) {
+	canRetry := req.Body == nil || req.GetBody != nil
+	for n := 0; ; n++ {
+		if err := c.Throttle.Wait(req.Context()); err != nil {
+			return nil, err
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil || !isThrottled(req, resp) || !canRetry {
+			return resp, err
+		}
+
+		d, ok := c.retryDelay(resp, n)
+		if !ok {
+			return resp, nil
+		}
+		resp.Body.Close()
+		logger.Info("request throttled, retrying", "method", req.Method, "path", req.URL.Path, "status", resp.Status, "delay", d.Round(time.Second/10))
+
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-req.Context().Done():
+			t.Stop()
+			return nil, req.Context().Err()
+		}
+
+		if req.Body != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package protonmail
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestIsThrottled(t *testing.T) {
+	tests := []struct {
+		method string
+		status int
+		want   bool
+	}{
+		{http.MethodGet, http.StatusTooManyRequests, true},
+		{http.MethodPost, http.StatusTooManyRequests, true},
+		{http.MethodGet, http.StatusServiceUnavailable, true},
+		{http.MethodHead, http.StatusServiceUnavailable, true},
+		{http.MethodPut, http.StatusServiceUnavailable, true},
+		{http.MethodDelete, http.StatusServiceUnavailable, true},
+		{http.MethodPost, http.StatusServiceUnavailable, false},
+		{http.MethodPatch, http.StatusServiceUnavailable, false},
+		{http.MethodGet, http.StatusInternalServerError, false},
+		{http.MethodGet, http.StatusOK, false},
+	}
+	for _, tc := range tests {
+		req := &http.Request{Method: tc.method}
+		resp := &http.Response{StatusCode: tc.status}
+		if got := isThrottled(req, resp); got != tc.want {
+			t.Errorf("isThrottled(%v, %v) = %v, want %v", tc.method, tc.status, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package protonmail
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Alternative routing is used by the official clients when the API is
+// blocked: the hosts of proxies to the API are published as TXT records of a
+// domain, which are looked up with DNS-over-HTTPS so that DNS blocking doesn't
+// get in the way.
+
+const (
+	// altRoutesQuery is base32("api.protonmail.ch") under a Proton domain
+	altRoutesQuery = "dMFYGSLTQOJXXI33ONVQWS3BOMNUA.protonpro.xyz."
+	// How long an alternative route is used before trying the API again
+	altRouteDuration = 24 * time.Hour
+	altRouteTimeout  = 15 * time.Second
+	maxDNSMessageLen = 65535
+)
+
+var dohProviders = []string{
+	"https://dns11.quad9.net/dns-query",
+	"https://dns.google/dns-query",
+}
+
+type altRoute struct {
+	rootURL string
+	expires time.Time
+}
+
+var (
+	altRoutesLocker sync.Mutex
+	// Alternative routes, indexed by Client.RootURL
+	altRoutes = make(map[string]*altRoute)
+	// Discoveries in progress, indexed by Client.RootURL, closed when done
+	altRoutesDiscoveries = make(map[string]chan struct{})
+)
+
+// rootURL returns the root URL for new requests: the alternative route if the
+// API has been found to be unreachable, Client.RootURL otherwise.
+func (c *Client) rootURL() string {
+	if !c.AlternativeRouting {
+		return c.RootURL
+	}
+
+	altRoutesLocker.Lock()
+	defer altRoutesLocker.Unlock()
+	if r := altRoutes[c.RootURL]; r != nil && time.Now().Before(r.expires) {
+		return r.rootURL
+	}
+	return c.RootURL
+}
+
+// send sends a request. If the API is unreachable and alternative routing is
+// enabled, the request is sent again through an alternative route.
+func (c *Client) send(httpClient *http.Client, req *http.Request) (*http.Response, error) {
+	resp, err := c.sendRetry(httpClient, req)
+	if err == nil || !c.AlternativeRouting || !c.reroute(httpClient, req, err) {
+		return resp, err
+	}
+	return c.sendRetry(httpClient, req)
+}
+
+// isIdempotent checks whether a request can be sent again without side
+// effects if the first attempt has reached the server (RFC 7231 section
+// 4.2.2).
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// isConnectError checks whether a request failed before being sent to the
+// server, because the connection or the TLS handshake failed.
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+
+	var (
+		recordErr    tls.RecordHeaderError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		certErr      x509.CertificateInvalidError
+	)
+	if errors.As(err, &recordErr) || errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &certErr) {
+		return true
+	}
+	// net/http doesn't export this error
+	return strings.Contains(err.Error(), "TLS handshake timeout")
+}
+
+// reroute switches a request which failed with err to an alternative route.
+// It returns false if the request can't be rerouted.
+//
+// Requests which may have reached the server, e.g. when the connection is
+// reset while waiting for the response, are only rerouted if they're
+// idempotent: sending a message twice must be avoided.
+func (c *Client) reroute(httpClient *http.Client, req *http.Request, err error) bool {
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) || req.Context().Err() != nil {
+		return false
+	}
+	if !isConnectError(err) && !isIdempotent(req.Method) {
+		return false
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return false
+	}
+
+	// Requests to other hosts, e.g. Drive blocks, can't be rerouted
+	from := c.RootURL
+	if !strings.HasPrefix(req.URL.String(), from) {
+		if from = c.rootURL(); !strings.HasPrefix(req.URL.String(), from) {
+			return false
+		}
+	}
+
+	to, err := c.findAltRoute(req.Context(), httpClient, from)
+	if err != nil {
+		logger.Warn("API unreachable and no alternative route found", "error", err)
+		return false
+	}
+
+	u, err := url.Parse(to + strings.TrimPrefix(req.URL.String(), from))
+	if err != nil {
+		return false
+	}
+	if req.Body != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return false
+		}
+		req.Body = body
+	}
+	req.URL = u
+	req.Host = u.Host
+	return true
+}
+
+// findAltRoute returns the root URL of a working alternative route, other than
+// failed.
+//
+// Only one discovery runs at a time for a root URL: requests failing in the
+// meantime wait for its result. The lock isn't held during the discovery, so
+// that requests using the current route aren't blocked by it.
+func (c *Client) findAltRoute(ctx context.Context, httpClient *http.Client, failed string) (string, error) {
+	var done chan struct{}
+	waited := false
+	for {
+		altRoutesLocker.Lock()
+		if r := altRoutes[c.RootURL]; r != nil && time.Now().Before(r.expires) && r.rootURL != failed {
+			altRoutesLocker.Unlock()
+			return r.rootURL, nil
+		}
+
+		var ok bool
+		if done, ok = altRoutesDiscoveries[c.RootURL]; !ok {
+			if waited {
+				altRoutesLocker.Unlock()
+				return "", errors.New("no alternative route found")
+			}
+			done = make(chan struct{})
+			altRoutesDiscoveries[c.RootURL] = done
+			delete(altRoutes, c.RootURL)
+			altRoutesLocker.Unlock()
+			break
+		}
+		altRoutesLocker.Unlock()
+
+		select {
+		case <-done:
+			waited = true
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+
+	rootURL, err := c.discoverAltRoute(ctx, httpClient, failed)
+
+	altRoutesLocker.Lock()
+	if err == nil {
+		altRoutes[c.RootURL] = &altRoute{
+			rootURL: rootURL,
+			expires: time.Now().Add(altRouteDuration),
+		}
+	}
+	delete(altRoutesDiscoveries, c.RootURL)
+	close(done)
+	altRoutesLocker.Unlock()
+
+	return rootURL, err
+}
+
+// discoverAltRoute looks up alternative routes and returns the first one
+// which is reachable, other than failed.
+func (c *Client) discoverAltRoute(ctx context.Context, httpClient *http.Client, failed string) (string, error) {
+	hosts, err := lookupAltRoutes(ctx, httpClient)
+	if err != nil {
+		return "", err
+	}
+
+	for _, host := range hosts {
+		rootURL := "https://" + host
+		if rootURL == failed {
+			continue
+		}
+		if err := c.ping(ctx, httpClient, rootURL); err != nil {
+			logger.Debug("alternative route unreachable", "host", host, "error", err)
+			continue
+		}
+
+		logger.Info("API unreachable, using alternative route", "host", host)
+		return rootURL, nil
+	}
+	return "", fmt.Errorf("none of the %v alternative routes is reachable", len(hosts))
+}
+
+// ping checks whether the API is reachable at a root URL.
+func (c *Client) ping(ctx context.Context, httpClient *http.Client, rootURL string) error {
+	ctx, cancel := context.WithTimeout(ctx, altRouteTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rootURL+"/tests/ping", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Pm-Appversion", c.AppVersion)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP error: %v", resp.Status)
+	}
+	return nil
+}
+
+// lookupAltRoutes returns the hosts of alternative routes, asking each
+// DNS-over-HTTPS provider in turn.
+func lookupAltRoutes(ctx context.Context, httpClient *http.Client) ([]string, error) {
+	var lastErr error
+	for _, provider := range dohProviders {
+		hosts, err := lookupTXT(ctx, httpClient, provider, altRoutesQuery)
+		if err != nil {
+			logger.Debug("DNS-over-HTTPS lookup failed", "provider", provider, "error", err)
+			lastErr = err
+			continue
+		}
+		if len(hosts) > 0 {
+			return hosts, nil
+		}
+	}
+	if lastErr != nil {
+		return nil, fmt.Errorf("cannot look up alternative routes: %v", lastErr)
+	}
+	return nil, errors.New("no alternative route available")
+}
+
+// lookupTXT looks up TXT records with DNS-over-HTTPS, see RFC 8484.
+func lookupTXT(ctx context.Context, httpClient *http.Client, provider, name string) ([]string, error) {
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// The ID is zero to make responses cacheable
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{RecursionDesired: true})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{
+		Name:  qname,
+		Type:  dnsmessage.TypeTXT,
+		Class: dnsmessage.ClassINET,
+	}); err != nil {
+		return nil, err
+	}
+	query, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, altRouteTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, provider, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP error: %v", resp.Status)
+	}
+	msg, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxDNSMessageLen))
+	if err != nil {
+		return nil, err
+	}
+
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return nil, err
+	}
+	if h.RCode != dnsmessage.RCodeSuccess {
+		return nil, fmt.Errorf("DNS error: %v", h.RCode)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+
+	var txts []string
+	for {
+		ah, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if ah.Type != dnsmessage.TypeTXT {
+			if err := p.SkipAnswer(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		r, err := p.TXTResource()
+		if err != nil {
+			return nil, err
+		}
+		txts = append(txts, strings.Join(r.TXT, ""))
+	}
+	return txts, nil
+}
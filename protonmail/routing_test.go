@@ -0,0 +1,42 @@
+package protonmail
+
+import (
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestRerouteConditions(t *testing.T) {
+	dialErr := &url.Error{Op: "Post", URL: "https://example.org", Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}
+	readErr := &url.Error{Op: "Post", URL: "https://example.org", Err: &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}}
+	tlsErr := &url.Error{Op: "Post", URL: "https://example.org", Err: x509.UnknownAuthorityError{}}
+	eofErr := &url.Error{Op: "Post", URL: "https://example.org", Err: io.EOF}
+
+	tests := []struct {
+		name    string
+		method  string
+		err     error
+		connect bool
+		reroute bool
+	}{
+		{"dial error", http.MethodPost, dialErr, true, true},
+		{"TLS error", http.MethodPost, tlsErr, true, true},
+		{"read error on POST", http.MethodPost, readErr, false, false},
+		{"EOF on POST", http.MethodPost, eofErr, false, false},
+		{"read error on GET", http.MethodGet, readErr, false, true},
+		{"read error on PUT", http.MethodPut, readErr, false, true},
+		{"read error on DELETE", http.MethodDelete, readErr, false, true},
+	}
+	for _, tc := range tests {
+		if got := isConnectError(tc.err); got != tc.connect {
+			t.Errorf("%v: isConnectError() = %v, want %v", tc.name, got, tc.connect)
+		}
+		if got := isConnectError(tc.err) || isIdempotent(tc.method); got != tc.reroute {
+			t.Errorf("%v: rerouted = %v, want %v", tc.name, got, tc.reroute)
+		}
+	}
+}
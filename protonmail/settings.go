@@ -0,0 +1,222 @@
+package protonmail
+
+import (
+	"context"
+	"net/http"
+)
+
+const mailSettingsPath = "/mail/v4/settings"
+
+// PGPScheme is the format of messages sent to external recipients with PGP.
+type PGPScheme int
+
+const (
+	PGPInline PGPScheme = 8
+	PGPMIME   PGPScheme = 16
+)
+
+// ComposerMode is the way the web client opens the composer.
+type ComposerMode int
+
+const (
+	ComposerPopup ComposerMode = iota
+	ComposerMaximized
+)
+
+// SwipeAction is the action applied to a message swiped in mobile clients.
+type SwipeAction int
+
+const (
+	SwipeTrash SwipeAction = iota
+	SwipeSpam
+	SwipeStar
+	SwipeArchive
+	SwipeMarkRead
+)
+
+// AutoResponderRepeat is the period during which the auto-responder is
+// active.
+type AutoResponderRepeat int
+
+const (
+	// Between StartTime and EndTime
+	AutoResponderFixed AutoResponderRepeat = iota
+	// Every day, between the times of day of StartTime and EndTime
+	AutoResponderDaily
+	// Every week, between the times of the week of StartTime and EndTime
+	AutoResponderWeekly
+	// Every month, between the days of the month of StartTime and EndTime
+	AutoResponderMonthly
+	// Until disabled
+	AutoResponderPermanent
+)
+
+// AutoResponder replies to incoming messages, e.g. when on vacation. Times
+// are interpreted in Zone, e.g. "Europe/Paris".
+type AutoResponder struct {
+	IsEnabled    bool
+	Subject      string
+	Message      string
+	Repeat       AutoResponderRepeat
+	StartTime    Timestamp
+	EndTime      Timestamp
+	DaysSelected []int
+	Zone         string
+}
+
+type MailSettings struct {
+	DisplayName string
+	Signature   string
+	// 1 if the "Sent with ProtonMail" signature is added, 0 otherwise
+	PMSignature   int
+	AutoResponder *AutoResponder
+	// Default format and signing of messages sent to external recipients
+	PGPScheme       PGPScheme
+	Sign            int
+	AttachPublicKey int
+	ComposerMode    ComposerMode
+	DraftMIMEType   string
+	SwipeLeft       SwipeAction
+	SwipeRight      SwipeAction
+	// Number of days after which messages in Spam and Trash are deleted, nil if
+	// the user has never configured it and 0 if disabled
+	AutoDeleteSpamAndTrashDays *int
+}
+
+// MailSettingsUpdate contains the mail settings to change. Nil fields are left
+// unchanged.
+type MailSettingsUpdate struct {
+	DisplayName     *string
+	Signature       *string
+	PMSignature     *bool
+	AutoResponder   *AutoResponder
+	PGPScheme       *PGPScheme
+	Sign            *bool
+	AttachPublicKey *bool
+	ComposerMode    *ComposerMode
+	DraftMIMEType   *string
+	SwipeLeft       *SwipeAction
+	SwipeRight      *SwipeAction
+}
+
+func (c *Client) GetMailSettings(ctx context.Context) (*MailSettings, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, mailSettingsPath, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		MailSettings *MailSettings
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.MailSettings, nil
+}
+
+func (c *Client) updateMailSetting(ctx context.Context, path string, reqData interface{}) (*MailSettings, error) {
+	req, err := c.newJSONRequest(ctx, http.MethodPut, mailSettingsPath+path, reqData)
+	if err != nil {
+		return nil, err
+	}
+
+	var respData struct {
+		resp
+		MailSettings *MailSettings
+	}
+	if err := c.doJSON(req, &respData); err != nil {
+		return nil, err
+	}
+
+	return respData.MailSettings, nil
+}
+
+// mailSettingRequest changes a single mail setting.
+type mailSettingRequest struct {
+	path string
+	data interface{}
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// UpdateMailSettings changes mail settings. Each setting is changed with a
+// separate request: if one fails, the previous ones have already been
+// applied.
+func (c *Client) UpdateMailSettings(ctx context.Context, update *MailSettingsUpdate) (*MailSettings, error) {
+	var reqs []mailSettingRequest
+	add := func(path string, data interface{}) {
+		reqs = append(reqs, mailSettingRequest{path, data})
+	}
+
+	if update.DisplayName != nil {
+		add("/display", struct{ DisplayName string }{*update.DisplayName})
+	}
+	if update.Signature != nil {
+		add("/signature", struct{ Signature string }{*update.Signature})
+	}
+	if update.PMSignature != nil {
+		add("/pmsignature", struct{ PMSignature int }{boolToInt(*update.PMSignature)})
+	}
+	if update.AutoResponder != nil {
+		add("/autoresponder", struct{ AutoResponder *AutoResponder }{update.AutoResponder})
+	}
+	if update.PGPScheme != nil {
+		add("/pgpscheme", struct{ PGPScheme PGPScheme }{*update.PGPScheme})
+	}
+	if update.Sign != nil {
+		add("/sign", struct{ Sign int }{boolToInt(*update.Sign)})
+	}
+	if update.AttachPublicKey != nil {
+		add("/attachpublic", struct{ AttachPublicKey int }{boolToInt(*update.AttachPublicKey)})
+	}
+	if update.ComposerMode != nil {
+		add("/composermode", struct{ ComposerMode ComposerMode }{*update.ComposerMode})
+	}
+	if update.DraftMIMEType != nil {
+		add("/drafttype", struct{ MIMEType string }{*update.DraftMIMEType})
+	}
+	if update.SwipeLeft != nil {
+		add("/swipeleft", struct{ SwipeLeft SwipeAction }{*update.SwipeLeft})
+	}
+	if update.SwipeRight != nil {
+		add("/swiperight", struct{ SwipeRight SwipeAction }{*update.SwipeRight})
+	}
+
+	if len(reqs) == 0 {
+		return c.GetMailSettings(ctx)
+	}
+
+	var settings *MailSettings
+	for _, r := range reqs {
+		var err error
+		if settings, err = c.updateMailSetting(ctx, r.path, r.data); err != nil {
+			return nil, err
+		}
+	}
+	return settings, nil
+}
+
+// SetAutoResponder replaces the auto-responder settings, e.g. to enable or
+// disable it.
+func (c *Client) SetAutoResponder(ctx context.Context, autoResponder *AutoResponder) (*MailSettings, error) {
+	reqData := struct {
+		AutoResponder *AutoResponder
+	}{autoResponder}
+	return c.updateMailSetting(ctx, "/autoresponder", &reqData)
+}
+
+// SetAutoDeleteSpamAndTrashDays sets the number of days after which messages
+// in Spam and Trash are permanently deleted. Zero disables auto-delete.
+func (c *Client) SetAutoDeleteSpamAndTrashDays(ctx context.Context, days int) (*MailSettings, error) {
+	reqData := struct {
+		Days int
+	}{days}
+	return c.updateMailSetting(ctx, "/auto-delete-spam-and-trash-days", &reqData)
+}
@@ -0,0 +1,261 @@
+package protonmail
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// FilterOperator combines the conditions of a simple filter.
+type FilterOperator string
+
+const (
+	FilterAll FilterOperator = "all"
+	FilterAny FilterOperator = "any"
+)
+
+// FilterConditionType is the part of a message checked by a condition.
+type FilterConditionType string
+
+const (
+	FilterSubject     FilterConditionType = "subject"
+	FilterSender      FilterConditionType = "sender"
+	FilterRecipient   FilterConditionType = "recipient"
+	FilterAttachments FilterConditionType = "attachments"
+)
+
+// FilterComparator compares a part of a message with the values of a
+// condition. Comparators prefixed with "!" are negated, e.g. "!contains".
+type FilterComparator string
+
+const (
+	FilterContains FilterComparator = "contains"
+	FilterIs       FilterComparator = "is"
+	FilterStarts   FilterComparator = "starts"
+	FilterEnds     FilterComparator = "ends"
+	// Values are wildcard patterns, with "*" and "?"
+	FilterMatches FilterComparator = "matches"
+)
+
+// The web client stores options as {label, value} objects, the label being
+// only used for display.
+type filterOption struct {
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+func marshalFilterOption(value string) ([]byte, error) {
+	return json.Marshal(&filterOption{Label: value, Value: value})
+}
+
+func unmarshalFilterOption(b []byte) (string, error) {
+	var opt filterOption
+	if err := json.Unmarshal(b, &opt); err != nil {
+		return "", err
+	}
+	return opt.Value, nil
+}
+
+func (op FilterOperator) MarshalJSON() ([]byte, error) {
+	return marshalFilterOption(string(op))
+}
+
+func (op *FilterOperator) UnmarshalJSON(b []byte) error {
+	v, err := unmarshalFilterOption(b)
+	*op = FilterOperator(v)
+	return err
+}
+
+func (t FilterConditionType) MarshalJSON() ([]byte, error) {
+	return marshalFilterOption(string(t))
+}
+
+func (t *FilterConditionType) UnmarshalJSON(b []byte) error {
+	v, err := unmarshalFilterOption(b)
+	*t = FilterConditionType(v)
+	return err
+}
+
+func (cmp FilterComparator) MarshalJSON() ([]byte, error) {
+	return marshalFilterOption(string(cmp))
+}
+
+func (cmp *FilterComparator) UnmarshalJSON(b []byte) error {
+	v, err := unmarshalFilterOption(b)
+	*cmp = FilterComparator(v)
+	return err
+}
+
+type FilterCondition struct {
+	Type       FilterConditionType
+	Comparator FilterComparator
+	Values     []string
+}
+
+type FilterMark struct {
+	Read    bool
+	Starred bool
+}
+
+type FilterActions struct {
+	// Folders and labels the message is moved to
+	FileInto []string
+	Mark     FilterMark
+	// Auto-reply message
+	Vacation string `json:",omitempty"`
+}
+
+// SimpleFilter is a filter made of conditions and actions, as created by the
+// simple editor of the web client.
+type SimpleFilter struct {
+	Operator   FilterOperator
+	Conditions []*FilterCondition
+	Actions    FilterActions
+}
+
+// NewSimpleFilter creates an enabled filter from a simple filter, with its
+// Sieve script generated.
+func NewSimpleFilter(name string, simple *SimpleFilter) (*Filter, error) {
+	sieve, err := simple.Sieve()
+	if err != nil {
+		return nil, err
+	}
+	return &Filter{
+		Name:    name,
+		Status:  FilterEnabled,
+		Version: FilterVersion,
+		Sieve:   sieve,
+		Simple:  simple,
+	}, nil
+}
+
+// quoteSieve formats a Sieve string.
+func quoteSieve(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+func quoteSieveList(l []string) string {
+	if len(l) == 1 {
+		return quoteSieve(l[0])
+	}
+	quoted := make([]string, len(l))
+	for i, s := range l {
+		quoted[i] = quoteSieve(s)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+// escapeSieveWildcards escapes a string for the :matches match type.
+func escapeSieveWildcards(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `*`, `\*`)
+	return strings.ReplaceAll(s, `?`, `\?`)
+}
+
+func (cond *FilterCondition) sieve() (string, error) {
+	cmp := string(cond.Comparator)
+	negated := strings.HasPrefix(cmp, "!")
+	cmp = strings.TrimPrefix(cmp, "!")
+
+	var test string
+	if cond.Type == FilterAttachments {
+		if cmp != string(FilterContains) {
+			return "", fmt.Errorf("invalid comparator %q for attachments", cond.Comparator)
+		}
+		test = `header :matches "X-Attached" "*"`
+	} else {
+		if len(cond.Values) == 0 {
+			return "", fmt.Errorf("no value for %v condition", cond.Type)
+		}
+
+		values := make([]string, len(cond.Values))
+		match := ":" + cmp
+		switch FilterComparator(cmp) {
+		case FilterContains, FilterIs, FilterMatches:
+			copy(values, cond.Values)
+		case FilterStarts, FilterEnds:
+			match = ":matches"
+			for i, v := range cond.Values {
+				if FilterComparator(cmp) == FilterStarts {
+					values[i] = escapeSieveWildcards(v) + "*"
+				} else {
+					values[i] = "*" + escapeSieveWildcards(v)
+				}
+			}
+		default:
+			return "", fmt.Errorf("invalid comparator %q", cond.Comparator)
+		}
+
+		switch cond.Type {
+		case FilterSubject:
+			test = fmt.Sprintf(`header %v "subject" %v`, match, quoteSieveList(values))
+		case FilterSender:
+			test = fmt.Sprintf(`address :all %v "from" %v`, match, quoteSieveList(values))
+		case FilterRecipient:
+			test = fmt.Sprintf(`address :all %v ["to", "cc", "bcc"] %v`, match, quoteSieveList(values))
+		default:
+			return "", fmt.Errorf("invalid condition type %q", cond.Type)
+		}
+	}
+
+	if negated {
+		test = "not " + test
+	}
+	return test, nil
+}
+
+// Sieve generates the Sieve script of a simple filter.
+func (f *SimpleFilter) Sieve() (string, error) {
+	if len(f.Conditions) == 0 {
+		return "", errors.New("filter has no condition")
+	}
+
+	var test string
+	switch f.Operator {
+	case FilterAll:
+		test = "allof"
+	case FilterAny:
+		test = "anyof"
+	default:
+		return "", fmt.Errorf("invalid filter operator %q", f.Operator)
+	}
+
+	tests := make([]string, len(f.Conditions))
+	for i, cond := range f.Conditions {
+		var err error
+		if tests[i], err = cond.sieve(); err != nil {
+			return "", err
+		}
+	}
+
+	require := []string{"fileinto", "imap4flags"}
+	var actions []string
+	for _, folder := range f.Actions.FileInto {
+		actions = append(actions, "fileinto "+quoteSieve(folder)+";")
+	}
+	if f.Actions.Mark.Read {
+		actions = append(actions, `addflag "\\Seen";`)
+	}
+	if f.Actions.Mark.Starred {
+		actions = append(actions, `addflag "\\Flagged";`)
+	}
+	if f.Actions.Vacation != "" {
+		require = append(require, "vacation")
+		actions = append(actions, "vacation "+quoteSieve(f.Actions.Vacation)+";")
+	}
+	if len(actions) == 0 {
+		return "", errors.New("filter has no action")
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "require %v;\n", quoteSieveList(require))
+	fmt.Fprintf(&sb, "if %v (%v) {\n", test, strings.Join(tests, ", "))
+	for _, action := range actions {
+		fmt.Fprintf(&sb, "\t%v\n", action)
+	}
+	sb.WriteString("}\n")
+	return sb.String(), nil
+}
@@ -171,6 +171,23 @@ func (p *proofs) VerifyServerProof(serverProofString string) error {
 	return nil
 }
 
+// srpVerifier computes the verifier of a password, which the server uses to
+// check proofs without knowing the password.
+func srpVerifier(password, salt, modulus []byte) ([]byte, error) {
+	hashed, err := hashPassword(4, password, salt, modulus)
+	if err != nil {
+		return nil, err
+	}
+
+	const l = 2048
+	n := atoi(append([]byte(nil), modulus...))
+	if n.BitLen() != l {
+		return nil, errors.New("SRP modulus has incorrect size")
+	}
+	verifier := big.NewInt(0).Exp(big.NewInt(2), atoi(hashed), n)
+	return itoa(verifier, l), nil
+}
+
 // From https://github.com/ProtonMail/WebClient/blob/public/src/app/authentication/services/srp.js#L135
 func srp(password []byte, info *AuthInfo) (*proofs, error) {
 	modulus, err := decodeModulus(info.modulus)
@@ -0,0 +1,107 @@
+package protonmail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"math/big"
+	"testing"
+)
+
+// srpTestModulus is the 2048-bit MODP group prime from RFC 3526 section 3,
+// a safe prime of the same size as the moduli used by ProtonMail.
+const srpTestModulus = "" +
+	"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74" +
+	"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437" +
+	"4FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED" +
+	"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF05" +
+	"98DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB" +
+	"9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B" +
+	"E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF695581718" +
+	"3995497CEA956AE515D2261898FA051015728E5A8AACAA68FFFFFFFFFFFFFFFF"
+
+// srpServerProof computes the client proof the server expects from a client
+// knowing the password of verifier, as the server would.
+func srpServerProof(t *testing.T, modulus, verifier []byte) (serverEphemeral []byte, check func(p *proofs) bool) {
+	const l = 2048
+	g := big.NewInt(2)
+	n := atoi(append([]byte(nil), modulus...))
+	v := atoi(append([]byte(nil), verifier...))
+	k := atoi(expandHash(append(itoa(g, l), modulus...)))
+	k.Mod(k, n)
+
+	b, err := rand.Int(rand.Reader, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bigB := new(big.Int).Mul(k, v)
+	bigB.Add(bigB, new(big.Int).Exp(g, b, n))
+	bigB.Mod(bigB, n)
+
+	return itoa(bigB, l), func(p *proofs) bool {
+		a := atoi(append([]byte(nil), p.clientEphemeral...))
+		u := atoi(expandHash(append(itoa(a, l), itoa(bigB, l)...)))
+		s := new(big.Int).Exp(v, u, n)
+		s.Mul(s, a)
+		s.Exp(s, b, n)
+
+		var proof []byte
+		proof = append(proof, itoa(a, l)...)
+		proof = append(proof, itoa(bigB, l)...)
+		proof = append(proof, itoa(s, l)...)
+		return bytes.Equal(expandHash(proof), p.clientProof)
+	}
+}
+
+func TestSRPVerifier(t *testing.T) {
+	prime, ok := new(big.Int).SetString(srpTestModulus, 16)
+	if !ok {
+		t.Fatal("invalid test modulus")
+	}
+	modulus := itoa(prime, 2048)
+	salt := []byte("0123456789")
+
+	tests := []struct {
+		name               string
+		password, login    string
+		shortModulus, fail bool
+	}{
+		{name: "ascii", password: "correct horse", login: "correct horse"},
+		{name: "unicode", password: "pässwörd ✓", login: "pässwörd ✓"},
+		{name: "empty", password: "", login: ""},
+		{name: "wrong password", password: "correct horse", login: "Correct horse", fail: true},
+		{name: "short modulus", password: "correct horse", shortModulus: true, fail: true},
+	}
+	for _, tc := range tests {
+		m := modulus
+		if tc.shortModulus {
+			m = modulus[:len(modulus)-1]
+		}
+		verifier, err := srpVerifier([]byte(tc.password), append([]byte(nil), salt...), m)
+		if tc.shortModulus {
+			if err == nil {
+				t.Errorf("%v: srpVerifier succeeded", tc.name)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%v: srpVerifier() = %v", tc.name, err)
+			continue
+		}
+		if len(verifier) != 2048/8 {
+			t.Errorf("%v: verifier has %v bytes, want %v", tc.name, len(verifier), 2048/8)
+		}
+
+		hashed, err := hashPassword(4, []byte(tc.login), append([]byte(nil), salt...), modulus)
+		if err != nil {
+			t.Fatalf("%v: hashPassword() = %v", tc.name, err)
+		}
+		serverEphemeral, check := srpServerProof(t, modulus, verifier)
+		// generateProofs reverses the modulus in place
+		p, err := generateProofs(2048, expandHash, append([]byte(nil), modulus...), hashed, serverEphemeral)
+		if err != nil {
+			t.Fatalf("%v: generateProofs() = %v", tc.name, err)
+		}
+		if ok := check(p); ok == tc.fail {
+			t.Errorf("%v: server accepted proof: %v, want %v", tc.name, ok, !tc.fail)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package protonmail
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// limiter spaces out events so that their average rate doesn't exceed a
+// limit.
+type limiter struct {
+	perSecond float64
+
+	sync.Mutex
+	next time.Time
+}
+
+func (l *limiter) waitN(n int) {
+	l.waitNContext(context.Background(), n)
+}
+
+// waitNContext is like waitN, but gives up if ctx is cancelled. The slot is
+// still consumed.
+func (l *limiter) waitNContext(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+
+	l.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	d := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / l.perSecond * float64(time.Second)))
+	l.Unlock()
+
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Throttle limits the number of requests and the bandwidth used by
+// background tasks, such as synchronization and exports. A nil Throttle
+// doesn't limit anything.
+type Throttle struct {
+	requests *limiter
+	bytes    *limiter
+}
+
+// NewThrottle creates a new throttle. Zero values mean no limit.
+func NewThrottle(requestsPerSecond float64, kilobytesPerSecond int) *Throttle {
+	if requestsPerSecond <= 0 && kilobytesPerSecond <= 0 {
+		return nil
+	}
+
+	t := new(Throttle)
+	if requestsPerSecond > 0 {
+		t.requests = &limiter{perSecond: requestsPerSecond}
+	}
+	if kilobytesPerSecond > 0 {
+		t.bytes = &limiter{perSecond: float64(kilobytesPerSecond) * 1024}
+	}
+	return t
+}
+
+// Wait blocks until a new request can be sent, or until ctx is done.
+func (t *Throttle) Wait(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	return t.requests.waitNContext(ctx, 1)
+}
+
+// Consume accounts for n bytes transferred outside of the Reader returned by
+// Reader, blocking if the bandwidth limit is exceeded.
+func (t *Throttle) Consume(n int) {
+	if t != nil {
+		t.bytes.waitN(n)
+	}
+}
+
+type throttledReader struct {
+	io.ReadCloser
+	t *Throttle
+}
+
+func (r throttledReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.t.Consume(n)
+	return n, err
+}
+
+// Reader returns a reader limited by the bandwidth limit.
+func (t *Throttle) Reader(r io.ReadCloser) io.ReadCloser {
+	if t == nil || t.bytes == nil {
+		return r
+	}
+	return throttledReader{r, t}
+}
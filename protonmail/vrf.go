@@ -0,0 +1,221 @@
+package protonmail
+
+import (
+	"crypto/sha512"
+	"crypto/subtle"
+	"errors"
+	"math/big"
+)
+
+// This file implements the verification of ECVRF-EDWARDS25519-SHA512-TAI
+// proofs (RFC 9381), used by key transparency. Only public values are
+// handled, so the edwards25519 arithmetic doesn't need to be constant-time.
+
+var (
+	edP = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+	// Order of the prime-order subgroup
+	edQ, _ = new(big.Int).SetString("7237005577332262213973186563042994240857116359379907606001950938285454250989", 10)
+	edD    = edMul(big.NewInt(-121665), edInv(big.NewInt(121666)))
+	// Square root of -1
+	edSqrtM1 = new(big.Int).Exp(big.NewInt(2), new(big.Int).Rsh(new(big.Int).Sub(edP, big.NewInt(1)), 2), edP)
+	edBase   = mustDecodeEdPoint([]byte{
+		0x58, 0x66, 0x66, 0x66, 0x66, 0x66, 0x66, 0x66,
+		0x66, 0x66, 0x66, 0x66, 0x66, 0x66, 0x66, 0x66,
+		0x66, 0x66, 0x66, 0x66, 0x66, 0x66, 0x66, 0x66,
+		0x66, 0x66, 0x66, 0x66, 0x66, 0x66, 0x66, 0x66,
+	})
+)
+
+const (
+	vrfSuite        = 0x03
+	vrfProofLen     = 80
+	vrfChallengeLen = 16
+)
+
+// edPoint is a point of edwards25519, in affine coordinates.
+type edPoint struct {
+	x, y *big.Int
+}
+
+func edMul(a, b *big.Int) *big.Int {
+	r := new(big.Int).Mul(a, b)
+	return r.Mod(r, edP)
+}
+
+func edInv(a *big.Int) *big.Int {
+	return new(big.Int).ModInverse(new(big.Int).Mod(a, edP), edP)
+}
+
+func edIdentity() *edPoint {
+	return &edPoint{big.NewInt(0), big.NewInt(1)}
+}
+
+func (p *edPoint) add(q *edPoint) *edPoint {
+	xx := edMul(p.x, q.x)
+	yy := edMul(p.y, q.y)
+	dxy := edMul(edD, edMul(xx, yy))
+	x := edMul(new(big.Int).Add(edMul(p.x, q.y), edMul(p.y, q.x)), edInv(new(big.Int).Add(big.NewInt(1), dxy)))
+	y := edMul(new(big.Int).Add(yy, xx), edInv(new(big.Int).Sub(big.NewInt(1), dxy)))
+	return &edPoint{x, y}
+}
+
+func (p *edPoint) neg() *edPoint {
+	return &edPoint{new(big.Int).Mod(new(big.Int).Neg(p.x), edP), new(big.Int).Set(p.y)}
+}
+
+func (p *edPoint) scalarMult(k *big.Int) *edPoint {
+	r := edIdentity()
+	for i := k.BitLen() - 1; i >= 0; i-- {
+		r = r.add(r)
+		if k.Bit(i) == 1 {
+			r = r.add(p)
+		}
+	}
+	return r
+}
+
+func (p *edPoint) equal(q *edPoint) bool {
+	return p.x.Cmp(q.x) == 0 && p.y.Cmp(q.y) == 0
+}
+
+// encode returns the 32-byte encoding of a point (RFC 8032 section 5.1.2).
+func (p *edPoint) encode() []byte {
+	b := make([]byte, 32)
+	yb := p.y.Bytes()
+	copy(b[32-len(yb):], yb)
+	reverse(b)
+	if p.x.Bit(0) == 1 {
+		b[31] |= 0x80
+	}
+	return b
+}
+
+// decodeEdPoint decodes a point (RFC 8032 section 5.1.3).
+func decodeEdPoint(b []byte) (*edPoint, error) {
+	if len(b) != 32 {
+		return nil, errors.New("invalid point length")
+	}
+	le := append([]byte(nil), b...)
+	sign := le[31] >> 7
+	le[31] &= 0x7f
+	reverse(le)
+	y := new(big.Int).SetBytes(le)
+	if y.Cmp(edP) >= 0 {
+		return nil, errors.New("invalid point encoding")
+	}
+
+	yy := edMul(y, y)
+	u := new(big.Int).Mod(new(big.Int).Sub(yy, big.NewInt(1)), edP)
+	v := new(big.Int).Mod(new(big.Int).Add(edMul(edD, yy), big.NewInt(1)), edP)
+
+	// x = u v^3 (u v^7)^((p-5)/8)
+	v3 := edMul(edMul(v, v), v)
+	v7 := edMul(edMul(v3, v3), v)
+	e := new(big.Int).Rsh(new(big.Int).Sub(edP, big.NewInt(5)), 3)
+	x := edMul(edMul(u, v3), new(big.Int).Exp(edMul(u, v7), e, edP))
+
+	vxx := edMul(v, edMul(x, x))
+	if vxx.Cmp(u) != 0 {
+		if vxx.Cmp(new(big.Int).Mod(new(big.Int).Neg(u), edP)) != 0 {
+			return nil, errors.New("point isn't on the curve")
+		}
+		x = edMul(x, edSqrtM1)
+	}
+	if x.Sign() == 0 && sign == 1 {
+		return nil, errors.New("invalid point encoding")
+	}
+	if x.Bit(0) != uint(sign) {
+		x.Sub(edP, x)
+	}
+	return &edPoint{x, y}, nil
+}
+
+func mustDecodeEdPoint(b []byte) *edPoint {
+	p, err := decodeEdPoint(b)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func (p *edPoint) mulByCofactor() *edPoint {
+	p2 := p.add(p)
+	p4 := p2.add(p2)
+	return p4.add(p4)
+}
+
+func decodeScalar(b []byte) *big.Int {
+	le := append([]byte(nil), b...)
+	reverse(le)
+	return new(big.Int).SetBytes(le)
+}
+
+// vrfEncodeToCurve hashes a VRF input to a point, with the try-and-increment
+// method (RFC 9381 section 5.4.1.1).
+func vrfEncodeToCurve(pk, alpha []byte) (*edPoint, error) {
+	for ctr := 0; ctr < 256; ctr++ {
+		h := sha512.New()
+		h.Write([]byte{vrfSuite, 0x01})
+		h.Write(pk)
+		h.Write(alpha)
+		h.Write([]byte{byte(ctr), 0x00})
+		if p, err := decodeEdPoint(h.Sum(nil)[:32]); err == nil {
+			return p.mulByCofactor(), nil
+		}
+	}
+	return nil, errors.New("cannot hash VRF input to a point")
+}
+
+func vrfChallenge(points ...*edPoint) []byte {
+	h := sha512.New()
+	h.Write([]byte{vrfSuite, 0x02})
+	for _, p := range points {
+		h.Write(p.encode())
+	}
+	h.Write([]byte{0x00})
+	return h.Sum(nil)[:vrfChallengeLen]
+}
+
+// vrfVerify checks a VRF proof for the input alpha and returns the VRF
+// output.
+func vrfVerify(pk, alpha, proof []byte) ([]byte, error) {
+	if len(proof) != vrfProofLen {
+		return nil, errors.New("invalid VRF proof length")
+	}
+	y, err := decodeEdPoint(pk)
+	if err != nil {
+		return nil, errors.New("invalid VRF public key")
+	}
+	if y.mulByCofactor().equal(edIdentity()) {
+		return nil, errors.New("VRF public key has a small order")
+	}
+	gamma, err := decodeEdPoint(proof[:32])
+	if err != nil {
+		return nil, errors.New("invalid VRF proof")
+	}
+	c := decodeScalar(proof[32:48])
+	s := decodeScalar(proof[48:])
+	if s.Cmp(edQ) >= 0 {
+		return nil, errors.New("invalid VRF proof")
+	}
+
+	h, err := vrfEncodeToCurve(pk, alpha)
+	if err != nil {
+		return nil, err
+	}
+	u := edBase.scalarMult(s).add(y.scalarMult(c).neg())
+	v := h.scalarMult(s).add(gamma.scalarMult(c).neg())
+	if subtle.ConstantTimeCompare(vrfChallenge(y, h, gamma, u, v), proof[32:48]) != 1 {
+		return nil, errors.New("VRF proof verification failed")
+	}
+
+	return vrfProofToHash(gamma), nil
+}
+
+func vrfProofToHash(gamma *edPoint) []byte {
+	h := sha512.New()
+	h.Write([]byte{vrfSuite, 0x03})
+	h.Write(gamma.mulByCofactor().encode())
+	h.Write([]byte{0x00})
+	return h.Sum(nil)
+}
@@ -0,0 +1,96 @@
+package protonmail
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// Test vectors of ECVRF-EDWARDS25519-SHA512-TAI, from RFC 9381 appendix B.3.
+var vrfTests = []struct {
+	pk, alpha, pi, beta string
+}{
+	{
+		pk:    "d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a",
+		alpha: "",
+		pi:    "8657106690b5526245a92b003bb079ccd1a92130477671f6fc01ad16f26f723f26f8a57ccaed74ee1b190bed1f479d9727d2d0f9b005a6e456a35d4fb0daab1268a1b0db10836d9826a528ca76567805",
+		beta:  "90cf1df3b703cce59e2a35b925d411164068269d7b2d29f3301c03dd757876ff66b71dda49d2de59d03450451af026798e8f81cd2e333de5cdf4f3e140fdd8ae",
+	},
+	{
+		pk:    "3d4017c3e843895a92b70aa74d1b7ebc9c982ccf2ec4968cc0cd55f12af4660c",
+		alpha: "72",
+		pi:    "f3141cd382dc42909d19ec5110469e4feae18300e94f304590abdced48aed5933bf0864a62558b3ed7f2fea45c92a465301b3bbf5e3e54ddf2d935be3b67926da3ef39226bbc355bdc9850112c8f4b02",
+		beta:  "eb4440665d3891d668e7e0fcaf587f1b4bd7fbfe99d0eb2211ccec90496310eb5e33821bc613efb94db5e5b54c70a848a0bef4553a41befc57663b56373a5031",
+	},
+	{
+		pk:    "fc51cd8e6218a1a38da47ed00230f0580816ed13ba3303ac5deb911548908025",
+		alpha: "af82",
+		pi:    "9bc0f79119cc5604bf02d23b4caede71393cedfbb191434dd016d30177ccbf8096bb474e53895c362d8628ee9f9ea3c0e52c7a5c691b6c18c9979866568add7a2d41b00b05081ed0f58ee5e31b3a970e",
+		beta:  "645427e5d00c62a23fb703732fa5d892940935942101e456ecca7bb217c61c452118fec1219202a0edcf038bb6373241578be7217ba85a2687f7a0310b2df19f",
+	},
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("invalid hex %q: %v", s, err)
+	}
+	return b
+}
+
+func TestVRFVerify(t *testing.T) {
+	for _, tc := range vrfTests {
+		pk := mustDecodeHex(t, tc.pk)
+		alpha := mustDecodeHex(t, tc.alpha)
+		pi := mustDecodeHex(t, tc.pi)
+
+		beta, err := vrfVerify(pk, alpha, pi)
+		if err != nil {
+			t.Errorf("vrfVerify(%v, %q) = %v", tc.pk, tc.alpha, err)
+			continue
+		}
+		if want := mustDecodeHex(t, tc.beta); !bytes.Equal(beta, want) {
+			t.Errorf("vrfVerify(%v, %q) = %x, want %x", tc.pk, tc.alpha, beta, want)
+		}
+	}
+}
+
+func TestVRFVerify_invalid(t *testing.T) {
+	tc := vrfTests[1]
+	pk := mustDecodeHex(t, tc.pk)
+	alpha := mustDecodeHex(t, tc.alpha)
+	pi := mustDecodeHex(t, tc.pi)
+
+	flip := func(b []byte, i int) []byte {
+		b = append([]byte(nil), b...)
+		b[i] ^= 0x01
+		return b
+	}
+
+	tests := []struct {
+		name          string
+		pk, alpha, pi []byte
+	}{
+		{"other public key", mustDecodeHex(t, vrfTests[0].pk), alpha, pi},
+		{"other input", pk, []byte("73"), pi},
+		{"altered gamma", pk, alpha, flip(pi, 0)},
+		{"altered challenge", pk, alpha, flip(pi, 40)},
+		{"altered scalar", pk, alpha, flip(pi, 60)},
+		{"truncated proof", pk, alpha, pi[:vrfProofLen-1]},
+		{"short public key", pk[:31], alpha, pi},
+		{"small order public key", make([]byte, 32), alpha, pi},
+	}
+	for _, tc := range tests {
+		if _, err := vrfVerify(tc.pk, tc.alpha, tc.pi); err == nil {
+			t.Errorf("%v: vrfVerify succeeded", tc.name)
+		}
+	}
+}
+
+func TestVerifyKTProof_noVRFKey(t *testing.T) {
+	proof := &KTProof{Type: KTProofExistent, Proof: vrfTests[0].pi}
+	skl := &SignedKeyList{}
+	if err := verifyKTProof(proof, &KTEpoch{}, "alice@example.org", skl, nil); err == nil {
+		t.Errorf("verifyKTProof succeeded without a VRF public key")
+	}
+}
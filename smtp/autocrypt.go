@@ -0,0 +1,56 @@
+package smtp
+
+import (
+	"fmt"
+
+	"github.com/emersion/go-message/mail"
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/emersion/hydroxide/autocrypt"
+	"github.com/emersion/hydroxide/config"
+)
+
+// setAutocrypt replaces the Autocrypt header field with one advertising the
+// sender's key, unless the account has disabled Autocrypt.
+func (s *session) setAutocrypt(h *mail.Header, from string, key *openpgp.Entity) error {
+	pref := s.account.AutocryptPreference()
+	if pref == config.AutocryptOff {
+		return nil
+	}
+
+	ah, err := autocrypt.New(from, pref, key)
+	if err != nil {
+		return err
+	}
+	h.Set(autocrypt.HeaderKey, ah.String())
+	return nil
+}
+
+// autocryptKey returns the key to use to encrypt a message to a recipient
+// without any published key. A key learned from the recipient's Autocrypt
+// header fields is only used if both parties prefer encryption, as
+// recommended by the Autocrypt specification.
+//
+// An error is returned if the peers can't be read, rather than sending the
+// message in cleartext to a recipient which may have a key.
+func (s *session) autocryptKey(email string) (*openpgp.Entity, error) {
+	if s.account.AutocryptPreference() != autocrypt.PreferEncryptMutual {
+		return nil, nil
+	}
+
+	peers, err := config.LoadAutocryptPeers(s.username)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load Autocrypt peers: %v", err)
+	}
+	peer, ok := peers[config.PinKey(email)]
+	if !ok || peer.PreferEncrypt != autocrypt.PreferEncryptMutual {
+		return nil, nil
+	}
+
+	h := autocrypt.Header{KeyData: peer.KeyData}
+	e, err := h.Entity()
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse Autocrypt key for %q: %v", email, err)
+	}
+	return e, nil
+}
@@ -0,0 +1,51 @@
+package smtp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-smtp"
+
+	"github.com/emersion/hydroxide/config"
+)
+
+// cleartextConfirmHeader is the header field which must be set to "yes" to
+// send a message unencrypted if the account's policy is to warn. It's removed
+// from outgoing messages.
+const cleartextConfirmHeader = "X-Hydroxide-Allow-Cleartext"
+
+// popCleartextConfirmation removes the confirmation header field from h and
+// returns whether it was set.
+func popCleartextConfirmation(h *mail.Header) bool {
+	confirmed := strings.EqualFold(strings.TrimSpace(h.Get(cleartextConfirmHeader)), "yes")
+	h.Del(cleartextConfirmHeader)
+	return confirmed
+}
+
+// checkCleartext enforces the account's policy for messages which would be
+// sent unencrypted to some recipients.
+func (s *session) checkCleartext(recipients []string, confirmed bool) error {
+	if len(recipients) == 0 {
+		return nil
+	}
+
+	switch s.account.CleartextPolicy() {
+	case config.CleartextBlock:
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      fmt.Sprintf("refusing to send unencrypted message to %v", strings.Join(recipients, ", ")),
+		}
+	case config.CleartextWarn:
+		if confirmed {
+			return nil
+		}
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      fmt.Sprintf("message would be sent unencrypted to %v, set %v: yes to confirm", strings.Join(recipients, ", "), cleartextConfirmHeader),
+		}
+	}
+	return nil
+}
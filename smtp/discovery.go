@@ -0,0 +1,72 @@
+package smtp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/emersion/hydroxide/config"
+	"github.com/emersion/hydroxide/keydiscovery"
+)
+
+// keyDiscoveryHeader is the header field overriding the account's key
+// discovery method for a message. It's removed from outgoing messages.
+const keyDiscoveryHeader = "X-Hydroxide-Key-Discovery"
+
+// keyDiscoveryTimeout bounds the time spent looking up the key of a recipient.
+const keyDiscoveryTimeout = 15 * time.Second
+
+// popKeyDiscovery removes the key discovery header field from h and returns
+// the key discovery method to use for the message.
+func popKeyDiscovery(h *mail.Header, account *config.Account) (string, error) {
+	v := strings.ToLower(strings.TrimSpace(h.Get(keyDiscoveryHeader)))
+	h.Del(keyDiscoveryHeader)
+
+	switch v {
+	case "":
+		return account.KeyDiscoveryMethod(), nil
+	case config.KeyDiscoveryOff, config.KeyDiscoveryWKD, config.KeyDiscoveryKeyserver:
+		return v, nil
+	default:
+		return "", fmt.Errorf("invalid %v header field: expected off, wkd or keyserver", keyDiscoveryHeader)
+	}
+}
+
+// discoverKey looks up the key of an external recipient which hasn't
+// published any key on ProtonMail. Lookup failures are logged, the message is
+// then handled as if the recipient had no key. Requests are sent with c, the
+// HTTP client of the account, so that they use the same proxy.
+func discoverKey(ctx context.Context, c *http.Client, method, email string) *openpgp.Entity {
+	if method == config.KeyDiscoveryOff {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, keyDiscoveryTimeout)
+	defer cancel()
+
+	e, err := keydiscovery.LookupWKD(ctx, c, email)
+	if err == nil {
+		logger.Info("found key in Web Key Directory", "email", email)
+		return e
+	} else if err != keydiscovery.ErrNotFound {
+		logger.Warn("cannot look up key in Web Key Directory", "email", email, "error", err)
+	}
+
+	if method != config.KeyDiscoveryKeyserver {
+		return nil
+	}
+
+	e, err = keydiscovery.LookupKeyserver(ctx, c, keydiscovery.DefaultKeyserver, email)
+	if err == nil {
+		logger.Info("found key on keyserver", "email", email, "keyserver", keydiscovery.DefaultKeyserver)
+		return e
+	} else if err != keydiscovery.ErrNotFound {
+		logger.Warn("cannot look up key on keyserver", "email", email, "keyserver", keydiscovery.DefaultKeyserver, "error", err)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package smtp
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+)
+
+// expirationHeader is the header field making a message expire: it's deleted
+// from the recipients' mailboxes after some time. It contains either a
+// duration (e.g. "72h") or a date, as accepted by scheduleHeader. It's removed
+// from outgoing messages.
+const expirationHeader = "X-Hydroxide-Expiration"
+
+// maxExpiration is the longest expiration delay accepted by ProtonMail.
+const maxExpiration = 28 * 24 * time.Hour
+
+// popExpiration removes the expiration header field from h and returns the
+// delay after which the message expires, counted from sent. It returns zero
+// if the message doesn't expire.
+func popExpiration(h *mail.Header, sent time.Time) (time.Duration, error) {
+	v := strings.TrimSpace(h.Get(expirationHeader))
+	h.Del(expirationHeader)
+	if v == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		t, dateErr := parseDateField(v)
+		if dateErr != nil {
+			return 0, fmt.Errorf("invalid %v header field: expected a duration or a date", expirationHeader)
+		}
+		d = t.Sub(sent)
+	}
+
+	if d < time.Second {
+		return 0, fmt.Errorf("invalid %v header field: the message would expire before being sent", expirationHeader)
+	}
+	if d > maxExpiration {
+		return 0, fmt.Errorf("invalid %v header field: messages can't expire after more than %v days", expirationHeader, int(maxExpiration.Hours()/24))
+	}
+	return d.Truncate(time.Second), nil
+}
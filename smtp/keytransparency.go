@@ -0,0 +1,41 @@
+package smtp
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/emersion/hydroxide/config"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// checkKeyTransparency verifies the keys of ProtonMail recipients with key
+// transparency. Failures are logged, and an error is returned if the
+// account's policy is strict.
+func (s *session) checkKeyTransparency(ctx context.Context, keys map[string]*protonmail.PublicKeyResp) error {
+	policy := s.account.KeyTransparencyPolicy()
+	if policy == config.KeyTransparencyOff || len(keys) == 0 {
+		return nil
+	}
+
+	var unverified []string
+	for addr, resp := range keys {
+		if err := s.c.VerifyKeyTransparency(ctx, addr, resp); err != nil {
+			logger.Warn("cannot verify public key with key transparency", "email", addr, "error", err)
+			unverified = append(unverified, addr)
+		}
+	}
+
+	if len(unverified) > 0 && policy == config.KeyTransparencyStrict {
+		sort.Strings(unverified)
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      fmt.Sprintf("cannot verify public key of %v with key transparency", strings.Join(unverified, ", ")),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package smtp
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// pgpMIMEPart is a part of a message, kept to build PGP/MIME messages.
+type pgpMIMEPart struct {
+	header message.Header
+	body   []byte
+}
+
+// protectedHeaderFields are the header fields copied into the encrypted part
+// of PGP/MIME messages when protected headers are enabled.
+var protectedHeaderFields = []string{
+	"Subject", "From", "To", "Cc", "Reply-To", "Date", "Message-Id",
+	"In-Reply-To", "References",
+}
+
+func randomBoundary() (string, error) {
+	var b [15]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// formatPGPMIME assembles the parts of a message into a multipart/signed
+// entity, as described in RFC 3156 section 5. The result is meant to be
+// encrypted and wrapped into a multipart/encrypted message by ProtonMail.
+//
+// If protectHeaders is set, the header fields of the outer message are
+// copied into the signed part using the "protected-headers" scheme, so that
+// they can be verified by the recipient.
+func formatPGPMIME(outer *mail.Header, parts []pgpMIMEPart, protectHeaders bool, signer *openpgp.Entity) ([]byte, error) {
+	var h message.Header
+	params := make(map[string]string)
+	if protectHeaders {
+		params["protected-headers"] = "v1"
+		for _, k := range protectedHeaderFields {
+			fields := outer.FieldsByKey(k)
+			for fields.Next() {
+				h.Add(k, fields.Value())
+			}
+		}
+	}
+	h.SetContentType("multipart/mixed", params)
+
+	var content bytes.Buffer
+	w, err := message.CreateWriter(&content, h)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range parts {
+		pw, err := w.CreatePart(p.header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := pw.Write(p.body); err != nil {
+			return nil, err
+		}
+		if err := pw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	// The content is already in canonical form: go-message uses CRLF line
+	// endings and 7-bit transfer encodings
+	var sig bytes.Buffer
+	config := &packet.Config{DefaultHash: crypto.SHA256}
+	if err := openpgp.ArmoredDetachSign(&sig, signer, bytes.NewReader(content.Bytes()), config); err != nil {
+		return nil, fmt.Errorf("cannot sign message: %v", err)
+	}
+
+	boundary, err := randomBoundary()
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Content-Type: multipart/signed; boundary=%q;\r\n micalg=pgp-sha256; protocol=\"application/pgp-signature\"\r\n\r\n", boundary)
+	fmt.Fprintf(&b, "--%v\r\n", boundary)
+	b.Write(content.Bytes())
+	fmt.Fprintf(&b, "\r\n--%v\r\n", boundary)
+	b.WriteString("Content-Type: application/pgp-signature; name=\"signature.asc\"\r\n")
+	b.WriteString("Content-Description: OpenPGP digital signature\r\n\r\n")
+	b.Write(sig.Bytes())
+	fmt.Fprintf(&b, "\r\n--%v--\r\n", boundary)
+	return b.Bytes(), nil
+}
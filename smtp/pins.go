@@ -0,0 +1,130 @@
+package smtp
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/emersion/hydroxide/carddav"
+	"github.com/emersion/hydroxide/config"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func keyFingerprint(e *openpgp.Entity) string {
+	return fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:])
+}
+
+// contactKeys returns the keys pinned in the contact of a recipient, the way
+// the web client's "Trust key" does.
+func (s *session) contactKeys(ctx context.Context, email string) openpgp.EntityList {
+	if s.account.KeyPinningPolicy() == config.KeyPinningOff {
+		return nil
+	}
+
+	_, card, err := carddav.FindContact(ctx, s.c, email, s.privateKeys)
+	if err != nil {
+		logger.Warn("cannot read contact", "email", email, "error", err)
+		return nil
+	} else if card == nil {
+		return nil
+	}
+	keys, err := carddav.PinnedKeys(card, email)
+	if err != nil {
+		logger.Warn("cannot read pinned keys", "email", email, "error", err)
+		return nil
+	}
+	return keys
+}
+
+// selectPinnedKey picks the key used to encrypt to a recipient whose contact
+// has pinned keys: the first pinned key also returned by ProtonMail, or the
+// first pinned key if ProtonMail hasn't returned any. matched is false if
+// none of the keys returned by ProtonMail is pinned. If so, a pinned key is
+// still returned for external recipients, but not for ProtonMail users,
+// which can only be sent messages encrypted with their current keys.
+func selectPinnedKey(pinned openpgp.EntityList, resp *protonmail.PublicKeyResp) (key *openpgp.Entity, matched bool) {
+	if len(resp.Keys) == 0 {
+		return pinned[0], true
+	}
+
+	for _, e := range pinned {
+		for _, pub := range resp.Keys {
+			pe, err := pub.Entity()
+			if err == nil && keyFingerprint(pe) == keyFingerprint(e) {
+				return pe, true
+			}
+		}
+	}
+
+	if resp.RecipientType == protonmail.RecipientInternal {
+		return nil, false
+	}
+	return pinned[0], false
+}
+
+// checkContactPins returns an error if the keys of recipients don't match
+// the keys pinned in their contact and the account's policy is to block
+// such messages.
+func (s *session) checkContactPins(mismatched []string) error {
+	if len(mismatched) == 0 || s.account.KeyPinningPolicy() != config.KeyPinningBlock {
+		return nil
+	}
+	sort.Strings(mismatched)
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      fmt.Sprintf("public key of %v doesn't match the key pinned in the contact, check it and run hydroxide pins trust", strings.Join(mismatched, ", ")),
+	}
+}
+
+// checkKeyPins compares the keys of external recipients with the keys used
+// for previous messages. Keys of new recipients are pinned. If a key has
+// changed, a warning is logged, and an error is returned if the account's
+// policy is to block such messages.
+func (s *session) checkKeyPins(keys map[string]*openpgp.Entity) error {
+	policy := s.account.KeyPinningPolicy()
+	if policy == config.KeyPinningOff || len(keys) == 0 {
+		return nil
+	}
+
+	pins, err := config.LoadPins(s.username)
+	if err != nil {
+		return fmt.Errorf("cannot load key pins: %v", err)
+	}
+
+	var changed []string
+	added := false
+	for addr, e := range keys {
+		k := config.PinKey(addr)
+		fingerprint := keyFingerprint(e)
+		pin, ok := pins[k]
+		if !ok {
+			pins[k] = &config.KeyPin{Fingerprint: fingerprint, FirstSeen: time.Now()}
+			added = true
+		} else if pin.Fingerprint != fingerprint {
+			logger.Warn("pinned key has changed", "email", addr, "pinned", pin.Fingerprint, "fingerprint", fingerprint)
+			changed = append(changed, addr)
+		}
+	}
+
+	if added {
+		if err := config.SavePins(s.username, pins); err != nil {
+			logger.Warn("cannot save key pins", "error", err)
+		}
+	}
+
+	if len(changed) > 0 && policy == config.KeyPinningBlock {
+		sort.Strings(changed)
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      fmt.Sprintf("public key of %v has changed, check it and run hydroxide pins update", strings.Join(changed, ", ")),
+		}
+	}
+	return nil
+}
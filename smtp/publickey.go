@@ -0,0 +1,59 @@
+package smtp
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-message/mail"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+
+	"github.com/emersion/hydroxide/config"
+)
+
+// attachPublicKeyHeader is the header field overriding the account's
+// attach-public-key setting for a message: "yes" or "no". It's removed from
+// outgoing messages.
+const attachPublicKeyHeader = "X-Hydroxide-Attach-Public-Key"
+
+// publicKeyType is the MIME type of attached public keys.
+const publicKeyType = "application/pgp-keys"
+
+// popAttachPublicKey removes the attach-public-key header field from h and
+// returns whether the sender's public key should be attached to the message.
+func popAttachPublicKey(h *mail.Header, account *config.Account) (bool, error) {
+	v := strings.ToLower(strings.TrimSpace(h.Get(attachPublicKeyHeader)))
+	h.Del(attachPublicKeyHeader)
+
+	switch v {
+	case "":
+		return account.AttachPublicKey, nil
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid %v header field: expected yes or no", attachPublicKeyHeader)
+	}
+}
+
+// publicKeyAttachment returns the file name and the armored contents of the
+// attachment containing the public key of a sender address. The file name
+// follows the official clients' convention.
+func publicKeyAttachment(email string, key *openpgp.Entity) (string, []byte, error) {
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := key.Serialize(w); err != nil {
+		return "", nil, err
+	}
+	if err := w.Close(); err != nil {
+		return "", nil, err
+	}
+
+	name := fmt.Sprintf("publickey - %v - 0x%08X.asc", email, uint32(key.PrimaryKey.KeyId))
+	return name, buf.Bytes(), nil
+}
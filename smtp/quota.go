@@ -0,0 +1,113 @@
+package smtp
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// Options contains settings of the SMTP backend.
+type Options struct {
+	// Maximum number of messages sent by an account per hour and per day, zero
+	// means no limit
+	HourlyLimit, DailyLimit int
+	// Maximum number of recipients per message, zero means no limit
+	MaxRecipients int
+	// Remove header fields leaking information about the sender's device or
+	// network before sending messages
+	ScrubHeaders bool
+}
+
+// defaultBlockDelay is how long sending is blocked after ProtonMail has
+// refused a message because of its sending limits, if it doesn't say when to
+// try again.
+const defaultBlockDelay = time.Hour
+
+// quota keeps track of the messages sent by an account.
+type quota struct {
+	locker sync.Mutex
+	sent   []time.Time
+	// Set when the API refuses to send more messages
+	blockedUntil time.Time
+}
+
+func errSendLimit(msg string) *smtp.SMTPError {
+	return &smtp.SMTPError{
+		Code:         454,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      msg + ", try again later",
+	}
+}
+
+var errTooManyRecipients = &smtp.SMTPError{
+	Code:         452,
+	EnhancedCode: smtp.EnhancedCode{4, 5, 3},
+	Message:      "Too many recipients, send the rest in another message",
+}
+
+func (q *quota) prune(now time.Time) {
+	i := 0
+	for i < len(q.sent) && now.Sub(q.sent[i]) >= 24*time.Hour {
+		i++
+	}
+	q.sent = q.sent[i:]
+}
+
+// check returns an error if sending a new message would exceed the limits.
+func (q *quota) check(options *Options) error {
+	q.locker.Lock()
+	defer q.locker.Unlock()
+
+	now := time.Now()
+	if now.Before(q.blockedUntil) {
+		return errSendLimit(fmt.Sprintf("ProtonMail sending limit reached until %v", q.blockedUntil.Format(time.Kitchen)))
+	}
+
+	q.prune(now)
+	if options.DailyLimit > 0 && len(q.sent) >= options.DailyLimit {
+		return errSendLimit(fmt.Sprintf("Daily limit of %v messages reached", options.DailyLimit))
+	}
+	if options.HourlyLimit > 0 {
+		n := 0
+		for _, t := range q.sent {
+			if now.Sub(t) < time.Hour {
+				n++
+			}
+		}
+		if n >= options.HourlyLimit {
+			return errSendLimit(fmt.Sprintf("Hourly limit of %v messages reached", options.HourlyLimit))
+		}
+	}
+	return nil
+}
+
+func (q *quota) record() {
+	q.locker.Lock()
+	q.sent = append(q.sent, time.Now())
+	q.locker.Unlock()
+}
+
+// apiError converts an error returned by the API into a temporary SMTP error
+// if ProtonMail has rejected the message because of its sending limits.
+func (q *quota) apiError(err error) error {
+	apiErr, ok := err.(*protonmail.APIError)
+	if !ok || apiErr.StatusCode != http.StatusTooManyRequests {
+		return err
+	}
+
+	d := apiErr.RetryAfter
+	if d < 0 {
+		d = defaultBlockDelay
+	}
+
+	q.locker.Lock()
+	q.blockedUntil = time.Now().Add(d)
+	q.locker.Unlock()
+
+	return errSendLimit("ProtonMail sending limit reached: " + apiErr.Message)
+}
@@ -0,0 +1,67 @@
+package smtp
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+func TestQuotaAPIError(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		limited bool
+		blocked time.Duration
+	}{
+		{
+			name: "not an API error",
+			err:  errors.New("connection reset"),
+		},
+		{
+			name: "other status",
+			err:  &protonmail.APIError{StatusCode: http.StatusUnprocessableEntity, RetryAfter: -1},
+		},
+		{
+			name:    "no Retry-After",
+			err:     &protonmail.APIError{StatusCode: http.StatusTooManyRequests, RetryAfter: -1},
+			limited: true,
+			blocked: defaultBlockDelay,
+		},
+		{
+			name:    "Retry-After",
+			err:     &protonmail.APIError{StatusCode: http.StatusTooManyRequests, RetryAfter: 10 * time.Minute},
+			limited: true,
+			blocked: 10 * time.Minute,
+		},
+		{
+			name:    "retry now",
+			err:     &protonmail.APIError{StatusCode: http.StatusTooManyRequests, RetryAfter: 0},
+			limited: true,
+		},
+	}
+	for _, tc := range tests {
+		var q quota
+		before := time.Now()
+		err := q.apiError(tc.err)
+		if limited := err != tc.err; limited != tc.limited {
+			t.Errorf("%v: apiError() = %v, want sending limit error: %v", tc.name, err, tc.limited)
+		}
+
+		checkErr := q.check(&Options{})
+		if tc.blocked == 0 {
+			if checkErr != nil {
+				t.Errorf("%v: check() = %v, want nil", tc.name, checkErr)
+			}
+			continue
+		}
+		if checkErr == nil {
+			t.Errorf("%v: check() succeeded, want sending limit error", tc.name)
+		}
+		if d := q.blockedUntil.Sub(before); d < tc.blocked || d > tc.blocked+time.Minute {
+			t.Errorf("%v: blocked for %v, want %v", tc.name, d, tc.blocked)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package smtp
+
+import (
+	"fmt"
+	netmail "net/mail"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+)
+
+// scheduleHeader is the header field requesting a message to be sent later,
+// with ProtonMail's scheduled send. It contains a date, either in the format
+// of the Date header field or in RFC 3339 format. It's removed from outgoing
+// messages.
+const scheduleHeader = "X-Hydroxide-Schedule-At"
+
+// parseDateField parses a date in the format of the Date header field or in
+// RFC 3339 format.
+func parseDateField(s string) (time.Time, error) {
+	if t, err := netmail.ParseDate(s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// popSchedule removes the scheduled send header field from h and returns the
+// time it contains. It returns the zero time if the message should be sent
+// right away.
+func popSchedule(h *mail.Header, now time.Time) (time.Time, error) {
+	v := strings.TrimSpace(h.Get(scheduleHeader))
+	h.Del(scheduleHeader)
+	if v == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := parseDateField(v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %v header field: %v", scheduleHeader, err)
+	}
+	if !t.After(now) {
+		return time.Time{}, fmt.Errorf("invalid %v header field: %v is in the past", scheduleHeader, v)
+	}
+	return t, nil
+}
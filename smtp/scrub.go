@@ -0,0 +1,103 @@
+package smtp
+
+import (
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+)
+
+// scrubbedFields are header fields describing the sender's device or network,
+// which the web client doesn't send.
+var scrubbedFields = []string{
+	"User-Agent",
+	"X-Mailer",
+	"X-Newsreader",
+	"X-MimeOLE",
+	"X-Originating-IP",
+	"X-Originating-Host",
+	"X-Client-IP",
+	"X-Forwarded-For",
+}
+
+var ipRegexp = regexp.MustCompile(`\[?(?:IPv6:)?([0-9a-fA-F:.]*[0-9a-fA-F])\]?`)
+
+var privateNetworks []*net.IPNet
+
+func init() {
+	for _, s := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"} {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		privateNetworks = append(privateNetworks, n)
+	}
+}
+
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocalReceived checks whether a Received field has been added by a host on
+// the local network, e.g. a local MTA relaying to hydroxide.
+func isLocalReceived(v string) bool {
+	if strings.Contains(strings.ToLower(v), "localhost") {
+		return true
+	}
+	for _, m := range ipRegexp.FindAllStringSubmatch(v, -1) {
+		if ip := net.ParseIP(m[1]); ip != nil && isLocalIP(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocalDomain checks whether a domain doesn't identify a public host, e.g.
+// a machine hostname used by the MUA to generate message IDs.
+func isLocalDomain(domain string) bool {
+	domain = strings.Trim(domain, "[]")
+	if ip := net.ParseIP(strings.TrimPrefix(domain, "IPv6:")); ip != nil {
+		return true
+	}
+	domain = strings.ToLower(domain)
+	return !strings.Contains(domain, ".") || strings.HasSuffix(domain, ".local") || strings.HasSuffix(domain, ".lan") || strings.HasSuffix(domain, ".localdomain")
+}
+
+// scrubHeader removes or normalizes header fields which leak information about
+// the sender's device, network or location.
+func scrubHeader(h *mail.Header, from *mail.Address) {
+	for _, k := range scrubbedFields {
+		h.Del(k)
+	}
+
+	fields := h.FieldsByKey("Received")
+	for fields.Next() {
+		if isLocalReceived(fields.Value()) {
+			fields.Del()
+		}
+	}
+
+	// Don't leak the machine hostname in the message ID
+	if id, err := h.MessageID(); err == nil && id != "" {
+		if i := strings.LastIndexByte(id, '@'); i >= 0 && isLocalDomain(id[i+1:]) {
+			if j := strings.LastIndexByte(from.Address, '@'); j >= 0 {
+				h.Set("Message-Id", "<"+id[:i]+"@"+from.Address[j+1:]+">")
+			}
+		}
+	}
+
+	// Don't leak the time zone
+	if t, err := h.Date(); err == nil {
+		h.SetDate(t.In(time.UTC))
+	}
+}
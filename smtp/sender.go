@@ -0,0 +1,85 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/emersion/go-message/mail"
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// chooseSender returns the address a message is sent from: the address in
+// the From header field if it's one of the user's, otherwise the envelope
+// sender. In the latter case, from is rewritten to the envelope sender so that
+// the message header matches the address it's sent from.
+func (s *session) chooseSender(ctx context.Context, from *mail.Address) (*protonmail.Address, error) {
+	addr, err := s.findAddress(ctx, from.Address)
+	if err != nil {
+		return nil, err
+	}
+	if addr == nil && s.from != "" {
+		addr, err = s.findAddress(ctx, s.from)
+		if err != nil {
+			return nil, err
+		}
+		if addr != nil {
+			logger.Info("sender isn't one of the user's addresses, using the default one", "from", from.Address, "address", addr.Email)
+			from.Address = addr.Email
+		}
+	}
+	if addr == nil {
+		return nil, errors.New("unknown sender address")
+	}
+
+	if addr.Status != protonmail.AddressEnabled || addr.Send == protonmail.AddressSendDisabled {
+		return nil, fmt.Errorf("sender address %q is disabled", addr.Email)
+	}
+	if len(addr.Keys) == 0 {
+		return nil, errors.New("sender address has no private key")
+	}
+	return addr, nil
+}
+
+// primaryKey returns the key used to sign messages sent from an address.
+func primaryKey(addr *protonmail.Address) *protonmail.PrivateKey {
+	for _, key := range addr.Keys {
+		if key.Primary == 1 {
+			return key
+		}
+	}
+	return addr.Keys[0]
+}
+
+// senderKey returns the decrypted primary key of an address.
+func (s *session) senderKey(addr *protonmail.Address) (*openpgp.Entity, error) {
+	encryptedPrivateKey, err := primaryKey(addr).Entity()
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse sender private key: %v", err)
+	}
+	keyID := encryptedPrivateKey.PrimaryKey.KeyId
+
+	for _, e := range s.privateKeys {
+		if e.PrimaryKey.KeyId == keyID {
+			return e, nil
+		}
+	}
+
+	// The address may have been created after login
+	keys, err := s.c.UnlockAddress(addr)
+	if err != nil {
+		logger.Warn("cannot unlock address keys", "address", addr.Email, "error", err)
+		return nil, errors.New("sender address key hasn't been decrypted")
+	}
+	// The key ring is shared with other sessions and with the client, don't
+	// append to its backing array
+	s.privateKeys = append(append(openpgp.EntityList(nil), s.privateKeys...), keys...)
+	for _, e := range keys {
+		if e.PrimaryKey.KeyId == keyID {
+			return e, nil
+		}
+	}
+	return nil, errors.New("sender address key hasn't been decrypted")
+}
@@ -2,21 +2,36 @@ package smtp
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/emersion/go-message"
 	"github.com/emersion/go-message/mail"
 	"github.com/emersion/go-smtp"
 	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/openpgp/packet"
 
 	"github.com/emersion/hydroxide/auth"
+	"github.com/emersion/hydroxide/config"
+	"github.com/emersion/hydroxide/logging"
 	"github.com/emersion/hydroxide/protonmail"
 )
 
+// Timeouts for the API requests needed to log in and to send a message, so
+// that a stuck request doesn't block an SMTP connection forever.
+const (
+	loginTimeout = time.Minute
+	sendTimeout  = 10 * time.Minute
+)
+
+var logger = logging.New("smtp")
+
 func toPMAddressList(addresses []*mail.Address) []*protonmail.MessageAddress {
 	l := make([]*protonmail.MessageAddress, len(addresses))
 	for i, addr := range addresses {
@@ -28,6 +43,14 @@ func toPMAddressList(addresses []*mail.Address) []*protonmail.MessageAddress {
 	return l
 }
 
+// asciiAddressList converts internationalized domains in addresses to their
+// ASCII form, as expected by the API.
+func asciiAddressList(addresses []*mail.Address) {
+	for _, addr := range addresses {
+		addr.Address = protonmail.ASCIIAddress(addr.Address)
+	}
+}
+
 func formatHeader(h mail.Header) string {
 	var b bytes.Buffer
 	fields := h.Fields()
@@ -38,14 +61,22 @@ func formatHeader(h mail.Header) string {
 }
 
 type session struct {
+	username     string
 	c            *protonmail.Client
 	u            *protonmail.User
 	privateKeys  openpgp.EntityList
 	addrs        []*protonmail.Address
+	account      *config.Account
+	options      *Options
+	quota        *quota
 	allReceivers []string
+	requireTLS   bool
+	from         string // envelope sender
 }
 
 func (s *session) Mail(from string, options smtp.MailOptions) error {
+	s.requireTLS = options.RequireTLS
+	s.from = protonmail.ASCIIAddress(from)
 	return nil
 }
 
@@ -54,9 +85,13 @@ func (s *session) Rcpt(to string) error {
 		return nil
 	}
 
+	if s.options.MaxRecipients > 0 && len(s.allReceivers) >= s.options.MaxRecipients {
+		return errTooManyRecipients
+	}
+
 	// Seems like github.com/emersion/go-smtp/conn.go:487 removes marks on message
 	// "to" is added into allReceivers blindly
-	s.allReceivers = append(s.allReceivers, to)
+	s.allReceivers = append(s.allReceivers, protonmail.ASCIIAddress(to))
 	return nil
 }
 
@@ -78,7 +113,59 @@ func (s *session) bccFromRest(ignoreMails []*mail.Address) []*mail.Address {
 	return final
 }
 
-func (s *session) Data(r io.Reader) error {
+// findAddress looks up one of the user's addresses by email. If the address
+// is unknown, the list is refreshed in case it's been created since login
+// (e.g. a freshly activated pm.me address).
+func (s *session) findAddress(ctx context.Context, email string) (*protonmail.Address, error) {
+	find := func() *protonmail.Address {
+		for _, addr := range s.addrs {
+			if strings.EqualFold(protonmail.ASCIIAddress(addr.Email), protonmail.ASCIIAddress(email)) {
+				return addr
+			}
+		}
+		return nil
+	}
+
+	if addr := find(); addr != nil {
+		return addr, nil
+	}
+
+	addrs, err := s.c.ListAddresses(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.addrs = addrs
+	return find(), nil
+}
+
+// checkRequireTLS refuses messages to recipients outside of ProtonMail when
+// REQUIRETLS is requested. Proton relays them over SMTP without guaranteeing
+// a verified TLS connection, and even encrypted messages leak their header,
+// including the subject.
+func checkRequireTLS(plaintextRecipients []string, externalRecipients map[string]*openpgp.Entity) error {
+	relayed := append([]string(nil), plaintextRecipients...)
+	for rcpt := range externalRecipients {
+		relayed = append(relayed, rcpt)
+	}
+	if len(relayed) == 0 {
+		return nil
+	}
+	sort.Strings(relayed)
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 30},
+		Message:      fmt.Sprintf("REQUIRETLS: cannot guarantee TLS-verified delivery to external recipients %v", strings.Join(relayed, ", ")),
+	}
+}
+
+func (s *session) Data(r io.Reader) (err error) {
+	if err := s.quota.check(s.options); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+
 	// Parse the incoming MIME message header
 	mr, err := mail.CreateReader(r)
 	if err != nil {
@@ -90,6 +177,9 @@ func (s *session) Data(r io.Reader) error {
 	toList, _ := mr.Header.AddressList("To")
 	ccList, _ := mr.Header.AddressList("Cc")
 	bccList, _ := mr.Header.AddressList("Bcc")
+	for _, l := range [][]*mail.Address{fromList, toList, ccList, bccList} {
+		asciiAddressList(l)
+	}
 
 	if len(bccList) == 0 {
 		bccList = s.bccFromRest(append(toList, ccList...))
@@ -102,37 +192,63 @@ func (s *session) Data(r io.Reader) error {
 		return errors.New("no recipient specified")
 	}
 
-	rawFrom := fromList[0]
-	fromAddrStr := rawFrom.Address
-	var fromAddr *protonmail.Address
-	for _, addr := range s.addrs {
-		if strings.EqualFold(addr.Email, fromAddrStr) {
-			fromAddr = addr
-			break
-		}
+	recipients := make([]*mail.Address, 0, len(toList)+len(ccList)+len(bccList))
+	recipients = append(recipients, toList...)
+	recipients = append(recipients, ccList...)
+	recipients = append(recipients, bccList...)
+	if s.options.MaxRecipients > 0 && len(recipients) > s.options.MaxRecipients {
+		return errTooManyRecipients
 	}
-	if fromAddr == nil {
-		return errors.New("unknown sender address")
+
+	rawFrom := fromList[0]
+	headerFrom := rawFrom.Address
+	fromAddr, err := s.chooseSender(ctx, rawFrom)
+	if err != nil {
+		return err
 	}
-	if len(fromAddr.Keys) == 0 {
-		return errors.New("sender address has no private key")
+	if rawFrom.Address != headerFrom {
+		mr.Header.SetAddressList("From", []*mail.Address{rawFrom})
 	}
 
-	// TODO: get appropriate private key
-	encryptedPrivateKey, err := fromAddr.Keys[0].Entity()
+	privateKey, err := s.senderKey(fromAddr)
 	if err != nil {
-		return fmt.Errorf("cannot parse sender private key: %v", err)
+		return err
 	}
 
-	var privateKey *openpgp.Entity
-	for _, e := range s.privateKeys {
-		if e.PrimaryKey.KeyId == encryptedPrivateKey.PrimaryKey.KeyId {
-			privateKey = e
-			break
-		}
+	if s.options.ScrubHeaders {
+		scrubHeader(&mr.Header, rawFrom)
+	}
+	cleartextConfirmed := popCleartextConfirmation(&mr.Header)
+	discovery, err := popKeyDiscovery(&mr.Header, s.account)
+	if err != nil {
+		return err
+	}
+	// Messages to recipients whose key has been discovered are sent as
+	// PGP/MIME, so their attachments must be kept
+	pgpMIME := s.account.PGPMIME || discovery != config.KeyDiscoveryOff
+	attachPublicKey, err := popAttachPublicKey(&mr.Header, s.account)
+	if err != nil {
+		return err
 	}
-	if privateKey == nil {
-		return errors.New("sender address key hasn't been decrypted")
+	now := time.Now()
+	deliveryTime, err := popSchedule(&mr.Header, now)
+	if err != nil {
+		return err
+	}
+	sent := now
+	if !deliveryTime.IsZero() {
+		sent = deliveryTime
+	}
+	expiration, err := popExpiration(&mr.Header, sent)
+	if err != nil {
+		return err
+	}
+	deco, err := popDecoration(&mr.Header, fromAddr)
+	if err != nil {
+		return err
+	}
+	if err := s.setAutocrypt(&mr.Header, rawFrom.Address, privateKey); err != nil {
+		return fmt.Errorf("cannot create Autocrypt header: %v", err)
 	}
 
 	msg := &protonmail.Message{
@@ -148,8 +264,113 @@ func (s *session) Data(r io.Reader) error {
 		},
 	}
 
+	// Split internal recipients and plaintext recipients. This is done before
+	// creating the draft, so that refused messages don't reach the server.
+
+	var plaintextRecipients []string
+	encryptedRecipients := make(map[string]*openpgp.Entity)
+	externalRecipients := make(map[string]*openpgp.Entity)
+	discoveredRecipients := make(map[string]bool)
+	internalRecipients := make(map[string]*protonmail.PublicKeyResp)
+	contactPinnedRecipients := make(map[string]bool)
+	var mismatchedRecipients []string
+	for _, rcpt := range recipients {
+		resp, err := s.c.GetPublicKeys(ctx, rcpt.Address)
+		if err != nil {
+			return fmt.Errorf("cannot get public key for address %q: %v", rcpt.Address, err)
+		}
+
+		if pinned := s.contactKeys(ctx, rcpt.Address); len(pinned) > 0 {
+			pub, matched := selectPinnedKey(pinned, resp)
+			if !matched {
+				logger.Warn("public key doesn't match the keys pinned in the contact", "email", rcpt.Address)
+				mismatchedRecipients = append(mismatchedRecipients, rcpt.Address)
+			}
+			if pub != nil {
+				contactPinnedRecipients[rcpt.Address] = true
+				encryptedRecipients[rcpt.Address] = pub
+				if resp.RecipientType == protonmail.RecipientInternal {
+					internalRecipients[rcpt.Address] = resp
+				} else {
+					externalRecipients[rcpt.Address] = pub
+				}
+				continue
+			}
+		}
+
+		if len(resp.Keys) == 0 {
+			pub, err := s.autocryptKey(rcpt.Address)
+			if err != nil {
+				return err
+			}
+			if pub != nil {
+				encryptedRecipients[rcpt.Address] = pub
+				externalRecipients[rcpt.Address] = pub
+				continue
+			}
+			if pub := discoverKey(ctx, s.c.HTTPClient, discovery, rcpt.Address); pub != nil {
+				encryptedRecipients[rcpt.Address] = pub
+				externalRecipients[rcpt.Address] = pub
+				discoveredRecipients[rcpt.Address] = true
+				continue
+			}
+			plaintextRecipients = append(plaintextRecipients, rcpt.Address)
+			continue
+		}
+
+		// TODO: only keys with Send == 1
+		pub, err := resp.Keys[0].Entity()
+		if err != nil {
+			return err
+		}
+
+		encryptedRecipients[rcpt.Address] = pub
+		if resp.RecipientType == protonmail.RecipientExternal {
+			externalRecipients[rcpt.Address] = pub
+		} else {
+			internalRecipients[rcpt.Address] = resp
+		}
+	}
+
+	if err := s.checkContactPins(mismatchedRecipients); err != nil {
+		return err
+	}
+
+	if err := s.checkKeyTransparency(ctx, internalRecipients); err != nil {
+		return err
+	}
+
+	// Keys pinned in contacts take precedence over keys pinned locally
+	tofuRecipients := make(map[string]*openpgp.Entity)
+	for rcpt, pub := range externalRecipients {
+		if !contactPinnedRecipients[rcpt] {
+			tofuRecipients[rcpt] = pub
+		}
+	}
+	if err := s.checkKeyPins(tofuRecipients); err != nil {
+		return err
+	}
+
+	pgpMIMERecipients := make(map[string]*openpgp.Entity)
+	for rcpt, pub := range externalRecipients {
+		if s.account.PGPMIME || discoveredRecipients[rcpt] {
+			pgpMIMERecipients[rcpt] = pub
+			delete(encryptedRecipients, rcpt)
+		}
+	}
+
+	if s.requireTLS || s.account.RequireTLS {
+		if err := checkRequireTLS(plaintextRecipients, externalRecipients); err != nil {
+			return err
+		}
+	}
+
+	if err := s.checkCleartext(plaintextRecipients, cleartextConfirmed); err != nil {
+		return err
+	}
+
 	// Create an empty draft
-	log.Println("creating draft message")
+	logger.Debug("creating draft message")
 
 	plaintext, err := msg.Encrypt([]*openpgp.Entity{privateKey}, privateKey)
 	if err != nil {
@@ -160,29 +381,35 @@ func (s *session) Data(r io.Reader) error {
 	}
 
 	parentID := ""
-	inReplyToList, _ := mr.Header.AddressList("In-Reply-To")
-	if len(inReplyToList) == 1 {
-		inReplyTo := inReplyToList[0].Address
-
-		filter := protonmail.MessageFilter{
-			Limit:      1,
-			ExternalID: inReplyTo,
-			AddressID:  fromAddr.ID,
-		}
-		total, msgs, err := s.c.ListMessages(&filter)
-		if err != nil {
-			return err
-		}
-		if total == 1 {
-			parentID = msgs[0].ID
-		}
+	action := protonmail.MessageReply
+	parent, err := s.findParent(ctx, &mr.Header, fromAddr.ID)
+	if err != nil {
+		return err
+	}
+	if parent != nil {
+		parentID = parent.ID
+		action = replyAction(subject, parent, append(toList, ccList...))
 	}
 
-	msg, err = s.c.CreateDraftMessage(msg, parentID)
+	msg, err = s.c.CreateDraftMessage(ctx, msg, parentID, action)
 	if err != nil {
+		if quotaErr := s.quota.apiError(err); quotaErr != err {
+			return quotaErr
+		}
 		return fmt.Errorf("cannot create draft message: %v", err)
 	}
 
+	// Don't leave the draft behind if the message isn't sent
+	draftID := msg.ID
+	defer func() {
+		if err == nil {
+			return
+		}
+		if err := s.c.DeleteMessages(ctx, []string{draftID}); err != nil {
+			logger.Warn("cannot delete draft", "message", draftID, "error", err)
+		}
+	}()
+
 	// Parse the incoming MIME message body
 	// Save the message text into a buffer
 	// Upload attachments
@@ -190,6 +417,8 @@ func (s *session) Data(r io.Reader) error {
 	var body *bytes.Buffer
 	var bodyType string
 	attachmentKeys := make(map[string]*packet.EncryptedKey)
+	// Attachments are part of the encrypted body of PGP/MIME messages
+	var pgpMIMEAttachments []pgpMIMEPart
 
 	for {
 		p, err := mr.NextPart()
@@ -234,34 +463,26 @@ func (s *session) Data(r io.Reader) error {
 				// TODO: Header
 			}
 
-			attKey, err := att.GenerateKey([]*openpgp.Entity{privateKey})
-			if err != nil {
-				return fmt.Errorf("cannot generate attachment key: %v", err)
-			}
+			logger.Debug("uploading message attachment", "filename", filename)
 
-			log.Printf("uploading message attachment %q", filename)
-
-			pr, pw := io.Pipe()
-
-			go func() {
-				cleartext, err := att.Encrypt(pw, privateKey)
-				if err != nil {
-					pw.CloseWithError(err)
-					return
-				}
-				if _, err := io.Copy(cleartext, p.Body); err != nil {
-					pw.CloseWithError(err)
-					return
-				}
-				pw.CloseWithError(cleartext.Close())
-			}()
+			var attBody io.Reader = p.Body
+			var attData bytes.Buffer
+			if pgpMIME {
+				attBody = io.TeeReader(p.Body, &attData)
+			}
 
-			att, err = s.c.CreateAttachment(att, pr)
+			att, attKey, err := s.uploadAttachment(ctx, att, attBody, privateKey)
 			if err != nil {
-				return fmt.Errorf("cannot upload attachment: %v", err)
+				return err
 			}
 
 			attachmentKeys[att.ID] = attKey
+
+			if pgpMIME {
+				ah := h.Copy()
+				ah.Set("Content-Transfer-Encoding", "base64")
+				pgpMIMEAttachments = append(pgpMIMEAttachments, pgpMIMEPart{ah, attData.Bytes()})
+			}
 		}
 	}
 
@@ -269,8 +490,43 @@ func (s *session) Data(r io.Reader) error {
 		return errors.New("message doesn't contain a body part")
 	}
 
+	if attachPublicKey {
+		name, data, err := publicKeyAttachment(rawFrom.Address, privateKey)
+		if err != nil {
+			return fmt.Errorf("cannot export public key: %v", err)
+		}
+
+		logger.Debug("attaching public key", "filename", name)
+		att := &protonmail.Attachment{
+			MessageID: msg.ID,
+			Name:      name,
+			MIMEType:  publicKeyType,
+		}
+		att, attKey, err := s.uploadAttachment(ctx, att, bytes.NewReader(data), privateKey)
+		if err != nil {
+			return err
+		}
+		attachmentKeys[att.ID] = attKey
+
+		if pgpMIME {
+			var ah mail.AttachmentHeader
+			ah.SetContentType(publicKeyType, nil)
+			ah.SetFilename(name)
+			ah.Set("Content-Transfer-Encoding", "base64")
+			pgpMIMEAttachments = append(pgpMIMEAttachments, pgpMIMEPart{ah.Header, data})
+		}
+	}
+
+	if deco != nil {
+		b, err := deco.apply(bodyType, body.Bytes(), subject, rawFrom)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewBuffer(b)
+	}
+
 	// Encrypt the body and update the draft
-	log.Println("uploading message body")
+	logger.Debug("uploading message body")
 
 	msg.MIMEType = bodyType
 	plaintext, err = msg.Encrypt([]*openpgp.Entity{privateKey}, privateKey)
@@ -284,43 +540,23 @@ func (s *session) Data(r io.Reader) error {
 		return err
 	}
 
-	msg, err = s.c.UpdateDraftMessage(msg)
+	msg, err = s.c.UpdateDraftMessage(ctx, msg)
 	if err != nil {
 		return fmt.Errorf("cannot update draft message: %v", err)
 	}
 
-	// Split internal recipients and plaintext recipients
-
-	recipients := make([]*mail.Address, 0, len(toList)+len(ccList)+len(bccList))
-	recipients = append(recipients, toList...)
-	recipients = append(recipients, ccList...)
-	recipients = append(recipients, bccList...)
-
-	var plaintextRecipients []string
-	encryptedRecipients := make(map[string]*openpgp.Entity)
-	for _, rcpt := range recipients {
-		resp, err := s.c.GetPublicKeys(rcpt.Address)
-		if err != nil {
-			return fmt.Errorf("cannot get public key for address %q: %v", rcpt.Address, err)
-		}
-
-		if len(resp.Keys) == 0 {
-			plaintextRecipients = append(plaintextRecipients, rcpt.Address)
-			continue
-		}
-
-		// TODO: only keys with Send == 1
-		pub, err := resp.Keys[0].Entity()
-		if err != nil {
-			return err
-		}
-
-		encryptedRecipients[rcpt.Address] = pub
-	}
-
 	// Create and send the outgoing message
-	log.Println("sending message")
 	outgoing := &protonmail.OutgoingMessage{ID: msg.ID}
+	if deliveryTime.IsZero() {
+		logger.Info("sending message", "message", msg.ID)
+	} else {
+		logger.Info("scheduling message", "message", msg.ID, "delivery_time", deliveryTime.UTC().Format(time.RFC3339))
+		outgoing.DeliveryTime = deliveryTime.Unix()
+	}
+	if expiration > 0 {
+		logger.Info("message expires", "message", msg.ID, "expiration", expiration)
+		outgoing.ExpirationTime = int(expiration / time.Second)
+	}
 
 	if len(plaintextRecipients) > 0 {
 		plaintextSet := protonmail.NewMessagePackageSet(attachmentKeys)
@@ -375,16 +611,86 @@ func (s *session) Data(r io.Reader) error {
 		outgoing.Packages = append(outgoing.Packages, encryptedSet)
 	}
 
-	_, _, err = s.c.SendMessage(outgoing)
+	if len(pgpMIMERecipients) > 0 {
+		var bh message.Header
+		bh.SetContentType(bodyType, map[string]string{"charset": "utf-8"})
+		bh.Set("Content-Transfer-Encoding", "quoted-printable")
+		parts := append([]pgpMIMEPart{{bh, body.Bytes()}}, pgpMIMEAttachments...)
+
+		b, err := formatPGPMIME(&mr.Header, parts, s.account.ProtectedHeaders, privateKey)
+		if err != nil {
+			return err
+		}
+
+		// The message is signed by formatPGPMIME
+		pgpMIMESet := protonmail.NewMessagePackageSet(nil)
+		plaintext, err := pgpMIMESet.Encrypt("multipart/mixed", nil)
+		if err != nil {
+			return err
+		}
+		if _, err := plaintext.Write(b); err != nil {
+			plaintext.Close()
+			return err
+		}
+		if err := plaintext.Close(); err != nil {
+			return err
+		}
+
+		for rcpt, pub := range pgpMIMERecipients {
+			if _, err := pgpMIMESet.AddPGPMIME(rcpt, pub); err != nil {
+				return err
+			}
+		}
+
+		outgoing.Packages = append(outgoing.Packages, pgpMIMESet)
+	}
+
+	_, _, err = s.c.SendMessage(ctx, outgoing)
 	if err != nil {
+		if quotaErr := s.quota.apiError(err); quotaErr != err {
+			return quotaErr
+		}
 		return fmt.Errorf("cannot send message: %v", err)
 	}
+	s.quota.record()
 
 	return nil
 }
 
+// uploadAttachment encrypts and uploads an attachment of a draft. The
+// attachment and its key are returned.
+func (s *session) uploadAttachment(ctx context.Context, att *protonmail.Attachment, r io.Reader, privateKey *openpgp.Entity) (*protonmail.Attachment, *packet.EncryptedKey, error) {
+	attKey, err := att.GenerateKey([]*openpgp.Entity{privateKey})
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot generate attachment key: %v", err)
+	}
+
+	pr, pw := io.Pipe()
+
+	go func() {
+		cleartext, err := att.Encrypt(pw, privateKey)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(cleartext, r); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(cleartext.Close())
+	}()
+
+	att, err = s.c.CreateAttachment(ctx, att, pr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot upload attachment: %v", err)
+	}
+	return att, attKey, nil
+}
+
 func (s *session) Reset() {
 	s.allReceivers = nil
+	s.requireTLS = false
+	s.from = ""
 }
 
 func (s *session) Logout() error {
@@ -397,33 +703,64 @@ func (s *session) Logout() error {
 
 type backend struct {
 	sessions *auth.Manager
+	options  Options
+
+	locker sync.Mutex
+	quotas map[string]*quota
+}
+
+func (be *backend) quota(username string) *quota {
+	be.locker.Lock()
+	defer be.locker.Unlock()
+
+	q, ok := be.quotas[username]
+	if !ok {
+		q = new(quota)
+		be.quotas[username] = q
+	}
+	return q
 }
 
 func (be *backend) Login(_ *smtp.ConnectionState, username, password string) (smtp.Session, error) {
-	c, privateKeys, err := be.sessions.Auth(username, password)
+	ctx, cancel := context.WithTimeout(context.Background(), loginTimeout)
+	defer cancel()
+
+	c, privateKeys, err := be.sessions.Auth(ctx, username, password)
 	if err != nil {
 		return nil, err
 	}
 
-	u, err := c.GetCurrentUser()
+	u, err := c.GetCurrentUser(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	addrs, err := c.ListAddresses()
+	addrs, err := c.ListAddresses(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	account, err := config.LoadAccount(username)
+	if err != nil {
+		return nil, err
+	}
+	if !account.ProtocolEnabled(config.ProtocolSMTP) {
+		return nil, fmt.Errorf("SMTP is disabled for account %q", username)
+	}
+
 	// TODO: decrypt private keys in u.Addresses
 
-	log.Printf("%s logged in", username)
+	logger.Info("user logged in", "user", username)
 
 	return &session{
+		username:    username,
 		c:           c,
 		u:           u,
 		privateKeys: privateKeys,
 		addrs:       addrs,
+		account:     account,
+		options:     &be.options,
+		quota:       be.quota(username),
 	}, nil
 }
 
@@ -431,6 +768,13 @@ func (be *backend) AnonymousLogin(_ *smtp.ConnectionState) (smtp.Session, error)
 	return nil, smtp.ErrAuthRequired
 }
 
-func New(sessions *auth.Manager) smtp.Backend {
-	return &backend{sessions}
+func New(sessions *auth.Manager, options *Options) smtp.Backend {
+	be := &backend{
+		sessions: sessions,
+		quotas:   make(map[string]*quota),
+	}
+	if options != nil {
+		be.options = *options
+	}
+	return be
 }
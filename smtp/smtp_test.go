@@ -0,0 +1,51 @@
+package smtp
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestCheckRequireTLS(t *testing.T) {
+	tests := []struct {
+		name      string
+		plaintext []string
+		external  map[string]*openpgp.Entity
+		message   string
+	}{
+		{
+			name: "internal recipients only",
+		},
+		{
+			name:      "plaintext recipient",
+			plaintext: []string{"bob@example.org"},
+			message:   "REQUIRETLS: cannot guarantee TLS-verified delivery to external recipients bob@example.org",
+		},
+		{
+			name:     "encrypted external recipient",
+			external: map[string]*openpgp.Entity{"carol@example.org": nil},
+			message:  "REQUIRETLS: cannot guarantee TLS-verified delivery to external recipients carol@example.org",
+		},
+		{
+			name:      "both",
+			plaintext: []string{"dave@example.org"},
+			external:  map[string]*openpgp.Entity{"carol@example.org": nil},
+			message:   "REQUIRETLS: cannot guarantee TLS-verified delivery to external recipients carol@example.org, dave@example.org",
+		},
+	}
+
+	for _, tc := range tests {
+		err := checkRequireTLS(tc.plaintext, tc.external)
+		if tc.message == "" {
+			if err != nil {
+				t.Errorf("%v: checkRequireTLS() = %v, want nil", tc.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%v: checkRequireTLS() = nil, want an error", tc.name)
+		} else if err.Error() != tc.message {
+			t.Errorf("%v: checkRequireTLS() = %v, want %q", tc.name, err, tc.message)
+		}
+	}
+}
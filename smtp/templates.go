@@ -0,0 +1,185 @@
+package smtp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	htmltemplate "html/template"
+	"regexp"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/emersion/go-message/mail"
+
+	"github.com/emersion/hydroxide/config"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// Header fields selecting the template and the signature applied to the body
+// of an outgoing message. They're removed from outgoing messages.
+const (
+	templateHeader  = "X-Hydroxide-Template"
+	signatureHeader = "X-Hydroxide-Signature"
+)
+
+// protonSignature selects the signature of the sender address, as set in
+// ProtonMail's settings.
+const protonSignature = "proton"
+
+var (
+	htmlLineBreakRegexp = regexp.MustCompile(`(?is)<br\b[^>]*>|</(p|div|li|tr|h[1-6])\s*>`)
+	htmlTagRegexp       = regexp.MustCompile(`(?s)<[^>]*>`)
+	blankLinesRegexp    = regexp.MustCompile(`\n{3,}`)
+	htmlBodyEndRegexp   = regexp.MustCompile(`(?i)</body\s*>`)
+)
+
+func htmlToText(s string) string {
+	s = htmlLineBreakRegexp.ReplaceAllString(s, "\n")
+	s = htmlTagRegexp.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+	s = blankLinesRegexp.ReplaceAllString(s, "\n\n")
+	return strings.TrimSpace(s)
+}
+
+func textToHTML(s string) string {
+	s = html.EscapeString(strings.TrimSpace(s))
+	return strings.Replace(s, "\n", "<br>", -1)
+}
+
+// decoration is a template and a signature applied to a message body.
+type decoration struct {
+	hasTemplate                  bool
+	templateText, templateHTML   string
+	signatureText, signatureHTML string
+}
+
+// popDecoration removes the template and signature header fields from h and
+// loads the template and signature they refer to. It returns nil if the
+// message doesn't opt in.
+func popDecoration(h *mail.Header, addr *protonmail.Address) (*decoration, error) {
+	templateName := strings.TrimSpace(h.Get(templateHeader))
+	signatureName := strings.TrimSpace(h.Get(signatureHeader))
+	h.Del(templateHeader)
+	h.Del(signatureHeader)
+
+	if templateName == "" && signatureName == "" {
+		return nil, nil
+	}
+
+	d := new(decoration)
+	if templateName != "" {
+		var err error
+		d.templateText, d.templateHTML, err = config.LoadTemplate(templateName)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load template: %v", err)
+		}
+		d.hasTemplate = true
+	}
+
+	switch signatureName {
+	case "":
+		// No signature
+	case protonSignature:
+		if addr.Signature == "" {
+			return nil, fmt.Errorf("address %q has no signature", addr.Email)
+		}
+		d.signatureHTML = addr.Signature
+		d.signatureText = htmlToText(addr.Signature)
+	default:
+		text, html, err := config.LoadSignature(signatureName)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load signature: %v", err)
+		}
+		if text == "" {
+			text = htmlToText(html)
+		}
+		if html == "" {
+			html = textToHTML(text)
+		}
+		d.signatureText = strings.TrimSpace(text)
+		d.signatureHTML = html
+	}
+
+	return d, nil
+}
+
+// templateData is the data passed to templates. For HTML templates, Body and
+// Signature aren't escaped.
+type templateData struct {
+	Subject   string
+	From      *mail.Address
+	Body      interface{}
+	Signature interface{}
+}
+
+func appendSignature(isHTML bool, body []byte, sig string) []byte {
+	if sig == "" {
+		return body
+	}
+
+	if isHTML {
+		sig = `<div class="protonmail_signature_block">` + sig + `</div>`
+		if loc := htmlBodyEndRegexp.FindAllIndex(body, -1); len(loc) > 0 {
+			i := loc[len(loc)-1][0]
+			return append(append(append([]byte(nil), body[:i]...), sig...), body[i:]...)
+		}
+		return append(append([]byte(nil), body...), sig...)
+	}
+
+	nl := "\n"
+	if bytes.Contains(body, []byte("\r\n")) {
+		nl = "\r\n"
+		sig = strings.Replace(sig, "\n", nl, -1)
+	}
+	body = bytes.TrimRight(body, "\r\n")
+	return append(append([]byte(nil), body...), nl+nl+"-- "+nl+sig+nl...)
+}
+
+// apply renders the template and inserts the signature into a body of the
+// given type. Without a template, the signature is appended to the body.
+// Otherwise, templates place it with {{.Signature}}.
+func (d *decoration) apply(bodyType string, body []byte, subject string, from *mail.Address) ([]byte, error) {
+	isHTML := bodyType == "text/html"
+
+	sig := d.signatureText
+	if isHTML {
+		sig = d.signatureHTML
+	}
+
+	if !d.hasTemplate {
+		return appendSignature(isHTML, body, sig), nil
+	}
+
+	data := templateData{Subject: subject, From: from}
+	var b bytes.Buffer
+	if isHTML {
+		if d.templateHTML == "" {
+			return nil, errors.New("template has no HTML version")
+		}
+		t, err := htmltemplate.New("template").Parse(d.templateHTML)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse template: %v", err)
+		}
+		data.Body = htmltemplate.HTML(body)
+		data.Signature = htmltemplate.HTML(sig)
+		if err := t.Execute(&b, &data); err != nil {
+			return nil, fmt.Errorf("cannot execute template: %v", err)
+		}
+	} else {
+		if d.templateText == "" {
+			return nil, errors.New("template has no plain text version")
+		}
+		t, err := texttemplate.New("template").Parse(d.templateText)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse template: %v", err)
+		}
+		data.Body = string(body)
+		data.Signature = sig
+		if err := t.Execute(&b, &data); err != nil {
+			return nil, fmt.Errorf("cannot execute template: %v", err)
+		}
+	}
+
+	return b.Bytes(), nil
+}
@@ -0,0 +1,80 @@
+package smtp
+
+import (
+	"context"
+	"strings"
+
+	"github.com/emersion/go-message/mail"
+
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+// forwardPrefixes are the subject prefixes of forwarded messages added by
+// common clients.
+var forwardPrefixes = []string{"fwd:", "fw:", "tr:", "wg:", "rv:"}
+
+// parentMessageIDs returns the Message-IDs of the messages a message replies
+// to, from the closest one: the In-Reply-To field first, then the References
+// field from the last one.
+func parentMessageIDs(h *mail.Header) []string {
+	var ids []string
+	seen := make(map[string]bool)
+	add := func(id string) {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	inReplyTo, _ := h.MsgIDList("In-Reply-To")
+	for _, id := range inReplyTo {
+		add(id)
+	}
+	refs, _ := h.MsgIDList("References")
+	for i := len(refs) - 1; i >= 0; i-- {
+		add(refs[i])
+	}
+	return ids
+}
+
+// findParent looks up the message a message replies to, among the messages of
+// the sender address. It returns nil if the parent isn't found.
+func (s *session) findParent(ctx context.Context, h *mail.Header, addressID string) (*protonmail.Message, error) {
+	for _, id := range parentMessageIDs(h) {
+		filter := protonmail.MessageFilter{
+			Limit:      1,
+			ExternalID: id,
+			AddressID:  addressID,
+		}
+		total, msgs, err := s.c.ListMessages(ctx, &filter)
+		if err != nil {
+			return nil, err
+		}
+		if total > 0 && len(msgs) > 0 {
+			return msgs[0], nil
+		}
+	}
+	return nil, nil
+}
+
+// replyAction guesses whether a message is a reply, a reply to all or a
+// forward of its parent. Forwards are recognized by their subject, replies to
+// all by recipients other than the sender of the parent message.
+func replyAction(subject string, parent *protonmail.Message, recipients []*mail.Address) protonmail.MessageAction {
+	subject = strings.ToLower(strings.TrimSpace(subject))
+	for _, prefix := range forwardPrefixes {
+		if strings.HasPrefix(subject, prefix) {
+			return protonmail.MessageForward
+		}
+	}
+
+	if parent.Sender == nil {
+		return protonmail.MessageReply
+	}
+	for _, addr := range recipients {
+		if !strings.EqualFold(addr.Address, parent.Sender.Address) {
+			return protonmail.MessageReplyAll
+		}
+	}
+	return protonmail.MessageReply
+}
@@ -0,0 +1,206 @@
+// Package systemd implements socket activation and service notifications for
+// systemd services, see sd_listen_fds(3) and sd_notify(3).
+//
+// Both are no-ops when hydroxide isn't started by systemd.
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/hydroxide/logging"
+)
+
+var logger = logging.New("systemd")
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+var (
+	listenersOnce sync.Once
+	listeners     map[string]net.Listener
+	listenersErr  error
+)
+
+func loadListeners() {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners = make(map[string]net.Listener)
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	for i := 0; i < n; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			listenersErr = fmt.Errorf("systemd: invalid socket %q: %v", name, err)
+			return
+		}
+		listeners[name] = l
+	}
+}
+
+// Listener returns the socket passed by systemd with the given name, set with
+// the FileDescriptorName= option of the socket unit. Sockets of units named
+// after hydroxide-<name>.socket are also accepted. Nil is returned if there's
+// no such socket.
+func Listener(name string) (net.Listener, error) {
+	listenersOnce.Do(loadListeners)
+	if listenersErr != nil {
+		return nil, listenersErr
+	}
+	if l, ok := listeners[name]; ok {
+		return l, nil
+	}
+	return listeners["hydroxide-"+name+".socket"], nil
+}
+
+// Notify sends a state change to systemd, e.g. "READY=1". It does nothing if
+// the service isn't supervised by systemd.
+func Notify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if strings.HasPrefix(addr, "@") {
+		// Abstract socket
+		addr = "\x00" + addr[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("systemd: cannot connect to notification socket: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("systemd: cannot send notification: %v", err)
+	}
+	return nil
+}
+
+// Ready tells systemd that the service has started.
+func Ready() error {
+	return Notify("READY=1")
+}
+
+// watchdogInterval returns the watchdog timeout configured with the
+// WatchdogSec= option of the service, or zero if disabled.
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+var (
+	watchedLock sync.Mutex
+	watched     []*watchedListener
+)
+
+// watchedListener records whether the server serving a listener still
+// accepts connections.
+type watchedListener struct {
+	net.Listener
+
+	lock      sync.Mutex
+	accepting int
+	accepted  time.Time
+}
+
+func (l *watchedListener) Accept() (net.Conn, error) {
+	l.lock.Lock()
+	l.accepting++
+	l.lock.Unlock()
+
+	c, err := l.Listener.Accept()
+
+	l.lock.Lock()
+	l.accepting--
+	l.accepted = time.Now()
+	l.lock.Unlock()
+	return c, err
+}
+
+// alive checks whether the serve loop is waiting for a connection, or has
+// accepted one since the given time. Servers accept the next connection right
+// after handing one over, so a loop which does neither is stuck.
+func (l *watchedListener) alive(since time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.accepting > 0 || l.accepted.After(since)
+}
+
+// Watch wraps a listener so that the watchdog is only pinged while the server
+// serving it accepts connections. The listener is returned as-is if the
+// watchdog is disabled.
+func Watch(l net.Listener) net.Listener {
+	if watchdogInterval() == 0 {
+		return l
+	}
+
+	wl := &watchedListener{Listener: l, accepted: time.Now()}
+	watchedLock.Lock()
+	watched = append(watched, wl)
+	watchedLock.Unlock()
+	return wl
+}
+
+// checkListeners returns an error if a watched listener isn't served anymore.
+func checkListeners(since time.Time) error {
+	watchedLock.Lock()
+	defer watchedLock.Unlock()
+	for _, l := range watched {
+		if !l.alive(since) {
+			return fmt.Errorf("server listening on %v doesn't accept connections", l.Addr())
+		}
+	}
+	return nil
+}
+
+// StartWatchdog pings the systemd watchdog as long as the servers of the
+// listeners returned by Watch accept connections: the service is restarted if
+// one of them hangs.
+func StartWatchdog() {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+
+	go func() {
+		t := time.NewTicker(interval / 2)
+		defer t.Stop()
+		prev := time.Now()
+		for now := range t.C {
+			if err := checkListeners(prev); err != nil {
+				logger.Error("not pinging the watchdog", "error", err)
+			} else if err := Notify("WATCHDOG=1"); err != nil {
+				logger.Warn("cannot ping the watchdog", "error", err)
+			}
+			prev = now
+		}
+	}()
+}
@@ -0,0 +1,60 @@
+package systemd
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// blockingListener is a listener whose Accept blocks until a connection is
+// sent on conns.
+type blockingListener struct {
+	net.Listener
+	conns chan net.Conn
+}
+
+func (l *blockingListener) Accept() (net.Conn, error) {
+	return <-l.conns, nil
+}
+
+func TestWatchedListenerAlive(t *testing.T) {
+	start := time.Now()
+
+	tests := []struct {
+		name      string
+		accepting bool
+		accepted  time.Time
+		alive     bool
+	}{
+		{name: "waiting for a connection", accepting: true, accepted: start.Add(-time.Hour), alive: true},
+		{name: "accepted recently", accepted: start.Add(time.Second), alive: true},
+		{name: "stuck", accepted: start.Add(-time.Second), alive: false},
+	}
+	for _, tc := range tests {
+		bl := &blockingListener{conns: make(chan net.Conn)}
+		l := &watchedListener{Listener: bl, accepted: tc.accepted}
+
+		done := make(chan struct{})
+		if tc.accepting {
+			go func() {
+				l.Accept()
+				close(done)
+			}()
+			for !l.alive(time.Now()) {
+				time.Sleep(time.Millisecond)
+			}
+		}
+
+		if alive := l.alive(start); alive != tc.alive {
+			t.Errorf("%v: alive() = %v, want %v", tc.name, alive, tc.alive)
+		}
+
+		if tc.accepting {
+			bl.conns <- nil
+			<-done
+			if !l.alive(start) {
+				t.Errorf("%v: alive() = false after accepting a connection", tc.name)
+			}
+		}
+	}
+}
@@ -0,0 +1,505 @@
+// Package webdav exposes the user's Proton Drive over WebDAV (RFC 4918).
+//
+// Names, keys and contents of files are decrypted on the fly. For now, the
+// drive is read-only: methods which would change it are rejected.
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-webdav"
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/emersion/hydroxide/logging"
+	"github.com/emersion/hydroxide/protonmail"
+)
+
+var logger = logging.New("webdav")
+
+const (
+	childrenPageSize = 150
+	blocksPageSize   = 50
+)
+
+// requestTimeout bounds the time spent on API requests needed by a single
+// filesystem operation.
+const requestTimeout = time.Minute
+
+// childrenTTL is the time during which the contents of a folder are cached.
+const childrenTTL = 30 * time.Second
+
+// node is a file or a folder whose name has been decrypted.
+type node struct {
+	link      *protonmail.Link
+	name      string
+	parentKey *openpgp.Entity
+
+	// Set after the node key has been unlocked
+	key   *openpgp.Entity
+	xattr *protonmail.LinkXAttr
+}
+
+type folder struct {
+	children []*node
+	fetched  time.Time
+}
+
+type fileSystem struct {
+	c           *protonmail.Client
+	privateKeys openpgp.EntityList
+
+	locker  sync.Mutex
+	shareID string
+	root    *node
+	folders map[string]*folder // by link ID
+}
+
+func notExist(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *fileSystem) init(ctx context.Context) error {
+	fs.locker.Lock()
+	defer fs.locker.Unlock()
+
+	if fs.root != nil {
+		return nil
+	}
+
+	shares, err := fs.c.ListShares(ctx)
+	if err != nil {
+		return err
+	}
+	var shareID string
+	for _, share := range shares {
+		if share.Type == protonmail.ShareMain && share.State == protonmail.ShareActive {
+			shareID = share.ShareID
+			break
+		}
+	}
+	if shareID == "" {
+		return fmt.Errorf("hydroxide/webdav: no drive found")
+	}
+
+	share, err := fs.c.GetShare(ctx, shareID)
+	if err != nil {
+		return err
+	}
+	shareKey, err := share.Unlock(fs.privateKeys)
+	if err != nil {
+		return fmt.Errorf("cannot unlock share key: %v", err)
+	}
+
+	link, err := fs.c.GetLink(ctx, shareID, share.LinkID)
+	if err != nil {
+		return err
+	}
+
+	fs.shareID = shareID
+	fs.root = &node{link: link, parentKey: shareKey}
+	return nil
+}
+
+// unlock decrypts the node key and the extended attributes of a node.
+func (fs *fileSystem) unlock(n *node) (*openpgp.Entity, error) {
+	fs.locker.Lock()
+	defer fs.locker.Unlock()
+
+	if n.key != nil {
+		return n.key, nil
+	}
+
+	key, err := n.link.UnlockNodeKey(openpgp.EntityList{n.parentKey})
+	if err != nil {
+		return nil, fmt.Errorf("cannot unlock node key: %v", err)
+	}
+	xattr, err := n.link.DecryptXAttr(openpgp.EntityList{key})
+	if err != nil {
+		logger.Warn("cannot decrypt link attributes", "link", n.link.LinkID, "error", err)
+	}
+
+	n.key = key
+	n.xattr = xattr
+	return key, nil
+}
+
+func (fs *fileSystem) children(ctx context.Context, n *node) ([]*node, error) {
+	linkID := n.link.LinkID
+
+	fs.locker.Lock()
+	f, ok := fs.folders[linkID]
+	fs.locker.Unlock()
+	if ok && time.Since(f.fetched) < childrenTTL {
+		return f.children, nil
+	}
+
+	key, err := fs.unlock(n)
+	if err != nil {
+		return nil, err
+	}
+
+	var children []*node
+	for page := 0; ; page++ {
+		links, err := fs.c.ListChildren(ctx, fs.shareID, linkID, page, childrenPageSize)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, link := range links {
+			if link.State != protonmail.LinkActive {
+				continue
+			}
+			name, err := link.DecryptName(openpgp.EntityList{key})
+			if err != nil {
+				logger.Warn("cannot decrypt link name", "link", link.LinkID, "error", err)
+				continue
+			}
+			children = append(children, &node{link: link, name: name, parentKey: key})
+		}
+
+		if len(links) < childrenPageSize {
+			break
+		}
+	}
+
+	fs.locker.Lock()
+	fs.folders[linkID] = &folder{children: children, fetched: time.Now()}
+	fs.locker.Unlock()
+	return children, nil
+}
+
+func (fs *fileSystem) lookup(ctx context.Context, name string) (*node, error) {
+	if err := fs.init(ctx); err != nil {
+		return nil, err
+	}
+
+	n := fs.root
+	for _, part := range strings.Split(strings.Trim(path.Clean(name), "/"), "/") {
+		if part == "" {
+			continue
+		}
+		if n.link.Type != protonmail.LinkFolder {
+			return nil, notExist("stat", name)
+		}
+
+		children, err := fs.children(ctx, n)
+		if err != nil {
+			return nil, err
+		}
+
+		var child *node
+		for _, c := range children {
+			if c.name == part {
+				child = c
+				break
+			}
+		}
+		if child == nil {
+			return nil, notExist("stat", name)
+		}
+		n = child
+	}
+	return n, nil
+}
+
+func (fs *fileSystem) fileInfo(p string, n *node) (*webdav.FileInfo, error) {
+	link := n.link
+	fi := &webdav.FileInfo{
+		Path:    p,
+		ModTime: link.ModifyTime.Time(),
+		IsDir:   link.Type == protonmail.LinkFolder,
+	}
+	if fi.IsDir {
+		return fi, nil
+	}
+
+	// The plaintext size is only known from the extended attributes,
+	// otherwise the encrypted size is reported
+	if _, err := fs.unlock(n); err != nil {
+		return nil, err
+	}
+	fi.Size = link.Size
+	if n.xattr != nil {
+		fi.Size = n.xattr.Common.Size
+		if t, err := time.Parse(time.RFC3339, n.xattr.Common.ModificationTime); err == nil {
+			fi.ModTime = t
+		}
+	}
+	fi.MIMEType = link.MIMEType
+	if link.FileProperties != nil && link.FileProperties.ActiveRevision != nil {
+		fi.ETag = link.FileProperties.ActiveRevision.ID
+	}
+	return fi, nil
+}
+
+func (fs *fileSystem) Open(name string) (io.ReadCloser, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	n, err := fs.lookup(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if n.link.Type != protonmail.LinkFile {
+		return nil, fmt.Errorf("hydroxide/webdav: %q is a folder", name)
+	}
+	props := n.link.FileProperties
+	if props == nil || props.ActiveRevision == nil {
+		return nil, fmt.Errorf("hydroxide/webdav: %q has no content", name)
+	}
+
+	key, err := fs.unlock(n)
+	if err != nil {
+		return nil, err
+	}
+	return &fileReader{
+		fs:         fs,
+		link:       n.link,
+		key:        key,
+		revisionID: props.ActiveRevision.ID,
+		nextIndex:  1,
+	}, nil
+}
+
+// sizeUnknown returns true if name is a file whose plaintext size isn't
+// known. An error is reported as false, it'll be returned by the WebDAV
+// handler.
+func (fs *fileSystem) sizeUnknown(name string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	n, err := fs.lookup(ctx, name)
+	if err != nil || n.link.Type != protonmail.LinkFile {
+		return false
+	}
+	if _, err := fs.unlock(n); err != nil {
+		return false
+	}
+	return n.xattr == nil
+}
+
+func (fs *fileSystem) Stat(name string) (*webdav.FileInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	n, err := fs.lookup(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.fileInfo(path.Clean(name), n)
+}
+
+func (fs *fileSystem) readdir(ctx context.Context, p string, n *node, recursive bool, l []webdav.FileInfo) ([]webdav.FileInfo, error) {
+	children, err := fs.children(ctx, n)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, child := range children {
+		childPath := path.Join(p, child.name)
+		fi, err := fs.fileInfo(childPath, child)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, *fi)
+
+		if recursive && fi.IsDir {
+			if l, err = fs.readdir(ctx, childPath, child, recursive, l); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return l, nil
+}
+
+func (fs *fileSystem) Readdir(name string, recursive bool) ([]webdav.FileInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	name = path.Clean(name)
+	n, err := fs.lookup(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := fs.fileInfo(name, n)
+	if err != nil {
+		return nil, err
+	}
+	// The folder itself comes first
+	l := []webdav.FileInfo{*fi}
+	if !fi.IsDir {
+		return l, nil
+	}
+	return fs.readdir(ctx, name, n, recursive, l)
+}
+
+func (fs *fileSystem) Create(name string) (io.WriteCloser, error) {
+	return nil, os.ErrPermission
+}
+
+func (fs *fileSystem) RemoveAll(name string) error {
+	return os.ErrPermission
+}
+
+func (fs *fileSystem) Mkdir(name string) error {
+	return os.ErrPermission
+}
+
+func (fs *fileSystem) Copy(name, dest string, recursive, overwrite bool) (created bool, err error) {
+	return false, os.ErrPermission
+}
+
+func (fs *fileSystem) MoveAll(name, dest string, overwrite bool) (created bool, err error) {
+	return false, os.ErrPermission
+}
+
+// fileReader downloads and decrypts the blocks of a file, one at a time.
+type fileReader struct {
+	fs         *fileSystem
+	link       *protonmail.Link
+	key        *openpgp.Entity
+	revisionID string
+
+	blocks    []*protonmail.Block
+	nextIndex int // index of the first block of the next page
+	done      bool
+
+	cur *bytes.Reader
+}
+
+func (r *fileReader) nextBlock() error {
+	if len(r.blocks) == 0 {
+		if r.done {
+			return io.EOF
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		rev, err := r.fs.c.GetRevision(ctx, r.fs.shareID, r.link.LinkID, r.revisionID, r.nextIndex, blocksPageSize)
+		cancel()
+		if err != nil {
+			return err
+		}
+		r.blocks = rev.Blocks
+		if len(rev.Blocks) < blocksPageSize {
+			r.done = true
+		}
+		if len(r.blocks) == 0 {
+			return io.EOF
+		}
+		r.nextIndex = r.blocks[len(r.blocks)-1].Index + 1
+	}
+
+	block := r.blocks[0]
+	r.blocks = r.blocks[1:]
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	body, err := r.fs.c.GetBlock(ctx, block)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	b, err := r.link.ReadBlock(body, block, openpgp.EntityList{r.key}, r.fs.privateKeys)
+	if err != nil {
+		return fmt.Errorf("cannot read block %v: %v", block.Index, err)
+	}
+	r.cur = bytes.NewReader(b)
+	return nil
+}
+
+func (r *fileReader) Read(b []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if err := r.nextBlock(); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := r.cur.Read(b)
+		if err == io.EOF {
+			r.cur = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *fileReader) Close() error {
+	r.cur = nil
+	return nil
+}
+
+// noLengthWriter removes the Content-Length header set by the WebDAV handler
+// from the size reported by Stat, for files whose size isn't known.
+type noLengthWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *noLengthWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.Header().Del("Content-Length")
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *noLengthWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+type handler struct {
+	webdav http.Handler
+	fs     *fileSystem
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPut, http.MethodDelete, "MKCOL", "COPY", "MOVE", "PROPPATCH":
+		http.Error(w, "hydroxide/webdav: the drive is read-only", http.StatusMethodNotAllowed)
+		return
+	case http.MethodGet, http.MethodHead:
+		if h.fs.sizeUnknown(req.URL.Path) {
+			nlw := &noLengthWriter{ResponseWriter: w}
+			h.webdav.ServeHTTP(nlw, req)
+			if !nlw.wroteHeader {
+				w.Header().Del("Content-Length")
+			}
+			return
+		}
+	}
+	h.webdav.ServeHTTP(w, req)
+}
+
+// NewHandler returns a WebDAV handler for the drive of a user. privateKeys
+// are the user's address keys, used to unlock the drive's keys and to check
+// the signatures of files.
+func NewHandler(c *protonmail.Client, privateKeys openpgp.EntityList) http.Handler {
+	if len(privateKeys) == 0 {
+		panic("hydroxide/webdav: no private key available")
+	}
+
+	fs := &fileSystem{
+		c:           c,
+		privateKeys: privateKeys,
+		folders:     make(map[string]*folder),
+	}
+	return &handler{webdav: &webdav.Handler{FileSystem: fs}, fs: fs}
+}